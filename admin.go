@@ -5,16 +5,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 
 	"github.com/jmoiron/sqlx/types"
 	"github.com/labstack/echo"
 )
 
 type configScript struct {
-	RootURL       string   `json:"rootURL"`
-	FromEmail     string   `json:"fromEmail"`
-	Messengers    []string `json:"messengers"`
-	MediaProvider string   `json:"media_provider"`
+	RootURL         string   `json:"rootURL"`
+	FromEmail       string   `json:"fromEmail"`
+	Messengers      []string `json:"messengers"`
+	MediaProvider   string   `json:"media_provider"`
+	TrackingDomains []string `json:"tracking_domains"`
 }
 
 // handleGetConfigScript returns general configuration as a Javascript
@@ -33,6 +35,12 @@ func handleGetConfigScript(c echo.Context) error {
 		j = json.NewEncoder(&b)
 	)
 
+	out.TrackingDomains = make([]string, 0, len(app.constants.TrackingDomains))
+	for d := range app.constants.TrackingDomains {
+		out.TrackingDomains = append(out.TrackingDomains, d)
+	}
+	sort.Strings(out.TrackingDomains)
+
 	b.Write([]byte(`var CONFIG = `))
 	_ = j.Encode(out)
 	return c.Blob(http.StatusOK, "application/javascript", b.Bytes())
@@ -67,3 +75,69 @@ func handleGetDashboardCounts(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, okResp{out})
 }
+
+// dbPoolStats represents the stats of the DB connection pool.
+type dbPoolStats struct {
+	MaxOpen           int     `json:"max_open"`
+	Open              int     `json:"open"`
+	InUse             int     `json:"in_use"`
+	Idle              int     `json:"idle"`
+	WaitCount         int64   `json:"wait_count"`
+	WaitDuration      float64 `json:"wait_duration"`
+	MaxIdleClosed     int64   `json:"max_idle_closed"`
+	MaxIdleTimeClosed int64   `json:"max_idle_time_closed"`
+	MaxLifetimeClosed int64   `json:"max_lifetime_closed"`
+}
+
+// messageRateStats represents the effective rate of campaign messages
+// across all workers and the interval (seconds) at which each worker sends.
+type messageRateStats struct {
+	PerSecond float64 `json:"per_second"`
+	PerMinute float64 `json:"per_minute"`
+	PerHour   float64 `json:"per_hour"`
+	PerDay    float64 `json:"per_day"`
+	Interval  float64 `json:"interval"`
+}
+
+// handleGetMessengerStatus returns the health and the push statistics
+// of the messengers since the app was started.
+func handleGetMessengerStatus(c echo.Context) error {
+	app := c.Get("app").(*App)
+	return c.JSON(http.StatusOK, okResp{app.manager.GetMessengerStatus()})
+}
+
+// handleGetMetrics returns the runtime metrics of the app. WaitDuration
+// is the total time (in seconds) spent waiting for DB connections.
+func handleGetMetrics(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		s   = app.db.Stats()
+	)
+
+	// The effective message rate across all workers.
+	var (
+		rate = app.manager.MessageRate()
+		msgs = messageRateStats{
+			PerSecond: rate,
+			PerMinute: rate * 60,
+			PerHour:   rate * 3600,
+			PerDay:    rate * 86400,
+			Interval:  app.manager.MessageInterval().Seconds(),
+		}
+	)
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		MessageRate messageRateStats `json:"message_rate"`
+		DB          dbPoolStats      `json:"db"`
+	}{msgs, dbPoolStats{
+		MaxOpen:           s.MaxOpenConnections,
+		Open:              s.OpenConnections,
+		InUse:             s.InUse,
+		Idle:              s.Idle,
+		WaitCount:         s.WaitCount,
+		WaitDuration:      s.WaitDuration.Seconds(),
+		MaxIdleClosed:     s.MaxIdleClosed,
+		MaxIdleTimeClosed: s.MaxIdleTimeClosed,
+		MaxLifetimeClosed: s.MaxLifetimeClosed,
+	}}})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+// campaignReview is the review of a campaign that's pending approval.
+type campaignReview struct {
+	Note string `json:"note"`
+}
+
+// requestCampaignApproval submits a campaign for approval on behalf of the
+// user of the request, who can't approve it.
+func requestCampaignApproval(c echo.Context, cm models.Campaign) error {
+	var (
+		app  = c.Get("app").(*App)
+		user = c.Get("user").(models.User)
+	)
+
+	res, err := app.queries.RequestCampaignApproval.Exec(cm.ID, user.ID)
+	if err != nil {
+		app.log.Printf("error submitting campaign for approval: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating campaign status: %s", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+	}
+
+	app.log.Printf("campaign (%s) submitted for approval by %s", cm.Name, user.Email)
+	return handleGetCampaigns(c)
+}
+
+// handleApproveCampaign approves a campaign that's pending approval, which
+// returns to a draft (or paused, if it has been started) that can be sent.
+func handleApproveCampaign(c echo.Context) error {
+	return reviewCampaign(c, true)
+}
+
+// handleRejectCampaign rejects a campaign that's pending approval with
+// a note, which returns to a draft (or paused, if it has been started).
+func handleRejectCampaign(c echo.Context) error {
+	return reviewCampaign(c, false)
+}
+
+// reviewCampaign approves or rejects a campaign that's pending approval.
+// Campaigns can't be reviewed by the users who submitted them.
+func reviewCampaign(c echo.Context, approve bool) error {
+	var (
+		app   = c.Get("app").(*App)
+		user  = c.Get("user").(models.User)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if !app.constants.CampaignApproval {
+		return echo.NewHTTPError(http.StatusBadRequest, "Campaign approvals aren't enabled.")
+	}
+
+	var o campaignReview
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+	o.Note = strings.TrimSpace(o.Note)
+	if !approve && o.Note == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Rejections need a `note` with the reason.")
+	}
+
+	var cm models.Campaign
+	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+
+	if cm.Status != models.CampaignStatusPendingApproval {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only campaigns that are pending approval can be reviewed.")
+	}
+	if cm.ApprovalRequestedBy.Valid && cm.ApprovalRequestedBy.Int == user.ID {
+		return echo.NewHTTPError(http.StatusForbidden, "Campaigns can't be reviewed by the users who submitted them.")
+	}
+
+	res, err := app.queries.ReviewCampaign.Exec(cm.ID, user.ID, approve, o.Note)
+	if err != nil {
+		app.log.Printf("error reviewing campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error reviewing campaign: %s", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "The campaign is no longer pending approval.")
+	}
+
+	verdict := "approved"
+	if !approve {
+		verdict = "rejected"
+	}
+	app.log.Printf("campaign (%s) %s by %s", cm.Name, verdict, user.Email)
+	return handleGetCampaigns(c)
+}
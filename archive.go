@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+const tplArchive = "archive"
+
+// archiveTpl is the archive page of a list.
+type archiveTpl struct {
+	publicTpl
+	ListName  string
+	Campaigns []archivedCampaign
+	Page      int
+	PrevPage  int
+	NextPage  int
+}
+
+// archivedCampaign represents a campaign on the archive page of a list.
+type archivedCampaign struct {
+	UUID      string    `db:"uuid"`
+	Subject   string    `db:"subject"`
+	StartedAt null.Time `db:"started_at"`
+
+	Total int `db:"total"`
+}
+
+// handleArchivePage renders the archive page of a public list with the
+// campaigns in the archive that have been sent to it, latest first.
+func handleArchivePage(c echo.Context) error {
+	var (
+		app      = c.Get("app").(*App)
+		listUUID = c.Param("listUUID")
+
+		// Archive pages are always paginated.
+		pg = getPagination(url.Values{"page": {c.QueryParam("page")}})
+	)
+
+	var list models.List
+	if err := app.queries.GetArchiveList.Get(&list, listUUID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Render(http.StatusNotFound, tplMessage,
+				makeMsgTpl("Not found", "", `The archive was not found.`))
+		}
+
+		app.log.Printf("error fetching archive list: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl("Error", "", `Error fetching the archive.`))
+	}
+
+	var camps []archivedCampaign
+	if err := app.queries.GetArchivedCampaigns.Select(&camps, list.ID, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching archived campaigns: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl("Error", "", `Error fetching the archive.`))
+	}
+
+	// Subjects are templates that are rendered for the dummy subscriber, whose
+	// views and clicks aren't tracked.
+	for i, cm := range camps {
+		camp := models.Campaign{UUID: cm.UUID, Subject: cm.Subject, TemplateBody: tplTag}
+		if err := app.manager.CompileTemplate(&camp); err != nil {
+			continue
+		}
+		m := app.manager.NewCampaignMessage(&camp, dummySubscriber)
+		if err := m.Render(); err != nil {
+			continue
+		}
+		camps[i].Subject = m.Subject()
+	}
+
+	out := archiveTpl{
+		ListName:  list.Name,
+		Campaigns: camps,
+		Page:      pg.Page,
+	}
+	out.Title = list.Name + " archive"
+	out.Description = "Past campaigns of " + list.Name
+	if pg.Page > 1 {
+		out.PrevPage = pg.Page - 1
+	}
+	if len(camps) > 0 && pg.Offset+len(camps) < camps[0].Total {
+		out.NextPage = pg.Page + 1
+	}
+
+	return c.Render(http.StatusOK, tplArchive, out)
+}
+
+// handleArchivedCampaignPage renders a campaign in the archive, as it was
+// sent, for the dummy subscriber. Campaigns that aren't in the archive,
+// haven't been started, or are simulations aren't found.
+func handleArchivedCampaignPage(c echo.Context) error {
+	var (
+		app      = c.Get("app").(*App)
+		campUUID = c.Param("campUUID")
+	)
+
+	var camp models.Campaign
+	if err := app.queries.GetCampaign.Get(&camp, 0, campUUID); err != nil {
+		if err == sql.ErrNoRows {
+			return c.Render(http.StatusNotFound, tplMessage,
+				makeMsgTpl("Not found", "", `The e-mail campaign was not found.`))
+		}
+
+		app.log.Printf("error fetching campaign: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl("Error", "", `Error fetching e-mail campaign.`))
+	}
+	if !camp.Archive || !camp.StartedAt.Valid || camp.Simulate {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl("Not found", "", `The e-mail campaign was not found.`))
+	}
+
+	camp.ApplySnapshot()
+	if err := app.manager.CompileTemplate(&camp); err != nil {
+		app.log.Printf("error compiling template: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl("Error", "", `Error compiling e-mail template.`))
+	}
+
+	m := app.manager.NewCampaignMessage(&camp, dummySubscriber)
+	if err := m.Render(); err != nil {
+		app.log.Printf("error rendering message: %v", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl("Error", "", `Error rendering e-mail message.`))
+	}
+
+	body := m.Body()
+	if app.constants.Sanitizer != nil {
+		body = app.constants.Sanitizer.Sanitize(body)
+	}
+	return c.HTML(http.StatusOK, string(body))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/jobs"
+	"github.com/knadh/listmonk/internal/segment"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	// jobTypeAttribIndex is the job type of the background migrations that
+	// create and drop the indexes of subscriber attributes.
+	jobTypeAttribIndex = "attrib-index"
+
+	// attribIndexPrefix is the name prefix of the attribute indexes.
+	// Postgres identifiers are limited to 63 bytes, which limits the length
+	// of the indexed keys.
+	attribIndexPrefix    = "idx_subs_attrib_"
+	attribIndexMaxKeyLen = 40
+
+	attribIndexReady  = "ready"
+	attribIndexFailed = "failed"
+)
+
+// attribIndex represents an indexed subscriber attribute key.
+type attribIndex struct {
+	Key       string    `db:"key" json:"key"`
+	Status    string    `db:"status" json:"status"`
+	Error     string    `db:"error" json:"error"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+	UpdatedAt time.Time `db:"updated_at" json:"updated_at"`
+}
+
+// attribIndexJob represents the params of a job that creates or drops the
+// indexes of an attribute key.
+type attribIndexJob struct {
+	Key  string `json:"key"`
+	Drop bool   `json:"drop"`
+}
+
+// attribIndexes is the set of attribute keys whose indexes are ready,
+// which the segment compiler prefers.
+type attribIndexes struct {
+	sync.RWMutex
+	keys map[string]bool
+}
+
+// Keys returns the set of indexed attribute keys. The set isn't modified
+// once it's returned.
+func (a *attribIndexes) Keys() map[string]bool {
+	if a == nil {
+		return nil
+	}
+	a.RLock()
+	defer a.RUnlock()
+	return a.keys
+}
+
+// load replaces the set of indexed attribute keys with the ones that are
+// ready in the DB.
+func (a *attribIndexes) load(q *Queries) error {
+	var keys []string
+	if err := q.GetReadyAttribIndexes.Select(&keys); err != nil {
+		return err
+	}
+
+	m := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		m[k] = true
+	}
+	a.Lock()
+	a.keys = m
+	a.Unlock()
+	return nil
+}
+
+// handleGetAttribIndexes returns the indexed subscriber attribute keys and
+// the statuses of their indexes.
+func handleGetAttribIndexes(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []attribIndex
+	)
+
+	if err := app.queries.GetAttribIndexes.Select(&out); err != nil {
+		app.log.Printf("error fetching attribute indexes: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching attribute indexes: %s", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateAttribIndex adds an indexed subscriber attribute key and
+// queues a job that creates its indexes. Segment queries use the indexes
+// once the job finishes. Failed keys can be added again to retry them.
+func handleCreateAttribIndex(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req struct {
+			Key string `json:"key"`
+		}
+	)
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Key = strings.TrimSpace(req.Key)
+	if !segment.ValidAttribKey(req.Key) || len(req.Key) > attribIndexMaxKeyLen {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid `key`. Should be up to %d alphanumeric characters, underscores, or hyphens.", attribIndexMaxKeyLen))
+	}
+
+	var out attribIndex
+	if err := app.queries.UpsertAttribIndex.Get(&out, req.Key); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "The key is already indexed or is being dropped.")
+		}
+		app.log.Printf("error creating attribute index: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating attribute index: %s", pqErrMsg(err)))
+	}
+
+	if _, err := app.jobs.Enqueue(jobTypeAttribIndex, attribIndexJob{Key: out.Key}); err != nil {
+		app.log.Printf("error queuing attribute index job: %v", err)
+		app.queries.UpdateAttribIndexStatus.Exec(out.Key, attribIndexFailed, err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error queuing attribute index: %s", pqErrMsg(err)))
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleDeleteAttribIndex stops preferring the indexes of an attribute key
+// and queues a job that drops them.
+func handleDeleteAttribIndex(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		key = c.Param("key")
+	)
+
+	var out attribIndex
+	if err := app.queries.DropAttribIndex.Get(&out, key); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Attribute index not found.")
+		}
+		app.log.Printf("error deleting attribute index: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error deleting attribute index: %s", pqErrMsg(err)))
+	}
+	if err := app.attribIndexes.load(app.queries); err != nil {
+		app.log.Printf("error loading attribute indexes: %v", err)
+	}
+
+	if _, err := app.jobs.Enqueue(jobTypeAttribIndex, attribIndexJob{Key: out.Key, Drop: true}); err != nil {
+		app.log.Printf("error queuing attribute index job: %v", err)
+		app.queries.UpdateAttribIndexStatus.Exec(out.Key, attribIndexFailed, err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error queuing attribute index: %s", pqErrMsg(err)))
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// makeAttribIndexJobHandler returns the handler of the jobs that create and
+// drop attribute indexes. The indexes are built concurrently so that writes
+// to subscribers aren't blocked, and the statements are idempotent so that
+// interrupted jobs can be re-run after a restart.
+func makeAttribIndexJobHandler(app *App) jobs.Handler {
+	return func(c *jobs.Ctx) error {
+		var p attribIndexJob
+		if err := c.Params(&p); err != nil {
+			return fmt.Errorf("error reading attribute index params: %v", err)
+		}
+
+		var err error
+		if p.Drop {
+			err = dropAttribIndexes(c, p.Key, app)
+		} else {
+			err = createAttribIndexes(c, p.Key, app)
+		}
+		if err != nil {
+			msg := err.Error()
+			if err == jobs.ErrCancelled {
+				msg = "cancelled"
+			}
+			if _, err := app.queries.UpdateAttribIndexStatus.Exec(p.Key, attribIndexFailed, msg); err != nil {
+				app.log.Printf("error updating attribute index (%s): %v", p.Key, err)
+			}
+		}
+
+		if err := app.attribIndexes.load(app.queries); err != nil {
+			app.log.Printf("error loading attribute indexes: %v", err)
+		}
+		return err
+	}
+}
+
+// createAttribIndexes creates the indexes of an attribute key, replacing
+// any invalid ones left behind by failed builds, and marks it ready.
+func createAttribIndexes(c *jobs.Ctx, key string, app *App) error {
+	idx := attribIndexNames(key)
+	c.SetProgress(len(idx), 0)
+	for i, x := range idx {
+		if c.Cancelled() {
+			return jobs.ErrCancelled
+		}
+
+		var invalid string
+		if err := app.queries.GetInvalidIndex.Get(&invalid, x[0]); err != nil && err != sql.ErrNoRows {
+			return fmt.Errorf("error checking index %s: %v", x[0], pqErrMsg(err))
+		}
+		if invalid != "" {
+			if _, err := app.db.Exec(fmt.Sprintf(app.queries.DropIndex, pq.QuoteIdentifier(x[0]))); err != nil {
+				return fmt.Errorf("error dropping invalid index %s: %v", x[0], pqErrMsg(err))
+			}
+		}
+
+		if _, err := app.db.Exec(fmt.Sprintf(app.queries.CreateAttribIndex,
+			pq.QuoteIdentifier(x[0]), x[1], pq.QuoteLiteral(key))); err != nil {
+			return fmt.Errorf("error creating index %s: %v", x[0], pqErrMsg(err))
+		}
+		c.SetProgress(len(idx), i+1)
+	}
+
+	_, err := app.queries.UpdateAttribIndexStatus.Exec(key, attribIndexReady, "")
+	return err
+}
+
+// dropAttribIndexes drops the indexes of an attribute key and removes it.
+func dropAttribIndexes(c *jobs.Ctx, key string, app *App) error {
+	idx := attribIndexNames(key)
+	c.SetProgress(len(idx), 0)
+	for i, x := range idx {
+		if _, err := app.db.Exec(fmt.Sprintf(app.queries.DropIndex, pq.QuoteIdentifier(x[0]))); err != nil {
+			return fmt.Errorf("error dropping index %s: %v", x[0], pqErrMsg(err))
+		}
+		c.SetProgress(len(idx), i+1)
+	}
+
+	_, err := app.queries.DeleteAttribIndex.Exec(key)
+	return err
+}
+
+// attribIndexNames returns the names of the indexes of an attribute key
+// along with the JSONB operators they're on: -> for the JSONB comparisons
+// and existence checks, and ->> for the text matches of the segment rules.
+func attribIndexNames(key string) [][2]string {
+	return [][2]string{
+		{attribIndexPrefix + key, "->"},
+		{attribIndexPrefix + key + "_text", "->>"},
+	}
+}
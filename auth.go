@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Permission scopes of the API endpoints.
+const (
+	// Viewing everything, including previews and counts.
+	permRead = "read"
+
+	// Creating and editing campaigns, templates, media, lists,
+	// subscribers, and segments.
+	permManage = "manage"
+
+	// Deletions, imports, bulk operations by queries, jobs, settings,
+	// and users.
+	permAdmin = "admin"
+
+	// Approving and rejecting campaigns that are pending approval.
+	permApprove = "approve"
+)
+
+// rolePerms are the permission scopes of each user role.
+var rolePerms = map[string]map[string]bool{
+	models.UserRoleAdmin:   {permRead: true, permManage: true, permAdmin: true, permApprove: true},
+	models.UserRoleEditor:  {permRead: true, permManage: true},
+	models.UserRoleAnalyst: {permRead: true},
+}
+
+// authCacheTTL is the duration for which verified credentials are cached
+// to not hash the password on every request.
+const authCacheTTL = time.Minute * 5
+
+// authCache caches the users of verified credentials keyed by the hash
+// of the credentials. It's reset when users are modified.
+type authCache struct {
+	users map[[sha256.Size]byte]authEntry
+	sync.Mutex
+}
+
+type authEntry struct {
+	user models.User
+	exp  time.Time
+}
+
+// authUsers is the cache of the verified credentials of users.
+var authUsers = &authCache{users: make(map[[sha256.Size]byte]authEntry)}
+
+// authorize returns a middleware that authenticates admin users with HTTP
+// basic auth (the e-mail and the password) and checks that their roles
+// have the permission scope. The user is set as "user" on the context.
+func authorize(perm string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			app := c.Get("app").(*App)
+
+			email, pwd, ok := c.Request().BasicAuth()
+			if !ok {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Basic realm="listmonk"`)
+				return echo.ErrUnauthorized
+			}
+
+			u, err := authUsers.get(email, pwd, app)
+			if err != nil {
+				return err
+			}
+			if !rolePerms[u.Role][perm] {
+				return echo.NewHTTPError(http.StatusForbidden,
+					"You don't have the permission to do this.")
+			}
+
+			c.Set("user", u)
+			return next(c)
+		}
+	}
+}
+
+// get returns the enabled user with the given credentials.
+func (a *authCache) get(email, pwd string, app *App) (models.User, error) {
+	key := sha256.Sum256([]byte(email + "\x00" + pwd))
+
+	a.Lock()
+	e, ok := a.users[key]
+	a.Unlock()
+	if ok && time.Now().Before(e.exp) {
+		return e.user, nil
+	}
+
+	var u models.User
+	if err := app.queries.GetUserByEmail.Get(&u, email); err != nil {
+		if err == sql.ErrNoRows {
+			return u, echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials.")
+		}
+		app.log.Printf("error fetching user: %v", err)
+		return u, echo.NewHTTPError(http.StatusInternalServerError, "Error authenticating.")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pwd)) != nil {
+		return u, echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials.")
+	}
+
+	a.Lock()
+	a.users[key] = authEntry{user: u, exp: time.Now().Add(authCacheTTL)}
+	a.Unlock()
+	return u, nil
+}
+
+// reset clears the cache to re-verify the credentials of all users.
+func (a *authCache) reset() {
+	a.Lock()
+	a.users = make(map[[sha256.Size]byte]authEntry)
+	a.Unlock()
+}
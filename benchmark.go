@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/labstack/echo"
+)
+
+// benchmarkMessenger is the name of the fake messenger of the benchmark mode
+// that campaigns are load tested on.
+const benchmarkMessenger = "benchmark"
+
+// benchmarkConf has the settings of the benchmark mode.
+type benchmarkConf struct {
+	Enabled   bool          `koanf:"enabled"`
+	Latency   time.Duration `koanf:"latency"`
+	Jitter    time.Duration `koanf:"latency_jitter"`
+	ErrorRate float64       `koanf:"error_rate"`
+}
+
+// benchmarkStatus represents the settings and the push results of the fake
+// messenger, and the counters of the queues and workers of the manager.
+type benchmarkStatus struct {
+	Messenger struct {
+		Name      string  `json:"name"`
+		Latency   string  `json:"latency"`
+		Jitter    string  `json:"latency_jitter"`
+		ErrorRate float64 `json:"error_rate"`
+		Pushed    int64   `json:"pushed"`
+		Failed    int64   `json:"failed"`
+	} `json:"messenger"`
+
+	Queue manager.QueueStats `json:"queue"`
+}
+
+// handleGetBenchmark returns the status of the benchmark mode, for load
+// testing harnesses to measure throughput and backpressure while they drive
+// campaigns on the fake messenger.
+func handleGetBenchmark(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	if app.benchmark == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "The benchmark mode isn't enabled.")
+	}
+	return c.JSON(http.StatusOK, okResp{makeBenchmarkStatus(app)})
+}
+
+// handleUpdateBenchmark changes the latency and the error rate of the fake
+// messenger of the benchmark mode while it's pushing.
+func handleUpdateBenchmark(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req struct {
+			Latency   string  `json:"latency"`
+			Jitter    string  `json:"latency_jitter"`
+			ErrorRate float64 `json:"error_rate"`
+		}
+	)
+
+	if app.benchmark == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "The benchmark mode isn't enabled.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	var (
+		cfg = messenger.FakeConfig{ErrorRate: req.ErrorRate}
+		err error
+	)
+	if req.Latency != "" {
+		if cfg.Latency, err = time.ParseDuration(req.Latency); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `latency`.")
+		}
+	}
+	if req.Jitter != "" {
+		if cfg.Jitter, err = time.ParseDuration(req.Jitter); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `latency_jitter`.")
+		}
+	}
+	if err := app.benchmark.SetConfig(cfg); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	return c.JSON(http.StatusOK, okResp{makeBenchmarkStatus(app)})
+}
+
+func makeBenchmarkStatus(app *App) benchmarkStatus {
+	var (
+		s   = app.benchmark.Status()
+		out = benchmarkStatus{Queue: app.manager.QueueStats()}
+	)
+	out.Messenger.Name = app.benchmark.Name()
+	out.Messenger.Latency = s.Latency.String()
+	out.Messenger.Jitter = s.Jitter.String()
+	out.Messenger.ErrorRate = s.ErrorRate
+	out.Messenger.Pushed = s.Pushed
+	out.Messenger.Failed = s.Failed
+	return out
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
@@ -14,6 +15,12 @@ import (
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/cron"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/segment"
+	"github.com/knadh/listmonk/internal/smtppool"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
@@ -37,9 +44,35 @@ type campaignReq struct {
 	// This is only relevant to campaign test requests.
 	SubscriberEmails pq.StringArray `json:"subscribers"`
 
+	// ConfirmToken is the token from /confirm that large campaigns are
+	// started and scheduled with. See sendConfirmConf.
+	ConfirmToken string `db:"-" json:"confirm_token"`
+
+	// DryRun starts a draft as a simulation, like Simulate.
+	DryRun bool `db:"-" json:"dry_run"`
+
 	Type string `json:"type"`
 }
 
+// followupReq represents a request to create a follow-up campaign
+// derived from a parent campaign.
+type followupReq struct {
+	Name     string `json:"name"`
+	Subject  string `json:"subject"`
+	Body     string `json:"body"`
+	Audience string `json:"audience"`
+
+	// Optional delay after which the follow-up is to be sent, eg: 48h.
+	// This sets send_at and the follow-up has to be scheduled.
+	Delay string `json:"delay"`
+}
+
+// duplicateReq represents a request to duplicate a campaign into a new draft.
+type duplicateReq struct {
+	// Optional name of the draft. It's "Copy of" the campaign's by default.
+	Name string `json:"name"`
+}
+
 type campaignStats struct {
 	ID        int       `db:"id" json:"id"`
 	Status    string    `db:"status" json:"status"`
@@ -48,6 +81,84 @@ type campaignStats struct {
 	Started   null.Time `db:"started_at" json:"started_at"`
 	UpdatedAt null.Time `db:"updated_at" json:"updated_at"`
 	Rate      float64   `json:"rate"`
+
+	// Priority is the campaign's priority and Share, the fraction of the
+	// send capacity that's currently allocated to it.
+	Priority int     `db:"priority" json:"priority"`
+	Share    float64 `json:"share"`
+}
+
+// campaignLangStats represents the stats of a campaign's language variant.
+// Lang is empty for the default variant.
+type campaignLangStats struct {
+	Lang   string `db:"lang" json:"lang"`
+	Views  int    `db:"views" json:"views"`
+	Clicks int    `db:"clicks" json:"clicks"`
+}
+
+// campaignAnalytics represents the views and clicks of a campaign on a day.
+type campaignAnalytics struct {
+	CampaignID   int    `db:"campaign_id" json:"campaign_id"`
+	CampaignName string `db:"campaign_name" json:"campaign_name"`
+	Date         string `db:"date" json:"date"`
+	Views        int    `db:"views" json:"views"`
+	Clicks       int    `db:"clicks" json:"clicks"`
+}
+
+// queuedCampaign represents a campaign that's waiting for a slot under the
+// cap on running campaigns and its position in the queue.
+type queuedCampaign struct {
+	Position int       `db:"position" json:"position"`
+	ID       int       `db:"id" json:"id"`
+	UUID     string    `db:"uuid" json:"uuid"`
+	Name     string    `db:"name" json:"name"`
+	Status   string    `db:"status" json:"status"`
+	Priority int       `db:"priority" json:"priority"`
+	QueuedAt null.Time `db:"queued_at" json:"queued_at"`
+}
+
+// campaignFailureCounts represents the counts of the failed recipients
+// of a campaign.
+type campaignFailureCounts struct {
+	Retryable int `db:"retryable" json:"retryable"`
+	Permanent int `db:"permanent" json:"permanent"`
+}
+
+// campaignRecipientCounts represents the number of subscribers in a campaign's
+// lists and segments that it targets, how many of them are excluded, and the
+// final count. Overlap is the number of subscribers that are in both its lists
+// and segments, who are counted (and sent to) once.
+type campaignRecipientCounts struct {
+	Total    int `db:"total" json:"total"`
+	Excluded int `db:"excluded" json:"excluded"`
+	Lists    int `db:"lists" json:"lists"`
+	Segments int `db:"segments" json:"segments"`
+	Overlap  int `db:"overlap" json:"overlap"`
+	Count    int `db:"-" json:"count"`
+}
+
+// campaignSendWindows represents the send windows of the lists of a
+// campaign and when it can be sent next. Open is whether they're open now
+// and NextSendAt, the earliest time (after the campaign's send_at, if it's
+// scheduled) at which they're all open. Empty is set if they don't overlap
+// and the campaign can't be sent.
+type campaignSendWindows struct {
+	Windows    models.CampaignSendWindows `json:"windows"`
+	Open       bool                       `json:"open"`
+	NextSendAt null.Time                  `json:"next_send_at"`
+	Empty      bool                       `json:"empty"`
+}
+
+// campaignLocalSend represents the timezones of the recipients of a campaign
+// with a local send time and the progress of the send over them. NextSendAt
+// is the send time of the next timezone and EndsAt, of the last one.
+type campaignLocalSend struct {
+	LocalSendTime string                   `json:"local_send_time"`
+	Buckets       []models.LocalSendBucket `json:"buckets"`
+	Total         int                      `json:"total"`
+	Delivered     int                      `json:"delivered"`
+	NextSendAt    null.Time                `json:"next_send_at"`
+	EndsAt        null.Time                `json:"ends_at"`
 }
 
 type campsWrap struct {
@@ -59,11 +170,29 @@ type campsWrap struct {
 	Page    int    `json:"page"`
 }
 
+// sseKeepAliveInterval is the interval at which keep-alive comments
+// are written to idle campaign event streams.
+const sseKeepAliveInterval = time.Second * 15
+
 var (
 	regexFromAddress   = regexp.MustCompile(`(.+?)\s<(.+?)@(.+?)>`)
 	regexFullTextQuery = regexp.MustCompile(`\s+`)
+
+	// Language codes of campaign variants, eg: de, pt-br, zh_hant.
+	regexLangCode = regexp.MustCompile(`^[a-z]{2,3}([-_][a-z0-9]{2,8})?$`)
+
+	// Attribute paths of the send order field, eg: attribs.vip, attribs.stack.score.
+	regexSendOrderAttrib = regexp.MustCompile(`^attribs(\.[a-zA-Z0-9_-]+)+$`)
 )
 
+// sendOrderColumns are the subscriber columns campaigns can be sent in the order of.
+var sendOrderColumns = map[string]bool{
+	"email":      true,
+	"name":       true,
+	"created_at": true,
+	"updated_at": true,
+}
+
 // handleGetCampaigns handles retrieval of campaigns.
 func handleGetCampaigns(c echo.Context) error {
 	var (
@@ -85,8 +214,12 @@ func handleGetCampaigns(c echo.Context) error {
 	if query != "" {
 		query = string(regexFullTextQuery.ReplaceAll([]byte(query), []byte("&")))
 	}
+	window, err := getStatsWindow(c, app)
+	if err != nil {
+		return err
+	}
 
-	err := app.queries.QueryCampaigns.Select(&out.Results, id, pq.StringArray(status), query, pg.Offset, pg.Limit)
+	err = app.queries.QueryCampaigns.Select(&out.Results, id, pq.StringArray(status), query, pg.Offset, pg.Limit)
 	if err != nil {
 		app.log.Printf("error fetching campaigns: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -112,13 +245,16 @@ func handleGetCampaigns(c echo.Context) error {
 	}
 
 	// Lazy load stats.
-	if err := out.Results.LoadStats(app.queries.GetCampaignStats); err != nil {
+	if err := out.Results.LoadStats(app.queries.GetCampaignStats, window); err != nil {
 		app.log.Printf("error fetching campaign stats: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error fetching campaign stats: %v", pqErrMsg(err)))
 	}
 
 	if single {
+		if w, ok := c.Get(ctxCampaignWarnings).([]string); ok {
+			out.Results[0].Warnings = w
+		}
 		return c.JSON(http.StatusOK, okResp{out.Results[0]})
 	}
 
@@ -137,6 +273,16 @@ func handlePreviewCampaign(c echo.Context) error {
 		id, _ = strconv.Atoi(c.Param("id"))
 		body  = c.FormValue("body")
 
+		// Optional language variant to preview.
+		lang = strings.ToLower(c.FormValue("lang"))
+
+		// Preview the AMP body (amp_body) or the plaintext body (altbody,
+		// or the generated one) instead of the HTML.
+		format  = c.FormValue("format")
+		amp     = format == "amp"
+		ampBody = c.FormValue("amp_body")
+		altBody = c.FormValue("altbody")
+
 		camp = &models.Campaign{}
 	)
 
@@ -168,12 +314,38 @@ func handlePreviewCampaign(c echo.Context) error {
 		}
 	}
 
-	// Compile the template.
-	if body != "" {
+	// Preview the variant by rendering it for a subscriber in its language.
+	if v, ok := camp.Variants[lang]; ok {
+		attribs := make(models.SubscriberAttribs, len(sub.Attribs)+1)
+		for k, a := range sub.Attribs {
+			attribs[k] = a
+		}
+		attribs[app.constants.LangAttrib] = lang
+		sub.Attribs = attribs
+
+		if body != "" {
+			v.Body = body
+			camp.Variants[lang] = v
+		}
+	} else if body != "" {
 		camp.Body = body
 	}
+	if ampBody != "" {
+		camp.AMPBody = ampBody
+	}
+	if amp && camp.AMPBody == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "The campaign has no AMP body.")
+	}
+	if altBody != "" {
+		camp.AltBody = altBody
+	}
+	if format == "plain" {
+		// Show the generated plaintext even if generation is turned off.
+		camp.AutoAltBody = null.BoolFrom(true)
+	}
 
-	if err := camp.CompileTemplate(app.manager.TemplateFuncs(camp)); err != nil {
+	// Compile the template.
+	if err := app.manager.CompileTemplate(camp); err != nil {
 		app.log.Printf("error compiling template: %v", err)
 		return echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Error compiling template: %v", err))
@@ -187,6 +359,12 @@ func handlePreviewCampaign(c echo.Context) error {
 			fmt.Sprintf("Error rendering message: %v", err))
 	}
 
+	if amp {
+		return c.HTML(http.StatusOK, string(m.AMP()))
+	}
+	if format == "plain" {
+		return c.String(http.StatusOK, string(m.AltBody()))
+	}
 	return c.HTML(http.StatusOK, string(m.Body()))
 }
 
@@ -211,17 +389,29 @@ func handleCreateCampaign(c echo.Context) error {
 		o = op
 	}
 
+	// Apply the defaults of the campaign's category.
+	if v, err := validateCategory(o); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	} else {
+		o = applyCategoryDefaults(v, app)
+	}
+
 	// Validate.
 	if c, err := validateCampaignFields(o, app); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	} else {
 		o = c
 	}
-
 	if !app.manager.HasMessenger(o.MessengerID) {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Unknown messenger %s", o.MessengerID))
 	}
+	c.Set(ctxCampaignWarnings, append(subjectWarnings(o), messengerWarnings(o, app)...))
+
+	// If there's no template, use the messenger's default template, if any.
+	if o.TemplateID == 0 {
+		o.TemplateID = app.constants.Messengers[o.MessengerID].DefaultTemplate
+	}
 
 	uu, err := uuid.NewV4()
 	if err != nil {
@@ -241,9 +431,40 @@ func handleCreateCampaign(c echo.Context) error {
 		o.ContentType,
 		o.SendAt,
 		pq.StringArray(normalizeTags(o.Tags)),
-		"email",
+		o.MessengerID,
 		o.TemplateID,
 		o.ListIDs,
+		o.TrackingDomain,
+		nil,
+		"",
+		o.Variants,
+		o.SendOrder,
+		o.SendOrderField,
+		o.SendOrderDesc,
+		o.FromName,
+		o.ExcludeSegmentID,
+		o.Priority,
+		o.AllowResend,
+		o.Charset,
+		o.TransferEncoding,
+		o.OutagePolicy,
+		o.LocalSendTime,
+		o.RolloutPercent,
+		o.RolloutGate,
+		o.UnsubRedirect,
+		o.Metadata,
+		o.AMPBody,
+		o.AltBody,
+		o.AutoAltBody,
+		o.ShortenLinks,
+		o.ErrorMode,
+		o.ErrorRate,
+		o.ErrorWindow,
+		o.Category,
+		o.RolloutRate,
+		o.Recurrence,
+		o.ABTest,
+		o.Archive,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			return echo.NewHTTPError(http.StatusBadRequest,
@@ -254,6 +475,275 @@ func handleCreateCampaign(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error creating campaign: %v", pqErrMsg(err)))
 	}
+	if err := saveCampaignExclusions(newID, o.ExcludeSubscribers, o.ExcludeSegmentID, app); err != nil {
+		app.log.Printf("error saving campaign exclusions: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign exclusions: %v", pqErrMsg(err)))
+	}
+	if err := saveCampaignSegments(newID, o.SegmentIDs, app); err != nil {
+		app.log.Printf("error saving campaign segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign segments: %v", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprintf("%d", newID))
+	return handleGetCampaigns(c)
+}
+
+// handleCreateFollowupCampaign creates a draft follow-up campaign derived from
+// a parent campaign that targets a subset of the parent's recipients
+// (eg: non-openers, or the ones the parent failed to be sent to). The follow-up inherits the parent's lists, template,
+// and content, which can be overridden in the request and edited later.
+func handleCreateFollowupCampaign(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   followupReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	if req.Audience == "" {
+		req.Audience = models.CampaignAudienceNonOpeners
+	}
+	if req.Audience != models.CampaignAudienceNonOpeners &&
+		req.Audience != models.CampaignAudienceFailed {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid `audience`.")
+	}
+
+	var parent models.Campaign
+	if err := app.queries.GetCampaign.Get(&parent, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+
+	if parent.Type != models.CampaignTypeRegular {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Follow-ups can only be created for regular campaigns.")
+	}
+	if parent.Status == models.CampaignStatusDraft ||
+		parent.Status == models.CampaignStatusScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Follow-ups can only be created for campaigns that have been sent.")
+	}
+
+	// Failures are only known once the campaign has stopped sending.
+	if req.Audience == models.CampaignAudienceFailed &&
+		parent.Status == models.CampaignStatusRunning {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Failures can only be resent once the campaign is paused, cancelled, or finished.")
+	}
+
+	// Get the parent's lists.
+	camps := models.Campaigns{parent}
+	if err := camps.LoadStats(app.queries.GetCampaignStats, 0); err != nil {
+		app.log.Printf("error fetching campaign lists: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign lists: %s", pqErrMsg(err)))
+	}
+	var lists []struct {
+		ID int64 `json:"id"`
+	}
+	if err := camps[0].Lists.Unmarshal(&lists); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error reading campaign lists: %v", err))
+	}
+
+	o := campaignReq{Campaign: parent, Type: parent.Type}
+	o.Name = "Follow-up: " + parent.Name
+	if req.Audience == models.CampaignAudienceFailed {
+		o.Name = "Resend: " + parent.Name
+	}
+	o.Status = ""
+	o.SendAt = null.Time{}
+	o.ParentID = null.IntFrom(parent.ID)
+	o.ParentAudience = req.Audience
+	o.RolloutPercent = 0
+	o.RolloutGate = models.CampaignRolloutGate{}
+	o.RolloutRate = 0
+	o.Recurrence = ""
+	o.ABTest = models.CampaignABTest{}
+	for _, l := range lists {
+		// Lists deleted since the parent was sent have no ID.
+		if l.ID > 0 {
+			o.ListIDs = append(o.ListIDs, l.ID)
+		}
+	}
+
+	// And the parent's segments.
+	var segs []models.Segment
+	if err := app.queries.GetCampaignSegments.Select(&segs, parent.ID); err != nil {
+		app.log.Printf("error fetching campaign segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign segments: %s", pqErrMsg(err)))
+	}
+	for _, s := range segs {
+		o.SegmentIDs = append(o.SegmentIDs, int64(s.ID))
+	}
+
+	if req.Name != "" {
+		o.Name = req.Name
+	}
+	if req.Subject != "" {
+		o.Subject = req.Subject
+	}
+	if req.Body != "" {
+		o.Body = req.Body
+	}
+
+	// The parent's language variants and AMP and plaintext bodies don't
+	// apply to new content.
+	if req.Subject != "" || req.Body != "" {
+		o.Variants = nil
+	}
+	if req.Body != "" {
+		o.AMPBody = ""
+		o.AltBody = ""
+	}
+	if req.Delay != "" {
+		d, err := time.ParseDuration(req.Delay)
+		if err != nil || d < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `delay`.")
+		}
+		o.SendAt = null.TimeFrom(time.Now().Add(d))
+	}
+
+	if v, err := validateCampaignFields(o, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	} else {
+		o = v
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error generating UUID")
+	}
+
+	// Insert and read ID.
+	var newID int
+	if err := app.queries.CreateCampaign.Get(&newID,
+		uu,
+		o.Type,
+		o.Name,
+		o.Subject,
+		o.FromEmail,
+		o.Body,
+		o.ContentType,
+		o.SendAt,
+		pq.StringArray(normalizeTags(o.Tags)),
+		o.MessengerID,
+		o.TemplateID,
+		o.ListIDs,
+		o.TrackingDomain,
+		o.ParentID,
+		o.ParentAudience,
+		o.Variants,
+		o.SendOrder,
+		o.SendOrderField,
+		o.SendOrderDesc,
+		o.FromName,
+		o.ExcludeSegmentID,
+		o.Priority,
+		o.AllowResend,
+		o.Charset,
+		o.TransferEncoding,
+		o.OutagePolicy,
+		o.LocalSendTime,
+		o.RolloutPercent,
+		o.RolloutGate,
+		o.UnsubRedirect,
+		o.Metadata,
+		o.AMPBody,
+		o.AltBody,
+		o.AutoAltBody,
+		o.ShortenLinks,
+		o.ErrorMode,
+		o.ErrorRate,
+		o.ErrorWindow,
+		o.Category,
+		o.RolloutRate,
+		o.Recurrence,
+		o.ABTest,
+		o.Archive,
+	); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				"There aren't any subscribers in the target lists to create the campaign.")
+		}
+
+		app.log.Printf("error creating follow-up campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating campaign: %v", pqErrMsg(err)))
+	}
+
+	// The follow-up inherits the parent's exclusion segment.
+	if err := saveCampaignExclusions(newID, nil, o.ExcludeSegmentID, app); err != nil {
+		app.log.Printf("error saving campaign exclusions: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign exclusions: %v", pqErrMsg(err)))
+	}
+	if err := saveCampaignSegments(newID, o.SegmentIDs, app); err != nil {
+		app.log.Printf("error saving campaign segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign segments: %v", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprintf("%d", newID))
+	return handleGetCampaigns(c)
+}
+
+// handleDuplicateCampaign duplicates a campaign of any status into a new
+// draft with the campaign's content, template, tags, settings, and target
+// lists and segments, which can then be edited and sent.
+func handleDuplicateCampaign(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   duplicateReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name != "" && !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error generating UUID")
+	}
+
+	var newID int
+	if err := app.queries.DuplicateCampaign.Get(&newID, id, uu, req.Name); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+
+		app.log.Printf("error duplicating campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error duplicating campaign: %v", pqErrMsg(err)))
+	}
 
 	// Hand over to the GET handler to return the last insertion.
 	c.SetParamNames("id")
@@ -288,6 +778,10 @@ func handleUpdateCampaign(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			"Cannot update a running or a finished campaign.")
 	}
+	if cm.Status == models.CampaignStatusPendingApproval {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Cannot update a campaign that's pending approval. Save it as a draft first.")
+	}
 
 	// Incoming params.
 	var o campaignReq
@@ -300,6 +794,26 @@ func handleUpdateCampaign(c echo.Context) error {
 	} else {
 		o = c
 	}
+	if !app.manager.HasMessenger(o.MessengerID) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Unknown messenger %s", o.MessengerID))
+	}
+	c.Set(ctxCampaignWarnings, append(subjectWarnings(o), messengerWarnings(o, app)...))
+
+	// The checkpoint of a paused campaign is only valid in its send order.
+	if cm.Status == models.CampaignStatusPaused && (o.SendOrder != cm.SendOrder ||
+		o.SendOrderField != cm.SendOrderField || o.SendOrderDesc != cm.SendOrderDesc ||
+		o.LocalSendTime != cm.LocalSendTime) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Cannot change the send order or the local send time of a paused campaign.")
+	}
+
+	// The initial share of a rollout that has started is fixed. Its gate
+	// can be changed until it's released.
+	if cm.Status == models.CampaignStatusPaused && o.RolloutPercent != cm.RolloutPercent {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Cannot change the rollout percentage of a paused campaign.")
+	}
 
 	_, err := app.queries.UpdateCampaign.Exec(cm.ID,
 		o.Name,
@@ -311,12 +825,53 @@ func handleUpdateCampaign(c echo.Context) error {
 		o.SendLater,
 		pq.StringArray(normalizeTags(o.Tags)),
 		o.TemplateID,
-		o.ListIDs)
+		o.ListIDs,
+		o.TrackingDomain,
+		o.Variants,
+		o.SendOrder,
+		o.SendOrderField,
+		o.SendOrderDesc,
+		o.FromName,
+		o.ExcludeSegmentID,
+		o.Priority,
+		o.AllowResend,
+		o.Charset,
+		o.TransferEncoding,
+		o.OutagePolicy,
+		o.LocalSendTime,
+		o.RolloutPercent,
+		o.RolloutGate,
+		o.UnsubRedirect,
+		o.Metadata,
+		o.AMPBody,
+		o.AltBody,
+		o.AutoAltBody,
+		o.ShortenLinks,
+		o.ErrorMode,
+		o.ErrorRate,
+		o.ErrorWindow,
+		o.MessengerID,
+		o.Category,
+		o.RolloutRate,
+		o.Recurrence,
+		o.ABTest,
+		app.constants.CampaignApproval,
+		o.Archive)
 	if err != nil {
 		app.log.Printf("error updating campaign: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error updating campaign: %s", pqErrMsg(err)))
 	}
+	if err := saveCampaignExclusions(cm.ID, o.ExcludeSubscribers, o.ExcludeSegmentID, app); err != nil {
+		app.log.Printf("error saving campaign exclusions: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign exclusions: %v", pqErrMsg(err)))
+	}
+	if err := saveCampaignSegments(cm.ID, o.SegmentIDs, app); err != nil {
+		app.log.Printf("error saving campaign segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign segments: %v", pqErrMsg(err)))
+	}
 
 	return handleGetCampaigns(c)
 }
@@ -348,12 +903,15 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 	if err := c.Bind(&o); err != nil {
 		return err
 	}
+	o.Simulate = o.Simulate || o.DryRun
 
 	errMsg := ""
 	switch o.Status {
 	case models.CampaignStatusDraft:
-		if cm.Status != models.CampaignStatusScheduled {
-			errMsg = "Only scheduled campaigns can be saved as drafts"
+		// Unstarted campaigns that are pending approval are withdrawn.
+		withdraw := cm.Status == models.CampaignStatusPendingApproval && !cm.StartedAt.Valid
+		if cm.Status != models.CampaignStatusScheduled && !withdraw {
+			errMsg = "Only scheduled campaigns and unstarted ones pending approval can be saved as drafts"
 		}
 	case models.CampaignStatusScheduled:
 		if cm.Status != models.CampaignStatusDraft {
@@ -367,13 +925,26 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 		if cm.Status != models.CampaignStatusPaused && cm.Status != models.CampaignStatusDraft {
 			errMsg = "Only paused campaigns and drafts can be started"
 		}
+		if o.Simulate && cm.Status != models.CampaignStatusDraft {
+			errMsg = "Only drafts can be simulated"
+		}
 	case models.CampaignStatusPaused:
 		if cm.Status != models.CampaignStatusRunning {
 			errMsg = "Only active campaigns can be paused"
 		}
 	case models.CampaignStatusCancelled:
-		if cm.Status != models.CampaignStatusRunning && cm.Status != models.CampaignStatusPaused {
-			errMsg = "Only active campaigns can be cancelled"
+		// Scheduled campaigns whose time is up are queued to be started.
+		queued := cm.Status == models.CampaignStatusScheduled && cm.SendAt.Valid && !cm.SendAt.Time.After(time.Now())
+		if cm.Status != models.CampaignStatusRunning && cm.Status != models.CampaignStatusPaused && !queued {
+			errMsg = "Only active and queued campaigns can be cancelled"
+		}
+	case models.CampaignStatusAborted:
+		errMsg = "Campaigns are only aborted on send errors. Cancel them instead"
+	case models.CampaignStatusPendingApproval:
+		if !app.constants.CampaignApproval {
+			errMsg = "Campaign approvals aren't enabled"
+		} else if cm.Status != models.CampaignStatusDraft && (cm.Status != models.CampaignStatusPaused || cm.Approved) {
+			errMsg = "Only drafts and unapproved paused campaigns can be submitted for approval"
 		}
 	}
 
@@ -381,6 +952,84 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, errMsg)
 	}
 
+	// Check the template's compatibility with the messenger before starting.
+	if o.Status == models.CampaignStatusRunning || o.Status == models.CampaignStatusScheduled {
+		if err := app.manager.ValidateTemplateFormat(cm.MessengerID, cm.TemplateFormat); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Cannot start campaign: %v", err))
+		}
+		if err := app.manager.ValidateFooter(&cm); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Cannot start campaign: %v", err))
+		}
+		if w, err := getCampaignSendWindows(cm, app); err != nil {
+			return err
+		} else if w.Empty {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				"Cannot start campaign: the send windows of its lists don't overlap")
+		}
+
+		// Take a fresh snapshot of the subscribers of the exclusion segment
+		// and the target segments.
+		if err := excludeCampaignSegment(cm.ID, cm.ExcludeSegmentID, app); err != nil {
+			app.log.Printf("error saving campaign exclusions: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error saving campaign exclusions: %v", pqErrMsg(err)))
+		}
+		if err := snapshotCampaignSegments(cm.ID, app); err != nil {
+			app.log.Printf("error saving campaign segments: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error saving campaign segments: %v", pqErrMsg(err)))
+		}
+
+		// Warn about the languages of subscribers that the variants
+		// of a localized campaign don't cover.
+		if w := campaignLangWarnings(cm, app); len(w) > 0 {
+			for _, s := range w {
+				app.log.Printf("campaign %s: %s", cm.Name, s)
+			}
+			c.Set(ctxCampaignWarnings, w)
+		}
+
+		// Simulations don't deliver messages and aren't confirmed.
+		simulate := o.Status == models.CampaignStatusRunning &&
+			((cm.Status == models.CampaignStatusDraft && o.Simulate) || (cm.Status == models.CampaignStatusPaused && cm.Simulate))
+		if !simulate {
+			if app.constants.CampaignApproval && !cm.Approved {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					"The campaign needs to be approved before it can be started or scheduled.")
+			}
+			if err := checkSendConfirmation(cm, o.ConfirmToken, app); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Drafts are started as simulations that don't deliver messages or for real.
+	if o.Status == models.CampaignStatusRunning && cm.Status == models.CampaignStatusDraft {
+		if _, err := app.queries.SetCampaignSimulate.Exec(cm.ID, o.Simulate); err != nil {
+			app.log.Printf("error updating campaign simulation: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error updating campaign status: %s", pqErrMsg(err)))
+		}
+	}
+
+	// Releasing a held rollout by hand before its A/B test's window has
+	// passed picks the winner as of now.
+	if o.Status == models.CampaignStatusRunning && cm.ABTest.Enabled() && cm.ABWinner < 0 &&
+		(cm.RolloutStage == models.CampaignRolloutHolding || cm.RolloutStage == models.CampaignRolloutHalted) {
+		if err := pickABWinner(cm, app); err != nil {
+			app.log.Printf("error picking A/B test winner: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error picking the A/B test winner: %s", pqErrMsg(err)))
+		}
+	}
+
+	// Submissions for approval record the submitter, who can't approve it.
+	if o.Status == models.CampaignStatusPendingApproval {
+		return requestCampaignApproval(c, cm)
+	}
+
 	res, err := app.queries.UpdateCampaignStatus.Exec(cm.ID, o.Status)
 	if err != nil {
 		app.log.Printf("error updating campaign status: %v", err)
@@ -395,9 +1044,11 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 	return handleGetCampaigns(c)
 }
 
-// handleDeleteCampaign handles campaign deletion.
-// Only scheduled campaigns that have not started yet can be deleted.
-func handleDeleteCampaign(c echo.Context) error {
+// handleApplyCampaignEdits clears the content snapshot of a paused campaign
+// so that the edits made to it since it started are sent to its remaining
+// recipients when it's resumed. With approvals, the campaign has to be
+// approved again before it's resumed.
+func handleApplyCampaignEdits(c echo.Context) error {
 	var (
 		app   = c.Get("app").(*App)
 		id, _ = strconv.Atoi(c.Param("id"))
@@ -407,25 +1058,52 @@ func handleDeleteCampaign(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
 	}
 
-	var cm models.Campaign
-	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
-		if err == sql.ErrNoRows {
-			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
-		}
-
-		app.log.Printf("error fetching campaign: %v", err)
+	res, err := app.queries.ClearCampaignSnapshot.Exec(id, app.constants.CampaignApproval)
+	if err != nil {
+		app.log.Printf("error clearing campaign snapshot: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
-			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+			fmt.Sprintf("Error applying campaign edits: %s", pqErrMsg(err)))
 	}
 
-	// Only scheduled campaigns can be deleted.
-	if cm.Status != models.CampaignStatusDraft &&
-		cm.Status != models.CampaignStatusScheduled {
+	if n, _ := res.RowsAffected(); n == 0 {
 		return echo.NewHTTPError(http.StatusBadRequest,
-			"Only campaigns that haven't been started can be deleted.")
+			"Edits can only be applied to paused campaigns that have a content snapshot.")
 	}
 
-	if _, err := app.queries.DeleteCampaign.Exec(cm.ID); err != nil {
+	return handleGetCampaigns(c)
+}
+
+// handleDeleteCampaign handles campaign deletion.
+// Only scheduled campaigns that have not started yet can be deleted.
+func handleDeleteCampaign(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	var cm models.Campaign
+	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+
+	// Only scheduled campaigns can be deleted.
+	if cm.Status != models.CampaignStatusDraft &&
+		cm.Status != models.CampaignStatusScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Only campaigns that haven't been started can be deleted.")
+	}
+
+	if _, err := app.queries.DeleteCampaign.Exec(cm.ID); err != nil {
 		app.log.Printf("error deleting campaign: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error deleting campaign: %v", pqErrMsg(err)))
@@ -434,6 +1112,24 @@ func handleDeleteCampaign(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetCampaignQueue returns the campaigns that are waiting to be started
+// under the cap on running campaigns (app.max_running_campaigns) in the order
+// in which they'll be started. Queued campaigns can be cancelled.
+func handleGetCampaignQueue(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = []queuedCampaign{}
+	)
+
+	if err := app.queries.GetCampaignQueue.Select(&out, pq.Int64Array(app.manager.GetActiveCampaignIDs())); err != nil {
+		app.log.Printf("error fetching campaign queue: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign queue: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handleGetRunningCampaignStats returns stats of a given set of campaign IDs.
 func handleGetRunningCampaignStats(c echo.Context) error {
 	var (
@@ -468,11 +1164,331 @@ func handleGetRunningCampaignStats(c echo.Context) error {
 				out[i].Rate = rate
 			}
 		}
+
+		if p, s, ok := app.manager.GetAllocation(c.ID); ok {
+			out[i].Priority = p
+			out[i].Share = s
+		}
 	}
 
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleGetCampaignLangStats returns the views and clicks of a campaign
+// broken down by its language variants.
+func handleGetCampaignLangStats(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		out   []campaignLangStats
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	// The lang stats are all-time unless a window is requested.
+	var window time.Duration
+	if c.QueryParam("window") != "" {
+		w, err := getStatsWindow(c, app)
+		if err != nil {
+			return err
+		}
+		window = w
+	}
+
+	if err := app.queries.GetCampaignLangStats.Select(&out, id, app.constants.LangAttrib,
+		int(window.Seconds())); err != nil {
+		app.log.Printf("error fetching campaign language stats: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign stats: %s", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignAnalytics returns the daily views and clicks of campaigns
+// filtered by the campaign metadata recorded with the events. `metadata`
+// params are key:value pairs, or keys that only have to exist, that all have
+// to match. `from` and `to` are inclusive dates (YYYY-MM-DD) that default to
+// the last 30 days.
+func handleGetCampaignAnalytics(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out = []campaignAnalytics{}
+
+		keys = []string{}
+		vals = []string{}
+	)
+
+	for _, m := range c.QueryParams()["metadata"] {
+		kv := strings.SplitN(m, ":", 2)
+		k := strings.TrimSpace(kv[0])
+		if k == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `metadata`.")
+		}
+		v := ""
+		if len(kv) == 2 {
+			v = kv[1]
+		}
+		keys = append(keys, k)
+		vals = append(vals, v)
+	}
+
+	now := time.Now()
+	to := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if v := c.QueryParam("to"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, now.Location())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `to`.")
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -29)
+	if v := c.QueryParam("from"); v != "" {
+		t, err := time.ParseInLocation("2006-01-02", v, now.Location())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `from`.")
+		}
+		from = t
+	}
+	if from.After(to) {
+		return echo.NewHTTPError(http.StatusBadRequest, "`from` should be before `to`.")
+	}
+
+	if err := app.queries.GetCampaignAnalytics.Select(&out, pq.StringArray(keys), pq.StringArray(vals),
+		from, to.AddDate(0, 0, 1)); err != nil {
+		app.log.Printf("error fetching campaign analytics: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign analytics: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignFailures returns the counts of the recipients of a campaign
+// that it failed to be sent to, that can be resent to with a follow-up to the
+// 'failed' audience, and that have failed permanently.
+func handleGetCampaignFailures(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		out   campaignFailureCounts
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetCampaignFailureCounts.Get(&out, id); err != nil {
+		app.log.Printf("error fetching campaign failures: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign failures: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignRecipients returns the number of subscribers a campaign
+// would be sent to after its exclusions.
+func handleGetCampaignRecipients(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		out   campaignRecipientCounts
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetCampaignRecipientCounts.Get(&out, id); err != nil {
+		app.log.Printf("error fetching campaign recipients: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign recipients: %s", pqErrMsg(err)))
+	}
+	out.Count = out.Total - out.Excluded
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignSendWindows returns the send windows of the lists of a
+// campaign and its effective next send time.
+func handleGetCampaignSendWindows(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	var cm models.Campaign
+	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+
+	out, err := getCampaignSendWindows(cm, app)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetCampaignLocalSend returns the timezones of the recipients of a
+// campaign with a local send time, when they're sent the campaign, and how
+// many of them it was delivered to.
+func handleGetCampaignLocalSend(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	var cm models.Campaign
+	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+	if cm.LocalSendTime == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "The campaign doesn't have a local send time.")
+	}
+
+	out := campaignLocalSend{LocalSendTime: cm.LocalSendTime, Buckets: []models.LocalSendBucket{}}
+	if err := app.queries.GetCampaignLocalSend.Select(&out.Buckets, id,
+		app.constants.LocalSendAttrib, app.constants.LocalSendTZ); err != nil {
+		app.log.Printf("error fetching campaign local send times: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign local send times: %s", pqErrMsg(err)))
+	}
+
+	now := time.Now()
+	for _, b := range out.Buckets {
+		out.Total += b.Total
+		out.Delivered += b.Delivered
+		if !out.NextSendAt.Valid && b.SendAt.After(now) {
+			out.NextSendAt = null.TimeFrom(b.SendAt)
+		}
+	}
+	if n := len(out.Buckets); n > 0 {
+		out.EndsAt = null.TimeFrom(out.Buckets[n-1].SendAt)
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCampaignEvents streams the live progress of a campaign as
+// server-sent events until the campaign stops processing or the client
+// disconnects. Campaigns that aren't running get a single event.
+func handleCampaignEvents(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	// Subscribe before looking up the campaign so that it
+	// can't stop processing in between unnoticed.
+	ch, unsub := app.manager.SubscribeProgress(id)
+	defer unsub()
+
+	p, ok := app.manager.GetProgress(id)
+	if !ok {
+		var cm models.Campaign
+		if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+			if err == sql.ErrNoRows {
+				return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+			}
+
+			app.log.Printf("error fetching campaign: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+		}
+
+		p = manager.CampaignProgress{
+			CampaignID: cm.ID,
+			Status:     cm.Status,
+			ToSend:     cm.ToSend,
+			Sent:       cm.Sent,
+			Done:       cm.Status != models.CampaignStatusRunning,
+		}
+	}
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	if err := writeProgressEvent(w, p); err != nil || p.Done {
+		return nil
+	}
+
+	// Keep the connection alive through proxies while
+	// the campaign waits to be picked up.
+	ping := time.NewTicker(sseKeepAliveInterval)
+	defer ping.Stop()
+
+	done := c.Request().Context().Done()
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if err := writeProgressEvent(w, p); err != nil || p.Done {
+				return nil
+			}
+
+		case <-ping.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return nil
+			}
+			w.Flush()
+
+		case <-done:
+			return nil
+
+		// Clients reconnect to another instance.
+		case <-httpShutdown:
+			return nil
+		}
+	}
+}
+
+// writeProgressEvent writes a campaign progress snapshot as a server-sent
+// event and flushes it.
+func writeProgressEvent(w *echo.Response, p manager.CampaignProgress) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "event: progress\ndata: %s\n\n", b); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
 // handleTestCampaign handles the sending of a campaign message to
 // arbitrary subscribers for testing.
 func handleTestCampaign(c echo.Context) error {
@@ -529,7 +1545,16 @@ func handleTestCampaign(c echo.Context) error {
 	camp.Name = req.Name
 	camp.Subject = req.Subject
 	camp.FromEmail = req.FromEmail
+	camp.FromName = req.FromName
 	camp.Body = req.Body
+	camp.AMPBody = strings.TrimSpace(req.AMPBody)
+	if camp.AMPBody != "" {
+		if err := models.ValidateAMP(camp.AMPBody); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid `amp_body`: %v", err))
+		}
+	}
+	camp.AltBody = strings.TrimSpace(req.AltBody)
+	camp.AutoAltBody = req.AutoAltBody
 
 	// Send the test messages.
 	for _, s := range subs {
@@ -545,7 +1570,7 @@ func handleTestCampaign(c echo.Context) error {
 
 // sendTestMessage takes a campaign and a subsriber and sends out a sample campaign message.
 func sendTestMessage(sub models.Subscriber, camp *models.Campaign, app *App) error {
-	if err := camp.CompileTemplate(app.manager.TemplateFuncs(camp)); err != nil {
+	if err := app.manager.CompileTemplate(camp); err != nil {
 		app.log.Printf("error compiling template: %v", err)
 		return fmt.Errorf("Error compiling template: %v", err)
 	}
@@ -558,18 +1583,78 @@ func sendTestMessage(sub models.Subscriber, camp *models.Campaign, app *App) err
 			fmt.Sprintf("Error rendering message: %v", err))
 	}
 
-	if err := app.messenger.Push(camp.FromEmail,
-		[]string{sub.Email},
-		m.Subject(),
-		m.Body(), nil); err != nil {
+	body, err := app.manager.Transform(app.messenger.Name(), m.Body())
+	if err != nil {
+		return err
+	}
+
+	if err := app.messenger.Push(messenger.Message{
+		From:       m.From(),
+		To:         []string{sub.Email},
+		Subject:    m.Subject(),
+		Body:       body,
+		AMP:        m.AMP(),
+		AltBody:    m.AltBody(),
+		Campaign:   camp,
+		Subscriber: &sub,
+	}); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// listsMessenger returns the default messenger of campaigns sent to the
+// given lists, which is the one default messenger of the lists, if any, or
+// the global default messenger. Lists with different default messengers
+// require campaigns to explicitly set a messenger.
+func listsMessenger(listIDs pq.Int64Array, app *App) (string, error) {
+	var ms pq.StringArray
+	if len(listIDs) > 0 {
+		if err := app.queries.GetListsMessengers.Get(&ms, listIDs); err != nil {
+			app.log.Printf("error fetching list messengers: %v", err)
+			return "", fmt.Errorf("error fetching list messengers: %s", pqErrMsg(err))
+		}
+	}
+
+	switch len(ms) {
+	case 0:
+		return app.constants.DefMessenger, nil
+	case 1:
+		return ms[0], nil
+	}
+	return "", fmt.Errorf("the lists have different default messengers (%s). Set a `messenger` for the campaign",
+		strings.Join(ms, ", "))
+}
+
+// messengerWarnings returns a warning for a campaign whose messenger
+// overrides the default messenger of its lists.
+func messengerWarnings(c campaignReq, app *App) []string {
+	if len(c.ListIDs) == 0 {
+		return nil
+	}
+
+	var ms pq.StringArray
+	if err := app.queries.GetListsMessengers.Get(&ms, c.ListIDs); err != nil {
+		app.log.Printf("error fetching list messengers: %v", err)
+		return nil
+	}
+	if len(ms) == 1 && ms[0] != c.MessengerID {
+		return []string{fmt.Sprintf("The messenger '%s' overrides the default messenger '%s' of the campaign's lists.",
+			c.MessengerID, ms[0])}
+	}
+	return nil
+}
+
 // validateCampaignFields validates incoming campaign field values.
 func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
+	if c.MessengerID == "" {
+		m, err := listsMessenger(c.ListIDs, app)
+		if err != nil {
+			return c, err
+		}
+		c.MessengerID = m
+	}
 	if c.FromEmail == "" {
 		c.FromEmail = app.constants.FromEmail
 	} else if !regexFromAddress.Match([]byte(c.FromEmail)) {
@@ -581,6 +1666,7 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 	if !strHasLen(c.Name, 1, stdInputMaxLen) {
 		return c, errors.New("invalid length for `name`")
 	}
+	c.Subject = normalizeSubject(c.Subject)
 	if !strHasLen(c.Subject, 1, stdInputMaxLen) {
 		return c, errors.New("invalid length for `subject`")
 	}
@@ -596,24 +1682,374 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 		}
 	}
 
-	if len(c.ListIDs) == 0 {
-		return c, errors.New("no lists selected")
+	if len(c.ListIDs) == 0 && len(c.SegmentIDs) == 0 {
+		return c, errors.New("no lists or segments selected")
+	}
+
+	c, err := validateCategory(c)
+	if err != nil {
+		return c, err
+	}
+
+	// The first occurrence of a recurring campaign without a send_at is
+	// its next one.
+	c.Recurrence = strings.TrimSpace(c.Recurrence)
+	if c.Recurrence != "" {
+		s, err := cron.ParseRule(c.Recurrence)
+		if err != nil {
+			return c, fmt.Errorf("invalid `recurrence`: %v", err)
+		}
+		next := s.Next(time.Now())
+		if next.IsZero() {
+			return c, errors.New("`recurrence` never occurs")
+		}
+		if !c.SendAt.Valid {
+			c.SendAt = null.TimeFrom(next)
+			c.SendLater = true
+		}
+	}
+
+	c.TrackingDomain = strings.ToLower(strings.TrimSpace(c.TrackingDomain))
+	if c.TrackingDomain != "" {
+		if _, ok := app.constants.TrackingDomains[c.TrackingDomain]; !ok {
+			return c, fmt.Errorf("unknown tracking domain '%s'", c.TrackingDomain)
+		}
+	}
+
+	switch c.SendOrder {
+	case "":
+		c.SendOrder = models.CampaignSendOrderID
+		c.SendOrderField = ""
+	case models.CampaignSendOrderID, models.CampaignSendOrderRandom:
+		c.SendOrderField = ""
+	case models.CampaignSendOrderField:
+		c.SendOrderField = strings.TrimSpace(c.SendOrderField)
+		if !sendOrderColumns[c.SendOrderField] && !regexSendOrderAttrib.MatchString(c.SendOrderField) {
+			return c, fmt.Errorf("invalid `send_order_field` '%s'", c.SendOrderField)
+		}
+	default:
+		return c, fmt.Errorf("unknown `send_order` '%s'", c.SendOrder)
+	}
+
+	// Local sends are ordered by the send times of subscribers, which
+	// can't be combined with the other send orders.
+	c.LocalSendTime = strings.TrimSpace(c.LocalSendTime)
+	if c.LocalSendTime != "" {
+		t, err := time.Parse("15:04", c.LocalSendTime)
+		if err != nil {
+			return c, fmt.Errorf("invalid `local_send_time` '%s'. Should be HH:MM", c.LocalSendTime)
+		}
+		c.LocalSendTime = t.Format("15:04")
+
+		if c.SendOrder != models.CampaignSendOrderID || c.SendOrderDesc {
+			return c, errors.New("`local_send_time` can only be used with the ID send order")
+		}
+	}
+
+	if c.RolloutPercent < 0 || c.RolloutPercent > 99 {
+		return c, errors.New("`rollout_percent` should be between 1 and 99, or 0 to send to everyone")
+	}
+	if err := c.RolloutGate.Validate(); err != nil {
+		return c, fmt.Errorf("invalid `rollout_gate`: %v", err)
+	}
+	if c.RolloutRate < 0 {
+		return c, errors.New("invalid `rollout_rate`")
+	}
+	if c.RolloutRate > 0 && c.RolloutPercent == 0 {
+		return c, errors.New("`rollout_rate` can only be used with a `rollout_percent`")
+	}
+	if err := c.ABTest.Validate(); err != nil {
+		return c, fmt.Errorf("invalid `ab_test`: %v", err)
+	}
+	if c.ABTest.Enabled() {
+		if c.RolloutPercent == 0 {
+			return c, errors.New("`ab_test` is sent to the `rollout_percent` sample, which should be set")
+		}
+		if len(c.Variants) > 0 {
+			return c, errors.New("`ab_test` can't be used with language variants")
+		}
+	}
+
+	c.UnsubRedirect = strings.TrimSpace(c.UnsubRedirect)
+	if err := validateUnsubRedirect(c.UnsubRedirect, app); err != nil {
+		return c, fmt.Errorf("invalid `unsubscribe_redirect`: %v", err)
+	}
+
+	c.AltBody = strings.TrimSpace(c.AltBody)
+	c.AMPBody = strings.TrimSpace(c.AMPBody)
+	if c.AMPBody != "" {
+		if err := models.ValidateAMP(c.AMPBody); err != nil {
+			return c, fmt.Errorf("invalid `amp_body`: %v", err)
+		}
+	}
+
+	if len(c.Metadata) == 0 {
+		c.Metadata = types.JSONText(`{}`)
+	}
+	var meta map[string]interface{}
+	if err := json.Unmarshal(c.Metadata, &meta); err != nil || meta == nil {
+		return c, errors.New("`metadata` should be a JSON object")
+	}
+
+	// Empty values use the defaults.
+	if c.Charset != "" || c.TransferEncoding != "" {
+		cs, enc, err := smtppool.NormalizeEncoding(c.Charset, c.TransferEncoding)
+		if err != nil {
+			return c, err
+		}
+		if c.Charset != "" {
+			c.Charset = cs
+		}
+		if c.TransferEncoding != "" {
+			c.TransferEncoding = enc
+		}
+	}
+
+	switch c.OutagePolicy {
+	case "", models.CampaignOutagePause, models.CampaignOutageCancel, models.CampaignOutageContinue:
+	default:
+		return c, fmt.Errorf("unknown `outage_policy` '%s'. Should be pause, cancel, or continue", c.OutagePolicy)
 	}
 
+	switch c.ErrorMode {
+	case "", models.CampaignErrorModeCount, models.CampaignErrorModeRate:
+	default:
+		return c, fmt.Errorf("unknown `error_mode` '%s'. Should be count or rate", c.ErrorMode)
+	}
+	if c.ErrorRate < 0 || c.ErrorRate > 100 {
+		return c, errors.New("`error_rate` should be between 0 and 100")
+	}
+	if c.ErrorWindow < 0 || c.ErrorWindow > manager.MaxErrorWindow {
+		return c, fmt.Errorf("`error_window` should be between 0 and %d", manager.MaxErrorWindow)
+	}
+
+	if c.Priority == 0 {
+		c.Priority = models.CampaignPriorityDefault
+	} else if c.Priority < models.CampaignPriorityMin || c.Priority > models.CampaignPriorityMax {
+		return c, fmt.Errorf("`priority` should be between %d and %d",
+			models.CampaignPriorityMin, models.CampaignPriorityMax)
+	}
+
+	// Language variants.
+	vars := make(models.CampaignVariants, len(c.Variants))
+	for lang, v := range c.Variants {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if !regexLangCode.MatchString(lang) {
+			return c, fmt.Errorf("invalid variant language code '%s'", lang)
+		}
+		if _, ok := vars[lang]; ok {
+			return c, fmt.Errorf("duplicate variant '%s'", lang)
+		}
+		// Variants without a subject get the default one.
+		v.Subject = normalizeSubject(v.Subject)
+		if len(v.Subject) > stdInputMaxLen {
+			return c, fmt.Errorf("invalid length for `subject` of variant '%s'", lang)
+		}
+		if v.Body == "" {
+			return c, fmt.Errorf("empty `body` for variant '%s'", lang)
+		}
+		vars[lang] = v
+	}
+	c.Variants = vars
+
 	camp := models.Campaign{Body: c.Body, TemplateBody: tplTag}
 	if err := c.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
 		return c, fmt.Errorf("Error compiling campaign body: %v", err)
 	}
 
+	c.FromName = strings.TrimSpace(c.FromName)
+	if err := validateFromName(c.FromName, c.FromEmail, app); err != nil {
+		return c, fmt.Errorf("invalid `from_name`: %v", err)
+	}
+
+	if c.ExcludeSegmentID.Int > 0 {
+		var segs []models.Segment
+		if err := app.queries.GetSegments.Select(&segs, c.ExcludeSegmentID.Int); err != nil {
+			return c, fmt.Errorf("error fetching `exclude_segment_id`: %v", pqErrMsg(err))
+		}
+		if len(segs) == 0 {
+			return c, errors.New("unknown `exclude_segment_id`")
+		}
+	} else {
+		c.ExcludeSegmentID = null.Int{}
+	}
+
+	for _, id := range c.SegmentIDs {
+		var segs []models.Segment
+		if err := app.queries.GetSegments.Select(&segs, id); err != nil {
+			return c, fmt.Errorf("error fetching `segment_ids`: %v", pqErrMsg(err))
+		}
+		if id < 1 || len(segs) == 0 {
+			return c, fmt.Errorf("unknown segment %d in `segment_ids`", id)
+		}
+	}
+
 	return c, nil
 }
 
+// saveCampaignExclusions replaces the explicitly excluded subscribers of a
+// campaign and the snapshot of its exclusion segment's subscribers.
+func saveCampaignExclusions(campID int, subIDs pq.Int64Array, segID null.Int, app *App) error {
+	if subIDs == nil {
+		subIDs = pq.Int64Array{}
+	}
+	if _, err := app.queries.SetCampaignExclusions.Exec(campID, subIDs); err != nil {
+		return err
+	}
+	return excludeCampaignSegment(campID, segID, app)
+}
+
+// excludeCampaignSegment replaces the excluded subscribers of a campaign that
+// were copied from its exclusion segment with the segment's current subscribers.
+// Subscribers that join the segment later are excluded only when the campaign
+// is saved, scheduled, or started again.
+func excludeCampaignSegment(campID int, segID null.Int, app *App) error {
+	var (
+		exp  string
+		args []interface{}
+	)
+	if segID.Valid {
+		var segs []models.Segment
+		if err := app.queries.GetSegments.Select(&segs, segID.Int); err != nil {
+			return err
+		}
+		if len(segs) > 0 {
+			e, a, err := compileCampaignSegment(segs[0], app)
+			if err != nil {
+				return err
+			}
+			exp, args = e, append([]interface{}{campID}, a...)
+		}
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(app.queries.DeleteCampaignSegmentExclusions).Exec(campID); err != nil {
+		return err
+	}
+	if exp != "" {
+		if _, err := tx.Exec(fmt.Sprintf(app.queries.AddCampaignSegmentExclusions, exp), args...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// saveCampaignSegments replaces the segments that a campaign is sent to and
+// the snapshot of their subscribers.
+func saveCampaignSegments(campID int, segIDs pq.Int64Array, app *App) error {
+	if segIDs == nil {
+		segIDs = pq.Int64Array{}
+	}
+	if _, err := app.queries.SetCampaignSegments.Exec(campID, segIDs); err != nil {
+		return err
+	}
+	return snapshotCampaignSegments(campID, app)
+}
+
+// snapshotCampaignSegments replaces the copied subscribers of a campaign's
+// segments with the segments' current subscribers. The subscribers are
+// deduplicated by their IDs with each other and with the subscribers of the
+// campaign's lists when the campaign is sent. Subscribers that join the
+// segments later are sent to only when the campaign is saved, scheduled, or
+// started again.
+func snapshotCampaignSegments(campID int, app *App) error {
+	var segs []models.Segment
+	if err := app.queries.GetCampaignSegments.Select(&segs, campID); err != nil {
+		return err
+	}
+
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(app.queries.DeleteCampaignSegmentSubscribers).Exec(campID); err != nil {
+		return err
+	}
+	for _, s := range segs {
+		exp, args, err := compileCampaignSegment(s, app)
+		if err != nil {
+			return fmt.Errorf("segment '%s': %v", s.Name, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(app.queries.AddCampaignSegmentSubscribers, exp),
+			append([]interface{}{campID}, args...)...); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// compileCampaignSegment compiles the rules of a segment into an expression
+// whose arguments start from $2, after the campaign ID.
+func compileCampaignSegment(s models.Segment, app *App) (string, []interface{}, error) {
+	var r segment.Rule
+	if err := json.Unmarshal(s.Rules, &r); err != nil {
+		return "", nil, fmt.Errorf("error reading segment rules: %v", err)
+	}
+
+	exp, args, err := segment.Compile(r, 1, app.attribIndexes.Keys())
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid segment rules: %v", err)
+	}
+	return exp, args, nil
+}
+
+// getCampaignSendWindows returns the send windows of the lists of a
+// campaign and when it can be sent next.
+func getCampaignSendWindows(cm models.Campaign, app *App) (campaignSendWindows, error) {
+	out := campaignSendWindows{Windows: models.CampaignSendWindows{}}
+	if err := app.queries.GetCampaignSendWindows.Get(&out.Windows, cm.ID); err != nil {
+		app.log.Printf("error fetching campaign send windows: %v", err)
+		return out, echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign send windows: %s", pqErrMsg(err)))
+	}
+
+	now := time.Now()
+	out.Open = out.Windows.Contains(now)
+
+	from := now
+	if cm.Status == models.CampaignStatusScheduled && cm.SendAt.Valid && cm.SendAt.Time.After(now) {
+		from = cm.SendAt.Time
+	}
+	if t, ok := out.Windows.NextOpen(from); ok {
+		out.NextSendAt = null.TimeFrom(t)
+	} else {
+		out.Empty = true
+	}
+	return out, nil
+}
+
+// validateFromName checks whether a from-name template compiles and renders
+// into a valid From header with the given from e-mail for a dummy subscriber.
+func validateFromName(name, fromEmail string, app *App) error {
+	if name == "" {
+		return nil
+	}
+	if !strHasLen(name, 1, stdInputMaxLen) {
+		return errors.New("invalid length")
+	}
+
+	camp := models.Campaign{FromName: name, FromEmail: fromEmail, TemplateBody: tplTag}
+	if err := camp.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
+		return err
+	}
+	msg := app.manager.NewCampaignMessage(&camp, dummySubscriber)
+	return msg.RenderFrom()
+}
+
 // isCampaignalMutable tells if a campaign's in a state where it's
 // properties can be mutated.
 func isCampaignalMutable(status string) bool {
 	return status == models.CampaignStatusRunning ||
 		status == models.CampaignStatusCancelled ||
-		status == models.CampaignStatusFinished
+		status == models.CampaignStatusFinished ||
+		status == models.CampaignStatusAborted
 }
 
 // makeOptinCampaignMessage makes a default opt-in campaign message body.
@@ -665,3 +2101,19 @@ func makeOptinCampaignMessage(o campaignReq, app *App) (campaignReq, error) {
 	o.Body = b.String()
 	return o, nil
 }
+
+// getStatsWindow returns the attribution window of the campaign stats from
+// the optional `window` param (eg: 72h, 0 for all-time stats only) or the
+// default window (app.attribution_window).
+func getStatsWindow(c echo.Context, app *App) (time.Duration, error) {
+	v := c.QueryParam("window")
+	if v == "" {
+		return app.constants.AttributionWindow, nil
+	}
+
+	w, err := time.ParseDuration(v)
+	if err != nil || w < 0 {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "Invalid `window`.")
+	}
+	return w, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// campaignCategories are the categories that campaigns are classified by.
+var campaignCategories = []string{
+	models.CampaignCategoryTransactional,
+	models.CampaignCategoryNewsletter,
+	models.CampaignCategoryPromotional,
+}
+
+// categoryConf contains the defaults of new campaigns of a category.
+type categoryConf struct {
+	// ID of the template of new campaigns without one. It takes precedence
+	// over the default template of the campaign's messenger. 0 doesn't set it.
+	Template int `koanf:"template"`
+
+	// Branding of new campaigns without a from e-mail or name.
+	FromEmail string `koanf:"from_email"`
+	FromName  string `koanf:"from_name"`
+
+	// Footers that are appended to the bodies (and language variants) of
+	// new campaigns. FooterPlain is used for plain text campaigns.
+	Footer      string `koanf:"footer"`
+	FooterPlain string `koanf:"footer_plain"`
+}
+
+// isCampaignCategory checks whether a name is that of a campaign category.
+func isCampaignCategory(name string) bool {
+	for _, c := range campaignCategories {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCategory validates the category of a campaign, which is optional.
+func validateCategory(c campaignReq) (campaignReq, error) {
+	c.Category = strings.ToLower(strings.TrimSpace(c.Category))
+	if c.Category != "" && !isCampaignCategory(c.Category) {
+		return c, fmt.Errorf("invalid `category` '%s'. Should be one of %s",
+			c.Category, strings.Join(campaignCategories, ", "))
+	}
+	return c, nil
+}
+
+// applyCategoryDefaults applies the configured defaults of a new campaign's
+// category (template, branding, and footer) to the fields that the campaign
+// doesn't set. They're only applied on creation and can be edited after.
+func applyCategoryDefaults(c campaignReq, app *App) campaignReq {
+	d, ok := app.constants.Categories[c.Category]
+	if !ok {
+		return c
+	}
+
+	if c.TemplateID == 0 {
+		c.TemplateID = d.Template
+	}
+	if c.FromEmail == "" {
+		c.FromEmail = d.FromEmail
+	}
+	if c.FromName == "" {
+		c.FromName = d.FromName
+	}
+
+	footer := d.Footer
+	if c.ContentType == "plain" {
+		footer = d.FooterPlain
+	}
+	if footer == "" {
+		return c
+	}
+	c.Body = withCategoryFooter(c.Body, footer)
+	if len(c.Variants) > 0 {
+		vars := make(models.CampaignVariants, len(c.Variants))
+		for lang, v := range c.Variants {
+			if v.Body != "" {
+				v.Body = withCategoryFooter(v.Body, footer)
+			}
+			vars[lang] = v
+		}
+		c.Variants = vars
+	}
+	return c
+}
+
+// withCategoryFooter appends a category footer to a body that doesn't
+// already have it.
+func withCategoryFooter(body, footer string) string {
+	if strings.Contains(body, footer) {
+		return body
+	}
+	return body + "\n" + footer
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/labstack/echo"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// maxEventBodySize is the maximum size of webhook requests from the
+// e-mail provider.
+const maxEventBodySize = 1 << 20
+
+// regexpTrackedLink matches the path of listmonk's link tracking URLs,
+// whose clicks are recorded when they're redirected.
+var regexpTrackedLink = regexp.MustCompile(`/link/[0-9a-fA-F-]{36}/[0-9a-fA-F-]{36}/[0-9a-fA-F-]{36}$`)
+
+// Actions on spam complaints.
+const (
+	complaintUnsubscribe = "unsubscribe"
+	complaintBlacklist   = "blacklist"
+	complaintNone        = "none"
+)
+
+// eventsConf represents the webhook of the e-mail provider's events.
+// ComplaintAction is what's done to subscribers who complain and
+// ComplaintNotify, whether admins are notified of complaints.
+type eventsConf struct {
+	Name     string
+	Secret   string
+	Provider events.Provider
+
+	ComplaintAction string
+	ComplaintNotify bool
+}
+
+// complaint represents a spam complaint that has been acted on. Unsubscribed
+// is the number of lists that the subscriber was unsubscribed from.
+type complaint struct {
+	SubscriberID   int         `db:"subscriber_id" json:"subscriber_id"`
+	SubscriberUUID string      `db:"subscriber_uuid" json:"subscriber_uuid"`
+	CampaignID     null.Int    `db:"campaign_id" json:"campaign_id"`
+	CampaignName   null.String `db:"campaign_name" json:"campaign_name"`
+	Unsubscribed   int         `db:"unsubscribed" json:"unsubscribed"`
+	Action         string      `db:"-" json:"action"`
+}
+
+// handleProviderEvents handles a webhook request from the e-mail provider
+// and records its bounces, complaints, opens, and clicks. The request should
+// have the secret as the password of basic auth or as the token param.
+func handleProviderEvents(c echo.Context) error {
+	app := c.Get("app").(*App)
+	if app.events == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "The feature is not available.")
+	}
+
+	token := c.QueryParam("token")
+	if _, pwd, ok := c.Request().BasicAuth(); ok {
+		token = pwd
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(app.events.Secret)) != 1 {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid token.")
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxEventBodySize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Error reading request.")
+	}
+
+	evs, err := app.events.Provider.Parse(b)
+	if err != nil {
+		if cErr, ok := err.(*events.ConfirmError); ok {
+			if err := confirmEventsSubscription(cErr.URL); err != nil {
+				app.log.Printf("events: error confirming %s webhook subscription: %v", app.events.Name, err)
+				return echo.NewHTTPError(http.StatusBadRequest, "Error confirming subscription.")
+			}
+			app.log.Printf("events: confirmed %s webhook subscription", app.events.Name)
+			return c.JSON(http.StatusOK, okResp{true})
+		}
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error parsing %s events: %v", app.events.Name, err))
+	}
+
+	for _, e := range evs {
+		if err := recordProviderEvent(e, app); err != nil {
+			app.log.Printf("events: error recording %s %s of %s: %v", app.events.Name, e.Type, e.Email, err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error recording events.")
+		}
+	}
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// recordProviderEvent records a bounce or a complaint as a bounce of the
+// subscriber and an open or a click as a campaign view or a link click.
+// Soft bounces and events that can't be attributed are skipped.
+func recordProviderEvent(e events.Event, app *App) error {
+	// Tags that aren't UUIDs would fail the queries.
+	if !reUUID.MatchString(e.CampaignUUID) {
+		e.CampaignUUID = ""
+	}
+	if !reUUID.MatchString(e.SubscriberUUID) {
+		e.SubscriberUUID = ""
+	}
+
+	switch e.Type {
+	case events.TypeBounce, events.TypeComplaint:
+		if e.Soft {
+			return nil
+		}
+
+		meta, err := json.Marshal(e.Meta)
+		if err != nil {
+			return err
+		}
+
+		var id int64
+		if err := app.queries.InsertBounce.Get(&id, e.SubscriberUUID, e.Email,
+			e.CampaignUUID, app.events.Name, types.JSONText(meta), e.Type); err != nil {
+			if err == sql.ErrNoRows {
+				app.log.Printf("events: skipping %s of %s: no matching subscriber", e.Type, e.Email)
+				return nil
+			}
+			return err
+		}
+		if e.Type == events.TypeComplaint {
+			return handleComplaint(id, app)
+		}
+
+	case events.TypeOpen, events.TypeClick:
+		if app.constants.Privacy.DisableTracking {
+			return nil
+		}
+		if e.CampaignUUID == "" || e.SubscriberUUID == "" {
+			app.log.Printf("events: skipping %s of %s on an untagged message", e.Type, e.Email)
+			return nil
+		}
+		reengageWinbacks(e.SubscriberUUID, app)
+		if e.Type == events.TypeOpen {
+			if _, err := app.queries.RegisterCampaignView.Exec(e.CampaignUUID, e.SubscriberUUID); err != nil {
+				return err
+			}
+			go pushTrackingEvent(webhooks.EventCampaignViewed, e.CampaignUUID, e.SubscriberUUID, "", "", app.events.Name, app)
+			return nil
+		}
+
+		// Tracked links are recorded on the redirect.
+		if e.URL == "" || regexpTrackedLink.MatchString(strings.SplitN(e.URL, "?", 2)[0]) {
+			return nil
+		}
+		uu, err := uuid.NewV4()
+		if err != nil {
+			return err
+		}
+		if _, err := app.queries.RegisterProviderLinkClick.Exec(e.URL, e.CampaignUUID, e.SubscriberUUID, uu.String()); err != nil {
+			return err
+		}
+		go pushTrackingEvent(webhooks.EventLinkClicked, e.CampaignUUID, e.SubscriberUUID, "", e.URL, app.events.Name, app)
+		return nil
+	}
+	return nil
+}
+
+// handleComplaint acts on a recorded spam complaint with the configured
+// action and notifies the admins if it's enabled.
+func handleComplaint(bounceID int64, app *App) error {
+	out := complaint{Action: app.events.ComplaintAction}
+	if err := app.queries.UnsubscribeComplaint.Get(&out, bounceID, out.Action); err != nil {
+		if err == sql.ErrNoRows {
+			return nil
+		}
+		return err
+	}
+
+	switch {
+	case out.Action == complaintBlacklist:
+		onStatusTransition(webhooks.EventSubscriberBlacklisted, nil, []string{out.SubscriberUUID}, app)
+	case out.Unsubscribed > 0:
+		onStatusTransition(webhooks.EventSubscriberUnsubscribed, nil, []string{out.SubscriberUUID}, app)
+	}
+	app.log.Printf("events: %s complaint by subscriber %d on campaign %s (%s)",
+		app.events.Name, out.SubscriberID, out.CampaignName.String, out.Action)
+
+	if app.events.ComplaintNotify {
+		app.sendNotification(app.constants.NotifyEmails,
+			fmt.Sprintf("Spam complaint: %s", out.CampaignName.String), notifTplComplaint, out)
+	}
+	return nil
+}
+
+// confirmEventsSubscription confirms a webhook subscription, eg: of AWS SNS,
+// by requesting its confirmation URL on an AWS host.
+func confirmEventsSubscription(u string) error {
+	p, err := url.Parse(u)
+	if err != nil {
+		return err
+	}
+	if p.Scheme != "https" || !strings.HasSuffix(p.Hostname(), ".amazonaws.com") {
+		return fmt.Errorf("unexpected confirmation URL %s", u)
+	}
+
+	cl := http.Client{Timeout: 10 * time.Second}
+	resp, err := cl.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("confirmation URL returned %d", resp.StatusCode)
+	}
+	return nil
+}
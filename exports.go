@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/listmonk/internal/cron"
+	"github.com/knadh/listmonk/internal/jobs"
+	"github.com/knadh/listmonk/internal/media"
+	"github.com/lib/pq"
+)
+
+// jobTypeExport is the job type of scheduled exports.
+const jobTypeExport = "export"
+
+// Export entities and formats.
+const (
+	exportSubscribers = "subscribers"
+	exportCampaigns   = "campaigns"
+
+	exportCSV  = "csv"
+	exportJSON = "json"
+)
+
+// exportProgressRows is the number of rows after which the progress
+// of an export is recorded and its cancellation is checked.
+const exportProgressRows = 1000
+
+// exportChunkIDs is the size of the ranges of IDs that the records of
+// exports with more than one worker are fetched in.
+const exportChunkIDs = 10000
+
+// exportAttribPrefix is the prefix of the fields of subscriber exports
+// that are the values of single attribute keys, eg: attribs.city.
+const exportAttribPrefix = "attribs."
+
+// exportField is a field that can be exported and its SQL expression.
+// Item is the item of the privacy.exportable allowlist that the field
+// belongs to, if any. Fields of items that aren't allowed can't be exported.
+type exportField struct {
+	Name string
+	Expr string
+	Item string
+}
+
+// exportFields are the fields of each entity that can be exported
+// in the order in which they're exported by default.
+var exportFields = map[string][]exportField{
+	exportSubscribers: {
+		{"id", "subscribers.id", "profile"},
+		{"uuid", "subscribers.uuid", "profile"},
+		{"email", "subscribers.email", "profile"},
+		{"name", "subscribers.name", "profile"},
+		{"attribs", "subscribers.attribs", "profile"},
+		{"status", "subscribers.status", "profile"},
+		{"lists", `(SELECT COALESCE(JSON_AGG(lists.name ORDER BY lists.name), '[]') FROM subscriber_lists
+			LEFT JOIN lists ON (lists.id = subscriber_lists.list_id)
+			WHERE subscriber_lists.subscriber_id = subscribers.id AND subscriber_lists.status != 'unsubscribed')`, "subscriptions"},
+		{"created_at", "subscribers.created_at", "profile"},
+		{"updated_at", "subscribers.updated_at", "profile"},
+	},
+	exportCampaigns: {
+		{"id", "campaigns.id", ""},
+		{"uuid", "campaigns.uuid", ""},
+		{"name", "campaigns.name", ""},
+		{"subject", "campaigns.subject", ""},
+		{"status", "campaigns.status", ""},
+		{"type", "campaigns.type", ""},
+		{"messenger", "campaigns.messenger", ""},
+		{"tags", "campaigns.tags", ""},
+		{"to_send", "campaigns.to_send", ""},
+		{"sent", "campaigns.sent", ""},
+		{"views", "v.num", ""},
+		{"clicks", "c.num", ""},
+		{"send_at", "campaigns.send_at", ""},
+		{"started_at", "campaigns.started_at", ""},
+		{"created_at", "campaigns.created_at", ""},
+		{"updated_at", "campaigns.updated_at", ""},
+	},
+}
+
+// exportConf represents a scheduled export.
+type exportConf struct {
+	Name     string   `koanf:"-"`
+	Schedule string   `koanf:"schedule"`
+	Entity   string   `koanf:"entity"`
+	Format   string   `koanf:"format"`
+	Fields   []string `koanf:"fields"`
+
+	// The single character delimiter of CSV files and whether they have
+	// a header row of the field names.
+	Delimiter string `koanf:"delimiter"`
+	Header    bool   `koanf:"header"`
+
+	// Arbitrary SQL expression that filters the records and, for
+	// subscribers, an optional list that they should belong to.
+	Query  string `koanf:"query"`
+	ListID int    `koanf:"list_id"`
+
+	// Bucket (the upload.s3 bucket if it's empty) and the path in it that
+	// the files are uploaded to, and the number of files that are retained.
+	Bucket string `koanf:"bucket"`
+	Prefix string `koanf:"prefix"`
+	Retain int    `koanf:"retain"`
+
+	// E-mail failures to app.notify_emails.
+	Notify bool `koanf:"notify"`
+
+	sched  *cron.Schedule
+	fields []exportField
+	comma  rune
+	store  media.Store
+
+	// workers is the number of workers that fetch the records
+	// (app.export_concurrency).
+	workers int
+}
+
+// exportJob represents the params of an export job.
+type exportJob struct {
+	Export string `json:"export"`
+}
+
+// exportAlert represents the failure of a scheduled export.
+type exportAlert struct {
+	Export string    `json:"export"`
+	JobID  int64     `json:"job_id"`
+	Error  string    `json:"error"`
+	Time   time.Time `json:"time"`
+}
+
+// runExports is a blocking function that queues the export jobs of
+// scheduled exports when they're due.
+func runExports(exps map[string]exportConf, app *App) {
+	if len(exps) == 0 {
+		return
+	}
+
+	next := make(map[string]time.Time, len(exps))
+	for name, e := range exps {
+		next[name] = e.sched.Next(time.Now())
+	}
+
+	for {
+		// Pick the export that's due the earliest.
+		var (
+			name string
+			at   time.Time
+		)
+		for n, t := range next {
+			if !t.IsZero() && (at.IsZero() || t.Before(at)) {
+				name, at = n, t
+			}
+		}
+		if at.IsZero() {
+			return
+		}
+
+		time.Sleep(time.Until(at))
+		if _, err := app.jobs.Enqueue(jobTypeExport, exportJob{Export: name}); err != nil {
+			app.log.Printf("error queuing export '%s': %v", name, err)
+		}
+		next[name] = exps[name].sched.Next(at)
+	}
+}
+
+// makeExportJobHandler returns the handler of export jobs that alerts
+// on the failures of exports.
+func makeExportJobHandler(exps map[string]exportConf, app *App) jobs.Handler {
+	return func(c *jobs.Ctx) error {
+		var p exportJob
+		if err := c.Params(&p); err != nil {
+			return fmt.Errorf("error reading export params: %v", err)
+		}
+
+		e, ok := exps[p.Export]
+		if !ok {
+			return fmt.Errorf("unknown export '%s'", p.Export)
+		}
+
+		err := doExport(c, e, app)
+		if err != nil && err != jobs.ErrCancelled && !c.Cancelled() {
+			app.sendExportAlert(exportAlert{
+				Export: e.Name,
+				JobID:  c.Job.ID,
+				Error:  err.Error(),
+				Time:   time.Now(),
+			}, e.Notify)
+		}
+		return err
+	}
+}
+
+// doExport writes the records of an export to a file, uploads it, and
+// deletes the files of the export that are beyond its retention.
+func doExport(c *jobs.Ctx, e exportConf, app *App) error {
+	f, err := ioutil.TempFile("", "listmonk-export")
+	if err != nil {
+		return fmt.Errorf("error creating export file: %v", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := writeExport(c, e, f, app)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading export file: %v", err)
+	}
+
+	// eg: exports/subscribers/subscribers-20200101-020000.csv
+	var (
+		key   = fmt.Sprintf("%s-%s.%s", e.Name, time.Now().UTC().Format("20060102-150405"), e.Format)
+		cType = "text/csv"
+	)
+	if p := strings.Trim(e.Prefix, "/"); p != "" {
+		key = p + "/" + key
+	}
+	if e.Format == exportJSON {
+		cType = "application/json"
+	}
+
+	if _, err := e.store.Upload(key, cType, f); err != nil {
+		return fmt.Errorf("error uploading export: %v", err)
+	}
+	if _, err := app.queries.InsertExportFile.Exec(e.Name, key); err != nil {
+		return fmt.Errorf("error recording export file: %v", err)
+	}
+	c.SetProgress(n, n)
+	app.log.Printf("exported %d %s to %s", n, e.Entity, key)
+
+	if e.Retain > 0 {
+		pruneExport(e, app)
+	}
+	return nil
+}
+
+// writeExport streams the records of an export to w in its format and
+// returns the number of records. With more than one worker, the records are
+// fetched concurrently in ranges of IDs over the same snapshot of the DB and
+// written in order.
+func writeExport(c *jobs.Ctx, e exportConf, w io.Writer, app *App) (int, error) {
+	var (
+		stmt  = app.queries.ExportSubscribers
+		args  = []interface{}{e.ListID}
+		cols  = make([]string, len(e.fields))
+		names = make([]string, len(e.fields))
+		cond  = ""
+	)
+	if e.Entity == exportCampaigns {
+		stmt, args = app.queries.ExportCampaigns, nil
+	}
+	for i, f := range e.fields {
+		cols[i] = fmt.Sprintf("%s AS %s", f.Expr, pq.QuoteIdentifier(f.Name))
+		names[i] = f.Name
+	}
+	if q := sanitizeSQLExp(e.Query); q != "" {
+		cond = " AND " + q
+	}
+	query := func(rangeCond string) string {
+		return fmt.Sprintf(stmt, strings.Join(cols, ", "), cond+rangeCond)
+	}
+
+	// Create a readonly transaction to prevent mutations.
+	tx, err := app.db.BeginTxx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return 0, fmt.Errorf("error preparing export query: %v", pqErrMsg(err))
+	}
+	defer tx.Rollback()
+
+	ew := newExportWriter(e.Format, names, e.comma, w)
+	if e.Header {
+		if err := ew.header(); err != nil {
+			return 0, err
+		}
+	}
+
+	if e.workers > 1 {
+		err = fetchExportChunks(c, e, tx, query, args, ew, app)
+	} else {
+		err = fetchExport(c, tx, query(""), args, ew)
+	}
+	if err != nil {
+		return ew.n, err
+	}
+	return ew.n, ew.close()
+}
+
+// fetchExport streams the records of an export to the writer.
+func fetchExport(c *jobs.Ctx, tx *sqlx.Tx, query string, args []interface{}, ew *exportWriter) error {
+	rows, err := tx.QueryContext(c, query, args...)
+	if err != nil {
+		return fmt.Errorf("error querying export: %v", pqErrMsg(err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return fmt.Errorf("error reading export row: %v", err)
+		}
+		if err := ew.write(c, b); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error querying export: %v", pqErrMsg(err))
+	}
+	return nil
+}
+
+// exportChunk is the records of a range of IDs of an export fetched by a
+// worker.
+type exportChunk struct {
+	idx  int
+	rows [][]byte
+	err  error
+}
+
+// fetchExportChunks fetches the records of an export in ranges of IDs with
+// the export's workers, which read the snapshot of the export's transaction,
+// and writes them to the writer in order. At most two ranges per worker are
+// fetched ahead of the one being written.
+func fetchExportChunks(c *jobs.Ctx, e exportConf, tx *sqlx.Tx, query func(string) string, args []interface{},
+	ew *exportWriter, app *App) error {
+	var snap string
+	if err := tx.QueryRowContext(c, app.queries.ExportSnapshot).Scan(&snap); err != nil {
+		return fmt.Errorf("error preparing export query: %v", pqErrMsg(err))
+	}
+	var minID, maxID int
+	if err := tx.QueryRowContext(c, fmt.Sprintf(app.queries.ExportIDRange, e.Entity)).Scan(&minID, &maxID); err != nil {
+		return fmt.Errorf("error querying export: %v", pqErrMsg(err))
+	}
+	if maxID == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(c)
+	defer cancel()
+
+	var (
+		numChunks = (maxID-minID)/exportChunkIDs + 1
+		idxs      = make(chan int)
+		out       = make(chan exportChunk, e.workers)
+		window    = make(chan bool, e.workers*2)
+		wg        sync.WaitGroup
+	)
+	go func() {
+		defer close(idxs)
+		for i := 0; i < numChunks; i++ {
+			select {
+			case window <- true:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case idxs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < e.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runExportWorker(ctx, e, snap, minID, query, args, idxs, out, app)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+
+	var (
+		pending = make(map[int]exportChunk)
+		next    = 0
+	)
+	for ch := range out {
+		if ch.err != nil {
+			return ch.err
+		}
+
+		pending[ch.idx] = ch
+		for {
+			p, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			for _, b := range p.rows {
+				if err := ew.write(c, b); err != nil {
+					return err
+				}
+			}
+			<-window
+		}
+	}
+	if next < numChunks {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// runExportWorker fetches the records of the ranges of IDs of an export that
+// it receives in a transaction over the export's snapshot until there are no
+// more ranges, or there's an error.
+func runExportWorker(ctx context.Context, e exportConf, snap string, minID int, query func(string) string,
+	args []interface{}, idxs <-chan int, out chan<- exportChunk, app *App) {
+	send := func(ch exportChunk) bool {
+		select {
+		case out <- ch:
+			return ch.err == nil
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	tx, err := app.db.BeginTxx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		send(exportChunk{err: fmt.Errorf("error preparing export query: %v", pqErrMsg(err))})
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, fmt.Sprintf(app.queries.SetExportSnapshot, snap)); err != nil {
+		send(exportChunk{err: fmt.Errorf("error preparing export query: %v", pqErrMsg(err))})
+		return
+	}
+
+	for i := range idxs {
+		var (
+			from = minID - 1 + i*exportChunkIDs
+			cond = fmt.Sprintf(" AND %s.id > %d AND %s.id <= %d", e.Entity, from, e.Entity, from+exportChunkIDs)
+			ch   = exportChunk{idx: i}
+		)
+		ch.rows, ch.err = fetchExportRows(ctx, tx, query(cond), args)
+		if !send(ch) {
+			return
+		}
+	}
+}
+
+// fetchExportRows returns the JSON rows of an export query.
+func fetchExportRows(ctx context.Context, tx *sqlx.Tx, query string, args []interface{}) ([][]byte, error) {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying export: %v", pqErrMsg(err))
+	}
+	defer rows.Close()
+
+	var out [][]byte
+	for rows.Next() {
+		var b []byte
+		if err := rows.Scan(&b); err != nil {
+			return nil, fmt.Errorf("error reading export row: %v", err)
+		}
+		out = append(out, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error querying export: %v", pqErrMsg(err))
+	}
+	return out, nil
+}
+
+// exportWriter writes the JSON rows of an export in its format.
+type exportWriter struct {
+	format string
+	names  []string
+	rec    []string
+	delim  string
+	n      int
+
+	buf *bufio.Writer
+	cw  *csv.Writer
+}
+
+func newExportWriter(format string, names []string, comma rune, w io.Writer) *exportWriter {
+	var (
+		buf = bufio.NewWriter(w)
+		cw  = csv.NewWriter(buf)
+	)
+	if comma != 0 {
+		cw.Comma = comma
+	}
+	return &exportWriter{
+		format: format,
+		names:  names,
+		rec:    make([]string, len(names)),
+		delim:  "[",
+		buf:    buf,
+		cw:     cw,
+	}
+}
+
+// header writes the header of CSV exports.
+func (w *exportWriter) header() error {
+	if w.format == exportCSV {
+		return w.cw.Write(w.names)
+	}
+	return nil
+}
+
+// write writes a row and records the progress of the export every
+// exportProgressRows rows, when its cancellation is checked.
+func (w *exportWriter) write(c *jobs.Ctx, b []byte) error {
+	switch w.format {
+	case exportCSV:
+		if err := csvRecord(b, w.names, w.rec); err != nil {
+			return err
+		}
+		if err := w.cw.Write(w.rec); err != nil {
+			return err
+		}
+	case exportJSON:
+		w.buf.WriteString(w.delim + "\n")
+		w.buf.Write(b)
+		w.delim = ","
+	}
+
+	w.n++
+	if w.n%exportProgressRows == 0 {
+		c.SetProgress(0, w.n)
+		if c.Cancelled() {
+			return jobs.ErrCancelled
+		}
+	}
+	return nil
+}
+
+// close ends the export and flushes it.
+func (w *exportWriter) close() error {
+	if w.format == exportJSON {
+		if w.n == 0 {
+			w.buf.WriteString(w.delim)
+		}
+		w.buf.WriteString("\n]\n")
+	}
+	w.cw.Flush()
+	if err := w.cw.Error(); err != nil {
+		return fmt.Errorf("error writing export file: %v", err)
+	}
+	if err := w.buf.Flush(); err != nil {
+		return fmt.Errorf("error writing export file: %v", err)
+	}
+	return nil
+}
+
+// selectExportFields returns the fields of an entity with the given names in
+// their order, or all of them if there are none. The fields of subscribers
+// also include the values of single attribute keys. Fields of items that
+// aren't in the exportable allowlist are left out of all the fields and
+// aren't allowed.
+func selectExportFields(entity string, names []string, exportable map[string]bool) ([]exportField, error) {
+	all, ok := exportFields[entity]
+	if !ok {
+		return nil, fmt.Errorf("unknown entity '%s'", entity)
+	}
+	allowed := func(f exportField) bool {
+		return f.Item == "" || exportable[f.Item]
+	}
+
+	if len(names) == 0 {
+		out := make([]exportField, 0, len(all))
+		for _, f := range all {
+			if allowed(f) {
+				out = append(out, f)
+			}
+		}
+		return out, nil
+	}
+
+	var (
+		out  = make([]exportField, 0, len(names))
+		seen = make(map[string]bool, len(names))
+	)
+	for _, name := range names {
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate field '%s'", name)
+		}
+		seen[name] = true
+
+		var (
+			f     exportField
+			found bool
+		)
+		if key := strings.TrimPrefix(name, exportAttribPrefix); entity == exportSubscribers &&
+			key != name && key != "" {
+			f = exportField{
+				Name: name,
+				Expr: "subscribers.attribs->" + pq.QuoteLiteral(key),
+				Item: "profile",
+			}
+			found = true
+		} else {
+			for _, a := range all {
+				if a.Name == name {
+					f, found = a, true
+					break
+				}
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown field '%s' for %s", name, entity)
+		}
+		if !allowed(f) {
+			return nil, fmt.Errorf("field '%s' isn't allowed by privacy.exportable (%s)", name, f.Item)
+		}
+		out = append(out, f)
+	}
+	return out, nil
+}
+
+// csvRecord sets the values of the fields of a JSON row in rec. Strings are
+// written as they are, nulls as empty values, and the rest as JSON.
+func csvRecord(b []byte, names, rec []string) error {
+	var row map[string]json.RawMessage
+	if err := json.Unmarshal(b, &row); err != nil {
+		return fmt.Errorf("error reading export row: %v", err)
+	}
+
+	for i, name := range names {
+		v := row[name]
+		switch {
+		case len(v) == 0 || string(v) == "null":
+			rec[i] = ""
+		case v[0] == '"':
+			var s string
+			if err := json.Unmarshal(v, &s); err != nil {
+				return fmt.Errorf("error reading export row: %v", err)
+			}
+			rec[i] = s
+		default:
+			rec[i] = string(v)
+		}
+	}
+	return nil
+}
+
+// pruneExport deletes the files of an export, other than the latest ones
+// it retains, from the store. Errors are logged and the files are retried
+// on the next run.
+func pruneExport(e exportConf, app *App) {
+	var files []struct {
+		ID   int64  `db:"id"`
+		File string `db:"file"`
+	}
+	if err := app.queries.GetExpiredExportFiles.Select(&files, e.Name, e.Retain); err != nil {
+		app.log.Printf("error fetching expired files of export '%s': %v", e.Name, err)
+		return
+	}
+
+	for _, f := range files {
+		if err := e.store.Delete(f.File); err != nil {
+			app.log.Printf("error deleting export file %s: %v", f.File, err)
+			continue
+		}
+		if _, err := app.queries.DeleteExportFile.Exec(f.ID); err != nil {
+			app.log.Printf("error deleting export file %s: %v", f.File, err)
+		}
+	}
+}
@@ -1,4 +1,5 @@
 module github.com/knadh/listmonk
+
 go 1.13
 
 require (
@@ -8,7 +9,6 @@ require (
 	github.com/jmoiron/sqlx v1.2.0
 	github.com/knadh/goyesql/v2 v2.1.1
 	github.com/knadh/koanf v0.8.1
-	github.com/knadh/smtppool v0.2.0
 	github.com/knadh/stuffbin v1.1.0
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/labstack/gommon v0.3.0 // indirect
@@ -18,7 +18,9 @@ require (
 	github.com/rhnvrm/simples3 v0.5.0
 	github.com/spf13/pflag v1.0.5
 	github.com/ssor/bom v0.0.0-20170718123548-6386211fdfcf // indirect
+	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
+	golang.org/x/net v0.0.0-20190603091049-60506f45cf65
 	gopkg.in/check.v1 v1.0.0-20200227125254-8fa46927fb4f // indirect
 	gopkg.in/volatiletech/null.v6 v6.0.0-20170828023728-0bef4e07ae1b
 	jaytaylor.com/html2text v0.0.0-20200220170450-61d9dc4d7195
-)
\ No newline at end of file
+)
@@ -5,6 +5,7 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
 
 	"github.com/labstack/echo"
 )
@@ -18,6 +19,10 @@ const (
 
 	// maxPerPage is the maximum number of allowed for paginated records.
 	maxPerPage = 100
+
+	// consentMaxLen is the maximum length of the recorded consent source
+	// and user agent of a subscription.
+	consentMaxLen = 1000
 )
 
 type okResp struct {
@@ -34,66 +39,154 @@ type pagination struct {
 
 var reUUID = regexp.MustCompile("^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$")
 
-// registerHandlers registers HTTP handlers.
+// registerHandlers registers HTTP handlers. The admin's handlers require
+// the permission scopes of their endpoints.
 func registerHTTPHandlers(e *echo.Echo) {
-	e.GET("/", handleIndexPage)
-	e.GET("/api/config.js", handleGetConfigScript)
-	e.GET("/api/dashboard/charts", handleGetDashboardCharts)
-	e.GET("/api/dashboard/counts", handleGetDashboardCounts)
-
-	e.GET("/api/subscribers/:id", handleGetSubscriber)
-	e.GET("/api/subscribers/:id/export", handleExportSubscriberData)
-	e.POST("/api/subscribers", handleCreateSubscriber)
-	e.PUT("/api/subscribers/:id", handleUpdateSubscriber)
-	e.POST("/api/subscribers/:id/optin", handleSubscriberSendOptin)
-	e.PUT("/api/subscribers/blacklist", handleBlacklistSubscribers)
-	e.PUT("/api/subscribers/:id/blacklist", handleBlacklistSubscribers)
-	e.PUT("/api/subscribers/lists/:id", handleManageSubscriberLists)
-	e.PUT("/api/subscribers/lists", handleManageSubscriberLists)
-	e.DELETE("/api/subscribers/:id", handleDeleteSubscribers)
-	e.DELETE("/api/subscribers", handleDeleteSubscribers)
+	var (
+		read    = authorize(permRead)
+		manage  = authorize(permManage)
+		admin   = authorize(permAdmin)
+		approve = authorize(permApprove)
+	)
+
+	e.GET("/", handleIndexPage, read)
+	e.GET("/api/config.js", handleGetConfigScript, read)
+	e.GET("/api/dashboard/charts", handleGetDashboardCharts, read)
+	e.GET("/api/dashboard/counts", handleGetDashboardCounts, read)
+	e.GET("/api/metrics", handleGetMetrics, read)
+	e.GET("/api/messengers/status", handleGetMessengerStatus, read)
+	e.GET("/api/benchmark", handleGetBenchmark, admin)
+	e.PUT("/api/benchmark", handleUpdateBenchmark, admin)
+
+	e.GET("/api/settings/schema", handleGetSettingsSchema, admin)
+	e.POST("/api/settings/reload", handleReloadSettings, admin)
+
+	e.GET("/api/subscribers/:id", handleGetSubscriber, read)
+	e.GET("/api/subscribers/:id/export", handleExportSubscriberData, read)
+	e.GET("/api/subscribers/:id/activity", handleGetSubscriberActivity, read)
+	e.POST("/api/subscribers", handleCreateSubscriber, manage)
+	e.PUT("/api/subscribers/:id", handleUpdateSubscriber, manage)
+	e.POST("/api/subscribers/:id/optin", handleSubscriberSendOptin, manage)
+	e.PUT("/api/subscribers/blacklist", handleBlacklistSubscribers, manage)
+	e.PUT("/api/subscribers/:id/blacklist", handleBlacklistSubscribers, manage)
+	e.PUT("/api/subscribers/lists/:id", handleManageSubscriberLists, manage)
+	e.PUT("/api/subscribers/lists", handleManageSubscriberLists, manage)
+	e.GET("/api/subscribers/deletions", handleGetSubscriberDeletions, read)
+	e.GET("/api/subscribers/unsubscribe-reasons", handleGetUnsubscribeReasons, read)
+	e.GET("/api/subscribers/without-consent", handleGetSubscriptionsWithoutConsent, read)
+	e.DELETE("/api/subscribers/:id", handleDeleteSubscribers, admin)
+	e.DELETE("/api/subscribers", handleDeleteSubscribers, admin)
 
 	// Subscriber operations based on arbitrary SQL queries.
 	// These aren't very REST-like.
-	e.POST("/api/subscribers/query/delete", handleDeleteSubscribersByQuery)
-	e.PUT("/api/subscribers/query/blacklist", handleBlacklistSubscribersByQuery)
-	e.PUT("/api/subscribers/query/lists", handleManageSubscriberListsByQuery)
-	e.GET("/api/subscribers", handleQuerySubscribers)
-
-	e.GET("/api/import/subscribers", handleGetImportSubscribers)
-	e.GET("/api/import/subscribers/logs", handleGetImportSubscriberStats)
-	e.POST("/api/import/subscribers", handleImportSubscribers)
-	e.DELETE("/api/import/subscribers", handleStopImportSubscribers)
-
-	e.GET("/api/lists", handleGetLists)
-	e.GET("/api/lists/:id", handleGetLists)
-	e.POST("/api/lists", handleCreateList)
-	e.PUT("/api/lists/:id", handleUpdateList)
-	e.DELETE("/api/lists/:id", handleDeleteLists)
-
-	e.GET("/api/campaigns", handleGetCampaigns)
-	e.GET("/api/campaigns/running/stats", handleGetRunningCampaignStats)
-	e.GET("/api/campaigns/:id", handleGetCampaigns)
-	e.GET("/api/campaigns/:id/preview", handlePreviewCampaign)
-	e.POST("/api/campaigns/:id/preview", handlePreviewCampaign)
-	e.POST("/api/campaigns/:id/test", handleTestCampaign)
-	e.POST("/api/campaigns", handleCreateCampaign)
-	e.PUT("/api/campaigns/:id", handleUpdateCampaign)
-	e.PUT("/api/campaigns/:id/status", handleUpdateCampaignStatus)
-	e.DELETE("/api/campaigns/:id", handleDeleteCampaign)
-
-	e.GET("/api/media", handleGetMedia)
-	e.POST("/api/media", handleUploadMedia)
-	e.DELETE("/api/media/:id", handleDeleteMedia)
-
-	e.GET("/api/templates", handleGetTemplates)
-	e.GET("/api/templates/:id", handleGetTemplates)
-	e.GET("/api/templates/:id/preview", handlePreviewTemplate)
-	e.POST("/api/templates/preview", handlePreviewTemplate)
-	e.POST("/api/templates", handleCreateTemplate)
-	e.PUT("/api/templates/:id", handleUpdateTemplate)
-	e.PUT("/api/templates/:id/default", handleTemplateSetDefault)
-	e.DELETE("/api/templates/:id", handleDeleteTemplate)
+	e.POST("/api/subscribers/query/delete", handleDeleteSubscribersByQuery, admin)
+	e.PUT("/api/subscribers/query/blacklist", handleBlacklistSubscribersByQuery, admin)
+	e.PUT("/api/subscribers/query/lists", handleManageSubscriberListsByQuery, admin)
+	e.GET("/api/subscribers", handleQuerySubscribers, read)
+
+	e.GET("/api/segments", handleGetSegments, read)
+	e.GET("/api/segments/:id", handleGetSegments, read)
+	e.GET("/api/segments/indexes", handleGetAttribIndexes, read)
+	e.POST("/api/segments/indexes", handleCreateAttribIndex, admin)
+	e.DELETE("/api/segments/indexes/:key", handleDeleteAttribIndex, admin)
+	e.POST("/api/segments/count", handleCountSegment, read)
+	e.POST("/api/segments", handleCreateSegment, manage)
+	e.PUT("/api/segments/:id", handleUpdateSegment, manage)
+	e.DELETE("/api/segments/:id", handleDeleteSegment, admin)
+
+	e.GET("/api/list-rules", handleGetListRules, read)
+	e.GET("/api/list-rules/:id", handleGetListRules, read)
+	e.POST("/api/list-rules/preview", handlePreviewListRule, read)
+	e.POST("/api/list-rules", handleCreateListRule, manage)
+	e.PUT("/api/list-rules/:id", handleUpdateListRule, manage)
+	e.DELETE("/api/list-rules/:id", handleDeleteListRule, admin)
+	e.POST("/api/list-rules/:id/backfill", handleBackfillListRule, manage)
+
+	e.GET("/api/import/subscribers", handleGetImportSubscribers, read)
+	e.GET("/api/import/subscribers/logs", handleGetImportSubscriberStats, read)
+	e.POST("/api/import/subscribers", handleImportSubscribers, admin)
+	e.POST("/api/import/subscribers/preview", handlePreviewImport, admin)
+	e.POST("/api/import/subscribers/preview/:id", handleConfirmImport, admin)
+	e.DELETE("/api/import/subscribers", handleStopImportSubscribers, admin)
+
+	e.GET("/api/jobs", handleGetJobs, read)
+	e.GET("/api/jobs/:id", handleGetJob, read)
+	e.POST("/api/jobs/:id/cancel", handleCancelJob, admin)
+
+	e.GET("/api/webhooks/dead-letters", handleGetWebhookDeadLetters, admin)
+	e.GET("/api/webhooks/dead-letters/:id", handleGetWebhookDeadLetter, admin)
+	e.POST("/api/webhooks/dead-letters/replay", handleReplayWebhookDeadLetters, admin)
+	e.POST("/api/webhooks/dead-letters/:id/replay", handleReplayWebhookDeadLetters, admin)
+	e.DELETE("/api/webhooks/dead-letters", handleDeleteWebhookDeadLetters, admin)
+	e.DELETE("/api/webhooks/dead-letters/:id", handleDeleteWebhookDeadLetters, admin)
+
+	e.GET("/api/lists", handleGetLists, read)
+	e.GET("/api/lists/:id", handleGetLists, read)
+	e.POST("/api/lists", handleCreateList, manage)
+	e.PUT("/api/lists/:id", handleUpdateList, manage)
+	e.DELETE("/api/lists/:id", handleDeleteLists, admin)
+	e.GET("/api/lists/:id/welcome", handleGetWelcomeSteps, read)
+	e.PUT("/api/lists/:id/welcome", handleUpdateWelcomeSteps, manage)
+
+	e.GET("/api/sequences", handleGetSequences, read)
+	e.GET("/api/sequences/:id", handleGetSequences, read)
+	e.GET("/api/sequences/:id/subscribers", handleGetSequenceSubscribers, read)
+	e.POST("/api/sequences", handleCreateSequence, manage)
+	e.PUT("/api/sequences/:id", handleUpdateSequence, manage)
+	e.DELETE("/api/sequences/:id", handleDeleteSequence, admin)
+
+	e.GET("/api/campaigns", handleGetCampaigns, read)
+	e.GET("/api/campaigns/running/stats", handleGetRunningCampaignStats, read)
+	e.GET("/api/campaigns/analytics", handleGetCampaignAnalytics, read)
+	e.GET("/api/campaigns/queue", handleGetCampaignQueue, read)
+	e.GET("/api/campaigns/:id", handleGetCampaigns, read)
+	e.GET("/api/campaigns/:id/events", handleCampaignEvents, read)
+	e.GET("/api/campaigns/:id/stats/languages", handleGetCampaignLangStats, read)
+	e.GET("/api/campaigns/:id/failures", handleGetCampaignFailures, read)
+	e.GET("/api/campaigns/:id/recipients", handleGetCampaignRecipients, read)
+	e.GET("/api/campaigns/:id/send-windows", handleGetCampaignSendWindows, read)
+	e.GET("/api/campaigns/:id/local-send", handleGetCampaignLocalSend, read)
+	e.GET("/api/campaigns/:id/rollout", handleGetCampaignRollout, read)
+	e.GET("/api/campaigns/:id/short-links", handleGetCampaignShortLinks, read)
+	e.POST("/api/campaigns/:id/link-check", handleCheckCampaignLinks, manage)
+	e.GET("/api/campaigns/:id/preview", handlePreviewCampaign, read)
+	e.POST("/api/campaigns/:id/preview", handlePreviewCampaign, read)
+	e.POST("/api/campaigns/:id/test", handleTestCampaign, manage)
+	e.POST("/api/campaigns", handleCreateCampaign, manage)
+	e.POST("/api/campaigns/:id/followup", handleCreateFollowupCampaign, manage)
+	e.POST("/api/campaigns/:id/duplicate", handleDuplicateCampaign, manage)
+	e.PUT("/api/campaigns/:id", handleUpdateCampaign, manage)
+	e.PUT("/api/campaigns/:id/status", handleUpdateCampaignStatus, manage)
+	e.POST("/api/campaigns/:id/confirm", handleConfirmCampaignSend, manage)
+	e.POST("/api/campaigns/:id/approve", handleApproveCampaign, approve)
+	e.POST("/api/campaigns/:id/reject", handleRejectCampaign, approve)
+	e.DELETE("/api/campaigns/:id/snapshot", handleApplyCampaignEdits, manage)
+	e.DELETE("/api/campaigns/:id", handleDeleteCampaign, admin)
+
+	e.GET("/api/media", handleGetMedia, read)
+	e.POST("/api/media", handleUploadMedia, manage)
+	e.DELETE("/api/media/:id", handleDeleteMedia, admin)
+	e.POST("/api/media/migrate", handleMigrateMedia, admin)
+
+	e.GET("/api/templates", handleGetTemplates, read)
+	e.GET("/api/templates/export", handleExportTemplates, read)
+	e.POST("/api/templates/import", handleImportTemplates, manage)
+	e.GET("/api/templates/:id", handleGetTemplates, read)
+	e.GET("/api/templates/:id/preview", handlePreviewTemplate, read)
+	e.POST("/api/templates/preview", handlePreviewTemplate, read)
+	e.POST("/api/templates", handleCreateTemplate, manage)
+	e.PUT("/api/templates/:id", handleUpdateTemplate, manage)
+	e.PUT("/api/templates/:id/default", handleTemplateSetDefault, manage)
+	e.DELETE("/api/templates/:id", handleDeleteTemplate, admin)
+
+	e.GET("/api/messages", handleGetRenderedMessages, admin)
+
+	e.GET("/api/profile", handleGetProfile, read)
+	e.GET("/api/users", handleGetUsers, admin)
+	e.GET("/api/users/:id", handleGetUsers, admin)
+	e.POST("/api/users", handleCreateUser, admin)
+	e.PUT("/api/users/:id", handleUpdateUser, admin)
+	e.DELETE("/api/users/:id", handleDeleteUser, admin)
 
 	// Subscriber facing views.
 	e.POST("/subscription/form", handleSubscriptionForm)
@@ -109,22 +202,31 @@ func registerHTTPHandlers(e *echo.Echo) {
 		"subUUID"))
 	e.GET("/link/:linkUUID/:campUUID/:subUUID", validateUUID(handleLinkRedirect,
 		"linkUUID", "campUUID", "subUUID"))
+	e.GET("/s/:code", handleShortLinkRedirect)
 	e.GET("/campaign/:campUUID/:subUUID", validateUUID(handleViewCampaignMessage,
 		"campUUID", "subUUID"))
 	e.GET("/campaign/:campUUID/:subUUID/px.png", validateUUID(handleRegisterCampaignView,
 		"campUUID", "subUUID"))
+	e.GET("/archive/:campUUID", validateUUID(handleArchivedCampaignPage, "campUUID"))
+	e.GET("/archive/lists/:listUUID", validateUUID(handleArchivePage, "listUUID"))
+	e.GET("/conversion/:campUUID/:subUUID", validateUUID(handleRegisterConversion,
+		"campUUID", "subUUID"))
+	e.POST("/conversion/:campUUID/:subUUID", validateUUID(handleRegisterConversion,
+		"campUUID", "subUUID"))
+	e.POST("/webhooks/events", handleProviderEvents)
+	e.POST("/webhooks/subscribers", handleSubscriberWebhook)
 
 	// Static views.
-	e.GET("/lists", handleIndexPage)
-	e.GET("/lists/forms", handleIndexPage)
-	e.GET("/subscribers", handleIndexPage)
-	e.GET("/subscribers/lists/:listID", handleIndexPage)
-	e.GET("/subscribers/import", handleIndexPage)
-	e.GET("/campaigns", handleIndexPage)
-	e.GET("/campaigns/new", handleIndexPage)
-	e.GET("/campaigns/media", handleIndexPage)
-	e.GET("/campaigns/templates", handleIndexPage)
-	e.GET("/campaigns/:campignID", handleIndexPage)
+	e.GET("/lists", handleIndexPage, read)
+	e.GET("/lists/forms", handleIndexPage, read)
+	e.GET("/subscribers", handleIndexPage, read)
+	e.GET("/subscribers/lists/:listID", handleIndexPage, read)
+	e.GET("/subscribers/import", handleIndexPage, read)
+	e.GET("/campaigns", handleIndexPage, read)
+	e.GET("/campaigns/new", handleIndexPage, read)
+	e.GET("/campaigns/media", handleIndexPage, read)
+	e.GET("/campaigns/templates", handleIndexPage, read)
+	e.GET("/campaigns/:campignID", handleIndexPage, read)
 }
 
 // handleIndex is the root handler that renders the Javascript frontend.
@@ -154,6 +256,25 @@ func validateUUID(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
 	}
 }
 
+// trackingDomainFilter middleware only allows link, short link, view, and conversion
+// tracking requests on tracking domains and responds with a 404 to everything else.
+func trackingDomainFilter(domains map[string]string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if _, ok := domains[strings.ToLower(c.Request().Host)]; !ok {
+				return next(c)
+			}
+
+			p := c.Request().URL.Path
+			if strings.HasPrefix(p, "/link/") || strings.HasPrefix(p, "/s/") || strings.HasPrefix(p, "/conversion/") ||
+				(strings.HasPrefix(p, "/campaign/") && strings.HasSuffix(p, "/px.png")) {
+				return next(c)
+			}
+			return echo.ErrNotFound
+		}
+	}
+}
+
 // subscriberExists middleware checks if a subscriber exists given the UUID
 // param in a request.
 func subscriberExists(next echo.HandlerFunc, params ...string) echo.HandlerFunc {
@@ -1,102 +1,390 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/knadh/listmonk/internal/jobs"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/labstack/echo"
 )
 
+// Job types of subscriber imports and import previews.
+const (
+	jobTypeImport        = "import"
+	jobTypeImportPreview = "import-preview"
+)
+
+// importPreviewTTL is the duration for which the file of an import
+// preview is retained to be imported.
+const importPreviewTTL = time.Hour
+
 // reqImport represents file upload import params.
 type reqImport struct {
 	Mode      string `json:"mode"`
 	Overwrite bool   `json:"overwrite"`
 	Delim     string `json:"delim"`
 	ListIDs   []int  `json:"lists"`
+
+	// Policies for existing subscribers. If the conflict policy isn't set,
+	// it's derived from Overwrite.
+	Conflict string `json:"conflict"`
+	ListMode string `json:"list_mode"`
+
+	// Policy for records that match suppressed subscribers. If it isn't
+	// set, it's app.import_suppression.
+	Suppression string `json:"suppression"`
+}
+
+// importJob represents the params of an import job.
+type importJob struct {
+	reqImport
+
+	// Path of the uploaded file and its original name.
+	File string `json:"file"`
+	Name string `json:"name"`
+}
+
+// setDefaults sets the policies that aren't set in the request.
+func (r *reqImport) setDefaults(suppression string) {
+	if r.Conflict == "" {
+		r.Conflict = subimporter.ConflictSkip
+		if r.Overwrite {
+			r.Conflict = subimporter.ConflictOverwrite
+		}
+	}
+	if r.ListMode == "" {
+		r.ListMode = subimporter.ListsAdd
+	}
+	if r.Suppression == "" {
+		r.Suppression = suppression
+	}
 }
 
 // handleImportSubscribers handles the uploading and bulk importing of
 // a ZIP file of one or more CSV files.
 func handleImportSubscribers(c echo.Context) error {
 	app := c.Get("app").(*App)
+	if err := checkImporterFree(app); err != nil {
+		return err
+	}
+
+	j, err := readImportUpload(c)
+	if err != nil {
+		return err
+	}
+	if err := queueImport(j, app); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
+}
+
+// handlePreviewImport handles the uploading of an import file and queues
+// a job that validates it without importing anything. The preview is the
+// result of the job, which can then be imported with handleConfirmImport.
+func handlePreviewImport(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	j, err := readImportUpload(c)
+	if err != nil {
+		return err
+	}
+
+	id, err := app.jobs.Enqueue(jobTypeImportPreview, j)
+	if err != nil {
+		os.Remove(j.File)
+		app.log.Printf("error queuing import preview job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error starting import preview: %s", pqErrMsg(err)))
+	}
+
+	var out jobs.Job
+	if err := app.queries.GetJob.Get(&out, id); err != nil {
+		app.log.Printf("error fetching job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching job: %s", pqErrMsg(err)))
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleConfirmImport imports the file of a finished import preview job
+// with the params it was validated with.
+func handleConfirmImport(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	var job jobs.Job
+	if err := app.queries.GetJob.Get(&job, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Import preview not found.")
+		}
+		app.log.Printf("error fetching job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching job: %s", pqErrMsg(err)))
+	}
+	if job.Type != jobTypeImportPreview || job.Status != jobs.StatusFinished {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Import preview not found or it hasn't finished.")
+	}
+
+	var (
+		j  importJob
+		pv subimporter.Preview
+	)
+	if err := job.Params.Unmarshal(&j); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error reading import preview: %v", err))
+	}
+	if err := job.Result.Unmarshal(&pv); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error reading import preview: %v", err))
+	}
+	if pv.Valid == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "The file has no valid records to import.")
+	}
+
+	if err := checkImporterFree(app); err != nil {
+		return err
+	}
+
+	// Take over the file so that it isn't removed along with the
+	// expired preview, which also prevents it from being imported twice.
+	path := j.File + ".import"
+	if err := os.Rename(j.File, path); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"The import preview has expired or has already been imported. Upload the file again.")
+	}
+	j.File = path
 
+	if err := queueImport(j, app); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
+}
+
+// checkImporterFree checks whether the importer is free to start an import.
+func checkImporterFree(app *App) error {
 	// Is an import already running?
 	if app.importer.GetStats().Status == subimporter.StatusImporting {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			"An import is already running. Wait for it to finish or stop it before trying again.")
 	}
+	if app.importer.GetStats().Status != subimporter.StatusNone {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Clear the last import before starting a new one.")
+	}
+	return nil
+}
+
+// readImportUpload validates the import params of a request and copies the
+// uploaded file to a temporary file that the caller should remove.
+func readImportUpload(c echo.Context) (importJob, error) {
+	app := c.Get("app").(*App)
 
 	// Unmarsal the JSON params.
 	var r reqImport
 	if err := json.Unmarshal([]byte(c.FormValue("params")), &r); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest,
+		return importJob{}, echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Invalid `params` field: %v", err))
 	}
 
 	if r.Mode != subimporter.ModeSubscribe && r.Mode != subimporter.ModeBlacklist {
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid `mode`")
+		return importJob{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid `mode`")
+	}
+
+	r.setDefaults(app.constants.ImportSuppression)
+	if r.Conflict != subimporter.ConflictSkip && r.Conflict != subimporter.ConflictOverwrite &&
+		r.Conflict != subimporter.ConflictMerge {
+		return importJob{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid `conflict`")
+	}
+
+	if r.ListMode != subimporter.ListsAdd && r.ListMode != subimporter.ListsReplace {
+		return importJob{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid `list_mode`")
+	}
+
+	if !isImportSuppression(r.Suppression) {
+		return importJob{}, echo.NewHTTPError(http.StatusBadRequest, "Invalid `suppression`")
 	}
 
 	if len(r.Delim) != 1 {
-		return echo.NewHTTPError(http.StatusBadRequest,
+		return importJob{}, echo.NewHTTPError(http.StatusBadRequest,
 			"`delim` should be a single character")
 	}
 
 	file, err := c.FormFile("file")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest,
+		return importJob{}, echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Invalid `file`: %v", err))
 	}
 
 	src, err := file.Open()
 	if err != nil {
-		return err
+		return importJob{}, err
 	}
 	defer src.Close()
 
 	out, err := ioutil.TempFile("", "listmonk")
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError,
+		return importJob{}, echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error copying uploaded file: %v", err))
 	}
 	defer out.Close()
 
 	if _, err = io.Copy(out, src); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError,
+		os.Remove(out.Name())
+		return importJob{}, echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error copying uploaded file: %v", err))
 	}
 
-	// Start the importer session.
-	impSess, err := app.importer.NewSession(file.Filename, r.Mode, r.Overwrite, r.ListIDs)
-	if err != nil {
+	return importJob{reqImport: r, File: out.Name(), Name: file.Filename}, nil
+}
+
+// queueImport reserves the importer and queues the import job of an
+// uploaded file.
+func queueImport(j importJob, app *App) error {
+	if err := app.importer.Queue(j.Name); err != nil {
+		os.Remove(j.File)
 		return echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Error starting import session: %v", err))
 	}
-	go impSess.Start()
-
-	if strings.HasSuffix(strings.ToLower(file.Filename), ".csv") {
-		go impSess.LoadCSV(out.Name(), rune(r.Delim[0]))
-	} else {
-		// Only 1 CSV from the ZIP is considered. If multiple files have
-		// to be processed, counting the net number of lines (to track progress),
-		// keeping the global import state (failed / successful) etc. across
-		// multiple files becomes complex. Instead, it's just easier for the
-		// end user to concat multiple CSVs (if there are multiple in the first)
-		// place and uploada as one in the first place.
-		dir, files, err := impSess.ExtractZIP(out.Name(), 1)
+	if _, err := app.jobs.Enqueue(jobTypeImport, j); err != nil {
+		app.importer.Stop()
+		os.Remove(j.File)
+		app.log.Printf("error queuing import job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error starting import session: %s", pqErrMsg(err)))
+	}
+	return nil
+}
+
+// makeImportJobHandler returns the job handler that runs imports queued by
+// handleImportSubscribers. Imports aren't resumable as the uploaded files
+// may not survive a restart.
+func makeImportJobHandler(app *App) jobs.Handler {
+	return func(c *jobs.Ctx) error {
+		var p importJob
+		if err := c.Params(&p); err != nil {
+			return err
+		}
+		defer os.Remove(p.File)
+		p.setDefaults(app.constants.ImportSuppression)
+
+		// Start the importer session.
+		sess, err := app.importer.NewSession(p.Name, p.Mode, p.Conflict, p.ListMode, p.Suppression, p.ListIDs)
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError,
-				fmt.Sprintf("Error processing ZIP file: %v", err))
+			return err
+		}
+
+		path := p.File
+		if !strings.HasSuffix(strings.ToLower(p.Name), ".csv") {
+			// Only 1 CSV from the ZIP is considered. If multiple files have
+			// to be processed, counting the net number of lines (to track progress),
+			// keeping the global import state (failed / successful) etc. across
+			// multiple files becomes complex. Instead, it's just easier for the
+			// end user to concat multiple CSVs (if there are multiple in the first)
+			// place and uploada as one in the first place.
+			dir, files, err := sess.ExtractZIP(p.File, 1)
+			if err != nil {
+				return fmt.Errorf("error processing ZIP file: %v", err)
+			}
+			defer os.RemoveAll(dir)
+			path = dir + "/" + files[0]
 		}
-		go impSess.LoadCSV(dir+"/"+files[0], rune(r.Delim[0]))
+
+		done := make(chan bool)
+		go func() {
+			sess.Start()
+			close(done)
+		}()
+
+		// Mirror the importer's progress on the job and stop the import
+		// if the job is cancelled.
+		go func() {
+			t := time.NewTicker(time.Second)
+			defer t.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case <-c.Done():
+					if app.importer.GetStats().Status == subimporter.StatusImporting {
+						app.importer.Stop()
+					}
+					return
+				case <-t.C:
+					s := app.importer.GetStats()
+					c.SetProgress(s.Total, s.Imported)
+				}
+			}
+		}()
+
+		loadErr := sess.LoadCSV(path, rune(p.Delim[0]))
+		if loadErr != nil {
+			// Close the queue that LoadCSV leaves open on errors.
+			sess.Stop()
+		}
+		<-done
+
+		s := app.importer.GetStats()
+		c.SetProgress(s.Total, s.Imported)
+		switch {
+		case loadErr != nil:
+			return loadErr
+		case c.Cancelled():
+			return jobs.ErrCancelled
+		case s.Status == subimporter.StatusFailed:
+			return errors.New("no records were imported")
+		}
+		return nil
 	}
+}
 
-	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
+// makeImportPreviewJobHandler returns the job handler that validates the
+// files queued by handlePreviewImport and sets the preview as the result.
+func makeImportPreviewJobHandler(app *App) jobs.Handler {
+	return func(c *jobs.Ctx) error {
+		var p importJob
+		if err := c.Params(&p); err != nil {
+			return err
+		}
+
+		pv, err := subimporter.PreviewFile(p.File, p.Name, rune(p.Delim[0]), app.constants.Attribs)
+		if err != nil {
+			os.Remove(p.File)
+			return err
+		}
+		c.SetProgress(pv.Total, pv.Total)
+		if err := c.SetResult(pv); err != nil {
+			os.Remove(p.File)
+			return err
+		}
+
+		// Retain the file to be imported on confirmation.
+		time.AfterFunc(importPreviewTTL, func() {
+			os.Remove(p.File)
+		})
+		return nil
+	}
+}
+
+// isImportSuppression checks whether a suppression policy of imports is valid.
+func isImportSuppression(s string) bool {
+	return s == subimporter.SuppressSkip || s == subimporter.SuppressFlag || s == subimporter.SuppressNone
 }
 
 // handleGetImportSubscribers returns import statistics.
@@ -116,9 +404,33 @@ func handleGetImportSubscriberStats(c echo.Context) error {
 
 // handleStopImportSubscribers sends a stop signal to the importer.
 // If there's an ongoing import, it'll be stopped, and if an import
-// is finished, it's state is cleared.
+// is finished, it's state is cleared. Import jobs that are queued or
+// running are cancelled.
 func handleStopImportSubscribers(c echo.Context) error {
 	app := c.Get("app").(*App)
-	app.importer.Stop()
+
+	// A running import job stops the import itself on being cancelled.
+	running := false
+	for _, st := range []string{jobs.StatusQueued, jobs.StatusRunning} {
+		var js []jobs.Job
+		if err := app.queries.QueryJobs.Select(&js, jobTypeImport, st, 0, 0); err != nil {
+			app.log.Printf("error fetching import jobs: %v", err)
+			continue
+		}
+		for _, j := range js {
+			if _, err := cancelJob(j.ID, app); err != nil {
+				if err != sql.ErrNoRows {
+					app.log.Printf("error cancelling import job %d: %v", j.ID, err)
+				}
+				continue
+			}
+			if st == jobs.StatusRunning {
+				running = true
+			}
+		}
+	}
+	if !running {
+		app.importer.Stop()
+	}
 	return c.JSON(http.StatusOK, okResp{app.importer.GetStats()})
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/inbox"
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/lib/pq"
+)
+
+const (
+	// Unsubscribe scopes of inbound unsubscribe replies.
+	inboundScopeLists     = "lists"
+	inboundScopeBlacklist = "blacklist"
+)
+
+// inboundConf represents the inbound mailbox settings.
+type inboundConf struct {
+	inbox.Opt `koanf:",squash"`
+
+	Enabled  bool     `koanf:"enabled"`
+	Scope    string   `koanf:"unsubscribe_scope"`
+	Keywords []string `koanf:"keywords"`
+
+	// Bounces records bounce reports sent to VERP addresses.
+	Bounces bool `koanf:"process_bounces"`
+}
+
+// bounceSourceVERP is the source of bounces attributed by VERP addresses.
+const bounceSourceVERP = "verp"
+
+// Encodings of the plus-addressed Reply-To of campaign messages.
+const (
+	replyEncodingUUID  = "uuid"
+	replyEncodingEmail = "email"
+)
+
+var (
+	// Reply prefixes in subjects, eg: Re: Fwd: AW:
+	regexpReplyPrefix = regexp.MustCompile(`(?i)^((re|fwd?|aw|sv|antw)\s*:\s*)+`)
+
+	// The line that introduces the quoted original message in replies,
+	// eg: On Mon, 1 Jan 2020, listmonk <x@y.com> wrote:
+	regexpQuoteIntro = regexp.MustCompile(`(?i)^on\s.+wrote:$`)
+
+	regexpNonAlpha = regexp.MustCompile(`[^a-z\s]+`)
+	regexpSpaces   = regexp.MustCompile(`\s+`)
+)
+
+// makeInboundHandler returns an inbox handler that unsubscribes senders
+// of replies with an unsubscribe intent. Messages without a clear intent or
+// from unknown senders are skipped and left untouched in the mailbox. If
+// verp is set, bounce reports to VERP addresses are recorded. If replies is
+// set, replies to the plus-addressed Reply-To of campaign messages are
+// recorded on the subscribers' activity.
+func makeInboundHandler(cfg inboundConf, verp, replies *messenger.VERP, app *App) inbox.Handler {
+	keywords := make(map[string]bool, len(cfg.Keywords))
+	for _, k := range cfg.Keywords {
+		keywords[normalizeIntent(k)] = true
+	}
+
+	blacklist := cfg.Scope == inboundScopeBlacklist
+	return func(m inbox.Message) (bool, error) {
+		if m.DSN != nil {
+			if verp == nil {
+				return false, nil
+			}
+			return recordVERPBounce(m, verp, app)
+		}
+
+		var recorded bool
+		if replies != nil {
+			ok, err := recordReply(m, replies, app)
+			if err != nil {
+				return false, err
+			}
+			recorded = ok
+		}
+
+		if !hasUnsubIntent(m, keywords) {
+			if !recorded {
+				app.log.Printf("inbound: skipping message %d from %s without a clear unsubscribe intent", m.UID, m.From)
+			}
+			return recorded, nil
+		}
+
+		var subUUID string
+		if err := app.queries.UnsubscribeByEmail.Get(&subUUID, m.From, blacklist); err != nil {
+			if err == sql.ErrNoRows {
+				app.log.Printf("inbound: skipping message %d from %s: no matching subscriber", m.UID, m.From)
+				return recorded, nil
+			}
+			return false, err
+		}
+
+		ev := webhooks.EventSubscriberUnsubscribed
+		if blacklist {
+			ev = webhooks.EventSubscriberBlacklisted
+		}
+		onStatusTransition(ev, nil, []string{subUUID}, app)
+
+		app.log.Printf("inbound: unsubscribed %s (%s) by reply", m.From, cfg.Scope)
+		return true, nil
+	}
+}
+
+// recordVERPBounce records the bounce of a subscriber that's decoded from
+// the VERP address a bounce report was delivered to. Reports that
+// aren't to a VERP address are skipped.
+func recordVERPBounce(m inbox.Message, verp *messenger.VERP, app *App) (bool, error) {
+	addr, ok, err := decodeRecipient(m, verp, true, app)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		app.log.Printf("inbound: skipping bounce %d without a VERP recipient", m.UID)
+		return false, nil
+	}
+
+	// Only failures are bounces. Delays, relays etc. are ignored.
+	if m.DSN.Action != "" && m.DSN.Action != "failed" {
+		return true, nil
+	}
+
+	meta, err := json.Marshal(m.DSN)
+	if err != nil {
+		return false, err
+	}
+
+	var id int64
+	if err := app.queries.InsertBounce.Get(&id, addr.SubscriberUUID, addr.Email,
+		addr.CampaignUUID, bounceSourceVERP, types.JSONText(meta), events.TypeBounce); err != nil {
+		if err == sql.ErrNoRows {
+			app.log.Printf("inbound: skipping bounce %d: no matching subscriber", m.UID)
+			return false, nil
+		}
+		return false, err
+	}
+
+	app.log.Printf("inbound: recorded bounce %d (%s) for subscriber %s%s",
+		m.UID, m.DSN.Status, addr.SubscriberUUID, addr.Email)
+	return true, nil
+}
+
+// recordReply records a reply of a subscriber to a campaign that's decoded
+// from the plus-addressed Reply-To the reply was delivered to. Messages that
+// aren't to a reply address are skipped.
+func recordReply(m inbox.Message, replies *messenger.VERP, app *App) (bool, error) {
+	addr, ok, err := decodeRecipient(m, replies, false, app)
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return false, nil
+	}
+
+	var id int64
+	if err := app.queries.InsertReply.Get(&id, addr.SubscriberUUID, addr.Email,
+		addr.CampaignUUID, m.MessageID, m.From, m.Subject); err != nil {
+		if err == sql.ErrNoRows {
+			app.log.Printf("inbound: skipping reply %d: no matching subscriber or already recorded", m.UID)
+			return false, nil
+		}
+		return false, err
+	}
+
+	app.log.Printf("inbound: recorded reply %d from %s to campaign %s", m.UID, m.From, addr.CampaignUUID)
+	return true, nil
+}
+
+// decodeRecipient decodes the first of the recipients of a message that
+// matches a VERP pattern or the pattern rebased on the bounce (or Reply-To)
+// addresses of lists, which campaign messages to the lists are sent with.
+func decodeRecipient(m inbox.Message, v *messenger.VERP, bounce bool, app *App) (messenger.VERPAddr, bool, error) {
+	for _, r := range m.Recipients {
+		if addr, ok := v.Decode(r); ok {
+			return addr, true, nil
+		}
+	}
+
+	var l struct {
+		ReplyTo       pq.StringArray `db:"reply_to"`
+		BounceAddress pq.StringArray `db:"bounce_address"`
+	}
+	if err := app.queries.GetListAddresses.Get(&l); err != nil {
+		return messenger.VERPAddr{}, false, err
+	}
+
+	addrs := l.ReplyTo
+	if bounce {
+		addrs = l.BounceAddress
+	}
+	for _, a := range addrs {
+		lv, err := v.Rebase(a)
+		if err != nil {
+			continue
+		}
+		for _, r := range m.Recipients {
+			if addr, ok := lv.Decode(r); ok {
+				return addr, true, nil
+			}
+		}
+	}
+	return messenger.VERPAddr{}, false, nil
+}
+
+// hasUnsubIntent checks whether the subject or the first line of the reply
+// (excluding the quoted original message) is exactly one of the keywords.
+// Anything else is considered ambiguous.
+func hasUnsubIntent(m inbox.Message, keywords map[string]bool) bool {
+	if keywords[normalizeIntent(regexpReplyPrefix.ReplaceAllString(m.Subject, ""))] {
+		return true
+	}
+
+	for _, l := range strings.Split(m.Body, "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		if strings.HasPrefix(l, ">") || regexpQuoteIntro.MatchString(l) {
+			return false
+		}
+		return keywords[normalizeIntent(l)]
+	}
+	return false
+}
+
+// normalizeIntent lowercases a string and strips punctuation and
+// extra whitespace from it.
+func normalizeIntent(s string) string {
+	s = regexpNonAlpha.ReplaceAllString(strings.ToLower(s), "")
+	return strings.TrimSpace(regexpSpaces.ReplaceAllString(s, " "))
+}
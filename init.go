@@ -1,29 +1,62 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
+	"net/http"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/goyesql/v2"
 	goyesqlx "github.com/knadh/goyesql/v2/sqlx"
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/maps"
+	"github.com/knadh/listmonk/internal/cron"
+	"github.com/knadh/listmonk/internal/events"
+	"github.com/knadh/listmonk/internal/inbox"
+	"github.com/knadh/listmonk/internal/jobs"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
-	"github.com/knadh/listmonk/internal/media/providers/filesystem"
-	"github.com/knadh/listmonk/internal/media/providers/s3"
 	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/sanitize"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/transform"
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
 	"github.com/labstack/echo"
+	"golang.org/x/crypto/bcrypt"
+
+	// Media store providers register themselves with the media package.
+	_ "github.com/knadh/listmonk/internal/media/providers/filesystem"
+	"github.com/knadh/listmonk/internal/media/providers/s3"
 )
 
+// rateUnits are the units of app.message_rate. Empty is a second.
+var rateUnits = map[string]time.Duration{
+	"":       time.Second,
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    time.Hour * 24,
+}
+
+// minMessageInterval is the shortest interval at which a worker can be
+// paced to send messages.
+const minMessageInterval = time.Millisecond
+
 const (
 	queryFilePath = "queries.sql"
+
+	// minFreeDBConns is the number of DB connections that should be
+	// available over the campaign workers' (app.concurrency).
+	minFreeDBConns = 5
 )
 
 // initFileSystem initializes the stuffbin FileSystem to provide
@@ -99,9 +132,41 @@ func initDB() *sqlx.DB {
 		lo.Fatalf("error connecting to DB: %v", err)
 	}
 
+	// Campaign workers may each hold a connection (eg: registering links
+	// while rendering messages). Leave some for the HTTP handlers.
+	if n := ko.Int("app.concurrency"); dbCfg.MaxOpen > 0 && dbCfg.MaxOpen < n+minFreeDBConns {
+		lo.Printf("WARNING: db.max_open (%d) should be at least app.concurrency (%d) + %d "+
+			"so that campaigns don't starve the HTTP handlers of connections", dbCfg.MaxOpen, n, minFreeDBConns)
+	}
+
 	return db
 }
 
+// dbWorkers returns the number of workers of bulk imports or exports in a
+// config key, each of which holds a DB connection. It's capped to the
+// connections left in the pool (db.max_open) after the campaign workers
+// and the ones for the HTTP handlers.
+func dbWorkers(key string) int {
+	n := ko.Int(key)
+	if n < 1 {
+		n = 1
+	}
+
+	max := ko.Int("db.max_open")
+	if max == 0 {
+		return n
+	}
+	free := max - ko.Int("app.concurrency") - minFreeDBConns
+	if free < 1 {
+		free = 1
+	}
+	if n > free {
+		lo.Printf("WARNING: %s (%d) is capped to %d by the connections left in db.max_open (%d)", key, n, free, max)
+		n = free
+	}
+	return n
+}
+
 // initQueries loads named SQL queries from the queries file and optionally
 // prepares them.
 func initQueries(sqlFile string, db *sqlx.DB, fs stuffbin.FileSystem, prepareQueries bool) (goyesql.Queries, *Queries) {
@@ -129,25 +194,159 @@ func initQueries(sqlFile string, db *sqlx.DB, fs stuffbin.FileSystem, prepareQue
 
 // constants contains static, constant config values required by the app.
 type constants struct {
-	RootURL      string   `koanf:"root"`
-	LogoURL      string   `koanf:"logo_url"`
-	FaviconURL   string   `koanf:"favicon_url"`
-	FromEmail    string   `koanf:"from_email"`
-	NotifyEmails []string `koanf:"notify_emails"`
-	Privacy      struct {
-		AllowBlacklist bool            `koanf:"allow_blacklist"`
-		AllowExport    bool            `koanf:"allow_export"`
-		AllowWipe      bool            `koanf:"allow_wipe"`
-		Exportable     map[string]bool `koanf:"-"`
-	} `koanf:"privacy"`
+	RootURL      string      `koanf:"root"`
+	LogoURL      string      `koanf:"logo_url"`
+	FaviconURL   string      `koanf:"favicon_url"`
+	FromEmail    string      `koanf:"from_email"`
+	DefMessenger string      `koanf:"default_messenger"`
+	NotifyEmails []string    `koanf:"notify_emails"`
+	LangAttrib   string      `koanf:"lang_attribute"`
+	ConvSecret   string      `koanf:"conversion_secret"`
+	Privacy      privacyConf `koanf:"privacy"`
+
+	// LocalSendAttrib is the subscriber attribute that has the timezone
+	// of subscribers for campaigns with a local send time. Subscribers
+	// without a valid one are in LocalSendTZ.
+	LocalSendAttrib string `koanf:"local_send_attribute"`
+	LocalSendTZ     string `koanf:"local_send_timezone"`
+
+	// AttributionWindow is the default window from the start of campaigns
+	// that their windowed stats count events in. 0 disables them.
+	AttributionWindow time.Duration `koanf:"attribution_window"`
+
+	// ImportSuppression is the default policy of imports for records that
+	// match suppressed subscribers (subimporter.Suppress*).
+	ImportSuppression string `koanf:"import_suppression"`
 
 	UnsubURL     string
 	LinkTrackURL string
+	ShortLinkURL string
 	ViewTrackURL string
+	ConvTrackURL string
 	OptinURL     string
 	MessageURL   string
 
+	// TrackingDomains is the map of configured tracking domains
+	// and their base URLs, eg: track.site.com => https://track.site.com
+	TrackingDomains map[string]string
+
+	// Messengers is the map of messenger names and their
+	// template settings.
+	Messengers map[string]messengerConf
+
+	// Categories is the map of campaign categories and the defaults
+	// of their new campaigns.
+	Categories map[string]categoryConf
+
 	MediaProvider string
+	MediaUpload   uploadConf
+
+	// Sanitizer sanitizes campaign bodies rendered on public pages.
+	// It's nil if sanitization is disabled.
+	Sanitizer *sanitize.Policy
+
+	// Attribs normalizes the phone and locale attributes of subscribers.
+	// It's nil if no attributes are normalized.
+	Attribs *subimporter.AttribRules
+
+	// SendConfirm has the settings of the confirmation of large sends.
+	SendConfirm sendConfirmConf `koanf:"-"`
+
+	// CampaignApproval requires campaigns to be approved by a user other
+	// than the one who submitted them before they're sent.
+	CampaignApproval bool `koanf:"-"`
+}
+
+// uploadConf contains the restrictions on media uploads.
+type uploadConf struct {
+	// Maximum file size in KB.
+	MaxSize int64 `koanf:"max_file_size"`
+
+	// Allowed MIME types (detected from the file's contents) and file
+	// extensions. An empty list allows all.
+	Types []string `koanf:"allowed_types"`
+	Exts  []string `koanf:"allowed_extensions"`
+}
+
+// privacyConf contains the privacy settings of subscribers.
+type privacyConf struct {
+	AllowBlacklist bool            `koanf:"allow_blacklist"`
+	AllowExport    bool            `koanf:"allow_export"`
+	AllowWipe      bool            `koanf:"allow_wipe"`
+	DelHistory     string          `koanf:"deletion_history"`
+	UnsubReasons   []string        `koanf:"unsubscribe_reasons"`
+	Exportable     map[string]bool `koanf:"-"`
+
+	// DisableTracking disables the tracking of campaign views and link
+	// clicks, and their webhooks.
+	DisableTracking bool `koanf:"disable_tracking"`
+
+	// UnsubRedirectHosts are the hosts that the unsubscribe redirect URLs
+	// of lists and campaigns can point to. Empty allows any host. The
+	// status appended to redirects is signed with UnsubRedirectSecret.
+	UnsubRedirectHosts  []string `koanf:"unsubscribe_redirect_hosts"`
+	UnsubRedirectSecret string   `koanf:"unsubscribe_redirect_secret"`
+}
+
+// footerConf contains the templates of the mandatory campaign footer.
+type footerConf struct {
+	Template      string `koanf:"template"`
+	TemplatePlain string `koanf:"template_plain"`
+}
+
+// domainLimitConf contains the rate limit and the concurrency cap of the
+// campaign messages to the recipients of a group of domains.
+type domainLimitConf struct {
+	Domains     []string      `koanf:"domains"`
+	Rate        int           `koanf:"rate"`
+	Window      time.Duration `koanf:"window"`
+	Concurrency int           `koanf:"concurrency"`
+}
+
+// messengerConf contains the template settings of a messenger.
+type messengerConf struct {
+	// Template formats (html, plain) that the messenger can send.
+	// An empty list allows all formats.
+	TemplateFormats []string `koanf:"template_formats"`
+
+	// ID of the template that campaigns on the messenger get when
+	// they're created without one. 0 uses the default template.
+	DefaultTemplate int `koanf:"default_template"`
+
+	// Names of the transforms (internal/transform) that are applied in
+	// order to the rendered bodies of the messages pushed to the messenger.
+	Transforms []string `koanf:"transforms"`
+}
+
+// initAdminUser creates the first admin user from app.admin_email and
+// app.admin_password if there are no users.
+func initAdminUser(q *Queries) {
+	var n int
+	if err := q.CountUsers.Get(&n); err != nil {
+		lo.Fatalf("error counting users: %v", err)
+	}
+	if n > 0 {
+		return
+	}
+
+	var (
+		email = strings.TrimSpace(ko.String("app.admin_email"))
+		pwd   = ko.String("app.admin_password")
+	)
+	if email == "" || !strHasLen(pwd, userPasswordMinLen, userPasswordMaxLen) {
+		lo.Fatalf("there are no users. Set app.admin_email and app.admin_password (%d to %d characters) to create the admin user",
+			userPasswordMinLen, userPasswordMaxLen)
+	}
+
+	h, err := bcrypt.GenerateFromPassword([]byte(pwd), bcrypt.DefaultCost)
+	if err != nil {
+		lo.Fatalf("error hashing admin password: %v", err)
+	}
+	if _, err := q.CreateUser.Exec(email, "Admin", string(h),
+		models.UserRoleAdmin, models.UserStatusEnabled); err != nil {
+		lo.Fatalf("error creating admin user: %v", err)
+	}
+	lo.Printf("created admin user %s", email)
 }
 
 func initConstants() *constants {
@@ -156,12 +355,83 @@ func initConstants() *constants {
 	if err := ko.Unmarshal("app", &c); err != nil {
 		lo.Fatalf("error loading app config: %v", err)
 	}
-	if err := ko.Unmarshal("privacy", &c.Privacy); err != nil {
+	p, err := loadPrivacy(ko)
+	if err != nil {
 		lo.Fatalf("error loading app config: %v", err)
 	}
+	c.Privacy = p
 	c.RootURL = strings.TrimRight(c.RootURL, "/")
-	c.Privacy.Exportable = maps.StringSliceToLookupMap(ko.Strings("privacy.exportable"))
 	c.MediaProvider = ko.String("upload.provider")
+	if c.MediaUpload, err = loadUpload(ko); err != nil {
+		lo.Fatalf("error loading upload config: %v", err)
+	}
+	if c.Sanitizer, err = loadSanitizer(ko); err != nil {
+		lo.Fatalf("error loading sanitize config: %v", err)
+	}
+	c.Attribs = initAttribRules()
+	if c.ImportSuppression == "" {
+		c.ImportSuppression = subimporter.SuppressSkip
+	}
+	if !isImportSuppression(c.ImportSuppression) {
+		lo.Fatalf("unknown app.import_suppression '%s'", c.ImportSuppression)
+	}
+	if c.SendConfirm, err = loadSendConfirm(ko); err != nil {
+		lo.Fatalf("error loading send_confirmation config: %v", err)
+	}
+	c.CampaignApproval = ko.Bool("campaign_approval.enabled")
+	if c.DefMessenger == "" {
+		c.DefMessenger = "email"
+	}
+	if c.AttributionWindow < 0 {
+		lo.Fatal("app.attribution_window can't be negative")
+	}
+	if c.LocalSendTZ == "" {
+		c.LocalSendTZ = "UTC"
+	}
+	if _, err := time.LoadLocation(c.LocalSendTZ); err != nil {
+		lo.Fatalf("invalid app.local_send_timezone '%s': %v", c.LocalSendTZ, err)
+	}
+
+	// Tracking domains.
+	c.TrackingDomains = make(map[string]string)
+	for _, d := range ko.Strings("app.tracking_domains") {
+		host, base, err := parseTrackingDomain(d, c.RootURL)
+		if err != nil {
+			lo.Fatalf("invalid tracking domain '%s': %v", d, err)
+		}
+		c.TrackingDomains[host] = base
+	}
+
+	// Messenger template settings.
+	c.Messengers = make(map[string]messengerConf)
+	for _, name := range ko.MapKeys("messengers") {
+		var m messengerConf
+		if err := ko.Unmarshal("messengers."+name, &m); err != nil {
+			lo.Fatalf("error loading messenger config: %v", err)
+		}
+		for _, f := range m.TemplateFormats {
+			if f != models.TemplateFormatHTML && f != models.TemplateFormatPlain {
+				lo.Fatalf("invalid template format '%s' for messenger '%s'", f, name)
+			}
+		}
+		if _, err := transform.New(m.Transforms); err != nil {
+			lo.Fatalf("invalid transforms for messenger '%s': %v", name, err)
+		}
+		c.Messengers[name] = m
+	}
+
+	// Campaign category defaults.
+	c.Categories = make(map[string]categoryConf)
+	for _, name := range ko.MapKeys("campaign_categories") {
+		if !isCampaignCategory(name) {
+			lo.Fatalf("unknown campaign category '%s' in campaign_categories", name)
+		}
+		var cat categoryConf
+		if err := ko.Unmarshal("campaign_categories."+name, &cat); err != nil {
+			lo.Fatalf("error loading campaign category config: %v", err)
+		}
+		c.Categories[name] = cat
+	}
 
 	// Static URLS.
 	// url.com/subscription/{campaign_uuid}/{subscriber_uuid}
@@ -173,16 +443,124 @@ func initConstants() *constants {
 	// url.com/link/{campaign_uuid}/{subscriber_uuid}/{link_uuid}
 	c.LinkTrackURL = fmt.Sprintf("%s/link/%%s/%%s/%%s", c.RootURL)
 
+	// url.com/s/{code}
+	c.ShortLinkURL = fmt.Sprintf("%s/s/%%s", c.RootURL)
+
 	// url.com/link/{campaign_uuid}/{subscriber_uuid}
 	c.MessageURL = fmt.Sprintf("%s/campaign/%%s/%%s", c.RootURL)
 
 	// url.com/campaign/{campaign_uuid}/{subscriber_uuid}/px.png
 	c.ViewTrackURL = fmt.Sprintf("%s/campaign/%%s/%%s/px.png", c.RootURL)
+
+	// url.com/conversion/{campaign_uuid}/{subscriber_uuid}?token={token}
+	c.ConvTrackURL = fmt.Sprintf("%s/conversion/%%s/%%s?token=%%s", c.RootURL)
 	return &c
 }
 
 // initCampaignManager initializes the campaign manager.
-func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
+// loadPrivacy loads the privacy settings from a config.
+func loadPrivacy(k *koanf.Koanf) (privacyConf, error) {
+	var p privacyConf
+	if err := k.Unmarshal("privacy", &p); err != nil {
+		return p, err
+	}
+	p.Exportable = maps.StringSliceToLookupMap(k.Strings("privacy.exportable"))
+
+	switch p.DelHistory {
+	case "":
+		p.DelHistory = delHistoryAnonymize
+	case delHistoryAnonymize, delHistoryDelete:
+	default:
+		return p, fmt.Errorf("unknown privacy.deletion_history '%s'. Should be anonymize or delete", p.DelHistory)
+	}
+	return p, nil
+}
+
+// loadUpload loads the media upload restrictions from a config.
+func loadUpload(k *koanf.Koanf) (uploadConf, error) {
+	u := uploadConf{
+		MaxSize: k.Int64("upload.max_file_size"),
+		Types:   k.Strings("upload.allowed_types"),
+	}
+	if u.MaxSize < 1 {
+		u.MaxSize = 5120
+	}
+
+	for i, t := range u.Types {
+		u.Types[i] = strings.ToLower(strings.TrimSpace(t))
+	}
+	for _, e := range k.Strings("upload.allowed_extensions") {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		u.Exts = append(u.Exts, e)
+	}
+	return u, nil
+}
+
+// loadSanitizer loads the HTML sanitization policy of public pages from
+// a config. It returns nil if sanitization is disabled.
+func loadSanitizer(k *koanf.Koanf) (*sanitize.Policy, error) {
+	if !k.Bool("sanitize.enabled") {
+		return nil, nil
+	}
+	if len(k.Strings("sanitize.tags")) == 0 {
+		return nil, errors.New("sanitize.tags should have at least one tag")
+	}
+	return sanitize.New(k.Strings("sanitize.tags"), k.Strings("sanitize.attributes"),
+		k.Strings("sanitize.url_schemes")), nil
+}
+
+// initAttribRules loads the subscriber attributes that are normalized.
+// It returns nil if there are none.
+func initAttribRules() *subimporter.AttribRules {
+	r := &subimporter.AttribRules{
+		Phones:      ko.Strings("attribs.phone"),
+		CountryCode: strings.TrimPrefix(ko.String("attribs.phone_country_code"), "+"),
+		Locales:     ko.Strings("attribs.locale"),
+	}
+	if len(r.Phones) == 0 && len(r.Locales) == 0 {
+		return nil
+	}
+	for _, c := range r.CountryCode {
+		if c < '0' || c > '9' {
+			lo.Fatalf("invalid attribs.phone_country_code '%s'", r.CountryCode)
+		}
+	}
+	return r
+}
+
+// initMessageLog loads the settings of the log of rendered campaign messages
+// and returns them with the retention of the logged messages.
+func initMessageLog() (manager.MessageLogConfig, time.Duration) {
+	var c msgLogConf
+	if err := ko.Unmarshal("message_log", &c); err != nil {
+		lo.Fatalf("error loading message_log config: %v", err)
+	}
+	if !c.Enabled {
+		return manager.MessageLogConfig{}, 0
+	}
+	if c.Sample < 0 || c.Sample > 1 {
+		lo.Fatal("message_log.sample should be between 0 and 1")
+	}
+	if c.Retention <= 0 {
+		lo.Fatal("message_log.retention should be set to purge logged messages")
+	}
+
+	out := manager.MessageLogConfig{Sample: c.Sample, Emails: make(map[string]bool, len(c.Emails))}
+	for _, e := range c.Emails {
+		out.Emails[strings.ToLower(strings.TrimSpace(e))] = true
+	}
+	lo.Printf("logging rendered messages of %.2f%% of recipients and %d e-mails for %v",
+		c.Sample*100, len(out.Emails), c.Retention)
+	return out, c.Retention
+}
+
+func initCampaignManager(q *Queries, cs *constants, msgLog manager.MessageLogConfig, app *App) *manager.Manager {
 	campNotifCB := func(subject string, data interface{}) error {
 		return app.sendNotification(cs.NotifyEmails, subject, notifTplCampaign, data)
 	}
@@ -193,20 +571,310 @@ func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 	if ko.Int("app.message_rate") < 1 {
 		lo.Fatal("app.message_rate should be at least 1")
 	}
+	rateUnit, ok := rateUnits[ko.String("app.message_rate_unit")]
+	if !ok {
+		lo.Fatalf("unknown app.message_rate_unit '%s'. Should be second, minute, hour, or day",
+			ko.String("app.message_rate_unit"))
+	}
+	if rateUnit/time.Duration(ko.Int("app.message_rate")) < minMessageInterval {
+		lo.Fatalf("app.message_rate is too high. Each worker can send at most one message every %v",
+			minMessageInterval)
+	}
+	outagePolicy := ko.String("app.outage_policy")
+	switch outagePolicy {
+	case "", models.CampaignOutagePause, models.CampaignOutageCancel, models.CampaignOutageContinue:
+	default:
+		lo.Fatalf("unknown app.outage_policy '%s'. Should be pause, cancel, or continue", outagePolicy)
+	}
+	errorMode := ko.String("app.send_error_mode")
+	switch errorMode {
+	case "", models.CampaignErrorModeCount:
+	case models.CampaignErrorModeRate:
+		if r := ko.Float64("app.max_send_error_rate"); r <= 0 || r > 100 {
+			lo.Fatal("app.max_send_error_rate should be between 0 and 100")
+		}
+		if w := ko.Int("app.send_error_window"); w < 1 || w > manager.MaxErrorWindow {
+			lo.Fatalf("app.send_error_window should be between 1 and %d", manager.MaxErrorWindow)
+		}
+	default:
+		lo.Fatalf("unknown app.send_error_mode '%s'. Should be count or rate", errorMode)
+	}
+
+	// Send failure alerts.
+	var (
+		alerts  manager.AlertConfig
+		alertCB manager.AlertCallback
+	)
+	if ko.Bool("send_alerts.enabled") {
+		alerts = manager.AlertConfig{
+			ErrorRate:         ko.Float64("send_alerts.error_rate"),
+			Window:            ko.Int("send_alerts.window"),
+			ConsecutiveErrors: ko.Int("send_alerts.consecutive_errors"),
+			Cooldown:          ko.Duration("send_alerts.cooldown"),
+			Samples:           ko.Int("send_alerts.samples"),
+		}
+		if alerts.ErrorRate < 0 || alerts.ErrorRate > 100 {
+			lo.Fatal("send_alerts.error_rate should be between 0 and 100")
+		}
+
+		notify := ko.Bool("send_alerts.notify")
+		alertCB = func(a manager.SendAlert) {
+			app.sendAlert(a, notify)
+		}
+	}
+
+	tplFormats := make(map[string][]string, len(cs.Messengers))
+	transforms := make(map[string]transform.Transform, len(cs.Messengers))
+	for name, m := range cs.Messengers {
+		tplFormats[name] = m.TemplateFormats
+		transforms[name], _ = transform.New(m.Transforms)
+	}
+
+	// Tag messages for the e-mail provider's events.
+	var tagHeaders func(string, string) textproto.MIMEHeader
+	if app.events != nil {
+		tagHeaders = app.events.Provider.Headers
+	}
+
+	// Plaintext bodies were always generated before they were configurable.
+	autoAltBody := !ko.Exists("app.auto_altbody") || ko.Bool("app.auto_altbody")
+
+	footer := initFooter()
+	m := manager.New(manager.Config{
+		BatchSize:       ko.Int("app.batch_size"),
+		Concurrency:     ko.Int("app.concurrency"),
+		MessageRate:     ko.Int("app.message_rate"),
+		MessageRateUnit: rateUnit,
+		MaxSendErrors:   ko.Int("app.max_send_errors"),
+		ErrorMode:       errorMode,
+		MaxErrorRate:    ko.Float64("app.max_send_error_rate"),
+		ErrorWindow:     ko.Int("app.send_error_window"),
+		MaxRunning:      ko.Int("app.max_running_campaigns"),
+		AutoAltBody:     autoAltBody,
+		OutagePolicy:    outagePolicy,
+		RequireApproval: cs.CampaignApproval,
+		FromEmail:       cs.FromEmail,
+		UnsubURL:        cs.UnsubURL,
+		OptinURL:        cs.OptinURL,
+		LinkTrackURL:    cs.LinkTrackURL,
+		ShortLinkURL:    cs.ShortLinkURL,
+		ViewTrackURL:    cs.ViewTrackURL,
+		MessageURL:      cs.MessageURL,
+
+		ConversionURL:    cs.ConvTrackURL,
+		ConversionSecret: cs.ConvSecret,
+		DisableTracking:  cs.Privacy.DisableTracking,
+
+		RootURL:         cs.RootURL,
+		TrackingDomains: cs.TrackingDomains,
+		TemplateFormats: tplFormats,
+		Transforms:      transforms,
+		LangAttrib:      cs.LangAttrib,
+
+		Alerts:  alerts,
+		AlertCB: alertCB,
+
+		Fallback: manager.FallbackConfig{
+			Chain:      ko.Strings("messenger_fallback.chain"),
+			Errors:     ko.Int("messenger_fallback.errors"),
+			RetryAfter: ko.Duration("messenger_fallback.retry_after"),
+		},
+		DomainLimits: initDomainLimits(),
+		Footer:       footer,
+		MessageLog:   msgLog,
+		ReplyTo:      initReplies(),
+		TagHeaders:   tagHeaders,
+		FinishCB:     app.campaignFinished,
+	}, newManagerDB(q, ko.Bool("app.campaign_snapshots"), cs.LocalSendAttrib, cs.LocalSendTZ), campNotifCB, lo)
+
+	// Check that the footer templates compile.
+	camp := models.Campaign{TemplateBody: tplTag, Variants: models.CampaignVariants{}}
+	for lang := range footer.Templates {
+		if lang != "" {
+			camp.Variants[lang] = models.CampaignVariant{}
+		}
+	}
+	for _, f := range []string{models.TemplateFormatHTML, models.TemplateFormatPlain} {
+		camp.TemplateFormat = f
+		if err := m.CompileTemplate(&camp); err != nil {
+			lo.Fatalf("error compiling footer: %v", err)
+		}
+	}
+
+	return m
+}
+
+// initFooter loads the mandatory campaign footer and its localized templates.
+func initFooter() manager.FooterConfig {
+	out := manager.FooterConfig{
+		Address: ko.String("footer.postal_address"),
+		Strict:  ko.Bool("footer.strict"),
+	}
+	if !ko.Bool("footer.enabled") {
+		return out
+	}
+
+	var f footerConf
+	if err := ko.Unmarshal("footer", &f); err != nil {
+		lo.Fatalf("error loading footer config: %v", err)
+	}
+	out.Templates = map[string]models.Footer{
+		"": {HTML: f.Template, Plain: f.TemplatePlain},
+	}
+
+	for _, lang := range ko.MapKeys("footer.lang") {
+		var l footerConf
+		if err := ko.Unmarshal("footer.lang."+lang, &l); err != nil {
+			lo.Fatalf("error loading footer config: %v", err)
+		}
+		if !regexLangCode.MatchString(lang) {
+			lo.Fatalf("invalid footer language code '%s'", lang)
+		}
+
+		// Missing templates fall back to the default ones.
+		if l.Template == "" {
+			l.Template = f.Template
+		}
+		if l.TemplatePlain == "" {
+			l.TemplatePlain = f.TemplatePlain
+		}
+		out.Templates[lang] = models.Footer{HTML: l.Template, Plain: l.TemplatePlain}
+	}
+	return out
+}
+
+// initDomainLimits loads the rate limits and concurrency caps of the campaign
+// messages to the recipients of groups of domains.
+func initDomainLimits() []manager.DomainLimit {
+	var (
+		out  []manager.DomainLimit
+		seen = make(map[string]string)
+	)
+	for _, name := range ko.MapKeys("domain_limits") {
+		var d domainLimitConf
+		if err := ko.Unmarshal("domain_limits."+name, &d); err != nil {
+			lo.Fatalf("error loading domain_limits config: %v", err)
+		}
+		if len(d.Domains) == 0 {
+			lo.Fatalf("domain_limits.%s.domains is empty", name)
+		}
+		if d.Rate < 0 || d.Concurrency < 0 {
+			lo.Fatalf("domain_limits.%s.rate and concurrency should be >= 0", name)
+		}
+		if d.Window < 0 {
+			lo.Fatalf("domain_limits.%s.window should be >= 0", name)
+		} else if d.Window == 0 {
+			d.Window = time.Minute
+		}
+		for i, dom := range d.Domains {
+			dom = strings.ToLower(strings.TrimSpace(dom))
+			if other, ok := seen[dom]; ok {
+				lo.Fatalf("domain '%s' is in both domain_limits.%s and domain_limits.%s", dom, other, name)
+			}
+			seen[dom] = name
+			d.Domains[i] = dom
+		}
+
+		out = append(out, manager.DomainLimit{
+			Domains:     d.Domains,
+			Rate:        d.Rate,
+			Window:      d.Window,
+			Concurrency: d.Concurrency,
+		})
+		lo.Printf("limiting messages to %s to %d per %v and %d at a time (0 is unlimited)",
+			strings.Join(d.Domains, ", "), d.Rate, d.Window, d.Concurrency)
+	}
+	return out
+}
 
-	return manager.New(manager.Config{
-		BatchSize:     ko.Int("app.batch_size"),
-		Concurrency:   ko.Int("app.concurrency"),
-		MessageRate:   ko.Int("app.message_rate"),
-		MaxSendErrors: ko.Int("app.max_send_errors"),
-		FromEmail:     cs.FromEmail,
-		UnsubURL:      cs.UnsubURL,
-		OptinURL:      cs.OptinURL,
-		LinkTrackURL:  cs.LinkTrackURL,
-		ViewTrackURL:  cs.ViewTrackURL,
-		MessageURL:    cs.MessageURL,
-	}, newManagerDB(q), campNotifCB, lo)
+// initAttribIndexes loads the subscriber attribute keys whose indexes are
+// ready for the segment compiler.
+func initAttribIndexes(q *Queries) *attribIndexes {
+	a := &attribIndexes{}
+	if err := a.load(q); err != nil {
+		lo.Fatalf("error loading attribute indexes: %v", err)
+	}
+	return a
+}
 
+// initJobs initializes the background job runner and registers the job types.
+func initJobs(q *Queries, exps map[string]exportConf, app *App) *jobs.Runner {
+	r := jobs.New(&jobsDB{queries: q}, lo)
+	r.Register(jobs.Type{Name: jobTypeImport, Handler: makeImportJobHandler(app)})
+	r.Register(jobs.Type{Name: jobTypeImportPreview, Handler: makeImportPreviewJobHandler(app)})
+	r.Register(jobs.Type{Name: jobTypeExport, Handler: makeExportJobHandler(exps, app)})
+	r.Register(jobs.Type{Name: jobTypeMediaMigration, Handler: makeMediaMigrationJobHandler(app), Resumable: true})
+	r.Register(jobs.Type{Name: jobTypeAttribIndex, Handler: makeAttribIndexJobHandler(app), Resumable: true})
+	return r
+}
+
+// initExports loads the enabled scheduled exports. Their files are uploaded
+// to S3 with the upload.s3 credentials.
+func initExports(exportable map[string]bool) map[string]exportConf {
+	out := make(map[string]exportConf)
+	for _, name := range ko.MapKeys("exports") {
+		if !ko.Bool(fmt.Sprintf("exports.%s.enabled", name)) {
+			lo.Printf("skipped export: %s", name)
+			continue
+		}
+
+		e := exportConf{Name: name, Delimiter: ",", Header: true}
+		if err := ko.Unmarshal("exports."+name, &e); err != nil {
+			lo.Fatalf("error loading export config: %v", err)
+		}
+
+		s, err := cron.Parse(e.Schedule)
+		if err != nil {
+			lo.Fatalf("invalid schedule for export '%s': %v", name, err)
+		}
+		if s.Next(time.Now()).IsZero() {
+			lo.Fatalf("schedule '%s' of export '%s' never runs", e.Schedule, name)
+		}
+		e.sched = s
+		e.workers = dbWorkers("app.export_concurrency")
+
+		if _, ok := exportFields[e.Entity]; !ok {
+			lo.Fatalf("unknown entity '%s' for export '%s'", e.Entity, name)
+		}
+		if e.Format != exportCSV && e.Format != exportJSON {
+			lo.Fatalf("unknown format '%s' for export '%s'", e.Format, name)
+		}
+		if e.Retain < 0 {
+			lo.Fatalf("exports.%s.retain should be >= 0", name)
+		}
+
+		if d := []rune(e.Delimiter); len(d) != 1 || d[0] == '"' || d[0] == '\r' || d[0] == '\n' {
+			lo.Fatalf("exports.%s.delimiter should be a single character", name)
+		} else {
+			e.comma = d[0]
+		}
+
+		// Pick the fields in the given order.
+		if e.fields, err = selectExportFields(e.Entity, e.Fields, exportable); err != nil {
+			lo.Fatalf("error loading fields of export '%s': %v", name, err)
+		}
+		if len(e.fields) == 0 {
+			lo.Fatalf("export '%s' has no fields allowed by privacy.exportable", name)
+		}
+
+		var opts s3.Opts
+		if err := ko.Unmarshal("upload.s3", &opts); err != nil {
+			lo.Fatalf("error loading upload.s3 config: %v", err)
+		}
+		if e.Bucket != "" {
+			opts.Bucket = e.Bucket
+		}
+		opts.BucketPath = "/"
+		st, err := s3.NewS3Store(opts)
+		if err != nil {
+			lo.Fatalf("error initializing S3 for export '%s': %v", name, err)
+		}
+		e.store = st
+
+		out[name] = e
+		lo.Printf("loaded export: %s (%s, %s)", name, e.Entity, e.Schedule)
+	}
+	return out
 }
 
 // initImporter initializes the bulk subscriber importer.
@@ -215,81 +883,400 @@ func initImporter(q *Queries, db *sqlx.DB, app *App) *subimporter.Importer {
 		subimporter.Options{
 			UpsertStmt:         q.UpsertSubscriber.Stmt,
 			BlacklistStmt:      q.UpsertBlacklistSubscriber.Stmt,
+			UpsertBatchStmt:    q.UpsertSubscribers.Stmt,
+			BlacklistBatchStmt: q.UpsertBlacklistSubscribers.Stmt,
 			UpdateListDateStmt: q.UpdateListsDate.Stmt,
+			SuppressedStmt:     q.GetSuppressedSubscribers.Stmt,
+			BatchSize:          ko.Int("app.import_batch_size"),
+			Concurrency:        dbWorkers("app.import_concurrency"),
+			Attribs:            app.constants.Attribs,
 			NotifCB: func(subject string, data interface{}) error {
 				app.sendNotification(app.constants.NotifyEmails, subject, notifTplImport, data)
 				return nil
 			},
+			BatchCB: func(emails []string) {
+				applyListRules(nil, emails, app)
+			},
+			BlacklistCB: func(uuids []string) {
+				onStatusTransition(webhooks.EventSubscriberBlacklisted, nil, uuids, app)
+			},
 		}, db.DB)
 }
 
-// initMessengers initializes various messenger backends.
-func initMessengers(m *manager.Manager) messenger.Messenger {
+// initMessengers initializes various messenger backends and, in the
+// benchmark mode, the fake messenger.
+func initMessengers(m *manager.Manager) (messenger.Messenger, *messenger.Fake) {
+	// Initialize the default e-mail messenger.
+	msgr, err := newEmailer(ko, initVERP())
+	if err != nil {
+		lo.Fatalf("error loading e-mail messenger: %v", err)
+	}
+	if err := m.AddMessenger(msgr); err != nil {
+		lo.Printf("error registering messenger %s", err)
+	}
+
+	fake := initBenchmark()
+	if fake != nil {
+		if err := m.AddMessenger(fake); err != nil {
+			lo.Printf("error registering messenger %s", err)
+		}
+	}
+
+	// Validate the default and fallback messengers.
+	if d := ko.String("app.default_messenger"); d != "" && !m.HasMessenger(d) {
+		lo.Fatalf("unknown app.default_messenger '%s'", d)
+	}
+	for _, n := range ko.Strings("messenger_fallback.chain") {
+		if !m.HasMessenger(n) {
+			lo.Fatalf("unknown messenger '%s' in messenger_fallback.chain", n)
+		}
+	}
+
+	return msgr, fake
+}
+
+// initBenchmark initializes the fake messenger of the benchmark mode, if
+// it's enabled.
+func initBenchmark() *messenger.Fake {
+	var c benchmarkConf
+	if err := ko.Unmarshal("benchmark", &c); err != nil {
+		lo.Fatalf("error loading benchmark config: %v", err)
+	}
+	if !c.Enabled {
+		return nil
+	}
+
+	f, err := messenger.NewFake(benchmarkMessenger, messenger.FakeConfig{
+		Latency:   c.Latency,
+		Jitter:    c.Jitter,
+		ErrorRate: c.ErrorRate,
+	})
+	if err != nil {
+		lo.Fatalf("error loading benchmark config: %v", err)
+	}
+	lo.Printf("WARNING: benchmark mode is enabled. Messages of campaigns on the '%s' messenger are discarded", benchmarkMessenger)
+	return f
+}
+
+// initLinkChecker initializes the checker of the URLs of campaigns. The hosts
+// of the root URL and the tracking domains are its own hosts.
+func initLinkChecker(cs *constants, st media.Store) *linkChecker {
+	c := linkCheckConf{
+		Timeout:       10 * time.Second,
+		SlowThreshold: 3 * time.Second,
+		Rate:          5,
+		Concurrency:   2,
+		MaxURLs:       200,
+	}
+	if err := ko.Unmarshal("link_check", &c); err != nil {
+		lo.Fatalf("error loading link_check config: %v", err)
+	}
+	if c.Timeout <= 0 || c.Rate <= 0 || c.Concurrency < 1 || c.MaxURLs < 0 || c.SlowThreshold < 0 {
+		lo.Fatal("link_check.timeout, rate, and concurrency should be > 0, and max_urls and slow_threshold >= 0")
+	}
+
+	origins := make(map[string]bool)
+	if u, err := url.Parse(cs.RootURL); err == nil {
+		origins[origin(u)] = true
+	}
+	for _, base := range cs.TrackingDomains {
+		if u, err := url.Parse(base); err == nil {
+			origins[origin(u)] = true
+		}
+	}
+
+	// The URLs of files in the media store are its prefix and the names.
+	var prefix string
+	if u := st.URL("x"); strings.HasSuffix(u, "/x") {
+		prefix = strings.TrimSuffix(u, "x")
+	}
+
+	return newLinkChecker(c, origins, prefix)
+}
+
+// newEmailer initializes the e-mail messenger with the enabled SMTP servers in a config.
+func newEmailer(k *koanf.Koanf, verp *messenger.VERP) (*messenger.Emailer, error) {
 	var (
-		mapKeys = ko.MapKeys("smtp")
+		mapKeys = k.MapKeys("smtp")
 		srv     = make([]messenger.Server, 0, len(mapKeys))
 	)
 
-	// Load the default SMTP messengers.
 	for _, name := range mapKeys {
-		if !ko.Bool(fmt.Sprintf("smtp.%s.enabled", name)) {
+		if !k.Bool(fmt.Sprintf("smtp.%s.enabled", name)) {
 			lo.Printf("skipped SMTP: %s", name)
 			continue
 		}
 
 		// Read the SMTP config.
 		s := messenger.Server{Name: name}
-		if err := ko.UnmarshalWithConf("smtp."+name, &s, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-			lo.Fatalf("error loading SMTP: %v", err)
+		if err := k.UnmarshalWithConf("smtp."+name, &s, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			return nil, fmt.Errorf("error loading SMTP: %v", err)
 		}
+		s.VERP = verp
+		s.Charset = k.String("app.charset")
+		s.Encoding = k.String("app.transfer_encoding")
 
 		srv = append(srv, s)
 		lo.Printf("loaded SMTP: %s (%s@%s)", s.Name, s.Username, s.Host)
 	}
 	if len(srv) == 0 {
-		lo.Fatalf("no SMTP servers found in config")
+		return nil, errors.New("no SMTP servers found in config")
 	}
 
-	// Initialize the default e-mail messenger.
-	msgr, err := messenger.NewEmailer(srv...)
+	return messenger.NewEmailer(srv...)
+}
+
+// initRetention loads the retention settings of tracking events.
+func initRetention() retentionConf {
+	var c retentionConf
+	if err := ko.Unmarshal("privacy.retention", &c); err != nil {
+		lo.Fatalf("error loading retention config: %v", err)
+	}
+	if c.CampaignViews < 0 || c.LinkClicks < 0 {
+		lo.Fatal("privacy.retention periods should be >= 0")
+	}
+	if c.Interval < time.Minute {
+		c.Interval = time.Hour * 24
+	}
+	if c.BatchSize < 1 {
+		c.BatchSize = 10000
+	}
+	return c
+}
+
+// initInbox initializes the optional inbound mailbox scanner that processes
+// unsubscribe replies.
+func initInbox(app *App) *inbox.Inbox {
+	var c inboundConf
+	if err := ko.Unmarshal("inbound", &c); err != nil {
+		lo.Fatalf("error loading inbound config: %v", err)
+	}
+	if !c.Enabled {
+		return nil
+	}
+
+	switch c.Scope {
+	case inboundScopeLists:
+	case inboundScopeBlacklist:
+		if !app.constants.Privacy.AllowBlacklist {
+			lo.Fatal("inbound.unsubscribe_scope = blacklist requires privacy.allow_blacklist")
+		}
+	default:
+		lo.Fatalf("unknown inbound.unsubscribe_scope '%s'", c.Scope)
+	}
+	if len(c.Keywords) == 0 {
+		lo.Fatal("inbound.keywords should have at least one keyword")
+	}
+
+	var verp *messenger.VERP
+	if c.Bounces {
+		if verp = initVERP(); verp == nil {
+			lo.Fatal("inbound.process_bounces requires bounce.verp_enabled")
+		}
+	}
+
+	ib, err := inbox.New(c.Opt, makeInboundHandler(c, verp, initReplies(), app), lo)
 	if err != nil {
-		lo.Fatalf("error loading e-mail messenger: %v", err)
+		lo.Fatalf("error initializing inbound mailbox: %v", err)
 	}
-	if err := m.AddMessenger(msgr); err != nil {
-		lo.Printf("error registering messenger %s", err)
+	lo.Printf("scanning inbound mailbox: %s@%s/%s", c.Username, c.Host, c.Mailbox)
+	return ib
+}
+
+// initVERP returns the VERP encoder of envelope sender addresses if VERP is
+// enabled, or nil.
+func initVERP() *messenger.VERP {
+	if !ko.Bool("bounce.verp_enabled") {
+		return nil
 	}
 
-	return msgr
+	v, err := messenger.NewVERP(ko.String("bounce.verp_pattern"))
+	if err != nil {
+		lo.Fatalf("invalid bounce.verp_pattern: %v", err)
+	}
+	return v
 }
 
-// initMediaStore initializes Upload manager with a custom backend.
-func initMediaStore() media.Store {
-	switch provider := ko.String("upload.provider"); provider {
-	case "s3":
-		var opts s3.Opts
-		ko.Unmarshal("upload.s3", &opts)
-		uplder, err := s3.NewS3Store(opts)
-		if err != nil {
-			lo.Fatalf("error initializing s3 upload provider %s", err)
-		}
-		return uplder
+// initProviderEvents returns the config of the webhook of the e-mail
+// provider's events if it's enabled, or nil.
+func initProviderEvents() *eventsConf {
+	if !ko.Bool("provider_events.enabled") {
+		return nil
+	}
 
-	case "filesystem":
-		var opts filesystem.Opts
-		ko.Unmarshal("upload.filesystem", &opts)
-		opts.RootURL = ko.String("app.root")
-		opts.UploadPath = filepath.Clean(opts.UploadPath)
-		opts.UploadURI = filepath.Clean(opts.UploadURI)
-		uplder, err := filesystem.NewDiskStore(opts)
-		if err != nil {
-			lo.Fatalf("error initializing filesystem upload provider %s", err)
+	var (
+		name   = ko.String("provider_events.provider")
+		secret = ko.String("provider_events.secret")
+	)
+	p, err := events.Get(name)
+	if err != nil {
+		lo.Fatalf("error loading provider_events: %v", err)
+	}
+	if len(secret) < 16 {
+		lo.Fatal("provider_events.secret should be at least 16 characters")
+	}
+
+	action := ko.String("provider_events.complaint_action")
+	switch action {
+	case "":
+		action = complaintUnsubscribe
+	case complaintUnsubscribe, complaintBlacklist, complaintNone:
+	default:
+		lo.Fatalf("unknown provider_events.complaint_action '%s'. Should be unsubscribe, blacklist, or none", action)
+	}
+
+	lo.Printf("recording %s events on /webhooks/events", name)
+	return &eventsConf{
+		Name:     name,
+		Secret:   secret,
+		Provider: p,
+
+		ComplaintAction: action,
+		ComplaintNotify: ko.Bool("provider_events.complaint_notify"),
+	}
+}
+
+// initSubscriberWebhook returns the config of the inbound webhook that
+// creates subscribers if it's enabled, or nil.
+func initSubscriberWebhook() *subWebhookConf {
+	if !ko.Bool("subscriber_webhook.enabled") {
+		return nil
+	}
+
+	c := &subWebhookConf{
+		Secret:    ko.String("subscriber_webhook.secret"),
+		Lists:     ko.Strings("subscriber_webhook.lists"),
+		EmailPath: ko.String("subscriber_webhook.mapping.email"),
+		NamePath:  ko.String("subscriber_webhook.mapping.name"),
+		ListsPath: ko.String("subscriber_webhook.mapping.lists"),
+		Attribs:   make(map[string]string),
+	}
+	if len(c.Secret) < 16 {
+		lo.Fatal("subscriber_webhook.secret should be at least 16 characters")
+	}
+	if c.EmailPath == "" {
+		lo.Fatal("subscriber_webhook.mapping.email is required")
+	}
+	if len(c.Lists) == 0 {
+		lo.Fatal("subscriber_webhook.lists should have at least one list UUID")
+	}
+	for _, l := range c.Lists {
+		if !reUUID.MatchString(l) {
+			lo.Fatalf("invalid list UUID '%s' in subscriber_webhook.lists", l)
 		}
-		return uplder
+	}
+	for _, k := range ko.MapKeys("subscriber_webhook.mapping.attribs") {
+		c.Attribs[k] = ko.String("subscriber_webhook.mapping.attribs." + k)
+	}
+
+	lo.Printf("creating subscribers on /webhooks/subscribers")
+	return c
+}
+
+// initReplies returns the encoder of the plus-addressed Reply-To of campaign
+// messages if reply tracking is enabled, or nil.
+func initReplies() *messenger.VERP {
+	if !ko.Bool("replies.enabled") {
+		return nil
+	}
+
+	var (
+		prefix = strings.TrimSpace(ko.String("replies.prefix"))
+		domain = strings.TrimSpace(ko.String("replies.domain"))
+	)
+	if prefix == "" || domain == "" {
+		lo.Fatal("replies.prefix and replies.domain are required")
+	}
 
+	var pattern string
+	switch ko.String("replies.encoding") {
+	case replyEncodingUUID:
+		pattern = prefix + "+{campaign}+{subscriber}@" + domain
+	case replyEncodingEmail:
+		pattern = prefix + "+{campaign}+{email}@" + domain
 	default:
-		lo.Fatalf("unknown provider. please select one of either filesystem or s3")
+		lo.Fatalf("unknown replies.encoding '%s'", ko.String("replies.encoding"))
+	}
+
+	v, err := messenger.NewVERP(pattern)
+	if err != nil {
+		lo.Fatalf("invalid replies.prefix or replies.domain: %v", err)
+	}
+	if !ko.Bool("inbound.enabled") {
+		lo.Println("WARNING: replies.enabled requires inbound.enabled for replies to be recorded")
+	}
+	return v
+}
+
+// initWebhooks initializes the outbound webhook dispatcher.
+func initWebhooks(q *Queries) *webhooks.Webhooks {
+	var (
+		mapKeys = ko.MapKeys("webhooks.endpoints")
+		eps     = make([]webhooks.Endpoint, 0, len(mapKeys))
+	)
+
+	for _, name := range mapKeys {
+		if !ko.Bool(fmt.Sprintf("webhooks.endpoints.%s.enabled", name)) {
+			lo.Printf("skipped webhook: %s", name)
+			continue
+		}
+
+		e := webhooks.Endpoint{Name: name}
+		if err := ko.Unmarshal("webhooks.endpoints."+name, &e); err != nil {
+			lo.Fatalf("error loading webhook: %v", err)
+		}
+
+		eps = append(eps, e)
+		lo.Printf("loaded webhook: %s (%s)", e.Name, strings.Join(e.Events, ", "))
 	}
-	return nil
+
+	var schedule []time.Duration
+	for _, s := range ko.Strings("webhooks.retry_schedule") {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			lo.Fatalf("invalid duration '%s' in webhooks.retry_schedule", s)
+		}
+		schedule = append(schedule, d)
+	}
+
+	w, err := webhooks.New(webhooks.Opt{
+		Endpoints:     eps,
+		Concurrency:   ko.Int("webhooks.concurrency"),
+		QueueSize:     ko.Int("webhooks.queue_size"),
+		RetrySchedule: schedule,
+		MaxRetries:    ko.Int("webhooks.max_retries"),
+		RetryInterval: ko.Duration("webhooks.retry_interval"),
+		Timeout:       ko.Duration("webhooks.timeout"),
+	}, &webhooksDB{queries: q}, lo)
+	if err != nil {
+		lo.Fatalf("error initializing webhooks: %v", err)
+	}
+	return w
+}
+
+// initMediaStore initializes Upload manager with a custom backend
+// from the registered providers.
+func initMediaStore() media.Store {
+	st, err := newMediaStore(ko)
+	if err != nil {
+		lo.Fatalf("error initializing %s upload provider: %v", ko.String("upload.provider"), err)
+	}
+	return st
+}
+
+// newMediaStore initializes the configured media store provider from a config.
+func newMediaStore(k *koanf.Koanf) (media.Store, error) {
+	return newProviderMediaStore(k, k.String("upload.provider"))
+}
+
+// newProviderMediaStore initializes a media store provider from its config.
+func newProviderMediaStore(k *koanf.Koanf, provider string) (media.Store, error) {
+	return media.New(provider, media.Opt{
+		RootURL: k.String("app.root"),
+		Unmarshal: func(o interface{}) error {
+			return k.Unmarshal("upload."+provider, o)
+		},
+	})
 }
 
 // initNotifTemplates compiles and returns e-mail notification templates that are
@@ -311,20 +1298,34 @@ func initNotifTemplates(path string, fs stuffbin.FileSystem, cs *constants) *tem
 	return tpl
 }
 
-// initHTTPServer sets up and runs the app's main HTTP server and blocks forever.
-func initHTTPServer(app *App) {
+// initHTTPServer sets up the app's main HTTP server and starts it
+// in the background.
+func initHTTPServer(app *App) *echo.Echo {
 	// Initialize the HTTP server.
 	var srv = echo.New()
 	srv.HideBanner = true
+	srv.Server.ReadTimeout = ko.Duration("app.read_timeout")
+	srv.Server.WriteTimeout = ko.Duration("app.write_timeout")
+	srv.Server.IdleTimeout = ko.Duration("app.idle_timeout")
+	srv.Server.RegisterOnShutdown(func() {
+		close(httpShutdown)
+	})
 
 	// Register app (*App) to be injected into all HTTP handlers.
+	// Settings reloads swap the instance in liveApp.
+	liveApp.Store(app)
 	srv.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
-			c.Set("app", app)
+			c.Set("app", liveApp.Load().(*App))
 			return next(c)
 		}
 	})
 
+	// Only serve tracking routes on tracking domains.
+	if len(app.constants.TrackingDomains) > 0 {
+		srv.Use(trackingDomainFilter(app.constants.TrackingDomains))
+	}
+
 	// Parse and load user facing templates.
 	tpl, err := stuffbin.ParseTemplatesGlob(nil, app.fs, "/public/templates/*.html")
 	if err != nil {
@@ -340,14 +1341,18 @@ func initHTTPServer(app *App) {
 	fSrv := app.fs.FileServer()
 	srv.GET("/public/*", echo.WrapHandler(fSrv))
 	srv.GET("/frontend/*", echo.WrapHandler(fSrv))
-	if ko.String("upload.provider") == "filesystem" {
-		srv.Static(ko.String("upload.filesystem.upload_uri"),
-			ko.String("upload.filesystem.upload_path"))
+	if st, ok := app.media.(media.StaticStore); ok {
+		srv.Static(st.StaticDir())
 	}
 
 	// Register all HTTP handlers.
 	registerHTTPHandlers(srv)
 
 	// Start the server.
-	srv.Logger.Fatal(srv.Start(ko.String("app.address")))
+	go func() {
+		if err := srv.Start(ko.String("app.address")); err != http.ErrServerClosed {
+			lo.Fatalf("error starting HTTP server: %v", err)
+		}
+	}()
+	return srv
 }
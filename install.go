@@ -10,10 +10,13 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/types"
 	goyesqlx "github.com/knadh/goyesql/v2/sqlx"
+	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/knadh/stuffbin"
 	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 // install runs the first time setup of creating and
@@ -62,6 +65,9 @@ func install(db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		models.ListTypePrivate,
 		models.ListOptinSingle,
 		pq.StringArray{"test"},
+		"", "", "",
+		models.SendWindows{}, "UTC",
+		"", 0, 0, "", "", "",
 	); err != nil {
 		lo.Fatalf("Error creating list: %v", err)
 	}
@@ -71,6 +77,9 @@ func install(db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		models.ListTypePublic,
 		models.ListOptinDouble,
 		pq.StringArray{"test"},
+		"", "", "",
+		models.SendWindows{}, "UTC",
+		"", 0, 0, "", "", "",
 	); err != nil {
 		lo.Fatalf("Error creating list: %v", err)
 	}
@@ -82,7 +91,8 @@ func install(db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		"John Doe",
 		`{"type": "known", "good": true, "city": "Bengaluru"}`,
 		pq.Int64Array{int64(defList)},
-		true); err != nil {
+		subimporter.ConflictOverwrite,
+		subimporter.ListsAdd); err != nil {
 		lo.Fatalf("Error creating subscriber: %v", err)
 	}
 	if _, err := q.UpsertSubscriber.Exec(
@@ -91,7 +101,8 @@ func install(db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		"Anon Doe",
 		`{"type": "unknown", "good": true, "city": "Bengaluru"}`,
 		pq.Int64Array{int64(optinList)},
-		true); err != nil {
+		subimporter.ConflictOverwrite,
+		subimporter.ListsAdd); err != nil {
 		lo.Fatalf("Error creating subscriber: %v", err)
 	}
 
@@ -105,6 +116,8 @@ func install(db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 	if err := q.CreateTemplate.Get(&tplID,
 		"Default template",
 		string(tplBody),
+		models.TemplateFormatHTML,
+		uuid.Must(uuid.NewV4()),
 	); err != nil {
 		lo.Fatalf("error creating default template: %v", err)
 	}
@@ -127,6 +140,37 @@ func install(db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		"email",
 		1,
 		pq.Int64Array{1},
+		"",
+		nil,
+		"",
+		models.CampaignVariants{},
+		models.CampaignSendOrderID,
+		"",
+		false,
+		"",
+		nil,
+		models.CampaignPriorityDefault,
+		false,
+		"",
+		"",
+		"",
+		"",
+		0,
+		models.CampaignRolloutGate{},
+		"",
+		types.JSONText(`{}`),
+		"",
+		"",
+		null.Bool{},
+		false,
+		"",
+		0,
+		0,
+		"",
+		0,
+		"",
+		models.CampaignABTest{},
+		false,
 	); err != nil {
 		lo.Fatalf("error creating sample campaign: %v", err)
 	}
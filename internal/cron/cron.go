@@ -0,0 +1,186 @@
+// Package cron parses standard 5 field cron expressions
+// (minute hour day-of-month month day-of-week) and computes the times
+// at which they fire.
+package cron
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shortcuts are the predefined schedules.
+var shortcuts = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// maxYears is the number of years that Next looks ahead for a match
+// to terminate on expressions that never fire, eg: "0 0 31 2 *".
+const maxYears = 5
+
+// Schedule represents a parsed cron expression. Each field is a bitset
+// of the values it matches.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day fields are unrestricted (*). If both days are
+	// restricted, a day that matches either of them matches.
+	domStar, dowStar bool
+}
+
+// field represents the range of values of a cron field.
+type field struct {
+	name     string
+	min, max int
+}
+
+var fields = []field{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// Parse parses a cron expression. Each field is *, a value, a range (a-b),
+// or a comma separated list of them with an optional step (*/n, a-b/n).
+// In the day of week field, both 0 and 7 are Sunday. The shortcuts @yearly,
+// @monthly, @weekly, @daily, and @hourly are also accepted.
+func Parse(spec string) (*Schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if s, ok := shortcuts[strings.ToLower(spec)]; ok {
+		spec = s
+	}
+
+	parts := strings.Fields(spec)
+	if len(parts) != len(fields) {
+		return nil, fmt.Errorf("expected %d fields in '%s', got %d", len(fields), spec, len(parts))
+	}
+
+	var vals [5]uint64
+	for i, p := range parts {
+		v, err := parseField(p, fields[i])
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+
+	// Sunday is both 0 and 7.
+	if vals[4]&(1<<7) != 0 {
+		vals[4] = (vals[4] | 1) &^ (1 << 7)
+	}
+
+	return &Schedule{
+		minute:  vals[0],
+		hour:    vals[1],
+		dom:     vals[2],
+		month:   vals[3],
+		dow:     vals[4],
+		domStar: strings.HasPrefix(parts[2], "*"),
+		dowStar: strings.HasPrefix(parts[4], "*"),
+	}, nil
+}
+
+// parseField parses a single field into a bitset of its values.
+func parseField(s string, f field) (uint64, error) {
+	var out uint64
+	for _, p := range strings.Split(s, ",") {
+		var (
+			rng  = p
+			step = 1
+		)
+		if i := strings.Index(p, "/"); i >= 0 {
+			n, err := strconv.Atoi(p[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %s '%s'", f.name, p)
+			}
+			rng, step = p[:i], n
+		}
+
+		lo, hi := f.min, f.max
+		switch {
+		case rng == "*":
+		case strings.Contains(rng, "-"):
+			i := strings.Index(rng, "-")
+			a, err1 := strconv.Atoi(rng[:i])
+			b, err2 := strconv.Atoi(rng[i+1:])
+			if err1 != nil || err2 != nil || a > b {
+				return 0, fmt.Errorf("invalid range in %s '%s'", f.name, p)
+			}
+			lo, hi = a, b
+		default:
+			n, err := strconv.Atoi(rng)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value in %s '%s'", f.name, p)
+			}
+			// A value with a step (5/15) runs till the end of the range.
+			lo = n
+			if step == 1 {
+				hi = n
+			}
+		}
+
+		if lo < f.min || hi > f.max {
+			return 0, fmt.Errorf("%s '%s' is out of range %d-%d", f.name, p, f.min, f.max)
+		}
+		for v := lo; v <= hi; v += step {
+			out |= 1 << uint(v)
+		}
+	}
+	return out, nil
+}
+
+// Next returns the first time after t (in t's location) at which the
+// schedule fires, or a zero time if it doesn't fire in the next few years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	var (
+		loc   = t.Location()
+		limit = t.Year() + maxYears
+	)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Year() <= limit {
+		if !has(s.month, int(t.Month())) {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Truncate(time.Minute).Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// matchDay checks whether the day of t matches the day fields.
+func (s *Schedule) matchDay(t time.Time) bool {
+	var (
+		dom = has(s.dom, t.Day())
+		dow = has(s.dow, int(t.Weekday()))
+	)
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
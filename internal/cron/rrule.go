@@ -0,0 +1,127 @@
+package cron
+
+import (
+	"fmt"
+	"strings"
+)
+
+// rruleDays are the iCalendar weekdays and their cron day of week values.
+var rruleDays = map[string]string{
+	"SU": "0",
+	"MO": "1",
+	"TU": "2",
+	"WE": "3",
+	"TH": "4",
+	"FR": "5",
+	"SA": "6",
+}
+
+// ParseRule parses a schedule that's either a cron expression (see Parse)
+// or an iCalendar recurrence rule (see ParseRRule) that starts with RRULE:
+// or FREQ=.
+func ParseRule(spec string) (*Schedule, error) {
+	s := strings.ToUpper(strings.TrimSpace(spec))
+	if strings.HasPrefix(s, "RRULE:") || strings.HasPrefix(s, "FREQ=") {
+		return ParseRRule(spec)
+	}
+	return Parse(spec)
+}
+
+// ParseRRule parses the subset of iCalendar (RFC 5545) recurrence rules that
+// cron expressions can express: a FREQ of HOURLY, DAILY, WEEKLY, MONTHLY, or
+// YEARLY with the BYMONTH, BYMONTHDAY, BYDAY (without ordinals), BYHOUR, and
+// BYMINUTE parts, eg: FREQ=WEEKLY;BYDAY=MO,TH;BYHOUR=9. The parts that aren't
+// given are pinned to the start of their period like the cron shortcuts,
+// eg: 00:00 for DAILY, Sunday for WEEKLY, and the 1st for MONTHLY. INTERVALs
+// other than 1, COUNT, and UNTIL aren't supported.
+func ParseRRule(rule string) (*Schedule, error) {
+	rule = strings.TrimSpace(rule)
+	if len(rule) >= 6 && strings.EqualFold(rule[:6], "RRULE:") {
+		rule = rule[6:]
+	}
+
+	parts := make(map[string]string)
+	for _, p := range strings.Split(strings.ToUpper(rule), ";") {
+		if p == "" {
+			continue
+		}
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid rule part '%s'", p)
+		}
+		if _, ok := parts[kv[0]]; ok {
+			return nil, fmt.Errorf("duplicate rule part '%s'", kv[0])
+		}
+		parts[kv[0]] = kv[1]
+	}
+
+	var (
+		freq   = parts["FREQ"]
+		minute = "0"
+		hour   = "0"
+		dom    = "*"
+		month  = "*"
+		dow    = "*"
+	)
+	switch freq {
+	case "HOURLY":
+		hour = "*"
+	case "DAILY":
+	case "WEEKLY":
+		dow = "0"
+	case "MONTHLY":
+		dom = "1"
+	case "YEARLY":
+		dom, month = "1", "1"
+	case "":
+		return nil, fmt.Errorf("FREQ is required in '%s'", rule)
+	default:
+		return nil, fmt.Errorf("unsupported FREQ '%s'", freq)
+	}
+
+	for k, v := range parts {
+		switch k {
+		case "FREQ", "WKST":
+		case "INTERVAL":
+			if v != "1" {
+				return nil, fmt.Errorf("unsupported INTERVAL '%s'", v)
+			}
+		case "BYMINUTE":
+			minute = v
+		case "BYHOUR":
+			hour = v
+		case "BYMONTHDAY":
+			dom = v
+		case "BYMONTH":
+			month = v
+		case "BYDAY":
+			days := strings.Split(v, ",")
+			for i, d := range days {
+				n, ok := rruleDays[d]
+				if !ok {
+					return nil, fmt.Errorf("unsupported BYDAY '%s'", d)
+				}
+				days[i] = n
+			}
+			dow = strings.Join(days, ",")
+		default:
+			return nil, fmt.Errorf("unsupported rule part '%s'", k)
+		}
+	}
+
+	// Cron matches either of the day fields when both are restricted while
+	// rules match both, so they can't be combined.
+	_, byDay := parts["BYDAY"]
+	_, byMonthDay := parts["BYMONTHDAY"]
+	if byDay && byMonthDay {
+		return nil, fmt.Errorf("BYDAY and BYMONTHDAY can't be combined")
+	}
+	if byDay {
+		dom = "*"
+	}
+	if byMonthDay {
+		dow = "*"
+	}
+
+	return Parse(strings.Join([]string{minute, hour, dom, month, dow}, " "))
+}
@@ -0,0 +1,110 @@
+// Package events parses the delivery events, eg: bounces and opens, that
+// e-mail providers post to webhooks into a common format. Providers are
+// looked up by name in a dispatch table that new ones can be registered in.
+package events
+
+import (
+	"fmt"
+	"net/textproto"
+	"sort"
+	"sync"
+)
+
+// Event types.
+const (
+	TypeBounce    = "bounce"
+	TypeComplaint = "complaint"
+	TypeOpen      = "open"
+	TypeClick     = "click"
+)
+
+// Headers that tag messages with the UUIDs of their campaigns and
+// subscribers for providers that report the headers of messages.
+const (
+	HeaderCampaign   = "X-Listmonk-Campaign"
+	HeaderSubscriber = "X-Listmonk-Subscriber"
+)
+
+// Event represents a delivery event of a message reported by a provider.
+type Event struct {
+	Type  string
+	Email string
+
+	// UUIDs of the campaign and the subscriber of the message from its
+	// tags (see Provider.Headers). They're empty if the message wasn't tagged.
+	CampaignUUID   string
+	SubscriberUUID string
+
+	// Soft is set on temporary bounces, eg: full mailboxes.
+	Soft bool
+
+	// URL is the clicked URL of click events.
+	URL string
+
+	// Meta has the provider's details of the event, eg: the status and
+	// the diagnostic of a bounce.
+	Meta map[string]string
+}
+
+// Provider represents an e-mail provider's webhook format.
+type Provider struct {
+	// Parse parses the body of a webhook request into events. Events that
+	// aren't of one of the types are skipped.
+	Parse func(b []byte) ([]Event, error)
+
+	// Headers returns the headers that tag a message with its campaign and
+	// subscriber in a way that the provider reports them back on events.
+	Headers func(campUUID, subUUID string) textproto.MIMEHeader
+}
+
+// ConfirmError is returned by parsers on requests that ask for a webhook
+// subscription to be confirmed by requesting the URL.
+type ConfirmError struct {
+	URL string
+}
+
+func (e *ConfirmError) Error() string {
+	return "webhook subscription confirmation"
+}
+
+var (
+	providers = map[string]Provider{
+		"postmark": {Parse: parsePostmark, Headers: postmarkHeaders},
+		"mailgun":  {Parse: parseMailgun, Headers: mailgunHeaders},
+		"ses":      {Parse: parseSES, Headers: tagHeaders},
+	}
+	mut sync.RWMutex
+)
+
+// Register registers a provider in the dispatch table, replacing the
+// provider with the same name if there's one.
+func Register(name string, p Provider) {
+	mut.Lock()
+	providers[name] = p
+	mut.Unlock()
+}
+
+// Get returns the provider registered with a name.
+func Get(name string) (Provider, error) {
+	mut.RLock()
+	defer mut.RUnlock()
+
+	p, ok := providers[name]
+	if !ok {
+		names := make([]string, 0, len(providers))
+		for n := range providers {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Provider{}, fmt.Errorf("unknown provider '%s'. Should be one of %v", name, names)
+	}
+	return p, nil
+}
+
+// tagHeaders returns the listmonk headers that tag a message.
+func tagHeaders(campUUID, subUUID string) textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	h.Set(HeaderCampaign, campUUID)
+	h.Set(HeaderSubscriber, subUUID)
+	return h
+}
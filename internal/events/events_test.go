@@ -0,0 +1,466 @@
+package events
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+const (
+	campUUID = "8e5c0b4a-5f0c-4d4b-9d1e-1c3f0c2e6a11"
+	subUUID  = "1b0df5a2-7a59-4cf1-8b5c-0f0f1c8e0e22"
+)
+
+// snsNotification wraps an SES notification in an SNS delivery.
+func snsNotification(msg string) string {
+	b, _ := json.Marshal(map[string]string{
+		"Type":      "Notification",
+		"MessageId": "22b80b92-fdea-4c2c-8f9d-bdfb0c7bf324",
+		"TopicArn":  "arn:aws:sns:us-east-1:123456789012:ses-events",
+		"Message":   msg,
+	})
+	return string(b)
+}
+
+// sesHeaders are the headers of a tagged message in SES notifications.
+const sesHeaders = `"headers": [
+	{"name": "From", "value": "news@listmonk.app"},
+	{"name": "x-listmonk-campaign", "value": "` + campUUID + `"},
+	{"name": "X-Listmonk-Subscriber", "value": "` + subUUID + `"}
+]`
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		name     string
+		provider string
+		in       string
+		out      []Event
+		err      bool
+	}{
+		// Postmark.
+		{
+			name:     "postmark hard bounce",
+			provider: "postmark",
+			in: `{
+				"RecordType": "Bounce",
+				"MessageStream": "broadcast",
+				"ID": 4323372036854775807,
+				"Type": "HardBounce",
+				"TypeCode": 1,
+				"Name": "Hard bounce",
+				"MessageID": "883953f4-6105-42a2-a16a-77a8eac79483",
+				"Description": "The server was unable to deliver your message (ex: unknown user, mailbox not found).",
+				"Details": "smtp;550 5.1.1 The email account that you tried to reach does not exist.",
+				"Email": "john@example.com",
+				"BouncedAt": "2019-11-05T16:33:54.9070259Z",
+				"Inactive": true,
+				"Metadata": {"Campaign": "` + campUUID + `", "subscriber": "` + subUUID + `"}
+			}`,
+			out: []Event{{
+				Type: TypeBounce, Email: "john@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				Meta: map[string]string{
+					"message_id":  "883953f4-6105-42a2-a16a-77a8eac79483",
+					"type":        "HardBounce",
+					"code":        "1",
+					"description": "The server was unable to deliver your message (ex: unknown user, mailbox not found).",
+					"details":     "smtp;550 5.1.1 The email account that you tried to reach does not exist.",
+				},
+			}},
+		},
+		{
+			name:     "postmark soft bounce",
+			provider: "postmark",
+			in: `{
+				"RecordType": "Bounce",
+				"Type": "SoftBounce",
+				"TypeCode": 4096,
+				"MessageID": "00000000-0000-0000-0000-000000000001",
+				"Description": "Mailbox full",
+				"Email": "john@example.com",
+				"Inactive": false
+			}`,
+			out: []Event{{
+				Type: TypeBounce, Email: "john@example.com", Soft: true,
+				Meta: map[string]string{
+					"message_id":  "00000000-0000-0000-0000-000000000001",
+					"type":        "SoftBounce",
+					"code":        "4096",
+					"description": "Mailbox full",
+					"details":     "",
+				},
+			}},
+		},
+		{
+			name:     "postmark soft bounce deactivated",
+			provider: "postmark",
+			in:       `{"RecordType": "Bounce", "Type": "SoftBounce", "TypeCode": 4096, "Email": "john@example.com", "Inactive": true}`,
+			out: []Event{{
+				Type: TypeBounce, Email: "john@example.com",
+				Meta: map[string]string{"message_id": "", "type": "SoftBounce", "code": "4096", "description": "", "details": ""},
+			}},
+		},
+		{
+			name:     "postmark complaint",
+			provider: "postmark",
+			in: `{
+				"RecordType": "SpamComplaint",
+				"Type": "SpamComplaint",
+				"TypeCode": 512,
+				"MessageID": "00000000-0000-0000-0000-000000000002",
+				"Email": "john@example.com",
+				"Metadata": {"campaign": "` + campUUID + `"}
+			}`,
+			out: []Event{{
+				Type: TypeComplaint, Email: "john@example.com", CampaignUUID: campUUID,
+				Meta: map[string]string{"message_id": "00000000-0000-0000-0000-000000000002"},
+			}},
+		},
+		{
+			name:     "postmark open",
+			provider: "postmark",
+			in: `{
+				"RecordType": "Open",
+				"FirstOpen": true,
+				"Recipient": "john@example.com",
+				"MessageID": "00000000-0000-0000-0000-000000000003",
+				"ReceivedAt": "2019-11-05T16:33:54.9070259Z",
+				"Platform": "WebMail",
+				"Metadata": {"campaign": "` + campUUID + `", "subscriber": "` + subUUID + `"}
+			}`,
+			out: []Event{{
+				Type: TypeOpen, Email: "john@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				Meta: map[string]string{"message_id": "00000000-0000-0000-0000-000000000003"},
+			}},
+		},
+		{
+			name:     "postmark click",
+			provider: "postmark",
+			in: `{
+				"RecordType": "Click",
+				"ClickLocation": "HTML",
+				"Recipient": "john@example.com",
+				"MessageID": "00000000-0000-0000-0000-000000000004",
+				"OriginalLink": "https://listmonk.app/docs?a=1",
+				"Metadata": {"campaign": "` + campUUID + `", "subscriber": "` + subUUID + `"}
+			}`,
+			out: []Event{{
+				Type: TypeClick, Email: "john@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				URL:  "https://listmonk.app/docs?a=1",
+				Meta: map[string]string{"message_id": "00000000-0000-0000-0000-000000000004"},
+			}},
+		},
+		{
+			name:     "postmark delivery is skipped",
+			provider: "postmark",
+			in:       `{"RecordType": "Delivery", "Recipient": "john@example.com"}`,
+		},
+		{
+			name:     "postmark invalid",
+			provider: "postmark",
+			in:       `{"RecordType": `,
+			err:      true,
+		},
+
+		// Mailgun.
+		{
+			name:     "mailgun permanent failure",
+			provider: "mailgun",
+			in: `{
+				"signature": {"timestamp": "1529006854", "token": "a8ce0edb2dd8301dee6c2405235584e45aa91d1e9f979f3de0", "signature": "d2271d12299f6592d9d44cd9d250f0704e4674c30d79d07c47a66f95ce71cf55"},
+				"event-data": {
+					"event": "failed",
+					"id": "G9Bn5sl1TC6nu79C8C0bwg",
+					"timestamp": 1521233195.375624,
+					"severity": "permanent",
+					"reason": "suppress-bounce",
+					"recipient": "alice@example.com",
+					"delivery-status": {"code": 605, "message": "", "description": "Not delivering to previously bounced address", "attempt-no": 1},
+					"user-variables": {"campaign": "` + campUUID + `", "subscriber": "` + subUUID + `"}
+				}
+			}`,
+			out: []Event{{
+				Type: TypeBounce, Email: "alice@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				Meta: map[string]string{
+					"id":          "G9Bn5sl1TC6nu79C8C0bwg",
+					"severity":    "permanent",
+					"reason":      "suppress-bounce",
+					"code":        "605",
+					"message":     "",
+					"description": "Not delivering to previously bounced address",
+				},
+			}},
+		},
+		{
+			name:     "mailgun temporary failure",
+			provider: "mailgun",
+			in: `{"event-data": {
+				"event": "failed",
+				"id": "Fs7-5t81S2ir.TBSCRCxNg",
+				"severity": "temporary",
+				"reason": "generic",
+				"recipient": "alice@example.com",
+				"delivery-status": {"code": 452, "message": "4.2.2 The email account that you tried to reach is over quota."}
+			}}`,
+			out: []Event{{
+				Type: TypeBounce, Email: "alice@example.com", Soft: true,
+				Meta: map[string]string{
+					"id":          "Fs7-5t81S2ir.TBSCRCxNg",
+					"severity":    "temporary",
+					"reason":      "generic",
+					"code":        "452",
+					"message":     "4.2.2 The email account that you tried to reach is over quota.",
+					"description": "",
+				},
+			}},
+		},
+		{
+			name:     "mailgun complaint",
+			provider: "mailgun",
+			in: `{"event-data": {
+				"event": "complained",
+				"id": "ncV2XwymRUKbPek_MIM-Gw",
+				"recipient": "alice@example.com",
+				"user-variables": {"campaign": "` + campUUID + `"}
+			}}`,
+			out: []Event{{
+				Type: TypeComplaint, Email: "alice@example.com", CampaignUUID: campUUID,
+				Meta: map[string]string{"id": "ncV2XwymRUKbPek_MIM-Gw"},
+			}},
+		},
+		{
+			name:     "mailgun open",
+			provider: "mailgun",
+			in: `{"event-data": {
+				"event": "opened",
+				"id": "Ase7i2zsRYeDXztHGENqRA",
+				"recipient": "alice@example.com",
+				"user-variables": {"campaign": "` + campUUID + `", "subscriber": "` + subUUID + `"}
+			}}`,
+			out: []Event{{
+				Type: TypeOpen, Email: "alice@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				Meta: map[string]string{"id": "Ase7i2zsRYeDXztHGENqRA"},
+			}},
+		},
+		{
+			name:     "mailgun click",
+			provider: "mailgun",
+			in: `{"event-data": {
+				"event": "clicked",
+				"id": "Ase7i2zsRYeDXztHGENqRA",
+				"recipient": "alice@example.com",
+				"url": "https://listmonk.app/docs",
+				"user-variables": {"campaign": "` + campUUID + `", "subscriber": "` + subUUID + `"}
+			}}`,
+			out: []Event{{
+				Type: TypeClick, Email: "alice@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				URL:  "https://listmonk.app/docs",
+				Meta: map[string]string{"id": "Ase7i2zsRYeDXztHGENqRA"},
+			}},
+		},
+		{
+			name:     "mailgun untagged variables",
+			provider: "mailgun",
+			in:       `{"event-data": {"event": "opened", "id": "x", "recipient": "alice@example.com", "user-variables": {"campaign": 1}}}`,
+			out: []Event{{
+				Type: TypeOpen, Email: "alice@example.com",
+				Meta: map[string]string{"id": "x"},
+			}},
+		},
+		{
+			name:     "mailgun delivery is skipped",
+			provider: "mailgun",
+			in:       `{"event-data": {"event": "delivered", "recipient": "alice@example.com"}}`,
+		},
+		{
+			name:     "mailgun invalid",
+			provider: "mailgun",
+			in:       `[]`,
+			err:      true,
+		},
+
+		// SES.
+		{
+			name:     "ses subscription confirmation",
+			provider: "ses",
+			in: `{
+				"Type": "SubscriptionConfirmation",
+				"MessageId": "165545c9-2a5c-472c-8df2-7ff2be2b3b1b",
+				"Token": "2336412f37",
+				"TopicArn": "arn:aws:sns:us-east-1:123456789012:ses-events",
+				"SubscribeURL": "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription&Token=2336412f37"
+			}`,
+			err: true,
+		},
+		{
+			name:     "ses subscription confirmation without url",
+			provider: "ses",
+			in:       `{"Type": "SubscriptionConfirmation"}`,
+			err:      true,
+		},
+		{
+			name:     "ses permanent bounce",
+			provider: "ses",
+			in: snsNotification(`{
+				"notificationType": "Bounce",
+				"bounce": {
+					"bounceType": "Permanent",
+					"bounceSubType": "General",
+					"bouncedRecipients": [
+						{"emailAddress": "jane@example.com", "action": "failed", "status": "5.1.1", "diagnosticCode": "smtp; 550 5.1.1 user unknown"},
+						{"emailAddress": "richard@example.com", "action": "failed", "status": "5.1.1", "diagnosticCode": "smtp; 550 5.1.1 user unknown"}
+					],
+					"timestamp": "2016-01-27T14:59:38.237Z"
+				},
+				"mail": {
+					"messageId": "00000138111222aa-33322211-cccc-cccc-cccc-ddddaaaa0680-000000",
+					"destination": ["jane@example.com", "richard@example.com"],
+					` + sesHeaders + `
+				}
+			}`),
+			out: []Event{
+				{
+					Type: TypeBounce, Email: "jane@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+					Meta: map[string]string{
+						"message_id": "00000138111222aa-33322211-cccc-cccc-cccc-ddddaaaa0680-000000",
+						"type":       "Permanent",
+						"sub_type":   "General",
+						"status":     "5.1.1",
+						"diagnostic": "smtp; 550 5.1.1 user unknown",
+					},
+				},
+				{
+					Type: TypeBounce, Email: "richard@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+					Meta: map[string]string{
+						"message_id": "00000138111222aa-33322211-cccc-cccc-cccc-ddddaaaa0680-000000",
+						"type":       "Permanent",
+						"sub_type":   "General",
+						"status":     "5.1.1",
+						"diagnostic": "smtp; 550 5.1.1 user unknown",
+					},
+				},
+			},
+		},
+		{
+			name:     "ses transient bounce event",
+			provider: "ses",
+			in: snsNotification(`{
+				"eventType": "Bounce",
+				"bounce": {
+					"bounceType": "Transient",
+					"bounceSubType": "MailboxFull",
+					"bouncedRecipients": [{"emailAddress": "jane@example.com", "status": "4.2.2"}]
+				},
+				"mail": {"messageId": "m1", "destination": ["jane@example.com"]}
+			}`),
+			out: []Event{{
+				Type: TypeBounce, Email: "jane@example.com", Soft: true,
+				Meta: map[string]string{
+					"message_id": "m1",
+					"type":       "Transient",
+					"sub_type":   "MailboxFull",
+					"status":     "4.2.2",
+					"diagnostic": "",
+				},
+			}},
+		},
+		{
+			name:     "ses complaint",
+			provider: "ses",
+			in: snsNotification(`{
+				"notificationType": "Complaint",
+				"complaint": {
+					"complaintFeedbackType": "abuse",
+					"complainedRecipients": [{"emailAddress": "richard@example.com"}]
+				},
+				"mail": {"messageId": "m2", "destination": ["richard@example.com"], ` + sesHeaders + `}
+			}`),
+			out: []Event{{
+				Type: TypeComplaint, Email: "richard@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				Meta: map[string]string{"message_id": "m2", "feedback_type": "abuse"},
+			}},
+		},
+		{
+			name:     "ses open",
+			provider: "ses",
+			in: snsNotification(`{
+				"eventType": "Open",
+				"open": {"ipAddress": "192.0.2.1", "timestamp": "2017-08-09T22:00:19.652Z"},
+				"mail": {"messageId": "m3", "destination": ["jane@example.com"], ` + sesHeaders + `}
+			}`),
+			out: []Event{{
+				Type: TypeOpen, Email: "jane@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				Meta: map[string]string{"message_id": "m3"},
+			}},
+		},
+		{
+			name:     "ses click",
+			provider: "ses",
+			in: snsNotification(`{
+				"eventType": "Click",
+				"click": {"link": "https://listmonk.app/docs", "linkTags": {"samplekey0": ["samplevalue0"]}},
+				"mail": {"messageId": "m4", "destination": ["jane@example.com"], ` + sesHeaders + `}
+			}`),
+			out: []Event{{
+				Type: TypeClick, Email: "jane@example.com", CampaignUUID: campUUID, SubscriberUUID: subUUID,
+				URL:  "https://listmonk.app/docs",
+				Meta: map[string]string{"message_id": "m4"},
+			}},
+		},
+		{
+			name:     "ses open without destination is skipped",
+			provider: "ses",
+			in:       snsNotification(`{"eventType": "Open", "mail": {"messageId": "m5"}}`),
+		},
+		{
+			name:     "ses delivery is skipped",
+			provider: "ses",
+			in:       snsNotification(`{"notificationType": "Delivery", "mail": {"messageId": "m6", "destination": ["jane@example.com"]}}`),
+		},
+		{
+			name:     "ses unsubscribe confirmation is skipped",
+			provider: "ses",
+			in:       `{"Type": "UnsubscribeConfirmation"}`,
+		},
+		{
+			name:     "ses invalid message",
+			provider: "ses",
+			in:       snsNotification(`{"notificationType": `),
+			err:      true,
+		},
+	}
+
+	for _, c := range cases {
+		p, err := Get(c.provider)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		out, err := p.Parse([]byte(c.in))
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error: %v", c.name, err, c.err)
+			continue
+		}
+		if !reflect.DeepEqual(out, c.out) {
+			t.Errorf("%s: got %+v, want %+v", c.name, out, c.out)
+		}
+	}
+}
+
+func TestParseSESConfirm(t *testing.T) {
+	p, _ := Get("ses")
+	_, err := p.Parse([]byte(`{"Type": "SubscriptionConfirmation", "SubscribeURL": "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription"}`))
+
+	e, ok := err.(*ConfirmError)
+	if !ok {
+		t.Fatalf("got error %v, want a ConfirmError", err)
+	}
+	if e.URL != "https://sns.us-east-1.amazonaws.com/?Action=ConfirmSubscription" {
+		t.Errorf("got URL %q", e.URL)
+	}
+}
+
+func TestGet(t *testing.T) {
+	if _, err := Get("sendgrid"); err == nil {
+		t.Error("got no error for an unknown provider")
+	}
+}
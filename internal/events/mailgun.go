@@ -0,0 +1,74 @@
+package events
+
+import (
+	"encoding/json"
+	"net/textproto"
+	"strconv"
+)
+
+// mailgunHook represents a Mailgun webhook request, which has one event.
+type mailgunHook struct {
+	Data struct {
+		Event     string `json:"event"`
+		Severity  string `json:"severity"`
+		Reason    string `json:"reason"`
+		Recipient string `json:"recipient"`
+		URL       string `json:"url"`
+		ID        string `json:"id"`
+
+		DeliveryStatus struct {
+			Code        int    `json:"code"`
+			Message     string `json:"message"`
+			Description string `json:"description"`
+		} `json:"delivery-status"`
+
+		// Variables set on the message with the X-Mailgun-Variables header.
+		Vars map[string]interface{} `json:"user-variables"`
+	} `json:"event-data"`
+}
+
+// parseMailgun parses Mailgun's failed (bounce), complained, opened, and
+// clicked webhooks.
+func parseMailgun(b []byte) ([]Event, error) {
+	var h mailgunHook
+	if err := json.Unmarshal(b, &h); err != nil {
+		return nil, err
+	}
+
+	d := h.Data
+	e := Event{
+		Email: d.Recipient,
+		Meta:  map[string]string{"id": d.ID},
+	}
+	e.CampaignUUID, _ = d.Vars["campaign"].(string)
+	e.SubscriberUUID, _ = d.Vars["subscriber"].(string)
+
+	switch d.Event {
+	case "failed":
+		e.Type = TypeBounce
+		e.Soft = d.Severity != "permanent"
+		e.Meta["severity"] = d.Severity
+		e.Meta["reason"] = d.Reason
+		e.Meta["code"] = strconv.Itoa(d.DeliveryStatus.Code)
+		e.Meta["message"] = d.DeliveryStatus.Message
+		e.Meta["description"] = d.DeliveryStatus.Description
+	case "complained":
+		e.Type = TypeComplaint
+	case "opened":
+		e.Type = TypeOpen
+	case "clicked":
+		e.Type = TypeClick
+		e.URL = d.URL
+	default:
+		return nil, nil
+	}
+	return []Event{e}, nil
+}
+
+// mailgunHeaders tags messages with Mailgun's user variables header.
+func mailgunHeaders(campUUID, subUUID string) textproto.MIMEHeader {
+	h := tagHeaders(campUUID, subUUID)
+	b, _ := json.Marshal(map[string]string{"campaign": campUUID, "subscriber": subUUID})
+	h.Set("X-Mailgun-Variables", string(b))
+	return h
+}
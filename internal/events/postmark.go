@@ -0,0 +1,83 @@
+package events
+
+import (
+	"encoding/json"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// postmarkRecord represents a Postmark webhook record. Postmark posts
+// one record per request.
+type postmarkRecord struct {
+	RecordType   string            `json:"RecordType"`
+	Type         string            `json:"Type"`
+	TypeCode     int               `json:"TypeCode"`
+	Email        string            `json:"Email"`
+	Recipient    string            `json:"Recipient"`
+	Description  string            `json:"Description"`
+	Details      string            `json:"Details"`
+	Inactive     bool              `json:"Inactive"`
+	MessageID    string            `json:"MessageID"`
+	OriginalLink string            `json:"OriginalLink"`
+	Metadata     map[string]string `json:"Metadata"`
+}
+
+// postmarkHardBounces are the bounce types that are permanent. Postmark
+// also deactivates (Inactive) addresses on them.
+var postmarkHardBounces = map[string]bool{
+	"HardBounce":      true,
+	"BadEmailAddress": true,
+}
+
+// parsePostmark parses Postmark's bounce, spam complaint, open, and
+// click webhooks.
+func parsePostmark(b []byte) ([]Event, error) {
+	var r postmarkRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+
+	// Metadata keys are case-insensitive as they're set via SMTP headers.
+	meta := make(map[string]string, len(r.Metadata))
+	for k, v := range r.Metadata {
+		meta[strings.ToLower(k)] = v
+	}
+	e := Event{
+		CampaignUUID:   meta["campaign"],
+		SubscriberUUID: meta["subscriber"],
+		Meta:           map[string]string{"message_id": r.MessageID},
+	}
+
+	switch r.RecordType {
+	case "Bounce":
+		e.Type = TypeBounce
+		e.Email = r.Email
+		e.Soft = !postmarkHardBounces[r.Type] && !r.Inactive
+		e.Meta["type"] = r.Type
+		e.Meta["code"] = strconv.Itoa(r.TypeCode)
+		e.Meta["description"] = r.Description
+		e.Meta["details"] = r.Details
+	case "SpamComplaint":
+		e.Type = TypeComplaint
+		e.Email = r.Email
+	case "Open":
+		e.Type = TypeOpen
+		e.Email = r.Recipient
+	case "Click":
+		e.Type = TypeClick
+		e.Email = r.Recipient
+		e.URL = r.OriginalLink
+	default:
+		return nil, nil
+	}
+	return []Event{e}, nil
+}
+
+// postmarkHeaders tags messages with Postmark metadata headers.
+func postmarkHeaders(campUUID, subUUID string) textproto.MIMEHeader {
+	h := tagHeaders(campUUID, subUUID)
+	h["X-PM-Metadata-campaign"] = []string{campUUID}
+	h["X-PM-Metadata-subscriber"] = []string{subUUID}
+	return h
+}
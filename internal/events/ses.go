@@ -0,0 +1,137 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"net/textproto"
+)
+
+// snsMessage represents an AWS SNS HTTP(S) delivery that SES
+// notifications are published with.
+type snsMessage struct {
+	Type         string `json:"Type"`
+	Message      string `json:"Message"`
+	SubscribeURL string `json:"SubscribeURL"`
+}
+
+// sesNotification represents an SES notification or, with eventType,
+// an event published with a configuration set.
+type sesNotification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+
+	Bounce struct {
+		BounceType    string `json:"bounceType"`
+		BounceSubType string `json:"bounceSubType"`
+		Recipients    []struct {
+			Email      string `json:"emailAddress"`
+			Action     string `json:"action"`
+			Status     string `json:"status"`
+			Diagnostic string `json:"diagnosticCode"`
+		} `json:"bouncedRecipients"`
+	} `json:"bounce"`
+
+	Complaint struct {
+		FeedbackType string `json:"complaintFeedbackType"`
+		Recipients   []struct {
+			Email string `json:"emailAddress"`
+		} `json:"complainedRecipients"`
+	} `json:"complaint"`
+
+	Click struct {
+		Link string `json:"link"`
+	} `json:"click"`
+
+	Mail struct {
+		MessageID   string   `json:"messageId"`
+		Destination []string `json:"destination"`
+		Headers     []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"headers"`
+	} `json:"mail"`
+}
+
+// parseSES parses SES bounce and complaint notifications and bounce,
+// complaint, open, and click events that are delivered by SNS. Requests to
+// confirm the SNS subscription return a ConfirmError.
+func parseSES(b []byte) ([]Event, error) {
+	var m snsMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	switch m.Type {
+	case "SubscriptionConfirmation":
+		if m.SubscribeURL == "" {
+			return nil, errors.New("SubscribeURL not found")
+		}
+		return nil, &ConfirmError{URL: m.SubscribeURL}
+	case "Notification":
+	default:
+		return nil, nil
+	}
+
+	var n sesNotification
+	if err := json.Unmarshal([]byte(m.Message), &n); err != nil {
+		return nil, err
+	}
+
+	// The tags of the message from its headers, which SES includes
+	// unless it's configured not to.
+	var campUUID, subUUID string
+	for _, h := range n.Mail.Headers {
+		switch textproto.CanonicalMIMEHeaderKey(h.Name) {
+		case HeaderCampaign:
+			campUUID = h.Value
+		case HeaderSubscriber:
+			subUUID = h.Value
+		}
+	}
+	newEvent := func(typ, email string) Event {
+		return Event{
+			Type:           typ,
+			Email:          email,
+			CampaignUUID:   campUUID,
+			SubscriberUUID: subUUID,
+			Meta:           map[string]string{"message_id": n.Mail.MessageID},
+		}
+	}
+
+	typ := n.NotificationType
+	if typ == "" {
+		typ = n.EventType
+	}
+
+	var out []Event
+	switch typ {
+	case "Bounce":
+		for _, r := range n.Bounce.Recipients {
+			e := newEvent(TypeBounce, r.Email)
+			e.Soft = n.Bounce.BounceType != "Permanent"
+			e.Meta["type"] = n.Bounce.BounceType
+			e.Meta["sub_type"] = n.Bounce.BounceSubType
+			e.Meta["status"] = r.Status
+			e.Meta["diagnostic"] = r.Diagnostic
+			out = append(out, e)
+		}
+	case "Complaint":
+		for _, r := range n.Complaint.Recipients {
+			e := newEvent(TypeComplaint, r.Email)
+			e.Meta["feedback_type"] = n.Complaint.FeedbackType
+			out = append(out, e)
+		}
+	case "Open", "Click":
+		// Campaign messages have one recipient.
+		if len(n.Mail.Destination) == 0 {
+			return nil, nil
+		}
+		e := newEvent(TypeOpen, n.Mail.Destination[0])
+		if typ == "Click" {
+			e.Type = TypeClick
+			e.URL = n.Click.Link
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
@@ -0,0 +1,226 @@
+package inbox
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	reLiteral     = regexp.MustCompile(`\{(\d+)\}$`)
+	reUIDValidity = regexp.MustCompile(`(?i)\[UIDVALIDITY (\d+)\]`)
+	reFetchUID    = regexp.MustCompile(`(?i)\bUID (\d+)\b`)
+)
+
+// maxLiteralSize is the maximum size of a literal that's read from the server.
+const maxLiteralSize = 10 * 1024 * 1024
+
+// resp represents an untagged IMAP response line and the literals
+// embedded in it, in order.
+type resp struct {
+	line     string
+	literals [][]byte
+}
+
+// client is a minimal IMAP4rev1 client that supports only the commands
+// required to scan a mailbox.
+type client struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	tag     int
+	timeout time.Duration
+}
+
+// dial connects to an IMAP server and reads its greeting.
+func dial(o Opt) (*client, error) {
+	var (
+		addr   = net.JoinHostPort(o.Host, strconv.Itoa(o.Port))
+		d      = &net.Dialer{Timeout: o.Timeout}
+		conn   net.Conn
+		err    error
+		tlsCfg = &tls.Config{ServerName: o.Host, InsecureSkipVerify: o.TLSSkipVerify}
+	)
+	if o.TLSEnabled {
+		conn, err = tls.DialWithDialer(d, "tcp", addr, tlsCfg)
+	} else {
+		conn, err = d.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{conn: conn, r: bufio.NewReader(conn), timeout: o.Timeout}
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	line, err := c.readLine()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected IMAP greeting: %s", line)
+	}
+	return c, nil
+}
+
+// login authenticates with the server.
+func (c *client) login(username, password string) error {
+	_, err := c.cmd("LOGIN %s %s", quote(username), quote(password))
+	return err
+}
+
+// selectMailbox selects a mailbox and returns its UIDVALIDITY.
+func (c *client) selectMailbox(name string) (uint32, error) {
+	out, err := c.cmd("SELECT %s", quote(name))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, r := range out {
+		if m := reUIDValidity.FindStringSubmatch(r.line); m != nil {
+			v, _ := strconv.ParseUint(m[1], 10, 32)
+			return uint32(v), nil
+		}
+	}
+	return 0, nil
+}
+
+// searchUnseen returns the UIDs of unseen messages with UIDs greater than
+// the given UID.
+func (c *client) searchUnseen(after uint32) ([]uint32, error) {
+	out, err := c.cmd("UID SEARCH UNSEEN UID %d:*", after+1)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []uint32
+	for _, r := range out {
+		if !strings.HasPrefix(strings.ToUpper(r.line), "* SEARCH") {
+			continue
+		}
+		for _, f := range strings.Fields(r.line)[2:] {
+			u, err := strconv.ParseUint(f, 10, 32)
+			if err != nil {
+				continue
+			}
+
+			// n:* always matches the last message even if its UID is < n.
+			if uint32(u) > after {
+				uids = append(uids, uint32(u))
+			}
+		}
+	}
+	return uids, nil
+}
+
+// fetch fetches up to maxSize bytes of the raw message with the given UID
+// without marking it as seen.
+func (c *client) fetch(uid uint32, maxSize int) ([]byte, error) {
+	out, err := c.cmd("UID FETCH %d (UID BODY.PEEK[]<0.%d>)", uid, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range out {
+		m := reFetchUID.FindStringSubmatch(r.line)
+		if m == nil || m[1] != strconv.FormatUint(uint64(uid), 10) || len(r.literals) == 0 {
+			continue
+		}
+		return r.literals[0], nil
+	}
+	return nil, fmt.Errorf("message %d not found", uid)
+}
+
+// markSeen flags a message as seen.
+func (c *client) markSeen(uid uint32) error {
+	_, err := c.cmd(`UID STORE %d +FLAGS.SILENT (\Seen)`, uid)
+	return err
+}
+
+// logout logs out and closes the connection.
+func (c *client) logout() {
+	_, _ = c.cmd("LOGOUT")
+	c.conn.Close()
+}
+
+// cmd sends a tagged command and returns the untagged responses
+// up until its completion.
+func (c *client) cmd(format string, args ...interface{}) ([]resp, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%d", c.tag)
+
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, fmt.Sprintf(format, args...)); err != nil {
+		return nil, err
+	}
+
+	var out []resp
+	for {
+		r, err := c.readResp()
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(r.line, tag+" ") {
+			out = append(out, r)
+			continue
+		}
+
+		status := strings.TrimPrefix(r.line, tag+" ")
+		if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+			// Don't echo the command to not leak credentials in the LOGIN command.
+			return nil, fmt.Errorf("IMAP error: %s", status)
+		}
+		return out, nil
+	}
+}
+
+// readResp reads a response line along with the literals in it.
+func (c *client) readResp() (resp, error) {
+	var r resp
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return r, err
+		}
+
+		m := reLiteral.FindStringSubmatch(line)
+		if m == nil {
+			r.line += line
+			return r, nil
+		}
+
+		// The line has a literal of n bytes followed by the rest of the line.
+		n, _ := strconv.Atoi(m[1])
+		if n > maxLiteralSize {
+			return r, errors.New("IMAP literal is too big")
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(c.r, b); err != nil {
+			return r, err
+		}
+		r.line += line
+		r.literals = append(r.literals, b)
+	}
+}
+
+// readLine reads a CRLF terminated line.
+func (c *client) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// quote returns an IMAP quoted string.
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,371 @@
+// Package inbox periodically scans an IMAP mailbox for new messages and
+// passes them to a handler. Messages that the handler processes are marked
+// as seen and the ones it skips are left untouched.
+package inbox
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/jaytaylor/html2text"
+)
+
+const (
+	// maxMessageSize is the number of bytes of a message that are fetched.
+	// Replies are parsed only for the intent in the first few lines.
+	maxMessageSize = 64 * 1024
+
+	// maxScanMessages is the maximum number of messages processed in
+	// a single scan.
+	maxScanMessages = 500
+)
+
+// Opt represents the inbox options.
+type Opt struct {
+	Host          string        `koanf:"host"`
+	Port          int           `koanf:"port"`
+	TLSEnabled    bool          `koanf:"tls_enabled"`
+	TLSSkipVerify bool          `koanf:"tls_skip_verify"`
+	Username      string        `koanf:"username"`
+	Password      string        `koanf:"password"`
+	Mailbox       string        `koanf:"mailbox"`
+	ScanInterval  time.Duration `koanf:"scan_interval"`
+	Timeout       time.Duration `koanf:"timeout"`
+}
+
+// Message represents a parsed inbound message.
+type Message struct {
+	UID       uint32
+	MessageID string
+	From      string
+	Subject   string
+	Body      string
+
+	// Recipients are the addresses the message was delivered to from the
+	// Delivered-To, X-Original-To, and To headers, in that order.
+	Recipients []string
+
+	// DSN is set if the message is a delivery status notification
+	// (bounce) report.
+	DSN *DSN
+}
+
+// DSN represents the per-recipient fields of a delivery status
+// notification (RFC 3464).
+type DSN struct {
+	Recipient  string `json:"recipient"`
+	Action     string `json:"action"`
+	Status     string `json:"status"`
+	Diagnostic string `json:"diagnostic"`
+}
+
+// recipientHeaders are the headers that carry the delivery addresses of
+// a message in the order of preference.
+var recipientHeaders = []string{"Delivered-To", "X-Original-To", "To"}
+
+// Handler processes an inbound message and returns true if the message
+// was processed. Processed messages are marked as seen.
+type Handler func(m Message) (bool, error)
+
+// Inbox scans a mailbox.
+type Inbox struct {
+	opt Opt
+	h   Handler
+	log *log.Logger
+
+	// UIDs of messages upto lastUID have been scanned in the mailbox
+	// with the UIDVALIDITY uidValidity.
+	lastUID     uint32
+	uidValidity uint32
+}
+
+// New returns a new instance of Inbox.
+func New(o Opt, h Handler, l *log.Logger) (*Inbox, error) {
+	if o.Host == "" || o.Port < 1 {
+		return nil, errors.New("invalid host or port")
+	}
+	if o.Mailbox == "" {
+		o.Mailbox = "INBOX"
+	}
+	if o.ScanInterval < time.Minute {
+		o.ScanInterval = time.Minute
+	}
+	if o.Timeout < time.Second {
+		o.Timeout = time.Second * 30
+	}
+
+	return &Inbox{opt: o, h: h, log: l}, nil
+}
+
+// Run is a blocking function (that should be invoked as a goroutine)
+// that scans the mailbox at the configured interval.
+func (ib *Inbox) Run() {
+	for {
+		if err := ib.scan(); err != nil {
+			ib.log.Printf("error scanning inbox %s@%s: %v", ib.opt.Username, ib.opt.Host, err)
+		}
+		time.Sleep(ib.opt.ScanInterval)
+	}
+}
+
+// scan fetches the unseen messages since the last scan and passes them
+// to the handler.
+func (ib *Inbox) scan() error {
+	c, err := dial(ib.opt)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+
+	if err := c.login(ib.opt.Username, ib.opt.Password); err != nil {
+		return err
+	}
+
+	v, err := c.selectMailbox(ib.opt.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	// UIDs are only valid for a given UIDVALIDITY. Start over if it's changed.
+	if v != ib.uidValidity {
+		ib.uidValidity = v
+		ib.lastUID = 0
+	}
+
+	uids, err := c.searchUnseen(ib.lastUID)
+	if err != nil {
+		return err
+	}
+	if len(uids) > maxScanMessages {
+		uids = uids[:maxScanMessages]
+	}
+
+	for _, uid := range uids {
+		ib.lastUID = uid
+
+		b, err := c.fetch(uid, maxMessageSize)
+		if err != nil {
+			return err
+		}
+
+		m, err := parseMessage(b)
+		if err != nil {
+			ib.log.Printf("error parsing inbound message %d: %v", uid, err)
+			continue
+		}
+		m.UID = uid
+
+		ok, err := ib.h(m)
+		if err != nil {
+			ib.log.Printf("error processing inbound message %d from %s: %v", uid, m.From, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+
+		if err := c.markSeen(uid); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseMessage parses a raw message and extracts its sender, subject,
+// and text body.
+func parseMessage(b []byte) (Message, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(b))
+	if err != nil {
+		return Message{}, err
+	}
+
+	// Bounces from mailer daemons may have an empty From.
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		if !isReport(msg.Header.Get("Content-Type")) {
+			return Message{}, fmt.Errorf("invalid From: %v", err)
+		}
+		from = &mail.Address{}
+	}
+
+	msgID := strings.Trim(strings.TrimSpace(msg.Header.Get("Message-Id")), "<>")
+
+	var rcpts []string
+	for _, h := range recipientHeaders {
+		for _, v := range msg.Header[h] {
+			addrs, err := mail.ParseAddressList(v)
+			if err != nil {
+				continue
+			}
+			for _, a := range addrs {
+				rcpts = append(rcpts, strings.ToLower(a.Address))
+			}
+		}
+	}
+
+	// Delivery status reports.
+	if isReport(msg.Header.Get("Content-Type")) {
+		dsn, err := readDSN(msg.Header.Get("Content-Type"), msg.Body)
+		if err != nil {
+			return Message{}, err
+		}
+		return Message{
+			MessageID:  msgID,
+			From:       strings.ToLower(from.Address),
+			Subject:    msg.Header.Get("Subject"),
+			Recipients: rcpts,
+			DSN:        &dsn,
+		}, nil
+	}
+
+	var dec mime.WordDecoder
+	subject, err := dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+
+	body, err := readText(msg.Header.Get("Content-Type"),
+		msg.Header.Get("Content-Transfer-Encoding"), msg.Body, 0)
+	if err != nil {
+		return Message{}, err
+	}
+
+	return Message{
+		MessageID:  msgID,
+		From:       strings.ToLower(from.Address),
+		Subject:    subject,
+		Body:       body,
+		Recipients: rcpts,
+	}, nil
+}
+
+// isReport checks whether a content type is that of a delivery status report.
+func isReport(contentType string) bool {
+	mType, params, err := mime.ParseMediaType(contentType)
+	return err == nil && mType == "multipart/report" &&
+		strings.EqualFold(params["report-type"], "delivery-status")
+}
+
+// readDSN reads the fields of the first recipient in the
+// message/delivery-status part of a delivery status report.
+func readDSN(contentType string, r io.Reader) (DSN, error) {
+	_, params, _ := mime.ParseMediaType(contentType)
+
+	mr := multipart.NewReader(r, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			return DSN{}, errors.New("delivery-status not found in report")
+		}
+
+		pType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+		if pType != "message/delivery-status" {
+			continue
+		}
+
+		// The per-message fields are followed by the per-recipient fields,
+		// both of which are header blocks.
+		tr := textproto.NewReader(bufio.NewReader(p))
+		if _, err := tr.ReadMIMEHeader(); err != nil && err != io.EOF {
+			return DSN{}, err
+		}
+		h, err := tr.ReadMIMEHeader()
+		if err != nil && err != io.EOF {
+			return DSN{}, err
+		}
+
+		return DSN{
+			Recipient:  dsnValue(h.Get("Final-Recipient")),
+			Action:     strings.ToLower(h.Get("Action")),
+			Status:     h.Get("Status"),
+			Diagnostic: dsnValue(h.Get("Diagnostic-Code")),
+		}, nil
+	}
+}
+
+// dsnValue strips the type from a typed DSN field,
+// eg: rfc822; user@site.com => user@site.com
+func dsnValue(v string) string {
+	if i := strings.Index(v, ";"); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// readText returns the text body of a message part. For multipart messages,
+// the first text/plain part is preferred over the first text/html part.
+// As messages are fetched partially, errors from truncated parts are ignored.
+func readText(contentType, encoding string, r io.Reader, depth int) (string, error) {
+	mType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mType = "text/plain"
+	}
+
+	if strings.HasPrefix(mType, "multipart/") {
+		if depth > 3 {
+			return "", nil
+		}
+
+		var (
+			mr   = multipart.NewReader(r, params["boundary"])
+			html string
+		)
+		for {
+			p, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+
+			t, err := readText(p.Header.Get("Content-Type"),
+				p.Header.Get("Content-Transfer-Encoding"), p, depth+1)
+			if err != nil || t == "" {
+				continue
+			}
+
+			pType, _, _ := mime.ParseMediaType(p.Header.Get("Content-Type"))
+			if pType == "text/html" {
+				if html == "" {
+					html = t
+				}
+				continue
+			}
+			return t, nil
+		}
+		return html, nil
+	}
+
+	if mType != "text/plain" && mType != "text/html" {
+		return "", nil
+	}
+
+	switch strings.ToLower(encoding) {
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	}
+
+	b, _ := ioutil.ReadAll(r)
+	if mType == "text/html" {
+		t, err := html2text.FromString(string(b), html2text.Options{})
+		if err != nil {
+			return "", err
+		}
+		return t, nil
+	}
+	return string(b), nil
+}
@@ -0,0 +1,374 @@
+// Package jobs runs long-running operations (eg: imports) as background jobs.
+// Jobs are queued and persisted in a Store with their progress so that they
+// can be inspected and cancelled across requests. Jobs of a type run one at
+// a time in the order they're queued. Jobs that were running when the app
+// stopped are resumed on startup if their type is resumable and are marked
+// as interrupted otherwise.
+package jobs
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// Job statuses.
+const (
+	StatusQueued      = "queued"
+	StatusRunning     = "running"
+	StatusFinished    = "finished"
+	StatusFailed      = "failed"
+	StatusCancelled   = "cancelled"
+	StatusInterrupted = "interrupted"
+)
+
+const (
+	// flushInterval is the interval at which the progress of running
+	// jobs is persisted and their cancellation is checked.
+	flushInterval = time.Second * 2
+
+	// pollInterval is the interval at which the store is scanned for
+	// queued jobs in addition to the jobs queued with Enqueue.
+	pollInterval = time.Second * 30
+)
+
+// ErrCancelled is returned by handlers that stop on a cancellation.
+var ErrCancelled = errors.New("job cancelled")
+
+// Job represents a job.
+type Job struct {
+	ID         int64          `db:"id" json:"id"`
+	Type       string         `db:"type" json:"type"`
+	Status     string         `db:"status" json:"status"`
+	Params     types.JSONText `db:"params" json:"params"`
+	State      types.JSONText `db:"state" json:"-"`
+	Result     types.JSONText `db:"result" json:"result"`
+	Total      int            `db:"total" json:"total"`
+	Done       int            `db:"done" json:"done"`
+	Error      string         `db:"error" json:"error"`
+	Cancel     bool           `db:"cancel" json:"cancel"`
+	CreatedAt  null.Time      `db:"created_at" json:"created_at"`
+	StartedAt  null.Time      `db:"started_at" json:"started_at"`
+	UpdatedAt  null.Time      `db:"updated_at" json:"updated_at"`
+	FinishedAt null.Time      `db:"finished_at" json:"finished_at"`
+
+	// Rate is the throughput of the job in done per second. It's only
+	// set by the queries that fetch jobs to be inspected.
+	Rate float64 `db:"rate" json:"rate"`
+
+	// Pseudofield for getting the total number of jobs in queries.
+	TotalRows int `db:"total_rows" json:"-"`
+}
+
+// Store represents the data store that jobs are persisted in.
+type Store interface {
+	CreateJob(typ string, params []byte) (int64, error)
+
+	// ClaimJob marks the oldest queued job of a type as running and
+	// returns it, or sql.ErrNoRows if there are none.
+	ClaimJob(typ string) (Job, error)
+
+	// UpdateJobProgress records the progress of a running job and
+	// returns whether its cancellation has been requested. A nil
+	// state retains the last one.
+	UpdateJobProgress(id int64, total, done int, state []byte) (bool, error)
+
+	// FinishJob records the final status of a job and the result
+	// that it set, which may be nil.
+	FinishJob(id int64, status, errMsg string, total, done int, result []byte) error
+
+	// RecoverJobs requeues the running jobs of the given types and marks
+	// the rest as interrupted.
+	RecoverJobs(resumable []string) error
+}
+
+// Handler runs a job. It should periodically record its progress and state
+// on the Ctx and return ErrCancelled when the Ctx is cancelled.
+type Handler func(c *Ctx) error
+
+// Type represents a registered job type.
+type Type struct {
+	Name    string
+	Handler Handler
+
+	// Resumable job types are requeued after a restart and their handlers
+	// get the last state they saved.
+	Resumable bool
+}
+
+// Runner runs jobs of registered types.
+type Runner struct {
+	store Store
+	log   *log.Logger
+
+	types  map[string]Type
+	notify map[string]chan bool
+
+	// Contexts of running jobs by ID.
+	running map[int64]*Ctx
+	sync.Mutex
+}
+
+// Ctx is passed to job handlers. It carries the job, records its progress,
+// and is cancelled when the job's cancellation is requested.
+type Ctx struct {
+	context.Context
+	Job Job
+
+	cancel context.CancelFunc
+	total  int
+	done   int
+	state  []byte
+	result []byte
+	mut    sync.Mutex
+}
+
+// New returns a new instance of Runner.
+func New(s Store, l *log.Logger) *Runner {
+	return &Runner{
+		store:   s,
+		log:     l,
+		types:   make(map[string]Type),
+		notify:  make(map[string]chan bool),
+		running: make(map[int64]*Ctx),
+	}
+}
+
+// Register registers a job type. It should be called before Run.
+func (r *Runner) Register(t Type) {
+	r.types[t.Name] = t
+	r.notify[t.Name] = make(chan bool, 1)
+}
+
+// Enqueue queues a job of a registered type with the given params
+// (that are JSON marshalled) and returns its ID.
+func (r *Runner) Enqueue(typ string, params interface{}) (int64, error) {
+	if _, ok := r.types[typ]; !ok {
+		return 0, fmt.Errorf("unknown job type '%s'", typ)
+	}
+
+	b, err := json.Marshal(params)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := r.store.CreateJob(typ, b)
+	if err != nil {
+		return 0, err
+	}
+
+	select {
+	case r.notify[typ] <- true:
+	default:
+	}
+	return id, nil
+}
+
+// Cancel cancels a running job right away if it's running on this instance.
+// The cancellation of jobs (including queued ones) should be recorded in the
+// Store, which running jobs check periodically.
+func (r *Runner) Cancel(id int64) {
+	r.Lock()
+	c, ok := r.running[id]
+	r.Unlock()
+	if ok {
+		c.cancel()
+	}
+}
+
+// Run is a blocking function (that should be invoked as a goroutine) that
+// recovers the jobs interrupted by a restart and runs queued jobs.
+func (r *Runner) Run() {
+	var resumable []string
+	for name, t := range r.types {
+		if t.Resumable {
+			resumable = append(resumable, name)
+		}
+	}
+	if err := r.store.RecoverJobs(resumable); err != nil {
+		r.log.Printf("error recovering jobs: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for name := range r.types {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			r.worker(name)
+		}(name)
+	}
+	wg.Wait()
+}
+
+// worker runs the queued jobs of a type one at a time.
+func (r *Runner) worker(typ string) {
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+
+	for {
+		j, err := r.store.ClaimJob(typ)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				r.log.Printf("error fetching %s jobs: %v", typ, err)
+			}
+
+			select {
+			case <-r.notify[typ]:
+			case <-t.C:
+			}
+			continue
+		}
+
+		r.run(j)
+	}
+}
+
+// run runs a job and records its result.
+func (r *Runner) run(j Job) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &Ctx{Context: ctx, Job: j, cancel: cancel, total: j.Total, done: j.Done}
+	defer cancel()
+
+	r.Lock()
+	r.running[j.ID] = c
+	r.Unlock()
+
+	// Persist the progress periodically and check for cancellation.
+	stop := make(chan bool)
+	go func() {
+		t := time.NewTicker(flushInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if r.flush(c) {
+					c.cancel()
+				}
+			}
+		}
+	}()
+
+	r.log.Printf("running %s job %d", j.Type, j.ID)
+	err := r.exec(c)
+	close(stop)
+
+	r.Lock()
+	delete(r.running, j.ID)
+	r.Unlock()
+
+	var (
+		status = StatusFinished
+		errMsg = ""
+	)
+	if err != nil {
+		if err == ErrCancelled || c.Err() != nil {
+			status = StatusCancelled
+		} else {
+			status = StatusFailed
+			errMsg = err.Error()
+		}
+	}
+
+	c.mut.Lock()
+	total, done, result := c.total, c.done, c.result
+	c.mut.Unlock()
+	if err := r.store.FinishJob(j.ID, status, errMsg, total, done, result); err != nil {
+		r.log.Printf("error updating %s job %d: %v", j.Type, j.ID, err)
+	}
+	r.log.Printf("%s job %d %s", j.Type, j.ID, status)
+}
+
+// exec runs a job's handler and recovers from panics in it.
+func (r *Runner) exec(c *Ctx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("job panicked: %v", p)
+		}
+	}()
+	return r.types[c.Job.Type].Handler(c)
+}
+
+// flush persists the progress of a running job and returns whether
+// its cancellation has been requested.
+func (r *Runner) flush(c *Ctx) bool {
+	c.mut.Lock()
+	total, done, state := c.total, c.done, c.state
+	c.state = nil
+	c.mut.Unlock()
+
+	cancel, err := r.store.UpdateJobProgress(c.Job.ID, total, done, state)
+	if err != nil {
+		r.log.Printf("error updating %s job %d: %v", c.Job.Type, c.Job.ID, err)
+		return false
+	}
+	return cancel
+}
+
+// Params unmarshals the job's params into v.
+func (c *Ctx) Params(v interface{}) error {
+	return json.Unmarshal(c.Job.Params, v)
+}
+
+// State unmarshals the last state the job saved before it was interrupted
+// into v. It returns false if there's no saved state.
+func (c *Ctx) State(v interface{}) (bool, error) {
+	if len(c.Job.State) == 0 || string(c.Job.State) == "null" {
+		return false, nil
+	}
+	if err := json.Unmarshal(c.Job.State, v); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// SetProgress sets the total number of items the job has to process and the
+// number of items it has processed.
+func (c *Ctx) SetProgress(total, done int) {
+	c.mut.Lock()
+	c.total = total
+	c.done = done
+	c.mut.Unlock()
+}
+
+// SaveState saves the state (that's JSON marshalled) that the job should be
+// resumed from if it's interrupted. It's persisted along with the progress.
+func (c *Ctx) SaveState(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mut.Lock()
+	c.state = b
+	c.mut.Unlock()
+	return nil
+}
+
+// SetResult sets the result (that's JSON marshalled) of the job, eg: a report,
+// that's recorded when the job finishes.
+func (c *Ctx) SetResult(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	c.mut.Lock()
+	c.result = b
+	c.mut.Unlock()
+	return nil
+}
+
+// Cancelled checks whether the job's cancellation has been requested.
+func (c *Ctx) Cancelled() bool {
+	return c.Err() != nil
+}
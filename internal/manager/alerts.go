@@ -0,0 +1,164 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// Reasons for send failure alerts.
+const (
+	AlertErrorRate         = "error_rate"
+	AlertConsecutiveErrors = "consecutive_errors"
+)
+
+// AlertConfig has the thresholds for send failure alerts.
+type AlertConfig struct {
+	// ErrorRate is the percentage of failed messages among the last Window
+	// messages of a campaign that triggers an alert. 0 disables it.
+	ErrorRate float64
+	Window    int
+
+	// ConsecutiveErrors is the number of consecutive failed messages of
+	// a campaign that triggers an alert. 0 disables it.
+	ConsecutiveErrors int
+
+	// Cooldown is the minimum interval between two alerts of a campaign.
+	Cooldown time.Duration
+
+	// Samples is the number of recent error messages sent with an alert.
+	Samples int
+}
+
+// SendAlert represents an alert that's raised when the send failures of
+// a campaign cross one of the thresholds.
+type SendAlert struct {
+	CampaignID   int    `json:"campaign_id"`
+	CampaignUUID string `json:"campaign_uuid"`
+	CampaignName string `json:"campaign_name"`
+	Reason       string `json:"reason"`
+
+	// Counts of the messages in the window.
+	Window    int     `json:"window"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+
+	ConsecutiveErrors int       `json:"consecutive_errors"`
+	Samples           []string  `json:"samples"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// AlertCallback is the callback that's invoked with send failure alerts.
+type AlertCallback func(a SendAlert)
+
+// alertState holds the recent send results of a campaign.
+type alertState struct {
+	// Ring buffer of the results (true = failed) of the last n messages.
+	results []bool
+	pos     int
+	n       int
+	errors  int
+
+	consecutive int
+	samples     []string
+
+	// firing is set when a threshold is crossed and is reset when the
+	// failures fall back below the thresholds.
+	firing    bool
+	lastFired time.Time
+}
+
+// alerts tracks the send results of campaigns being processed.
+type alerts struct {
+	camps map[int]*alertState
+	sync.Mutex
+}
+
+// recordAlert records the result of a campaign message and raises an alert
+// if it makes the campaign's failures cross one of the thresholds. Alerts
+// are raised once per crossing and not more often than the cooldown.
+func (m *Manager) recordAlert(c *models.Campaign, sendErr error) {
+	cfg := m.cfg.Alerts
+	if m.cfg.AlertCB == nil || (cfg.ErrorRate <= 0 && cfg.ConsecutiveErrors < 1) {
+		return
+	}
+
+	m.alerts.Lock()
+	st, ok := m.alerts.camps[c.ID]
+	if !ok {
+		st = &alertState{results: make([]bool, cfg.Window)}
+		m.alerts.camps[c.ID] = st
+	}
+
+	// Slide the window.
+	failed := sendErr != nil
+	if st.n == len(st.results) {
+		if st.results[st.pos] {
+			st.errors--
+		}
+	} else {
+		st.n++
+	}
+	st.results[st.pos] = failed
+	st.pos = (st.pos + 1) % len(st.results)
+
+	if failed {
+		st.errors++
+		st.consecutive++
+		st.samples = append(st.samples, sendErr.Error())
+		if len(st.samples) > cfg.Samples {
+			st.samples = st.samples[len(st.samples)-cfg.Samples:]
+		}
+	} else {
+		st.consecutive = 0
+	}
+
+	// The error rate is only evaluated on a full window.
+	var (
+		rate   = float64(st.errors) / float64(st.n) * 100
+		reason = ""
+	)
+	if cfg.ConsecutiveErrors > 0 && st.consecutive >= cfg.ConsecutiveErrors {
+		reason = AlertConsecutiveErrors
+	} else if cfg.ErrorRate > 0 && st.n == len(st.results) && rate >= cfg.ErrorRate {
+		reason = AlertErrorRate
+	}
+
+	if reason == "" {
+		st.firing = false
+		m.alerts.Unlock()
+		return
+	}
+	if st.firing || time.Since(st.lastFired) < cfg.Cooldown {
+		m.alerts.Unlock()
+		return
+	}
+	st.firing = true
+	st.lastFired = time.Now()
+
+	a := SendAlert{
+		CampaignID:        c.ID,
+		CampaignUUID:      c.UUID,
+		CampaignName:      c.Name,
+		Reason:            reason,
+		Window:            st.n,
+		Errors:            st.errors,
+		ErrorRate:         rate,
+		ConsecutiveErrors: st.consecutive,
+		Samples:           append([]string{}, st.samples...),
+		Timestamp:         st.lastFired,
+	}
+	m.alerts.Unlock()
+
+	// Don't hold up the message worker.
+	go m.cfg.AlertCB(a)
+}
+
+// endAlerts clears the send results of a campaign that has
+// stopped processing.
+func (m *Manager) endAlerts(campID int) {
+	m.alerts.Lock()
+	delete(m.alerts.camps, campID)
+	m.alerts.Unlock()
+}
@@ -0,0 +1,170 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// checkpointQueueSize is the number of batches whose checkpoints can be
+	// queued to be dropped before the message workers wait.
+	checkpointQueueSize = 1000
+
+	// checkpointRetryInterval is the interval at which the checkpoints that
+	// couldn't be dropped, eg: because their deliveries couldn't be recorded,
+	// are retried.
+	checkpointRetryInterval = time.Second * 5
+)
+
+// campBatch is a batch of subscribers of a campaign whose messages are
+// being pushed.
+type campBatch struct {
+	campID int
+
+	// The messages of the batch that are yet to be pushed.
+	pending int
+}
+
+// checkpoints has the batches of the running campaigns, oldest first. Every
+// batch has a checkpoint in the data source (the position before it) that's
+// dropped once its messages and those of the batches before it have been
+// pushed and recorded. A campaign that's picked up after a restart is
+// rewound to its oldest checkpoint.
+type checkpoints struct {
+	camps map[int][]*campBatch
+
+	// The campaigns that have been picked up since the manager started.
+	seen map[int]bool
+
+	sync.Mutex
+}
+
+// resumeCampaign rewinds a running campaign that's picked up for the first
+// time since the manager started to the oldest checkpoint that it was left
+// with, if any, eg: by a crash in the middle of a batch.
+func (m *Manager) resumeCampaign(c *models.Campaign) {
+	m.checkpoints.Lock()
+	seen := m.checkpoints.seen[c.ID]
+	m.checkpoints.seen[c.ID] = true
+	m.checkpoints.Unlock()
+	if seen {
+		return
+	}
+
+	sent, ok, err := m.src.ResumeCampaign(c.ID)
+	if err != nil {
+		m.logger.Printf("error resuming campaign (%s) from its checkpoint: %v", c.Name, err)
+		return
+	}
+	if ok {
+		c.Sent = sent
+		m.logger.Printf("resuming campaign (%s) from its last checkpoint", c.Name)
+	}
+}
+
+// newBatch starts tracking a batch of subscribers of a campaign. It holds
+// an extra message that's finished once all its messages have been queued.
+func (m *Manager) newBatch(campID int) *campBatch {
+	b := &campBatch{campID: campID, pending: 1}
+
+	m.checkpoints.Lock()
+	m.checkpoints.camps[campID] = append(m.checkpoints.camps[campID], b)
+	m.checkpoints.Unlock()
+	return b
+}
+
+// addBatchMessage adds a message that's being queued to a batch.
+func (m *Manager) addBatchMessage(b *campBatch) {
+	m.checkpoints.Lock()
+	b.pending++
+	m.checkpoints.Unlock()
+}
+
+// finishBatchMessage finishes a message of a batch and queues the
+// checkpoints of the oldest batches of its campaign that are done to be
+// dropped.
+func (m *Manager) finishBatchMessage(b *campBatch) {
+	if b == nil {
+		return
+	}
+
+	m.checkpoints.Lock()
+	b.pending--
+
+	var (
+		bs = m.checkpoints.camps[b.campID]
+		n  = 0
+	)
+	for len(bs) > 0 && bs[0].pending == 0 {
+		bs = bs[1:]
+		n++
+	}
+	if len(bs) == 0 {
+		delete(m.checkpoints.camps, b.campID)
+	} else {
+		m.checkpoints.camps[b.campID] = bs
+	}
+	m.checkpoints.Unlock()
+
+	for i := 0; i < n; i++ {
+		m.checkpointQueue <- b.campID
+	}
+}
+
+// dropCheckpoints is a blocking function that drops the checkpoints of the
+// batches that are done. The queued deliveries and failures are recorded
+// first so that their subscribers are skipped if the campaign is rewound to
+// a later checkpoint. Checkpoints are kept, and retried, until their
+// deliveries have been recorded and they've been dropped.
+func (m *Manager) dropCheckpoints() {
+	var (
+		ids   []int
+		retry <-chan time.Time
+	)
+	for {
+		select {
+		case id := <-m.checkpointQueue:
+			ids = append(ids, id)
+			for len(m.checkpointQueue) > 0 {
+				ids = append(ids, <-m.checkpointQueue)
+			}
+			if retry != nil {
+				continue
+			}
+		case <-retry:
+		}
+		retry = nil
+
+		if err := m.flushRecords(); err != nil {
+			m.logger.Printf("error recording deliveries. not dropping %d checkpoints: %v", len(ids), err)
+			retry = time.After(checkpointRetryInterval)
+			continue
+		}
+
+		var failed []int
+		for _, id := range ids {
+			if err := m.src.CheckpointCampaign(id); err != nil {
+				m.logger.Printf("error checkpointing campaign %d: %v", id, err)
+				failed = append(failed, id)
+			}
+		}
+		ids = failed
+		if len(ids) > 0 {
+			retry = time.After(checkpointRetryInterval)
+		}
+	}
+}
+
+// flushRecords records the queued failures and deliveries right away and
+// returns the error of recording the deliveries, if any.
+func (m *Manager) flushRecords() error {
+	flushed := make(chan bool)
+	m.failFlushReq <- flushed
+	<-flushed
+
+	res := make(chan error, 1)
+	m.delivFlushReq <- res
+	return <-res
+}
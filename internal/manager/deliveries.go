@@ -0,0 +1,82 @@
+package manager
+
+import (
+	"time"
+)
+
+// delivQueueSize is the number of deliveries that can be queued before
+// they're recorded. The message workers wait when the queue is full, eg:
+// while a batch of deliveries that failed to be recorded is retried, as
+// deliveries that aren't recorded would be sent again.
+const delivQueueSize = 10000
+
+// Delivery represents a campaign message that was pushed to a subscriber.
+// Campaigns that don't allow resends skip the subscribers they've been
+// delivered to, eg: when they're started again or resumed, and all campaigns
+// skip them when they're rewound to a checkpoint.
+type Delivery struct {
+	CampaignID   int
+	SubscriberID int
+}
+
+// recordDelivery queues the delivery of a campaign message to be recorded,
+// waiting if the queue is full.
+func (m *Manager) recordDelivery(campID, subID int) {
+	m.delivQueue <- Delivery{CampaignID: campID, SubscriberID: subID}
+}
+
+// flushDeliveries is a blocking function that records queued deliveries in
+// batches at the given interval or when they're requested on delivFlushReq.
+// A batch that fails to be recorded is retried at the interval, and no more
+// deliveries are received until it's recorded.
+func (m *Manager) flushDeliveries(interval time.Duration) {
+	var (
+		t      = time.NewTicker(interval)
+		batch  = make([]Delivery, 0, failFlushSize)
+		failed bool
+	)
+	defer t.Stop()
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := m.src.RecordDeliveries(batch); err != nil {
+			m.logger.Printf("error recording %d campaign deliveries. retrying: %v", len(batch), err)
+			failed = true
+			return err
+		}
+		failed = false
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		queue := m.delivQueue
+		if failed {
+			queue = nil
+		}
+
+		select {
+		case d := <-queue:
+			batch = append(batch, d)
+			if len(batch) >= failFlushSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case res := <-m.delivFlushReq:
+			err := flush()
+			for err == nil && len(m.delivQueue) > 0 {
+				batch = append(batch, <-m.delivQueue)
+				if len(batch) >= failFlushSize {
+					err = flush()
+				}
+			}
+			if err == nil {
+				err = flush()
+			}
+			res <- err
+		}
+	}
+}
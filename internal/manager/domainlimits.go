@@ -0,0 +1,208 @@
+package manager
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// DomainLimit is the rate limit and the concurrency cap of the campaign
+// messages to the recipients of a group of domains, eg: at most 50 messages
+// a minute and 5 at a time to gmail.com and googlemail.com. The domains of a
+// group share its limits.
+type DomainLimit struct {
+	Domains []string
+
+	// Rate is the maximum number of messages that are pushed in any
+	// sliding Window (a minute by default). 0 is unlimited.
+	Rate   int
+	Window time.Duration
+
+	// Concurrency is the maximum number of messages that are pushed at
+	// the same time. 0 is unlimited.
+	Concurrency int
+}
+
+// domainLimiter limits the campaign messages to the domains of a DomainLimit.
+type domainLimiter struct {
+	rate   int
+	window time.Duration
+
+	// The times of the pushes in the last window, oldest first.
+	sent []time.Time
+	mut  sync.Mutex
+
+	// sem has a slot for each of the messages that can be pushed at the
+	// same time. It's nil when they're unlimited.
+	sem chan struct{}
+
+	// Campaign messages that are deferred until there's room in the limits,
+	// oldest first, and whether they're being re-queued.
+	deferred  []CampaignMessage
+	requeuing bool
+	deferMut  sync.Mutex
+}
+
+// newDomainLimiters returns the limiters of the domains of the limits.
+func newDomainLimiters(limits []DomainLimit) map[string]*domainLimiter {
+	out := make(map[string]*domainLimiter)
+	for _, d := range limits {
+		l := &domainLimiter{rate: d.Rate, window: d.Window}
+		if l.window <= 0 {
+			l.window = time.Minute
+		}
+		if d.Concurrency > 0 {
+			l.sem = make(chan struct{}, d.Concurrency)
+		}
+		for _, dom := range d.Domains {
+			out[strings.ToLower(dom)] = l
+		}
+	}
+	return out
+}
+
+// limitDomain checks, without waiting, whether a campaign message can be
+// pushed within the limits of its recipient's domain, if it has any. If it
+// can, it returns the function that's called once the message has been
+// pushed. If it can't, the message is deferred and put back on the campaign
+// message queue once there's room for it, and the message workers move on.
+// The messages of simulated campaigns are limited separately.
+func (m *Manager) limitDomain(msg CampaignMessage) (func(), bool) {
+	// Deferred messages have room reserved for them when they're re-queued.
+	if msg.limitDone != nil {
+		return msg.limitDone, true
+	}
+
+	limits := m.domainLimits
+	if msg.Campaign.Simulate {
+		limits = m.simDomainLimits
+	}
+	l, ok := limits[recipientDomain(msg.to)]
+	if !ok {
+		return func() {}, true
+	}
+
+	l.deferMut.Lock()
+	defer l.deferMut.Unlock()
+
+	// Messages that are deferred go first.
+	if len(l.deferred) == 0 {
+		if done, ok := l.tryAcquire(); ok {
+			return done, true
+		}
+	}
+
+	l.deferred = append(l.deferred, msg)
+	if !l.requeuing {
+		l.requeuing = true
+		go m.requeueDeferred(l)
+	}
+	return nil, false
+}
+
+// waitDomain waits until a campaign message to an address can be pushed
+// within the limits of its domain, if it has any, for messages that aren't
+// pushed by the message workers. It returns the function that's called once
+// the message has been pushed.
+func (m *Manager) waitDomain(addr string) func() {
+	l, ok := m.domainLimits[recipientDomain(addr)]
+	if !ok {
+		return func() {}
+	}
+	return l.acquire()
+}
+
+// requeueDeferred is a blocking function that puts the deferred messages
+// of a domain back on the campaign message queue one at a time, as room is
+// made for them in its limits, until there are none.
+func (m *Manager) requeueDeferred(l *domainLimiter) {
+	for {
+		l.deferMut.Lock()
+		if len(l.deferred) == 0 {
+			l.requeuing = false
+			l.deferMut.Unlock()
+			return
+		}
+		msg := l.deferred[0]
+		l.deferred = l.deferred[1:]
+		l.deferMut.Unlock()
+
+		msg.limitDone = l.acquire()
+		m.campMsgQueue <- msg
+	}
+}
+
+// acquire waits until a message can be pushed within the limits and
+// returns the function that's called once it's been pushed.
+func (l *domainLimiter) acquire() func() {
+	if l.sem != nil {
+		l.sem <- struct{}{}
+	}
+	for {
+		d := l.reserve()
+		if d == 0 {
+			break
+		}
+		time.Sleep(d)
+	}
+	return l.release
+}
+
+// tryAcquire checks, without waiting, whether a message can be pushed
+// within the limits. If it can, it returns the function that's called once
+// it's been pushed.
+func (l *domainLimiter) tryAcquire() (func(), bool) {
+	if l.sem != nil {
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			return nil, false
+		}
+	}
+	if l.reserve() > 0 {
+		l.release()
+		return nil, false
+	}
+	return l.release, true
+}
+
+// release frees the slot of a message that's been pushed.
+func (l *domainLimiter) release() {
+	if l.sem != nil {
+		<-l.sem
+	}
+}
+
+// reserve records a push if there's room for it in the sliding window.
+// If there isn't, it returns the time until there is.
+func (l *domainLimiter) reserve() time.Duration {
+	if l.rate < 1 {
+		return 0
+	}
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	now := time.Now()
+
+	// Forget the pushes that have slid out of the window.
+	n := 0
+	for n < len(l.sent) && !now.Before(l.sent[n].Add(l.window)) {
+		n++
+	}
+	l.sent = l.sent[n:]
+
+	if len(l.sent) < l.rate {
+		l.sent = append(l.sent, now)
+		return 0
+	}
+	return l.sent[0].Add(l.window).Sub(now)
+}
+
+// recipientDomain returns the lowercased domain of an e-mail address.
+func recipientDomain(addr string) string {
+	i := strings.LastIndex(addr, "@")
+	if i < 0 {
+		return ""
+	}
+	return strings.ToLower(strings.TrimRight(addr[i+1:], "> "))
+}
@@ -0,0 +1,161 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// MaxErrorWindow is the maximum number of the last messages of a campaign
+// that its error rate is evaluated on.
+const MaxErrorWindow = 100000
+
+// AlertAborted is the reason of the send alerts of campaigns that were
+// aborted for crossing their error rate threshold.
+const AlertAborted = "aborted"
+
+// errWindow holds the results of the last messages of a campaign.
+type errWindow struct {
+	// Ring buffer of the results (true = failed) of the last n messages.
+	results []bool
+	pos     int
+	n       int
+	errors  int
+
+	// aborted is set once the campaign is queued to be aborted.
+	aborted bool
+}
+
+// errorRates tracks the error rates of campaigns being processed that
+// have the rate threshold.
+type errorRates struct {
+	camps map[int]*errWindow
+	sync.Mutex
+}
+
+// errorMode returns the effective send error threshold of a campaign.
+func (m *Manager) errorMode(c *models.Campaign) string {
+	if c.ErrorMode != "" {
+		return c.ErrorMode
+	}
+	if m.cfg.ErrorMode != "" {
+		return m.cfg.ErrorMode
+	}
+	return models.CampaignErrorModeCount
+}
+
+// errorRateThreshold returns the effective error rate (percentage) that a
+// campaign is aborted at and the number of its last messages it's
+// evaluated on.
+func (m *Manager) errorRateThreshold(c *models.Campaign) (float64, int) {
+	rate, window := m.cfg.MaxErrorRate, m.cfg.ErrorWindow
+	if c.ErrorRate > 0 {
+		rate = c.ErrorRate
+	}
+	if c.ErrorWindow > 0 {
+		window = c.ErrorWindow
+	}
+	return rate, window
+}
+
+// recordErrorRate records the result of a message of a campaign with the
+// rate threshold and queues the campaign to be aborted once the rate of
+// errors among its last messages crosses the threshold. The rate is only
+// evaluated on a full window so that a few early errors don't abort it.
+func (m *Manager) recordErrorRate(c *models.Campaign, sendErr error) {
+	if m.errorMode(c) != models.CampaignErrorModeRate {
+		return
+	}
+	rate, window := m.errorRateThreshold(c)
+	if rate <= 0 || window < 1 {
+		return
+	}
+
+	m.errorRates.Lock()
+	w, ok := m.errorRates.camps[c.ID]
+	if !ok {
+		w = &errWindow{results: make([]bool, window)}
+		m.errorRates.camps[c.ID] = w
+	}
+
+	// Slide the window.
+	failed := sendErr != nil
+	if w.n == len(w.results) {
+		if w.results[w.pos] {
+			w.errors--
+		}
+	} else {
+		w.n++
+	}
+	w.results[w.pos] = failed
+	w.pos = (w.pos + 1) % len(w.results)
+	if failed {
+		w.errors++
+	}
+
+	cur := float64(w.errors) / float64(w.n) * 100
+	if w.aborted || w.n < len(w.results) || cur < rate {
+		m.errorRates.Unlock()
+		return
+	}
+	w.aborted = true
+	errs, n := w.errors, w.n
+	m.errorRates.Unlock()
+
+	e := msgError{
+		camp: c,
+		err:  fmt.Errorf("%d of the last %d messages (%.2f%%) failed, above the threshold of %.2f%%", errs, n, cur, rate),
+	}
+	select {
+	case m.campAbortQueue <- e:
+	default:
+	}
+}
+
+// abortCampaign aborts a campaign whose error rate crossed its threshold,
+// records the reason, and notifies the admins and the send alert callback.
+func (m *Manager) abortCampaign(e msgError) {
+	if !m.isCampaignProcessing(e.camp.ID) {
+		return
+	}
+
+	reason := e.err.Error()
+	m.logger.Printf("aborting campaign %s: %s", e.camp.Name, reason)
+
+	a := SendAlert{
+		CampaignID:   e.camp.ID,
+		CampaignUUID: e.camp.UUID,
+		CampaignName: e.camp.Name,
+		Reason:       AlertAborted,
+		Samples:      []string{reason},
+		Timestamp:    time.Now(),
+	}
+	m.errorRates.Lock()
+	if w, ok := m.errorRates.camps[e.camp.ID]; ok {
+		a.Window = w.n
+		a.Errors = w.errors
+		a.ErrorRate = float64(w.errors) / float64(w.n) * 100
+	}
+	m.errorRates.Unlock()
+
+	if err := m.src.SetCampaignAbortReason(e.camp.ID, reason); err != nil {
+		m.logger.Printf("error recording campaign (%s) abort reason: %v", e.camp.Name, err)
+	}
+	m.exhaustCampaign(e.camp, models.CampaignStatusAborted)
+	delete(m.campMsgErrorCounts, e.camp.ID)
+
+	m.sendNotif(e.camp, models.CampaignStatusAborted, "Error rate: "+reason)
+	if m.cfg.AlertCB != nil {
+		go m.cfg.AlertCB(a)
+	}
+}
+
+// endErrorRate clears the results of a campaign that has stopped
+// processing.
+func (m *Manager) endErrorRate(campID int) {
+	m.errorRates.Lock()
+	delete(m.errorRates.camps, campID)
+	m.errorRates.Unlock()
+}
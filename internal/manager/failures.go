@@ -0,0 +1,87 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const (
+	// failQueueSize is the number of failures that can be queued before
+	// they're recorded. Failures beyond that are dropped so that the
+	// message workers are never blocked.
+	failQueueSize = 10000
+
+	// failFlushInterval is the interval at which queued failures are
+	// recorded and failFlushSize the number of failures recorded at once.
+	failFlushInterval = time.Second * 2
+	failFlushSize     = 500
+)
+
+// Failure represents a campaign message that failed to be sent
+// to a subscriber.
+type Failure struct {
+	CampaignID   int
+	SubscriberID int
+	Error        string
+
+	// Permanent failures won't succeed on being resent.
+	Permanent bool
+}
+
+// recordFailure queues the failure of a campaign message to be recorded.
+func (m *Manager) recordFailure(campID, subID int, err error) {
+	f := Failure{
+		CampaignID:   campID,
+		SubscriberID: subID,
+		Error:        err.Error(),
+		Permanent:    messenger.IsPermanent(err),
+	}
+
+	select {
+	case m.failQueue <- f:
+	default:
+		m.logger.Printf("failure queue is full. not recording failure of subscriber %d in campaign %d", subID, campID)
+	}
+}
+
+// flushFailures is a blocking function that records queued failures
+// in batches at the given interval or when they're requested on failFlushReq.
+func (m *Manager) flushFailures(interval time.Duration) {
+	var (
+		t     = time.NewTicker(interval)
+		batch = make([]Failure, 0, failFlushSize)
+	)
+	defer t.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := m.src.RecordFailures(batch); err != nil {
+			m.logger.Printf("error recording %d campaign failures: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case f := <-m.failQueue:
+			batch = append(batch, f)
+			if len(batch) >= failFlushSize {
+				flush()
+			}
+		case <-t.C:
+			flush()
+		case done := <-m.failFlushReq:
+			for len(m.failQueue) > 0 {
+				batch = append(batch, <-m.failQueue)
+				if len(batch) >= failFlushSize {
+					flush()
+				}
+			}
+			flush()
+			close(done)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+// FallbackConfig has the settings of the messenger fallback chain.
+type FallbackConfig struct {
+	// Chain is the ordered list of messengers that campaign messages fall
+	// back to when the campaign's messenger is unhealthy.
+	Chain []string
+
+	// Errors is the number of consecutive (non-permanent) send errors
+	// after which a messenger is considered unhealthy. 0 disables fallbacks.
+	Errors int
+
+	// RetryAfter is the interval after which an unhealthy messenger
+	// is tried again.
+	RetryAfter time.Duration
+}
+
+// msgrHealth is the health of a messenger derived from its send results.
+type msgrHealth struct {
+	errors    int
+	downUntil time.Time
+}
+
+// campChain is the messenger chain of a campaign being processed.
+type campChain struct {
+	names []string
+
+	// The messenger that was last picked.
+	cur string
+}
+
+// fallbacks tracks the health of messengers and the messenger chains
+// of campaigns being processed.
+type fallbacks struct {
+	health map[string]*msgrHealth
+	camps  map[int]*campChain
+	sync.Mutex
+}
+
+// startFallback prepares the messenger chain of a campaign, which is its
+// messenger followed by the messengers in the fallback chain that are
+// compatible with its template.
+func (m *Manager) startFallback(c *models.Campaign) {
+	if m.cfg.Fallback.Errors < 1 {
+		return
+	}
+
+	names := []string{c.MessengerID}
+	for _, n := range m.cfg.Fallback.Chain {
+		if n == c.MessengerID {
+			continue
+		}
+		if !m.HasMessenger(n) {
+			continue
+		}
+		if err := m.ValidateTemplateFormat(n, c.TemplateFormat); err != nil {
+			m.logger.Printf("skipping fallback messenger %s on campaign %s: %v", n, c.Name, err)
+			continue
+		}
+		names = append(names, n)
+	}
+
+	m.fallbacks.Lock()
+	m.fallbacks.camps[c.ID] = &campChain{names: names, cur: c.MessengerID}
+	m.fallbacks.Unlock()
+}
+
+// pickMessenger returns the first healthy messenger in a campaign's chain.
+// If none of them are healthy, the campaign's own messenger is returned.
+func (m *Manager) pickMessenger(c *models.Campaign) string {
+	if m.cfg.Fallback.Errors < 1 {
+		return c.MessengerID
+	}
+
+	m.fallbacks.Lock()
+	defer m.fallbacks.Unlock()
+
+	ch, ok := m.fallbacks.camps[c.ID]
+	if !ok {
+		return c.MessengerID
+	}
+
+	name := c.MessengerID
+	for _, n := range ch.names {
+		if h, ok := m.fallbacks.health[n]; !ok || time.Now().After(h.downUntil) {
+			name = n
+			break
+		}
+	}
+
+	if name != ch.cur {
+		if name == c.MessengerID {
+			m.logger.Printf("messenger %s is healthy again. resuming it on campaign %s", name, c.Name)
+		} else {
+			m.logger.Printf("messenger %s is unhealthy. falling back to %s on campaign %s", ch.cur, name, c.Name)
+		}
+		ch.cur = name
+	}
+	return name
+}
+
+// recordHealth records the result of a message push on a messenger.
+// Permanent errors, such as rejected recipients, don't count against
+// the messenger's health.
+func (m *Manager) recordHealth(name string, err error) {
+	if m.cfg.Fallback.Errors < 1 || (err != nil && messenger.IsPermanent(err)) {
+		return
+	}
+
+	m.fallbacks.Lock()
+	defer m.fallbacks.Unlock()
+
+	h, ok := m.fallbacks.health[name]
+	if !ok {
+		if err == nil {
+			return
+		}
+		h = &msgrHealth{}
+		m.fallbacks.health[name] = h
+	}
+
+	if err == nil {
+		delete(m.fallbacks.health, name)
+		return
+	}
+
+	h.errors++
+	if h.errors >= m.cfg.Fallback.Errors {
+		// On retrying, a single error marks it unhealthy again.
+		h.errors = m.cfg.Fallback.Errors - 1
+		h.downUntil = time.Now().Add(m.cfg.Fallback.RetryAfter)
+	}
+}
+
+// endFallback clears the messenger chain of a campaign that has
+// stopped processing.
+func (m *Manager) endFallback(campID int) {
+	m.fallbacks.Lock()
+	delete(m.fallbacks.camps, campID)
+	m.fallbacks.Unlock()
+}
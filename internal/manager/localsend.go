@@ -0,0 +1,65 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// localSendMargin is how long before a batch was fetched the send times of
+// timezones are still waited for in case the clocks of the app and the data
+// source differ.
+const localSendMargin = time.Minute
+
+// waitLocalSend checks whether a running campaign with a local send time
+// that has no more subscribers due has timezones that are yet to reach it,
+// and if it has, parks it until the next one does. The campaign is finished
+// once all of its timezones have been sent.
+func (m *Manager) waitLocalSend(c *models.Campaign, fetched time.Time) bool {
+	cm, err := m.src.GetCampaign(c.ID)
+	if err != nil {
+		m.logger.Printf("error fetching campaign (%s): %v", c.Name, err)
+		return false
+	}
+	if cm.Status != models.CampaignStatusRunning {
+		return false
+	}
+
+	buckets, err := m.src.GetLocalSendBuckets(c.ID)
+	if err != nil {
+		// Check again later instead of finishing the campaign early.
+		m.logger.Printf("error fetching local send times of campaign (%s): %v", c.Name, err)
+		m.parkUntil(c, time.Now().Add(windowRecheck))
+		return true
+	}
+
+	var (
+		from = fetched.Add(-localSendMargin)
+		next time.Time
+		tz   string
+	)
+	for _, b := range buckets {
+		if b.SendAt.After(from) && (next.IsZero() || b.SendAt.Before(next)) {
+			next = b.SendAt
+			tz = b.Timezone
+		}
+	}
+	if next.IsZero() {
+		return false
+	}
+
+	m.logger.Printf("campaign (%s) waiting until %s for its %s subscribers",
+		c.Name, next.Format(time.RFC3339), tz)
+	m.parkUntil(c, next)
+	return true
+}
+
+// parkUntil stops processing a running campaign without changing its status
+// until a time, after which it's picked up from where it left off.
+func (m *Manager) parkUntil(c *models.Campaign, until time.Time) {
+	m.releaseCampaign(c)
+
+	m.deferredMutex.Lock()
+	m.deferred[c.ID] = until
+	m.deferredMutex.Unlock()
+}
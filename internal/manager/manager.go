@@ -2,44 +2,72 @@ package manager
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
+	"net/textproto"
+	"regexp"
 	"strings"
 	"sync"
+	ttemplate "text/template"
 	"time"
 
 	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/plaintext"
+	"github.com/knadh/listmonk/internal/transform"
 	"github.com/knadh/listmonk/models"
 )
 
+// regexpPostalAddress matches the postal address placeholder in templates.
+var regexpPostalAddress = regexp.MustCompile(`{{[^}]*\bPostalAddress\b`)
+
 const (
 	// BaseTPL is the name of the base template.
 	BaseTPL = "base"
 
 	// ContentTpl is the name of the compiled message.
 	ContentTpl = "content"
+
+	// messengerCloseDelay is the time after which replaced messengers are closed.
+	messengerCloseDelay = time.Second * 30
 )
 
 // DataSource represents a data backend, such as a database,
 // that provides subscriber and campaign records.
 type DataSource interface {
-	NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error)
+	NextCampaigns(excludeIDs []int64, limit int) ([]*models.Campaign, error)
 	NextSubscribers(campID, limit int) ([]models.Subscriber, error)
+	GetLocalSendBuckets(campID int) ([]models.LocalSendBucket, error)
 	GetCampaign(campID int) (*models.Campaign, error)
 	UpdateCampaignStatus(campID int, status string) error
+	HoldCampaignRollout(campID int) error
 	CreateLink(url string) (string, error)
+	CreateShortLink(campID int, linkUUID string) (string, error)
+	RecordFailures([]Failure) error
+	RecordDeliveries([]Delivery) error
+	CheckpointCampaign(campID int) error
+	ResumeCampaign(campID int) (int, bool, error)
+	RecordMessage(RenderedMessage) error
+	SetCampaignAbortReason(campID int, reason string) error
+	RecordRenderErrors(campID, n int, lastErr string) error
 }
 
 // Manager handles the scheduling, processing, and queuing of campaigns
 // and message pushes.
 type Manager struct {
-	cfg        Config
-	src        DataSource
+	cfg     Config
+	src     DataSource
+	notifCB models.AdminNotifCallback
+	logger  *log.Logger
+
+	// Messengers can be replaced while campaigns are running. See ReplaceMessenger.
 	messengers map[string]messenger.Messenger
-	notifCB    models.AdminNotifCallback
-	logger     *log.Logger
+	msgrMutex  sync.RWMutex
 
 	// Campaigns that are currently running.
 	camps      map[int]*models.Campaign
@@ -49,13 +77,74 @@ type Manager struct {
 	// the database for the link UUID for every message sent. This has to
 	// be locked as it may be used externally when previewing campaigns.
 	links      map[string]string
+	shortLinks map[shortLinkKey]string
 	linksMutex sync.RWMutex
 
-	subFetchQueue      chan *models.Campaign
+	// Live progress of campaigns being processed and its subscribers.
+	progress progress
+
+	// Recent send results of campaigns for send failure alerts.
+	alerts alerts
+
+	// Failed recipients of campaigns that are yet to be recorded and
+	// requests to record them right away.
+	failQueue    chan Failure
+	failFlushReq chan chan bool
+
+	// Deliveries of campaigns that are queued to be recorded and requests
+	// to record them right away, which are answered with the error, if any.
+	delivQueue    chan Delivery
+	delivFlushReq chan chan error
+
+	// Rendered messages that are queued to be logged. See MessageLogConfig.
+	msgLogQueue chan RenderedMessage
+
+	// Messenger health and the messenger chains of campaigns.
+	fallbacks fallbacks
+
+	// Push results of messengers for diagnostics.
+	msgrStats msgrStats
+
+	// Counters of campaign messages for load testing.
+	queueStats queueStats
+
+	// Rolling error rates of campaigns with the rate threshold.
+	errorRates errorRates
+
+	// Running campaigns that are allocated batches of subscribers.
+	sched scheduler
+
+	// Batches of the running campaigns whose checkpoints are yet to be
+	// dropped and the campaigns whose batches are done.
+	checkpoints     checkpoints
+	checkpointQueue chan int
+
+	// Limiters of the domains with DomainLimits. Simulated campaigns have
+	// their own so that their dry runs are limited like the campaigns they
+	// simulate, which estimates their duration, without taking the room of
+	// the messages that are pushed.
+	domainLimits    map[string]*domainLimiter
+	simDomainLimits map[string]*domainLimiter
+
+	// Campaigns outside the send windows of their lists and the times until
+	// which they're deferred.
+	deferred      map[int]time.Time
+	deferredMutex sync.Mutex
+
 	campMsgQueue       chan CampaignMessage
 	campMsgErrorQueue  chan msgError
+	campOutageQueue    chan msgError
+	campAbortQueue     chan msgError
 	campMsgErrorCounts map[int]int
 	msgQueue           chan Message
+
+	// stop is closed by Stop and runDone by Run once it stops starting
+	// new batches. inFlight counts the campaign messages that are yet
+	// to be pushed.
+	stop     chan bool
+	stopOnce sync.Once
+	runDone  chan bool
+	inFlight sync.WaitGroup
 }
 
 // CampaignMessage represents an instance of campaign message to be pushed out,
@@ -68,7 +157,36 @@ type CampaignMessage struct {
 	to       string
 	subject  string
 	body     []byte
+	amp      []byte
+	altBody  []byte
 	unsubURL string
+	replyTo  string
+	tags     textproto.MIMEHeader
+
+	// lang is the campaign's language variant that's picked for the
+	// subscriber, if any, and tpl and subjectTpl are its templates.
+	lang       string
+	tpl        *template.Template
+	subjectTpl *template.Template
+
+	// ampTpl is the campaign's AMP body, which is only sent with the
+	// default content as it doesn't have language variants.
+	ampTpl *template.Template
+
+	// altTpl is the campaign's plaintext body, which is also only sent with
+	// the default content. If there's none, autoAlt generates one from the
+	// rendered body.
+	altTpl  *ttemplate.Template
+	autoAlt bool
+
+	// batch is the batch of subscribers of the campaign that the message
+	// is from, if any.
+	batch *campBatch
+
+	// limitDone releases the room that's reserved for the message in the
+	// limits of its recipient's domain when it's re-queued after being
+	// deferred.
+	limitDone func()
 }
 
 // Message represents a generic message to be pushed to a messenger.
@@ -85,16 +203,127 @@ type Config struct {
 	// Number of subscribers to pull from the DB in a single iteration.
 	BatchSize int
 
-	Concurrency    int
-	MessageRate    int
+	Concurrency int
+
+	// MessageRate is the number of campaign messages that each worker
+	// sends per MessageRateUnit (a second by default). Messages are paced
+	// evenly across the unit instead of being sent in bursts.
+	MessageRate     int
+	MessageRateUnit time.Duration
+
 	MaxSendErrors  int
 	RequeueOnError bool
 	FromEmail      string
 	LinkTrackURL   string
+	ShortLinkURL   string
 	UnsubURL       string
 	OptinURL       string
 	MessageURL     string
 	ViewTrackURL   string
+
+	// ErrorMode is the default threshold of the send errors of campaigns
+	// (models.CampaignErrorModeCount etc.). With rate, campaigns are aborted
+	// when MaxErrorRate percent of their last ErrorWindow messages fail
+	// instead of being paused after MaxSendErrors. Campaigns can override it.
+	ErrorMode    string
+	MaxErrorRate float64
+	ErrorWindow  int
+
+	// MaxRunning is the maximum number of campaigns that are processed at
+	// the same time. The rest are left in the data source's queue until
+	// there's a slot. 0 is unlimited.
+	MaxRunning int
+
+	// AutoAltBody generates the plaintext alternatives of the HTML bodies
+	// of campaigns that don't have one. Campaigns can override it.
+	AutoAltBody bool
+
+	// OutagePolicy is the default policy of campaigns on outages of their
+	// messengers (models.CampaignOutagePause etc.) whose messages aren't
+	// counted towards MaxSendErrors unless it's continue.
+	OutagePolicy string
+
+	// ConversionURL is the URL for reporting conversions and
+	// ConversionSecret is the secret its tokens are signed with.
+	ConversionURL    string
+	ConversionSecret string
+
+	// DisableTracking renders the tracked links of messages as they are and
+	// the view tracking pixel as nothing so that no views or clicks are
+	// recorded.
+	DisableTracking bool
+
+	// RootURL is the root URL that the LinkTrackURL and ViewTrackURL
+	// are prefixed with. It's swapped with the base URL of a campaign's
+	// tracking domain, if it has one, from TrackingDomains.
+	RootURL         string
+	TrackingDomains map[string]string
+
+	// TemplateFormats is the map of messenger names and the template
+	// formats (html, plain) they're compatible with. Messengers that
+	// aren't in the map are compatible with all formats.
+	TemplateFormats map[string][]string
+
+	// Transforms is the map of messenger names and the transforms that
+	// are applied to the rendered bodies of the campaign messages that are
+	// pushed to them.
+	Transforms map[string]transform.Transform
+
+	// LangAttrib is the subscriber attribute that has the language
+	// code used to pick a campaign's language variant.
+	LangAttrib string
+
+	// Alerts has the thresholds of send failure alerts that are
+	// raised with AlertCB.
+	Alerts  AlertConfig
+	AlertCB AlertCallback
+
+	// Fallback has the messenger fallback chain of campaign messages.
+	Fallback FallbackConfig
+
+	// RequireApproval refuses to run campaigns that haven't been approved,
+	// which are returned to be approved instead. Simulations aren't.
+	RequireApproval bool
+
+	// DomainLimits are the rate limits and concurrency caps of the
+	// campaign messages to the recipients of groups of domains. A worker
+	// waits for the limits of the domain of the message it's sending.
+	DomainLimits []DomainLimit
+
+	// Footer has the mandatory campaign footer.
+	Footer FooterConfig
+
+	// MessageLog has the settings of the log of rendered messages.
+	MessageLog MessageLogConfig
+
+	// ReplyTo, if set, encodes the campaign and the subscriber into the
+	// Reply-To of campaign messages to attribute replies.
+	ReplyTo *messenger.VERP
+
+	// TagHeaders, if set, returns the headers that tag campaign messages
+	// with the campaign and subscriber UUIDs to attribute the events that
+	// the e-mail provider reports on them.
+	TagHeaders func(campUUID, subUUID string) textproto.MIMEHeader
+
+	// FinishCB, if set, is invoked with campaigns that have finished
+	// sending to all their subscribers.
+	FinishCB func(c *models.Campaign)
+}
+
+// FooterConfig has the settings of the mandatory campaign footer.
+type FooterConfig struct {
+	// Templates are the footers keyed by language code ("" is the default)
+	// that are appended to messages without an unsubscribe link. An empty
+	// map disables the footer.
+	Templates map[string]models.Footer
+
+	// Address is the postal address that's available in templates
+	// as {{ PostalAddress }}.
+	Address string
+
+	// Strict blocks campaigns whose messages (with the footer) don't have
+	// an unsubscribe link or, if it's set, the postal address.
+	Strict bool
 }
 
 type msgError struct {
@@ -102,6 +331,12 @@ type msgError struct {
 	err  error
 }
 
+// shortLinkKey is the key of the cached short links of campaigns.
+type shortLinkKey struct {
+	campID int
+	url    string
+}
+
 // New returns a new instance of Mailer.
 func New(cfg Config, src DataSource, notifCB models.AdminNotifCallback, l *log.Logger) *Manager {
 	if cfg.BatchSize < 1 {
@@ -113,40 +348,140 @@ func New(cfg Config, src DataSource, notifCB models.AdminNotifCallback, l *log.L
 	if cfg.MessageRate < 1 {
 		cfg.MessageRate = 1
 	}
+	if cfg.MessageRateUnit <= 0 {
+		cfg.MessageRateUnit = time.Second
+	}
+	if cfg.Alerts.Window < 1 {
+		cfg.Alerts.Window = 100
+	}
+	if cfg.OutagePolicy == "" {
+		cfg.OutagePolicy = models.CampaignOutagePause
+	}
+	if cfg.Fallback.RetryAfter < time.Second {
+		cfg.Fallback.RetryAfter = time.Minute
+	}
 
 	return &Manager{
-		cfg:                cfg,
-		src:                src,
-		notifCB:            notifCB,
-		logger:             l,
-		messengers:         make(map[string]messenger.Messenger),
-		camps:              make(map[int]*models.Campaign),
-		links:              make(map[string]string),
-		subFetchQueue:      make(chan *models.Campaign, cfg.Concurrency),
+		cfg:        cfg,
+		src:        src,
+		notifCB:    notifCB,
+		logger:     l,
+		messengers: make(map[string]messenger.Messenger),
+		camps:      make(map[int]*models.Campaign),
+		links:      make(map[string]string),
+		shortLinks: make(map[shortLinkKey]string),
+		progress: progress{
+			camps: make(map[int]*campProgress),
+			subs:  make(map[int]map[chan CampaignProgress]struct{}),
+		},
+		alerts:     alerts{camps: make(map[int]*alertState)},
+		errorRates: errorRates{camps: make(map[int]*errWindow)},
+		fallbacks: fallbacks{
+			health: make(map[string]*msgrHealth),
+			camps:  make(map[int]*campChain),
+		},
+		msgrStats:          msgrStats{msgrs: make(map[string]*msgrStat)},
+		domainLimits:       newDomainLimiters(cfg.DomainLimits),
+		simDomainLimits:    newDomainLimiters(cfg.DomainLimits),
+		checkpointQueue:    make(chan int, checkpointQueueSize),
+		failQueue:          make(chan Failure, failQueueSize),
+		failFlushReq:       make(chan chan bool),
+		delivQueue:         make(chan Delivery, delivQueueSize),
+		delivFlushReq:      make(chan chan error),
+		msgLogQueue:        make(chan RenderedMessage, msgLogQueueSize),
 		campMsgQueue:       make(chan CampaignMessage, cfg.Concurrency*2),
 		msgQueue:           make(chan Message, cfg.Concurrency),
 		campMsgErrorQueue:  make(chan msgError, cfg.MaxSendErrors),
+		campOutageQueue:    make(chan msgError, cfg.Concurrency),
+		campAbortQueue:     make(chan msgError, cfg.Concurrency),
 		campMsgErrorCounts: make(map[int]int),
+		deferred:           make(map[int]time.Time),
+		stop:               make(chan bool),
+		runDone:            make(chan bool),
+		sched: scheduler{
+			camps: make(map[int]*schedCamp),
+			wake:  make(chan bool, 1),
+		},
+		checkpoints: checkpoints{
+			camps: make(map[int][]*campBatch),
+			seen:  make(map[int]bool),
+		},
 	}
 }
 
 // NewCampaignMessage creates and returns a CampaignMessage that is made available
 // to message templates while they're compiled. It represents a message from
 // a campaign that's bound to a single Subscriber.
+// If the campaign has a language variant that matches the subscriber's
+// language or an A/B test variant, the message is rendered from it.
 func (m *Manager) NewCampaignMessage(c *models.Campaign, s models.Subscriber) CampaignMessage {
-	return CampaignMessage{
+	msg := CampaignMessage{
 		Campaign:   c,
 		Subscriber: s,
 
-		subject:  c.Subject,
-		from:     c.FromEmail,
-		to:       s.Email,
-		unsubURL: fmt.Sprintf(m.cfg.UnsubURL, c.UUID, s.UUID),
+		subject:    c.Subject,
+		from:       c.FromEmail,
+		to:         s.Email,
+		unsubURL:   fmt.Sprintf(m.cfg.UnsubURL, c.UUID, s.UUID),
+		tpl:        c.Tpl,
+		subjectTpl: c.SubjectTpl,
+		ampTpl:     c.AMPTpl,
+		altTpl:     c.AltBodyTpl,
+		autoAlt:    m.cfg.AutoAltBody,
+	}
+	if c.AutoAltBody.Valid {
+		msg.autoAlt = c.AutoAltBody.Bool
+	}
+
+	// The Reply-To of the campaign's lists, which the reply tracking
+	// address is rebased on if it's enabled.
+	switch {
+	case m.cfg.ReplyTo != nil && c.ListReplyTo != "":
+		msg.replyTo = m.cfg.ReplyTo.EncodeAt(c.ListReplyTo, c.UUID, s.UUID, s.Email)
+	case m.cfg.ReplyTo != nil:
+		msg.replyTo = m.cfg.ReplyTo.Encode(c.UUID, s.UUID, s.Email)
+	case c.ListReplyTo != "":
+		msg.replyTo = c.ListReplyTo
+	}
+	if m.cfg.TagHeaders != nil {
+		msg.tags = m.cfg.TagHeaders(c.UUID, s.UUID)
 	}
+
+	if lang := c.Variant(s, m.cfg.LangAttrib); lang != "" {
+		if v, ok := c.VariantTpls[lang]; ok {
+			msg.lang = lang
+			msg.subject = v.Subject
+			msg.tpl = v.Tpl
+			msg.subjectTpl = v.SubjectTpl
+			msg.ampTpl = nil
+			msg.altTpl = nil
+		}
+	}
+
+	// The sample of an A/B test is split between its variants and the rest
+	// get the winner.
+	if len(c.ABTpls) > 0 {
+		v := c.ABWinner
+		if c.RolloutStage == models.CampaignRolloutInitial {
+			v = c.ABTest.Variant(c.UUID, s.ID)
+		}
+		if v > 0 && v <= len(c.ABTpls) {
+			t := c.ABTpls[v-1]
+			msg.subject = t.Subject
+			msg.tpl = t.Tpl
+			msg.subjectTpl = t.SubjectTpl
+			msg.ampTpl = nil
+			msg.altTpl = nil
+		}
+	}
+	return msg
 }
 
 // AddMessenger adds a Messenger messaging backend to the manager.
 func (m *Manager) AddMessenger(msg messenger.Messenger) error {
+	m.msgrMutex.Lock()
+	defer m.msgrMutex.Unlock()
+
 	id := msg.Name()
 	if _, ok := m.messengers[id]; ok {
 		return fmt.Errorf("messenger '%s' is already loaded", id)
@@ -155,6 +490,40 @@ func (m *Manager) AddMessenger(msg messenger.Messenger) error {
 	return nil
 }
 
+// ReplaceMessenger replaces a loaded Messenger with a new instance of it
+// (eg: with new credentials) without interrupting running campaigns, whose
+// subsequent messages are pushed to the new instance. If the old instance
+// has a Close() method, it's closed once the messages being pushed to it
+// are likely to have finished.
+func (m *Manager) ReplaceMessenger(msg messenger.Messenger) error {
+	m.msgrMutex.Lock()
+	old, ok := m.messengers[msg.Name()]
+	if !ok {
+		m.msgrMutex.Unlock()
+		return fmt.Errorf("messenger '%s' isn't loaded", msg.Name())
+	}
+	m.messengers[msg.Name()] = msg
+	m.msgrMutex.Unlock()
+
+	if c, ok := old.(interface{ Close() error }); ok {
+		go func() {
+			time.Sleep(messengerCloseDelay)
+			if err := c.Close(); err != nil {
+				m.logger.Printf("error closing replaced messenger %s: %v", msg.Name(), err)
+			}
+		}()
+	}
+	return nil
+}
+
+// getMessenger returns a loaded Messenger.
+func (m *Manager) getMessenger(id string) (messenger.Messenger, bool) {
+	m.msgrMutex.RLock()
+	msg, ok := m.messengers[id]
+	m.msgrMutex.RUnlock()
+	return msg, ok
+}
+
 // PushMessage pushes a Message to be sent out by the workers.
 func (m *Manager) PushMessage(msg Message) error {
 	t := time.NewTicker(time.Second * 3)
@@ -171,6 +540,9 @@ func (m *Manager) PushMessage(msg Message) error {
 
 // GetMessengerNames returns the list of registered messengers.
 func (m *Manager) GetMessengerNames() []string {
+	m.msgrMutex.RLock()
+	defer m.msgrMutex.RUnlock()
+
 	names := make([]string, 0, len(m.messengers))
 	for n := range m.messengers {
 		names = append(names, n)
@@ -180,10 +552,26 @@ func (m *Manager) GetMessengerNames() []string {
 
 // HasMessenger checks if a given messenger is registered.
 func (m *Manager) HasMessenger(id string) bool {
-	_, ok := m.messengers[id]
+	_, ok := m.getMessenger(id)
 	return ok
 }
 
+// ValidateTemplateFormat checks if a template format is compatible
+// with a given messenger.
+func (m *Manager) ValidateTemplateFormat(messengerID, format string) error {
+	formats, ok := m.cfg.TemplateFormats[messengerID]
+	if !ok || len(formats) == 0 {
+		return nil
+	}
+	for _, f := range formats {
+		if f == format {
+			return nil
+		}
+	}
+	return fmt.Errorf("'%s' template is not compatible with the messenger '%s'. Compatible formats are: %s",
+		format, messengerID, strings.Join(formats, ", "))
+}
+
 // Run is a blocking function (that should be invoked as a goroutine)
 // that scans the data source at regular intervals for pending campaigns,
 // and queues them for processing. The process queue fetches batches of
@@ -192,24 +580,68 @@ func (m *Manager) HasMessenger(id string) bool {
 // as "finished".
 func (m *Manager) Run(tick time.Duration) {
 	go m.scanCampaigns(tick)
+	go m.publishProgress(progressInterval)
+	go m.flushFailures(failFlushInterval)
+	go m.flushDeliveries(failFlushInterval)
+	go m.recordMessages()
+	go m.dropCheckpoints()
 
 	// Spawn N message workers.
 	for i := 0; i < m.cfg.Concurrency; i++ {
 		go m.messageWorker()
 	}
 
-	// Fetch the next set of subscribers for a campaign and process them.
-	for c := range m.subFetchQueue {
-		has, err := m.nextSubscribers(c, m.cfg.BatchSize)
+	// Fetch the next set of subscribers for a campaign and process them
+	// until the manager is stopped.
+	defer close(m.runDone)
+	for {
+		c, ok := m.nextScheduled()
+		if !ok {
+			select {
+			case <-m.stop:
+				return
+			case <-m.sched.wake:
+			}
+			continue
+		}
+
+		// Don't start a new batch once the manager is stopped.
+		if m.isStopped() {
+			return
+		}
+
+		// Stop processing the campaign when its lists' send windows close.
+		if !c.ListSendWindows.Contains(time.Now()) {
+			m.parkCampaign(c)
+			continue
+		}
+
+		fetched := time.Now()
+		size, wait := m.trickleBatch(c)
+		has, err := m.nextSubscribers(c, size)
 		if err != nil {
 			m.logger.Printf("error processing campaign batch (%s): %v", c.Name, err)
+			m.unschedule(c.ID)
 			continue
 		}
 
+		// There are more subscribers to fetch in the campaign's next turn,
+		// which trickled rollouts wait for.
 		if has {
-			// There are more subscribers to fetch.
-			m.subFetchQueue <- c
-		} else if m.isCampaignProcessing(c.ID) {
+			if wait > 0 {
+				m.parkUntil(c, fetched.Add(wait))
+			}
+			continue
+		}
+
+		// Campaigns with a local send time wait until it's that time in
+		// the next timezone of their subscribers.
+		if c.LocalSendTime != "" && m.waitLocalSend(c, fetched) {
+			continue
+		}
+
+		m.unschedule(c.ID)
+		if m.isCampaignProcessing(c.ID) {
 			// There are no more subscribers. Either the campaign status
 			// has changed or all subscribers have been processed.
 			newC, err := m.exhaustCampaign(c, "")
@@ -217,42 +649,184 @@ func (m *Manager) Run(tick time.Duration) {
 				m.logger.Printf("error exhausting campaign (%s): %v", c.Name, err)
 				continue
 			}
-			m.sendNotif(newC, newC.Status, "")
+			m.sendNotif(newC, newC.Status, rolloutNotifReason(newC))
 		}
 	}
 }
 
+// Stop stops the manager from starting new campaign batches and waits until
+// the messages of the batches being processed are pushed and their failures
+// and deliveries are recorded, or until ctx is done. The campaigns remain running and are
+// picked up from the next batch when the manager runs again.
+func (m *Manager) Stop(ctx context.Context) error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+
+	done := make(chan bool)
+	go func() {
+		<-m.runDone
+		m.inFlight.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return fmt.Errorf("%d queued messages were not sent: %v", len(m.campMsgQueue), ctx.Err())
+	}
+
+	// Record the queued failures and deliveries right away.
+	flushed := make(chan bool)
+	select {
+	case m.failFlushReq <- flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	res := make(chan error, 1)
+	select {
+	case m.delivFlushReq <- res:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isStopped checks whether the manager has been stopped.
+func (m *Manager) isStopped() bool {
+	select {
+	case <-m.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// MessageInterval returns the interval at which each worker sends
+// campaign messages to keep to the message rate.
+func (m *Manager) MessageInterval() time.Duration {
+	return m.cfg.MessageRateUnit / time.Duration(m.cfg.MessageRate)
+}
+
+// MessageRate returns the effective number of campaign messages sent per
+// second across all workers.
+func (m *Manager) MessageRate() float64 {
+	return float64(m.cfg.Concurrency) / m.MessageInterval().Seconds()
+}
+
 // messageWorker is a blocking function that listens to the message queue
 // and pushes out incoming messages on it to the messenger.
 func (m *Manager) messageWorker() {
-	// Counter to keep track of the message / sec rate limit.
-	numMsg := 0
+	var (
+		interval = m.MessageInterval()
+
+		// The time after which the next campaign message can be sent.
+		next  time.Time
+		timer = time.NewTimer(0)
+	)
 	for {
+		// Only receive campaign messages when the next one is due and wait
+		// for it otherwise. Arbitrary messages aren't paced.
+		var campMsgs chan CampaignMessage
+		if d := time.Until(next); d > 0 {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(d)
+		} else {
+			campMsgs = m.campMsgQueue
+		}
+
 		select {
+		case <-timer.C:
+
 		// Campaign message.
-		case msg := <-m.campMsgQueue:
-			// Pause on hitting the message rate.
-			if numMsg >= m.cfg.MessageRate {
-				time.Sleep(time.Second)
-				numMsg = 0
+		case msg := <-campMsgs:
+			// Messages that are deferred by the limits of their domains
+			// remain in flight and aren't paced until they're sent.
+			done, ok := m.limitDomain(msg)
+			if !ok {
+				continue
 			}
-			numMsg++
 
-			err := m.messengers[msg.Campaign.MessengerID].Push(
-				msg.from, []string{msg.to}, msg.subject, msg.body, nil)
+			// Messages aren't made up for when they're sent slower than
+			// the rate, which would send them in bursts.
+			next = time.Now().Add(interval)
+
+			var (
+				sub = msg.Subscriber
+				err error
+			)
+
+			// The messages of simulated campaigns go through the entire
+			// pipeline, including the transforms and the domain limits,
+			// and are dropped instead of being pushed.
+			name := m.pickMessenger(msg.Campaign)
+			var body []byte
+			if body, err = m.Transform(name, msg.body); err == nil && !msg.Campaign.Simulate {
+				err = m.push(name, &msg, body)
+			}
+			done()
+			if err == nil && !msg.Campaign.Simulate {
+				m.recordDelivery(msg.Campaign.ID, sub.ID)
+			}
+			m.logMessage(&msg)
+			m.recordProgress(msg.Campaign.ID, err)
+			m.recordDispatched(msg.Campaign, err)
+
+			// Outages are handled by the campaign's outage policy and
+			// aren't counted as the errors of individual messages.
+			outage := err != nil && m.isOutage(msg.Campaign, err)
+			if !outage {
+				m.recordAlert(msg.Campaign, err)
+				m.recordErrorRate(msg.Campaign, err)
+			}
 			if err != nil {
 				m.logger.Printf("error sending message in campaign %s: %v", msg.Campaign.Name, err)
+				if !msg.Campaign.Simulate {
+					m.recordFailure(msg.Campaign.ID, sub.ID, err)
+				}
 
+				q := m.campMsgErrorQueue
+				if outage {
+					q = m.campOutageQueue
+				}
 				select {
-				case m.campMsgErrorQueue <- msgError{camp: msg.Campaign, err: err}:
+				case q <- msgError{camp: msg.Campaign, err: err}:
 				default:
 				}
 			}
+			m.finishBatchMessage(msg.batch)
+			m.inFlight.Done()
 
 		// Arbitrary message.
 		case msg := <-m.msgQueue:
-			err := m.messengers[msg.Messenger].Push(
-				msg.From, msg.To, msg.Subject, msg.Body, nil)
+			msgr, ok := m.getMessenger(msg.Messenger)
+			if !ok {
+				m.logger.Printf("error sending message '%s': unknown messenger %s", msg.Subject, msg.Messenger)
+				continue
+			}
+			err := msgr.Push(messenger.Message{
+				From:    msg.From,
+				To:      msg.To,
+				Subject: msg.Subject,
+				Body:    msg.Body,
+			})
+			m.recordMessengerStat(msg.Messenger, err)
 			if err != nil {
 				m.logger.Printf("error sending message '%s': %v", msg.Subject, err)
 			}
@@ -260,20 +834,104 @@ func (m *Manager) messageWorker() {
 	}
 }
 
+// PushCampaignMessage pushes a rendered message of a campaign that isn't run
+// by the manager, eg: a step of a sequence, through the pipeline of campaign
+// messages: the transforms of the campaign's messenger, the domain limits,
+// and the delivery and failure records. Unlike the messages of running
+// campaigns, it's pushed right away and doesn't count towards the progress
+// and the error thresholds of the campaign. Messages of campaigns that
+// don't exist (ID 0) aren't recorded.
+func (m *Manager) PushCampaignMessage(msg CampaignMessage) error {
+	name := msg.Campaign.MessengerID
+	if _, ok := m.getMessenger(name); !ok {
+		return fmt.Errorf("unknown messenger %s", name)
+	}
+
+	body, err := m.Transform(name, msg.body)
+	if err == nil {
+		done := m.waitDomain(msg.to)
+		err = m.push(name, &msg, body)
+		done()
+	}
+
+	if msg.Campaign.ID > 0 {
+		if err == nil {
+			m.recordDelivery(msg.Campaign.ID, msg.Subscriber.ID)
+		} else {
+			m.recordFailure(msg.Campaign.ID, msg.Subscriber.ID, err)
+		}
+		m.logMessage(&msg)
+	}
+	return err
+}
+
+// push pushes a campaign message with the given (transformed) body to a
+// messenger and records the result in the messenger's health and stats.
+func (m *Manager) push(name string, msg *CampaignMessage, body []byte) error {
+	msgr, _ := m.getMessenger(name)
+	sub := msg.Subscriber
+	err := msgr.Push(messenger.Message{
+		From:       msg.from,
+		To:         []string{msg.to},
+		Subject:    msg.subject,
+		Body:       body,
+		AMP:        msg.amp,
+		AltBody:    msg.altBody,
+		Headers:    msg.headers(),
+		Campaign:   msg.Campaign,
+		Subscriber: &sub,
+	})
+	m.recordHealth(name, err)
+	m.recordMessengerStat(name, err)
+	return err
+}
+
+// Transform applies the transforms of a messenger, if any, to a rendered
+// message body.
+func (m *Manager) Transform(messenger string, b []byte) ([]byte, error) {
+	t := m.cfg.Transforms[messenger]
+	if t == nil {
+		return b, nil
+	}
+	out, err := t(b)
+	if err != nil {
+		return nil, fmt.Errorf("error transforming message for %s: %v", messenger, err)
+	}
+	return out, nil
+}
+
 // TemplateFuncs returns the template functions to be applied into
 // compiled campaign templates.
 func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 	return template.FuncMap{
 		"TrackLink": func(url string, msg *CampaignMessage) string {
-			return m.trackLink(url, msg.Campaign.UUID, msg.Subscriber.UUID)
+			if m.cfg.DisableTracking {
+				return url
+			}
+			return m.trackLink(url, msg.Campaign, msg.Subscriber.UUID)
 		},
 		"TrackView": func(msg *CampaignMessage) template.HTML {
+			if m.cfg.DisableTracking {
+				return ""
+			}
 			return template.HTML(fmt.Sprintf(`<img src="%s" alt="" />`,
-				fmt.Sprintf(m.cfg.ViewTrackURL, msg.Campaign.UUID, msg.Subscriber.UUID)))
+				fmt.Sprintf(m.trackingURL(msg.Campaign, m.cfg.ViewTrackURL),
+					msg.Campaign.UUID, msg.Subscriber.UUID)))
+		},
+		"ConversionToken": func(msg *CampaignMessage) string {
+			return m.ConversionToken(msg.Campaign.UUID, msg.Subscriber.UUID)
+		},
+		"ConversionURL": func(msg *CampaignMessage) string {
+			return fmt.Sprintf(m.trackingURL(msg.Campaign, m.cfg.ConversionURL),
+				msg.Campaign.UUID, msg.Subscriber.UUID,
+				m.ConversionToken(msg.Campaign.UUID, msg.Subscriber.UUID))
 		},
 		"UnsubscribeURL": func(msg *CampaignMessage) string {
 			return msg.unsubURL
 		},
+		"PostalAddress": func() string {
+			return m.cfg.Footer.Address
+		},
 		"OptinURL": func(msg *CampaignMessage) string {
 			// Add list IDs.
 			// TODO: Show private lists list on optin e-mail
@@ -291,6 +949,72 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 	}
 }
 
+// CompileTemplate compiles a campaign's templates with the template
+// functions and the mandatory footers.
+func (m *Manager) CompileTemplate(c *models.Campaign) error {
+	c.Footers = m.cfg.Footer.Templates
+	return c.CompileTemplate(m.TemplateFuncs(c))
+}
+
+// ValidateFooter checks, in the strict mode, whether the messages of
+// a campaign and its language variants, with the mandatory footer,
+// have an unsubscribe link and the postal address.
+func (m *Manager) ValidateFooter(c *models.Campaign) error {
+	if !m.cfg.Footer.Strict {
+		return nil
+	}
+
+	bodies := map[string]string{"": c.Body}
+	for lang, v := range c.Variants {
+		bodies[lang] = v.Body
+	}
+
+	cp := *c
+	cp.Footers = m.cfg.Footer.Templates
+	check := func(name, lang, b string) error {
+		body := cp.TemplateBody + cp.WithFooter(lang, b)
+		if !models.HasUnsubscribeURL(body) {
+			return fmt.Errorf("%s doesn't have an unsubscribe link ({{ UnsubscribeURL }})", name)
+		}
+		if a := m.cfg.Footer.Address; a != "" &&
+			!regexpPostalAddress.MatchString(body) && !strings.Contains(body, a) {
+			return fmt.Errorf("%s doesn't have the postal address ({{ PostalAddress }})", name)
+		}
+		return nil
+	}
+
+	for lang, b := range bodies {
+		name := "the campaign"
+		if lang != "" {
+			name = fmt.Sprintf("the variant '%s'", lang)
+		}
+		if err := check(name, lang, b); err != nil {
+			return err
+		}
+	}
+	for i, v := range c.ABTest.Variants {
+		if v.Body == "" {
+			continue
+		}
+		if err := check(fmt.Sprintf("the A/B variant %d", i+1), "", v.Body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConversionToken returns the token that authenticates conversion reports
+// of a campaign and subscriber. It's the hex encoded HMAC-SHA256 of
+// "$campaignUUID.$subscriberUUID" signed with the conversion secret.
+func (m *Manager) ConversionToken(campUUID, subUUID string) string {
+	if m.cfg.ConversionSecret == "" {
+		return ""
+	}
+	h := hmac.New(sha256.New, []byte(m.cfg.ConversionSecret))
+	h.Write([]byte(campUUID + "." + subUUID))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 // scanCampaigns is a blocking function that periodically scans the data source
 // for campaigns to process and dispatches them to the manager.
 func (m *Manager) scanCampaigns(tick time.Duration) {
@@ -299,32 +1023,44 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 		select {
 		// Periodically scan the data source for campaigns to process.
 		case <-t.C:
-			campaigns, err := m.src.NextCampaigns(m.getPendingCampaignIDs())
+			limit, ok := m.runSlots()
+			if !ok {
+				continue
+			}
+
+			campaigns, err := m.src.NextCampaigns(append(m.getPendingCampaignIDs(), m.getDeferredCampaignIDs()...), limit)
 			if err != nil {
 				m.logger.Printf("error fetching campaigns: %v", err)
 				continue
 			}
 
 			for _, c := range campaigns {
-				if err := m.addCampaign(c); err != nil {
-					m.logger.Printf("error processing campaign (%s): %v", c.Name, err)
+				// Campaigns are picked up again when their lists' send windows open.
+				if m.deferCampaign(c) {
 					continue
 				}
-				m.logger.Printf("start processing campaign (%s)", c.Name)
+				m.resumeCampaign(c)
 
-				// If subscriber processing is busy, move on. Blocking and waiting
-				// can end up in a race condition where the waiting campaign's
-				// state in the data source has changed.
-				select {
-				case m.subFetchQueue <- c:
-				default:
+				if err := m.addCampaign(c); err != nil {
+					m.logger.Printf("error processing campaign (%s): %v", c.Name, err)
+					continue
 				}
+				m.logger.Printf("start processing campaign (%s) with priority %d", c.Name, c.Priority)
+				m.schedule(c)
 			}
 
+		// Outages of the messengers of campaigns.
+		case e := <-m.campOutageQueue:
+			m.handleOutage(e)
+
+		// Campaigns whose error rates crossed their thresholds.
+		case e := <-m.campAbortQueue:
+			m.abortCampaign(e)
+
 			// Aggregate errors from sending messages to check against the error threshold
 			// after which a campaign is paused.
 		case e := <-m.campMsgErrorQueue:
-			if m.cfg.MaxSendErrors < 1 {
+			if m.cfg.MaxSendErrors < 1 || m.errorMode(e.camp) != models.CampaignErrorModeCount {
 				continue
 			}
 
@@ -349,13 +1085,47 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 // addCampaign adds a campaign to the process queue.
 func (m *Manager) addCampaign(c *models.Campaign) error {
 	// Validate messenger.
-	if _, ok := m.messengers[c.MessengerID]; !ok {
+	if !m.HasMessenger(c.MessengerID) {
 		m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusCancelled)
+		m.endProgress(c.ID, models.CampaignStatusCancelled)
 		return fmt.Errorf("unknown messenger %s on campaign %s", c.MessengerID, c.Name)
 	}
 
+	// Validate the tracking domain.
+	if c.TrackingDomain != "" {
+		if _, ok := m.cfg.TrackingDomains[c.TrackingDomain]; !ok {
+			m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusCancelled)
+			m.endProgress(c.ID, models.CampaignStatusCancelled)
+			return fmt.Errorf("unknown tracking domain %s on campaign %s", c.TrackingDomain, c.Name)
+		}
+	}
+
+	// Validate the template's compatibility with the messenger.
+	if err := m.ValidateTemplateFormat(c.MessengerID, c.TemplateFormat); err != nil {
+		m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusCancelled)
+		m.endProgress(c.ID, models.CampaignStatusCancelled)
+		m.sendNotif(c, models.CampaignStatusCancelled, err.Error())
+		return err
+	}
+
+	// Unapproved campaigns are returned to be approved instead of being run.
+	if m.cfg.RequireApproval && !c.Approved && !c.Simulate {
+		m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusPendingApproval)
+		m.endProgress(c.ID, models.CampaignStatusPendingApproval)
+		m.sendNotif(c, models.CampaignStatusPendingApproval, "The campaign hasn't been approved")
+		return fmt.Errorf("campaign %s hasn't been approved", c.Name)
+	}
+
+	// Check the mandatory footer elements.
+	if err := m.ValidateFooter(c); err != nil {
+		m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusCancelled)
+		m.endProgress(c.ID, models.CampaignStatusCancelled)
+		m.sendNotif(c, models.CampaignStatusCancelled, err.Error())
+		return err
+	}
+
 	// Load the template.
-	if err := c.CompileTemplate(m.TemplateFuncs(c)); err != nil {
+	if err := m.CompileTemplate(c); err != nil {
 		return err
 	}
 
@@ -363,9 +1133,32 @@ func (m *Manager) addCampaign(c *models.Campaign) error {
 	m.campsMutex.Lock()
 	m.camps[c.ID] = c
 	m.campsMutex.Unlock()
+
+	m.startProgress(c.ID, c.ToSend, c.Sent)
+	m.startFallback(c)
 	return nil
 }
 
+// runSlots returns the number of campaigns that can be started under the cap
+// on running campaigns (0 if there's no cap) and whether any can be.
+func (m *Manager) runSlots() (int, bool) {
+	if m.cfg.MaxRunning < 1 {
+		return 0, true
+	}
+
+	m.campsMutex.RLock()
+	n := m.cfg.MaxRunning - len(m.camps)
+	m.campsMutex.RUnlock()
+	return n, n > 0
+}
+
+// GetActiveCampaignIDs returns the IDs of the campaigns that are being
+// processed or are deferred until their lists' send windows open, that is,
+// the ones that aren't waiting for a slot to run.
+func (m *Manager) GetActiveCampaignIDs() []int64 {
+	return append(m.getPendingCampaignIDs(), m.getDeferredCampaignIDs()...)
+}
+
 // getPendingCampaignIDs returns the IDs of campaigns currently being processed.
 func (m *Manager) getPendingCampaignIDs() []int64 {
 	// Needs to return an empty slice in case there are no campaigns.
@@ -394,18 +1187,37 @@ func (m *Manager) nextSubscribers(c *models.Campaign, batchSize int) (bool, erro
 		return false, nil
 	}
 
-	// Push messages.
+	// Push messages. The ones that can't be rendered are skipped and
+	// recorded on the campaign.
+	var (
+		b       = m.newBatch(c.ID)
+		nErrs   = 0
+		lastErr error
+	)
 	for _, s := range subs {
 		msg := m.NewCampaignMessage(c, s)
 		if err := msg.Render(); err != nil {
 			m.logger.Printf("error rendering message (%s) (%s): %v", c.Name, s.Email, err)
+			nErrs++
+			lastErr = err
 			continue
 		}
+		msg.batch = b
 
 		// Push the message to the queue while blocking and waiting until
 		// the queue is drained.
+		m.inFlight.Add(1)
+		m.recordEnqueued()
+		m.addBatchMessage(b)
 		m.campMsgQueue <- msg
 	}
+	m.finishBatchMessage(b)
+
+	if nErrs > 0 {
+		if err := m.src.RecordRenderErrors(c.ID, nErrs, lastErr.Error()); err != nil {
+			m.logger.Printf("error recording render errors of campaign (%s): %v", c.Name, err)
+		}
+	}
 
 	return true, nil
 }
@@ -422,6 +1234,10 @@ func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Ca
 	m.campsMutex.Lock()
 	delete(m.camps, c.ID)
 	m.campsMutex.Unlock()
+	m.unschedule(c.ID)
+	m.endAlerts(c.ID)
+	m.endErrorRate(c.ID)
+	m.endFallback(c.ID)
 
 	// A status has been passed. Change the campaign's status
 	// without further checks.
@@ -431,54 +1247,107 @@ func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Ca
 		} else {
 			m.logger.Printf("set campaign (%s) to %s", c.Name, status)
 		}
+		m.endProgress(c.ID, status)
 		return c, nil
 	}
 
 	// Fetch the up-to-date campaign status from the source.
 	cm, err := m.src.GetCampaign(c.ID)
 	if err != nil {
+		m.endProgress(c.ID, "")
 		return nil, err
 	}
 
-	// If a running campaign has exhausted subscribers, it's finished.
-	if cm.Status == models.CampaignStatusRunning {
+	// If a running campaign has exhausted subscribers, it's finished, unless
+	// it's a staged rollout that has only been sent to its initial share.
+	if cm.Status == models.CampaignStatusRunning && cm.RolloutStage == models.CampaignRolloutInitial && !cm.Simulate {
+		m.holdRollout(cm)
+	} else if cm.Status == models.CampaignStatusRunning {
 		cm.Status = models.CampaignStatusFinished
 		if err := m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusFinished); err != nil {
 			m.logger.Printf("error finishing campaign (%s): %v", c.Name, err)
 		} else {
 			m.logger.Printf("campaign (%s) finished", c.Name)
+			if m.cfg.FinishCB != nil {
+				m.cfg.FinishCB(cm)
+			}
 		}
 	} else {
 		m.logger.Printf("stop processing campaign (%s)", c.Name)
 	}
 
+	m.endProgress(c.ID, cm.Status)
 	return cm, nil
 }
 
 // trackLink register a URL and return its UUID to be used in message templates
 // for tracking links.
-func (m *Manager) trackLink(url, campUUID, subUUID string) string {
+func (m *Manager) trackLink(url string, c *models.Campaign, subUUID string) string {
+	linkURL := m.trackingURL(c, m.cfg.LinkTrackURL)
+
 	m.linksMutex.RLock()
-	if uu, ok := m.links[url]; ok {
-		m.linksMutex.RUnlock()
-		return fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID)
+	uu, ok := m.links[url]
+	m.linksMutex.RUnlock()
+
+	if !ok {
+		// Register link.
+		var err error
+		uu, err = m.src.CreateLink(url)
+		if err != nil {
+			m.logger.Printf("error registering tracking for link '%s': %v", url, err)
+
+			// If the registration fails, fail over to the original URL.
+			return url
+		}
+
+		m.linksMutex.Lock()
+		m.links[url] = uu
+		m.linksMutex.Unlock()
 	}
+
+	if c.ShortenLinks && c.ID > 0 {
+		return m.shortLink(uu, url, c, fmt.Sprintf(linkURL, uu, c.UUID, subUUID))
+	}
+	return fmt.Sprintf(linkURL, uu, c.UUID, subUUID)
+}
+
+// shortLink returns the short link of a registered link (UUID) of a campaign,
+// creating it if it doesn't exist. If the creation fails, it fails over to
+// the tracked link.
+func (m *Manager) shortLink(linkUUID, url string, c *models.Campaign, trackedURL string) string {
+	key := shortLinkKey{campID: c.ID, url: url}
+
+	m.linksMutex.RLock()
+	code, ok := m.shortLinks[key]
 	m.linksMutex.RUnlock()
+	if ok {
+		return fmt.Sprintf(m.trackingURL(c, m.cfg.ShortLinkURL), code)
+	}
 
-	// Register link.
-	uu, err := m.src.CreateLink(url)
+	code, err := m.src.CreateShortLink(c.ID, linkUUID)
 	if err != nil {
-		m.logger.Printf("error registering tracking for link '%s': %v", url, err)
-
-		// If the registration fails, fail over to the original URL.
-		return url
+		m.logger.Printf("error creating short link for '%s': %v", url, err)
+		return trackedURL
 	}
 
 	m.linksMutex.Lock()
-	m.links[url] = uu
+	m.shortLinks[key] = code
 	m.linksMutex.Unlock()
 
-	return fmt.Sprintf(m.cfg.LinkTrackURL, uu, campUUID, subUUID)
+	return fmt.Sprintf(m.trackingURL(c, m.cfg.ShortLinkURL), code)
+}
+
+// trackingURL returns the given tracking URL (format) with the root URL
+// swapped with the base URL of the campaign's tracking domain, if it has one.
+func (m *Manager) trackingURL(c *models.Campaign, u string) string {
+	if c.TrackingDomain == "" {
+		return u
+	}
+	base, ok := m.cfg.TrackingDomains[c.TrackingDomain]
+	if !ok {
+		return u
+	}
+	return base + strings.TrimPrefix(u, m.cfg.RootURL)
 }
 
 // sendNotif sends a notification to registered admin e-mails.
@@ -497,27 +1366,87 @@ func (m *Manager) sendNotif(c *models.Campaign, status, reason string) error {
 	return m.notifCB(subject, data)
 }
 
-// Render takes a Message, executes its pre-compiled Campaign.Tpl
-// and applies the resultant bytes to Message.body to be used in messages.
+// Render takes a Message, executes its pre-compiled Campaign.Tpl (or that
+// of its language variant) and applies the resultant bytes to Message.body
+// to be used in messages.
 func (m *CampaignMessage) Render() error {
+	if err := m.RenderFrom(); err != nil {
+		return err
+	}
+
 	out := bytes.Buffer{}
 
 	// Render the subject if it's a template.
-	if m.Campaign.SubjectTpl != nil {
-		if err := m.Campaign.SubjectTpl.ExecuteTemplate(&out, models.ContentTpl, m); err != nil {
+	if m.subjectTpl != nil {
+		if err := m.subjectTpl.ExecuteTemplate(&out, models.ContentTpl, m); err != nil {
 			return err
 		}
 		m.subject = out.String()
 		out.Reset()
 	}
 
-	if err := m.Campaign.Tpl.ExecuteTemplate(&out, models.BaseTpl, m); err != nil {
+	if err := m.tpl.ExecuteTemplate(&out, models.BaseTpl, m); err != nil {
 		return err
 	}
 	m.body = out.Bytes()
+
+	if m.ampTpl != nil {
+		amp := bytes.Buffer{}
+		if err := m.ampTpl.ExecuteTemplate(&amp, models.ContentTpl, m); err != nil {
+			return fmt.Errorf("error rendering AMP body: %v", err)
+		}
+		m.amp = amp.Bytes()
+	}
+
+	switch {
+	case m.altTpl != nil:
+		alt := bytes.Buffer{}
+		if err := m.altTpl.ExecuteTemplate(&alt, models.ContentTpl, m); err != nil {
+			return fmt.Errorf("error rendering plaintext body: %v", err)
+		}
+		m.altBody = alt.Bytes()
+
+	// Plain templates are already plaintext.
+	case m.autoAlt && m.Campaign.TemplateFormat != models.TemplateFormatPlain:
+		alt, err := plaintext.FromHTML(m.body)
+		if err != nil {
+			return fmt.Errorf("error generating plaintext body: %v", err)
+		}
+		m.altBody = alt
+	}
+	return nil
+}
+
+// RenderFrom renders the campaign's from-name, if any, into the message's
+// From header. See models.Campaign.ResolveFromName for the precedence.
+func (m *CampaignMessage) RenderFrom() error {
+	if m.Campaign.FromNameTpl == nil {
+		return nil
+	}
+
+	out := bytes.Buffer{}
+	if err := m.Campaign.FromNameTpl.ExecuteTemplate(&out, models.ContentTpl, m); err != nil {
+		return err
+	}
+	from, err := models.FromHeader(out.String(), m.Campaign.FromEmail)
+	if err != nil {
+		return err
+	}
+	m.from = from
 	return nil
 }
 
+// From returns the From header of the message.
+func (m *CampaignMessage) From() string {
+	return m.from
+}
+
+// Lang returns the language code of the campaign variant the message is
+// rendered from or an empty string if it's the default.
+func (m *CampaignMessage) Lang() string {
+	return m.lang
+}
+
 // Subject returns a copy of the message subject
 func (m *CampaignMessage) Subject() string {
 	return m.subject
@@ -529,3 +1458,32 @@ func (m *CampaignMessage) Body() []byte {
 	copy(out, m.body)
 	return out
 }
+
+// AMP returns a copy of the message's AMP body, if any.
+func (m *CampaignMessage) AMP() []byte {
+	out := make([]byte, len(m.amp))
+	copy(out, m.amp)
+	return out
+}
+
+// AltBody returns a copy of the message's plaintext body, if any.
+func (m *CampaignMessage) AltBody() []byte {
+	out := make([]byte, len(m.altBody))
+	copy(out, m.altBody)
+	return out
+}
+
+// headers returns the List-Unsubscribe headers of the message that let
+// mail clients unsubscribe with a single click (RFC 8058), and its tags.
+func (m *CampaignMessage) headers() textproto.MIMEHeader {
+	h := textproto.MIMEHeader{}
+	h.Set("List-Unsubscribe", "<"+m.unsubURL+">")
+	h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	if m.replyTo != "" {
+		h.Set("Reply-To", m.replyTo)
+	}
+	for k, v := range m.tags {
+		h[k] = v
+	}
+	return h
+}
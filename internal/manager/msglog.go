@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"math/rand"
+	"net/textproto"
+	"strings"
+)
+
+// msgLogQueueSize is the number of rendered messages that can be queued
+// before they're recorded. Messages beyond that aren't logged so that the
+// message workers are never blocked.
+const msgLogQueueSize = 1000
+
+// MessageLogConfig has the settings of the log of rendered campaign
+// messages that's used to debug personalization and rendering. As the
+// messages have personal data, it's disabled unless one of them is set.
+type MessageLogConfig struct {
+	// Sample is the fraction (0 to 1) of the recipients whose messages
+	// are logged and Emails are the (lowercased) e-mails of the recipients
+	// whose messages are always logged.
+	Sample float64
+	Emails map[string]bool
+}
+
+// RenderedMessage represents a campaign message as it was pushed to the
+// messenger, with the From, To, and Subject in its headers.
+type RenderedMessage struct {
+	CampaignID   int
+	SubscriberID int
+	Headers      textproto.MIMEHeader
+	Body         []byte
+}
+
+// logMessage queues a campaign message to be recorded if its recipient
+// is sampled or is one of the logged e-mails.
+func (m *Manager) logMessage(msg *CampaignMessage) {
+	c := m.cfg.MessageLog
+	if !c.Emails[strings.ToLower(msg.Subscriber.Email)] && (c.Sample <= 0 || rand.Float64() >= c.Sample) {
+		return
+	}
+
+	h := msg.headers()
+	h.Set("From", msg.from)
+	h.Set("To", msg.to)
+	h.Set("Subject", msg.subject)
+
+	select {
+	case m.msgLogQueue <- RenderedMessage{
+		CampaignID:   msg.Campaign.ID,
+		SubscriberID: msg.Subscriber.ID,
+		Headers:      h,
+		Body:         msg.body,
+	}:
+	default:
+		m.logger.Printf("message log queue is full. not logging message to subscriber %d in campaign %d",
+			msg.Subscriber.ID, msg.Campaign.ID)
+	}
+}
+
+// recordMessages is a blocking function that records the queued
+// rendered messages.
+func (m *Manager) recordMessages() {
+	for r := range m.msgLogQueue {
+		if err := m.src.RecordMessage(r); err != nil {
+			m.logger.Printf("error logging message to subscriber %d in campaign %d: %v",
+				r.SubscriberID, r.CampaignID, err)
+		}
+	}
+}
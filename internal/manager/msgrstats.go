@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// Messenger statuses.
+const (
+	MessengerOK      = "ok"
+	MessengerFailing = "failing"
+	MessengerDown    = "down"
+	MessengerOutage  = "outage"
+)
+
+// MessengerStatus represents the diagnostics of a messenger since the
+// manager was started.
+type MessengerStatus struct {
+	Name string `json:"name"`
+
+	// Status is failing if the last (non-permanent) push errored, down
+	// if the messenger has been marked unhealthy by the fallback chain, and
+	// outage if all its servers are unavailable (since OutageSince).
+	Status            string    `json:"status"`
+	ConsecutiveErrors int       `json:"consecutive_errors"`
+	DownUntil         null.Time `json:"down_until"`
+	OutageSince       null.Time `json:"outage_since"`
+
+	// Connections is the number of open connections of messengers that
+	// keep them (messenger.ConnCounter), or null.
+	Connections null.Int `json:"connections"`
+
+	// Connections that were replaced for exceeding their maximum age and
+	// for failing a keepalive check (messenger.ConnRecycler), or null.
+	RecycledConns null.Int `json:"recycled_conns"`
+	StaleConns    null.Int `json:"stale_conns"`
+
+	// TimedOut is the number of messages that were aborted for exceeding
+	// the send timeouts of messengers that have them
+	// (messenger.TimeoutCounter), or null. They're counted in Failed.
+	TimedOut null.Int `json:"timed_out"`
+
+	Sent        int64       `json:"sent"`
+	Failed      int64       `json:"failed"`
+	LastError   null.String `json:"last_error"`
+	LastErrorAt null.Time   `json:"last_error_at"`
+}
+
+// msgrStat holds the push results of a messenger.
+type msgrStat struct {
+	sent        int64
+	failed      int64
+	consecutive int
+	lastErr     string
+	lastErrAt   time.Time
+	outageSince time.Time
+}
+
+// msgrStats tracks the push results of messengers.
+type msgrStats struct {
+	msgrs map[string]*msgrStat
+	sync.Mutex
+}
+
+// recordMessengerStat records the result of a message push on a messenger.
+// Permanent errors, such as rejected recipients, count as failures but
+// not as consecutive errors.
+func (m *Manager) recordMessengerStat(name string, err error) {
+	m.msgrStats.Lock()
+	defer m.msgrStats.Unlock()
+
+	s, ok := m.msgrStats.msgrs[name]
+	if !ok {
+		s = &msgrStat{}
+		m.msgrStats.msgrs[name] = s
+	}
+
+	if err == nil {
+		s.sent++
+		s.consecutive = 0
+		s.outageSince = time.Time{}
+		return
+	}
+
+	// Any answer from a server ends an outage.
+	if !messenger.IsUnavailable(err) {
+		s.outageSince = time.Time{}
+	} else if s.outageSince.IsZero() {
+		s.outageSince = time.Now()
+	}
+
+	s.failed++
+	s.lastErr = err.Error()
+	s.lastErrAt = time.Now()
+	if !messenger.IsPermanent(err) {
+		s.consecutive++
+	}
+}
+
+// GetMessengerStatus returns the diagnostics of all the messengers
+// sorted by name.
+func (m *Manager) GetMessengerStatus() []MessengerStatus {
+	m.msgrMutex.RLock()
+	msgrs := make([]messenger.Messenger, 0, len(m.messengers))
+	for _, msgr := range m.messengers {
+		msgrs = append(msgrs, msgr)
+	}
+	m.msgrMutex.RUnlock()
+
+	out := make([]MessengerStatus, 0, len(msgrs))
+	for _, msgr := range msgrs {
+		s := MessengerStatus{Name: msgr.Name(), Status: MessengerOK}
+		if c, ok := msgr.(messenger.ConnCounter); ok {
+			s.Connections = null.IntFrom(c.Conns())
+		}
+		if c, ok := msgr.(messenger.ConnRecycler); ok {
+			r, st := c.Recycled()
+			s.RecycledConns = null.IntFrom(int(r))
+			s.StaleConns = null.IntFrom(int(st))
+		}
+		if c, ok := msgr.(messenger.TimeoutCounter); ok {
+			s.TimedOut = null.IntFrom(int(c.TimedOut()))
+		}
+
+		m.msgrStats.Lock()
+		if st, ok := m.msgrStats.msgrs[s.Name]; ok {
+			s.Sent = st.sent
+			s.Failed = st.failed
+			s.ConsecutiveErrors = st.consecutive
+			if st.lastErr != "" {
+				s.LastError = null.StringFrom(st.lastErr)
+				s.LastErrorAt = null.TimeFrom(st.lastErrAt)
+			}
+			if st.consecutive > 0 {
+				s.Status = MessengerFailing
+			}
+		}
+		m.msgrStats.Unlock()
+
+		m.fallbacks.Lock()
+		if h, ok := m.fallbacks.health[s.Name]; ok && time.Now().Before(h.downUntil) {
+			s.Status = MessengerDown
+			s.DownUntil = null.TimeFrom(h.downUntil)
+		}
+		m.fallbacks.Unlock()
+
+		m.msgrStats.Lock()
+		if st, ok := m.msgrStats.msgrs[s.Name]; ok && !st.outageSince.IsZero() {
+			s.Status = MessengerOutage
+			s.OutageSince = null.TimeFrom(st.outageSince)
+		}
+		m.msgrStats.Unlock()
+
+		out = append(out, s)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
@@ -0,0 +1,39 @@
+package manager
+
+import (
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+// outagePolicy returns the effective outage policy of a campaign.
+func (m *Manager) outagePolicy(c *models.Campaign) string {
+	if c.OutagePolicy != "" {
+		return c.OutagePolicy
+	}
+	return m.cfg.OutagePolicy
+}
+
+// isOutage checks whether a push error of a campaign message is an outage
+// of the messenger (all of its servers are unavailable) that's handled by
+// the campaign's outage policy instead of being counted as an error.
+func (m *Manager) isOutage(c *models.Campaign, err error) bool {
+	return messenger.IsUnavailable(err) && m.outagePolicy(c) != models.CampaignOutageContinue
+}
+
+// handleOutage pauses or cancels a campaign whose messenger is out, as per
+// its outage policy, and notifies the admins.
+func (m *Manager) handleOutage(e msgError) {
+	if !m.isCampaignProcessing(e.camp.ID) {
+		return
+	}
+
+	status := models.CampaignStatusPaused
+	if m.outagePolicy(e.camp) == models.CampaignOutageCancel {
+		status = models.CampaignStatusCancelled
+	}
+	m.logger.Printf("messenger outage on campaign %s: %v. setting it to %s", e.camp.Name, e.err, status)
+
+	m.exhaustCampaign(e.camp, status)
+	delete(m.campMsgErrorCounts, e.camp.ID)
+	m.sendNotif(e.camp, status, "Messenger outage: "+e.err.Error())
+}
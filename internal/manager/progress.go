@@ -0,0 +1,209 @@
+package manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// progressInterval is the interval at which the progress of running
+// campaigns is published to their subscribers.
+const progressInterval = time.Second
+
+// CampaignProgress is a snapshot of a campaign's progress.
+type CampaignProgress struct {
+	CampaignID int    `json:"id"`
+	Status     string `json:"status"`
+	ToSend     int    `json:"to_send"`
+	Sent       int    `json:"sent"`
+	Errors     int    `json:"errors"`
+
+	// Rate is the number of messages sent per second since the campaign
+	// started processing and ETA is the estimated number of seconds
+	// to finish.
+	Rate float64 `json:"rate"`
+	ETA  int     `json:"eta"`
+
+	// Priority is the effective priority of the campaign and Share, the
+	// fraction of the send capacity that's allocated to it among the
+	// running campaigns.
+	Priority int     `json:"priority"`
+	Share    float64 `json:"share"`
+
+	Done bool `json:"done"`
+}
+
+// campProgress holds the live counters of a campaign being processed.
+type campProgress struct {
+	toSend  int
+	sent    int
+	errors  int
+	started time.Time
+
+	// Number of messages sent since the campaign started processing,
+	// used for computing the rate.
+	numSent int
+}
+
+// progress tracks the live counters of campaigns that are being processed
+// and the subscribers to their progress. Snapshots are published to
+// subscribers at a fixed interval irrespective of the number of subscribers
+// or the send rate, and slow subscribers miss snapshots instead of blocking
+// the manager.
+type progress struct {
+	camps map[int]*campProgress
+	subs  map[int]map[chan CampaignProgress]struct{}
+	sync.Mutex
+}
+
+// SubscribeProgress returns a channel on which progress snapshots of a
+// campaign are published until it stops processing, at which point the
+// channel is closed. The returned function should be called to unsubscribe.
+func (m *Manager) SubscribeProgress(campID int) (<-chan CampaignProgress, func()) {
+	ch := make(chan CampaignProgress, 1)
+
+	m.progress.Lock()
+	if _, ok := m.progress.subs[campID]; !ok {
+		m.progress.subs[campID] = make(map[chan CampaignProgress]struct{})
+	}
+	m.progress.subs[campID][ch] = struct{}{}
+	m.progress.Unlock()
+
+	return ch, func() {
+		m.progress.Lock()
+		defer m.progress.Unlock()
+
+		// The channel may have already been removed and
+		// closed when the campaign stopped processing.
+		if _, ok := m.progress.subs[campID][ch]; !ok {
+			return
+		}
+		delete(m.progress.subs[campID], ch)
+		if len(m.progress.subs[campID]) == 0 {
+			delete(m.progress.subs, campID)
+		}
+		close(ch)
+	}
+}
+
+// GetProgress returns the progress of a campaign that's being processed.
+func (m *Manager) GetProgress(campID int) (CampaignProgress, bool) {
+	m.progress.Lock()
+	defer m.progress.Unlock()
+
+	p, ok := m.progress.camps[campID]
+	if !ok {
+		return CampaignProgress{}, false
+	}
+	return m.snapshot(campID, p), true
+}
+
+// startProgress starts tracking the progress of a campaign.
+func (m *Manager) startProgress(campID, toSend, sent int) {
+	m.progress.Lock()
+	m.progress.camps[campID] = &campProgress{
+		toSend:  toSend,
+		sent:    sent,
+		started: time.Now(),
+	}
+	m.progress.Unlock()
+}
+
+// recordProgress records the result of a message push in a campaign.
+func (m *Manager) recordProgress(campID int, err error) {
+	m.progress.Lock()
+	defer m.progress.Unlock()
+
+	p, ok := m.progress.camps[campID]
+	if !ok {
+		return
+	}
+	if err != nil {
+		p.errors++
+		return
+	}
+	p.sent++
+	p.numSent++
+}
+
+// endProgress stops tracking the progress of a campaign, publishes the
+// final snapshot with its status to the subscribers, and closes them.
+func (m *Manager) endProgress(campID int, status string) {
+	m.progress.Lock()
+	defer m.progress.Unlock()
+
+	var s CampaignProgress
+	if p, ok := m.progress.camps[campID]; ok {
+		s = m.snapshot(campID, p)
+	} else {
+		s = CampaignProgress{CampaignID: campID}
+	}
+	s.Status = status
+	s.Done = true
+	s.ETA = 0
+
+	for ch := range m.progress.subs[campID] {
+		// Drop the pending snapshot, if any, to make room for the final one.
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- s
+		close(ch)
+	}
+	delete(m.progress.subs, campID)
+	delete(m.progress.camps, campID)
+}
+
+// publishProgress is a blocking function that periodically publishes
+// progress snapshots of campaigns that have subscribers.
+func (m *Manager) publishProgress(interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for range t.C {
+		m.progress.Lock()
+		for id, subs := range m.progress.subs {
+			p, ok := m.progress.camps[id]
+			if !ok {
+				continue
+			}
+
+			s := m.snapshot(id, p)
+			for ch := range subs {
+				select {
+				case ch <- s:
+				default:
+				}
+			}
+		}
+		m.progress.Unlock()
+	}
+}
+
+// snapshot returns a snapshot of a campaign's progress and its allocation.
+func (m *Manager) snapshot(campID int, p *campProgress) CampaignProgress {
+	s := p.snapshot(campID)
+	s.Priority, s.Share, _ = m.GetAllocation(campID)
+	return s
+}
+
+// snapshot returns a snapshot of the campaign's progress.
+func (p *campProgress) snapshot(campID int) CampaignProgress {
+	out := CampaignProgress{
+		CampaignID: campID,
+		Status:     models.CampaignStatusRunning,
+		ToSend:     p.toSend,
+		Sent:       p.sent,
+		Errors:     p.errors,
+	}
+
+	if d := time.Since(p.started).Seconds(); d > 0 && p.numSent > 0 {
+		out.Rate = float64(p.numSent) / d
+		if rem := p.toSend - p.sent; rem > 0 {
+			out.ETA = int(float64(rem) / out.Rate)
+		}
+	}
+	return out
+}
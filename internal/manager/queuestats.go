@@ -0,0 +1,66 @@
+package manager
+
+import (
+	"sync/atomic"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// QueueStats represents the counters of the message queues and workers
+// since the manager was started, for load testing. Retried is the number
+// of the dispatched messages that are resends of failures. QueueLen and
+// QueueCap are the length and the capacity of the campaign message queue,
+// which is full when the workers are the bottleneck.
+type QueueStats struct {
+	Enqueued   int64 `json:"enqueued"`
+	Dispatched int64 `json:"dispatched"`
+	InFlight   int64 `json:"in_flight"`
+	Retried    int64 `json:"retried"`
+	Failed     int64 `json:"failed"`
+
+	QueueLen int `json:"queue_len"`
+	QueueCap int `json:"queue_cap"`
+	Workers  int `json:"workers"`
+}
+
+// queueStats holds the counters of campaign messages.
+type queueStats struct {
+	enqueued   int64
+	dispatched int64
+	inFlight   int64
+	retried    int64
+	failed     int64
+}
+
+// QueueStats returns the counters of the message queues and workers.
+func (m *Manager) QueueStats() QueueStats {
+	return QueueStats{
+		Enqueued:   atomic.LoadInt64(&m.queueStats.enqueued),
+		Dispatched: atomic.LoadInt64(&m.queueStats.dispatched),
+		InFlight:   atomic.LoadInt64(&m.queueStats.inFlight),
+		Retried:    atomic.LoadInt64(&m.queueStats.retried),
+		Failed:     atomic.LoadInt64(&m.queueStats.failed),
+		QueueLen:   len(m.campMsgQueue),
+		QueueCap:   cap(m.campMsgQueue),
+		Workers:    m.cfg.Concurrency,
+	}
+}
+
+// recordEnqueued records a campaign message that's been queued.
+func (m *Manager) recordEnqueued() {
+	atomic.AddInt64(&m.queueStats.enqueued, 1)
+	atomic.AddInt64(&m.queueStats.inFlight, 1)
+}
+
+// recordDispatched records a campaign message that's been pushed to a
+// messenger, or dropped (simulations), and is no longer in flight.
+func (m *Manager) recordDispatched(c *models.Campaign, err error) {
+	atomic.AddInt64(&m.queueStats.dispatched, 1)
+	atomic.AddInt64(&m.queueStats.inFlight, -1)
+	if c.ParentAudience == models.CampaignAudienceFailed {
+		atomic.AddInt64(&m.queueStats.retried, 1)
+	}
+	if err != nil {
+		atomic.AddInt64(&m.queueStats.failed, 1)
+	}
+}
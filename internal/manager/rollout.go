@@ -0,0 +1,56 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// holdRollout pauses a staged rollout that has been sent to its initial
+// share of subscribers until it's released to the rest.
+func (m *Manager) holdRollout(c *models.Campaign) {
+	if err := m.src.HoldCampaignRollout(c.ID); err != nil {
+		m.logger.Printf("error holding campaign (%s) rollout: %v", c.Name, err)
+		return
+	}
+
+	c.Status = models.CampaignStatusPaused
+	c.RolloutStage = models.CampaignRolloutHolding
+	m.logger.Printf("campaign (%s) sent to the initial %d%% of its subscribers. Holding the rollout",
+		c.Name, c.RolloutPercent)
+}
+
+// trickleBatch returns the size of the next batch of subscribers of a
+// campaign and, if it's the initial share of a trickled staged rollout, how
+// long it's parked after the batch to keep to its rate of RolloutRate
+// messages per hour. Trickles are sent in batches of up to a minute's worth
+// of messages.
+func (m *Manager) trickleBatch(c *models.Campaign) (int, time.Duration) {
+	if c.RolloutRate < 1 || c.RolloutStage != models.CampaignRolloutInitial || c.Simulate {
+		return m.cfg.BatchSize, 0
+	}
+
+	n := c.RolloutRate / 60
+	if n < 1 {
+		n = 1
+	}
+	if n > m.cfg.BatchSize {
+		n = m.cfg.BatchSize
+	}
+	return n, time.Hour * time.Duration(n) / time.Duration(c.RolloutRate)
+}
+
+// rolloutNotifReason returns the reason in the notification of a campaign
+// that's stopped processing if it's a held rollout.
+func rolloutNotifReason(c *models.Campaign) string {
+	if c.Status != models.CampaignStatusPaused || c.RolloutStage != models.CampaignRolloutHolding {
+		return ""
+	}
+
+	r := fmt.Sprintf("Sent to the initial %d%% of the subscribers. ", c.RolloutPercent)
+	if c.RolloutGate.Enabled() {
+		return r + "The rollout is released to the rest if the initial metrics pass its gate, or when it's resumed."
+	}
+	return r + "Resume the campaign to release the rollout to the rest."
+}
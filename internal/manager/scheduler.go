@@ -0,0 +1,110 @@
+package manager
+
+import (
+	"sync"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// scheduler allocates the batches of subscribers that the manager processes
+// one at a time to the running campaigns in proportion to the weights of
+// their priorities (stride scheduling). Every campaign advances its pass by
+// the inverse of its weight on each batch and the campaign with the lowest
+// pass gets the next batch, so higher priority campaigns get more of the
+// send capacity while lower priority ones still progress.
+type scheduler struct {
+	camps map[int]*schedCamp
+
+	// pass is the pass of the last scheduled batch. Campaigns join at it
+	// so that they don't get a burst of batches to catch up.
+	pass float64
+
+	// wake is signalled when a campaign is added.
+	wake chan bool
+	sync.Mutex
+}
+
+// schedCamp represents a campaign in the scheduler.
+type schedCamp struct {
+	camp     *models.Campaign
+	priority int
+	weight   float64
+	pass     float64
+}
+
+// priorityWeight returns the weight of a priority. Each level doubles the
+// weight. Priorities out of range are clamped.
+func priorityWeight(p int) (int, float64) {
+	switch {
+	case p == 0:
+		p = models.CampaignPriorityDefault
+	case p < models.CampaignPriorityMin:
+		p = models.CampaignPriorityMin
+	case p > models.CampaignPriorityMax:
+		p = models.CampaignPriorityMax
+	}
+	return p, float64(int(1) << uint(p-models.CampaignPriorityMin))
+}
+
+// schedule adds a campaign to the scheduler.
+func (m *Manager) schedule(c *models.Campaign) {
+	p, w := priorityWeight(c.Priority)
+
+	m.sched.Lock()
+	m.sched.camps[c.ID] = &schedCamp{camp: c, priority: p, weight: w, pass: m.sched.pass}
+	m.sched.Unlock()
+
+	select {
+	case m.sched.wake <- true:
+	default:
+	}
+}
+
+// unschedule removes a campaign from the scheduler.
+func (m *Manager) unschedule(campID int) {
+	m.sched.Lock()
+	delete(m.sched.camps, campID)
+	m.sched.Unlock()
+}
+
+// nextScheduled returns the campaign that gets the next batch, or false if
+// there are no campaigns. Ties go to the higher priority and then to
+// the older campaign.
+func (m *Manager) nextScheduled() (*models.Campaign, bool) {
+	m.sched.Lock()
+	defer m.sched.Unlock()
+
+	var next *schedCamp
+	for _, sc := range m.sched.camps {
+		if next == nil || sc.pass < next.pass ||
+			(sc.pass == next.pass && (sc.priority > next.priority ||
+				(sc.priority == next.priority && sc.camp.ID < next.camp.ID))) {
+			next = sc
+		}
+	}
+	if next == nil {
+		return nil, false
+	}
+
+	m.sched.pass = next.pass
+	next.pass += 1 / next.weight
+	return next.camp, true
+}
+
+// GetAllocation returns the effective priority of a running campaign and
+// the fraction of the send capacity that's allocated to it.
+func (m *Manager) GetAllocation(campID int) (int, float64, bool) {
+	m.sched.Lock()
+	defer m.sched.Unlock()
+
+	sc, ok := m.sched.camps[campID]
+	if !ok {
+		return 0, 0, false
+	}
+
+	var total float64
+	for _, c := range m.sched.camps {
+		total += c.weight
+	}
+	return sc.priority, sc.weight / total, true
+}
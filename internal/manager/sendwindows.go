@@ -0,0 +1,78 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// windowRecheck is the maximum time for which a campaign outside the send
+// windows of its lists is deferred before it's fetched and checked again,
+// eg: in case the windows have changed.
+const windowRecheck = time.Minute * 15
+
+// deferCampaign checks whether the send windows of a campaign's lists are
+// open and if they're not, defers the campaign until they open.
+func (m *Manager) deferCampaign(c *models.Campaign) bool {
+	now := time.Now()
+	if c.ListSendWindows.Contains(now) {
+		return false
+	}
+
+	until := now.Add(windowRecheck)
+	next, ok := c.ListSendWindows.NextOpen(now)
+	if !ok {
+		m.logger.Printf("send windows of the lists of campaign (%s) don't overlap", c.Name)
+	} else if next.Before(until) {
+		until = next
+	}
+
+	m.deferredMutex.Lock()
+	_, was := m.deferred[c.ID]
+	m.deferred[c.ID] = until
+	m.deferredMutex.Unlock()
+
+	if !was && ok {
+		m.logger.Printf("deferring campaign (%s) until its lists' send windows open at %s",
+			c.Name, next.Format(time.RFC3339))
+	}
+	return true
+}
+
+// parkCampaign stops processing a running campaign whose lists' send
+// windows have closed without changing its status. It's picked up from
+// where it left off when they open again.
+func (m *Manager) parkCampaign(c *models.Campaign) {
+	m.releaseCampaign(c)
+	m.deferCampaign(c)
+}
+
+// releaseCampaign stops processing a campaign without changing its status.
+func (m *Manager) releaseCampaign(c *models.Campaign) {
+	m.campsMutex.Lock()
+	delete(m.camps, c.ID)
+	m.campsMutex.Unlock()
+	m.unschedule(c.ID)
+	m.endAlerts(c.ID)
+	m.endFallback(c.ID)
+	m.endProgress(c.ID, models.CampaignStatusRunning)
+}
+
+// getDeferredCampaignIDs returns the IDs of the campaigns that are deferred
+// and forgets the ones whose deferral has expired.
+func (m *Manager) getDeferredCampaignIDs() []int64 {
+	now := time.Now()
+
+	m.deferredMutex.Lock()
+	defer m.deferredMutex.Unlock()
+
+	ids := make([]int64, 0, len(m.deferred))
+	for id, until := range m.deferred {
+		if !now.Before(until) {
+			delete(m.deferred, id)
+			continue
+		}
+		ids = append(ids, int64(id))
+	}
+	return ids
+}
@@ -1,7 +1,11 @@
 package media
 
 import (
+	"fmt"
 	"io"
+	"sort"
+	"strings"
+	"sync"
 
 	"gopkg.in/volatiletech/null.v6"
 )
@@ -20,7 +24,81 @@ type Media struct {
 
 // Store represents functions to store and retrieve media (files).
 type Store interface {
-	Put(string, string, io.ReadSeeker) (string, error)
-	Delete(string) error
-	Get(string) string
+	// Upload stores a file with the given name and content type and
+	// returns the name it's stored with.
+	Upload(name string, cType string, src io.ReadSeeker) (string, error)
+
+	// Delete deletes a stored file.
+	Delete(name string) error
+
+	// Get returns a reader for the contents of a stored file.
+	Get(name string) (io.ReadCloser, error)
+
+	// URL returns the public URL of a stored file.
+	URL(name string) string
+}
+
+// StaticStore is implemented by stores whose files are served by the app's
+// HTTP server from a local directory.
+type StaticStore interface {
+	// StaticDir returns the URI the files are served on and the directory
+	// they're served from.
+	StaticDir() (uri string, dir string)
+}
+
+// Opt represents the options that are passed to providers
+// to initialize stores.
+type Opt struct {
+	// RootURL is the root URL of the app.
+	RootURL string
+
+	// Unmarshal unmarshals the provider's config into the given struct.
+	Unmarshal func(o interface{}) error
+}
+
+// Provider initializes a Store.
+type Provider func(o Opt) (Store, error)
+
+var (
+	providers   = make(map[string]Provider)
+	providersMu sync.RWMutex
+)
+
+// Register registers a store provider with a name. It's meant to be called
+// from the init() of provider packages. It panics if a provider with the
+// name is already registered.
+func Register(name string, p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+
+	if _, ok := providers[name]; ok {
+		panic(fmt.Sprintf("media provider '%s' is already registered", name))
+	}
+	providers[name] = p
+}
+
+// Providers returns the sorted names of the registered providers.
+func Providers() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+
+	out := make([]string, 0, len(providers))
+	for name := range providers {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// New initializes a Store with the registered provider of the given name.
+func New(name string, o Opt) (Store, error) {
+	providersMu.RLock()
+	p, ok := providers[name]
+	providersMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown media provider '%s'. Should be one of %s",
+			name, strings.Join(Providers(), ", "))
+	}
+	return p(o)
 }
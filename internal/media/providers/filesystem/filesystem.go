@@ -15,6 +15,19 @@ import (
 
 const tmpFilePrefix = "listmonk"
 
+func init() {
+	media.Register("filesystem", func(o media.Opt) (media.Store, error) {
+		var opts Opts
+		if err := o.Unmarshal(&opts); err != nil {
+			return nil, err
+		}
+		opts.RootURL = o.RootURL
+		opts.UploadPath = filepath.Clean(opts.UploadPath)
+		opts.UploadURI = filepath.Clean(opts.UploadURI)
+		return NewDiskStore(opts)
+	})
+}
+
 // Opts represents filesystem params
 type Opts struct {
 	UploadPath string `koanf:"upload_path"`
@@ -40,8 +53,8 @@ func NewDiskStore(opts Opts) (media.Store, error) {
 	}, nil
 }
 
-// Put accepts the filename, the content type and file object itself and stores the file in disk.
-func (c *Client) Put(filename string, cType string, src io.ReadSeeker) (string, error) {
+// Upload accepts the filename, the content type and file object itself and stores the file in disk.
+func (c *Client) Upload(filename string, cType string, src io.ReadSeeker) (string, error) {
 	var out *os.File
 	// There's no explicit name. Use the one posted in the HTTP request.
 	if filename == "" {
@@ -66,11 +79,22 @@ func (c *Client) Put(filename string, cType string, src io.ReadSeeker) (string,
 	return filename, nil
 }
 
-// Get accepts a filename and retrieves the full path from disk.
-func (c *Client) Get(name string) string {
+// Get accepts a filename and opens the file on disk.
+func (c *Client) Get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(getDir(c.opts.UploadPath), filepath.Base(name)))
+}
+
+// URL accepts a filename and returns its public URL.
+func (c *Client) URL(name string) string {
 	return fmt.Sprintf("%s%s/%s", c.opts.RootURL, c.opts.UploadURI, name)
 }
 
+// StaticDir returns the URI that uploads are served on and the
+// directory they're served from.
+func (c *Client) StaticDir() (string, string) {
+	return c.opts.UploadURI, c.opts.UploadPath
+}
+
 // Delete accepts a filename and removes it from disk.
 func (c *Client) Delete(file string) error {
 	dir := getDir(c.opts.UploadPath)
@@ -13,6 +13,16 @@ import (
 
 const amznS3PublicURL = "https://%s.s3.%s.amazonaws.com%s"
 
+func init() {
+	media.Register("s3", func(o media.Opt) (media.Store, error) {
+		var opts Opts
+		if err := o.Unmarshal(&opts); err != nil {
+			return nil, err
+		}
+		return NewS3Store(opts)
+	})
+}
+
 // Opts represents AWS S3 specific params
 type Opts struct {
 	AccessKey  string `koanf:"aws_access_key_id"`
@@ -55,8 +65,8 @@ func NewS3Store(opts Opts) (media.Store, error) {
 	}, nil
 }
 
-// Put takes in the filename, the content type and file object itself and uploads to S3.
-func (c *Client) Put(name string, cType string, file io.ReadSeeker) (string, error) {
+// Upload takes in the filename, the content type and file object itself and uploads to S3.
+func (c *Client) Upload(name string, cType string, file io.ReadSeeker) (string, error) {
 	// Upload input parameters
 	upParams := simples3.UploadInput{
 		Bucket:      c.opts.Bucket,
@@ -74,8 +84,16 @@ func (c *Client) Put(name string, cType string, file io.ReadSeeker) (string, err
 	return name, nil
 }
 
-// Get accepts the filename of the object stored and retrieves from S3.
-func (c *Client) Get(name string) string {
+// Get accepts the filename of the object stored and downloads it from S3.
+func (c *Client) Get(name string) (io.ReadCloser, error) {
+	return c.s3.FileDownload(simples3.DownloadInput{
+		Bucket:    c.opts.Bucket,
+		ObjectKey: strings.TrimPrefix(makeBucketPath(c.opts.BucketPath, name), "/"),
+	})
+}
+
+// URL accepts the filename of the object stored and returns its S3 URL.
+func (c *Client) URL(name string) string {
 	// Generate a private S3 pre-signed URL if it's a private bucket.
 	if c.opts.BucketType == "private" {
 		url := c.s3.GeneratePresignedURL(simples3.PresignedInput{
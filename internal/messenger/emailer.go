@@ -2,17 +2,54 @@ package messenger
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"log"
 	"math/rand"
+	"net/mail"
 	"net/smtp"
 	"net/textproto"
+	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/jaytaylor/html2text"
-	"github.com/knadh/smtppool"
+	"github.com/knadh/listmonk/internal/smtppool"
 )
 
 const emName = "email"
 
+// TLS types of SMTP servers.
+const (
+	TLSTypeNone     = "none"
+	TLSTypeSTARTTLS = "starttls"
+	TLSTypeTLS      = "tls"
+)
+
+const (
+	// serverDownErrors is the number of consecutive (non-permanent) send
+	// errors after which an SMTP server is considered unhealthy and isn't
+	// sent to for serverRetryAfter.
+	serverDownErrors = 5
+	serverRetryAfter = time.Second * 30
+)
+
+// Conventional SMTP submission ports of the TLS types.
+const (
+	portSMTPS      = 465
+	portSubmission = 587
+)
+
+// tlsVersions maps TLS version config strings to their tls package values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 // Server represents an SMTP server's credentials.
 type Server struct {
 	Name          string
@@ -20,15 +57,42 @@ type Server struct {
 	Password      string            `json:"password"`
 	AuthProtocol  string            `json:"auth_protocol"`
 	EmailFormat   string            `json:"email_format"`
+	TLSType       string            `json:"tls_type"`
 	TLSEnabled    bool              `json:"tls_enabled"`
 	TLSSkipVerify bool              `json:"tls_skip_verify"`
+	TLSMinVersion string            `json:"tls_min_version"`
+	TLSRequired   bool              `json:"tls_required"`
+	TLSStrict     bool              `json:"tls_strict"`
 	EmailHeaders  map[string]string `json:"email_headers"`
 
+	// EnvelopeFrom is the optional SMTP envelope sender (MAIL FROM) that's
+	// used instead of the header From. VERP, if set, overrides it on
+	// campaign messages.
+	EnvelopeFrom string `json:"envelope_from"`
+	VERP         *VERP  `json:"-"`
+
+	// Trace logs the SMTP conversations of the first few connections to
+	// the server for debugging.
+	Trace bool `json:"trace"`
+
+	// Charset and Encoding are the default charset and content transfer
+	// encoding of messages, which campaigns can override.
+	Charset  string `json:"-"`
+	Encoding string `json:"-"`
+
 	// Rest of the options are embedded directly from the smtppool lib.
 	// The JSON tag is for config unmarshal to work.
 	smtppool.Opt `json:",squash"`
 
-	pool *smtppool.Pool
+	pool   *smtppool.Pool
+	health *serverHealth
+}
+
+// serverHealth is the health of an SMTP server derived from its send results.
+type serverHealth struct {
+	errors    int
+	downUntil time.Time
+	sync.Mutex
 }
 
 // Emailer is the SMTP e-mail messenger.
@@ -61,22 +125,44 @@ func NewEmailer(servers ...Server) (*Emailer, error) {
 		}
 		s.Opt.Auth = auth
 
-		// TLS config.
-		if s.TLSEnabled {
-			s.TLSConfig = &tls.Config{}
-			if s.TLSSkipVerify {
-				s.TLSConfig.InsecureSkipVerify = s.TLSSkipVerify
-			} else {
-				s.TLSConfig.ServerName = s.Host
+		if s.EnvelopeFrom != "" {
+			if _, err := mail.ParseAddress(s.EnvelopeFrom); err != nil {
+				return nil, fmt.Errorf("SMTP %s: invalid envelope_from: %v", s.Name, err)
 			}
 		}
 
+		// TLS config.
+		tlsType, err := resolveTLSType(s)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP %s: %v", s.Name, err)
+		}
+		s.TLSType = tlsType
+
+		tlsCfg, err := makeTLSConfig(s)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP %s: %v", s.Name, err)
+		}
+		s.TLSConfig = tlsCfg
+		s.SSL = s.TLSType == TLSTypeTLS
+		s.RequireTLS = s.TLSRequired
+
+		cs, enc, err := smtppool.NormalizeEncoding(s.Charset, s.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("SMTP %s: %v", s.Name, err)
+		}
+		s.Charset, s.Encoding = cs, enc
+
+		if s.Trace {
+			s.Opt.Trace = log.New(os.Stdout, "smtp trace "+s.Name+": ", log.Ldate|log.Ltime)
+		}
+
 		pool, err := smtppool.New(s.Opt)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("SMTP %s: %v", s.Name, err)
 		}
 
 		s.pool = pool
+		s.health = &serverHealth{}
 		e.servers[s.Name] = &s
 		e.serverNames = append(e.serverNames, s.Name)
 	}
@@ -90,23 +176,19 @@ func (e *Emailer) Name() string {
 	return emName
 }
 
-// Push pushes a message to the server.
-func (e *Emailer) Push(fromAddr string, toAddr []string, subject string, m []byte, atts []Attachment) error {
-	var key string
-
-	// If there are more than one SMTP servers, send to a random
-	// one from the list.
-	if e.numServers > 1 {
-		key = e.serverNames[rand.Intn(e.numServers)]
-	} else {
-		key = e.serverNames[0]
+// Push pushes a message to a random healthy server. If none of the servers
+// are healthy, it returns ErrUnavailable without trying them.
+func (e *Emailer) Push(msg Message) error {
+	srv := e.pickServer()
+	if srv == nil {
+		return fmt.Errorf("%w: all %d SMTP servers have failed repeatedly", ErrUnavailable, e.numServers)
 	}
 
 	// Are there attachments?
 	var files []smtppool.Attachment
-	if atts != nil {
-		files = make([]smtppool.Attachment, 0, len(atts))
-		for _, f := range atts {
+	if msg.Attachments != nil {
+		files = make([]smtppool.Attachment, 0, len(msg.Attachments))
+		for _, f := range msg.Attachments {
 			a := smtppool.Attachment{
 				Filename: f.Name,
 				Header:   f.Header,
@@ -117,41 +199,267 @@ func (e *Emailer) Push(fromAddr string, toAddr []string, subject string, m []byt
 		}
 	}
 
-	mtext, err := html2text.FromString(string(m), html2text.Options{PrettyTables: true})
-	if err != nil {
-		return err
+	// Campaign messages carry their own plaintext bodies, if any.
+	m := msg.Body
+	mtext := msg.AltBody
+	if len(mtext) == 0 && (msg.Campaign == nil || srv.EmailFormat == "plain") {
+		t, err := html2text.FromString(string(m), html2text.Options{PrettyTables: true})
+		if err != nil {
+			return err
+		}
+		mtext = []byte(t)
 	}
 
-	srv := e.servers[key]
 	em := smtppool.Email{
-		From:        fromAddr,
-		To:          toAddr,
-		Subject:     subject,
+		From:        msg.From,
+		To:          msg.To,
+		Subject:     msg.Subject,
+		Sender:      srv.envelopeFrom(msg),
 		Attachments: files,
+		Charset:     srv.Charset,
+		Encoding:    srv.Encoding,
+	}
+	if msg.Campaign != nil {
+		if msg.Campaign.Charset != "" {
+			em.Charset = msg.Campaign.Charset
+		}
+		if msg.Campaign.TransferEncoding != "" {
+			em.Encoding = msg.Campaign.TransferEncoding
+		}
 	}
 
-	// If there are custom e-mail headers, attach them.
-	if len(srv.EmailHeaders) > 0 {
+	// If there are custom e-mail headers, attach them. The message's
+	// own headers take precedence.
+	if len(srv.EmailHeaders) > 0 || len(msg.Headers) > 0 {
 		em.Headers = textproto.MIMEHeader{}
 		for k, v := range srv.EmailHeaders {
 			em.Headers.Set(k, v)
 		}
+		for k, v := range msg.Headers {
+			em.Headers[k] = v
+		}
 	}
 
 	switch srv.EmailFormat {
 	case "html":
 		em.HTML = m
+		em.AMP = msg.AMP
 	case "plain":
-		em.Text = []byte(mtext)
+		em.Text = mtext
 	default:
 		em.HTML = m
-		em.Text = []byte(mtext)
+		em.AMP = msg.AMP
+		em.Text = mtext
+	}
+
+	err := srv.pool.Send(em)
+	srv.recordHealth(err)
+	if err != nil {
+		if srv.TLSType != TLSTypeNone && isTLSError(err) {
+			return fmt.Errorf("TLS negotiation with SMTP %s (%s) failed: %v", srv.Name, srv.Host, err)
+		}
+		return err
 	}
+	return nil
+}
 
-	return srv.pool.Send(em)
+// pickServer returns a random healthy server, or nil if there are none.
+// Servers that are due to be retried are healthy.
+func (e *Emailer) pickServer() *Server {
+	if e.numServers == 1 {
+		s := e.servers[e.serverNames[0]]
+		if !s.isHealthy() {
+			return nil
+		}
+		return s
+	}
+
+	// Start at a random server and take the first healthy one.
+	n := rand.Intn(e.numServers)
+	for i := 0; i < e.numServers; i++ {
+		s := e.servers[e.serverNames[(n+i)%e.numServers]]
+		if s.isHealthy() {
+			return s
+		}
+	}
+	return nil
 }
 
 // Flush flushes the message queue to the server.
 func (e *Emailer) Flush() error {
 	return nil
 }
+
+// Conns returns the number of open connections to the SMTP servers.
+func (e *Emailer) Conns() int {
+	n := 0
+	for _, s := range e.servers {
+		n += s.pool.Conns()
+	}
+	return n
+}
+
+// Recycled returns the number of connections of the SMTP servers that were
+// replaced for exceeding their maximum age and for failing a keepalive check.
+func (e *Emailer) Recycled() (int64, int64) {
+	var recycled, stale int64
+	for _, s := range e.servers {
+		r, st := s.pool.Recycled()
+		recycled += r
+		stale += st
+	}
+	return recycled, stale
+}
+
+// TimedOut returns the number of messages to the SMTP servers that were
+// aborted for exceeding their send timeouts.
+func (e *Emailer) TimedOut() int64 {
+	var n int64
+	for _, s := range e.servers {
+		n += s.pool.TimedOut()
+	}
+	return n
+}
+
+// Close closes the connection pools of the SMTP servers.
+func (e *Emailer) Close() error {
+	for _, s := range e.servers {
+		s.pool.Close()
+	}
+	return nil
+}
+
+// isHealthy checks whether the server isn't marked unhealthy.
+func (s *Server) isHealthy() bool {
+	s.health.Lock()
+	defer s.health.Unlock()
+	return !time.Now().Before(s.health.downUntil)
+}
+
+// recordHealth records the result of a send. Permanent errors, such as
+// rejected recipients, don't count against the server's health.
+func (s *Server) recordHealth(err error) {
+	if err != nil && IsPermanent(err) {
+		return
+	}
+
+	h := s.health
+	h.Lock()
+	defer h.Unlock()
+
+	if err == nil {
+		h.errors = 0
+		return
+	}
+	h.errors++
+	if h.errors >= serverDownErrors {
+		// On retrying, a single error marks it unhealthy again.
+		h.errors = serverDownErrors - 1
+		h.downUntil = time.Now().Add(serverRetryAfter)
+	}
+}
+
+// resolveTLSType validates the TLS type of a server against its port and
+// returns it. If the type isn't set, it's derived from the older tls_enabled
+// option and the port: implicit TLS on 465 and STARTTLS everywhere else.
+func resolveTLSType(s Server) (string, error) {
+	switch s.TLSType {
+	case "":
+		if !s.TLSEnabled {
+			return TLSTypeNone, nil
+		}
+		if s.Port == portSMTPS {
+			return TLSTypeTLS, nil
+		}
+		return TLSTypeSTARTTLS, nil
+	case TLSTypeNone, TLSTypeSTARTTLS, TLSTypeTLS:
+	default:
+		return "", fmt.Errorf("unknown tls_type '%s'. Should be one of none, starttls, tls", s.TLSType)
+	}
+
+	if s.TLSType == TLSTypeSTARTTLS && s.Port == portSMTPS {
+		return "", fmt.Errorf("tls_type is starttls but port %d is for implicit TLS. Use tls_type = \"tls\"", s.Port)
+	}
+	if s.TLSType == TLSTypeTLS && (s.Port == portSubmission || s.Port == 25) {
+		return "", fmt.Errorf("tls_type is tls but port %d is for STARTTLS. Use tls_type = \"starttls\"", s.Port)
+	}
+	return s.TLSType, nil
+}
+
+// envelopeFrom returns the envelope sender of a message on the server. The
+// bounce address of a campaign's lists, if there's one, overrides the
+// server's and VERP is rebased on it. An empty string uses the header From.
+func (s *Server) envelopeFrom(m Message) string {
+	var bounce string
+	if m.Campaign != nil {
+		bounce = m.Campaign.ListBounceAddress
+	}
+
+	if s.VERP != nil && m.Campaign != nil && m.Subscriber != nil {
+		if bounce != "" {
+			return s.VERP.EncodeAt(bounce, m.Campaign.UUID, m.Subscriber.UUID, m.Subscriber.Email)
+		}
+		return s.VERP.Encode(m.Campaign.UUID, m.Subscriber.UUID, m.Subscriber.Email)
+	}
+	if bounce != "" {
+		return bounce
+	}
+	return s.EnvelopeFrom
+}
+
+// makeTLSConfig validates the TLS options of a server and returns the
+// tls.Config to use for STARTTLS or implicit TLS. It returns nil if TLS
+// is disabled, which tls_required doesn't allow.
+func makeTLSConfig(s Server) (*tls.Config, error) {
+	if s.TLSType == TLSTypeNone {
+		if s.TLSRequired {
+			return nil, errors.New("tls_required is set but tls_type is none")
+		}
+		return nil, nil
+	}
+	if s.TLSStrict && s.TLSSkipVerify {
+		return nil, errors.New("tls_strict and tls_skip_verify cannot be enabled together")
+	}
+
+	cfg := &tls.Config{}
+	if s.TLSMinVersion != "" {
+		v, ok := tlsVersions[s.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("unknown tls_min_version '%s'. Should be one of 1.0, 1.1, 1.2, 1.3", s.TLSMinVersion)
+		}
+		cfg.MinVersion = v
+	}
+
+	if s.TLSSkipVerify {
+		cfg.InsecureSkipVerify = s.TLSSkipVerify
+	} else {
+		cfg.ServerName = s.Host
+	}
+
+	// Strict mode fails handshakes in which the certificate wasn't verified,
+	// which it isn't if verification gets skipped.
+	if s.TLSStrict {
+		cfg.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if len(chains) == 0 {
+				return errors.New("tls: the server's certificate wasn't verified but tls_strict is set")
+			}
+			return nil
+		}
+	}
+	return cfg, nil
+}
+
+// isTLSError checks whether an error returned by the SMTP pool occurred
+// during TLS negotiation or certificate verification.
+func isTLSError(err error) bool {
+	switch err.(type) {
+	case tls.RecordHeaderError, x509.CertificateInvalidError,
+		x509.HostnameError, x509.UnknownAuthorityError:
+		return true
+	}
+
+	msg := err.Error()
+	return strings.HasPrefix(msg, "tls:") ||
+		strings.HasPrefix(msg, "x509:") ||
+		strings.Contains(msg, "STARTTLS")
+}
@@ -0,0 +1,115 @@
+package messenger
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrFake is the error that a Fake messenger fails pushes with. It's not
+// a permanent error, so it counts against the health of the messenger.
+var ErrFake = errors.New("fake messenger error")
+
+// FakeConfig has the settings of a Fake messenger.
+type FakeConfig struct {
+	// Latency is the time that a push takes, plus a random jitter of up
+	// to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// ErrorRate is the share of pushes (0 to 1) that fail with ErrFake.
+	ErrorRate float64
+}
+
+// FakeStatus represents the settings of a Fake messenger and the results
+// of its pushes.
+type FakeStatus struct {
+	FakeConfig
+
+	Pushed int64
+	Failed int64
+}
+
+// Fake is a messenger that discards its messages after a configurable
+// latency and fails some of them, for load testing. Its settings can be
+// changed while it's pushing.
+type Fake struct {
+	name string
+
+	cfg FakeConfig
+	mut sync.RWMutex
+
+	pushed int64
+	failed int64
+}
+
+// NewFake returns a Fake messenger.
+func NewFake(name string, cfg FakeConfig) (*Fake, error) {
+	f := &Fake{name: name}
+	if err := f.SetConfig(cfg); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Name returns the messenger's name.
+func (f *Fake) Name() string {
+	return f.name
+}
+
+// Push waits for the latency and discards the message, or fails.
+func (f *Fake) Push(m Message) error {
+	f.mut.RLock()
+	cfg := f.cfg
+	f.mut.RUnlock()
+
+	d := cfg.Latency
+	if cfg.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(cfg.Jitter) + 1))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+
+	if cfg.ErrorRate > 0 && rand.Float64() < cfg.ErrorRate {
+		atomic.AddInt64(&f.failed, 1)
+		return ErrFake
+	}
+	atomic.AddInt64(&f.pushed, 1)
+	return nil
+}
+
+// Flush is a no-op as messages aren't queued.
+func (f *Fake) Flush() error {
+	return nil
+}
+
+// SetConfig replaces the settings of the messenger.
+func (f *Fake) SetConfig(cfg FakeConfig) error {
+	if cfg.Latency < 0 || cfg.Jitter < 0 {
+		return errors.New("latency and jitter can't be negative")
+	}
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+		return errors.New("error rate should be between 0 and 1")
+	}
+
+	f.mut.Lock()
+	f.cfg = cfg
+	f.mut.Unlock()
+	return nil
+}
+
+// Status returns the settings of the messenger and the results of its
+// pushes.
+func (f *Fake) Status() FakeStatus {
+	f.mut.RLock()
+	defer f.mut.RUnlock()
+
+	return FakeStatus{
+		FakeConfig: f.cfg,
+		Pushed:     atomic.LoadInt64(&f.pushed),
+		Failed:     atomic.LoadInt64(&f.failed),
+	}
+}
@@ -1,15 +1,74 @@
 package messenger
 
-import "net/textproto"
+import (
+	"errors"
+	"net/textproto"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// ErrUnavailable is returned, wrapped, by Push when all the backends of
+// a messenger (eg: SMTP servers) are unhealthy and the message wasn't sent
+// to any of them. It's an outage and not a failure of the message.
+var ErrUnavailable = errors.New("all servers are unavailable")
 
 // Messenger is an interface for a generic messaging backend,
 // for instance, e-mail, SMS etc.
 type Messenger interface {
 	Name() string
-	Push(fromAddr string, toAddr []string, subject string, message []byte, atts []Attachment) error
+	Push(m Message) error
 	Flush() error
 }
 
+// ConnCounter is implemented by messengers that keep connections
+// to their backends, for diagnostics.
+type ConnCounter interface {
+	// Conns returns the number of open connections.
+	Conns() int
+}
+
+// ConnRecycler is implemented by messengers that replace their aged and
+// dead connections, for diagnostics.
+type ConnRecycler interface {
+	// Recycled returns the number of connections that were replaced for
+	// exceeding their maximum age and for failing a keepalive check.
+	Recycled() (recycled, stale int64)
+}
+
+// TimeoutCounter is implemented by messengers that abort slow sends, for
+// diagnostics.
+type TimeoutCounter interface {
+	// TimedOut returns the number of messages that were aborted for
+	// exceeding their send timeouts.
+	TimedOut() int64
+}
+
+// Message represents a message to be pushed by a Messenger.
+type Message struct {
+	From        string
+	To          []string
+	Subject     string
+	Body        []byte
+	Attachments []Attachment
+
+	// AMP is the optional AMP for e-mail version of the HTML Body that
+	// messengers that support it send alongside it.
+	AMP []byte
+
+	// AltBody is the optional plaintext alternative of the HTML Body. When
+	// it's empty on campaign messages, they're sent without one, unless the
+	// messenger only sends plaintext.
+	AltBody []byte
+
+	// Headers are the optional headers of the message, eg: List-Unsubscribe.
+	Headers textproto.MIMEHeader
+
+	// Campaign and Subscriber are set on campaign messages
+	// and are nil on all other messages.
+	Campaign   *models.Campaign
+	Subscriber *models.Subscriber
+}
+
 // Attachment represents a file or blob attachment that can be
 // sent along with a message by a Messenger.
 type Attachment struct {
@@ -18,6 +77,20 @@ type Attachment struct {
 	Content []byte
 }
 
+// IsPermanent checks whether a Push error is a permanent failure that
+// won't succeed on retrying, ie: a 5xx reply from an SMTP server such
+// as a rejected recipient.
+func IsPermanent(err error) bool {
+	var e *textproto.Error
+	return errors.As(err, &e) && e.Code >= 500 && e.Code < 600
+}
+
+// IsUnavailable checks whether a Push error is due to an outage of all
+// the messenger's backends. See ErrUnavailable.
+func IsUnavailable(err error) bool {
+	return errors.Is(err, ErrUnavailable)
+}
+
 // MakeAttachmentHeader is a helper function that returns a
 // textproto.MIMEHeader tailored for attachments, primarily
 // email. If no encoding is given, base64 is assumed.
@@ -0,0 +1,145 @@
+package messenger
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+// Placeholders in VERP address patterns.
+const (
+	verpCampaign   = "{campaign}"
+	verpSubscriber = "{subscriber}"
+	verpEmail      = "{email}"
+)
+
+const reUUIDPattern = `[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`
+
+// VERP encodes the campaign and the subscriber of a message into its
+// envelope sender (return-path) address so that bounces to it can be
+// attributed without relying on the contents of the bounce. The address
+// is generated from a pattern, eg: bounces+{campaign}.{subscriber}@site.com
+// where {campaign} and {subscriber} are the UUIDs, and {email} is the
+// subscriber's e-mail with @ replaced by =, as in classic VERP.
+type VERP struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+// VERPAddr represents the values decoded from a VERP address.
+type VERPAddr struct {
+	CampaignUUID   string
+	SubscriberUUID string
+	Email          string
+}
+
+// NewVERP validates a VERP address pattern and returns a VERP.
+func NewVERP(pattern string) (*VERP, error) {
+	pattern = strings.TrimSpace(pattern)
+	if strings.Count(pattern, "@") != 1 || strings.HasSuffix(pattern, "@") {
+		return nil, errors.New("VERP pattern should be an e-mail address")
+	}
+	at := strings.Index(pattern, "@")
+	if strings.Contains(pattern[at:], "{") {
+		return nil, errors.New("VERP pattern placeholders should be in the local part")
+	}
+	if !strings.Contains(pattern, verpSubscriber) && !strings.Contains(pattern, verpEmail) {
+		return nil, errors.New("VERP pattern should have {subscriber} or {email}")
+	}
+
+	// Compile the decoder regexp from the pattern.
+	re := regexp.QuoteMeta(pattern)
+	re = strings.Replace(re, regexp.QuoteMeta(verpCampaign), "(?P<campaign>"+reUUIDPattern+")", 1)
+	re = strings.Replace(re, regexp.QuoteMeta(verpSubscriber), "(?P<subscriber>"+reUUIDPattern+")", 1)
+	re = strings.Replace(re, regexp.QuoteMeta(verpEmail), "(?P<email>[^@\\s]+=[^@=\\s]+)", 1)
+	r, err := regexp.Compile("(?i)^" + re + "$")
+	if err != nil {
+		return nil, err
+	}
+
+	return &VERP{pattern: pattern, re: r}, nil
+}
+
+// Encode returns the VERP address of a campaign's message to a subscriber.
+func (v *VERP) Encode(campUUID, subUUID, email string) string {
+	return encodeVERP(v.pattern, campUUID, subUUID, email)
+}
+
+// EncodeAt returns the VERP address of a campaign's message to a subscriber
+// with the pattern rebased on another address. See Rebase. If the address
+// is invalid, the pattern is used as is.
+func (v *VERP) EncodeAt(addr, campUUID, subUUID, email string) string {
+	p, ok := rebaseVERP(v.pattern, addr)
+	if !ok {
+		p = v.pattern
+	}
+	return encodeVERP(p, campUUID, subUUID, email)
+}
+
+// Rebase returns a VERP whose pattern has the placeholders of the pattern
+// appended to the local part of another address, eg:
+// bounces+{campaign}.{subscriber}@site.com rebased on returns@brand.com is
+// returns+{campaign}.{subscriber}@brand.com.
+func (v *VERP) Rebase(addr string) (*VERP, error) {
+	p, ok := rebaseVERP(v.pattern, addr)
+	if !ok {
+		return nil, errors.New("invalid e-mail address")
+	}
+	return NewVERP(p)
+}
+
+func encodeVERP(pattern, campUUID, subUUID, email string) string {
+	return strings.NewReplacer(
+		verpCampaign, campUUID,
+		verpSubscriber, subUUID,
+		verpEmail, strings.Replace(email, "@", "=", 1),
+	).Replace(pattern)
+}
+
+// rebaseVERP rebases a pattern on an address. The placeholders are separated
+// from the address' local part with the separator that precedes them in the
+// pattern (eg: the + in bounces+{campaign}), or +.
+func rebaseVERP(pattern, addr string) (string, bool) {
+	addr = strings.TrimSpace(addr)
+	at := strings.LastIndex(addr, "@")
+	if at < 1 || at == len(addr)-1 || strings.ContainsAny(addr, "{} <>") {
+		return "", false
+	}
+
+	var (
+		local = pattern[:strings.Index(pattern, "@")]
+		i     = strings.Index(local, "{")
+		sep   = "+"
+	)
+	if i > 0 && strings.ContainsAny(local[i-1:i], "+-._=") {
+		sep = local[i-1 : i]
+	}
+	return addr[:at] + sep + local[i:] + addr[at:], true
+}
+
+// Decode decodes a VERP address. It returns false if the address
+// doesn't match the pattern.
+func (v *VERP) Decode(addr string) (VERPAddr, bool) {
+	m := v.re.FindStringSubmatch(strings.TrimSpace(addr))
+	if m == nil {
+		return VERPAddr{}, false
+	}
+
+	var out VERPAddr
+	for i, name := range v.re.SubexpNames() {
+		switch name {
+		case "campaign":
+			out.CampaignUUID = strings.ToLower(m[i])
+		case "subscriber":
+			out.SubscriberUUID = strings.ToLower(m[i])
+		case "email":
+			// The last = is the @ as the local part may have =.
+			e := m[i]
+			if j := strings.LastIndex(e, "="); j > 0 {
+				e = e[:j] + "@" + e[j+1:]
+			}
+			out.Email = strings.ToLower(e)
+		}
+	}
+	return out, true
+}
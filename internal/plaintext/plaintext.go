@@ -0,0 +1,304 @@
+// Package plaintext generates the plaintext alternatives of HTML e-mails.
+// Tags are stripped, whitespace is collapsed, block elements such as
+// paragraphs, table rows, and list items are put on their own lines, and
+// links are preserved as "text (url)".
+package plaintext
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxNewlines is the maximum number of consecutive line breaks, that is,
+// one blank line between blocks.
+const maxNewlines = 2
+
+// list is an ordered or unordered list whose items are being written.
+type list struct {
+	ordered bool
+	n       int
+}
+
+// writer holds the state of a conversion.
+type writer struct {
+	buf bytes.Buffer
+
+	// Line breaks and the space that are written before the next text,
+	// so that empty elements don't leave blank lines behind.
+	newlines int
+	space    bool
+
+	// marker is the bullet of the current list item, which is written
+	// before its first text so that block elements in items, eg:
+	// paragraphs, don't leave it on a line of its own.
+	marker string
+
+	pre   int
+	lists []list
+}
+
+// FromHTML converts an HTML document or fragment into plaintext.
+func FromHTML(b []byte) ([]byte, error) {
+	doc, err := html.Parse(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+
+	w := &writer{}
+	w.walk(doc)
+
+	// Trim the trailing spaces of lines and the document.
+	lines := strings.Split(w.buf.String(), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t")
+	}
+	return []byte(strings.TrimSpace(strings.Join(lines, "\n"))), nil
+}
+
+func (w *writer) walk(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		w.text(n.Data)
+		return
+	case html.ElementNode:
+		w.element(n)
+		return
+	}
+	w.children(n)
+}
+
+func (w *writer) children(n *html.Node) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		w.walk(c)
+	}
+}
+
+func (w *writer) element(n *html.Node) {
+	if isHidden(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.Head, atom.Title, atom.Style, atom.Script, atom.Template, atom.Noscript:
+		return
+
+	case atom.Br:
+		if w.newlines > 0 {
+			w.newlines++
+		} else {
+			w.newlines = 1
+		}
+		w.space = false
+
+	case atom.Hr:
+		w.block(maxNewlines)
+		w.write("----------")
+		w.block(maxNewlines)
+
+	case atom.Img:
+		if alt := strings.TrimSpace(attr(n, "alt")); alt != "" {
+			w.text(alt)
+		}
+
+	case atom.A:
+		w.link(n)
+
+	case atom.Td, atom.Th:
+		// Cells of a row are separated by a space.
+		w.space = true
+		w.children(n)
+		w.space = true
+
+	case atom.Ul, atom.Ol:
+		// Nested lists continue their parent items without a blank line.
+		nl := maxNewlines
+		if len(w.lists) > 0 {
+			nl = 1
+		}
+		w.block(nl)
+		w.lists = append(w.lists, list{ordered: n.DataAtom == atom.Ol})
+		w.children(n)
+		w.lists = w.lists[:len(w.lists)-1]
+		w.block(nl)
+
+	case atom.Li:
+		w.block(1)
+		w.marker = w.bullet()
+		w.children(n)
+		w.marker = ""
+		w.block(1)
+
+	case atom.Pre:
+		w.block(maxNewlines)
+		w.pre++
+		w.children(n)
+		w.pre--
+		w.block(maxNewlines)
+
+	case atom.P, atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6,
+		atom.Table, atom.Blockquote:
+		w.block(maxNewlines)
+		w.children(n)
+		w.block(maxNewlines)
+
+	case atom.Div, atom.Tr, atom.Section, atom.Article, atom.Header, atom.Footer,
+		atom.Center, atom.Dl, atom.Dt, atom.Dd, atom.Tbody, atom.Thead, atom.Tfoot:
+		w.block(1)
+		w.children(n)
+		w.block(1)
+
+	default:
+		w.children(n)
+	}
+}
+
+// link writes a link's text followed by its URL, unless the text is the URL.
+func (w *writer) link(n *html.Node) {
+	start, marker := w.buf.Len(), w.marker
+	w.children(n)
+	text := strings.TrimSpace(w.buf.String()[start:])
+
+	// The bullet of the item that the link starts isn't a part of its text.
+	if marker != "" && w.marker == "" {
+		text = strings.TrimSpace(strings.TrimPrefix(text, marker))
+	}
+
+	href := strings.TrimSpace(attr(n, "href"))
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(strings.ToLower(href), "javascript:") {
+		return
+	}
+	if strings.HasPrefix(strings.ToLower(href), "mailto:") {
+		href = href[len("mailto:"):]
+		if i := strings.IndexByte(href, '?'); i >= 0 {
+			href = href[:i]
+		}
+	}
+	if text == "" {
+		w.space = true
+		w.write(href)
+		return
+	}
+	if sameURL(text, href) {
+		return
+	}
+
+	w.space = true
+	w.write("(" + href + ")")
+}
+
+// text writes a text node with its whitespace collapsed, or as-is in
+// preformatted blocks.
+func (w *writer) text(s string) {
+	if w.pre > 0 {
+		w.write(s)
+		return
+	}
+
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		if s != "" {
+			w.space = true
+		}
+		return
+	}
+
+	if r, _ := utf8.DecodeRuneInString(s); unicode.IsSpace(r) {
+		w.space = true
+	}
+	w.write(strings.Join(words, " "))
+	if r, _ := utf8.DecodeLastRuneInString(s); unicode.IsSpace(r) {
+		w.space = true
+	}
+}
+
+// write writes a string after the pending line breaks or space.
+func (w *writer) write(s string) {
+	if s == "" {
+		return
+	}
+
+	if w.buf.Len() > 0 {
+		if w.newlines > 0 {
+			if w.newlines > maxNewlines {
+				w.newlines = maxNewlines
+			}
+			w.buf.WriteString(strings.Repeat("\n", w.newlines))
+			w.buf.WriteString(w.indent())
+		} else if w.space {
+			if b := w.buf.Bytes(); b[len(b)-1] != ' ' && b[len(b)-1] != '\n' {
+				w.buf.WriteByte(' ')
+			}
+		}
+	}
+	w.newlines = 0
+	w.space = false
+	if w.marker != "" {
+		w.buf.WriteString(w.marker)
+		w.marker = ""
+	}
+	w.buf.WriteString(s)
+}
+
+// block requests at least n line breaks before the next text.
+func (w *writer) block(n int) {
+	if n > w.newlines {
+		w.newlines = n
+	}
+	w.space = false
+}
+
+// bullet returns the marker of the next item of the current list.
+func (w *writer) bullet() string {
+	if len(w.lists) == 0 {
+		return "* "
+	}
+	l := &w.lists[len(w.lists)-1]
+	if !l.ordered {
+		return "* "
+	}
+	l.n++
+	return strconv.Itoa(l.n) + ". "
+}
+
+// indent returns the indentation of the lines of nested lists.
+func (w *writer) indent() string {
+	if len(w.lists) < 2 {
+		return ""
+	}
+	return strings.Repeat("  ", len(w.lists)-1)
+}
+
+// sameURL checks whether a link's text is its URL, ignoring the scheme and
+// the trailing slash.
+func sameURL(text, href string) bool {
+	norm := func(s string) string {
+		s = strings.ToLower(s)
+		for _, p := range []string{"https://", "http://", "mailto:"} {
+			s = strings.TrimPrefix(s, p)
+		}
+		return strings.TrimSuffix(s, "/")
+	}
+	return norm(text) == norm(href)
+}
+
+// isHidden checks whether an element is hidden with an inline style, eg:
+// the preheaders of e-mails.
+func isHidden(n *html.Node) bool {
+	s := strings.ToLower(strings.Replace(attr(n, "style"), " ", "", -1))
+	return strings.Contains(s, "display:none")
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
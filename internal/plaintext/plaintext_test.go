@@ -0,0 +1,65 @@
+package plaintext
+
+import "testing"
+
+func TestFromHTML(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{"text", `Hello  <b>world</b>`, "Hello world"},
+		{"paragraphs", `<p>One</p><p>Two</p>`, "One\n\nTwo"},
+		{"line breaks", `One<br>Two<br><br><br>Three`, "One\nTwo\n\nThree"},
+		{"entities", `<p>Fish &amp; chips &lt;3</p>`, "Fish & chips <3"},
+		{"head and scripts", `<html><head><title>T</title><style>p{}</style></head><body><script>x()</script><p>Hi</p></body></html>`, "Hi"},
+		{"hidden preheader", `<div style="display: none">Preview</div><p>Hi</p>`, "Hi"},
+		{"image alt", `<p>Logo: <img src="a.png" alt="Acme"></p>`, "Logo: Acme"},
+		{"pre", "<pre>a  b\n  c</pre>", "a  b\n  c"},
+		{"hr", `<p>One</p><hr><p>Two</p>`, "One\n\n----------\n\nTwo"},
+
+		// Tables.
+		{"table", `<table><tr><td>Name</td><td>Qty</td></tr><tr><td>Apples</td><td>3</td></tr></table>`, "Name Qty\nApples 3"},
+		{"table head", `<table><thead><tr><th>A</th><th>B</th></tr></thead><tbody><tr><td>1</td><td>2</td></tr></tbody></table>`, "A B\n1 2"},
+		{"table between paragraphs", `<p>Before</p><table><tr><td>x</td></tr></table><p>After</p>`, "Before\n\nx\n\nAfter"},
+		{"layout tables", `<table><tr><td><table><tr><td><p>Hello</p></td></tr></table></td></tr></table>`, "Hello"},
+		{"empty cells", `<table><tr><td></td><td>x</td><td> </td></tr></table>`, "x"},
+
+		// Lists.
+		{"unordered", `<ul><li>One</li><li>Two</li></ul>`, "* One\n* Two"},
+		{"ordered", `<ol><li>One</li><li>Two</li><li>Three</li></ol>`, "1. One\n2. Two\n3. Three"},
+		{"nested", `<ul><li>One<ul><li>A</li><li>B</li></ul></li><li>Two</li></ul>`, "* One\n  * A\n  * B\n* Two"},
+		{"nested ordered", `<ol><li>One<ol><li>A</li></ol></li><li>Two</li></ol>`, "1. One\n  1. A\n2. Two"},
+		{"list between paragraphs", `<p>Items:</p><ul><li>One</li></ul><p>Done</p>`, "Items:\n\n* One\n\nDone"},
+		{"list item paragraphs", `<ul><li><p>One</p></li><li><p>Two</p></li></ul>`, "* One\n\n* Two"},
+
+		// Anchors.
+		{"link", `<a href="https://listmonk.app/docs">Docs</a>`, "Docs (https://listmonk.app/docs)"},
+		{"link in text", `Read the <a href="https://listmonk.app/docs">docs</a> now.`, "Read the docs (https://listmonk.app/docs) now."},
+		{"link is url", `<a href="https://listmonk.app/">listmonk.app</a>`, "listmonk.app"},
+		{"link is url with scheme", `<a href="https://listmonk.app">https://listmonk.app</a>`, "https://listmonk.app"},
+		{"link without text", `<a href="https://listmonk.app"></a>`, "https://listmonk.app"},
+		{"image link", `<a href="https://listmonk.app"><img src="a.png"></a>`, "https://listmonk.app"},
+		{"image link alt", `<a href="https://listmonk.app"><img src="a.png" alt="Acme"></a>`, "Acme (https://listmonk.app)"},
+		{"mailto", `<a href="mailto:hi@listmonk.app?subject=Hi">Write to us</a>`, "Write to us (hi@listmonk.app)"},
+		{"mailto is text", `<a href="mailto:hi@listmonk.app">hi@listmonk.app</a>`, "hi@listmonk.app"},
+		{"fragment", `<a href="#top">Top</a>`, "Top"},
+		{"javascript", `<a href="javascript:void(0)">Click</a>`, "Click"},
+		{"no href", `<a name="x">Anchor</a>`, "Anchor"},
+		{"link in list", `<ul><li><a href="https://listmonk.app">Home</a></li></ul>`, "* Home (https://listmonk.app)"},
+		{"url link in list", `<ul><li><a href="https://listmonk.app">listmonk.app</a></li></ul>`, "* listmonk.app"},
+		{"url link in list items", `<ul><li>One</li><li><a href="https://listmonk.app">listmonk.app</a></li></ul>`, "* One\n* listmonk.app"},
+		{"link in table", `<table><tr><td><a href="https://listmonk.app">Home</a></td><td>x</td></tr></table>`, "Home (https://listmonk.app) x"},
+	}
+
+	for _, c := range cases {
+		out, err := FromHTML([]byte(c.in))
+		if err != nil {
+			t.Errorf("%s: error converting: %v", c.name, err)
+			continue
+		}
+		if string(out) != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, out, c.out)
+		}
+	}
+}
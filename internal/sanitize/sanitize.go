@@ -0,0 +1,227 @@
+// Package sanitize strips HTML of the tags and attributes that aren't in
+// an allowlist to render untrusted HTML, eg: campaign bodies, on web pages.
+package sanitize
+
+import (
+	"bytes"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// dropContent are the tags whose contents are dropped along with them
+// if they aren't allowed. The contents of other tags are retained.
+var dropContent = map[string]bool{
+	"script":   true,
+	"style":    true,
+	"iframe":   true,
+	"object":   true,
+	"embed":    true,
+	"noscript": true,
+	"template": true,
+	"title":    true,
+	"textarea": true,
+	"select":   true,
+	"svg":      true,
+	"math":     true,
+}
+
+// urlAttrs are the attributes whose values are URLs.
+var urlAttrs = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"background": true,
+	"poster":     true,
+	"cite":       true,
+	"longdesc":   true,
+}
+
+// badCSS are the fragments that make CSS unsafe. They're matched after
+// stripping whitespace, backslashes, and comments.
+var badCSS = []string{"expression(", "javascript:", "vbscript:", "-moz-binding", "behavior:"}
+
+// Policy represents the allowlists of a sanitizer.
+type Policy struct {
+	tags    map[string]bool
+	attrs   map[string]bool
+	schemes map[string]bool
+}
+
+// New returns a Policy that allows the given tags, attributes, and URL
+// schemes (in href, src etc.). Event handler (on*) attributes are never
+// allowed. Relative URLs are always allowed.
+func New(tags, attrs, schemes []string) *Policy {
+	return &Policy{
+		tags:    makeSet(tags),
+		attrs:   makeSet(attrs),
+		schemes: makeSet(schemes),
+	}
+}
+
+// Sanitize returns the sanitized HTML.
+func (p *Policy) Sanitize(b []byte) []byte {
+	var (
+		out = bytes.NewBuffer(make([]byte, 0, len(b)))
+		z   = html.NewTokenizer(bytes.NewReader(b))
+
+		// The tag whose contents are being dropped and its nesting depth.
+		skip      string
+		skipDepth int
+
+		// The allowed raw text tag (eg: style) that's open.
+		raw string
+	)
+
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return out.Bytes()
+		}
+		tok := z.Token()
+		name := strings.ToLower(tok.Data)
+
+		if skip != "" {
+			switch {
+			case tt == html.StartTagToken && name == skip:
+				skipDepth++
+			case tt == html.EndTagToken && name == skip:
+				skipDepth--
+				if skipDepth == 0 {
+					skip = ""
+				}
+			}
+			continue
+		}
+
+		switch tt {
+		case html.DoctypeToken:
+			out.WriteString(tok.String())
+
+		case html.CommentToken:
+			// Comments, including conditional ones, may hide markup.
+
+		case html.TextToken:
+			if raw != "" {
+				if raw == "style" && !isSafeCSS(tok.Data) {
+					continue
+				}
+				out.WriteString(tok.Data)
+				continue
+			}
+			out.WriteString(html.EscapeString(tok.Data))
+
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if !p.tags[name] {
+				if tt == html.StartTagToken && dropContent[name] {
+					skip, skipDepth = name, 1
+				}
+				continue
+			}
+
+			out.WriteString("<" + name)
+			for _, a := range tok.Attr {
+				if v, ok := p.attr(a); ok {
+					out.WriteString(" " + strings.ToLower(a.Key) + `="` + html.EscapeString(v) + `"`)
+				}
+			}
+			if tt == html.SelfClosingTagToken {
+				out.WriteString("/>")
+				continue
+			}
+			out.WriteString(">")
+
+			if name == "style" || name == "script" {
+				raw = name
+			}
+
+		case html.EndTagToken:
+			if name == raw {
+				raw = ""
+			}
+			if p.tags[name] {
+				out.WriteString("</" + name + ">")
+			}
+		}
+	}
+}
+
+// attr returns the value of an attribute and whether it's allowed.
+func (p *Policy) attr(a html.Attribute) (string, bool) {
+	key := strings.ToLower(a.Key)
+	if a.Namespace != "" || strings.HasPrefix(key, "on") || !p.attrs[key] {
+		return "", false
+	}
+
+	switch {
+	case urlAttrs[key]:
+		if !p.isAllowedURL(a.Val) {
+			return "", false
+		}
+	case key == "style":
+		if !isSafeCSS(a.Val) {
+			return "", false
+		}
+	}
+	return a.Val, true
+}
+
+// isAllowedURL checks whether a URL is relative or has an allowed scheme.
+// Browsers ignore whitespace and control characters in schemes,
+// eg: "java\tscript:", so they're stripped before checking.
+func (p *Policy) isAllowedURL(u string) bool {
+	u = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, u)
+
+	i := strings.IndexAny(u, ":/?#")
+	if i < 0 || u[i] != ':' {
+		return true
+	}
+	return p.schemes[strings.ToLower(u[:i])]
+}
+
+// isSafeCSS checks whether a CSS block or declaration is free of
+// constructs that execute scripts.
+func isSafeCSS(s string) bool {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == '\\' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(s))
+
+	for {
+		i := strings.Index(s, "/*")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i+2:], "*/")
+		if j < 0 {
+			s = s[:i]
+			break
+		}
+		s = s[:i] + s[i+2+j+2:]
+	}
+
+	for _, b := range badCSS {
+		if strings.Contains(s, b) {
+			return false
+		}
+	}
+	return true
+}
+
+func makeSet(l []string) map[string]bool {
+	out := make(map[string]bool, len(l))
+	for _, v := range l {
+		if v = strings.ToLower(strings.TrimSpace(v)); v != "" {
+			out[v] = true
+		}
+	}
+	return out
+}
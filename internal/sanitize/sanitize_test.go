@@ -0,0 +1,67 @@
+package sanitize
+
+import "testing"
+
+func TestSanitize(t *testing.T) {
+	p := New([]string{"p", "a", "b", "img", "style"},
+		[]string{"href", "src", "style", "title"},
+		[]string{"http", "https", "mailto"})
+
+	cases := []struct {
+		name string
+		in   string
+		out  string
+	}{
+		{"allowed", `<p title="x"><b>Hi</b></p>`, `<p title="x"><b>Hi</b></p>`},
+		{"disallowed tag", `<p><u>Hi</u></p>`, `<p>Hi</p>`},
+		{"disallowed attr", `<p class="x" id="y">Hi</p>`, `<p>Hi</p>`},
+		{"text is escaped", `<p>1 &lt; 2</p>`, `<p>1 &lt; 2</p>`},
+		{"relative url", `<a href="/page?a=1#b">x</a>`, `<a href="/page?a=1#b">x</a>`},
+		{"allowed scheme", `<a href="https://listmonk.app">x</a>`, `<a href="https://listmonk.app">x</a>`},
+		{"mailto", `<a href="mailto:a@b.com">x</a>`, `<a href="mailto:a@b.com">x</a>`},
+
+		{"javascript href", `<a href="javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript href case", `<a href="JaVaScRiPt:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript href tab", "<a href=\"java\tscript:alert(1)\">x</a>", `<a>x</a>`},
+		{"javascript href newline", "<a href=\"java\nscript:alert(1)\">x</a>", `<a>x</a>`},
+		{"javascript href leading space", `<a href="  javascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript href entity", `<a href="&#106;avascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript href hex entity", `<a href="&#x6A;&#x61;vascript:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript href tab entity", `<a href="java&#9;script:alert(1)">x</a>`, `<a>x</a>`},
+		{"javascript href named entity", `<a href="javascript&colon;alert(1)">x</a>`, `<a>x</a>`},
+		{"data src", `<img src="data:text/html;base64,PHNjcmlwdD4=">`, `<img>`},
+		{"vbscript href", `<a href="vbscript:msgbox(1)">x</a>`, `<a>x</a>`},
+
+		{"onclick", `<p onclick="alert(1)">x</p>`, `<p>x</p>`},
+		{"onerror", `<img src="/a.png" onerror="alert(1)">`, `<img src="/a.png">`},
+		{"onload upper", `<img src="/a.png" ONLOAD="alert(1)">`, `<img src="/a.png">`},
+		{"onmouseover self-closing", `<img src="/a.png" onmouseover="alert(1)"/>`, `<img src="/a.png"/>`},
+
+		{"style expression", `<style>p { width: expression(alert(1)); }</style>`, `<style></style>`},
+		{"style expression escaped", `<style>p { width: e\xpression(alert(1)); }</style>`, `<style></style>`},
+		{"style expression comment", `<style>p { width: exp/**/ression(alert(1)); }</style>`, `<style></style>`},
+		{"style attr expression", `<p style="width: expression(alert(1))">x</p>`, `<p>x</p>`},
+		{"style attr javascript url", `<p style="background: url(javascript:alert(1))">x</p>`, `<p>x</p>`},
+		{"style binding", `<p style="-moz-binding: url(x.xml#y)">x</p>`, `<p>x</p>`},
+		{"safe style", `<style>p { color: red; }</style>`, `<style>p { color: red; }</style>`},
+		{"safe style attr", `<p style="color: red">x</p>`, `<p style="color: red">x</p>`},
+
+		{"script", `<p>a<script>alert(1)</script>b</p>`, `<p>ab</p>`},
+		{"svg script", `<svg><script>alert(1)</script></svg><p>x</p>`, `<p>x</p>`},
+		{"svg onload", `<svg onload="alert(1)"><p>x</p></svg>`, ``},
+		{"nested svg", `<svg><svg></svg><script>alert(1)</script></svg>x`, `x`},
+		{"style breakout", `<style>p { color: red; }</style><script>alert(1)</script>`, `<style>p { color: red; }</style>`},
+		{"style breakout in text", `<style>p { color: red; }</style><img src=x onerror=alert(1)>`, `<style>p { color: red; }</style><img src="x">`},
+		{"iframe", `<iframe src="https://evil.com"></iframe>x`, `x`},
+
+		{"comment", `<p>a<!-- <script>alert(1)</script> -->b</p>`, `<p>ab</p>`},
+		{"conditional comment", `<!--[if IE]><script>alert(1)</script><![endif]-->x`, `x`},
+		{"comment breakout", `<!-- --!><script>alert(1)</script> -->x`, ` --&gt;x`},
+	}
+
+	for _, c := range cases {
+		if out := string(p.Sanitize([]byte(c.in))); out != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, out, c.out)
+		}
+	}
+}
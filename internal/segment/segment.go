@@ -0,0 +1,306 @@
+// Package segment compiles structured subscriber filter trees into
+// parameterized SQL expressions. Only the fields and operators in the
+// allowlists are accepted and all user supplied values, including attribute
+// keys, are passed as query arguments, never interpolated into the SQL. The
+// only exception is the keys of indexed attributes, which are validated and
+// quoted as literals so that the expression indexes on them are used.
+package segment
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// GroupAnd and GroupOr are the logical operators of group rules.
+	GroupAnd = "and"
+	GroupOr  = "or"
+
+	// attribPrefix is the field prefix for filtering on subscriber attributes,
+	// eg: attribs.city.
+	attribPrefix = "attribs."
+
+	maxDepth = 8
+	maxRules = 100
+)
+
+// fields is the allowlist of subscriber columns that can be filtered.
+var fields = map[string]string{
+	"id":         "subscribers.id",
+	"uuid":       "subscribers.uuid",
+	"email":      "subscribers.email",
+	"name":       "subscribers.name",
+	"status":     "subscribers.status",
+	"created_at": "subscribers.created_at",
+	"updated_at": "subscribers.updated_at",
+}
+
+// comparisons is the allowlist of comparison operators.
+var comparisons = map[string]string{
+	"eq":  "=",
+	"neq": "!=",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+var reAttribKey = regexp.MustCompile(`^[a-zA-Z0-9_\-]{1,100}$`)
+
+// Rule is a node in a filter tree. A node is either a group with a logical
+// operator (and, or) and one or more child rules, or a condition with a
+// field, an operator, and a value.
+//
+// Operators: eq, neq, gt, gte, lt, lte, contains, not_contains, starts_with,
+// in, not_in, exists, not_exists (exists and not_exists are only applicable
+// to attributes).
+type Rule struct {
+	Group string `json:"group,omitempty"`
+	Rules []Rule `json:"rules,omitempty"`
+
+	Field    string      `json:"field,omitempty"`
+	Operator string      `json:"operator,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+}
+
+// compiler holds the state of a compilation.
+type compiler struct {
+	args     []interface{}
+	offset   int
+	numRules int
+	indexed  map[string]bool
+}
+
+// Compile compiles a filter tree into an SQL expression on the subscribers
+// table and returns it along with its positional arguments. argOffset is the
+// number of positional arguments already used by the query the expression
+// is embedded into, that is, the first argument in the expression will be
+// $(argOffset+1). indexed is the optional set of attribute keys that have
+// expression indexes on subscribers.attribs->'key' and ->>'key'.
+func Compile(r Rule, argOffset int, indexed map[string]bool) (string, []interface{}, error) {
+	c := &compiler{offset: argOffset, indexed: indexed}
+	exp, err := c.compile(r, 0)
+	if err != nil {
+		return "", nil, err
+	}
+	return exp, c.args, nil
+}
+
+// ValidAttribKey checks whether an attribute key can be filtered on.
+func ValidAttribKey(key string) bool {
+	return reAttribKey.MatchString(key)
+}
+
+func (c *compiler) compile(r Rule, depth int) (string, error) {
+	c.numRules++
+	if c.numRules > maxRules {
+		return "", fmt.Errorf("too many rules. Max is %d", maxRules)
+	}
+
+	if r.Group == "" {
+		return c.compileCond(r)
+	}
+
+	if depth >= maxDepth {
+		return "", fmt.Errorf("rules are nested too deep. Max depth is %d", maxDepth)
+	}
+	if r.Field != "" || r.Operator != "" {
+		return "", errors.New("a group rule cannot have a field or operator")
+	}
+
+	var op string
+	switch r.Group {
+	case GroupAnd:
+		op = " AND "
+	case GroupOr:
+		op = " OR "
+	default:
+		return "", fmt.Errorf("unknown group '%s'", r.Group)
+	}
+
+	if len(r.Rules) == 0 {
+		return "", errors.New("empty group")
+	}
+
+	out := make([]string, 0, len(r.Rules))
+	for _, child := range r.Rules {
+		exp, err := c.compile(child, depth+1)
+		if err != nil {
+			return "", err
+		}
+		out = append(out, exp)
+	}
+
+	return "(" + strings.Join(out, op) + ")", nil
+}
+
+// compileCond compiles a single condition.
+func (c *compiler) compileCond(r Rule) (string, error) {
+	if len(r.Rules) > 0 {
+		return "", errors.New("a condition cannot have child rules")
+	}
+
+	// Attribute.
+	if strings.HasPrefix(r.Field, attribPrefix) {
+		key := strings.TrimPrefix(r.Field, attribPrefix)
+		if !reAttribKey.MatchString(key) {
+			return "", fmt.Errorf("invalid attribute key '%s'", key)
+		}
+		return c.compileAttrib(key, r.Operator, r.Value)
+	}
+
+	// Column.
+	col, ok := fields[r.Field]
+	if !ok {
+		return "", fmt.Errorf("unknown field '%s'", r.Field)
+	}
+
+	if op, ok := comparisons[r.Operator]; ok {
+		v, err := scalar(r.Value)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s %s", col, op, c.arg(v)), nil
+	}
+
+	switch r.Operator {
+	case "contains", "not_contains", "starts_with":
+		v, err := likePattern(r.Operator, r.Value)
+		if err != nil {
+			return "", err
+		}
+		not := ""
+		if r.Operator == "not_contains" {
+			not = "NOT "
+		}
+		return fmt.Sprintf("%s::TEXT %sILIKE %s", col, not, c.arg(v)), nil
+
+	case "in", "not_in":
+		v, err := list(r.Value)
+		if err != nil {
+			return "", err
+		}
+		if r.Operator == "in" {
+			return fmt.Sprintf("%s::TEXT = ANY(%s::TEXT[])", col, c.arg(v)), nil
+		}
+		return fmt.Sprintf("NOT (%s::TEXT = ANY(%s::TEXT[]))", col, c.arg(v)), nil
+	}
+
+	return "", fmt.Errorf("unknown operator '%s' for field '%s'", r.Operator, r.Field)
+}
+
+// compileAttrib compiles a condition on a subscriber attribute. Attribute
+// values are compared as JSONB so that comparisons never fail on mixed types.
+func (c *compiler) compileAttrib(key, operator string, value interface{}) (string, error) {
+	if op, ok := comparisons[operator]; ok {
+		v, err := scalar(value)
+		if err != nil {
+			return "", err
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("subscribers.attribs->%s %s %s::JSONB", c.keyArg(key), op, c.arg(string(b))), nil
+	}
+
+	switch operator {
+	case "contains", "not_contains", "starts_with":
+		v, err := likePattern(operator, value)
+		if err != nil {
+			return "", err
+		}
+		if operator == "not_contains" {
+			return fmt.Sprintf("COALESCE(subscribers.attribs->>%s, '') NOT ILIKE %s", c.keyArg(key), c.arg(v)), nil
+		}
+		return fmt.Sprintf("subscribers.attribs->>%s ILIKE %s", c.keyArg(key), c.arg(v)), nil
+
+	case "in", "not_in":
+		v, err := list(value)
+		if err != nil {
+			return "", err
+		}
+		if operator == "in" {
+			return fmt.Sprintf("subscribers.attribs->>%s = ANY(%s::TEXT[])", c.keyArg(key), c.arg(v)), nil
+		}
+		return fmt.Sprintf("NOT COALESCE(subscribers.attribs->>%s = ANY(%s::TEXT[]), false)", c.keyArg(key), c.arg(v)), nil
+
+	case "exists":
+		return fmt.Sprintf("subscribers.attribs->%s IS NOT NULL", c.keyArg(key)), nil
+
+	case "not_exists":
+		return fmt.Sprintf("subscribers.attribs->%s IS NULL", c.keyArg(key)), nil
+	}
+
+	return "", fmt.Errorf("unknown operator '%s' for attribute '%s'", operator, key)
+}
+
+// arg adds a positional argument and returns its placeholder.
+func (c *compiler) arg(v interface{}) string {
+	c.args = append(c.args, v)
+	return fmt.Sprintf("$%d", c.offset+len(c.args))
+}
+
+// keyArg adds an attribute key as a positional argument and returns
+// its placeholder cast to TEXT for the JSONB -> and ->> operators. Indexed
+// keys are returned as quoted literals instead as the planner can only match
+// expression indexes on constant keys.
+func (c *compiler) keyArg(key string) string {
+	if c.indexed[key] {
+		return pq.QuoteLiteral(key)
+	}
+	return c.arg(key) + "::TEXT"
+}
+
+// scalar validates that a value is a string, number, or a boolean.
+func scalar(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case string, float64, bool:
+		return v, nil
+	}
+	return nil, errors.New("value should be a string, number, or boolean")
+}
+
+// likePattern returns the ILIKE pattern for a string value with the
+// LIKE wildcards in it escaped.
+func likePattern(operator string, v interface{}) (string, error) {
+	s, ok := v.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf("value for '%s' should be a non-empty string", operator)
+	}
+
+	s = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+	if operator == "starts_with" {
+		return s + "%", nil
+	}
+	return "%" + s + "%", nil
+}
+
+// list validates that a value is a list of scalars and returns them as strings.
+// Numbers are formatted without exponents as they're compared as text.
+func list(v interface{}) (pq.StringArray, error) {
+	items, ok := v.([]interface{})
+	if !ok || len(items) == 0 {
+		return nil, errors.New("value should be a non-empty list")
+	}
+
+	out := make(pq.StringArray, 0, len(items))
+	for _, i := range items {
+		if _, err := scalar(i); err != nil {
+			return nil, err
+		}
+		switch i := i.(type) {
+		case float64:
+			out = append(out, strconv.FormatFloat(i, 'f', -1, 64))
+		default:
+			out = append(out, fmt.Sprintf("%v", i))
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,165 @@
+package segment
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	cases := []struct {
+		name    string
+		rule    string
+		indexed map[string]bool
+		exp     string
+		args    string
+	}{
+		// Fields and operators.
+		{"eq", `{"field": "email", "operator": "eq", "value": "a@b.com"}`, nil,
+			"subscribers.email = $3", "[a@b.com]"},
+		{"neq", `{"field": "status", "operator": "neq", "value": "blocklisted"}`, nil,
+			"subscribers.status != $3", "[blocklisted]"},
+		{"gte", `{"field": "id", "operator": "gte", "value": 10}`, nil,
+			"subscribers.id >= $3", "[10]"},
+		{"contains", `{"field": "name", "operator": "contains", "value": "jo"}`, nil,
+			"subscribers.name::TEXT ILIKE $3", "[%jo%]"},
+		{"not contains", `{"field": "name", "operator": "not_contains", "value": "jo"}`, nil,
+			"subscribers.name::TEXT NOT ILIKE $3", "[%jo%]"},
+		{"starts with", `{"field": "email", "operator": "starts_with", "value": "jo"}`, nil,
+			"subscribers.email::TEXT ILIKE $3", "[jo%]"},
+		{"in", `{"field": "status", "operator": "in", "value": ["enabled", "disabled"]}`, nil,
+			"subscribers.status::TEXT = ANY($3::TEXT[])", `[{"enabled","disabled"}]`},
+		{"not in", `{"field": "id", "operator": "not_in", "value": [1, 2]}`, nil,
+			"NOT (subscribers.id::TEXT = ANY($3::TEXT[]))", `[{"1","2"}]`},
+		{"group", `{"group": "or", "rules": [{"field": "id", "operator": "eq", "value": 1}, {"group": "and", "rules": [{"field": "name", "operator": "eq", "value": "a"}, {"field": "email", "operator": "eq", "value": "b"}]}]}`, nil,
+			"(subscribers.id = $3 OR (subscribers.name = $4 AND subscribers.email = $5))", "[1 a b]"},
+
+		// Attributes.
+		{"attrib eq", `{"field": "attribs.city", "operator": "eq", "value": "Bengaluru"}`, nil,
+			"subscribers.attribs->$3::TEXT = $4::JSONB", `[city "Bengaluru"]`},
+		{"attrib exists", `{"field": "attribs.city", "operator": "exists"}`, nil,
+			"subscribers.attribs->$3::TEXT IS NOT NULL", "[city]"},
+		{"attrib not in", `{"field": "attribs.age", "operator": "not_in", "value": [30, true]}`, nil,
+			"NOT COALESCE(subscribers.attribs->>$3::TEXT = ANY($4::TEXT[]), false)", `[age {"30","true"}]`},
+		{"indexed attrib", `{"field": "attribs.city", "operator": "contains", "value": "a"}`, map[string]bool{"city": true},
+			"subscribers.attribs->>'city' ILIKE $3", "[%a%]"},
+
+		// Values that look like SQL are only ever arguments.
+		{"injection value", `{"field": "email", "operator": "eq", "value": "x' OR 1=1; --"}`, nil,
+			"subscribers.email = $3", "[x' OR 1=1; --]"},
+		{"key with dashes", `{"field": "attribs.city--", "operator": "exists"}`, nil,
+			"subscribers.attribs->$3::TEXT IS NOT NULL", "[city--]"},
+		{"injection list", `{"field": "name", "operator": "in", "value": ["a'); DROP TABLE subscribers; --"]}`, nil,
+			"subscribers.name::TEXT = ANY($3::TEXT[])", `[{"a'); DROP TABLE subscribers; --"}]`},
+
+		// LIKE escaping.
+		{"escape percent", `{"field": "name", "operator": "contains", "value": "50%"}`, nil,
+			"subscribers.name::TEXT ILIKE $3", `[%50\%%]`},
+		{"escape underscore", `{"field": "email", "operator": "starts_with", "value": "a_b"}`, nil,
+			"subscribers.email::TEXT ILIKE $3", `[a\_b%]`},
+		{"escape backslash", `{"field": "attribs.path", "operator": "contains", "value": "c:\\x"}`, nil,
+			"subscribers.attribs->>$3::TEXT ILIKE $4", `[path %c:\\x%]`},
+
+		// Number formatting.
+		{"large number", `{"field": "id", "operator": "in", "value": [1000000, 12345678901]}`, nil,
+			"subscribers.id::TEXT = ANY($3::TEXT[])", `[{"1000000","12345678901"}]`},
+		{"fraction", `{"field": "attribs.score", "operator": "in", "value": [0.5, -2.25]}`, nil,
+			"subscribers.attribs->>$3::TEXT = ANY($4::TEXT[])", `[score {"0.5","-2.25"}]`},
+		{"small number", `{"field": "attribs.score", "operator": "in", "value": [0.000001]}`, nil,
+			"subscribers.attribs->>$3::TEXT = ANY($4::TEXT[])", `[score {"0.000001"}]`},
+		{"large attrib number", `{"field": "attribs.score", "operator": "gt", "value": 1000000}`, nil,
+			"subscribers.attribs->$3::TEXT > $4::JSONB", "[score 1000000]"},
+	}
+
+	for _, c := range cases {
+		var r Rule
+		if err := json.Unmarshal([]byte(c.rule), &r); err != nil {
+			t.Fatalf("%s: error parsing rule: %v", c.name, err)
+		}
+
+		exp, args, err := Compile(r, 2, c.indexed)
+		if err != nil {
+			t.Errorf("%s: error compiling: %v", c.name, err)
+			continue
+		}
+		if exp != c.exp {
+			t.Errorf("%s: got %q, want %q", c.name, exp, c.exp)
+		}
+		if a := argsString(args); a != c.args {
+			t.Errorf("%s: got args %s, want %s", c.name, a, c.args)
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		rule string
+		err  string
+	}{
+		// Fields and operators that aren't in the allowlists.
+		{"unknown field", `{"field": "password", "operator": "eq", "value": "x"}`, "unknown field"},
+		{"column name", `{"field": "subscribers.email", "operator": "eq", "value": "x"}`, "unknown field"},
+		{"empty field", `{"operator": "eq", "value": "x"}`, "unknown field"},
+		{"unknown operator", `{"field": "email", "operator": "like", "value": "x"}`, "unknown operator"},
+		{"sql operator", `{"field": "email", "operator": "=", "value": "x"}`, "unknown operator"},
+		{"column exists", `{"field": "email", "operator": "exists"}`, "unknown operator"},
+		{"unknown attrib operator", `{"field": "attribs.city", "operator": "regex", "value": "x"}`, "unknown operator"},
+		{"unknown group", `{"group": "xor", "rules": [{"field": "id", "operator": "eq", "value": 1}]}`, "unknown group"},
+
+		// Injection attempts in fields and attribute keys.
+		{"injection field", `{"field": "email = email OR 1=1 --", "operator": "eq", "value": "x"}`, "unknown field"},
+		{"injection key", `{"field": "attribs.city' OR '1'='1", "operator": "eq", "value": "x"}`, "invalid attribute key"},
+		{"key with quote", `{"field": "attribs.a'b", "operator": "exists"}`, "invalid attribute key"},
+		{"key with parens", `{"field": "attribs.a)", "operator": "exists"}`, "invalid attribute key"},
+		{"key with space", `{"field": "attribs.a b", "operator": "exists"}`, "invalid attribute key"},
+		{"empty key", `{"field": "attribs.", "operator": "exists"}`, "invalid attribute key"},
+		{"long key", `{"field": "attribs.` + strings.Repeat("a", 101) + `", "operator": "exists"}`, "invalid attribute key"},
+
+		// Values.
+		{"object value", `{"field": "email", "operator": "eq", "value": {"a": 1}}`, "should be a string"},
+		{"list value", `{"field": "email", "operator": "eq", "value": ["a"]}`, "should be a string"},
+		{"null value", `{"field": "email", "operator": "eq"}`, "should be a string"},
+		{"empty like", `{"field": "email", "operator": "contains", "value": ""}`, "non-empty string"},
+		{"number like", `{"field": "email", "operator": "contains", "value": 1}`, "non-empty string"},
+		{"empty list", `{"field": "id", "operator": "in", "value": []}`, "non-empty list"},
+		{"nested list", `{"field": "id", "operator": "in", "value": [[1]]}`, "should be a string"},
+
+		// Tree structure.
+		{"empty group", `{"group": "and", "rules": []}`, "empty group"},
+		{"group with field", `{"group": "and", "field": "id", "rules": [{"field": "id", "operator": "eq", "value": 1}]}`, "cannot have a field"},
+		{"condition with rules", `{"field": "id", "operator": "eq", "value": 1, "rules": [{"field": "id", "operator": "eq", "value": 1}]}`, "cannot have child rules"},
+		{"too deep", strings.Repeat(`{"group": "and", "rules": [`, maxDepth+1) + `{"field": "id", "operator": "eq", "value": 1}` + strings.Repeat(`]}`, maxDepth+1), "nested too deep"},
+		{"too many", `{"group": "or", "rules": [` + strings.TrimSuffix(strings.Repeat(`{"field": "id", "operator": "eq", "value": 1},`, maxRules), ",") + `]}`, "too many rules"},
+	}
+
+	for _, c := range cases {
+		var r Rule
+		if err := json.Unmarshal([]byte(c.rule), &r); err != nil {
+			t.Fatalf("%s: error parsing rule: %v", c.name, err)
+		}
+
+		exp, _, err := Compile(r, 0, nil)
+		if err == nil {
+			t.Errorf("%s: got %q, want error %q", c.name, exp, c.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), c.err) {
+			t.Errorf("%s: got error %q, want %q", c.name, err, c.err)
+		}
+	}
+}
+
+// argsString returns the positional arguments of an expression as a string.
+func argsString(args []interface{}) string {
+	out := make([]string, 0, len(args))
+	for _, a := range args {
+		if v, ok := a.(driver.Valuer); ok {
+			a, _ = v.Value()
+		}
+		out = append(out, fmt.Sprintf("%v", a))
+	}
+	return "[" + strings.Join(out, " ") + "]"
+}
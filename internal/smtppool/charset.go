@@ -0,0 +1,181 @@
+package smtppool
+
+import (
+	"fmt"
+	"mime"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+// Charsets that messages can be encoded in. Content is always UTF-8 and
+// it's converted to the other charsets when a message is assembled.
+const (
+	CharsetUTF8   = "UTF-8"
+	CharsetLatin1 = "ISO-8859-1"
+	CharsetASCII  = "US-ASCII"
+)
+
+// Content transfer encodings of the text and HTML parts of messages.
+const (
+	EncodingQuotedPrintable = contentEncQuotedPrintable
+	EncodingBase64          = contentEncBase64
+)
+
+// charsetMax is the highest code point that each charset can represent.
+var charsetMax = map[string]rune{
+	CharsetUTF8:   utf8.MaxRune,
+	CharsetLatin1: 0xff,
+	CharsetASCII:  0x7f,
+}
+
+// maxHeaderLineLength is the line length limit of headers (RFC 5322).
+const maxHeaderLineLength = 78
+
+// addrHeaders are the headers whose values are lists of addresses, whose
+// names (but not the addresses) are encoded.
+var addrHeaders = map[string]bool{
+	HdrFrom:    true,
+	HdrTo:      true,
+	HdrCC:      true,
+	HdrReplyTo: true,
+}
+
+// NormalizeEncoding validates a charset and a content transfer encoding and
+// returns their canonical forms. Empty values are UTF-8 and quoted-printable.
+func NormalizeEncoding(charset, encoding string) (string, string, error) {
+	cs := strings.ToUpper(strings.TrimSpace(charset))
+	switch cs {
+	case "":
+		cs = CharsetUTF8
+	case "UTF8":
+		cs = CharsetUTF8
+	case "LATIN1", "LATIN-1":
+		cs = CharsetLatin1
+	case "ASCII":
+		cs = CharsetASCII
+	}
+	if _, ok := charsetMax[cs]; !ok {
+		return "", "", fmt.Errorf("unknown charset '%s'. Should be one of %s, %s, %s",
+			charset, CharsetUTF8, CharsetLatin1, CharsetASCII)
+	}
+
+	enc := strings.ToLower(strings.TrimSpace(encoding))
+	switch enc {
+	case "":
+		enc = EncodingQuotedPrintable
+	case EncodingQuotedPrintable, EncodingBase64:
+	default:
+		return "", "", fmt.Errorf("unknown transfer encoding '%s'. Should be one of %s, %s",
+			encoding, EncodingQuotedPrintable, EncodingBase64)
+	}
+	return cs, enc, nil
+}
+
+// inCharset checks whether a UTF-8 string can be represented in a charset.
+func inCharset(s, charset string) bool {
+	max := charsetMax[charset]
+	if max == utf8.MaxRune {
+		return true
+	}
+	for _, r := range s {
+		if r > max {
+			return false
+		}
+	}
+	return true
+}
+
+// toCharset converts a UTF-8 string that can be represented in a
+// single-byte charset (see inCharset) to the charset.
+func toCharset(s, charset string) []byte {
+	if charset == CharsetUTF8 {
+		return []byte(s)
+	}
+	out := make([]byte, 0, len(s))
+	for _, r := range s {
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+// charset returns the charset that the e-mail is assembled in. E-mails
+// whose content can't be represented in their Charset fall back to UTF-8.
+func (e *Email) charset() string {
+	cs, _, err := NormalizeEncoding(e.Charset, "")
+	if err != nil || cs == CharsetUTF8 {
+		return CharsetUTF8
+	}
+
+	vals := []string{e.Subject, e.From, string(e.Text), string(e.HTML)}
+	vals = append(vals, e.To...)
+	vals = append(vals, e.Cc...)
+	vals = append(vals, e.ReplyTo...)
+	for _, v := range e.Headers {
+		vals = append(vals, v...)
+	}
+	for _, v := range vals {
+		if !inCharset(v, cs) {
+			return CharsetUTF8
+		}
+	}
+	return cs
+}
+
+// encodeHeader returns a header value with encoded-words (RFC 2047) for the
+// non-ASCII text in the charset. Only the display names of addresses are
+// encoded as encoded-words aren't allowed in the addresses.
+func encodeHeader(field, val, charset string, we mime.WordEncoder) string {
+	if !needsEncoding(val) {
+		return val
+	}
+	if !addrHeaders[field] {
+		return foldEncodedWords(field, we.Encode(charset, string(toCharset(val, charset))))
+	}
+
+	list, err := mail.ParseAddressList(val)
+	if err != nil {
+		return foldEncodedWords(field, we.Encode(charset, string(toCharset(val, charset))))
+	}
+
+	out := make([]string, len(list))
+	for i, a := range list {
+		if a.Name == "" || !needsEncoding(a.Name) {
+			// mail.Address quotes names with special characters.
+			out[i] = a.String()
+			continue
+		}
+		out[i] = we.Encode(charset, string(toCharset(a.Name, charset))) + " <" + a.Address + ">"
+	}
+	return strings.Join(out, ", ")
+}
+
+// foldEncodedWords folds a header value of encoded-words, which the word
+// encoders split into words of at most 75 characters, onto a line per word
+// so that long values, eg: subjects with emoji, don't exceed the line length
+// limit (RFC 5322). The words start on the next line if the first one
+// doesn't fit on the line of the field. The whitespace between encoded-words
+// is ignored when they're decoded.
+func foldEncodedWords(field, s string) string {
+	s = strings.ReplaceAll(s, "?= =?", "?=\r\n =?")
+
+	first := s
+	if i := strings.Index(s, "\r\n"); i >= 0 {
+		first = s[:i]
+	}
+	if len(field)+len(": ")+len(first) > maxHeaderLineLength {
+		return "\r\n " + s
+	}
+	return s
+}
+
+// needsEncoding checks whether a string has non-ASCII or control characters,
+// like mime.WordEncoder does.
+func needsEncoding(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if (s[i] < ' ' || s[i] > '~') && s[i] != '\t' {
+			return true
+		}
+	}
+	return false
+}
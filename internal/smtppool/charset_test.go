@@ -0,0 +1,166 @@
+package smtppool
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeEncoding(t *testing.T) {
+	cases := []struct {
+		charset  string
+		encoding string
+		cs       string
+		enc      string
+		err      bool
+	}{
+		{"", "", CharsetUTF8, EncodingQuotedPrintable, false},
+		{"utf8", "BASE64", CharsetUTF8, EncodingBase64, false},
+		{" latin1 ", "quoted-printable", CharsetLatin1, EncodingQuotedPrintable, false},
+		{"iso-8859-1", "", CharsetLatin1, EncodingQuotedPrintable, false},
+		{"ascii", "", CharsetASCII, EncodingQuotedPrintable, false},
+		{"shift_jis", "", "", "", true},
+		{"", "8bit", "", "", true},
+	}
+
+	for _, c := range cases {
+		cs, enc, err := NormalizeEncoding(c.charset, c.encoding)
+		if (err != nil) != c.err {
+			t.Errorf("%q, %q: got error %v, want error: %v", c.charset, c.encoding, err, c.err)
+			continue
+		}
+		if cs != c.cs || enc != c.enc {
+			t.Errorf("%q, %q: got %q, %q, want %q, %q", c.charset, c.encoding, cs, enc, c.cs, c.enc)
+		}
+	}
+}
+
+func TestEncodeHeader(t *testing.T) {
+	cases := []struct {
+		name    string
+		field   string
+		val     string
+		charset string
+		we      mime.WordEncoder
+		out     string
+	}{
+		{"ascii", HdrSubject, "Hello", CharsetUTF8, mime.QEncoding, "Hello"},
+		{"utf-8 q", HdrSubject, "Grüße", CharsetUTF8, mime.QEncoding, "=?UTF-8?q?Gr=C3=BC=C3=9Fe?="},
+		{"utf-8 b", HdrSubject, "Grüße", CharsetUTF8, mime.BEncoding, "=?UTF-8?b?R3LDvMOfZQ==?="},
+		{"latin-1", HdrSubject, "Grüße", CharsetLatin1, mime.QEncoding, "=?ISO-8859-1?q?Gr=FC=DFe?="},
+		{"address name", HdrFrom, "Jörg <jorg@listmonk.app>", CharsetUTF8, mime.QEncoding, "=?UTF-8?q?J=C3=B6rg?= <jorg@listmonk.app>"},
+		{"address list", HdrTo, "Jörg <jorg@listmonk.app>, Ann <ann@listmonk.app>", CharsetUTF8, mime.QEncoding,
+			`=?UTF-8?q?J=C3=B6rg?= <jorg@listmonk.app>, "Ann" <ann@listmonk.app>`},
+	}
+
+	for _, c := range cases {
+		if out := encodeHeader(c.field, c.val, c.charset, c.we); out != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, out, c.out)
+		}
+	}
+}
+
+func TestBytesMultibyte(t *testing.T) {
+	cases := []struct {
+		name     string
+		charset  string
+		encoding string
+		subject  string
+		from     string
+		body     string
+
+		// Charset that the message is expected to be sent in.
+		cs string
+	}{
+		{"utf-8 qp", "", "", "Grüße aus Köln", "Jörg <jorg@listmonk.app>", "Grüße, 日本語 🎉", CharsetUTF8},
+		{"utf-8 base64", "", "base64", "日本語の件名", "山田 <yamada@listmonk.app>", "こんにちは 🎉", CharsetUTF8},
+		{"latin-1 qp", "latin1", "", "Grüße aus Köln", "Jörg <jorg@listmonk.app>", "Grüße, Zoë", CharsetLatin1},
+		{"latin-1 base64", "ISO-8859-1", "base64", "Ça va?", "François <f@listmonk.app>", "À bientôt", CharsetLatin1},
+		{"latin-1 falls back", "latin1", "", "Grüße 🎉", "Jörg <jorg@listmonk.app>", "Grüße", CharsetUTF8},
+		{"ascii falls back", "ascii", "", "Hello", "Jörg <jorg@listmonk.app>", "Hello", CharsetUTF8},
+		{"long subject", "", "", strings.Repeat("🎉 Grüße ", 20), "Jörg <jorg@listmonk.app>", "x", CharsetUTF8},
+	}
+
+	for _, c := range cases {
+		e := Email{
+			From:     c.from,
+			To:       []string{"Zoë <zoe@listmonk.app>"},
+			Subject:  c.subject,
+			Text:     []byte(c.body),
+			Charset:  c.charset,
+			Encoding: c.encoding,
+		}
+		b, err := e.Bytes()
+		if err != nil {
+			t.Errorf("%s: error assembling: %v", c.name, err)
+			continue
+		}
+
+		// Headers are 7-bit and within the line length limit.
+		hdr := b[:bytes.Index(b, []byte("\r\n\r\n"))]
+		for _, l := range strings.Split(string(hdr), "\r\n") {
+			if len(l) > maxHeaderLineLength {
+				t.Errorf("%s: header line is %d characters: %q", c.name, len(l), l)
+			}
+			if needsEncoding(strings.TrimPrefix(l, " ")) {
+				t.Errorf("%s: header line isn't encoded: %q", c.name, l)
+			}
+		}
+
+		m, err := mail.ReadMessage(bytes.NewReader(b))
+		if err != nil {
+			t.Errorf("%s: error parsing: %v", c.name, err)
+			continue
+		}
+
+		dec := new(mime.WordDecoder)
+		if s, err := dec.DecodeHeader(m.Header.Get(HdrSubject)); err != nil || s != c.subject {
+			t.Errorf("%s: got subject %q (%v), want %q", c.name, s, err, c.subject)
+		}
+		from, err := m.Header.AddressList(HdrFrom)
+		if want, _ := mail.ParseAddress(c.from); err != nil || len(from) != 1 || *from[0] != *want {
+			t.Errorf("%s: got from %v (%v), want %v", c.name, from, err, want)
+		}
+		if to, err := m.Header.AddressList(HdrTo); err != nil || len(to) != 1 || to[0].Name != "Zoë" {
+			t.Errorf("%s: got to %v (%v)", c.name, to, err)
+		}
+
+		// The body is in the charset and the transfer encoding.
+		_, params, err := mime.ParseMediaType(m.Header.Get(HdrContentType))
+		if err != nil || params["charset"] != c.cs {
+			t.Errorf("%s: got charset %q (%v), want %q", c.name, params["charset"], err, c.cs)
+			continue
+		}
+		_, enc, _ := NormalizeEncoding(c.charset, c.encoding)
+		if got := m.Header.Get(HdrContentTransferEncoding); got != enc {
+			t.Errorf("%s: got transfer encoding %q, want %q", c.name, got, enc)
+		}
+
+		var raw []byte
+		if enc == EncodingBase64 {
+			raw, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, m.Body))
+		} else {
+			raw, err = ioutil.ReadAll(quotedprintable.NewReader(m.Body))
+		}
+		if err != nil {
+			t.Errorf("%s: error decoding body: %v", c.name, err)
+			continue
+		}
+		body := string(raw)
+		if c.cs == CharsetLatin1 {
+			r := make([]rune, len(raw))
+			for i, ch := range raw {
+				r[i] = rune(ch)
+			}
+			body = string(r)
+		}
+		if body != c.body {
+			t.Errorf("%s: got body %q, want %q", c.name, body, c.body)
+		}
+	}
+}
@@ -0,0 +1,675 @@
+// Package smtppool creates a pool of reusable SMTP connections for high
+// throughput e-mailing.
+//
+// This package was forked from github.com/knadh/smtppool v0.2.0 to
+// support connection options that the upstream package doesn't have.
+package smtppool
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Opt represents SMTP pool options.
+type Opt struct {
+	// Host is the SMTP server's hostname.
+	Host string `json:"host"`
+
+	// Port is the SMTP server port.
+	Port int `json:"port"`
+
+	// HelloHostname is the optional hostname to pass with the HELO command.
+	// Default is "localhost".
+	HelloHostname string `json:"hello_hostname"`
+
+	// LocalAddr is the optional local IP address to bind outgoing
+	// connections to, for instance, to pick the egress IP on hosts
+	// with multiple IPs. By default, the OS picks the address.
+	LocalAddr string `json:"local_addr"`
+
+	// MaxConns is the maximum allowed concurrent SMTP connections.
+	MaxConns int `json:"max_conns"`
+
+	// MaxMessageRetries is the number of times a message should be retried
+	// if sending fails. Default is 2. Min is 1.
+	MaxMessageRetries int `json:"max_msg_retries"`
+
+	// IdleTimeout is the maximum time to wait for new activity on a connection
+	// before closing it and removing it from the pool.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+
+	// PoolWaitTimeout is the maximum time to wait to obtain a connection from
+	// a pool before timing out. This may happen when all open connections are
+	// busy sending e-mails and they're not returning to the pool fast enough.
+	// This is also the timeout used when creating new SMTP connections.
+	PoolWaitTimeout time.Duration `json:"wait_timeout"`
+
+	// KeepAlive is the optional interval after which a connection that's
+	// idling in the pool is checked with a NOOP, both periodically and
+	// before it's borrowed. Connections that fail the check are closed and
+	// replaced. It should be lower than IdleTimeout to have any effect.
+	KeepAlive time.Duration `json:"keepalive"`
+
+	// MaxConnAge is the optional maximum lifetime of a connection after
+	// which it's closed and replaced with a new one once it's idle.
+	MaxConnAge time.Duration `json:"max_conn_age"`
+
+	// SendTimeout is the optional maximum time that sending a message on a
+	// connection (MAIL, RCPT, DATA, and the server's final reply) can take.
+	// It's aborted after it with ErrSendTimeout and the connection is closed.
+	// Unlike IdleTimeout and PoolWaitTimeout, it bounds a single message.
+	SendTimeout time.Duration `json:"send_timeout"`
+
+	// Auth is the smtp.Auth authentication scheme.
+	Auth smtp.Auth
+
+	// TLSConfig is the optional TLS configuration. It's used for STARTTLS
+	// unless SSL is set.
+	TLSConfig *tls.Config
+
+	// SSL connects to the server over implicit TLS (eg: on port 465) with
+	// TLSConfig instead of upgrading the connection with STARTTLS.
+	SSL bool
+
+	// RequireTLS fails connections on which the SMTP session isn't
+	// encrypted, with implicit TLS or STARTTLS, before authenticating.
+	RequireTLS bool `json:"-"`
+
+	// Trace is the optional logger to which the SMTP conversations of the
+	// first few connections of the pool are logged for debugging, eg: the
+	// EHLO response, STARTTLS, AUTH, and every command and its response.
+	// Credentials are redacted and message contents aren't logged.
+	Trace *log.Logger `json:"-"`
+}
+
+// Pool represents an SMTP connection pool.
+type Pool struct {
+	opt          Opt
+	dialer       *net.Dialer
+	conns        chan *conn
+	createdConns int
+	lastActivity time.Time
+	mut          sync.Mutex
+
+	// Number of connections closed for exceeding MaxConnAge and for
+	// failing a keepalive check.
+	recycledConns int64
+	staleConns    int64
+
+	// Number of messages that were aborted for exceeding SendTimeout.
+	timedOut int64
+
+	// Number of connections that were traced.
+	tracedConns int
+
+	// stopBorrow signals all waiting borrowCon() calls on the pool to
+	// immediately return an ErrPoolClosed.
+	stopBorrow chan bool
+
+	// closed marks the pool as closed.
+	closed bool
+}
+
+// conn represents an AMTP client connection in the pool.
+type conn struct {
+	conn   *smtp.Client
+	netCon net.Conn
+	numErr int
+
+	// lastActivity records the time when the last message on this client
+	// was sent. Used for sweeping and disconnecting idle connections.
+	lastActivity time.Time
+
+	// createdAt is the time the connection was opened and lastCheck,
+	// the time it was last sent a message or a keepalive NOOP.
+	createdAt time.Time
+	lastCheck time.Time
+}
+
+// LoginAuth is the SMTP "LOGIN" type implementation for smtp.Auth.
+type LoginAuth struct {
+	Username string
+	Password string
+}
+
+// ErrPoolClosed is thrown when a closed Pool is used.
+var ErrPoolClosed = errors.New("pool closed")
+
+// ErrSendTimeout is returned, wrapped, when sending a message exceeds
+// Opt.SendTimeout. It isn't retried on the pool as the server is likely
+// to be as slow on another connection.
+var ErrSendTimeout = errors.New("timed out sending message")
+
+// New initializes and returns a new SMTP Pool.
+func New(o Opt) (*Pool, error) {
+	if o.MaxConns < 1 {
+		return nil, errors.New("MaxConns should be >= 1")
+	}
+	if o.MaxMessageRetries == 0 {
+		o.MaxMessageRetries = 2
+	}
+	if o.PoolWaitTimeout.Seconds() < 1 {
+		o.PoolWaitTimeout = time.Second * 2
+	}
+	if o.SSL && o.TLSConfig == nil {
+		o.TLSConfig = &tls.Config{ServerName: o.Host}
+	}
+
+	p := &Pool{
+		opt:        o,
+		dialer:     &net.Dialer{Timeout: o.PoolWaitTimeout},
+		conns:      make(chan *conn, o.MaxConns),
+		stopBorrow: make(chan bool),
+	}
+
+	// Bind outgoing connections to the local address.
+	if o.LocalAddr != "" {
+		addr, err := resolveLocalAddr(o.LocalAddr)
+		if err != nil {
+			return nil, err
+		}
+		p.dialer.LocalAddr = addr
+	}
+
+	// Start the idle connection sweeper.
+	if p.sweeps() {
+		go p.sweepConns(time.Second * 2)
+	}
+	return p, nil
+}
+
+// Send sends an e-mail using an available connection in the pool.
+// On error, the message is retried on a new connection.
+func (p *Pool) Send(e Email) error {
+	// Get a connection from the pool.
+	var lastErr error
+	for i := 0; i < p.opt.MaxMessageRetries; i++ {
+		c, err := p.borrowConn()
+		if err != nil {
+			return err
+		}
+
+		// Send the message.
+		canRetry, err := c.send(e, p.opt.SendTimeout)
+		if err == nil {
+			_ = p.returnConn(c, nil)
+			return nil
+		}
+		if isTimeout(err) {
+			p.mut.Lock()
+			p.timedOut++
+			p.mut.Unlock()
+
+			err = fmt.Errorf("%w after %s: %v", ErrSendTimeout, p.opt.SendTimeout, err)
+			canRetry = false
+		}
+		lastErr = err
+
+		// Not a retriable error.
+		_ = p.returnConn(c, err)
+		if !canRetry {
+			return err
+		}
+	}
+	return lastErr
+}
+
+// Conns returns the number of open connections in the pool, including
+// the ones being opened.
+func (p *Pool) Conns() int {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.createdConns
+}
+
+// Recycled returns the number of connections that were closed and replaced
+// for exceeding MaxConnAge (recycled) and for failing a keepalive check (stale).
+func (p *Pool) Recycled() (recycled, stale int64) {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.recycledConns, p.staleConns
+}
+
+// TimedOut returns the number of messages that were aborted for exceeding
+// SendTimeout.
+func (p *Pool) TimedOut() int64 {
+	p.mut.Lock()
+	defer p.mut.Unlock()
+	return p.timedOut
+}
+
+// Close closes the pool.
+func (p *Pool) Close() {
+	p.mut.Lock()
+	p.closed = true
+	p.mut.Unlock()
+	close(p.stopBorrow)
+
+	// If the sweeper isn't already running, run it.
+	if !p.sweeps() {
+		p.sweepConns(time.Second * 1)
+	}
+}
+
+// newConn creates a new SMTP client connection that can be added to the pool.
+func (p *Pool) newConn() (cn *conn, err error) {
+	netCon, err := p.dialer.Dial("tcp",
+		net.JoinHostPort(p.opt.Host, strconv.Itoa(p.opt.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	// Implicit TLS. The handshake is done upfront to fail early.
+	if p.opt.SSL {
+		tlsCon := tls.Client(netCon, p.opt.TLSConfig)
+		tlsCon.SetDeadline(time.Now().Add(p.opt.PoolWaitTimeout))
+		if err := tlsCon.Handshake(); err != nil {
+			netCon.Close()
+			return nil, err
+		}
+		tlsCon.SetDeadline(time.Time{})
+		netCon = tlsCon
+	}
+
+	// Trace the first few connections above the implicit TLS, if any.
+	var tc *traceConn
+	if p.opt.Trace != nil {
+		p.mut.Lock()
+		if p.tracedConns < traceConns {
+			p.tracedConns++
+			tc = newTraceConn(netCon, p.opt.Trace, fmt.Sprintf("%s:%d #%d", p.opt.Host, p.opt.Port, p.tracedConns))
+		}
+		p.mut.Unlock()
+	}
+	if tc != nil {
+		tc.note("connected to %s from %s", netCon.RemoteAddr(), netCon.LocalAddr())
+		if t, ok := netCon.(*tls.Conn); ok {
+			tc.noteTLS(t)
+		}
+		netCon = tc
+	}
+
+	// Connect to the SMTP server
+	sm, err := smtp.NewClient(netCon, p.opt.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	// The return values are named so that the errors from multiple points
+	// here on are captured and the connection closed.
+	defer func() {
+		if err != nil {
+			sm.Close()
+		}
+	}()
+
+	// Is there a custom hostname for doing a HELLO with the SMTP server?
+	if p.opt.HelloHostname != "" {
+		sm.Hello(p.opt.HelloHostname)
+	}
+
+	// Optional STARTTLS.
+	if p.opt.TLSConfig != nil && !p.opt.SSL {
+		if ok, _ := sm.Extension("STARTTLS"); !ok {
+			return nil, errors.New("SMTP STARTTLS extension not found")
+		}
+		if tc != nil {
+			sm2, err := tc.startTLS(sm, p.opt.Host, p.opt.HelloHostname, p.opt.TLSConfig)
+			if err != nil {
+				return nil, err
+			}
+			sm = sm2
+		} else if err := sm.StartTLS(p.opt.TLSConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	// Traced connections are encrypted if they're TLS underneath.
+	_, isTLS := sm.TLSConnectionState()
+	if tc != nil {
+		_, isTLS = tc.Conn.(*tls.Conn)
+	}
+	if p.opt.RequireTLS && !isTLS {
+		return nil, errors.New("SMTP session isn't encrypted but TLS is required")
+	}
+
+	// Optional auth.
+	if p.opt.Auth != nil {
+		ok, mechs := sm.Extension("AUTH")
+		if !ok {
+			return nil, errors.New("SMTP AUTH extension not found")
+		}
+
+		auth := p.opt.Auth
+		if tc != nil {
+			if isTLS {
+				auth = tlsAuth{auth}
+			}
+			tc.note("AUTH mechanisms advertised: %s", mechs)
+		}
+		if err := sm.Auth(auth); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	return &conn{
+		conn:      sm,
+		netCon:    netCon,
+		createdAt: now,
+		lastCheck: now,
+	}, nil
+}
+
+// borrowConn borrows a connection from the pool.
+func (p *Pool) borrowConn() (*conn, error) {
+	// If there are no connections in the pool and if there is room for new
+	// connections, create a new connection. Locks are used ad-hoc to avoid
+	// locking when IO bound newConn() is happening.
+	p.mut.Lock()
+	switch {
+	case p.closed:
+		p.mut.Unlock()
+		return nil, ErrPoolClosed
+	case p.createdConns <= p.opt.MaxConns && len(p.conns) == 0:
+		p.createdConns++
+		p.mut.Unlock()
+		return p.newConn()
+	default:
+		p.mut.Unlock()
+	}
+
+	select {
+	case c := <-p.conns:
+		// Replace aged or dead connections instead of handing them out.
+		if !p.checkConn(c) {
+			return p.borrowConn()
+		}
+		return c, nil
+	case <-p.stopBorrow:
+		return nil, ErrPoolClosed
+	case <-time.After(p.opt.PoolWaitTimeout):
+		return nil, errors.New("timed out waiting for free conn in pool")
+	}
+}
+
+// checkConn checks whether an idle connection from the pool can be used.
+// Connections older than MaxConnAge are closed, and ones that have been
+// idling longer than KeepAlive are sent a NOOP and closed if it fails.
+// It returns false if the connection was closed.
+func (p *Pool) checkConn(c *conn) bool {
+	switch {
+	case p.opt.MaxConnAge > 0 && time.Since(c.createdAt) > p.opt.MaxConnAge:
+		p.mut.Lock()
+		p.createdConns--
+		p.recycledConns++
+		p.mut.Unlock()
+
+		c.netCon.SetDeadline(time.Now().Add(p.opt.PoolWaitTimeout))
+		_ = c.conn.Quit()
+		return false
+
+	case p.opt.KeepAlive > 0 && time.Since(c.lastCheck) > p.opt.KeepAlive:
+		// A dead connection may never respond, so the NOOP is bound
+		// by the wait timeout.
+		c.netCon.SetDeadline(time.Now().Add(p.opt.PoolWaitTimeout))
+		err := c.conn.Noop()
+		c.netCon.SetDeadline(time.Time{})
+		if err != nil {
+			p.mut.Lock()
+			p.createdConns--
+			p.staleConns++
+			p.mut.Unlock()
+
+			_ = c.conn.Close()
+			return false
+		}
+		c.lastCheck = time.Now()
+	}
+	return true
+}
+
+// sweeps checks whether the pool's options require the connection sweeper.
+func (p *Pool) sweeps() bool {
+	return p.opt.IdleTimeout.Seconds() >= 1 || p.opt.KeepAlive.Seconds() >= 1 ||
+		p.opt.MaxConnAge.Seconds() >= 1
+}
+
+// returnConn returns connection to the pool based on the error from the last
+// transaction on it.
+func (p *Pool) returnConn(c *conn, lastErr error) (err error) {
+	// If the function returns an error, that it means it's a bad connection
+	// and should be closed and not added back to the pool.
+	defer func() {
+		if err != nil {
+			p.mut.Lock()
+			p.createdConns--
+			p.mut.Unlock()
+			c.conn.Close()
+		}
+	}()
+
+	if lastErr != nil {
+		// Any error, except for textproto.Error (according to jordan-wright/email),
+		// is a bad connection that should be killed.
+		if _, ok := lastErr.(*textproto.Error); !ok {
+			return lastErr
+		}
+	}
+
+	select {
+	case p.conns <- c:
+		return nil
+	case <-time.After(p.opt.PoolWaitTimeout):
+		return errors.New("timed out returning connection to pool")
+	case <-p.stopBorrow:
+		return ErrPoolClosed
+	}
+}
+
+// sweepConns periodically sweeps through connections and closes that have not
+// any activity in Opt.IdleTimeout time, and checks the rest with checkConn().
+// This is a blocking function and should be run as a goroutine.
+func (p *Pool) sweepConns(interval time.Duration) {
+	activeConns := make([]*conn, cap(p.conns))
+	for {
+		<-time.After(interval)
+		activeConns = activeConns[:0]
+
+		// The number of conns in the channel are the ones that are potentially
+		// idling. Iterate through them and examine their activity timestamp.
+		p.mut.Lock()
+		var (
+			num          = len(p.conns)
+			createdConns = p.createdConns
+			closed       = p.closed
+		)
+		p.mut.Unlock()
+
+		if closed && createdConns == 0 {
+			// If the pool is closed and there are no more connections, exit
+			// the sweeper.
+			return
+		}
+
+		for i := 0; i < num; i++ {
+			var c *conn
+
+			// Pick a connection to check from the pool.
+			select {
+			case c = <-p.conns:
+			default:
+				continue
+			}
+
+			if closed || (p.opt.IdleTimeout.Seconds() >= 1 && time.Since(c.lastActivity) > p.opt.IdleTimeout) {
+				// If the pool is closed or the the connection is idling,
+				// close the conn.
+				p.mut.Lock()
+				p.createdConns--
+				p.mut.Unlock()
+
+				// Unlock mutex before blockong on IO.
+				if closed {
+					_ = c.conn.Quit()
+				} else {
+					_ = c.conn.Close()
+				}
+
+				continue
+			}
+
+			if !p.checkConn(c) {
+				continue
+			}
+			activeConns = append(activeConns, c)
+		}
+
+		// Put the active conns back in the pool.
+		for _, c := range activeConns {
+			select {
+			case p.conns <- c:
+			default:
+				_ = c.conn.Close()
+				p.mut.Lock()
+				p.createdConns--
+				p.mut.Unlock()
+			}
+		}
+	}
+}
+
+// send sends a message using the connection within the optional timeout.
+// The bool in the return indicates if the message can be retried in case of
+// an SMTP related error.
+func (c *conn) send(e Email, timeout time.Duration) (bool, error) {
+	c.lastActivity = time.Now()
+	c.lastCheck = c.lastActivity
+
+	// The timeout bounds the whole transaction of the message.
+	if timeout > 0 {
+		c.netCon.SetDeadline(c.lastActivity.Add(timeout))
+		defer c.netCon.SetDeadline(time.Time{})
+	}
+
+	// Combile e-mail addresses from multiple lists.
+	emails, err := combineEmails(e.To, e.Cc, e.Bcc)
+	if err != nil {
+		return false, err
+	}
+
+	// Extract the envelope sender e-mail from the address.
+	from, err := e.parseSender()
+	if err != nil {
+		return false, err
+	}
+
+	// Send the Mail command.
+	if err = c.conn.Mail(from); err != nil {
+		return true, err
+	}
+
+	// Send RCPT for all receipients.
+	for _, recip := range emails {
+		if err = c.conn.Rcpt(recip); err != nil {
+			return true, err
+		}
+	}
+
+	// Get raw message payload.
+	msg, err := e.Bytes()
+	if err != nil {
+		return false, err
+	}
+
+	// Write the message. Closing the writer reads the server's reply
+	// to the message.
+	w, err := c.conn.Data()
+	if err != nil {
+		return true, err
+	}
+	if _, err = w.Write(msg); err != nil {
+		w.Close()
+		return true, err
+	}
+	if err := w.Close(); err != nil {
+		return true, err
+	}
+	return false, nil
+}
+
+// isTimeout checks whether an error is a network timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// Start starts the SMTP LOGIN auth type.
+// https://gist.github.com/andelf/5118732
+func (a *LoginAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	return "LOGIN", []byte{}, nil
+}
+
+// Next passes the credentials for SMTP LOGIN auth type.
+func (a *LoginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+	switch string(fromServer) {
+	case "Username:":
+		return []byte(a.Username), nil
+	case "Password:":
+		return []byte(a.Password), nil
+	default:
+		return nil, errors.New("unkown SMTP fromServer")
+	}
+}
+
+// resolveLocalAddr parses a local IP address to bind outgoing connections
+// to and checks that it's assignable on the host by listening on it on a
+// random port.
+func resolveLocalAddr(ip string) (*net.TCPAddr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(ip)}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("invalid local_addr '%s'", ip)
+	}
+
+	l, err := net.ListenTCP("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("local_addr '%s' is not assignable on the host: %v", ip, err)
+	}
+	l.Close()
+	return addr, nil
+}
+
+// combineEmails takes multiple lists of e-mails, parses them, and combines
+// them into a single list.
+func combineEmails(lists ...[]string) ([]string, error) {
+	ln := 0
+	for _, l := range lists {
+		ln += len(l)
+	}
+
+	out := make([]string, 0, ln)
+	for _, l := range lists {
+		for _, email := range l {
+			// Parse the e-mail out of the address string.
+			// Eg: a@a.com out of John Doe <a@a.com>.
+			addr, err := mail.ParseAddress(email)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, addr.Address)
+		}
+	}
+	return out, nil
+}
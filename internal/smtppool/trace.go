@@ -0,0 +1,239 @@
+package smtppool
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+)
+
+const (
+	// traceConns is the number of the connections of a pool whose SMTP
+	// conversations are traced. Connections opened after are not traced.
+	traceConns = 5
+
+	// traceLines is the maximum number of lines that are logged per
+	// traced connection.
+	traceLines = 200
+)
+
+// tlsVersionNames are the names of TLS versions in traces.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS10: "1.0",
+	tls.VersionTLS11: "1.1",
+	tls.VersionTLS12: "1.2",
+	tls.VersionTLS13: "1.3",
+}
+
+// traceConn is a net.Conn that logs the SMTP commands that are written to it
+// and the responses that are read from it, line by line. The credentials of
+// AUTH exchanges are redacted and message contents (DATA) aren't logged.
+type traceConn struct {
+	net.Conn
+
+	log    *log.Logger
+	prefix string
+	lines  int
+
+	// Partial lines of the incomplete reads and writes.
+	rbuf, wbuf []byte
+
+	// auth is set between an AUTH command and its final response, and data,
+	// between the 354 response to DATA and the terminating "." line.
+	auth      bool
+	data      bool
+	dataLines int
+
+	// pending is read before the connection, eg: a fake greeting that a new
+	// smtp.Client expects after STARTTLS.
+	pending []byte
+
+	mut sync.Mutex
+}
+
+// newTraceConn returns a traceConn that logs with the given log prefix.
+func newTraceConn(c net.Conn, l *log.Logger, prefix string) *traceConn {
+	return &traceConn{Conn: c, log: l, prefix: prefix}
+}
+
+// Read reads from the connection and logs the complete response lines.
+func (c *traceConn) Read(b []byte) (int, error) {
+	c.mut.Lock()
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		c.mut.Unlock()
+		return n, nil
+	}
+	c.mut.Unlock()
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.mut.Lock()
+		c.rbuf = c.logLines(c.rbuf, b[:n], c.logResponse)
+		c.mut.Unlock()
+	}
+	return n, err
+}
+
+// Write logs the complete command lines and writes them to the connection.
+func (c *traceConn) Write(b []byte) (int, error) {
+	c.mut.Lock()
+	c.wbuf = c.logLines(c.wbuf, b, c.logCommand)
+	c.mut.Unlock()
+	return c.Conn.Write(b)
+}
+
+// note logs a message that isn't part of the conversation, eg: the result of
+// a TLS handshake.
+func (c *traceConn) note(format string, args ...interface{}) {
+	c.mut.Lock()
+	c.print("* " + fmt.Sprintf(format, args...))
+	c.mut.Unlock()
+}
+
+// logLines appends b to the partial line in buf, logs the complete lines
+// with fn, and returns the remaining partial line.
+func (c *traceConn) logLines(buf, b []byte, fn func(string)) []byte {
+	buf = append(buf, b...)
+	for {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			break
+		}
+		fn(strings.TrimRight(string(buf[:i]), "\r"))
+		buf = buf[i+1:]
+	}
+
+	// Don't hold on to the backing array of large writes.
+	if len(buf) == 0 {
+		return nil
+	}
+	return append([]byte(nil), buf...)
+}
+
+// logCommand logs a command line written by the client.
+func (c *traceConn) logCommand(l string) {
+	switch {
+	case c.data:
+		if l == "." {
+			c.data = false
+			c.print(fmt.Sprintf("C: <message: %d lines>", c.dataLines))
+			c.print("C: .")
+			return
+		}
+		c.dataLines++
+		return
+
+	case c.auth:
+		c.print("C: <redacted>")
+		return
+	}
+
+	// AUTH PLAIN sends the credentials with the command.
+	if f := strings.Fields(l); len(f) > 0 && strings.EqualFold(f[0], "AUTH") {
+		c.auth = true
+		if len(f) > 2 {
+			l = f[0] + " " + f[1] + " <redacted>"
+		}
+	}
+	c.print("C: " + l)
+}
+
+// logResponse logs a response line read from the server.
+func (c *traceConn) logResponse(l string) {
+	if len(l) >= 3 && (len(l) == 3 || l[3] == ' ') {
+		switch {
+		case l[:3] == "354":
+			c.data = true
+			c.dataLines = 0
+		case c.auth && l[0] != '3':
+			c.auth = false
+		}
+	}
+	c.print("S: " + l)
+}
+
+// print logs a line until the connection's line limit is reached.
+func (c *traceConn) print(l string) {
+	if c.lines > traceLines {
+		return
+	}
+	c.lines++
+	if c.lines > traceLines {
+		c.log.Printf("%s: trace truncated after %d lines", c.prefix, traceLines)
+		return
+	}
+	c.log.Printf("%s: %s", c.prefix, l)
+}
+
+// startTLS upgrades a traced connection with STARTTLS and returns a new
+// smtp.Client on it. Unlike smtp.Client.StartTLS, which wraps the traced
+// connection, the TLS connection is swapped underneath it so that the rest
+// of the conversation is logged in the clear.
+func (c *traceConn) startTLS(sm *smtp.Client, host, helloHost string, cfg *tls.Config) (*smtp.Client, error) {
+	id, err := sm.Text.Cmd("STARTTLS")
+	if err != nil {
+		return nil, err
+	}
+	sm.Text.StartResponse(id)
+	_, _, err = sm.Text.ReadResponse(220)
+	sm.Text.EndResponse(id)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsCon := tls.Client(c.Conn, cfg)
+	if err := tlsCon.Handshake(); err != nil {
+		c.note("TLS handshake failed: %v", err)
+		return nil, err
+	}
+	c.noteTLS(tlsCon)
+
+	// smtp.NewClient reads the greeting, which isn't sent again after
+	// STARTTLS. The client then sends EHLO again over TLS as it should.
+	c.mut.Lock()
+	c.Conn = tlsCon
+	c.pending = []byte("220 " + host + "\r\n")
+	c.mut.Unlock()
+
+	sm2, err := smtp.NewClient(c, host)
+	if err != nil {
+		return nil, err
+	}
+	if helloHost != "" {
+		if err := sm2.Hello(helloHost); err != nil {
+			return nil, err
+		}
+	}
+	return sm2, nil
+}
+
+// noteTLS logs the negotiated parameters of a TLS connection.
+func (c *traceConn) noteTLS(tc *tls.Conn) {
+	st := tc.ConnectionState()
+	v, ok := tlsVersionNames[st.Version]
+	if !ok {
+		v = fmt.Sprintf("0x%04x", st.Version)
+	}
+	c.note("TLS %s established (cipher %s)", v, tls.CipherSuiteName(st.CipherSuite))
+}
+
+// tlsAuth is an smtp.Auth that tells the scheme that the connection is
+// encrypted. smtp.Client only knows it for the connections that are
+// *tls.Conn, which traced connections aren't, and smtp.PlainAuth refuses
+// to send credentials over connections that it thinks are unencrypted.
+type tlsAuth struct {
+	smtp.Auth
+}
+
+// Start starts the wrapped authentication scheme.
+func (a tlsAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	s := *server
+	s.TLS = true
+	return a.Auth.Start(&s)
+}
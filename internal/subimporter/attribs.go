@@ -0,0 +1,135 @@
+package subimporter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/models"
+)
+
+var (
+	// E.164: a + followed by the country code and up to 15 digits in all.
+	regexE164 = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+
+	// Separators that are stripped from phone numbers.
+	regexPhoneSep = regexp.MustCompile(`[\s\-.()/]`)
+
+	// BCP 47 language tags: language[-script][-region][-variant...]
+	// eg: en, pt-BR, zh-Hant-TW, de-CH-1996.
+	regexLocale = regexp.MustCompile(`^[a-z]{2,3}(-[a-z]{4})?(-([a-z]{2}|[0-9]{3}))?(-([a-z0-9]{5,8}|[0-9][a-z0-9]{3}))*$`)
+)
+
+// AttribRules are the subscriber attributes that are normalized on
+// subscriber creation, updates, and imports. Invalid values are rejected
+// instead of being stored.
+type AttribRules struct {
+	// Phones are the attributes with phone numbers that are normalized
+	// to E.164 (eg: +4915112345678).
+	Phones []string
+
+	// CountryCode is the calling code (eg: 49) of phone numbers that aren't
+	// in the international format, whose leading trunk 0, if any, is dropped.
+	// Such numbers are invalid if it's empty.
+	CountryCode string
+
+	// Locales are the attributes with BCP 47 language tags that are
+	// validated and canonicalized (eg: pt_br => pt-BR).
+	Locales []string
+}
+
+// Normalize normalizes the attributes of a subscriber in place. It returns
+// an error on the first invalid value. A nil *AttribRules is a no-op.
+func (r *AttribRules) Normalize(a models.SubscriberAttribs) error {
+	if r == nil || len(a) == 0 {
+		return nil
+	}
+
+	for _, k := range r.Phones {
+		v, ok := attribString(a, k)
+		if !ok {
+			continue
+		}
+		p, err := NormalizePhone(v, r.CountryCode)
+		if err != nil {
+			return fmt.Errorf("invalid phone number in attribute '%s': %v", k, err)
+		}
+		a[k] = p
+	}
+
+	for _, k := range r.Locales {
+		v, ok := attribString(a, k)
+		if !ok {
+			continue
+		}
+		l, err := NormalizeLocale(v)
+		if err != nil {
+			return fmt.Errorf("invalid locale in attribute '%s': %v", k, err)
+		}
+		a[k] = l
+	}
+	return nil
+}
+
+// attribString returns the non-empty value of an attribute as a string.
+// Numbers (eg: phone numbers without a +) are formatted as integers.
+func attribString(a models.SubscriberAttribs, k string) (string, bool) {
+	switch v := a[k].(type) {
+	case string:
+		v = strings.TrimSpace(v)
+		return v, v != ""
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case nil:
+		return "", false
+	default:
+		return fmt.Sprintf("%v", v), true
+	}
+}
+
+// NormalizePhone normalizes a phone number to E.164. Numbers that aren't in
+// the international format (+ or 00) are prefixed with the country code.
+func NormalizePhone(s, countryCode string) (string, error) {
+	n := regexPhoneSep.ReplaceAllString(s, "")
+	switch {
+	case strings.HasPrefix(n, "+"):
+	case strings.HasPrefix(n, "00"):
+		n = "+" + n[2:]
+	case countryCode != "":
+		n = "+" + strings.TrimPrefix(countryCode, "+") + strings.TrimPrefix(n, "0")
+	default:
+		return "", fmt.Errorf("'%s' isn't in the international format", s)
+	}
+
+	if !regexE164.MatchString(n) {
+		return "", fmt.Errorf("'%s' isn't a valid number", s)
+	}
+	return n, nil
+}
+
+// NormalizeLocale validates a BCP 47 language tag (underscores are accepted
+// as separators) and returns it in the canonical case, eg: zh_hant_tw =>
+// zh-Hant-TW.
+func NormalizeLocale(s string) (string, error) {
+	l := strings.ToLower(strings.ReplaceAll(s, "_", "-"))
+	if !regexLocale.MatchString(l) {
+		return "", fmt.Errorf("'%s' isn't a valid language tag", s)
+	}
+
+	parts := strings.Split(l, "-")
+	for i, p := range parts {
+		if i == 0 {
+			continue
+		}
+		switch {
+		case len(p) == 4 && i == 1 && p[0] >= 'a':
+			// Script.
+			parts[i] = strings.ToUpper(p[:1]) + p[1:]
+		case len(p) == 2:
+			// Region.
+			parts[i] = strings.ToUpper(p)
+		}
+	}
+	return strings.Join(parts, "-"), nil
+}
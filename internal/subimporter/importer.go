@@ -21,6 +21,8 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/knadh/listmonk/models"
@@ -31,8 +33,9 @@ const (
 	// stdInputMaxLen is the maximum allowed length for a standard input field.
 	stdInputMaxLen = 200
 
-	// commitBatchSize is the number of inserts to commit in a single SQL transaction.
-	commitBatchSize = 10000
+	// defaultBatchSize is the default number of records to insert in a single
+	// multi-row SQL query.
+	defaultBatchSize = 5000
 )
 
 // Various import statuses.
@@ -47,6 +50,43 @@ const (
 	ModeBlacklist = "blacklist"
 )
 
+// Policies for subscribers in the subscribe mode that already exist.
+// They're matched by their lowercased e-mails.
+const (
+	// ConflictSkip leaves the name and attributes of existing subscribers
+	// untouched.
+	ConflictSkip = "skip"
+
+	// ConflictOverwrite replaces the name and attributes.
+	ConflictOverwrite = "overwrite"
+
+	// ConflictMerge replaces the name and merges the attributes with the
+	// existing ones, the imported keys taking precedence.
+	ConflictMerge = "merge"
+
+	// ListsAdd subscribes existing subscribers to the import's lists
+	// retaining their other subscriptions.
+	ListsAdd = "add"
+
+	// ListsReplace removes subscriptions to lists other than the import's.
+	ListsReplace = "replace"
+)
+
+// Policies for records in the subscribe mode that match suppressed
+// subscribers: blacklisted ones, ones that have reported a message as spam,
+// and ones that have unsubscribed from one of the import's lists.
+const (
+	// SuppressSkip doesn't import the records.
+	SuppressSkip = "skip"
+
+	// SuppressFlag imports the records and reports them.
+	SuppressFlag = "flag"
+
+	// SuppressNone doesn't check the records, eg: for imports that
+	// re-subscribe people with fresh consent.
+	SuppressNone = "none"
+)
+
 // Importer represents the bulk CSV subscriber import system.
 type Importer struct {
 	opt Options
@@ -54,6 +94,10 @@ type Importer struct {
 
 	stop   chan bool
 	status Status
+
+	// queued is set when an import is queued to start in the background
+	// and the importer is reserved for it.
+	queued bool
 	sync.RWMutex
 }
 
@@ -61,8 +105,34 @@ type Importer struct {
 type Options struct {
 	UpsertStmt         *sql.Stmt
 	BlacklistStmt      *sql.Stmt
+	UpsertBatchStmt    *sql.Stmt
+	BlacklistBatchStmt *sql.Stmt
 	UpdateListDateStmt *sql.Stmt
+	SuppressedStmt     *sql.Stmt
 	NotifCB            models.AdminNotifCallback
+
+	// BatchCB is an optional callback that's called with the e-mails of
+	// the subscribers in every batch that's committed in the subscribe mode.
+	BatchCB func(emails []string)
+
+	// BlacklistCB is an optional callback that's called with the UUIDs of
+	// the existing subscribers that were blacklisted in every batch that's
+	// committed in the blacklist mode.
+	BlacklistCB func(uuids []string)
+
+	// BatchSize is the number of records that are inserted into the DB
+	// with a single multi-row query.
+	BatchSize int
+
+	// Concurrency is the number of workers that parse and validate the
+	// rows of files, and the number of workers that commit batches to the
+	// DB, each over a connection of its own. Records are committed in no
+	// particular order.
+	Concurrency int
+
+	// Attribs are the optional normalization rules of attributes. Records
+	// with invalid values are skipped.
+	Attribs *AttribRules
 }
 
 // Session represents a single import session.
@@ -71,9 +141,11 @@ type Session struct {
 	subQueue chan SubReq
 	log      *log.Logger
 
-	mode      string
-	overwrite bool
-	listIDs   []int
+	mode        string
+	conflict    string
+	listMode    string
+	suppression string
+	listIDs     []int
 }
 
 // Status reporesents statistics from an ongoing import session.
@@ -82,7 +154,24 @@ type Status struct {
 	Total    int    `json:"total"`
 	Imported int    `json:"imported"`
 	Status   string `json:"status"`
-	logBuf   *bytes.Buffer
+
+	// Breakdown of the imported records in the subscribe mode by whether
+	// they were new subscribers or existing ones that were updated or
+	// skipped by the conflict policy.
+	Inserted int `json:"inserted"`
+	Updated  int `json:"updated"`
+	Skipped  int `json:"skipped"`
+
+	// Suppressed is the number of records that matched suppressed
+	// subscribers. They're among the imported records if the suppression
+	// policy is to flag them.
+	Suppressed int `json:"suppressed"`
+
+	// Rate is the import throughput in records per second.
+	Rate float64 `json:"rate"`
+
+	logBuf    *bytes.Buffer
+	startedAt time.Time
 }
 
 // SubReq is a wrapper over the Subscriber model.
@@ -93,10 +182,14 @@ type SubReq struct {
 }
 
 type importStatusTpl struct {
-	Name     string
-	Status   string
-	Imported int
-	Total    int
+	Name       string
+	Status     string
+	Imported   int
+	Total      int
+	Inserted   int
+	Updated    int
+	Skipped    int
+	Suppressed int
 }
 
 var (
@@ -117,6 +210,13 @@ var (
 
 // New returns a new instance of Importer.
 func New(opt Options, db *sql.DB) *Importer {
+	if opt.BatchSize < 1 {
+		opt.BatchSize = defaultBatchSize
+	}
+	if opt.Concurrency < 1 {
+		opt.Concurrency = 1
+	}
+
 	im := Importer{
 		opt:    opt,
 		stop:   make(chan bool, 1),
@@ -128,30 +228,52 @@ func New(opt Options, db *sql.DB) *Importer {
 
 // NewSession returns an new instance of Session. It takes the name
 // of the uploaded file, but doesn't do anything with it but retains it for stats.
-func (im *Importer) NewSession(fName, mode string, overWrite bool, listIDs []int) (*Session, error) {
-	if im.getStatus() != StatusNone {
+// conflict (Conflict*) and listMode (Lists*) are the policies for existing
+// subscribers in the subscribe mode and suppression (Suppress*) is the policy
+// for suppressed ones.
+func (im *Importer) NewSession(fName, mode, conflict, listMode, suppression string, listIDs []int) (*Session, error) {
+	im.Lock()
+	if im.status.Status != StatusNone && !im.queued {
+		im.Unlock()
 		return nil, errors.New("an import is already running")
 	}
-
-	im.Lock()
+	im.queued = false
 	im.status = Status{Status: StatusImporting,
-		Name:   fName,
-		logBuf: bytes.NewBuffer(nil)}
+		Name:      fName,
+		logBuf:    bytes.NewBuffer(nil),
+		startedAt: time.Now()}
 	im.Unlock()
 
 	s := &Session{
-		im:        im,
-		log:       log.New(im.status.logBuf, "", log.Ldate|log.Ltime),
-		subQueue:  make(chan SubReq, commitBatchSize),
-		mode:      mode,
-		overwrite: overWrite,
-		listIDs:   listIDs,
+		im:          im,
+		log:         log.New(im.status.logBuf, "", log.Ldate|log.Ltime),
+		subQueue:    make(chan SubReq, im.opt.BatchSize),
+		mode:        mode,
+		conflict:    conflict,
+		listMode:    listMode,
+		suppression: suppression,
+		listIDs:     listIDs,
 	}
 
 	s.log.Printf("processing '%s'", fName)
 	return s, nil
 }
 
+// Queue reserves the importer for an import that's queued to start in the
+// background. The importer reports the import as running until its session
+// is started with NewSession or it's stopped.
+func (im *Importer) Queue(fName string) error {
+	im.Lock()
+	defer im.Unlock()
+
+	if im.status.Status != StatusNone {
+		return ErrIsImporting
+	}
+	im.status = Status{Status: StatusImporting, Name: fName, logBuf: bytes.NewBuffer(nil)}
+	im.queued = true
+	return nil
+}
+
 // GetStats returns the global Stats of the importer.
 func (im *Importer) GetStats() Status {
 	im.RLock()
@@ -161,6 +283,12 @@ func (im *Importer) GetStats() Status {
 		Status:   im.status.Status,
 		Total:    im.status.Total,
 		Imported: im.status.Imported,
+		Inserted: im.status.Inserted,
+		Updated:  im.status.Updated,
+		Skipped:  im.status.Skipped,
+		Rate:     im.status.Rate,
+
+		Suppressed: im.status.Suppressed,
 	}
 }
 
@@ -201,22 +329,55 @@ func (im *Importer) isDone() bool {
 	return s
 }
 
-// incrementImportCount sets the Importer's "imported" counter.
+// incrementImportCount sets the Importer's "imported" counter and
+// updates the throughput.
 func (im *Importer) incrementImportCount(n int) {
 	im.Lock()
 	im.status.Imported += n
+	im.updateRate()
 	im.Unlock()
 }
 
+// incrementUpsertCounts sets the Importer's "imported" counter along with
+// its breakdown and updates the throughput.
+func (im *Importer) incrementUpsertCounts(inserted, updated, skipped int) {
+	im.Lock()
+	im.status.Imported += inserted + updated + skipped
+	im.status.Inserted += inserted
+	im.status.Updated += updated
+	im.status.Skipped += skipped
+	im.updateRate()
+	im.Unlock()
+}
+
+// incrementSuppressedCount sets the Importer's "suppressed" counter.
+func (im *Importer) incrementSuppressedCount(n int) {
+	im.Lock()
+	im.status.Suppressed += n
+	im.Unlock()
+}
+
+// updateRate updates the import throughput. It should be called
+// with the lock held.
+func (im *Importer) updateRate() {
+	if d := time.Since(im.status.startedAt).Seconds(); d > 0 {
+		im.status.Rate = float64(im.status.Imported) / d
+	}
+}
+
 // sendNotif sends admin notifications for import completions.
 func (im *Importer) sendNotif(status string) error {
 	var (
 		s   = im.GetStats()
 		out = importStatusTpl{
-			Name:     s.Name,
-			Status:   status,
-			Imported: s.Imported,
-			Total:    s.Total,
+			Name:       s.Name,
+			Status:     status,
+			Imported:   s.Imported,
+			Total:      s.Total,
+			Inserted:   s.Inserted,
+			Updated:    s.Updated,
+			Skipped:    s.Skipped,
+			Suppressed: s.Suppressed,
 		}
 		subject = fmt.Sprintf("%s: %s import",
 			strings.Title(status),
@@ -226,15 +387,12 @@ func (im *Importer) sendNotif(status string) error {
 }
 
 // Start is a blocking function that selects on a channel queue until all
-// subscriber entries in the import session are imported. It should be
-// invoked as a goroutine.
+// subscriber entries in the import session are imported by the commit
+// workers. It should be invoked as a goroutine.
 func (s *Session) Start() {
 	var (
-		tx    *sql.Tx
-		stmt  *sql.Stmt
-		err   error
-		total = 0
-		cur   = 0
+		wg    sync.WaitGroup
+		count int64
 
 		listIDs = make(pq.Int64Array, len(s.listIDs))
 	)
@@ -243,83 +401,284 @@ func (s *Session) Start() {
 		listIDs[i] = int64(v)
 	}
 
-	for sub := range s.subQueue {
-		if cur == 0 {
-			// New transaction batch.
-			tx, err = s.im.db.Begin()
-			if err != nil {
-				s.log.Printf("error creating DB transaction: %v", err)
-				continue
-			}
+	for w := 0; w < s.im.opt.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			atomic.AddInt64(&count, int64(s.commitQueue(listIDs)))
+		}()
+	}
+	wg.Wait()
+	total := int(count)
 
-			if s.mode == ModeSubscribe {
-				stmt = tx.Stmt(s.im.opt.UpsertStmt)
-			} else {
-				stmt = tx.Stmt(s.im.opt.BlacklistStmt)
-			}
+	// The import failed while loading the file.
+	if s.im.getStatus() == StatusFailed {
+		s.log.Printf("import failed")
+		s.im.sendNotif(StatusFailed)
+		return
+	}
+
+	// Nothing could be imported. Records that were all suppressed aren't
+	// a failure.
+	if st := s.im.GetStats(); total == 0 && st.Total > 0 && st.Suppressed == 0 {
+		s.im.setStatus(StatusFailed)
+		s.log.Printf("no records were imported")
+		s.im.sendNotif(StatusFailed)
+		return
+	}
+
+	s.im.setStatus(StatusFinished)
+	s.log.Printf("imported finished")
+	if s.mode == ModeSubscribe {
+		st := s.im.GetStats()
+		s.log.Printf("inserted %d, updated %d, skipped %d", st.Inserted, st.Updated, st.Skipped)
+		if st.Suppressed > 0 {
+			s.log.Printf("suppressed %d (%s)", st.Suppressed, s.suppression)
+		}
+	}
+	if _, err := s.im.opt.UpdateListDateStmt.Exec(listIDs); err != nil {
+		s.log.Printf("error updating lists date: %v", err)
+	}
+	s.im.sendNotif(StatusFinished)
+}
+
+// commitQueue commits the subscribers in the queue in batches until it's
+// closed and returns the number of records that were imported.
+func (s *Session) commitQueue(listIDs pq.Int64Array) int {
+	var (
+		n     = 0
+		batch = make([]SubReq, 0, s.im.opt.BatchSize)
+	)
+	for sub := range s.subQueue {
+		batch = append(batch, sub)
+		if len(batch) < s.im.opt.BatchSize {
+			continue
 		}
 
+		// Batch size is met. Commit.
+		n += s.commitBatch(batch, listIDs)
+		batch = batch[:0]
+		s.log.Printf("imported %d", s.im.GetStats().Imported)
+	}
+
+	// Queue's closed and there are records left to commit.
+	if len(batch) > 0 {
+		n += s.commitBatch(batch, listIDs)
+	}
+	return n
+}
+
+// commitBatch inserts a batch of subscribers into the DB with a single
+// multi-row query. If the query fails, the batch is retried one record at
+// a time so that a single bad record doesn't fail the whole batch, and the
+// errors of individual records are logged. It returns the number of records
+// that were imported.
+func (s *Session) commitBatch(subs []SubReq, listIDs pq.Int64Array) int {
+	subs, ok := s.checkSuppressed(subs, listIDs)
+	if !ok || len(subs) == 0 {
+		return 0
+	}
+
+	var (
+		uuids   = make(pq.StringArray, 0, len(subs))
+		emails  = make(pq.StringArray, 0, len(subs))
+		names   = make(pq.StringArray, 0, len(subs))
+		attribs = make(pq.StringArray, 0, len(subs))
+	)
+	for _, sub := range subs {
 		uu, err := uuid.NewV4()
 		if err != nil {
 			s.log.Printf("error generating UUID: %v", err)
-			tx.Rollback()
-			break
+			return 0
+		}
+
+		a := []byte("{}")
+		if len(sub.Attribs) > 0 {
+			b, err := json.Marshal(sub.Attribs)
+			if err != nil {
+				s.log.Printf("error marshalling attributes for '%s': %v", sub.Email, err)
+			} else {
+				a = b
+			}
 		}
 
+		uuids = append(uuids, uu.String())
+		emails = append(emails, sub.Email)
+		names = append(names, sub.Name)
+		attribs = append(attribs, string(a))
+	}
+
+	var (
+		err              error
+		inserted, exists int
+		blacklisted      []string
+	)
+	if s.mode == ModeSubscribe {
+		err = s.im.opt.UpsertBatchStmt.QueryRow(uuids, emails, names, attribs, listIDs,
+			s.conflict, s.listMode).Scan(&inserted, &exists)
+	} else if s.mode == ModeBlacklist {
+		blacklisted, err = scanUUIDs(s.im.opt.BlacklistBatchStmt.Query(uuids, emails, names, attribs))
+	}
+	if err == nil {
+		s.incrementCounts(len(subs), inserted, exists)
+		s.batchCB(emails)
+		s.blacklistCB(blacklisted)
+		return len(subs)
+	}
+
+	// Isolate the bad record(s) by inserting the batch one record at a time.
+	s.log.Printf("error importing batch of %d records, retrying individually: %v", len(subs), err)
+	var (
+		n        = 0
+		imported = make([]string, 0, len(subs))
+	)
+	inserted, exists = 0, 0
+	for i, sub := range subs {
 		if s.mode == ModeSubscribe {
-			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs, listIDs, s.overwrite)
+			var isNew bool
+			err = s.im.opt.UpsertStmt.QueryRow(uuids[i], sub.Email, sub.Name, attribs[i], listIDs,
+				s.conflict, s.listMode).Scan(&isNew)
+			if err == nil {
+				if isNew {
+					inserted++
+				} else {
+					exists++
+				}
+			}
 		} else if s.mode == ModeBlacklist {
-			_, err = stmt.Exec(uu, sub.Email, sub.Name, sub.Attribs)
+			var u []string
+			u, err = scanUUIDs(s.im.opt.BlacklistStmt.Query(uuids[i], sub.Email, sub.Name, attribs[i]))
+			blacklisted = append(blacklisted, u...)
 		}
 		if err != nil {
-			s.log.Printf("error executing insert: %v", err)
-			tx.Rollback()
-			break
+			s.log.Printf("error importing '%s': %v", sub.Email, err)
+			continue
 		}
-		cur++
-		total++
+		imported = append(imported, sub.Email)
+		n++
+	}
 
-		// Batch size is met. Commit.
-		if cur%commitBatchSize == 0 {
-			if err := tx.Commit(); err != nil {
-				tx.Rollback()
-				s.log.Printf("error committing to DB: %v", err)
-			} else {
-				s.im.incrementImportCount(cur)
-				s.log.Printf("imported %d", total)
-			}
+	s.incrementCounts(n, inserted, exists)
+	s.batchCB(imported)
+	s.blacklistCB(blacklisted)
+	return n
+}
 
-			cur = 0
+// scanUUIDs reads the UUIDs returned by a query.
+func scanUUIDs(rows *sql.Rows, err error) ([]string, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var out []string
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		out = append(out, u)
+	}
+	return out, rows.Err()
+}
+
+// checkSuppressed checks a batch of records in the subscribe mode against
+// suppressed subscribers, logs and counts the ones that match them, and
+// returns the records to be imported by the suppression policy. If the check
+// fails, the batch isn't imported unless the policy is to flag them.
+func (s *Session) checkSuppressed(subs []SubReq, listIDs pq.Int64Array) ([]SubReq, bool) {
+	if s.mode != ModeSubscribe || s.suppression == SuppressNone || s.im.opt.SuppressedStmt == nil {
+		return subs, true
+	}
+
+	emails := make(pq.StringArray, 0, len(subs))
+	for _, sub := range subs {
+		emails = append(emails, sub.Email)
+	}
+
+	rows, err := s.im.opt.SuppressedStmt.Query(emails, listIDs)
+	if err != nil {
+		s.log.Printf("error checking batch of %d records for suppressed subscribers: %v", len(subs), err)
+		return subs, s.suppression == SuppressFlag
+	}
+	defer rows.Close()
+
+	reasons := make(map[string]string)
+	for rows.Next() {
+		var email, reason string
+		if err := rows.Scan(&email, &reason); err != nil {
+			s.log.Printf("error checking batch of %d records for suppressed subscribers: %v", len(subs), err)
+			return subs, s.suppression == SuppressFlag
 		}
+		reasons[email] = reason
+	}
+	if err := rows.Err(); err != nil {
+		s.log.Printf("error checking batch of %d records for suppressed subscribers: %v", len(subs), err)
+		return subs, s.suppression == SuppressFlag
+	}
+	if len(reasons) == 0 {
+		return subs, true
 	}
 
-	// Queue's closed and there's nothing left to commit.
-	if cur == 0 {
-		s.im.setStatus(StatusFinished)
-		s.log.Printf("imported finished")
-		if _, err := s.im.opt.UpdateListDateStmt.Exec(listIDs); err != nil {
-			s.log.Printf("error updating lists date: %v", err)
+	out := make([]SubReq, 0, len(subs))
+	n := 0
+	for _, sub := range subs {
+		reason, ok := reasons[sub.Email]
+		if !ok {
+			out = append(out, sub)
+			continue
 		}
-		s.im.sendNotif(StatusFinished)
+
+		n++
+		if s.suppression == SuppressFlag {
+			s.log.Printf("importing suppressed '%s' (%s)", sub.Email, reason)
+			out = append(out, sub)
+		} else {
+			s.log.Printf("skipping suppressed '%s' (%s)", sub.Email, reason)
+		}
+	}
+	s.im.incrementSuppressedCount(n)
+	return out, true
+}
+
+// incrementCounts records n imported records. In the subscribe mode, they're
+// broken down into inserted records and existing ones that are counted as
+// updated or skipped depending on the conflict policy. Records with duplicate
+// e-mails in a batch are collapsed into one and their duplicates are counted
+// as skipped.
+func (s *Session) incrementCounts(n, inserted, exists int) {
+	if s.mode != ModeSubscribe {
+		s.im.incrementImportCount(n)
 		return
 	}
 
-	// Queue's closed and there are records left to commit.
-	if err := tx.Commit(); err != nil {
-		tx.Rollback()
-		s.im.setStatus(StatusFailed)
-		s.log.Printf("error committing to DB: %v", err)
-		s.im.sendNotif(StatusFailed)
+	var (
+		updated = exists
+		skipped = n - inserted - exists
+	)
+	if s.conflict != ConflictOverwrite && s.conflict != ConflictMerge {
+		updated = 0
+		skipped += exists
+	}
+	s.im.incrementUpsertCounts(inserted, updated, skipped)
+}
+
+// batchCB calls the optional batch callback with the e-mails of the
+// subscribers committed in the subscribe mode.
+func (s *Session) batchCB(emails []string) {
+	if s.im.opt.BatchCB == nil || s.mode != ModeSubscribe || len(emails) == 0 {
 		return
 	}
+	s.im.opt.BatchCB(emails)
+}
 
-	s.im.incrementImportCount(cur)
-	s.im.setStatus(StatusFinished)
-	s.log.Printf("imported finished")
-	if _, err := s.im.opt.UpdateListDateStmt.Exec(listIDs); err != nil {
-		s.log.Printf("error updating lists date: %v", err)
+// blacklistCB calls the optional blacklist callback with the UUIDs of the
+// existing subscribers blacklisted in the blacklist mode.
+func (s *Session) blacklistCB(uuids []string) {
+	if s.im.opt.BlacklistCB == nil || len(uuids) == 0 {
+		return
 	}
-	s.im.sendNotif(StatusFinished)
+	s.im.opt.BlacklistCB(uuids)
 }
 
 // Stop stops an active import session.
@@ -335,13 +694,15 @@ func (s *Session) ExtractZIP(srcPath string, maxCSVs int) (string, []string, err
 		return "", nil, ErrIsImporting
 	}
 
-	failed := true
-	defer func() {
-		if failed {
-			s.im.setStatus(StatusFailed)
-		}
-	}()
+	dir, files, err := extractZIP(srcPath, maxCSVs, s.log)
+	if err != nil {
+		s.im.setStatus(StatusFailed)
+	}
+	return dir, files, err
+}
 
+// extractZIP extracts the .csv files in a ZIP file to a temporary directory.
+func extractZIP(srcPath string, maxCSVs int, l *log.Logger) (string, []string, error) {
 	z, err := zip.OpenReader(srcPath)
 	if err != nil {
 		return "", nil, err
@@ -351,7 +712,7 @@ func (s *Session) ExtractZIP(srcPath string, maxCSVs int) (string, []string, err
 	// Create a temporary directory to extract the files.
 	dir, err := ioutil.TempDir("", "listmonk")
 	if err != nil {
-		s.log.Printf("error creating temporary directory for extracting ZIP: %v", err)
+		l.Printf("error creating temporary directory for extracting ZIP: %v", err)
 		return "", nil, err
 	}
 
@@ -361,50 +722,49 @@ func (s *Session) ExtractZIP(srcPath string, maxCSVs int) (string, []string, err
 
 		// Skip directories.
 		if f.FileInfo().IsDir() {
-			s.log.Printf("skipping directory '%s'", fName)
+			l.Printf("skipping directory '%s'", fName)
 			continue
 		}
 
 		// Skip files without the .csv extension.
 		if !strings.HasSuffix(strings.ToLower(fName), ".csv") {
-			s.log.Printf("skipping non .csv file '%s'", fName)
+			l.Printf("skipping non .csv file '%s'", fName)
 			continue
 		}
 
-		s.log.Printf("extracting '%s'", fName)
+		l.Printf("extracting '%s'", fName)
 		src, err := f.Open()
 		if err != nil {
-			s.log.Printf("error opening '%s' from ZIP: '%v'", fName, err)
+			l.Printf("error opening '%s' from ZIP: '%v'", fName, err)
 			return "", nil, err
 		}
 		defer src.Close()
 
 		out, err := os.OpenFile(dir+"/"+fName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
 		if err != nil {
-			s.log.Printf("error creating '%s/%s': '%v'", dir, fName, err)
+			l.Printf("error creating '%s/%s': '%v'", dir, fName, err)
 			return "", nil, err
 		}
 		defer out.Close()
 
 		if _, err := io.Copy(out, src); err != nil {
-			s.log.Printf("error extracting to '%s/%s': '%v'", dir, fName, err)
+			l.Printf("error extracting to '%s/%s': '%v'", dir, fName, err)
 			return "", nil, err
 		}
-		s.log.Printf("extracted '%s'", fName)
+		l.Printf("extracted '%s'", fName)
 
 		files = append(files, fName)
 		if len(files) > maxCSVs {
-			s.log.Printf("won't extract any more files. Maximum is %d", maxCSVs)
+			l.Printf("won't extract any more files. Maximum is %d", maxCSVs)
 			break
 		}
 	}
 
 	if len(files) == 0 {
-		s.log.Println("no CSV files found in the ZIP")
+		l.Println("no CSV files found in the ZIP")
 		return "", nil, errors.New("no CSV files found in the ZIP")
 	}
 
-	failed = false
 	return dir, files, nil
 }
 
@@ -469,10 +829,35 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		return errors.New("'name' column not found")
 	}
 
+	// Rows are parsed and validated by the workers that send them to the
+	// queue. They're stopped before the queue's closed.
 	var (
 		lnHdr = len(hdrKeys)
 		i     = 0
+
+		rows = make(chan csvRow, s.im.opt.Concurrency)
+		wg   sync.WaitGroup
+		once sync.Once
 	)
+	for w := 0; w < s.im.opt.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for r := range rows {
+				if sub, ok := s.parseCSVRow(r, hdrKeys); ok {
+					s.subQueue <- sub
+				}
+			}
+		}()
+	}
+	stopWorkers := func() {
+		once.Do(func() {
+			close(rows)
+			wg.Wait()
+		})
+	}
+	defer stopWorkers()
+
 	for {
 		i++
 
@@ -480,6 +865,7 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 		select {
 		case <-s.im.stop:
 			failed = false
+			stopWorkers()
 			close(s.subQueue)
 			s.log.Println("stop request received")
 			return nil
@@ -505,49 +891,78 @@ func (s *Session) LoadCSV(srcPath string, delim rune) error {
 			continue
 		}
 
-		// Iterate the key map and based on the indices mapped earlier,
-		// form a map of key: csv_value, eg: email: user@user.com.
-		row := make(map[string]string, lnCols)
-		for key := range hdrKeys {
-			row[key] = cols[hdrKeys[key]]
-		}
-
-		sub := SubReq{}
-		// Lowercase to ensure uniqueness in the DB.
-		sub.Email = strings.ToLower(strings.TrimSpace(row["email"]))
-		sub.Name = row["name"]
-		if err := ValidateFields(sub); err != nil {
-			s.log.Printf("skipping line %d: %v", i, err)
-			continue
-		}
-
-		// JSON attributes.
-		if len(row["attributes"]) > 0 {
-			var (
-				attribs models.SubscriberAttribs
-				b       = []byte(row["attributes"])
-			)
-			if err := json.Unmarshal(b, &attribs); err != nil {
-				s.log.Printf("skipping invalid attributes JSON on line %d for '%s': %v", i, sub.Email, err)
-			} else {
-				sub.Attribs = attribs
-			}
-		}
-
-		// Send the subscriber to the queue.
-		s.subQueue <- sub
+		rows <- csvRow{line: i, cols: cols}
 	}
 
+	stopWorkers()
 	close(s.subQueue)
 	failed = false
 	return nil
 }
 
+// csvRow is a row of a CSV file and its line number.
+type csvRow struct {
+	line int
+	cols []string
+}
+
+// parseCSVRow parses and validates a CSV row. Invalid rows are logged and
+// skipped.
+func (s *Session) parseCSVRow(r csvRow, hdrKeys map[string]int) (SubReq, bool) {
+	sub, err := parseRow(r.cols, hdrKeys)
+	if err != nil {
+		s.log.Printf("skipping line %d: %v", r.line, err)
+		return sub, false
+	}
+
+	// JSON attributes.
+	if a, err := parseAttribs(r.cols, hdrKeys); err != nil {
+		s.log.Printf("skipping invalid attributes JSON on line %d for '%s': %v", r.line, sub.Email, err)
+	} else {
+		sub.Attribs = a
+	}
+	if err := s.im.opt.Attribs.Normalize(sub.Attribs); err != nil {
+		s.log.Printf("skipping line %d: %v", r.line, err)
+		return sub, false
+	}
+	return sub, true
+}
+
+// parseRow maps the columns of a CSV row to a subscriber by the positions of
+// the headers and validates it.
+func parseRow(cols []string, hdrKeys map[string]int) (SubReq, error) {
+	var sub SubReq
+
+	// Lowercase to ensure uniqueness in the DB.
+	sub.Email = strings.ToLower(strings.TrimSpace(cols[hdrKeys["email"]]))
+	sub.Name = cols[hdrKeys["name"]]
+	return sub, ValidateFields(sub)
+}
+
+// parseAttribs parses the optional JSON attributes column of a CSV row.
+func parseAttribs(cols []string, hdrKeys map[string]int) (models.SubscriberAttribs, error) {
+	i, ok := hdrKeys["attributes"]
+	if !ok || len(cols[i]) == 0 {
+		return nil, nil
+	}
+
+	var out models.SubscriberAttribs
+	if err := json.Unmarshal([]byte(cols[i]), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // Stop sends a signal to stop the existing import.
 func (im *Importer) Stop() {
-	if im.getStatus() != StatusImporting {
+	im.RLock()
+	queued := im.queued
+	im.RUnlock()
+
+	if im.getStatus() != StatusImporting || queued {
 		im.Lock()
 		im.status = Status{Status: StatusNone}
+		im.queued = false
 		im.Unlock()
 		return
 	}
@@ -563,20 +978,33 @@ func (im *Importer) Stop() {
 // and returns a new map with each of the headers in the known map mapped by the position (0-n)
 // in the given CSV list.
 func (s *Session) mapCSVHeaders(csvHdrs []string, knownHdrs map[string]bool) map[string]int {
+	hdrKeys, ignored := mapHeaders(csvHdrs, knownHdrs)
+	for _, h := range ignored {
+		s.log.Printf("ignoring unknown header '%s'", h)
+	}
+	return hdrKeys
+}
+
+// mapHeaders maps the known headers in a CSV header to their positions and
+// returns them along with the unknown headers.
+func mapHeaders(csvHdrs []string, knownHdrs map[string]bool) (map[string]int, []string) {
 	// Map 0-n column index to the header keys, name: 0, email: 1 etc.
 	// This is to allow dynamic ordering of columns in th CSV.
-	hdrKeys := make(map[string]int)
+	var (
+		hdrKeys = make(map[string]int)
+		ignored = []string{}
+	)
 	for i, h := range csvHdrs {
 		// Clean the string of non-ASCII characters (BOM etc.).
 		h := regexCleanStr.ReplaceAllString(h, "")
 		if _, ok := knownHdrs[h]; !ok {
-			s.log.Printf("ignoring unknown header '%s'", h)
+			ignored = append(ignored, h)
 			continue
 		}
 		hdrKeys[h] = i
 	}
 
-	return hdrKeys
+	return hdrKeys, ignored
 }
 
 // ValidateFields validates incoming subscriber field values.
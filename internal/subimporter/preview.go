@@ -0,0 +1,157 @@
+package subimporter
+
+import (
+	"encoding/csv"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	// previewSamples is the number of parsed records in a preview.
+	previewSamples = 10
+
+	// previewErrors is the maximum number of row errors in a preview.
+	previewErrors = 50
+)
+
+// Preview represents the result of validating an import file without
+// importing any of its records.
+type Preview struct {
+	// Total is the number of rows in the file excluding the header.
+	Total int `json:"total"`
+
+	// Columns are the columns in the file's header that are imported and
+	// Ignored are the unknown ones that are ignored.
+	Columns []string `json:"columns"`
+	Ignored []string `json:"ignored"`
+
+	// Valid rows would be imported and Failed rows would be skipped.
+	Valid  int `json:"valid"`
+	Failed int `json:"failed"`
+
+	// Rows whose (optional) attributes are invalid JSON and that would be
+	// imported without attributes.
+	InvalidAttribs int `json:"invalid_attribs"`
+
+	Sample []SubReq   `json:"sample"`
+	Errors []RowError `json:"errors"`
+}
+
+// RowError represents an error on a line of an import file.
+type RowError struct {
+	Line  int    `json:"line"`
+	Error string `json:"error"`
+}
+
+// PreviewFile validates an import file (a CSV or a ZIP with a CSV, by the
+// extension of its name) with the same rules as an import and reports the
+// rows that would be imported, without writing anything. Attributes are
+// normalized with the optional rules. It returns an error if the file can't
+// be imported at all, eg: if a required column is missing.
+func PreviewFile(srcPath, name string, delim rune, rules *AttribRules) (Preview, error) {
+	path := srcPath
+	if !strings.HasSuffix(strings.ToLower(name), ".csv") {
+		dir, files, err := extractZIP(srcPath, 1, log.New(ioutil.Discard, "", 0))
+		if err != nil {
+			return Preview{}, err
+		}
+		defer os.RemoveAll(dir)
+		path = dir + "/" + files[0]
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return Preview{}, err
+	}
+	defer f.Close()
+
+	rd := csv.NewReader(f)
+	rd.Comma = delim
+
+	csvHdr, err := rd.Read()
+	if err == io.EOF {
+		return Preview{}, errors.New("empty file")
+	} else if err != nil {
+		return Preview{}, err
+	}
+
+	hdrKeys, ignored := mapHeaders(csvHdr, csvHeaders)
+	if _, ok := hdrKeys["email"]; !ok {
+		return Preview{}, errors.New("'email' column not found")
+	}
+	if _, ok := hdrKeys["name"]; !ok {
+		return Preview{}, errors.New("'name' column not found")
+	}
+
+	out := Preview{
+		Columns: make([]string, 0, len(hdrKeys)),
+		Ignored: ignored,
+		Sample:  []SubReq{},
+		Errors:  []RowError{},
+	}
+	for _, h := range csvHdr {
+		h = regexCleanStr.ReplaceAllString(h, "")
+		if _, ok := hdrKeys[h]; ok {
+			out.Columns = append(out.Columns, h)
+		}
+	}
+
+	var (
+		lnHdr = len(hdrKeys)
+		fail  = func(line int, err string) {
+			out.Failed++
+			if len(out.Errors) < previewErrors {
+				out.Errors = append(out.Errors, RowError{Line: line, Error: err})
+			}
+		}
+	)
+	for i := 1; ; i++ {
+		cols, err := rd.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			if err, ok := err.(*csv.ParseError); ok && err.Err == csv.ErrFieldCount {
+				out.Total++
+				fail(i, err.Error())
+				continue
+			}
+			return out, err
+		}
+		out.Total++
+
+		if len(cols) < lnHdr {
+			fail(i, "column count does not match the header")
+			continue
+		}
+
+		sub, err := parseRow(cols, hdrKeys)
+		if err != nil {
+			fail(i, err.Error())
+			continue
+		}
+		if a, err := parseAttribs(cols, hdrKeys); err != nil {
+			out.InvalidAttribs++
+			if len(out.Errors) < previewErrors {
+				out.Errors = append(out.Errors, RowError{Line: i,
+					Error: "invalid attributes JSON (imported without attributes): " + err.Error()})
+			}
+		} else {
+			sub.Attribs = a
+		}
+		if err := rules.Normalize(sub.Attribs); err != nil {
+			fail(i, err.Error())
+			continue
+		}
+
+		out.Valid++
+		if len(out.Sample) < previewSamples {
+			out.Sample = append(out.Sample, sub)
+		}
+	}
+
+	return out, nil
+}
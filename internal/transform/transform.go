@@ -0,0 +1,109 @@
+// Package transform has the transformations of rendered message bodies that
+// messengers can be configured with, eg: stripping the HTML for a messenger
+// that sends plaintext, or JSON encoding the body for one that embeds it in
+// a JSON payload. Transforms are composed into a chain that's applied in order.
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/knadh/listmonk/internal/plaintext"
+)
+
+// Transform transforms a rendered message body.
+type Transform func(b []byte) ([]byte, error)
+
+var (
+	mut        sync.RWMutex
+	transforms = map[string]Transform{
+		// Converts the HTML to plaintext. See plaintext.FromHTML.
+		"strip_html": plaintext.FromHTML,
+
+		// Escapes the body as the contents of a JSON string, without the
+		// quotes, eg: for a messenger template that embeds it.
+		"json_escape": JSONEscape,
+
+		// Wraps the body in a JSON object, {"body": "..."}.
+		"json_wrap": JSONWrap,
+
+		// Trims the leading and trailing whitespace.
+		"trim": Trim,
+	}
+)
+
+// Register registers a named transform, replacing the one with the name,
+// if any.
+func Register(name string, t Transform) {
+	mut.Lock()
+	transforms[name] = t
+	mut.Unlock()
+}
+
+// New returns a Transform that applies the named transforms in order.
+// It returns nil if there are no names.
+func New(names []string) (Transform, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	mut.RLock()
+	defer mut.RUnlock()
+
+	ts := make([]Transform, 0, len(names))
+	for _, n := range names {
+		t, ok := transforms[n]
+		if !ok {
+			return nil, fmt.Errorf("unknown transform '%s'", n)
+		}
+		ts = append(ts, t)
+	}
+	return Chain(ts...), nil
+}
+
+// Chain composes transforms into one that applies them in order.
+func Chain(ts ...Transform) Transform {
+	return func(b []byte) ([]byte, error) {
+		for _, t := range ts {
+			var err error
+			if b, err = t(b); err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	}
+}
+
+// JSONEscape escapes a body as the contents of a JSON string.
+func JSONEscape(b []byte) ([]byte, error) {
+	out, err := marshal(string(b))
+	if err != nil {
+		return nil, err
+	}
+	return out[1 : len(out)-1], nil
+}
+
+// JSONWrap wraps a body in a JSON object as its "body".
+func JSONWrap(b []byte) ([]byte, error) {
+	return marshal(struct {
+		Body string `json:"body"`
+	}{string(b)})
+}
+
+// Trim trims the leading and trailing whitespace of a body.
+func Trim(b []byte) ([]byte, error) {
+	return bytes.TrimSpace(b), nil
+}
+
+// marshal marshals a value into JSON without escaping HTML characters.
+func marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
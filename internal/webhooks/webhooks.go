@@ -0,0 +1,377 @@
+// Package webhooks implements a queued dispatcher for outbound webhooks.
+// Events are persisted in a Store as deliveries to all the endpoints that
+// have subscribed to them and are POSTed as signed JSON payloads by a pool
+// of workers, without blocking the caller. Failed deliveries are retried on
+// a schedule and deliveries that exhaust their retries are dead-lettered in
+// the Store, from where they can be replayed.
+package webhooks
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Subscriber lifecycle events.
+const (
+	EventSubscriberCreated      = "subscriber.created"
+	EventSubscriberUpdated      = "subscriber.updated"
+	EventSubscriptionConfirmed  = "subscription.confirmed"
+	EventSubscriberUnsubscribed = "subscriber.unsubscribed"
+	EventSubscriberBlacklisted  = "subscriber.blacklisted"
+	EventSubscriberDeleted      = "subscriber.deleted"
+)
+
+// Campaign events.
+const (
+	// EventCampaignSendAlert is raised when the send failures of a running
+	// campaign cross the configured thresholds.
+	EventCampaignSendAlert = "campaign.send_alert"
+
+	// EventCampaignFinished is raised when a campaign has been sent to all
+	// its subscribers.
+	EventCampaignFinished = "campaign.finished"
+)
+
+// Tracking events.
+const (
+	// EventCampaignViewed is raised when a subscriber opens a campaign
+	// message that has the view tracking pixel, or the e-mail provider
+	// reports an open.
+	EventCampaignViewed = "campaign.viewed"
+
+	// EventLinkClicked is raised when a subscriber clicks on a link in a
+	// campaign message.
+	EventLinkClicked = "link.clicked"
+)
+
+// Export events.
+const (
+	// EventExportFailed is raised when a scheduled export fails.
+	EventExportFailed = "export.failed"
+)
+
+const (
+	// HeaderEvent is the header that carries the name of the event.
+	HeaderEvent = "X-Listmonk-Event"
+
+	// HeaderTimestamp is the header that carries the UNIX timestamp of the
+	// delivery which is part of the signed payload.
+	HeaderTimestamp = "X-Listmonk-Timestamp"
+
+	// HeaderSignature is the header that carries the hex encoded
+	// HMAC-SHA256 signature of "$timestamp.$body" signed with the
+	// endpoint's secret.
+	HeaderSignature = "X-Listmonk-Signature"
+)
+
+// Endpoint represents a webhook receiver.
+type Endpoint struct {
+	Name   string   `koanf:"-"`
+	URL    string   `koanf:"url"`
+	Secret string   `koanf:"secret"`
+	Events []string `koanf:"events"`
+
+	events map[string]bool
+}
+
+// Opt represents the webhook dispatcher options.
+type Opt struct {
+	Endpoints []Endpoint
+
+	// Concurrency is the number of workers that deliver webhooks.
+	Concurrency int
+
+	// QueueSize is the maximum number of due deliveries that are fetched
+	// from the Store at a time.
+	QueueSize int
+
+	// RetrySchedule is the wait before each retry of a failed delivery,
+	// after which it's dead-lettered. If it's empty, a failed delivery is
+	// retried MaxRetries times, first after RetryInterval, which is doubled
+	// on every subsequent retry.
+	RetrySchedule []time.Duration
+	MaxRetries    int
+	RetryInterval time.Duration
+
+	// Timeout is the HTTP timeout for a single delivery.
+	Timeout time.Duration
+}
+
+// Store represents the data store that deliveries are persisted in until
+// they're delivered or dead-lettered.
+type Store interface {
+	// QueueDeliveries persists the deliveries of an event to endpoints.
+	QueueDeliveries(endpoints []string, event string, body []byte) error
+
+	// ClaimDeliveries returns up to limit deliveries to the endpoints that
+	// are due and defers them by lease so that they aren't claimed again
+	// while they're delivered. Deliveries that are lost (eg: in a restart)
+	// are claimed again after their lease.
+	ClaimDeliveries(endpoints []string, limit int, lease time.Duration) ([]Delivery, error)
+
+	// DeleteDelivery deletes a delivered delivery.
+	DeleteDelivery(id int64) error
+
+	// RetryDelivery records a failed attempt of a delivery and when it's
+	// due again.
+	RetryDelivery(id int64, attempts int, errMsg string, wait time.Duration) error
+
+	// DeadLetter moves a delivery that has exhausted its retries to the
+	// dead-letters.
+	DeadLetter(id int64, attempts int, errMsg string) error
+}
+
+// Delivery represents a single event payload to be delivered to an endpoint.
+// Attempts is the number of failed attempts.
+type Delivery struct {
+	ID       int64  `db:"id"`
+	Endpoint string `db:"endpoint"`
+	Event    string `db:"event"`
+	Body     []byte `db:"body"`
+	Attempts int    `db:"attempts"`
+}
+
+// Event represents the JSON payload that's POSTed to webhook endpoints.
+type Event struct {
+	Event     string      `json:"event"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// pollInterval is the interval at which the Store is scanned for due
+// deliveries (eg: retries) in addition to the ones queued with Push.
+const pollInterval = time.Second * 5
+
+// Webhooks is the outbound webhook dispatcher.
+type Webhooks struct {
+	opt       Opt
+	store     Store
+	endpoints map[string]*Endpoint
+	queue     chan Delivery
+	notify    chan bool
+	client    *http.Client
+	log       *log.Logger
+}
+
+// New returns a new instance of the webhook dispatcher.
+func New(o Opt, s Store, l *log.Logger) (*Webhooks, error) {
+	if o.Concurrency < 1 {
+		o.Concurrency = 1
+	}
+	if o.QueueSize < 1 {
+		o.QueueSize = 1000
+	}
+	if o.RetryInterval < time.Second {
+		o.RetryInterval = time.Second
+	}
+	if o.Timeout < time.Second {
+		o.Timeout = time.Second * 5
+	}
+	if len(o.RetrySchedule) == 0 {
+		for i := 0; i < o.MaxRetries; i++ {
+			o.RetrySchedule = append(o.RetrySchedule, o.RetryInterval*time.Duration(1<<uint(i)))
+		}
+	}
+
+	eps := make(map[string]*Endpoint, len(o.Endpoints))
+	for i, e := range o.Endpoints {
+		if e.URL == "" {
+			return nil, fmt.Errorf("webhook '%s' has no URL", e.Name)
+		}
+		if len(e.Events) == 0 {
+			return nil, fmt.Errorf("webhook '%s' has no events", e.Name)
+		}
+
+		o.Endpoints[i].events = make(map[string]bool, len(e.Events))
+		for _, ev := range e.Events {
+			o.Endpoints[i].events[ev] = true
+		}
+		eps[e.Name] = &o.Endpoints[i]
+	}
+
+	return &Webhooks{
+		opt:       o,
+		store:     s,
+		endpoints: eps,
+		queue:     make(chan Delivery, o.QueueSize),
+		notify:    make(chan bool, 1),
+		client:    &http.Client{Timeout: o.Timeout},
+		log:       l,
+	}, nil
+}
+
+// Run is a blocking function (that should be invoked as a goroutine)
+// that spawns workers that deliver queued webhooks.
+func (w *Webhooks) Run() {
+	for i := 0; i < w.opt.Concurrency; i++ {
+		go w.worker()
+	}
+	w.poll()
+}
+
+// Has tells if there's at least one endpoint subscribed to the given event.
+// This can be used by callers to skip preparing expensive payloads.
+func (w *Webhooks) Has(event string) bool {
+	for _, e := range w.opt.Endpoints {
+		if e.events[event] {
+			return true
+		}
+	}
+	return false
+}
+
+// Push queues an event for delivery to all endpoints subscribed to it.
+// It does not wait for the deliveries.
+func (w *Webhooks) Push(event string, data interface{}) error {
+	if !w.Has(event) {
+		return nil
+	}
+
+	body, err := json.Marshal(Event{
+		Event:     event,
+		Timestamp: time.Now(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, e := range w.opt.Endpoints {
+		if e.events[event] {
+			names = append(names, e.Name)
+		}
+	}
+	if err := w.store.QueueDeliveries(names, event, body); err != nil {
+		return err
+	}
+
+	select {
+	case w.notify <- true:
+	default:
+	}
+	return nil
+}
+
+// poll is a blocking function that fetches the due deliveries from the
+// Store and queues them for the workers. The deliveries of endpoints that
+// aren't configured (eg: disabled ones) remain queued.
+func (w *Webhooks) poll() {
+	t := time.NewTicker(pollInterval)
+	defer t.Stop()
+
+	names := make([]string, 0, len(w.endpoints))
+	for name := range w.endpoints {
+		names = append(names, name)
+	}
+
+	for {
+		// Every delivery takes at most the timeout and the workers deliver
+		// them concurrently. The lease covers the wait in the queue.
+		var (
+			n     = w.opt.QueueSize - len(w.queue)
+			lease = w.opt.Timeout * time.Duration((len(w.queue)+n)/w.opt.Concurrency+2)
+		)
+		if n > 0 && len(w.endpoints) > 0 {
+			ds, err := w.store.ClaimDeliveries(names, n, lease)
+			if err != nil {
+				w.log.Printf("error fetching webhook deliveries: %v", err)
+			}
+			for _, d := range ds {
+				w.queue <- d
+			}
+
+			// There may be more due deliveries.
+			if len(ds) == n {
+				continue
+			}
+		}
+
+		select {
+		case <-w.notify:
+		case <-t.C:
+		}
+	}
+}
+
+// worker is a blocking function that listens to the delivery queue
+// and delivers incoming payloads.
+func (w *Webhooks) worker() {
+	for d := range w.queue {
+		err := w.deliver(d)
+		if err == nil {
+			if err := w.store.DeleteDelivery(d.ID); err != nil {
+				w.log.Printf("error deleting webhook delivery %d: %v", d.ID, err)
+			}
+			continue
+		}
+
+		d.Attempts++
+		if d.Attempts > len(w.opt.RetrySchedule) {
+			w.log.Printf("error delivering webhook '%s' to '%s' (dead-lettered after %d attempts): %v",
+				d.Event, d.Endpoint, d.Attempts, err)
+			if err := w.store.DeadLetter(d.ID, d.Attempts, err.Error()); err != nil {
+				w.log.Printf("error dead-lettering webhook delivery %d: %v", d.ID, err)
+			}
+			continue
+		}
+
+		// Schedule a retry.
+		wait := w.opt.RetrySchedule[d.Attempts-1]
+		w.log.Printf("error delivering webhook '%s' to '%s' (retrying in %v): %v",
+			d.Event, d.Endpoint, wait, err)
+		if err := w.store.RetryDelivery(d.ID, d.Attempts, err.Error(), wait); err != nil {
+			w.log.Printf("error updating webhook delivery %d: %v", d.ID, err)
+		}
+	}
+}
+
+// deliver POSTs a signed payload to an endpoint.
+func (w *Webhooks) deliver(d Delivery) error {
+	ep, ok := w.endpoints[d.Endpoint]
+	if !ok {
+		return fmt.Errorf("unknown webhook '%s'", d.Endpoint)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, ep.URL, bytes.NewReader(d.Body))
+	if err != nil {
+		return err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.Event)
+	req.Header.Set(HeaderTimestamp, ts)
+	if ep.Secret != "" {
+		req.Header.Set(HeaderSignature, Sign(ep.Secret, ts, d.Body))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("endpoint returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of "$timestamp.$body"
+// using the given secret. Receivers can compute this to verify payloads.
+func Sign(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/knadh/listmonk/internal/jobs"
+	"github.com/labstack/echo"
+)
+
+type jobsWrap struct {
+	Results []jobs.Job `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// handleGetJobs retrieves paginated jobs optionally filtered by type and status.
+func handleGetJobs(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = getPagination(c.QueryParams())
+		out jobsWrap
+	)
+
+	if err := app.queries.QueryJobs.Select(&out.Results,
+		c.QueryParam("type"), c.QueryParam("status"), pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching jobs: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching jobs: %s", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []jobs.Job{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].TotalRows
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetJob retrieves a single job.
+func handleGetJob(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+		out   jobs.Job
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetJob.Get(&out, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Job not found.")
+		}
+		app.log.Printf("error fetching job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching job: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCancelJob cancels a queued job or requests a running job to stop.
+// Running jobs stop at their next progress check.
+func handleCancelJob(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	out, err := cancelJob(id, app)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				"Job not found. Only queued or running jobs can be cancelled.")
+		}
+		app.log.Printf("error cancelling job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error cancelling job: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// cancelJob records the cancellation of a job and stops it right away if
+// it's running. Queued imports release the importer they've reserved.
+func cancelJob(id int64, app *App) (jobs.Job, error) {
+	var out jobs.Job
+	if err := app.queries.CancelJob.Get(&out, id); err != nil {
+		return out, err
+	}
+
+	app.jobs.Cancel(id)
+	if out.Type == jobTypeImport && out.Status == jobs.StatusCancelled {
+		app.importer.Stop()
+	}
+	return out, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/knadh/listmonk/internal/jobs"
+	"github.com/lib/pq"
+)
+
+// jobsDB implements jobs.Store over the primary database.
+type jobsDB struct {
+	queries *Queries
+}
+
+// CreateJob inserts a queued job and returns its ID.
+func (j *jobsDB) CreateJob(typ string, params []byte) (int64, error) {
+	var id int64
+	err := j.queries.CreateJob.Get(&id, typ, string(params))
+	return id, err
+}
+
+// ClaimJob marks the oldest queued job of a type as running and returns it.
+func (j *jobsDB) ClaimJob(typ string) (jobs.Job, error) {
+	var out jobs.Job
+	err := j.queries.ClaimJob.Get(&out, typ)
+	return out, err
+}
+
+// UpdateJobProgress records the progress of a running job and returns
+// whether its cancellation has been requested.
+func (j *jobsDB) UpdateJobProgress(id int64, total, done int, state []byte) (bool, error) {
+	var st interface{}
+	if state != nil {
+		st = string(state)
+	}
+
+	var cancel bool
+	err := j.queries.UpdateJobProgress.Get(&cancel, id, total, done, st)
+	return cancel, err
+}
+
+// FinishJob records the final status of a job and its result.
+func (j *jobsDB) FinishJob(id int64, status, errMsg string, total, done int, result []byte) error {
+	var res interface{}
+	if result != nil {
+		res = string(result)
+	}
+
+	_, err := j.queries.FinishJob.Exec(id, status, errMsg, total, done, res)
+	return err
+}
+
+// RecoverJobs requeues or marks as interrupted the jobs that were running
+// when the app stopped.
+func (j *jobsDB) RecoverJobs(resumable []string) error {
+	_, err := j.queries.RecoverJobs.Exec(pq.StringArray(resumable))
+	return err
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/knadh/listmonk/models"
+	"github.com/lib/pq"
+)
+
+// statusTransitions are the status transitions of subscribers that the
+// lifecycle hooks run on. They're named after the lifecycle webhook events
+// that they raise.
+var statusTransitions = []string{
+	webhooks.EventSubscriptionConfirmed,
+	webhooks.EventSubscriberUnsubscribed,
+	webhooks.EventSubscriberBlacklisted,
+}
+
+// lifecycleConf has the settings of the lifecycle hooks.
+type lifecycleConf struct {
+	// ListRules are the status transitions that apply the list rules to
+	// the subscribers.
+	ListRules []string `koanf:"list_rules"`
+}
+
+// lifecycleHook is an internal hook that's run on a status transition of
+// subscribers identified by their IDs or UUIDs.
+type lifecycleHook func(ids []int64, uuids []string, app *App)
+
+// lifecycleHooks holds the hooks of status transitions.
+type lifecycleHooks struct {
+	hooks map[string][]lifecycleHook
+}
+
+// On registers a hook to be run on a status transition.
+func (l *lifecycleHooks) On(transition string, h lifecycleHook) {
+	l.hooks[transition] = append(l.hooks[transition], h)
+}
+
+// onStatusTransition runs the hooks of a status transition of subscribers
+// identified by their IDs or UUIDs. Every write path that changes the status
+// of subscribers or subscriptions calls it with the ones that transitioned
+// so that the hooks are run consistently.
+func onStatusTransition(transition string, ids []int64, uuids []string, app *App) {
+	if len(ids) == 0 && len(uuids) == 0 {
+		return
+	}
+	for _, h := range app.lifecycle.hooks[transition] {
+		h(ids, uuids, app)
+	}
+}
+
+// initLifecycle registers the lifecycle hooks of status transitions. The
+// lifecycle webhook events are raised on all of them and the list rules are
+// applied on the configured ones.
+func initLifecycle() *lifecycleHooks {
+	var c lifecycleConf
+	if err := ko.Unmarshal("lifecycle", &c); err != nil {
+		lo.Fatalf("error loading lifecycle config: %v", err)
+	}
+
+	l := &lifecycleHooks{hooks: make(map[string][]lifecycleHook)}
+	for _, t := range statusTransitions {
+		t := t
+		l.On(t, func(ids []int64, uuids []string, app *App) {
+			pushSubscriberEventByIDs(t, ids, uuids, app)
+		})
+	}
+
+	for _, t := range c.ListRules {
+		if !isStatusTransition(t) {
+			lo.Fatalf("unknown status transition '%s' in lifecycle.list_rules", t)
+		}
+		l.On(t, applyTransitionListRules)
+	}
+	return l
+}
+
+// isStatusTransition checks whether a name is that of a status transition.
+func isStatusTransition(name string) bool {
+	for _, t := range statusTransitions {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyTransitionListRules applies the list rules to the subscribers of a
+// status transition.
+func applyTransitionListRules(ids []int64, uuids []string, app *App) {
+	if len(uuids) > 0 {
+		var subs models.Subscribers
+		if err := app.queries.GetSubscribersByIDs.Select(&subs, pq.Int64Array(nil), pq.StringArray(uuids)); err != nil {
+			app.log.Printf("error fetching subscribers for list rules: %v", err)
+			return
+		}
+		for _, s := range subs {
+			ids = append(ids, int64(s.ID))
+		}
+	}
+	applyListRules(ids, nil, app)
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"golang.org/x/net/html"
+)
+
+const (
+	linkCheckOK      = "ok"
+	linkCheckBroken  = "broken"
+	linkCheckSlow    = "slow"
+	linkCheckSkipped = "skipped"
+
+	linkTypeImage = "image"
+	linkTypeLink  = "link"
+
+	linkCheckMaxRedirects = 5
+)
+
+// errInternalURL is the error of requests to internal addresses, which
+// aren't checked so that campaign URLs can't be used to probe them.
+var errInternalURL = errors.New("internal addresses aren't checked")
+
+// internalNets are the loopback, private, and link-local networks that
+// URLs of external hosts aren't allowed to resolve to.
+var internalNets = func() []*net.IPNet {
+	var out []*net.IPNet
+	for _, c := range []string{"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8",
+		"169.254.0.0/16", "172.16.0.0/12", "192.168.0.0/16", "::1/128", "fc00::/7", "fe80::/10"} {
+		_, n, _ := net.ParseCIDR(c)
+		out = append(out, n)
+	}
+	return out
+}()
+
+// linkCheckConf has the settings of the checker of the image and link URLs
+// of campaigns.
+type linkCheckConf struct {
+	Timeout       time.Duration `koanf:"timeout"`
+	SlowThreshold time.Duration `koanf:"slow_threshold"`
+	Rate          float64       `koanf:"rate"`
+	Concurrency   int           `koanf:"concurrency"`
+	MaxURLs       int           `koanf:"max_urls"`
+}
+
+// linkChecker checks the reachability of the URLs in the bodies of
+// campaigns with HEAD requests. Only one check runs at a time.
+type linkChecker struct {
+	cfg    linkCheckConf
+	client *http.Client
+
+	// ownOrigins are the scheme://host:port origins of the root URL and the
+	// tracking domains, which may be internal. Only media URLs and the
+	// original URLs of the tracked links on them are checked.
+	ownOrigins  map[string]bool
+	mediaPrefix string
+
+	busy chan struct{}
+}
+
+// linkResource represents the result of the check of a URL.
+type linkResource struct {
+	URL        string `json:"url"`
+	Type       string `json:"type"`
+	Status     string `json:"status"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Duration   int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// linkCheckReport represents the results of the check of a campaign's URLs.
+// Resources only has the URLs that aren't ok.
+type linkCheckReport struct {
+	Checked   int            `json:"checked"`
+	Broken    int            `json:"broken"`
+	Slow      int            `json:"slow"`
+	Skipped   int            `json:"skipped"`
+	Resources []linkResource `json:"resources"`
+}
+
+// linkTransport is the transport of the requests of the checker. It records
+// the address that the connections of a request to an own origin or to the
+// media store may be to, even if it's internal, in the request's context.
+type linkTransport struct {
+	l *linkChecker
+	http.RoundTripper
+}
+
+// exemptAddrKey is the context key of the exempted address of a request.
+type exemptAddrKey struct{}
+
+// newLinkChecker returns a linkChecker that doesn't connect to internal
+// addresses other than those of the given own origins and of the media store.
+func newLinkChecker(cfg linkCheckConf, ownOrigins map[string]bool, mediaPrefix string) *linkChecker {
+	l := &linkChecker{
+		cfg:         cfg,
+		ownOrigins:  ownOrigins,
+		mediaPrefix: mediaPrefix,
+		busy:        make(chan struct{}, 1),
+	}
+	l.client = &http.Client{
+		Timeout: cfg.Timeout,
+		Transport: linkTransport{l: l, RoundTripper: &http.Transport{
+			DialContext:         l.dial,
+			TLSHandshakeTimeout: cfg.Timeout,
+			MaxIdleConnsPerHost: cfg.Concurrency,
+		}},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= linkCheckMaxRedirects {
+				return fmt.Errorf("stopped after %d redirects", linkCheckMaxRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported URL %s", req.URL)
+			}
+
+			// Redirects to internal addresses are refused unless they're
+			// within the own origins.
+			if !l.exempt(req) {
+				return checkHost(req.Context(), req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+	return l
+}
+
+// RoundTrip sends a request, with the address of its connections in its
+// context if they're exempted from the internal address check. Exempted
+// connections are closed after the request so that they aren't reused.
+func (t linkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.l.exempt(req) {
+		req = req.WithContext(context.WithValue(req.Context(), exemptAddrKey{}, hostPort(req.URL)))
+		req.Close = true
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
+
+// handleCheckCampaignLinks renders a campaign like its preview and checks
+// the reachability of the image and link URLs in its HTML body. It's
+// advisory and doesn't affect sending.
+func handleCheckCampaignLinks(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		lang  = strings.ToLower(c.FormValue("lang"))
+		camp  = &models.Campaign{}
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetCampaignForPreview.Get(camp, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+
+	var sub models.Subscriber
+	if err := app.queries.GetOneCampaignSubscriber.Get(&sub, camp.ID); err != nil {
+		if err == sql.ErrNoRows {
+			sub = dummySubscriber
+		} else {
+			app.log.Printf("error fetching subscriber: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error fetching subscriber: %s", pqErrMsg(err)))
+		}
+	}
+	if _, ok := camp.Variants[lang]; ok {
+		attribs := make(models.SubscriberAttribs, len(sub.Attribs)+1)
+		for k, a := range sub.Attribs {
+			attribs[k] = a
+		}
+		attribs[app.constants.LangAttrib] = lang
+		sub.Attribs = attribs
+	}
+
+	if err := app.manager.CompileTemplate(camp); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error compiling template: %v", err))
+	}
+	m := app.manager.NewCampaignMessage(camp, sub)
+	if err := m.Render(); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error rendering message: %v", err))
+	}
+
+	select {
+	case app.linkChecker.busy <- struct{}{}:
+		defer func() { <-app.linkChecker.busy }()
+	default:
+		return echo.NewHTTPError(http.StatusTooManyRequests,
+			"A link check is already running. Try again later.")
+	}
+
+	out, err := app.linkChecker.check(m.Body(), app)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error reading the campaign body: %v", err))
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// check checks the reachability of the URLs in an HTML body, at up to the
+// configured number of requests per second.
+func (l *linkChecker) check(body []byte, app *App) (linkCheckReport, error) {
+	res, err := l.resources(body, app)
+	if err != nil {
+		return linkCheckReport{}, err
+	}
+
+	var (
+		tick = time.NewTicker(time.Duration(float64(time.Second) / l.cfg.Rate))
+		ch   = make(chan int)
+		wg   sync.WaitGroup
+	)
+	defer tick.Stop()
+
+	for i := 0; i < l.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range ch {
+				l.checkURL(&res[n])
+			}
+		}()
+	}
+	for n := range res {
+		if res[n].Status != "" {
+			continue
+		}
+		<-tick.C
+		ch <- n
+	}
+	close(ch)
+	wg.Wait()
+
+	out := linkCheckReport{Resources: []linkResource{}}
+	for _, r := range res {
+		switch r.Status {
+		case linkCheckOK:
+			out.Checked++
+			continue
+		case linkCheckBroken:
+			out.Checked++
+			out.Broken++
+		case linkCheckSlow:
+			out.Checked++
+			out.Slow++
+		case linkCheckSkipped:
+			out.Skipped++
+		}
+		out.Resources = append(out.Resources, r)
+	}
+	return out, nil
+}
+
+// resources returns the unique image and link URLs of an HTML body that are
+// to be checked. The tracked and short links on the own hosts are replaced
+// with their original URLs and other URLs on them, eg: the view pixel and
+// the subscription pages, are ignored. URLs beyond the maximum number and
+// those that aren't http(s) are skipped.
+func (l *linkChecker) resources(body []byte, app *App) ([]linkResource, error) {
+	doc, err := html.Parse(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		out  []linkResource
+		seen = make(map[string]bool)
+		walk func(*html.Node)
+	)
+	add := func(u, typ string) {
+		u = strings.TrimSpace(u)
+		if u == "" || strings.HasPrefix(u, "#") || seen[u] {
+			return
+		}
+		seen[u] = true
+
+		p, err := url.Parse(u)
+		if err != nil {
+			out = append(out, linkResource{URL: u, Type: typ, Status: linkCheckBroken, Error: "invalid URL"})
+			return
+		}
+		switch p.Scheme {
+		case "http", "https":
+		case "mailto", "tel", "sms":
+			return
+		default:
+			out = append(out, linkResource{URL: u, Type: typ, Status: linkCheckSkipped, Error: "unsupported URL"})
+			return
+		}
+
+		if l.ownOrigins[origin(p)] && !l.isMedia(u) {
+			orig, ok := l.originalURL(p, app)
+			if !ok || seen[orig] {
+				return
+			}
+			seen[orig] = true
+			u = orig
+			if op, err := url.Parse(orig); err != nil || (op.Scheme != "http" && op.Scheme != "https") {
+				return
+			}
+		}
+
+		r := linkResource{URL: u, Type: typ}
+		if l.cfg.MaxURLs > 0 && len(out) >= l.cfg.MaxURLs {
+			r.Status = linkCheckSkipped
+			r.Error = fmt.Sprintf("beyond the maximum of %d URLs", l.cfg.MaxURLs)
+		}
+		out = append(out, r)
+	}
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			for _, a := range n.Attr {
+				switch {
+				case a.Key == "src" && n.Data == "img", a.Key == "background":
+					add(a.Val, linkTypeImage)
+				case a.Key == "href" && (n.Data == "a" || n.Data == "area"):
+					add(a.Val, linkTypeLink)
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	return out, nil
+}
+
+// originalURL returns the original URL of a tracked or a short link on an
+// own host.
+func (l *linkChecker) originalURL(p *url.URL, app *App) (string, bool) {
+	var (
+		out   string
+		parts = strings.Split(strings.Trim(p.Path, "/"), "/")
+		err   error
+	)
+	switch {
+	case len(parts) == 4 && parts[0] == "link" && regexpTrackedLink.MatchString(p.Path):
+		err = app.queries.GetLinkURL.Get(&out, parts[1])
+	case len(parts) == 2 && parts[0] == "s" && validShortCode(parts[1]):
+		err = app.queries.GetShortLinkURL.Get(&out, parts[1])
+	default:
+		return "", false
+	}
+	if err != nil {
+		if err != sql.ErrNoRows {
+			app.log.Printf("error fetching link URL: %v", err)
+		}
+		return "", false
+	}
+	return out, true
+}
+
+// checkURL checks a URL with a HEAD request, or a GET request if the server
+// doesn't allow HEAD, and records the result.
+func (l *linkChecker) checkURL(r *linkResource) {
+	start := time.Now()
+	code, err := l.request(http.MethodHead, r.URL)
+	if err == nil && (code == http.StatusMethodNotAllowed || code == http.StatusNotImplemented) {
+		code, err = l.request(http.MethodGet, r.URL)
+	}
+	d := time.Since(start)
+
+	r.StatusCode = code
+	r.Duration = d.Milliseconds()
+	switch {
+	case err != nil:
+		r.Status = linkCheckBroken
+		r.Error = err.Error()
+		if errors.Is(err, errInternalURL) {
+			r.Status = linkCheckSkipped
+			r.Error = errInternalURL.Error()
+		}
+	case code >= http.StatusBadRequest:
+		r.Status = linkCheckBroken
+	case l.cfg.SlowThreshold > 0 && d > l.cfg.SlowThreshold:
+		r.Status = linkCheckSlow
+	default:
+		r.Status = linkCheckOK
+	}
+}
+
+func (l *linkChecker) request(method, u string) (int, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "listmonk")
+	if method == http.MethodGet {
+		req.Header.Set("Range", "bytes=0-0")
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// exempt checks whether a request is to an own origin or to the media store,
+// and so were the requests of the redirects that led to it, if any.
+func (l *linkChecker) exempt(req *http.Request) bool {
+	for r := req; ; r = r.Response.Request {
+		if !l.ownOrigins[origin(r.URL)] && !l.isMedia(r.URL.String()) {
+			return false
+		}
+		if r.Response == nil {
+			return true
+		}
+	}
+}
+
+// isMedia checks whether a URL is that of a file in the media store.
+func (l *linkChecker) isMedia(u string) bool {
+	return l.mediaPrefix != "" && strings.HasPrefix(u, l.mediaPrefix)
+}
+
+// dial connects to an address. Connections other than to the exempted
+// address of the request, if any, are refused if they resolve to internal
+// addresses, including after DNS changes, as the resolved address is checked.
+func (l *linkChecker) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: l.cfg.Timeout}
+	if a, _ := ctx.Value(exemptAddrKey{}).(string); a != strings.ToLower(addr) {
+		d.Control = func(network, address string, _ syscall.RawConn) error {
+			h, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(h); ip == nil || isInternalIP(ip) {
+				return errInternalURL
+			}
+			return nil
+		}
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// checkHost checks that a host doesn't resolve to internal addresses.
+func checkHost(ctx context.Context, host string) error {
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if isInternalIP(ip.IP) {
+			return errInternalURL
+		}
+	}
+	return nil
+}
+
+// origin returns the lowercased scheme://host:port origin of a URL.
+func origin(u *url.URL) string {
+	return strings.ToLower(u.Scheme) + "://" + hostPort(u)
+}
+
+// hostPort returns the lowercased host:port of a URL with the default port
+// of its scheme if it doesn't have one.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if strings.EqualFold(u.Scheme, "https") {
+			port = "443"
+		}
+	}
+	return strings.ToLower(net.JoinHostPort(u.Hostname(), port))
+}
+
+// isInternalIP checks whether an IP is an unspecified, multicast, loopback,
+// private, or link-local address.
+func isInternalIP(ip net.IP) bool {
+	if ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range internalNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/knadh/listmonk/internal/segment"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+// listRuleReq represents a list rule create / update / preview request.
+type listRuleReq struct {
+	Name            string       `json:"name"`
+	ListID          int          `json:"list_id"`
+	Rules           segment.Rule `json:"rules"`
+	RemoveUnmatched bool         `json:"remove_unmatched"`
+	Enabled         bool         `json:"enabled"`
+}
+
+// listRuleCounts represents the number of subscribers affected
+// by a list rule.
+type listRuleCounts struct {
+	Matched int `db:"matched" json:"matched,omitempty"`
+	Added   int `db:"to_add" json:"added"`
+	Removed int `db:"to_remove" json:"removed"`
+}
+
+// handleGetListRules handles retrieval of list rules.
+func handleGetListRules(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.ListRule
+
+		id, _  = strconv.Atoi(c.Param("id"))
+		single = false
+	)
+
+	// Fetch one rule.
+	if id > 0 {
+		single = true
+	}
+
+	if err := app.queries.GetListRules.Select(&out, id); err != nil {
+		app.log.Printf("error fetching list rules: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching list rules: %s", pqErrMsg(err)))
+	}
+	if single && len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "List rule not found.")
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	if single {
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateListRule handles list rule creation. Rules only apply to
+// subscribers that are created or updated after they're created unless
+// they're explicitly backfilled.
+func handleCreateListRule(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req listRuleReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
+	}
+	if req.ListID < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid `list_id`.")
+	}
+
+	rules, err := validateSegmentRules(req.Rules)
+	if err != nil {
+		return err
+	}
+
+	// Insert and read ID.
+	var newID int
+	if err := app.queries.CreateListRule.Get(&newID, req.Name, req.ListID, rules,
+		req.RemoveUnmatched, req.Enabled); err != nil {
+		app.log.Printf("error creating list rule: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating list rule: %s", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprintf("%d", newID))
+	return handleGetListRules(c)
+}
+
+// handleUpdateListRule handles list rule modification.
+func handleUpdateListRule(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   listRuleReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name != "" && !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
+	}
+
+	rules, err := validateSegmentRules(req.Rules)
+	if err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdateListRule.Exec(id, req.Name, req.ListID, rules,
+		req.RemoveUnmatched, req.Enabled)
+	if err != nil {
+		app.log.Printf("error updating list rule: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating list rule: %s", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "List rule not found.")
+	}
+
+	return handleGetListRules(c)
+}
+
+// handleDeleteListRule handles list rule deletion.
+func handleDeleteListRule(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if _, err := app.queries.DeleteListRule.Exec(id); err != nil {
+		app.log.Printf("error deleting list rule: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error deleting list rule: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handlePreviewListRule does a dry-run of a list rule against all existing
+// subscribers and returns the number of subscribers that match it and
+// those that would be added to and removed from the list by a backfill.
+func handlePreviewListRule(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req listRuleReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.ListID < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid `list_id`.")
+	}
+
+	exp, args, err := segment.Compile(req.Rules, 1, app.attribIndexes.Keys())
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid rules: %v", err))
+	}
+
+	var out listRuleCounts
+	if err := app.db.Get(&out, fmt.Sprintf(app.queries.CountListRuleSubscribers, exp),
+		append([]interface{}{req.ListID}, args...)...); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error querying list rule: %v", pqErrMsg(err)))
+	}
+	if !req.RemoveUnmatched {
+		out.Removed = 0
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleBackfillListRule applies a list rule to all existing subscribers.
+func handleBackfillListRule(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		rules []models.ListRule
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetListRules.Select(&rules, id); err != nil {
+		app.log.Printf("error fetching list rules: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching list rules: %s", pqErrMsg(err)))
+	}
+	if len(rules) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "List rule not found.")
+	}
+
+	out, err := runListRule(rules[0], nil, nil, app)
+	if err != nil {
+		app.log.Printf("error backfilling list rule: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error backfilling list rule: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// applyListRules applies all enabled list rules to the given subscribers
+// that are identified either by their IDs or e-mails. Rules are applied on
+// a best-effort basis and errors are only logged as they shouldn't fail
+// the subscriber write that triggered them.
+func applyListRules(ids []int64, emails []string, app *App) {
+	if len(ids) == 0 && len(emails) == 0 {
+		return
+	}
+
+	var rules []models.ListRule
+	if err := app.queries.GetListRules.Select(&rules, 0); err != nil {
+		app.log.Printf("error fetching list rules: %v", err)
+		return
+	}
+
+	var (
+		idArr    pq.Int64Array
+		emailArr pq.StringArray
+	)
+	if len(ids) > 0 {
+		idArr = pq.Int64Array(ids)
+	}
+	if len(emails) > 0 {
+		emailArr = pq.StringArray(emails)
+	}
+
+	for _, r := range rules {
+		if !r.Enabled {
+			continue
+		}
+		if _, err := runListRule(r, idArr, emailArr, app); err != nil {
+			app.log.Printf("error applying list rule (%s): %v", r.Name, err)
+		}
+	}
+}
+
+// runListRule adds the subscribers matching a list rule to its list and,
+// if the rule says so, removes the ones that don't match from it. If both
+// ids and emails are nil, the rule is applied to all subscribers.
+func runListRule(r models.ListRule, ids pq.Int64Array, emails pq.StringArray, app *App) (listRuleCounts, error) {
+	var (
+		out  listRuleCounts
+		rule segment.Rule
+	)
+	if err := json.Unmarshal(r.Rules, &rule); err != nil {
+		return out, fmt.Errorf("error reading rules: %v", err)
+	}
+
+	exp, args, err := segment.Compile(rule, 3, app.attribIndexes.Keys())
+	if err != nil {
+		return out, fmt.Errorf("invalid rules: %v", err)
+	}
+	args = append([]interface{}{r.ListID, ids, emails}, args...)
+
+	if err := app.db.Get(&out.Added,
+		fmt.Sprintf(app.queries.AddListRuleSubscribers, exp), args...); err != nil {
+		return out, err
+	}
+
+	if r.RemoveUnmatched {
+		if err := app.db.Get(&out.Removed,
+			fmt.Sprintf(app.queries.RemoveListRuleSubscribers, exp), args...); err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
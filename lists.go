@@ -1,11 +1,15 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
 
@@ -83,6 +87,30 @@ func handleCreateList(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			"Invalid length for the name field.")
 	}
+	o.FromName = strings.TrimSpace(o.FromName)
+	if err := validateFromName(o.FromName, app.constants.FromEmail, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid `from_name`: %v", err))
+	}
+	if err := validateListAddrs(&o); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateListSendWindows(&o); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	o.UnsubRedirect = strings.TrimSpace(o.UnsubRedirect)
+	if err := validateUnsubRedirect(o.UnsubRedirect, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid `unsubscribe_redirect`: %v", err))
+	}
+	if err := validateListWinback(&o, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	o.Messenger = strings.TrimSpace(o.Messenger)
+	if o.Messenger != "" && !app.manager.HasMessenger(o.Messenger) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Unknown messenger %s", o.Messenger))
+	}
 
 	uu, err := uuid.NewV4()
 	if err != nil {
@@ -98,7 +126,18 @@ func handleCreateList(c echo.Context) error {
 		o.Name,
 		o.Type,
 		o.Optin,
-		pq.StringArray(normalizeTags(o.Tags))); err != nil {
+		pq.StringArray(normalizeTags(o.Tags)),
+		o.FromName,
+		o.ReplyTo,
+		o.BounceAddress,
+		o.SendWindows,
+		o.SendTimezone,
+		o.UnsubRedirect,
+		o.WinbackDays,
+		o.WinbackSendDays,
+		o.WinbackSubject,
+		o.WinbackBody,
+		o.Messenger); err != nil {
 		app.log.Printf("error creating list: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error creating list: %s", pqErrMsg(err)))
@@ -127,8 +166,35 @@ func handleUpdateList(c echo.Context) error {
 		return err
 	}
 
+	o.FromName = strings.TrimSpace(o.FromName)
+	if err := validateFromName(o.FromName, app.constants.FromEmail, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid `from_name`: %v", err))
+	}
+	if err := validateListAddrs(&o); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := validateListSendWindows(&o); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	o.UnsubRedirect = strings.TrimSpace(o.UnsubRedirect)
+	if err := validateUnsubRedirect(o.UnsubRedirect, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid `unsubscribe_redirect`: %v", err))
+	}
+	if err := validateListWinback(&o, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	o.Messenger = strings.TrimSpace(o.Messenger)
+	if o.Messenger != "" && !app.manager.HasMessenger(o.Messenger) {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Unknown messenger %s", o.Messenger))
+	}
+
 	res, err := app.queries.UpdateList.Exec(id,
-		o.Name, o.Type, o.Optin, pq.StringArray(normalizeTags(o.Tags)))
+		o.Name, o.Type, o.Optin, pq.StringArray(normalizeTags(o.Tags)), o.FromName,
+		o.ReplyTo, o.BounceAddress, o.SendWindows, o.SendTimezone, o.UnsubRedirect,
+		o.WinbackDays, o.WinbackSendDays, o.WinbackSubject, o.WinbackBody, o.Messenger)
 	if err != nil {
 		app.log.Printf("error updating list: %v", err)
 		return echo.NewHTTPError(http.StatusBadRequest,
@@ -167,3 +233,73 @@ func handleDeleteLists(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
+
+// validateListAddrs trims and validates the optional Reply-To and bounce
+// addresses of a list, which should be bare e-mail addresses.
+func validateListAddrs(o *models.List) error {
+	o.ReplyTo = strings.TrimSpace(o.ReplyTo)
+	o.BounceAddress = strings.TrimSpace(o.BounceAddress)
+
+	if o.ReplyTo != "" && !isListAddr(o.ReplyTo) {
+		return errors.New("Invalid `reply_to`. It should be an e-mail address, eg: support@site.com")
+	}
+	if o.BounceAddress != "" && !isListAddr(o.BounceAddress) {
+		return errors.New("Invalid `bounce_address`. It should be an e-mail address, eg: bounces@site.com")
+	}
+	return nil
+}
+
+// validateListSendWindows validates the optional send windows of a list and
+// its timezone, which defaults to UTC.
+func validateListSendWindows(o *models.List) error {
+	if err := o.SendWindows.Validate(); err != nil {
+		return fmt.Errorf("Invalid `send_windows`: %v", err)
+	}
+
+	o.SendTimezone = strings.TrimSpace(o.SendTimezone)
+	if o.SendTimezone == "" {
+		o.SendTimezone = "UTC"
+	}
+	if _, err := time.LoadLocation(o.SendTimezone); err != nil {
+		return fmt.Errorf("Invalid `send_timezone`: %v", err)
+	}
+	return nil
+}
+
+// validateListWinback validates the optional win-back grace period of a
+// list and compiles its win-back message.
+func validateListWinback(o *models.List, app *App) error {
+	if o.WinbackDays < 0 || o.WinbackDays > winbackMaxDays {
+		return fmt.Errorf("Invalid `winback_days`. It should be between 0 and %d.", winbackMaxDays)
+	}
+	if o.WinbackSendDays < 0 || (o.WinbackDays > 0 && o.WinbackSendDays >= o.WinbackDays) {
+		return errors.New("Invalid `winback_send_days`. It should be less than `winback_days`.")
+	}
+
+	o.WinbackSubject = strings.TrimSpace(o.WinbackSubject)
+	if o.WinbackSubject == "" && o.WinbackBody == "" {
+		return nil
+	}
+	if !strHasLen(o.WinbackSubject, 1, stdInputMaxLen) {
+		return errors.New("Invalid length for `winback_subject`.")
+	}
+	if o.WinbackBody == "" {
+		return errors.New("`winback_body` is required with `winback_subject`.")
+	}
+
+	camp := models.Campaign{
+		Subject:      o.WinbackSubject,
+		Body:         o.WinbackBody,
+		TemplateBody: tplTag,
+	}
+	if err := app.manager.CompileTemplate(&camp); err != nil {
+		return fmt.Errorf("Invalid win-back message: %v", err)
+	}
+	return nil
+}
+
+// isListAddr checks whether a list address is an e-mail address that VERP
+// and reply tracking patterns can be rebased on.
+func isListAddr(addr string) bool {
+	return subimporter.IsEmail(addr) && !strings.ContainsAny(addr, "{}")
+}
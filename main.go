@@ -1,11 +1,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"html/template"
 	"log"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -14,27 +18,39 @@ import (
 	"github.com/knadh/koanf/providers/env"
 	"github.com/knadh/koanf/providers/file"
 	"github.com/knadh/koanf/providers/posflag"
+	"github.com/knadh/listmonk/internal/jobs"
 	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/stuffbin"
+	"github.com/labstack/echo"
 	flag "github.com/spf13/pflag"
 )
 
 // App contains the "global" components that are
 // passed around, especially through HTTP handlers.
 type App struct {
-	fs        stuffbin.FileSystem
-	db        *sqlx.DB
-	queries   *Queries
-	constants *constants
-	manager   *manager.Manager
-	importer  *subimporter.Importer
-	messenger messenger.Messenger
-	media     media.Store
-	notifTpls *template.Template
-	log       *log.Logger
+	fs            stuffbin.FileSystem
+	db            *sqlx.DB
+	queries       *Queries
+	constants     *constants
+	manager       *manager.Manager
+	importer      *subimporter.Importer
+	jobs          *jobs.Runner
+	messenger     messenger.Messenger
+	webhooks      *webhooks.Webhooks
+	events        *eventsConf
+	subWebhook    *subWebhookConf
+	attribIndexes *attribIndexes
+	sendConfirms  *sendConfirmations
+	benchmark     *messenger.Fake
+	linkChecker   *linkChecker
+	lifecycle     *lifecycleHooks
+	media         media.Store
+	notifTpls     *template.Template
+	log           *log.Logger
 }
 
 var (
@@ -44,10 +60,18 @@ var (
 	// Global configuration reader.
 	ko = koanf.New(".")
 
+	// Commandline flags that the config is loaded with.
+	cfgFlags *flag.FlagSet
+
 	buildString string
+
+	// httpShutdown is closed when the HTTP server starts shutting down
+	// to end long-lived responses such as progress streams.
+	httpShutdown = make(chan bool)
 )
 
-func init() {
+// initFlags parses the commandline flags and loads the config.
+func initFlags() {
 	f := flag.NewFlagSet("config", flag.ContinueOnError)
 	f.Usage = func() {
 		// Register --help handler.
@@ -84,31 +108,40 @@ func init() {
 		os.Exit(0)
 	}
 
-	// Load config files.
-	cFiles, _ := f.GetStringSlice("config")
+	// Load the config files, environment variables, and flags.
+	cfgFlags = f
+	if err := loadConfig(ko); err != nil {
+		if os.IsNotExist(err) {
+			lo.Fatal("config file not found. If there isn't one yet, run --new-config to generate one.")
+		}
+		lo.Fatalf("error loading config: %v", err)
+	}
+}
+
+// loadConfig loads the config files, the environment variables, and the
+// commandline flags, in that order, into the given config.
+func loadConfig(k *koanf.Koanf) error {
+	cFiles, _ := cfgFlags.GetStringSlice("config")
 	for _, f := range cFiles {
 		lo.Printf("reading config: %s", f)
-		if err := ko.Load(file.Provider(f), toml.Parser()); err != nil {
-			if os.IsNotExist(err) {
-				lo.Fatal("config file not found. If there isn't one yet, run --new-config to generate one.")
-			}
-			lo.Fatalf("error loadng config from file: %v.", err)
+		if err := k.Load(file.Provider(f), toml.Parser()); err != nil {
+			return err
 		}
 	}
 
 	// Load environment variables and merge into the loaded config.
-	if err := ko.Load(env.Provider("LISTMONK_", ".", func(s string) string {
+	if err := k.Load(env.Provider("LISTMONK_", ".", func(s string) string {
 		return strings.Replace(strings.ToLower(
 			strings.TrimPrefix(s, "LISTMONK_")), "__", ".", -1)
 	}), nil); err != nil {
-		lo.Fatalf("error loading config from env: %v", err)
-	}
-	if err := ko.Load(posflag.Provider(f, ".", ko), nil); err != nil {
-		lo.Fatalf("error loading config: %v", err)
+		return fmt.Errorf("error loading config from env: %v", err)
 	}
+	return k.Load(posflag.Provider(cfgFlags, ".", k), nil)
 }
 
 func main() {
+	initFlags()
+
 	// Initialize the DB and the filesystem that are required by the installer
 	// and the app.
 	var (
@@ -127,22 +160,98 @@ func main() {
 	// Initialize the main app controller that wraps all of the app's
 	// components. This is passed around HTTP handlers.
 	app := &App{
-		fs:        fs,
-		db:        db,
-		constants: initConstants(),
-		media:     initMediaStore(),
-		log:       lo,
+		fs:         fs,
+		db:         db,
+		constants:  initConstants(),
+		media:      initMediaStore(),
+		events:     initProviderEvents(),
+		subWebhook: initSubscriberWebhook(),
+		log:        lo,
 	}
 	_, app.queries = initQueries(queryFilePath, db, fs, true)
-	app.manager = initCampaignManager(app.queries, app.constants, app)
+	initAdminUser(app.queries)
+	app.attribIndexes = initAttribIndexes(app.queries)
+	app.sendConfirms = &sendConfirmations{tokens: make(map[string]sendConfirmation)}
+	msgLog, msgLogRetention := initMessageLog()
+	app.manager = initCampaignManager(app.queries, app.constants, msgLog, app)
 	app.importer = initImporter(app.queries, db, app)
-	app.messenger = initMessengers(app.manager)
+	exps := initExports(app.constants.Privacy.Exportable)
+	app.jobs = initJobs(app.queries, exps, app)
+	app.messenger, app.benchmark = initMessengers(app.manager)
 	app.notifTpls = initNotifTemplates("/email-templates/*.html", fs, app.constants)
+	app.webhooks = initWebhooks(app.queries)
+	app.lifecycle = initLifecycle()
+	app.linkChecker = initLinkChecker(app.constants, app.media)
 
 	// Start the campaign workers. The campaign batches (fetch from DB, push out
 	// messages) get processed at the specified interval.
 	go app.manager.Run(time.Second * 5)
 
-	// Start and run the app server.
-	initHTTPServer(app)
+	// Start the outbound webhook workers.
+	go app.webhooks.Run()
+
+	// Start running background jobs.
+	go app.jobs.Run()
+
+	// Start queuing scheduled exports.
+	go runExports(exps, app)
+
+	// Start purging tracking events past their retention periods.
+	go runRetentionPurge(initRetention(), app)
+	go runMessageLogPurge(msgLogRetention, app)
+
+	// Start sending the welcome messages of lists that are due.
+	go runWelcomeMessages(app)
+
+	// Start enrolling subscribers in sequences and sending their due steps.
+	go runSequences(app)
+
+	// Start sending the win-back messages of paused unsubscriptions and
+	// removing the ones past their grace periods.
+	go runWinbacks(app)
+
+	// Start releasing the held staged rollouts of campaigns that pass their gates.
+	go runRolloutGates(app)
+
+	// Start scanning the inbound mailbox for unsubscribe replies.
+	if ib := initInbox(app); ib != nil {
+		go ib.Run()
+	}
+
+	// Start the app server.
+	srv := initHTTPServer(app)
+
+	// Wait for a shutdown signal.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+	lo.Printf("received %v. shutting down", <-sig)
+	shutdown(srv, app, ko.Duration("app.shutdown_timeout"))
+}
+
+// shutdown stops accepting new HTTP requests and new campaign batches and
+// waits for the in-flight requests and the messages of the batches being
+// processed, bounded by the timeout.
+func shutdown(srv *echo.Echo, app *App, timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = time.Second * 30
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		if err := srv.Shutdown(ctx); err != nil {
+			lo.Printf("error shutting down HTTP server: %v", err)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		if err := app.manager.Stop(ctx); err != nil {
+			lo.Printf("error stopping campaign manager: %v", err)
+		}
+	}()
+	wg.Wait()
+	lo.Println("shutdown complete")
 }
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+
 	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/manager"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
 )
@@ -10,28 +14,80 @@ import (
 // database.
 type runnerDB struct {
 	queries *Queries
+
+	// Freeze the content of campaigns in snapshots when they start.
+	snapshots bool
+
+	// The subscriber attribute with the timezones of subscribers and the
+	// default timezone for campaigns with a local send time.
+	localSendAttrib string
+	localSendTZ     string
 }
 
-func newManagerDB(q *Queries) *runnerDB {
+func newManagerDB(q *Queries, snapshots bool, localSendAttrib, localSendTZ string) *runnerDB {
 	return &runnerDB{
-		queries: q,
+		queries:         q,
+		snapshots:       snapshots,
+		localSendAttrib: localSendAttrib,
+		localSendTZ:     localSendTZ,
 	}
 }
 
-// NextCampaigns retrieves active campaigns ready to be processed.
-func (r *runnerDB) NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error) {
+// NextCampaigns retrieves up to limit (0 for all) active campaigns ready to
+// be processed in the order of the queue. With snapshots, their content is
+// replaced with the content frozen when they started.
+func (r *runnerDB) NextCampaigns(excludeIDs []int64, limit int) ([]*models.Campaign, error) {
 	var out []*models.Campaign
-	err := r.queries.NextCampaigns.Select(&out, pq.Int64Array(excludeIDs))
-	return out, err
+	if err := r.queries.NextCampaigns.Select(&out, pq.Int64Array(excludeIDs), r.snapshots, limit); err != nil {
+		return nil, err
+	}
+
+	if r.snapshots {
+		for _, c := range out {
+			c.ApplySnapshot()
+		}
+	}
+	return out, nil
 }
 
 // NextSubscribers retrieves a subset of subscribers of a given campaign.
-// Since batches are processed sequentially, the retrieval is ordered by ID,
-// and every batch takes the last ID of the last batch and fetches the next
-// batch above that.
+// Since batches are processed sequentially, the retrieval is ordered by the
+// campaign's send order (ID by default), and every batch takes the sort key
+// of the last batch and fetches the next batch after that. Campaigns with a
+// local send time only get the subscribers whose send time has come.
 func (r *runnerDB) NextSubscribers(campID, limit int) ([]models.Subscriber, error) {
 	var out []models.Subscriber
-	err := r.queries.NextCampaignSubscribers.Select(&out, campID, limit)
+	err := r.queries.NextCampaignSubscribers.Select(&out, campID, limit, r.localSendAttrib, r.localSendTZ)
+	return out, err
+}
+
+// CheckpointCampaign drops the checkpoint of the oldest batch of subscribers
+// of a campaign once its messages have been pushed and recorded.
+func (r *runnerDB) CheckpointCampaign(campID int) error {
+	_, err := r.queries.CheckpointCampaign.Exec(campID)
+	return err
+}
+
+// ResumeCampaign rewinds a running campaign to the checkpoint of its oldest
+// batch of subscribers whose messages may not all have been pushed, eg: when
+// it was interrupted by a crash. It returns the campaign's sent count and
+// whether it was rewound.
+func (r *runnerDB) ResumeCampaign(campID int) (int, bool, error) {
+	var sent int
+	if err := r.queries.ResumeCampaign.Get(&sent, campID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	return sent, true, nil
+}
+
+// GetLocalSendBuckets retrieves the timezones of the recipients of a
+// campaign with a local send time and when they're sent the campaign.
+func (r *runnerDB) GetLocalSendBuckets(campID int) ([]models.LocalSendBucket, error) {
+	var out []models.LocalSendBucket
+	err := r.queries.GetCampaignLocalSend.Select(&out, campID, r.localSendAttrib, r.localSendTZ)
 	return out, err
 }
 
@@ -48,6 +104,13 @@ func (r *runnerDB) UpdateCampaignStatus(campID int, status string) error {
 	return err
 }
 
+// HoldCampaignRollout pauses a staged rollout that has been sent to its
+// initial share of subscribers.
+func (r *runnerDB) HoldCampaignRollout(campID int) error {
+	_, err := r.queries.HoldCampaignRollout.Exec(campID)
+	return err
+}
+
 // CreateLink registers a URL with a UUID for tracking clicks and returns the UUID.
 func (r *runnerDB) CreateLink(url string) (string, error) {
 	// Create a new UUID for the URL. If the URL already exists in the DB
@@ -64,3 +127,84 @@ func (r *runnerDB) CreateLink(url string) (string, error) {
 
 	return out, nil
 }
+
+// CreateShortLink returns the short code of a registered link (UUID) of a
+// campaign, creating it with a random code if it doesn't exist.
+func (r *runnerDB) CreateShortLink(campID int, linkUUID string) (string, error) {
+	for i := 0; ; i++ {
+		code, err := newShortCode()
+		if err != nil {
+			return "", err
+		}
+
+		var out string
+		err = r.queries.CreateShortLink.Get(&out, campID, linkUUID, code)
+		if err == nil {
+			return out, nil
+		}
+
+		// Retry on the unlikely collision of codes.
+		if e, ok := err.(*pq.Error); ok && e.Code == "23505" && i < shortCodeRetries {
+			continue
+		}
+		return "", err
+	}
+}
+
+// SetCampaignAbortReason records why a campaign was aborted.
+func (r *runnerDB) SetCampaignAbortReason(campID int, reason string) error {
+	_, err := r.queries.SetCampaignAbortReason.Exec(campID, reason)
+	return err
+}
+
+// RecordRenderErrors adds messages of a campaign that couldn't be rendered.
+func (r *runnerDB) RecordRenderErrors(campID, n int, lastErr string) error {
+	_, err := r.queries.RecordRenderErrors.Exec(campID, n, lastErr)
+	return err
+}
+
+// RecordMessage records a rendered campaign message in the message log.
+func (r *runnerDB) RecordMessage(m manager.RenderedMessage) error {
+	h, err := json.Marshal(m.Headers)
+	if err != nil {
+		return err
+	}
+	_, err = r.queries.InsertRenderedMessage.Exec(m.CampaignID, m.SubscriberID, h, string(m.Body))
+	return err
+}
+
+// RecordDeliveries records the subscribers that campaign messages were
+// delivered to.
+func (r *runnerDB) RecordDeliveries(d []manager.Delivery) error {
+	var (
+		campIDs = make(pq.Int64Array, len(d))
+		subIDs  = make(pq.Int64Array, len(d))
+	)
+	for i, v := range d {
+		campIDs[i] = int64(v.CampaignID)
+		subIDs[i] = int64(v.SubscriberID)
+	}
+
+	_, err := r.queries.InsertCampaignDeliveries.Exec(campIDs, subIDs)
+	return err
+}
+
+// RecordFailures records the subscribers that campaign messages failed
+// to be sent to.
+func (r *runnerDB) RecordFailures(f []manager.Failure) error {
+	var (
+		campIDs = make(pq.Int64Array, len(f))
+		subIDs  = make(pq.Int64Array, len(f))
+		errs    = make(pq.StringArray, len(f))
+		perm    = make(pq.BoolArray, len(f))
+	)
+	for i, v := range f {
+		campIDs[i] = int64(v.CampaignID)
+		subIDs[i] = int64(v.SubscriberID)
+		errs[i] = v.Error
+		perm[i] = v.Permanent
+	}
+
+	_, err := r.queries.InsertCampaignFailures.Exec(campIDs, subIDs, errs, perm)
+	return err
+}
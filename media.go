@@ -3,9 +3,13 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"path/filepath"
 	"strconv"
+	"strings"
 
 	"github.com/disintegration/imaging"
 	"github.com/gofrs/uuid"
@@ -16,37 +20,49 @@ import (
 const (
 	thumbPrefix   = "thumb_"
 	thumbnailSize = 90
-)
 
-// imageMimes is the list of image types allowed to be uploaded.
-var imageMimes = []string{
-	"image/jpg",
-	"image/jpeg",
-	"image/png",
-	"image/svg",
-	"image/gif"}
+	// multipartOverhead is the allowance for the multipart form's
+	// boundaries and headers over the maximum file size.
+	multipartOverhead = 64 * 1024
+)
 
 // handleUploadMedia handles media file uploads.
 func handleUploadMedia(c echo.Context) error {
 	var (
 		app     = c.Get("app").(*App)
+		conf    = app.constants.MediaUpload
+		maxSize = conf.MaxSize * 1024
 		cleanUp = false
 	)
+
+	// Reject oversized uploads before the request body is read.
+	req := c.Request()
+	if req.ContentLength > maxSize+multipartOverhead {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("File exceeds the maximum size of %d KB.", conf.MaxSize))
+	}
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, maxSize+multipartOverhead)
+
 	file, err := c.FormFile("file")
 	if err != nil {
+		if err.Error() == "http: request body too large" {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("File exceeds the maximum size of %d KB.", conf.MaxSize))
+		}
 		return echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Invalid file uploaded: %v", err))
 	}
-
-	// Validate MIME type with the list of allowed types.
-	var typ = file.Header.Get("Content-type")
-	if ok := validateMIME(typ, imageMimes); !ok {
-		return echo.NewHTTPError(http.StatusBadRequest,
-			fmt.Sprintf("Unsupported file type (%s) uploaded.", typ))
+	if file.Size > maxSize {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("File exceeds the maximum size of %d KB.", conf.MaxSize))
 	}
 
-	// Generate filename
-	fName := generateFileName(file.Filename)
+	// Validate the extension with the list of allowed extensions.
+	ext := strings.ToLower(filepath.Ext(file.Filename))
+	if !validateMIME(ext, conf.Exts) {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType,
+			fmt.Sprintf("Unsupported file extension (%s) uploaded.", ext))
+	}
 
 	// Read file contents in memory
 	src, err := file.Open()
@@ -56,8 +72,23 @@ func handleUploadMedia(c echo.Context) error {
 	}
 	defer src.Close()
 
+	// Validate the MIME type detected from the contents (and not the one
+	// sent by the client) with the list of allowed types.
+	typ, err := detectMIME(src)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error reading file: %s", err))
+	}
+	if !validateMIME(typ, conf.Types) {
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType,
+			fmt.Sprintf("Unsupported file type (%s) uploaded.", typ))
+	}
+
+	// Generate filename
+	fName := generateFileName(file.Filename)
+
 	// Upload the file.
-	fName, err = app.media.Put(fName, typ, src)
+	fName, err = app.media.Upload(fName, typ, src)
 	if err != nil {
 		app.log.Printf("error uploading file: %v", err)
 		cleanUp = true
@@ -84,7 +115,7 @@ func handleUploadMedia(c echo.Context) error {
 	}
 
 	// Upload thumbnail.
-	thumbfName, err := app.media.Put(thumbPrefix+fName, typ, thumbFile)
+	thumbfName, err := app.media.Upload(thumbPrefix+fName, typ, thumbFile)
 	if err != nil {
 		cleanUp = true
 		app.log.Printf("error saving thumbnail: %v", err)
@@ -121,8 +152,8 @@ func handleGetMedia(c echo.Context) error {
 	}
 
 	for i := 0; i < len(out); i++ {
-		out[i].URL = app.media.Get(out[i].Filename)
-		out[i].ThumbURL = app.media.Get(out[i].Thumb)
+		out[i].URL = app.media.URL(out[i].Filename)
+		out[i].ThumbURL = app.media.URL(out[i].Thumb)
 	}
 
 	return c.JSON(http.StatusOK, okResp{out})
@@ -150,6 +181,25 @@ func handleDeleteMedia(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// detectMIME detects the MIME type of a file from its first 512 bytes
+// and rewinds it.
+func detectMIME(f multipart.File) (string, error) {
+	b := make([]byte, 512)
+	n, err := io.ReadFull(f, b)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	typ, _, err := mime.ParseMediaType(http.DetectContentType(b[:n]))
+	if err != nil {
+		return "", err
+	}
+	return typ, nil
+}
+
 // createThumbnail reads the file object and returns a smaller image
 func createThumbnail(file *multipart.FileHeader) (*bytes.Reader, error) {
 	src, err := file.Open()
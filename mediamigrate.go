@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/jobs"
+	"github.com/knadh/listmonk/internal/media"
+	"github.com/labstack/echo"
+)
+
+// jobTypeMediaMigration is the job type of media migrations.
+const jobTypeMediaMigration = "media-migration"
+
+// mediaMigrationJob represents the params of a job that copies the media of
+// a provider to another.
+type mediaMigrationJob struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// mediaMigrationResult is the result of a media migration job. Copied are the
+// files that were copied and Skipped, the ones that were already copied by an
+// earlier run. Rewritten is the number of times media URLs were rewritten in
+// templates, welcome steps, and campaigns.
+type mediaMigrationResult struct {
+	Copied    int                  `json:"copied"`
+	Skipped   int                  `json:"skipped"`
+	Rewritten int                  `json:"rewritten"`
+	Failed    []mediaMigrationFail `json:"failed"`
+}
+
+// mediaMigrationFail is a media that couldn't be migrated.
+type mediaMigrationFail struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+	Error    string `json:"error"`
+}
+
+// migrationMedia is a media with the names of its copies on the provider it's
+// migrated to, which are empty if it hasn't been copied.
+type migrationMedia struct {
+	media.Media
+	DstFilename string `db:"dst_filename"`
+	DstThumb    string `db:"dst_thumb"`
+}
+
+// handleMigrateMedia queues a job that copies all the media of the current
+// provider to another configured one (eg: upload.s3), verifies the copies,
+// and rewrites the media URLs in stored content to the new ones. Re-running
+// it only copies the files that are missing or differ on the new provider.
+// The job can be inspected and cancelled on /api/jobs.
+func handleMigrateMedia(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req struct {
+			Provider string `json:"provider"`
+		}
+	)
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	req.Provider = strings.TrimSpace(req.Provider)
+	if req.Provider == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid `provider`.")
+	}
+	if req.Provider == app.constants.MediaProvider {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"Media can only be migrated to a provider other than the current one.")
+	}
+	if _, err := newMediaProviderStore(req.Provider); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error initializing upload provider: %v", err))
+	}
+
+	id, err := app.jobs.Enqueue(jobTypeMediaMigration, mediaMigrationJob{
+		From: app.constants.MediaProvider,
+		To:   req.Provider,
+	})
+	if err != nil {
+		app.log.Printf("error queuing media migration job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error starting media migration: %s", pqErrMsg(err)))
+	}
+
+	var out jobs.Job
+	if err := app.queries.GetJob.Get(&out, id); err != nil {
+		app.log.Printf("error fetching job: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching job: %s", pqErrMsg(err)))
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// makeMediaMigrationJobHandler returns the handler of media migration jobs.
+// Media that fail to migrate are reported in the result and don't stop the
+// job.
+func makeMediaMigrationJobHandler(app *App) jobs.Handler {
+	return func(c *jobs.Ctx) error {
+		var p mediaMigrationJob
+		if err := c.Params(&p); err != nil {
+			return fmt.Errorf("error reading media migration params: %v", err)
+		}
+
+		src := app.media
+		if p.From != app.constants.MediaProvider {
+			return fmt.Errorf("the upload provider has changed from %s to %s", p.From, app.constants.MediaProvider)
+		}
+		dst, err := newMediaProviderStore(p.To)
+		if err != nil {
+			return fmt.Errorf("error initializing %s upload provider: %v", p.To, err)
+		}
+
+		var items []migrationMedia
+		if err := app.queries.GetMediaMigration.Select(&items, p.From, p.To); err != nil {
+			return fmt.Errorf("error fetching media: %v", err)
+		}
+
+		res := mediaMigrationResult{Failed: []mediaMigrationFail{}}
+		c.SetProgress(len(items), 0)
+		for i, m := range items {
+			if c.Cancelled() {
+				c.SetResult(res)
+				return jobs.ErrCancelled
+			}
+
+			n, err := migrateMedia(m, src, dst, p.To, app)
+			if err != nil {
+				res.Failed = append(res.Failed, mediaMigrationFail{ID: m.ID, Filename: m.Filename, Error: err.Error()})
+			} else if n.copied > 0 {
+				res.Copied++
+			} else {
+				res.Skipped++
+			}
+			res.Rewritten += n.rewritten
+
+			c.SetProgress(len(items), i+1)
+		}
+
+		if err := c.SetResult(res); err != nil {
+			return err
+		}
+		if len(res.Failed) > 0 {
+			return fmt.Errorf("%d of %d media couldn't be migrated", len(res.Failed), len(items))
+		}
+		return nil
+	}
+}
+
+// mediaMigrationCount counts the files copied and the records rewritten by
+// the migration of a media.
+type mediaMigrationCount struct {
+	copied    int
+	rewritten int
+}
+
+// migrateMedia copies a media file and its thumbnail to another store, records
+// the copy, and rewrites the URLs of the original files in stored content.
+func migrateMedia(m migrationMedia, src, dst media.Store, provider string, app *App) (mediaMigrationCount, error) {
+	var out mediaMigrationCount
+
+	name, ok, err := copyMediaFile(m.Filename, m.DstFilename, src, dst)
+	if err != nil {
+		return out, err
+	}
+	if ok {
+		out.copied++
+	}
+
+	thumb, ok, err := copyMediaFile(m.Thumb, m.DstThumb, src, dst)
+	if err != nil {
+		return out, err
+	}
+	if ok {
+		out.copied++
+	}
+
+	if out.copied > 0 || m.DstFilename == "" {
+		uu, err := uuid.NewV4()
+		if err != nil {
+			return out, err
+		}
+		if _, err := app.queries.SaveMigratedMedia.Exec(uu, name, thumb, provider, m.ID, m.CreatedAt); err != nil {
+			return out, fmt.Errorf("error recording media: %v", pqErrMsg(err))
+		}
+	}
+
+	// The URLs are rewritten on every run as the content may have been
+	// edited with the old URLs since the last one.
+	for _, u := range [][2]string{{src.URL(m.Filename), dst.URL(name)}, {src.URL(m.Thumb), dst.URL(thumb)}} {
+		if u[0] == u[1] {
+			continue
+		}
+		var n int
+		if err := app.queries.RewriteMediaURLs.Get(&n, u[0], u[1]); err != nil {
+			return out, fmt.Errorf("error rewriting media URLs: %v", pqErrMsg(err))
+		}
+		out.rewritten += n
+	}
+	return out, nil
+}
+
+// copyMediaFile copies a file to another store, unless the copy from an earlier
+// run (dstName) or a file with the same name and contents is already there, and
+// verifies the copy. It returns the name of the copy and whether it was copied.
+func copyMediaFile(name, dstName string, src, dst media.Store) (string, bool, error) {
+	b, err := readMediaFile(src, name)
+	if err != nil {
+		return "", false, fmt.Errorf("error reading %s: %v", name, err)
+	}
+	sum := sha256.Sum256(b)
+
+	if dstName == "" {
+		dstName = name
+	}
+	if c, err := readMediaFile(dst, dstName); err == nil && sha256.Sum256(c) == sum {
+		return dstName, false, nil
+	}
+
+	typ, _, err := mime.ParseMediaType(http.DetectContentType(b))
+	if err != nil {
+		typ = "application/octet-stream"
+	}
+	out, err := dst.Upload(name, typ, bytes.NewReader(b))
+	if err != nil {
+		return "", false, fmt.Errorf("error uploading %s: %v", name, err)
+	}
+
+	c, err := readMediaFile(dst, out)
+	if err != nil {
+		return "", false, fmt.Errorf("error verifying %s: %v", out, err)
+	}
+	if sha256.Sum256(c) != sum {
+		return "", false, fmt.Errorf("error verifying %s: the copy doesn't match the original", out)
+	}
+	return out, true, nil
+}
+
+// readMediaFile reads the contents of a stored file.
+func readMediaFile(st media.Store, name string) ([]byte, error) {
+	r, err := st.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// newMediaProviderStore initializes a store with a configured provider other
+// than the current one.
+func newMediaProviderStore(provider string) (media.Store, error) {
+	if !ko.Exists("upload." + provider) {
+		return nil, fmt.Errorf("upload.%s isn't configured", provider)
+	}
+	return newProviderMediaStore(ko, provider)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	null "gopkg.in/volatiletech/null.v6"
+
+	"github.com/labstack/echo"
+)
+
+// msgLogPurgeInterval is the interval at which logged messages that are
+// past their retention are purged.
+const msgLogPurgeInterval = time.Hour
+
+// msgLogConf represents the settings of the log of rendered campaign messages.
+type msgLogConf struct {
+	Enabled   bool          `koanf:"enabled"`
+	Sample    float64       `koanf:"sample"`
+	Emails    []string      `koanf:"emails"`
+	Retention time.Duration `koanf:"retention"`
+}
+
+// renderedMessage represents a logged campaign message.
+type renderedMessage struct {
+	ID           int64          `db:"id" json:"id"`
+	CampaignID   int            `db:"campaign_id" json:"campaign_id"`
+	SubscriberID int            `db:"subscriber_id" json:"subscriber_id"`
+	Email        string         `db:"email" json:"email"`
+	Headers      types.JSONText `db:"headers" json:"headers"`
+	Body         string         `db:"body" json:"body"`
+	CreatedAt    null.Time      `db:"created_at" json:"created_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+type renderedMessagesWrap struct {
+	Results []renderedMessage `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// handleGetRenderedMessages returns the logged campaign messages, optionally
+// filtered by a campaign, a subscriber ID, and/or an e-mail.
+func handleGetRenderedMessages(c echo.Context) error {
+	var (
+		app       = c.Get("app").(*App)
+		campID, _ = strconv.Atoi(c.QueryParam("campaign_id"))
+		subID, _  = strconv.Atoi(c.QueryParam("subscriber_id"))
+		email     = c.QueryParam("email")
+		pg        = getPagination(c.QueryParams())
+		out       renderedMessagesWrap
+	)
+
+	if err := app.queries.QueryRenderedMessages.Select(&out.Results,
+		campID, subID, email, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching logged messages: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching messages: %s", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []renderedMessage{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// runMessageLogPurge is a blocking function that periodically purges the
+// logged messages that are older than the retention.
+func runMessageLogPurge(retention time.Duration, app *App) {
+	if retention <= 0 {
+		return
+	}
+
+	for {
+		res, err := app.queries.PurgeRenderedMessages.Exec(time.Now().Add(-retention))
+		if err != nil {
+			app.log.Printf("error purging logged messages: %v", err)
+		} else if n, _ := res.RowsAffected(); n > 0 {
+			app.log.Printf("purged %d logged messages older than %v", n, retention)
+		}
+		time.Sleep(msgLogPurgeInterval)
+	}
+}
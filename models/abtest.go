@@ -0,0 +1,135 @@
+package models
+
+import (
+	"crypto/md5"
+	"database/sql/driver"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Metrics that A/B tests pick their winners by.
+const (
+	CampaignABMetricViews  = "views"
+	CampaignABMetricClicks = "clicks"
+)
+
+// CampaignABMaxVariants is the maximum number of the alternative variants
+// of an A/B test.
+const CampaignABMaxVariants = 10
+
+// CampaignABTest is the optional A/B test of the initial share (the sample)
+// of a staged rollout. The sample is split evenly between the campaign's own
+// subject and body (variant 0) and the alternative Variants (1..n), whose
+// empty subjects and bodies fall back to the campaign's. Once the rollout has
+// been held for Window, the variant with the highest Metric rate wins and is
+// sent to the rest.
+type CampaignABTest struct {
+	Variants []CampaignVariant `json:"variants"`
+	Metric   string            `json:"metric"`
+	Window   string            `json:"window"`
+}
+
+// CampaignABMetrics are the metrics of a variant of an A/B test. Views and
+// clicks are counted once per subscriber.
+type CampaignABMetrics struct {
+	Variant   int     `db:"variant" json:"variant"`
+	Sent      int     `db:"sent" json:"sent"`
+	Views     int     `db:"views" json:"views"`
+	Clicks    int     `db:"clicks" json:"clicks"`
+	ViewRate  float64 `db:"-" json:"view_rate"`
+	ClickRate float64 `db:"-" json:"click_rate"`
+}
+
+// Enabled checks whether the campaign has an A/B test.
+func (a CampaignABTest) Enabled() bool {
+	return len(a.Variants) > 0
+}
+
+// Validate checks the variants, the metric, and the window of the test.
+func (a CampaignABTest) Validate() error {
+	if !a.Enabled() {
+		return nil
+	}
+	if len(a.Variants) > CampaignABMaxVariants {
+		return fmt.Errorf("there can be up to %d variants", CampaignABMaxVariants)
+	}
+	for i, v := range a.Variants {
+		if v.Subject == "" && v.Body == "" {
+			return fmt.Errorf("variant %d has neither a subject nor a body", i+1)
+		}
+	}
+	if a.Metric != CampaignABMetricViews && a.Metric != CampaignABMetricClicks {
+		return fmt.Errorf("invalid metric '%s'. Should be views or clicks", a.Metric)
+	}
+	if d, err := time.ParseDuration(a.Window); err != nil || d <= 0 {
+		return fmt.Errorf("invalid window '%s'. Should be a duration, eg: 4h", a.Window)
+	}
+	return nil
+}
+
+// WindowDuration returns the test's window. Invalid windows are zero.
+func (a CampaignABTest) WindowDuration() time.Duration {
+	d, _ := time.ParseDuration(a.Window)
+	return d
+}
+
+// Variant returns the variant (0 for the campaign's own content) that a
+// subscriber in the sample of a campaign's A/B test gets. It's the same hash
+// of the campaign UUID and the subscriber ID as in get-campaign-ab-metrics.
+func (a CampaignABTest) Variant(campUUID string, subID int) int {
+	h := md5.Sum([]byte(campUUID + strconv.Itoa(subID) + ":ab"))
+	return int(binary.BigEndian.Uint32(h[:4]) % uint32(len(a.Variants)+1))
+}
+
+// Winner returns the variant with the highest rate of the test's metric.
+// Ties go to the lower variant.
+func (a CampaignABTest) Winner(m []CampaignABMetrics) (CampaignABMetrics, error) {
+	if len(m) == 0 {
+		return CampaignABMetrics{}, errors.New("no variant metrics")
+	}
+
+	best := m[0]
+	for _, v := range m[1:] {
+		if a.rate(v) > a.rate(best) {
+			best = v
+		}
+	}
+	return best, nil
+}
+
+func (a CampaignABTest) rate(m CampaignABMetrics) float64 {
+	if a.Metric == CampaignABMetricClicks {
+		return m.ClickRate
+	}
+	return m.ViewRate
+}
+
+// Value returns the JSON marshalled CampaignABTest. Tests that aren't
+// enabled are empty.
+func (a CampaignABTest) Value() (driver.Value, error) {
+	if !a.Enabled() {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(a)
+}
+
+// Scan unmarshals JSON into CampaignABTest.
+func (a *CampaignABTest) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, a)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, a)
+}
+
+// SetRates computes the rates of the metrics from the counts.
+func (m *CampaignABMetrics) SetRates() {
+	if m.Sent == 0 {
+		return
+	}
+	m.ViewRate = float64(m.Views) / float64(m.Sent) * 100
+	m.ClickRate = float64(m.Clicks) / float64(m.Sent) * 100
+}
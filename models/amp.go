@@ -0,0 +1,69 @@
+package models
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AMPMaxSize is the maximum size of an AMP for e-mail body. Mail clients
+// fall back to the HTML of messages with larger AMP parts.
+const AMPMaxSize = 100 * 1024
+
+var (
+	regexpAMPHTML        = regexp.MustCompile(`(?i)<html[^>]*\s(⚡4email|amp4email)[\s=>]`)
+	regexpAMPCharset     = regexp.MustCompile(`(?i)<meta\s+charset\s*=\s*"?utf-8"?\s*/?>`)
+	regexpAMPRuntime     = regexp.MustCompile(`(?i)<script\s+async\s+src\s*=\s*"https://cdn\.ampproject\.org/v0\.js"\s*>\s*</script>`)
+	regexpAMPBoilerplate = regexp.MustCompile(`(?i)<style\s+amp4email-boilerplate\s*>\s*body\s*\{\s*visibility\s*:\s*hidden;?\s*\}\s*</style>`)
+	regexpAMPScript      = regexp.MustCompile(`(?i)<script\b[^>]*>`)
+	regexpAMPScriptOK    = regexp.MustCompile(`(?i)(\ssrc\s*=\s*"https://cdn\.ampproject\.org/|\stype\s*=\s*"application/json")`)
+	regexpAMPBadTag      = regexp.MustCompile(`(?i)<(img|iframe|frame|frameset|object|embed|base|link|video|audio)\b`)
+)
+
+// ValidateAMP checks that an AMP for e-mail body has the structure that
+// AMP requires of e-mails: the doctype, the ⚡4email (or amp4email) html
+// attribute, the head with the UTF-8 charset, the AMP runtime script and
+// the e-mail boilerplate style, and the body. Scripts other than those of the
+// AMP components (and their JSON) and tags that have AMP replacements (eg:
+// img for amp-img) aren't allowed. It's not a full AMP validator.
+func ValidateAMP(body string) error {
+	if len(body) > AMPMaxSize {
+		return fmt.Errorf("the AMP body is larger than %d KB", AMPMaxSize/1024)
+	}
+
+	b := strings.TrimSpace(body)
+	if !strings.HasPrefix(strings.ToLower(b), "<!doctype html>") {
+		return errors.New("the AMP body should start with <!doctype html>")
+	}
+	if !regexpAMPHTML.MatchString(b) {
+		return errors.New("the AMP body should have <html ⚡4email>")
+	}
+
+	lb := strings.ToLower(b)
+	if !strings.Contains(lb, "<head>") || !strings.Contains(lb, "</head>") {
+		return errors.New("the AMP body has no <head>")
+	}
+	if !strings.Contains(lb, "<body") || !strings.Contains(lb, "</body>") {
+		return errors.New("the AMP body has no <body>")
+	}
+	if !regexpAMPCharset.MatchString(b) {
+		return errors.New(`the AMP body should have <meta charset="utf-8">`)
+	}
+	if !regexpAMPRuntime.MatchString(b) {
+		return errors.New(`the AMP body should load the AMP runtime with <script async src="https://cdn.ampproject.org/v0.js"></script>`)
+	}
+	if !regexpAMPBoilerplate.MatchString(b) {
+		return errors.New("the AMP body should have <style amp4email-boilerplate>body{visibility:hidden}</style>")
+	}
+
+	for _, s := range regexpAMPScript.FindAllString(b, -1) {
+		if !regexpAMPScriptOK.MatchString(s) {
+			return fmt.Errorf("the AMP body can only have the scripts of AMP components, not %s", s)
+		}
+	}
+	if m := regexpAMPBadTag.FindStringSubmatch(b); m != nil {
+		return fmt.Errorf("the AMP body can't have <%s> tags. Use the AMP components instead, eg: amp-img", strings.ToLower(m[1]))
+	}
+	return nil
+}
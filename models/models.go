@@ -6,8 +6,11 @@ import (
 	"errors"
 	"fmt"
 	"html/template"
+	"net/mail"
 	"regexp"
 	"strings"
+	ttemplate "text/template"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
@@ -35,18 +38,65 @@ const (
 	CampaignStatusPaused    = "paused"
 	CampaignStatusFinished  = "finished"
 	CampaignStatusCancelled = "cancelled"
+	CampaignStatusAborted   = "aborted"
 	CampaignTypeRegular     = "regular"
 	CampaignTypeOptin       = "optin"
 
+	// Campaigns that are waiting to be approved with campaign approvals.
+	CampaignStatusPendingApproval = "pending_approval"
+
+	// Campaign categories.
+	CampaignCategoryTransactional = "transactional"
+	CampaignCategoryNewsletter    = "newsletter"
+	CampaignCategoryPromotional   = "promotional"
+
+	// Follow-up campaign audiences.
+	CampaignAudienceNonOpeners = "non_openers"
+	CampaignAudienceFailed     = "failed"
+
+	// Campaign send orders.
+	CampaignSendOrderID     = "id"
+	CampaignSendOrderRandom = "random"
+	CampaignSendOrderField  = "field"
+
+	// Policies of campaigns on outages of their messengers, when all the
+	// messenger's servers are unavailable. Continue counts the messages
+	// as individual errors towards max_send_errors.
+	CampaignOutagePause    = "pause"
+	CampaignOutageCancel   = "cancel"
+	CampaignOutageContinue = "continue"
+
+	// Thresholds of the send errors of campaigns. Count pauses a campaign
+	// after max_send_errors errors and rate aborts it when the rate of
+	// errors among its last messages crosses the threshold.
+	CampaignErrorModeCount = "count"
+	CampaignErrorModeRate  = "rate"
+
+	// Campaign priorities.
+	CampaignPriorityMin     = 1
+	CampaignPriorityMax     = 5
+	CampaignPriorityDefault = 3
+
 	// List.
 	ListTypePrivate = "private"
 	ListTypePublic  = "public"
 	ListOptinSingle = "single"
 	ListOptinDouble = "double"
 
+	// Sequence triggers and the statuses of their subscribers.
+	SequenceTriggerLinkClick = "link_click"
+	SequenceSubActive        = "active"
+	SequenceSubFinished      = "finished"
+	SequenceSubExited        = "exited"
+
+	// Template.
+	TemplateFormatHTML  = "html"
+	TemplateFormatPlain = "plain"
+
 	// User.
-	UserTypeSuperadmin = "superadmin"
-	UserTypeUser       = "user"
+	UserRoleAdmin      = "admin"
+	UserRoleEditor     = "editor"
+	UserRoleAnalyst    = "analyst"
 	UserStatusEnabled  = "enabled"
 	UserStatusDisabled = "disabled"
 
@@ -79,6 +129,9 @@ var regTplFuncs = []regTplFunc{
 	},
 }
 
+// regexpUnsubURL matches the unsubscribe URL placeholder in templates.
+var regexpUnsubURL = regexp.MustCompile(`{{[^}]*\bUnsubscribeURL\b`)
+
 // AdminNotifCallback is a callback function that's called
 // when a campaign's status changes.
 type AdminNotifCallback func(subject string, data interface{}) error
@@ -90,15 +143,15 @@ type Base struct {
 	UpdatedAt null.Time `db:"updated_at" json:"updated_at"`
 }
 
-// User represents an admin user.
+// User represents an admin user. Role is one of admin, editor, or analyst.
 type User struct {
 	Base
 
-	Email    string `json:"email"`
-	Name     string `json:"name"`
-	Password string `json:"-"`
-	Type     string `json:"type"`
-	Status   string `json:"status"`
+	Email    string `db:"email" json:"email"`
+	Name     string `db:"name" json:"name"`
+	Password string `db:"password" json:"-"`
+	Role     string `db:"role" json:"role"`
+	Status   string `db:"status" json:"status"`
 }
 
 // Subscriber represents an e-mail subscriber.
@@ -138,7 +191,37 @@ type List struct {
 	Optin           string         `db:"optin" json:"optin"`
 	Tags            pq.StringArray `db:"tags" json:"tags"`
 	SubscriberCount int            `db:"subscriber_count" json:"subscriber_count"`
-	SubscriberID    int            `db:"subscriber_id" json:"-"`
+
+	// FromName is the optional from-name template of campaigns sent to the list.
+	FromName string `db:"from_name" json:"from_name"`
+
+	// ReplyTo and BounceAddress are the optional Reply-To and envelope
+	// sender (return-path) addresses of campaigns sent to the list.
+	ReplyTo       string `db:"reply_to" json:"reply_to"`
+	BounceAddress string `db:"bounce_address" json:"bounce_address"`
+
+	// SendWindows are the optional windows, in SendTimezone, in which
+	// campaigns are sent to the list.
+	SendWindows  SendWindows `db:"send_windows" json:"send_windows"`
+	SendTimezone string      `db:"send_timezone" json:"send_timezone"`
+
+	// UnsubRedirect is the optional URL that subscribers are redirected to
+	// after unsubscribing from campaigns sent to the list.
+	UnsubRedirect string `db:"unsubscribe_redirect" json:"unsubscribe_redirect"`
+
+	// WinbackDays is the optional grace period of unsubscriptions from the
+	// list, during which they're paused and the optional win-back message
+	// (WinbackSubject, WinbackBody) is sent once after WinbackSendDays.
+	WinbackDays     int    `db:"winback_days" json:"winback_days"`
+	WinbackSendDays int    `db:"winback_send_days" json:"winback_send_days"`
+	WinbackSubject  string `db:"winback_subject" json:"winback_subject"`
+	WinbackBody     string `db:"winback_body" json:"winback_body"`
+
+	// Messenger is the optional default messenger of campaigns that are sent
+	// to the list and don't have one.
+	Messenger string `db:"messenger" json:"messenger"`
+
+	SubscriberID int `db:"subscriber_id" json:"-"`
 
 	// This is only relevant when querying the lists of a subscriber.
 	SubscriptionStatus string `db:"subscription_status" json:"subscription_status,omitempty"`
@@ -158,6 +241,7 @@ type Campaign struct {
 	Name        string         `db:"name" json:"name"`
 	Subject     string         `db:"subject" json:"subject"`
 	FromEmail   string         `db:"from_email" json:"from_email"`
+	FromName    string         `db:"from_name" json:"from_name"`
 	Body        string         `db:"body" json:"body"`
 	SendAt      null.Time      `db:"send_at" json:"send_at"`
 	Status      string         `db:"status" json:"status"`
@@ -166,22 +250,271 @@ type Campaign struct {
 	TemplateID  int            `db:"template_id" json:"template_id"`
 	MessengerID string         `db:"messenger" json:"messenger"`
 
+	// TrackingDomain is the optional tracking domain used in link and
+	// view tracking URLs instead of the root URL.
+	TrackingDomain string `db:"tracking_domain" json:"tracking_domain"`
+
+	// Category is the optional category (transactional, newsletter,
+	// promotional) that classifies the campaign for the defaults of
+	// new campaigns and reporting.
+	Category string `db:"category" json:"category"`
+
+	// ParentID is the campaign a follow-up campaign is derived from and
+	// ParentAudience is the subset of the parent's recipients it targets.
+	ParentID       null.Int `db:"parent_id" json:"parent_id"`
+	ParentAudience string   `db:"parent_audience" json:"parent_audience"`
+
+	// Variants are the optional language variants of the subject and body
+	// keyed by language code (eg: de, pt-br). Subscribers whose language
+	// attribute matches a variant get it and the rest get the default
+	// subject and body. Variants without a subject get the default subject.
+	Variants CampaignVariants `db:"variants" json:"variants"`
+
+	// SendOrder is the order in which subscribers are sent the campaign:
+	// by ID, random, or by SendOrderField, which is one of the subscriber
+	// columns (email, name, created_at, updated_at) or an attribute
+	// path (eg: attribs.vip), in the ascending order unless SendOrderDesc.
+	SendOrder      string `db:"send_order" json:"send_order"`
+	SendOrderField string `db:"send_order_field" json:"send_order_field"`
+	SendOrderDesc  bool   `db:"send_order_desc" json:"send_order_desc"`
+
+	// Priority is the priority by which running campaigns share the
+	// send capacity of the campaign manager.
+	Priority int `db:"priority" json:"priority"`
+
+	// ExcludeSubscribers are the IDs of the subscribers that are explicitly
+	// excluded from the campaign and ExcludeSegmentID is the optional
+	// segment whose subscribers are excluded. Exclusions don't affect
+	// other campaigns or list subscriptions.
+	ExcludeSubscribers pq.Int64Array `db:"exclude_subscribers" json:"exclude_subscribers"`
+	ExcludeSegmentID   null.Int      `db:"exclude_segment_id" json:"exclude_segment_id"`
+
+	// Charset and TransferEncoding are the optional charset (eg: ISO-8859-1)
+	// and content transfer encoding (quoted-printable or base64) of the
+	// campaign's e-mails that override the defaults.
+	Charset          string `db:"charset" json:"charset"`
+	TransferEncoding string `db:"transfer_encoding" json:"transfer_encoding"`
+
+	// SegmentIDs are the segments whose subscribers the campaign is sent to
+	// along with the subscribers of its lists. Subscribers in more than one
+	// of them are sent to once.
+	SegmentIDs pq.Int64Array `db:"segment_ids" json:"segment_ids"`
+
+	// AllowResend lets the campaign send to subscribers that it was already
+	// delivered to, eg: when it's started again. By default, deliveries are
+	// recorded and skipped.
+	AllowResend bool `db:"allow_resend" json:"allow_resend"`
+
+	// OutagePolicy is what's done to the campaign when all the servers of
+	// its messenger are unavailable: pause, cancel, or continue. Empty uses
+	// the app default.
+	OutagePolicy string `db:"outage_policy" json:"outage_policy"`
+
+	// ErrorMode is the threshold of the campaign's send errors: count or
+	// rate, which aborts it when ErrorRate percent of its last ErrorWindow
+	// messages fail. Empty and zeros use the app defaults. AbortReason is
+	// why it was aborted.
+	ErrorMode   string  `db:"error_mode" json:"error_mode"`
+	ErrorRate   float64 `db:"error_rate" json:"error_rate"`
+	ErrorWindow int     `db:"error_window" json:"error_window"`
+	AbortReason string  `db:"abort_reason" json:"abort_reason"`
+
+	// LocalSendTime is the local time (HH:MM) at which the campaign is sent
+	// to each subscriber in their timezone, over the day after it starts.
+	// Empty sends it to everyone right away.
+	LocalSendTime string `db:"local_send_time" json:"local_send_time"`
+
+	// RolloutPercent is the share (1-99) of the subscribers that a staged
+	// rollout is sent to first, before it's held until it's released to the
+	// rest. Zero sends it to everyone. RolloutStage is the rollout's stage,
+	// RolloutSent, the number of messages sent to the initial share, and
+	// RolloutHeldAt, when it was held. See CampaignRolloutGate.
+	RolloutPercent int                 `db:"rollout_percent" json:"rollout_percent"`
+	RolloutGate    CampaignRolloutGate `db:"rollout_gate" json:"rollout_gate"`
+	RolloutStage   string              `db:"rollout_stage" json:"rollout_stage"`
+	RolloutSent    int                 `db:"rollout_sent" json:"rollout_sent"`
+	RolloutHeldAt  null.Time           `db:"rollout_held_at" json:"rollout_held_at"`
+
+	// RolloutRate is the optional rate (messages per hour) at which the
+	// initial share of a staged rollout is trickled. It's halted as soon as
+	// the initial metrics cross the gate's maximum rates. RolloutReason is
+	// the last decision on the rollout's gate.
+	RolloutRate   int    `db:"rollout_rate" json:"rollout_rate"`
+	RolloutReason string `db:"rollout_reason" json:"rollout_reason"`
+
+	// Recurrence is the optional cron expression or RRULE on which the
+	// campaign is re-sent. When it finishes, it's cloned into its next
+	// occurrence, which is scheduled with fresh stats and takes over the
+	// recurrence. RecurrenceOf is the first campaign of the series.
+	Recurrence   string   `db:"recurrence" json:"recurrence"`
+	RecurrenceOf null.Int `db:"recurrence_of" json:"recurrence_of"`
+
+	// ABTest is the optional A/B test of the initial share of a staged
+	// rollout and ABWinner, the variant that won it (0 is the campaign's
+	// own content), or -1 if it's yet to be picked. See CampaignABTest.
+	ABTest   CampaignABTest `db:"ab_test" json:"ab_test"`
+	ABWinner int            `db:"ab_winner" json:"ab_winner"`
+
+	// With campaign approvals, campaigns are only sent once they've been
+	// approved by a user other than the one who submitted them
+	// (ApprovalRequestedBy). ReviewedBy is the user who last approved or
+	// rejected the campaign with the optional ReviewNote.
+	Approved            bool      `db:"approved" json:"approved"`
+	ApprovalRequestedBy null.Int  `db:"approval_requested_by" json:"approval_requested_by"`
+	ReviewedBy          null.Int  `db:"reviewed_by" json:"reviewed_by"`
+	ReviewedAt          null.Time `db:"reviewed_at" json:"reviewed_at"`
+	ReviewNote          string    `db:"review_note" json:"review_note"`
+
+	// Archive publishes the campaign in the public archive once it's started.
+	Archive bool `db:"archive" json:"archive"`
+
+	// UnsubRedirect is the optional URL that subscribers are redirected to
+	// after unsubscribing, which overrides the ones of the campaign's lists.
+	UnsubRedirect string `db:"unsubscribe_redirect" json:"unsubscribe_redirect"`
+
+	// AMPBody is the optional AMP for e-mail version of the body that's
+	// sent as a text/x-amp-html part alongside the HTML, which clients that
+	// don't support AMP fall back to. It's a complete AMP document that's
+	// not wrapped in the campaign's template. See ValidateAMP.
+	AMPBody string `db:"amp_body" json:"amp_body"`
+
+	// AltBody is the optional plaintext alternative of the body that's
+	// sent alongside the HTML. It's a template like the body, but isn't
+	// wrapped in the campaign's template. If it's empty, one is generated
+	// from the rendered HTML when AutoAltBody, or if it's null, the app
+	// default, is on.
+	AltBody     string    `db:"altbody" json:"altbody"`
+	AutoAltBody null.Bool `db:"auto_altbody" json:"auto_altbody"`
+
+	// ShortenLinks replaces the campaign's tracked links with short links
+	// (/s/:code) that record clicks without the subscriber and redirect
+	// to the URL.
+	ShortenLinks bool `db:"shorten_links" json:"shorten_links"`
+
+	// Metadata is an arbitrary JSON object that's recorded with the
+	// campaign's views and clicks and is sent in the campaign.finished
+	// webhook. It isn't used in rendering or sending.
+	Metadata types.JSONText `db:"metadata" json:"metadata"`
+
+	// Simulate indicates that the campaign is being run without delivering
+	// its messages (a dry run). Simulation has the results of the last
+	// simulated run.
+	Simulate   bool                `db:"simulate" json:"simulate"`
+	Simulation *CampaignSimulation `db:"simulation" json:"simulation"`
+
+	// RenderErrors is the number of messages that couldn't be rendered in
+	// the run and were skipped, and RenderError is the last of the errors.
+	RenderErrors int    `db:"render_errors" json:"render_errors"`
+	RenderError  string `db:"render_error" json:"render_error"`
+
+	// Snapshot is the content frozen when the campaign started, if there is
+	// one, and SnapshotAt is when it was taken. See ApplySnapshot.
+	Snapshot   *CampaignSnapshot `db:"snapshot" json:"-"`
+	SnapshotAt null.Time         `db:"snapshot_at" json:"snapshot_at"`
+
+	// QueuedAt is when the campaign was last started or resumed.
+	QueuedAt null.Time `db:"queued_at" json:"queued_at"`
+
+	// ListFromName is the from-name of the first of the campaign's lists
+	// (by ID) that has one. It's joined in by the next-campaigns query.
+	ListFromName string `db:"list_from_name" json:"-"`
+
+	// ListReplyTo and ListBounceAddress are the reply_to and bounce_address
+	// of the first of the campaign's lists (by ID) that has one, which are
+	// used for the Reply-To and the envelope sender of its messages.
+	ListReplyTo       string `db:"list_reply_to" json:"-"`
+	ListBounceAddress string `db:"list_bounce_address" json:"-"`
+
+	// ListSendWindows are the send windows of the campaign's lists, which
+	// are joined in by the next-campaigns query. The campaign is only sent
+	// when all of them are open.
+	ListSendWindows CampaignSendWindows `db:"list_send_windows" json:"-"`
+
+	// FromNameTpl is the compiled from-name. See ResolveFromName.
+	FromNameTpl *ttemplate.Template `json:"-"`
+
 	// TemplateBody is joined in from templates by the next-campaigns query.
-	TemplateBody string             `db:"template_body" json:"-"`
-	Tpl          *template.Template `json:"-"`
-	SubjectTpl   *template.Template `json:"-"`
+	TemplateBody string `db:"template_body" json:"-"`
+
+	// TemplateFormat is the format (html, plain) of the campaign's template.
+	TemplateFormat string             `db:"template_format" json:"-"`
+	Tpl            *template.Template `json:"-"`
+	SubjectTpl     *template.Template `json:"-"`
+	AMPTpl         *template.Template `json:"-"`
+
+	// AltBodyTpl is the compiled AltBody, which isn't HTML escaped.
+	AltBodyTpl *ttemplate.Template `json:"-"`
+
+	// VariantTpls are the compiled language variants.
+	VariantTpls map[string]VariantTpl `json:"-"`
+
+	// ABTpls are the compiled alternative variants of the A/B test.
+	ABTpls []VariantTpl `json:"-"`
+
+	// Footers are the mandatory footers keyed by language code ("" is the
+	// default) that are appended to messages without an unsubscribe link.
+	// They're set by the campaign manager.
+	Footers map[string]Footer `json:"-"`
+
+	// Warnings are the non-fatal issues, eg: long subjects, found when the
+	// campaign is saved or started. They're only set in the responses.
+	Warnings []string `db:"-" json:"warnings,omitempty"`
 
 	// Pseudofield for getting the total number of subscribers
 	// in searches and queries.
 	Total int `db:"total" json:"-"`
 }
 
+// CampaignVariant is a language variant of a campaign's subject and body.
+type CampaignVariant struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// CampaignVariants is the map of language codes and campaign variants.
+type CampaignVariants map[string]CampaignVariant
+
+// CampaignSnapshot is the frozen content of a campaign.
+type CampaignSnapshot struct {
+	Subject        string           `json:"subject"`
+	FromEmail      string           `json:"from_email"`
+	FromName       string           `json:"from_name"`
+	Body           string           `json:"body"`
+	AMPBody        string           `json:"amp_body"`
+	AltBody        string           `json:"altbody"`
+	ContentType    string           `json:"content_type"`
+	TemplateBody   string           `json:"template_body"`
+	TemplateFormat string           `json:"template_format"`
+	Variants       CampaignVariants `json:"variants"`
+}
+
+// Footer is a mandatory campaign footer template for HTML and
+// plain text templates.
+type Footer struct {
+	HTML  string
+	Plain string
+}
+
+// VariantTpl is a compiled campaign variant.
+type VariantTpl struct {
+	Subject    string
+	Tpl        *template.Template
+	SubjectTpl *template.Template
+}
+
 // CampaignMeta contains fields tracking a campaign's progress.
 type CampaignMeta struct {
 	CampaignID int `db:"campaign_id" json:"-"`
 	Views      int `db:"views" json:"views"`
 	Clicks     int `db:"clicks" json:"clicks"`
 
+	// Conversions attributed to the campaign and their total value.
+	Conversions     int     `db:"conversions" json:"conversions"`
+	ConversionValue float64 `db:"conversion_value" json:"conversion_value"`
+
+	// Stats of the events within the attribution window, if one is applied.
+	WindowStats *CampaignWindowStats `db:"window_stats" json:"window_stats,omitempty"`
+
 	// This is a list of {list_id, name} pairs unlike Subscriber.Lists[]
 	// because lists can be deleted after a campaign is finished, resulting
 	// in null lists data to be returned. For that reason, campaign_lists maintains
@@ -197,13 +530,107 @@ type CampaignMeta struct {
 // Campaigns represents a slice of Campaigns.
 type Campaigns []Campaign
 
+// LocalSendBucket represents the recipients of a campaign with a local send
+// time who are in a timezone, when they're sent the campaign, and how many
+// of them it was delivered to.
+type LocalSendBucket struct {
+	Timezone  string    `db:"timezone" json:"timezone"`
+	SendAt    time.Time `db:"send_at" json:"send_at"`
+	Total     int       `db:"total" json:"total"`
+	Delivered int       `db:"delivered" json:"delivered"`
+}
+
+// Segment represents a stored subscriber filter tree.
+type Segment struct {
+	Base
+
+	UUID  string         `db:"uuid" json:"uuid"`
+	Name  string         `db:"name" json:"name"`
+	Rules types.JSONText `db:"rules" json:"rules"`
+
+	// Count is the number of subscribers matching the segment
+	// at the time of the query.
+	Count int `db:"-" json:"count"`
+}
+
+// ListRule represents a rule that adds subscribers matching a filter tree
+// to a list.
+type ListRule struct {
+	Base
+
+	Name            string         `db:"name" json:"name"`
+	ListID          int            `db:"list_id" json:"list_id"`
+	Rules           types.JSONText `db:"rules" json:"rules"`
+	RemoveUnmatched bool           `db:"remove_unmatched" json:"remove_unmatched"`
+	Enabled         bool           `db:"enabled" json:"enabled"`
+}
+
+// WelcomeStep represents a message in the welcome sequence of a list that's
+// sent to subscribers the delay (in seconds) after the previous step or
+// their confirmation. A zero TemplateID is the default template. Steps with
+// a CampaignID send the content of the campaign instead of their own.
+type WelcomeStep struct {
+	Base
+
+	ListID     int    `db:"list_id" json:"list_id"`
+	Position   int    `db:"position" json:"position"`
+	TemplateID int    `db:"template_id" json:"template_id"`
+	CampaignID int    `db:"campaign_id" json:"campaign_id"`
+	Subject    string `db:"subject" json:"subject"`
+	Body       string `db:"body" json:"body"`
+	Delay      int    `db:"delay" json:"delay"`
+}
+
+// Sequence represents an automated sequence of campaigns that subscribers
+// are enrolled in when they click its trigger link.
+// Steps are the ordered SequenceSteps and Subscribers are the numbers of the
+// subscribers in the sequence by status.
+type Sequence struct {
+	Base
+
+	Name        string         `db:"name" json:"name"`
+	Trigger     string         `db:"trigger" json:"trigger"`
+	TriggerURL  string         `db:"trigger_url" json:"trigger_url"`
+	Enabled     bool           `db:"enabled" json:"enabled"`
+	Steps       types.JSONText `db:"steps" json:"steps"`
+	Subscribers types.JSONText `db:"subscribers" json:"subscribers"`
+}
+
+// SequenceStep represents a step of a sequence that sends the content of a
+// campaign the delay (in seconds) after the previous step or the enrollment.
+type SequenceStep struct {
+	CampaignID int `json:"campaign_id"`
+	Delay      int `json:"delay"`
+}
+
+// SequenceSubscriber represents the state of a subscriber in a sequence.
+// Step is the position of the next step, which is due at SendAt.
+type SequenceSubscriber struct {
+	SubscriberID   int       `db:"subscriber_id" json:"subscriber_id"`
+	SubscriberUUID string    `db:"subscriber_uuid" json:"subscriber_uuid"`
+	Email          string    `db:"email" json:"email"`
+	Name           string    `db:"name" json:"name"`
+	Step           int       `db:"step" json:"step"`
+	Status         string    `db:"status" json:"status"`
+	SendAt         null.Time `db:"send_at" json:"send_at"`
+	LastSentAt     null.Time `db:"last_sent_at" json:"last_sent_at"`
+	CreatedAt      null.Time `db:"created_at" json:"created_at"`
+	UpdatedAt      null.Time `db:"updated_at" json:"updated_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
 // Template represents a reusable e-mail template.
 type Template struct {
 	Base
 
+	UUID      string `db:"uuid" json:"uuid"`
 	Name      string `db:"name" json:"name"`
 	Body      string `db:"body" json:"body,omitempty"`
 	IsDefault bool   `db:"is_default" json:"is_default"`
+
+	// Format is the format of the template's body, html or plain.
+	Format string `db:"format" json:"format"`
 }
 
 // GetIDs returns the list of subscriber IDs.
@@ -238,6 +665,22 @@ func (subs Subscribers) LoadLists(stmt *sqlx.Stmt) error {
 	return nil
 }
 
+// Value returns the JSON marshalled CampaignVariants.
+func (v CampaignVariants) Value() (driver.Value, error) {
+	if v == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(v)
+}
+
+// Scan unmarshals JSON into CampaignVariants.
+func (v *CampaignVariants) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, v)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, v)
+}
+
 // Value returns the JSON marshalled SubscriberAttribs.
 func (s SubscriberAttribs) Value() (driver.Value, error) {
 	return json.Marshal(s)
@@ -251,6 +694,58 @@ func (s SubscriberAttribs) Scan(src interface{}) error {
 	return fmt.Errorf("Could not not decode type %T -> %T", src, s)
 }
 
+// CampaignWindowStats represents the stats of a campaign counting only
+// the events within an attribution window (eg: 72h) from its start.
+type CampaignWindowStats struct {
+	Window          string  `json:"window"`
+	Views           int     `json:"views"`
+	Clicks          int     `json:"clicks"`
+	Conversions     int     `json:"conversions"`
+	ConversionValue float64 `json:"conversion_value"`
+}
+
+// CampaignSimulation represents the results of a simulated campaign run.
+// Status is the status (finished, cancelled) the run ended with and Rate,
+// the number of messages per second over its Duration (seconds), which
+// estimates that of the real send as the run is throttled by the same
+// rate limits. RenderErrors is the number of messages that couldn't be
+// rendered, with the last RenderError.
+type CampaignSimulation struct {
+	Status       string    `json:"status"`
+	ToSend       int       `json:"to_send"`
+	Sent         int       `json:"sent"`
+	StartedAt    null.Time `json:"started_at"`
+	FinishedAt   null.Time `json:"finished_at"`
+	Duration     float64   `json:"duration"`
+	Rate         float64   `json:"rate"`
+	RenderErrors int       `json:"render_errors"`
+	RenderError  string    `json:"render_error"`
+}
+
+// Scan unmarshals JSON into CampaignSimulation.
+func (s *CampaignSimulation) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, s)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, s)
+}
+
+// Scan unmarshals JSON into CampaignWindowStats.
+func (s *CampaignWindowStats) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, s)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, s)
+}
+
+// Scan unmarshals JSON into CampaignSnapshot.
+func (s *CampaignSnapshot) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, s)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, s)
+}
+
 // GetIDs returns the list of campaign IDs.
 func (camps Campaigns) GetIDs() []int {
 	IDs := make([]int, len(camps))
@@ -261,10 +756,11 @@ func (camps Campaigns) GetIDs() []int {
 	return IDs
 }
 
-// LoadStats lazy loads campaign stats onto a list of campaigns.
-func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
+// LoadStats lazy loads campaign stats onto a list of campaigns. If the
+// attribution window is set, the stats within it are loaded too.
+func (camps Campaigns) LoadStats(stmt *sqlx.Stmt, window time.Duration) error {
 	var meta []CampaignMeta
-	if err := stmt.Select(&meta, pq.Array(camps.GetIDs())); err != nil {
+	if err := stmt.Select(&meta, pq.Array(camps.GetIDs()), int(window.Seconds())); err != nil {
 		return err
 	}
 
@@ -277,15 +773,187 @@ func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
 			camps[i].Lists = c.Lists
 			camps[i].Views = c.Views
 			camps[i].Clicks = c.Clicks
+			camps[i].Conversions = c.Conversions
+			camps[i].ConversionValue = c.ConversionValue
+			if c.WindowStats != nil {
+				c.WindowStats.Window = window.String()
+				camps[i].WindowStats = c.WindowStats
+			}
 		}
 	}
 
 	return nil
 }
 
+// ApplySnapshot replaces the content of the campaign with its snapshot,
+// if it has one, so that it's rendered as it was when it started.
+func (c *Campaign) ApplySnapshot() {
+	s := c.Snapshot
+	if s == nil {
+		return
+	}
+
+	c.Subject = s.Subject
+	c.FromEmail = s.FromEmail
+	c.FromName = s.FromName
+	c.Body = s.Body
+	c.AMPBody = s.AMPBody
+	c.AltBody = s.AltBody
+	c.ContentType = s.ContentType
+	c.TemplateBody = s.TemplateBody
+	c.TemplateFormat = s.TemplateFormat
+	c.Variants = s.Variants
+}
+
 // CompileTemplate compiles a campaign body template into its base
-// template and sets the resultant template to Campaign.Tpl.
+// template and sets the resultant template to Campaign.Tpl. Language
+// variants, if any, are compiled into Campaign.VariantTpls.
 func (c *Campaign) CompileTemplate(f template.FuncMap) error {
+	out, subjTpl, err := c.compileMessage("", c.Subject, c.Body, f)
+	if err != nil {
+		return err
+	}
+
+	vars := make(map[string]VariantTpl, len(c.Variants))
+	for lang, v := range c.Variants {
+		subj := v.Subject
+		if subj == "" {
+			subj = c.Subject
+		}
+		tpl, vSubjTpl, err := c.compileMessage(lang, subj, v.Body, f)
+		if err != nil {
+			return fmt.Errorf("variant '%s': %v", lang, err)
+		}
+		vars[lang] = VariantTpl{Subject: subj, Tpl: tpl, SubjectTpl: vSubjTpl}
+	}
+
+	abTpls := make([]VariantTpl, 0, len(c.ABTest.Variants))
+	for i, v := range c.ABTest.Variants {
+		subj, body := v.Subject, v.Body
+		if subj == "" {
+			subj = c.Subject
+		}
+		if body == "" {
+			body = c.Body
+		}
+		tpl, vSubjTpl, err := c.compileMessage("", subj, body, f)
+		if err != nil {
+			return fmt.Errorf("A/B variant %d: %v", i+1, err)
+		}
+		abTpls = append(abTpls, VariantTpl{Subject: subj, Tpl: tpl, SubjectTpl: vSubjTpl})
+	}
+
+	// The AMP body is a complete document without the base template.
+	var ampTpl *template.Template
+	if c.AMPBody != "" {
+		body := c.AMPBody
+		for _, r := range regTplFuncs {
+			body = r.regExp.ReplaceAllString(body, r.replace)
+		}
+		ampTpl, err = template.New(ContentTpl).Funcs(f).Parse(body)
+		if err != nil {
+			return fmt.Errorf("error compiling AMP body: %v", err)
+		}
+	}
+
+	// The plaintext body isn't HTML escaped.
+	var altTpl *ttemplate.Template
+	if c.AltBody != "" {
+		body := c.AltBody
+		for _, r := range regTplFuncs {
+			body = r.regExp.ReplaceAllString(body, r.replace)
+		}
+		altTpl, err = ttemplate.New(ContentTpl).Funcs(ttemplate.FuncMap(f)).Parse(body)
+		if err != nil {
+			return fmt.Errorf("error compiling plaintext body: %v", err)
+		}
+	}
+
+	// The from-name is a header and isn't HTML escaped.
+	var fromTpl *ttemplate.Template
+	if name := c.ResolveFromName(); name != "" {
+		fromTpl, err = ttemplate.New(ContentTpl).Funcs(ttemplate.FuncMap(f)).Parse(name)
+		if err != nil {
+			return fmt.Errorf("error compiling from-name: %v", err)
+		}
+	}
+
+	c.Tpl = out
+	c.SubjectTpl = subjTpl
+	c.AMPTpl = ampTpl
+	c.AltBodyTpl = altTpl
+	c.VariantTpls = vars
+	c.ABTpls = abTpls
+	c.FromNameTpl = fromTpl
+	return nil
+}
+
+// ResolveFromName returns the from-name template of the campaign in the order
+// of precedence: the campaign's from_name, the from_name of the first of its
+// lists (by ID) that has one, or an empty string, in which case the display
+// name in the campaign's from_email (which defaults to the global
+// app.from_email) is used as is.
+func (c *Campaign) ResolveFromName() string {
+	if c.FromName != "" {
+		return c.FromName
+	}
+	return c.ListFromName
+}
+
+// FromHeader returns the From header made of a display name and the address
+// in a from e-mail (eg: "Name <email>" or "email"). The name is encoded if
+// required. An empty name retains the from e-mail as is.
+func FromHeader(name, from string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return from, nil
+	}
+	if strings.ContainsAny(name, "\r\n") {
+		return "", errors.New("from-name has line breaks")
+	}
+
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return "", fmt.Errorf("invalid from e-mail: %v", err)
+	}
+	return (&mail.Address{Name: name, Address: addr.Address}).String(), nil
+}
+
+// WithFooter returns a message body of a language with the language's
+// mandatory footer appended if neither the body nor the base template
+// has an unsubscribe link.
+func (c *Campaign) WithFooter(lang, body string) string {
+	if len(c.Footers) == 0 || HasUnsubscribeURL(c.TemplateBody) || HasUnsubscribeURL(body) {
+		return body
+	}
+
+	// pt-br falls back to pt and then to the default.
+	f, ok := c.Footers[lang]
+	if !ok {
+		if f, ok = c.Footers[strings.SplitN(lang, "-", 2)[0]]; !ok {
+			f = c.Footers[""]
+		}
+	}
+
+	tpl := f.HTML
+	if c.TemplateFormat == TemplateFormatPlain {
+		tpl = f.Plain
+	}
+	if tpl == "" {
+		return body
+	}
+	return body + "\n" + tpl
+}
+
+// HasUnsubscribeURL checks whether a template has the unsubscribe URL placeholder.
+func HasUnsubscribeURL(tpl string) bool {
+	return regexpUnsubURL.MatchString(tpl)
+}
+
+// compileMessage compiles a message body of a language (with the mandatory
+// footer, if required) into a fresh copy of the campaign's base template and
+// the subject if it has a template string.
+func (c *Campaign) compileMessage(lang, subject, msg string, f template.FuncMap) (*template.Template, *template.Template, error) {
 	// Compile the base template.
 	body := c.TemplateBody
 	for _, r := range regTplFuncs {
@@ -293,39 +961,61 @@ func (c *Campaign) CompileTemplate(f template.FuncMap) error {
 	}
 	baseTPL, err := template.New(BaseTpl).Funcs(f).Parse(body)
 	if err != nil {
-		return fmt.Errorf("error compiling base template: %v", err)
+		return nil, nil, fmt.Errorf("error compiling base template: %v", err)
 	}
 
 	// Compile the campaign message.
-	body = c.Body
+	body = c.WithFooter(lang, msg)
 	for _, r := range regTplFuncs {
 		body = r.regExp.ReplaceAllString(body, r.replace)
 	}
 	msgTpl, err := template.New(ContentTpl).Funcs(f).Parse(body)
 	if err != nil {
-		return fmt.Errorf("error compiling message: %v", err)
+		return nil, nil, fmt.Errorf("error compiling message: %v", err)
 	}
 
 	out, err := baseTPL.AddParseTree(ContentTpl, msgTpl.Tree)
 	if err != nil {
-		return fmt.Errorf("error inserting child template: %v", err)
+		return nil, nil, fmt.Errorf("error inserting child template: %v", err)
 	}
 
 	// If the subject line has a template string, compile it.
-	if strings.Contains(c.Subject, "{{") {
-		subj := c.Subject
-		for _, r := range regTplFuncs {
-			subj = r.regExp.ReplaceAllString(subj, r.replace)
-		}
-		subjTpl, err := template.New(ContentTpl).Funcs(f).Parse(subj)
-		if err != nil {
-			return fmt.Errorf("error compiling subject: %v", err)
-		}
-		c.SubjectTpl = subjTpl
+	if !strings.Contains(subject, "{{") {
+		return out, nil, nil
+	}
+	for _, r := range regTplFuncs {
+		subject = r.regExp.ReplaceAllString(subject, r.replace)
+	}
+	subjTpl, err := template.New(ContentTpl).Funcs(f).Parse(subject)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error compiling subject: %v", err)
 	}
+	return out, subjTpl, nil
+}
 
-	c.Tpl = out
-	return nil
+// Variant returns the language variant of the campaign that matches the
+// language in the given attribute of a subscriber. A language with a region
+// (eg: de-at) matches the variant of its base language (de) if there's no
+// exact match. An empty string is returned if no variant matches.
+func (c *Campaign) Variant(s Subscriber, attrib string) string {
+	if len(c.Variants) == 0 || attrib == "" {
+		return ""
+	}
+
+	l, ok := s.Attribs[attrib].(string)
+	if !ok {
+		return ""
+	}
+	l = strings.ToLower(strings.TrimSpace(l))
+	if _, ok := c.Variants[l]; ok {
+		return l
+	}
+	if i := strings.IndexAny(l, "-_"); i > 0 {
+		if _, ok := c.Variants[l[:i]]; ok {
+			return l[:i]
+		}
+	}
+	return ""
 }
 
 // FirstName splits the name by spaces and returns the first chunk
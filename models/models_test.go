@@ -0,0 +1,104 @@
+package models
+
+import (
+	"bytes"
+	"html/template"
+	"testing"
+)
+
+func TestResolveFromName(t *testing.T) {
+	cases := []struct {
+		name     string
+		campName string
+		listName string
+		out      string
+	}{
+		{"none", "", "", ""},
+		{"list", "", "Newsletter", "Newsletter"},
+		{"campaign", "Sales", "", "Sales"},
+		{"campaign over list", "Sales", "Newsletter", "Sales"},
+	}
+
+	for _, c := range cases {
+		camp := Campaign{FromName: c.campName, ListFromName: c.listName}
+		if out := camp.ResolveFromName(); out != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, out, c.out)
+		}
+	}
+}
+
+func TestFromHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		fromName string
+		from     string
+		out      string
+		err      bool
+	}{
+		{"no name keeps from", "", "Acme <noreply@acme.com>", "Acme <noreply@acme.com>", false},
+		{"blank name keeps from", "  ", "noreply@acme.com", "noreply@acme.com", false},
+		{"name on address", "Sales", "noreply@acme.com", `"Sales" <noreply@acme.com>`, false},
+		{"name replaces display name", "Sales", "Acme <noreply@acme.com>", `"Sales" <noreply@acme.com>`, false},
+		{"name is trimmed", " Sales ", "noreply@acme.com", `"Sales" <noreply@acme.com>`, false},
+		{"name is encoded", "Müller", "noreply@acme.com", "=?utf-8?q?M=C3=BCller?= <noreply@acme.com>", false},
+		{"line breaks", "Sales\r\nBcc: x@y.com", "noreply@acme.com", "", true},
+		{"invalid from", "Sales", "noreply", "", true},
+	}
+
+	for _, c := range cases {
+		out, err := FromHeader(c.fromName, c.from)
+		if (err != nil) != c.err {
+			t.Errorf("%s: got error %v, want error: %v", c.name, err, c.err)
+			continue
+		}
+		if out != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, out, c.out)
+		}
+	}
+}
+
+func TestCompileFromName(t *testing.T) {
+	sub := struct{ Subscriber Subscriber }{Subscriber{Name: "Jane & co"}}
+
+	cases := []struct {
+		name     string
+		campName string
+		listName string
+		out      string
+	}{
+		{"none", "", "", ""},
+		{"list template", "", "{{ .Subscriber.Name }} via Newsletter", "Jane & co via Newsletter"},
+		{"campaign template over list", "Sales for {{ .Subscriber.Name }}", "Newsletter", "Sales for Jane & co"},
+	}
+
+	for _, c := range cases {
+		camp := Campaign{
+			Subject:      "Hi",
+			Body:         "Hello",
+			TemplateBody: `{{ template "content" . }}`,
+			FromName:     c.campName,
+			ListFromName: c.listName,
+		}
+		if err := camp.CompileTemplate(template.FuncMap{}); err != nil {
+			t.Errorf("%s: error compiling: %v", c.name, err)
+			continue
+		}
+
+		if camp.FromNameTpl == nil {
+			if c.out != "" {
+				t.Errorf("%s: no from-name template, want %q", c.name, c.out)
+			}
+			continue
+		}
+
+		// From-names are headers and aren't HTML escaped.
+		var out bytes.Buffer
+		if err := camp.FromNameTpl.ExecuteTemplate(&out, ContentTpl, sub); err != nil {
+			t.Errorf("%s: error rendering: %v", c.name, err)
+			continue
+		}
+		if out.String() != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, out.String(), c.out)
+		}
+	}
+}
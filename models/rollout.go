@@ -0,0 +1,138 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Stages of staged rollouts. A rollout is sent to its initial share of
+// subscribers and held (paused) until it's released to the rest, either by
+// resuming it or by its gate. Halted rollouts have failed their gate and can
+// only be released by resuming them.
+const (
+	CampaignRolloutInitial  = "initial"
+	CampaignRolloutHolding  = "holding"
+	CampaignRolloutHalted   = "halted"
+	CampaignRolloutReleased = "released"
+)
+
+// CampaignRolloutGate is the optional gate that releases a held rollout
+// once Wait has passed since it was held, if the metrics of its initial
+// share pass the thresholds. Rates are percentages of the messages sent to
+// the initial share and zero thresholds aren't checked. An empty gate waits
+// for the rollout to be released by hand.
+type CampaignRolloutGate struct {
+	Wait               string  `json:"wait"`
+	MinViewRate        float64 `json:"min_view_rate"`
+	MinClickRate       float64 `json:"min_click_rate"`
+	MaxBounceRate      float64 `json:"max_bounce_rate"`
+	MaxUnsubscribeRate float64 `json:"max_unsubscribe_rate"`
+	MaxComplaintRate   float64 `json:"max_complaint_rate"`
+}
+
+// CampaignRolloutMetrics are the metrics of the initial share of the
+// subscribers of a staged rollout. Views, clicks, bounces, unsubscribes, and
+// complaints are counted once per subscriber.
+type CampaignRolloutMetrics struct {
+	Sent            int     `db:"sent" json:"sent"`
+	Views           int     `db:"views" json:"views"`
+	Clicks          int     `db:"clicks" json:"clicks"`
+	Bounces         int     `db:"bounces" json:"bounces"`
+	Unsubscribes    int     `db:"unsubscribes" json:"unsubscribes"`
+	Complaints      int     `db:"complaints" json:"complaints"`
+	ViewRate        float64 `db:"-" json:"view_rate"`
+	ClickRate       float64 `db:"-" json:"click_rate"`
+	BounceRate      float64 `db:"-" json:"bounce_rate"`
+	UnsubscribeRate float64 `db:"-" json:"unsubscribe_rate"`
+	ComplaintRate   float64 `db:"-" json:"complaint_rate"`
+}
+
+// Enabled checks whether the gate releases rollouts.
+func (g CampaignRolloutGate) Enabled() bool {
+	return g.Wait != "" || g.MinViewRate > 0 || g.MinClickRate > 0 ||
+		g.MaxBounceRate > 0 || g.MaxUnsubscribeRate > 0 || g.MaxComplaintRate > 0
+}
+
+// Validate checks the wait and the thresholds of the gate.
+func (g CampaignRolloutGate) Validate() error {
+	if g.Wait != "" {
+		if d, err := time.ParseDuration(g.Wait); err != nil || d < 0 {
+			return fmt.Errorf("invalid wait '%s'. Should be a duration, eg: 4h", g.Wait)
+		}
+	}
+	for _, r := range []float64{g.MinViewRate, g.MinClickRate, g.MaxBounceRate, g.MaxUnsubscribeRate, g.MaxComplaintRate} {
+		if r < 0 || r > 100 {
+			return errors.New("rates should be between 0 and 100")
+		}
+	}
+	return nil
+}
+
+// WaitDuration returns the gate's wait. Invalid waits are zero.
+func (g CampaignRolloutGate) WaitDuration() time.Duration {
+	d, _ := time.ParseDuration(g.Wait)
+	return d
+}
+
+// Check returns the thresholds that the metrics fail, if any.
+func (g CampaignRolloutGate) Check(m CampaignRolloutMetrics) []string {
+	out := []string{}
+	if g.MinViewRate > 0 && m.ViewRate < g.MinViewRate {
+		out = append(out, fmt.Sprintf("view rate %.2f%% is below %.2f%%", m.ViewRate, g.MinViewRate))
+	}
+	if g.MinClickRate > 0 && m.ClickRate < g.MinClickRate {
+		out = append(out, fmt.Sprintf("click rate %.2f%% is below %.2f%%", m.ClickRate, g.MinClickRate))
+	}
+	return append(out, g.CheckMax(m)...)
+}
+
+// CheckMax returns the maximum thresholds that the metrics cross, if any.
+// Unlike the minimum ones, they can be checked before the gate's wait.
+func (g CampaignRolloutGate) CheckMax(m CampaignRolloutMetrics) []string {
+	out := []string{}
+	if g.MaxBounceRate > 0 && m.BounceRate > g.MaxBounceRate {
+		out = append(out, fmt.Sprintf("bounce rate %.2f%% is above %.2f%%", m.BounceRate, g.MaxBounceRate))
+	}
+	if g.MaxUnsubscribeRate > 0 && m.UnsubscribeRate > g.MaxUnsubscribeRate {
+		out = append(out, fmt.Sprintf("unsubscribe rate %.2f%% is above %.2f%%", m.UnsubscribeRate, g.MaxUnsubscribeRate))
+	}
+	if g.MaxComplaintRate > 0 && m.ComplaintRate > g.MaxComplaintRate {
+		out = append(out, fmt.Sprintf("complaint rate %.2f%% is above %.2f%%", m.ComplaintRate, g.MaxComplaintRate))
+	}
+	return out
+}
+
+// Value returns the JSON marshalled CampaignRolloutGate. Gates that aren't
+// enabled are empty.
+func (g CampaignRolloutGate) Value() (driver.Value, error) {
+	if !g.Enabled() {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(g)
+}
+
+// Scan unmarshals JSON into CampaignRolloutGate.
+func (g *CampaignRolloutGate) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, g)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, g)
+}
+
+// SetRates computes the rates of the metrics from the counts.
+func (m *CampaignRolloutMetrics) SetRates() {
+	if m.Sent == 0 {
+		return
+	}
+	rate := func(n int) float64 {
+		return float64(n) / float64(m.Sent) * 100
+	}
+	m.ViewRate = rate(m.Views)
+	m.ClickRate = rate(m.Clicks)
+	m.BounceRate = rate(m.Bounces)
+	m.UnsubscribeRate = rate(m.Unsubscribes)
+	m.ComplaintRate = rate(m.Complaints)
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sendWindowLookahead is how far ahead the next opening of send windows is
+// looked for. Windows repeat weekly and a day more covers DST shifts.
+const sendWindowLookahead = time.Hour * 24 * 8
+
+// locations caches the loaded timezones of send windows by name.
+var locations sync.Map
+
+// SendWindow is a weekly window in which campaigns are sent to a list.
+// Windows whose end is before their start end on the next day.
+type SendWindow struct {
+	// Days are ISO weekdays, from 1 (Monday) to 7 (Sunday), on which the
+	// window starts. Empty means every day.
+	Days []int `json:"days"`
+
+	// Start and End are the local times in the 24 hour HH:MM format. End
+	// can be 24:00.
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+// SendWindows are the send windows of a list. Campaigns can be sent to
+// lists without windows at any time.
+type SendWindows []SendWindow
+
+// ListSendWindows represents the send windows of a list in its timezone.
+type ListSendWindows struct {
+	ListID   int         `json:"list_id"`
+	ListName string      `json:"list_name"`
+	Timezone string      `json:"timezone"`
+	Windows  SendWindows `json:"windows"`
+}
+
+// CampaignSendWindows are the send windows of the lists of a campaign.
+// A campaign can only be sent when all of them are open.
+type CampaignSendWindows []ListSendWindows
+
+// Validate checks the days and the times of the windows.
+func (s SendWindows) Validate() error {
+	for i, w := range s {
+		for _, d := range w.Days {
+			if d < 1 || d > 7 {
+				return fmt.Errorf("window %d: invalid day %d. Days are from 1 (Monday) to 7 (Sunday)", i+1, d)
+			}
+		}
+		start, err := clockMinutes(w.Start)
+		if err != nil || start == 24*60 {
+			return fmt.Errorf("window %d: invalid start '%s'. Should be HH:MM", i+1, w.Start)
+		}
+		end, err := clockMinutes(w.End)
+		if err != nil {
+			return fmt.Errorf("window %d: invalid end '%s'. Should be HH:MM", i+1, w.End)
+		}
+		if start == end {
+			return fmt.Errorf("window %d: start and end are the same", i+1)
+		}
+	}
+	return nil
+}
+
+// Scan unmarshals JSON into SendWindows.
+func (s *SendWindows) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, s)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, s)
+}
+
+// Value returns the JSON marshalled SendWindows.
+func (s SendWindows) Value() (driver.Value, error) {
+	if s == nil {
+		return "[]", nil
+	}
+	b, err := json.Marshal(s)
+	return string(b), err
+}
+
+// Scan unmarshals JSON into CampaignSendWindows.
+func (c *CampaignSendWindows) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, c)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, c)
+}
+
+// Contains checks whether the time is in one of the list's windows. Lists
+// without windows, or with an unknown timezone, always contain it.
+func (l ListSendWindows) Contains(t time.Time) bool {
+	if len(l.Windows) == 0 {
+		return true
+	}
+	loc, err := loadLocation(l.Timezone)
+	if err != nil {
+		return true
+	}
+
+	var (
+		lt   = t.In(loc)
+		day  = isoWeekday(lt.Weekday())
+		prev = day - 1
+		min  = lt.Hour()*60 + lt.Minute()
+	)
+	if prev == 0 {
+		prev = 7
+	}
+	for _, w := range l.Windows {
+		start, err1 := clockMinutes(w.Start)
+		end, err2 := clockMinutes(w.End)
+		if err1 != nil || err2 != nil {
+			continue
+		}
+
+		if start < end {
+			if w.onDay(day) && min >= start && min < end {
+				return true
+			}
+			continue
+		}
+
+		// Overnight windows.
+		if (w.onDay(day) && min >= start) || (w.onDay(prev) && min < end) {
+			return true
+		}
+	}
+	return false
+}
+
+// Contains checks whether all the windows are open at the time.
+func (c CampaignSendWindows) Contains(t time.Time) bool {
+	for _, l := range c {
+		if !l.Contains(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// NextOpen returns the earliest time, at or after t, at which all the
+// windows are open, or false if they don't overlap.
+func (c CampaignSendWindows) NextOpen(t time.Time) (time.Time, bool) {
+	if c.Contains(t) {
+		return t, true
+	}
+
+	// Windows open on the minute.
+	end := t.Add(sendWindowLookahead)
+	for n := t.Truncate(time.Minute).Add(time.Minute); n.Before(end); n = n.Add(time.Minute) {
+		if c.Contains(n) {
+			return n, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// onDay checks whether the window starts on an ISO weekday.
+func (w SendWindow) onDay(day int) bool {
+	if len(w.Days) == 0 {
+		return true
+	}
+	for _, d := range w.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+// isoWeekday returns the ISO number of a weekday, from 1 (Monday) to 7.
+func isoWeekday(d time.Weekday) int {
+	if d == time.Sunday {
+		return 7
+	}
+	return int(d)
+}
+
+// loadLocation returns a timezone by name, loading it once.
+func loadLocation(name string) (*time.Location, error) {
+	if l, ok := locations.Load(name); ok {
+		return l.(*time.Location), nil
+	}
+	l, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, l)
+	return l, nil
+}
+
+// clockMinutes returns the minutes since midnight of an HH:MM time.
+func clockMinutes(s string) (int, error) {
+	p := strings.Split(s, ":")
+	if len(p) != 2 || len(p[0]) != 2 || len(p[1]) != 2 {
+		return 0, errors.New("invalid time")
+	}
+	h, err := strconv.Atoi(p[0])
+	if err != nil {
+		return 0, err
+	}
+	m, err := strconv.Atoi(p[1])
+	if err != nil {
+		return 0, err
+	}
+	if h > 24 || m > 59 || (h == 24 && m > 0) {
+		return 0, errors.New("invalid time")
+	}
+	return h*60 + m, nil
+}
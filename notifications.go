@@ -2,17 +2,38 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 
+	"github.com/jmoiron/sqlx/types"
 	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 const (
 	notifTplImport       = "import-status"
 	notifTplCampaign     = "campaign-status"
+	notifTplSendAlert    = "campaign-send-alert"
+	notifTplExportFailed = "export-failed"
+	notifTplComplaint    = "subscriber-complaint"
 	notifSubscriberOptin = "subscriber-optin"
 	notifSubscriberData  = "subscriber-data"
 )
 
+// campaignFinished is the payload of the campaign.finished webhook.
+type campaignFinished struct {
+	CampaignID   int            `json:"campaign_id"`
+	CampaignUUID string         `json:"campaign_uuid"`
+	CampaignName string         `json:"campaign_name"`
+	Type         string         `json:"type"`
+	Tags         []string       `json:"tags"`
+	ToSend       int            `json:"to_send"`
+	Sent         int            `json:"sent"`
+	StartedAt    null.Time      `json:"started_at"`
+	Metadata     types.JSONText `json:"metadata"`
+}
+
 // notifData represents params commonly used across different notification
 // templates.
 type notifData struct {
@@ -41,3 +62,57 @@ func (app *App) sendNotification(toEmails []string, subject, tplName string, dat
 	}
 	return nil
 }
+
+// sendAlert dispatches a send failure alert of a campaign to the webhooks
+// subscribed to it and optionally, e-mails it to admins.
+func (app *App) sendAlert(a manager.SendAlert, notify bool) {
+	app.log.Printf("send alert on campaign %s (%s): %d errors in %d messages, %d consecutive",
+		a.CampaignName, a.Reason, a.Errors, a.Window, a.ConsecutiveErrors)
+
+	if err := app.webhooks.Push(webhooks.EventCampaignSendAlert, a); err != nil {
+		app.log.Printf("error queuing webhook '%s': %v", webhooks.EventCampaignSendAlert, err)
+	}
+
+	if notify {
+		app.sendNotification(app.constants.NotifyEmails,
+			fmt.Sprintf("Send errors: %s", a.CampaignName), notifTplSendAlert, a)
+	}
+}
+
+// sendExportAlert pushes the failure of a scheduled export to the webhooks
+// and optionally e-mails it to the admins.
+func (app *App) sendExportAlert(a exportAlert, notify bool) {
+	app.log.Printf("export '%s' (job %d) failed: %s", a.Export, a.JobID, a.Error)
+
+	if err := app.webhooks.Push(webhooks.EventExportFailed, a); err != nil {
+		app.log.Printf("error queuing webhook '%s': %v", webhooks.EventExportFailed, err)
+	}
+
+	if notify {
+		app.sendNotification(app.constants.NotifyEmails,
+			fmt.Sprintf("Export failed: %s", a.Export), notifTplExportFailed, a)
+	}
+}
+
+// sendCampaignFinished pushes a campaign that has finished to the webhooks
+// with its metadata. Simulated runs aren't pushed.
+func (app *App) sendCampaignFinished(c *models.Campaign) {
+	if c.Simulate {
+		return
+	}
+
+	out := campaignFinished{
+		CampaignID:   c.ID,
+		CampaignUUID: c.UUID,
+		CampaignName: c.Name,
+		Type:         c.Type,
+		Tags:         c.Tags,
+		ToSend:       c.ToSend,
+		Sent:         c.Sent,
+		StartedAt:    c.StartedAt,
+		Metadata:     c.Metadata,
+	}
+	if err := app.webhooks.Push(webhooks.EventCampaignFinished, out); err != nil {
+		app.log.Printf("error queuing webhook '%s': %v", webhooks.EventCampaignFinished, err)
+	}
+}
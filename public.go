@@ -2,18 +2,24 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"database/sql"
+	"errors"
 	"fmt"
 	"html/template"
 	"image"
 	"image/png"
 	"io"
+	"math"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
 	"github.com/lib/pq"
@@ -51,8 +57,19 @@ type unsubTpl struct {
 	AllowBlacklist bool
 	AllowExport    bool
 	AllowWipe      bool
+	Reasons        []string
 }
 
+const (
+	// unsubReasonOther is the reason of unsubscriptions with a free text comment
+	// and unsubReasonOneClick is that of one-click (List-Unsubscribe) ones.
+	unsubReasonOther    = "other"
+	unsubReasonOneClick = "one-click"
+
+	// unsubCommentMaxLen is the maximum length of unsubscribe comments.
+	unsubCommentMaxLen = 1000
+)
+
 type optinTpl struct {
 	publicTpl
 	SubUUID   string
@@ -120,13 +137,17 @@ func handleViewCampaignMessage(c echo.Context) error {
 			makeMsgTpl("Error", "", `Error fetching e-mail message.`))
 	}
 
-	// Compile the template.
-	if err := camp.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
+	// Render the content that was sent and compile the template.
+	camp.ApplySnapshot()
+	if err := app.manager.CompileTemplate(&camp); err != nil {
 		app.log.Printf("error compiling template: %v", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl("Error", "", `Error compiling e-mail template.`))
 	}
 
+	// Public views only identify subscribers by their UUIDs.
+	sub.ID = 0
+
 	// Render the message body.
 	m := app.manager.NewCampaignMessage(&camp, sub)
 	if err := m.Render(); err != nil {
@@ -135,7 +156,11 @@ func handleViewCampaignMessage(c echo.Context) error {
 			makeMsgTpl("Error", "", `Error rendering e-mail message.`))
 	}
 
-	return c.HTML(http.StatusOK, string(m.Body()))
+	body := m.Body()
+	if app.constants.Sanitizer != nil {
+		body = app.constants.Sanitizer.Sanitize(body)
+	}
+	return c.HTML(http.StatusOK, string(body))
 }
 
 // handleSubscriptionPage renders the subscription management page and
@@ -155,6 +180,15 @@ func handleSubscriptionPage(c echo.Context) error {
 	out.AllowBlacklist = app.constants.Privacy.AllowBlacklist
 	out.AllowExport = app.constants.Privacy.AllowExport
 	out.AllowWipe = app.constants.Privacy.AllowWipe
+	out.Reasons = app.constants.Privacy.UnsubReasons
+
+	// One-click unsubscriptions (RFC 8058) POST List-Unsubscribe=One-Click
+	// and can't have a reason.
+	oneClick := c.FormValue("List-Unsubscribe") == "One-Click"
+	if oneClick {
+		unsub = true
+		blacklist = false
+	}
 
 	// Unsubscribe.
 	if unsub {
@@ -163,13 +197,42 @@ func handleSubscriptionPage(c echo.Context) error {
 			blacklist = false
 		}
 
-		if _, err := app.queries.Unsubscribe.Exec(campUUID, subUUID, blacklist); err != nil {
+		reason, comment := unsubReasonOneClick, ""
+		if !oneClick {
+			reason, comment = getUnsubReason(c.FormValue("reason"), c.FormValue("comment"), app)
+		}
+
+		// One-click unsubscriptions are immediate opt-outs, without the
+		// win-back grace periods of lists.
+		res, err := app.queries.Unsubscribe.Exec(campUUID, subUUID, blacklist, reason, comment, !oneClick)
+		if err != nil {
 			app.log.Printf("error unsubscribing: %v", err)
 			return c.Render(http.StatusInternalServerError, tplMessage,
 				makeMsgTpl("Error", "",
 					`Error processing request. Please retry.`))
 		}
 
+		// The reason is only recorded if any lists were unsubscribed from.
+		ev := webhooks.EventSubscriberUnsubscribed
+		if blacklist {
+			ev = webhooks.EventSubscriberBlacklisted
+		}
+		if n, _ := res.RowsAffected(); n > 0 || blacklist {
+			onStatusTransition(ev, nil, []string{subUUID}, app)
+		}
+
+		// Redirect to the unsubscribe page of the campaign or its lists, if
+		// there's one. One-click unsubscriptions aren't from browsers.
+		if !oneClick {
+			status := models.SubscriptionStatusUnsubscribed
+			if blacklist {
+				status = models.SubscriberStatusBlackListed
+			}
+			if u := getUnsubRedirect(campUUID, status, app); u != "" {
+				return c.Redirect(http.StatusFound, u)
+			}
+		}
+
 		return c.Render(http.StatusOK, tplMessage,
 			makeMsgTpl("Unsubscribed", "",
 				`You have been successfully unsubscribed.`))
@@ -178,6 +241,85 @@ func handleSubscriptionPage(c echo.Context) error {
 	return c.Render(http.StatusOK, "subscription", out)
 }
 
+// getUnsubRedirect returns the unsubscribe redirect URL of a campaign (or
+// its lists), or of a list, with the signed status of the unsubscription, or
+// an empty string if there isn't one.
+func getUnsubRedirect(uuid, status string, app *App) string {
+	var u string
+	if err := app.queries.GetUnsubscribeRedirect.Get(&u, uuid); err != nil {
+		app.log.Printf("error fetching unsubscribe redirect: %v", err)
+		return ""
+	}
+	if u == "" {
+		return ""
+	}
+
+	// The allowed hosts may have changed since the URL was saved.
+	if err := validateUnsubRedirect(u, app); err != nil {
+		app.log.Printf("ignoring unsubscribe redirect '%s': %v", u, err)
+		return ""
+	}
+
+	p, _ := url.Parse(u)
+	q := p.Query()
+	q.Set("status", status)
+	if secret := app.constants.Privacy.UnsubRedirectSecret; secret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		q.Set("ts", ts)
+		q.Set("sig", webhooks.Sign(secret, ts, []byte(status)))
+	}
+	p.RawQuery = q.Encode()
+	return p.String()
+}
+
+// validateUnsubRedirect checks that an unsubscribe redirect URL is an
+// absolute http(s) URL on one of the allowed hosts, if there are any.
+func validateUnsubRedirect(u string, app *App) error {
+	if u == "" {
+		return nil
+	}
+
+	p, err := url.Parse(u)
+	if err != nil || !p.IsAbs() || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+		return errors.New("it should be an absolute http(s) URL")
+	}
+
+	hosts := app.constants.Privacy.UnsubRedirectHosts
+	if len(hosts) == 0 {
+		return nil
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(h, p.Hostname()) {
+			return nil
+		}
+	}
+	return fmt.Errorf("the host '%s' isn't in privacy.unsubscribe_redirect_hosts", p.Hostname())
+}
+
+// getUnsubReason validates the reason an unsubscribing subscriber has picked
+// against the configured reasons. Free text comments are only retained with
+// the 'other' reason, which is implied if there's only a comment.
+func getUnsubReason(reason, comment string, app *App) (string, string) {
+	comment = strings.TrimSpace(comment)
+	if r := []rune(comment); len(r) > unsubCommentMaxLen {
+		comment = string(r[:unsubCommentMaxLen])
+	}
+
+	if reason == "" && comment != "" {
+		reason = unsubReasonOther
+	}
+	if reason == unsubReasonOther {
+		return reason, comment
+	}
+
+	for _, r := range app.constants.Privacy.UnsubReasons {
+		if r == reason {
+			return reason, ""
+		}
+	}
+	return "", ""
+}
+
 // handleOptinPage renders the double opt-in confirmation page that subscribers
 // see when they click on the "Confirm subscription" button in double-optin
 // notifications.
@@ -225,12 +367,23 @@ func handleOptinPage(c echo.Context) error {
 
 	// Confirm.
 	if confirm {
-		if _, err := app.queries.ConfirmSubscriptionOptin.Exec(subUUID, pq.StringArray(out.ListUUIDs)); err != nil {
+		var n int
+		if err := app.queries.ConfirmSubscriptionOptin.Get(&n, subUUID, pq.StringArray(out.ListUUIDs),
+			c.RealIP(), truncate(c.Request().UserAgent(), consentMaxLen)); err != nil {
 			app.log.Printf("error unsubscribing: %v", err)
 			return c.Render(http.StatusInternalServerError, tplMessage,
 				makeMsgTpl("Error", "",
 					`Error processing request. Please retry.`))
 		}
+		if n > 0 {
+			onStatusTransition(webhooks.EventSubscriptionConfirmed, nil, []string{subUUID}, app)
+		}
+
+		// Start the welcome sequences of the confirmed lists.
+		if _, err := app.queries.QueueWelcomeMessages.Exec(subUUID, pq.StringArray(out.ListUUIDs)); err != nil {
+			app.log.Printf("error queuing welcome messages: %v", err)
+		}
+
 		return c.Render(http.StatusOK, tplMessage,
 			makeMsgTpl("Confirmed", "",
 				`Your subscriptions have been confirmed.`))
@@ -269,11 +422,15 @@ func handleSubscriptionForm(c echo.Context) error {
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl("Error", "", err.Error()))
 	}
+	if err := app.constants.Attribs.Normalize(req.Attribs); err != nil {
+		return c.Render(http.StatusBadRequest, tplMessage,
+			makeMsgTpl("Error", "", err.Error()))
+	}
 
 	// Insert the subscriber into the DB.
 	req.Status = models.SubscriberStatusEnabled
 	req.ListUUIDs = pq.StringArray(req.SubListUUIDs)
-	if _, err := insertSubscriber(req.SubReq, app); err != nil {
+	if _, err := insertSubscriber(req.SubReq, makeConsent(c), app); err != nil {
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl("Error", "", fmt.Sprintf("%s", err.(*echo.HTTPError).Message)))
 	}
@@ -293,8 +450,18 @@ func handleLinkRedirect(c echo.Context) error {
 		subUUID  = c.Param("subUUID")
 	)
 
-	var url string
-	if err := app.queries.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID); err != nil {
+	// Links of messages sent before tracking was disabled are redirected
+	// without recording the clicks.
+	var (
+		url string
+		err error
+	)
+	if app.constants.Privacy.DisableTracking {
+		err = app.queries.GetLinkURL.Get(&url, linkUUID)
+	} else {
+		err = app.queries.RegisterLinkClick.Get(&url, linkUUID, campUUID, subUUID)
+	}
+	if err != nil {
 		if err != sql.ErrNoRows {
 			app.log.Printf("error fetching redirect link: %s", err)
 		}
@@ -303,6 +470,10 @@ func handleLinkRedirect(c echo.Context) error {
 			makeMsgTpl("Error opening link", "",
 				"There was an error opening the link. Please try later."))
 	}
+	if !app.constants.Privacy.DisableTracking {
+		reengageWinbacks(subUUID, app)
+		go pushTrackingEvent(webhooks.EventLinkClicked, campUUID, subUUID, linkUUID, url, trackingSource, app)
+	}
 
 	return c.Redirect(http.StatusTemporaryRedirect, url)
 }
@@ -319,16 +490,67 @@ func handleRegisterCampaignView(c echo.Context) error {
 	)
 
 	// Exclude dummy hits from template previews.
-	if campUUID != dummyUUID && subUUID != dummyUUID {
+	if campUUID != dummyUUID && subUUID != dummyUUID && !app.constants.Privacy.DisableTracking {
 		if _, err := app.queries.RegisterCampaignView.Exec(campUUID, subUUID); err != nil {
 			app.log.Printf("error registering campaign view: %s", err)
+		} else {
+			go pushTrackingEvent(webhooks.EventCampaignViewed, campUUID, subUUID, "", "", trackingSource, app)
 		}
+		reengageWinbacks(subUUID, app)
 	}
 
 	c.Response().Header().Set("Cache-Control", "no-cache")
 	return c.Blob(http.StatusOK, "image/png", pixelPNG)
 }
 
+// handleRegisterConversion records a conversion (eg: a purchase) on an
+// external site that's attributed to a campaign. It takes the token
+// that's generated by the ConversionToken() template function, and an
+// optional value and a ref (eg: an order ID) that deduplicates repeated
+// reports of the same conversion. GET requests respond with a pixel so
+// that it can be embedded as an image.
+func handleRegisterConversion(c echo.Context) error {
+	var (
+		app      = c.Get("app").(*App)
+		campUUID = c.Param("campUUID")
+		subUUID  = c.Param("subUUID")
+		token    = c.FormValue("token")
+		ref      = strings.TrimSpace(c.FormValue("ref"))
+		value    = 0.0
+	)
+
+	if app.constants.ConvSecret == "" {
+		return echo.NewHTTPError(http.StatusNotFound, "The feature is not available.")
+	}
+	if !hmac.Equal([]byte(token), []byte(app.manager.ConversionToken(campUUID, subUUID))) {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid token.")
+	}
+	if v := c.FormValue("value"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid value.")
+		}
+		value = f
+	}
+	if len(ref) > stdInputMaxLen {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for ref.")
+	}
+
+	// Exclude dummy hits from template previews.
+	if campUUID != dummyUUID && subUUID != dummyUUID {
+		if _, err := app.queries.RegisterConversion.Exec(campUUID, subUUID, value, ref); err != nil {
+			app.log.Printf("error registering conversion: %s", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error registering conversion.")
+		}
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	if c.Request().Method == http.MethodGet {
+		return c.Blob(http.StatusOK, "image/png", pixelPNG)
+	}
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
 // handleSelfExportSubscriberData pulls the subscriber's profile, list subscriptions,
 // campaign views and clicks and produces a JSON report that is then e-mailed
 // to the subscriber. This is a privacy feature and the data that's exported
@@ -367,18 +589,19 @@ func handleSelfExportSubscriberData(c echo.Context) error {
 
 	// Send the data as a JSON attachment to the subscriber.
 	const fname = "profile.json"
-	if err := app.messenger.Push(app.constants.FromEmail,
-		[]string{data.Email},
-		"Your profile data",
-		msg.Bytes(),
-		[]messenger.Attachment{
+	if err := app.messenger.Push(messenger.Message{
+		From:    app.constants.FromEmail,
+		To:      []string{data.Email},
+		Subject: "Your profile data",
+		Body:    msg.Bytes(),
+		Attachments: []messenger.Attachment{
 			{
 				Name:    fname,
 				Content: b,
 				Header:  messenger.MakeAttachmentHeader(fname, "base64"),
 			},
 		},
-	); err != nil {
+	}); err != nil {
 		app.log.Printf("error e-mailing subscriber profile: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl("Error e-mailing data", "",
@@ -391,7 +614,8 @@ func handleSelfExportSubscriberData(c echo.Context) error {
 
 // handleWipeSubscriberData allows a subscriber to delete their data. The
 // profile and subscriptions are deleted, while the campaign_views and link
-// clicks remain as orphan data unconnected to any subscriber.
+// clicks remain as orphan data unconnected to any subscriber, or are deleted
+// as per the privacy settings.
 func handleWipeSubscriberData(c echo.Context) error {
 	var (
 		app     = c.Get("app").(*App)
@@ -405,7 +629,19 @@ func handleWipeSubscriberData(c echo.Context) error {
 				"The feature is not available."))
 	}
 
-	if _, err := app.queries.DeleteSubscribers.Exec(nil, pq.StringArray{subUUID}); err != nil {
+	var subs models.Subscribers
+	if err := app.queries.GetSubscribersByIDs.Select(&subs, pq.Int64Array{}, pq.StringArray{subUUID}); err != nil {
+		app.log.Printf("error fetching subscriber to wipe: %s", err)
+		return c.Render(http.StatusInternalServerError, tplMessage,
+			makeMsgTpl("Error processing request", "",
+				"There was an error processing your request. Please try later."))
+	}
+
+	IDs := make([]int64, 0, len(subs))
+	for _, s := range subs {
+		IDs = append(IDs, int64(s.ID))
+	}
+	if _, err := deleteSubscribers(IDs, delSourceWipe, app); err != nil {
 		app.log.Printf("error wiping subscriber data: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl("Error processing request", "",
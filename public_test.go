@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"text/template/parse"
+
+	"github.com/knadh/goyesql/v2"
+	"github.com/labstack/echo"
+)
+
+// testUUID is a valid UUID for the params of public routes.
+const testUUID = "d27bfc8b-4b8b-4a7a-a6ab-8fb7c8f4e7a1"
+
+// reSelectCols matches the column list of a CTE or a subquery in the
+// export-subscriber-data query.
+var reSelectCols = regexp.MustCompile(`(?is)(\w+) AS \(\s*SELECT (.+?)\s+FROM `)
+
+// msgRenderer records the data of the rendered templates.
+type msgRenderer struct {
+	data interface{}
+}
+
+func (r *msgRenderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	r.data = data
+	return nil
+}
+
+// idKeys returns the keys in a JSON document that are integer IDs, such as
+// id or subscriber_id.
+func idKeys(v interface{}) []string {
+	var out []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, c := range v {
+			if k == "id" || strings.HasSuffix(k, "_id") {
+				out = append(out, k)
+			}
+			out = append(out, idKeys(c)...)
+		}
+	case []interface{}:
+		for _, c := range v {
+			out = append(out, idKeys(c)...)
+		}
+	}
+	return out
+}
+
+// selectAliases returns the names of the columns in a SELECT column list.
+func selectAliases(cols string) []string {
+	var (
+		out   []string
+		depth = 0
+		start = 0
+	)
+	cols += ","
+	for i, ch := range cols {
+		switch ch {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth > 0 {
+				continue
+			}
+			col := strings.TrimSpace(cols[start:i])
+			start = i + 1
+
+			// The alias is the last word of the column, eg: name in
+			// "lists.name" or "(CASE ... END) AS name".
+			f := strings.FieldsFunc(col, func(r rune) bool {
+				return !(r == '_' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9')
+			})
+			if len(f) > 0 {
+				out = append(out, f[len(f)-1])
+			}
+		}
+	}
+	return out
+}
+
+// idFields returns the field references in a template tree that are integer
+// IDs, such as .ID, $l.ID, or .Data.SubscriberID.
+func idFields(n parse.Node) []string {
+	var out []string
+	isID := func(idents []string) {
+		for _, i := range idents {
+			if strings.HasSuffix(i, "ID") && !strings.HasSuffix(i, "UUID") {
+				out = append(out, strings.Join(idents, "."))
+				return
+			}
+		}
+	}
+
+	switch n := n.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Nodes {
+			out = append(out, idFields(c)...)
+		}
+	case *parse.ActionNode:
+		out = append(out, idFields(n.Pipe)...)
+	case *parse.IfNode:
+		out = append(out, idFields(n.Pipe)...)
+		out = append(out, idFields(n.List)...)
+		out = append(out, idFields(n.ElseList)...)
+	case *parse.RangeNode:
+		out = append(out, idFields(n.Pipe)...)
+		out = append(out, idFields(n.List)...)
+		out = append(out, idFields(n.ElseList)...)
+	case *parse.WithNode:
+		out = append(out, idFields(n.Pipe)...)
+		out = append(out, idFields(n.List)...)
+		out = append(out, idFields(n.ElseList)...)
+	case *parse.TemplateNode:
+		if n.Pipe != nil {
+			out = append(out, idFields(n.Pipe)...)
+		}
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, c := range n.Cmds {
+			out = append(out, idFields(c)...)
+		}
+	case *parse.CommandNode:
+		for _, a := range n.Args {
+			out = append(out, idFields(a)...)
+		}
+	case *parse.ChainNode:
+		out = append(out, idFields(n.Node)...)
+		isID(n.Field)
+	case *parse.FieldNode:
+		isID(n.Ident)
+	case *parse.VariableNode:
+		isID(n.Ident)
+	}
+	return out
+}
+
+func TestIDFields(t *testing.T) {
+	cases := []struct {
+		name string
+		tpl  string
+		out  string
+	}{
+		{"uuid", `{{ .Data.SubUUID }}`, ""},
+		{"field", `{{ .Data.ID }}`, "Data.ID"},
+		{"subscriber id", `{{ .Data.SubscriberID }}`, "Data.SubscriberID"},
+		{"variable", `{{ range $l := .Data.Lists }}{{ $l.ID }}{{ end }}`, "$l.ID"},
+		{"if", `{{ if .Data.Subscriber.ID }}x{{ end }}`, "Data.Subscriber.ID"},
+		{"else", `{{ if .Data }}x{{ else }}{{ .ID }}{{ end }}`, "ID"},
+		{"template arg", `{{ define "a" }}{{ end }}{{ template "a" .Data.ID }}`, "Data.ID"},
+	}
+
+	for _, c := range cases {
+		tpl, err := template.New(c.name).Parse(c.tpl)
+		if err != nil {
+			t.Fatalf("%s: error parsing: %v", c.name, err)
+		}
+
+		var out []string
+		for _, t := range tpl.Templates() {
+			out = append(out, idFields(t.Tree.Root)...)
+		}
+		if got := strings.Join(out, ","); got != c.out {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.out)
+		}
+	}
+}
+
+// TestPublicTemplatesIDs checks that the public pages only refer to
+// subscribers, lists, and campaigns by their UUIDs and never emit their
+// integer IDs.
+func TestPublicTemplatesIDs(t *testing.T) {
+	tpl, err := template.ParseGlob("static/public/templates/*.html")
+	if err != nil {
+		t.Fatalf("error parsing public templates: %v", err)
+	}
+
+	for _, name := range []string{"header", "footer", tplArchive, tplMessage, "optin", "subscription"} {
+		p := tpl.Lookup(name)
+		if p == nil {
+			t.Errorf("%s: template not found", name)
+			continue
+		}
+		if ids := idFields(p.Tree.Root); len(ids) > 0 {
+			t.Errorf("%s: template refers to IDs: %v", name, ids)
+		}
+	}
+}
+
+// TestPublicRoutesUUIDs checks that the params of the public routes are
+// only accepted as UUIDs and never as integer IDs.
+func TestPublicRoutesUUIDs(t *testing.T) {
+	e := echo.New()
+	registerHTTPHandlers(e)
+
+	n := 0
+	for _, r := range e.Routes() {
+		var public bool
+		for _, p := range []string{"/subscription/", "/link/", "/campaign/", "/archive/", "/conversion/"} {
+			if strings.HasPrefix(r.Path, p) {
+				public = true
+			}
+		}
+		if !public || !strings.Contains(r.Path, ":") {
+			continue
+		}
+		n++
+
+		// Set each param to an integer ID with the others set to a UUID.
+		parts := strings.Split(r.Path, "/")
+		for i, p := range parts {
+			if !strings.HasPrefix(p, ":") {
+				continue
+			}
+
+			path := make([]string, len(parts))
+			for j, p := range parts {
+				path[j] = p
+				if strings.HasPrefix(p, ":") {
+					path[j] = testUUID
+				}
+			}
+			path[i] = "1"
+
+			if status, ok := servePublic(e, r.Method, strings.Join(path, "/")); !ok || status != http.StatusBadRequest {
+				t.Errorf("%s %s: %s isn't validated as a UUID", r.Method, r.Path, p)
+			}
+		}
+	}
+
+	// Catch the routes being moved or renamed.
+	if n < 13 {
+		t.Errorf("got %d public routes with params, want at least 13", n)
+	}
+}
+
+// servePublic serves a request and returns its status. Requests that aren't
+// rejected by validateUUID reach their handlers, which panic without an App,
+// and aren't ok.
+func servePublic(e *echo.Echo, method, path string) (status int, ok bool) {
+	e.Renderer = &msgRenderer{}
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	w := httptest.NewRecorder()
+	e.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code, true
+}
+
+// TestSubscriptionFormIDs checks that the responses of the public
+// subscription form don't emit integer IDs.
+func TestSubscriptionFormIDs(t *testing.T) {
+	cases := []struct {
+		name string
+		form url.Values
+	}{
+		{"no lists", url.Values{"email": {"a@listmonk.app"}}},
+		{"invalid email", url.Values{"email": {"1"}, "l": {testUUID}}},
+	}
+
+	for _, c := range cases {
+		var (
+			e   = echo.New()
+			r   = &msgRenderer{}
+			app = &App{constants: &constants{}}
+		)
+		e.Renderer = r
+		e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Set("app", app)
+				return next(c)
+			}
+		})
+		e.POST("/subscription/form", handleSubscriptionForm)
+
+		req := httptest.NewRequest(http.MethodPost, "/subscription/form", strings.NewReader(c.form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+
+		if r.data == nil {
+			t.Errorf("%s: nothing was rendered", c.name)
+			continue
+		}
+		b, _ := json.Marshal(r.data)
+		var v interface{}
+		if err := json.Unmarshal(b, &v); err != nil {
+			t.Fatalf("%s: error parsing response: %v", c.name, err)
+		}
+		if ids := idKeys(v); len(ids) > 0 {
+			t.Errorf("%s: response has IDs: %v", c.name, ids)
+		}
+	}
+}
+
+// TestSelfExportIDs checks that the data that subscribers export themselves
+// on the public pages doesn't have integer IDs. The export is the JSON of
+// subProfileData, whose items are aggregated as JSON by the
+// export-subscriber-data query from the columns that it selects.
+func TestSelfExportIDs(t *testing.T) {
+	qs, err := goyesql.ParseFile("queries.sql")
+	if err != nil {
+		t.Fatalf("error parsing queries: %v", err)
+	}
+	q, ok := qs["export-subscriber-data"]
+	if !ok {
+		t.Fatal("export-subscriber-data query not found")
+	}
+
+	// The columns of the CTEs and of the subqueries that are aggregated.
+	cols := make(map[string][]string)
+	for _, m := range reSelectCols.FindAllStringSubmatch(q.Query, -1) {
+		cols[m[1]] = selectAliases(m[2])
+	}
+	for _, m := range regexp.MustCompile(`(?is)JSON_AGG\(t\) FROM (\(SELECT (.+?) FROM \w+\)|(\w+)) t`).FindAllStringSubmatch(q.Query, -1) {
+		src, aliases := m[3], cols[m[3]]
+		if m[3] == "" {
+			src, aliases = m[1], selectAliases(m[2])
+		}
+		if len(aliases) == 0 {
+			t.Errorf("%s: no columns found", src)
+			continue
+		}
+		for _, a := range aliases {
+			if a == "id" || strings.HasSuffix(a, "_id") {
+				t.Errorf("%s: export has ID column %s", src, a)
+			}
+		}
+	}
+
+	// The JSON of the export with its items.
+	b, err := json.Marshal(subProfileData{
+		Email:         "a@listmonk.app",
+		Profile:       json.RawMessage(`[{"uuid": "` + testUUID + `"}]`),
+		Subscriptions: json.RawMessage(`[]`),
+		CampaignViews: json.RawMessage(`[]`),
+		LinkClicks:    json.RawMessage(`[]`),
+	})
+	if err != nil {
+		t.Fatalf("error marshalling export: %v", err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		t.Fatalf("error parsing export: %v", err)
+	}
+	if ids := idKeys(v); len(ids) > 0 {
+		t.Errorf("export has IDs: %v", ids)
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/lib/pq"
@@ -17,8 +19,12 @@ type Queries struct {
 	InsertSubscriber                *sqlx.Stmt `query:"insert-subscriber"`
 	UpsertSubscriber                *sqlx.Stmt `query:"upsert-subscriber"`
 	UpsertBlacklistSubscriber       *sqlx.Stmt `query:"upsert-blacklist-subscriber"`
+	UpsertSubscribers               *sqlx.Stmt `query:"upsert-subscribers"`
+	UpsertBlacklistSubscribers      *sqlx.Stmt `query:"upsert-blacklist-subscribers"`
+	GetSuppressedSubscribers        *sqlx.Stmt `query:"get-suppressed-subscribers"`
 	GetSubscriber                   *sqlx.Stmt `query:"get-subscriber"`
 	GetSubscribersByEmails          *sqlx.Stmt `query:"get-subscribers-by-emails"`
+	GetSubscribersByIDs             *sqlx.Stmt `query:"get-subscribers-by-ids"`
 	GetSubscriberLists              *sqlx.Stmt `query:"get-subscriber-lists"`
 	GetSubscriberListsLazy          *sqlx.Stmt `query:"get-subscriber-lists-lazy"`
 	SubscriberExists                *sqlx.Stmt `query:"subscriber-exists"`
@@ -29,52 +35,204 @@ type Queries struct {
 	ConfirmSubscriptionOptin        *sqlx.Stmt `query:"confirm-subscription-optin"`
 	UnsubscribeSubscribersFromLists *sqlx.Stmt `query:"unsubscribe-subscribers-from-lists"`
 	DeleteSubscribers               *sqlx.Stmt `query:"delete-subscribers"`
+	GetUnsubscribeReasons           *sqlx.Stmt `query:"get-unsubscribe-reasons"`
+	DeleteSubscriberHistory         *sqlx.Stmt `query:"delete-subscriber-history"`
+	GetSubscriberDeletions          *sqlx.Stmt `query:"get-subscriber-deletions"`
+	GetSubscriptionsWithoutConsent  *sqlx.Stmt `query:"get-subscriptions-without-consent"`
 	Unsubscribe                     *sqlx.Stmt `query:"unsubscribe"`
+	GetUnsubscribeRedirect          *sqlx.Stmt `query:"get-unsubscribe-redirect"`
+	UnsubscribeByEmail              *sqlx.Stmt `query:"unsubscribe-by-email"`
 	ExportSubscriberData            *sqlx.Stmt `query:"export-subscriber-data"`
+	GetSubscriberActivity           *sqlx.Stmt `query:"get-subscriber-activity"`
+	UnsubscribeComplaint            *sqlx.Stmt `query:"unsubscribe-complaint"`
 
 	// Non-prepared arbitrary subscriber queries.
 	QuerySubscribers                       string `query:"query-subscribers"`
 	QuerySubscribersTpl                    string `query:"query-subscribers-template"`
-	DeleteSubscribersByQuery               string `query:"delete-subscribers-by-query"`
 	AddSubscribersToListsByQuery           string `query:"add-subscribers-to-lists-by-query"`
 	BlacklistSubscribersByQuery            string `query:"blacklist-subscribers-by-query"`
 	DeleteSubscriptionsByQuery             string `query:"delete-subscriptions-by-query"`
 	UnsubscribeSubscribersFromListsByQuery string `query:"unsubscribe-subscribers-from-lists-by-query"`
 
-	CreateList      *sqlx.Stmt `query:"create-list"`
-	GetLists        *sqlx.Stmt `query:"get-lists"`
-	GetListsByOptin *sqlx.Stmt `query:"get-lists-by-optin"`
-	UpdateList      *sqlx.Stmt `query:"update-list"`
-	UpdateListsDate *sqlx.Stmt `query:"update-lists-date"`
-	DeleteLists     *sqlx.Stmt `query:"delete-lists"`
+	CreateList         *sqlx.Stmt `query:"create-list"`
+	GetLists           *sqlx.Stmt `query:"get-lists"`
+	GetListsByOptin    *sqlx.Stmt `query:"get-lists-by-optin"`
+	UpdateList         *sqlx.Stmt `query:"update-list"`
+	UpdateListsDate    *sqlx.Stmt `query:"update-lists-date"`
+	DeleteLists        *sqlx.Stmt `query:"delete-lists"`
+	GetListAddresses   *sqlx.Stmt `query:"get-list-addresses"`
+	GetListsMessengers *sqlx.Stmt `query:"get-lists-messengers"`
 
 	CreateCampaign           *sqlx.Stmt `query:"create-campaign"`
+	CreateCampaignOccurrence *sqlx.Stmt `query:"create-campaign-occurrence"`
+	DuplicateCampaign        *sqlx.Stmt `query:"duplicate-campaign"`
 	QueryCampaigns           *sqlx.Stmt `query:"query-campaigns"`
 	GetCampaign              *sqlx.Stmt `query:"get-campaign"`
 	GetCampaignForPreview    *sqlx.Stmt `query:"get-campaign-for-preview"`
+	GetCampaignSendWindows   *sqlx.Stmt `query:"get-campaign-send-windows"`
+	GetCampaignLocalSend     *sqlx.Stmt `query:"get-campaign-local-send-buckets"`
+	HoldCampaignRollout      *sqlx.Stmt `query:"hold-campaign-rollout"`
+	HaltCampaignRollout      *sqlx.Stmt `query:"halt-campaign-rollout"`
+	HaltCampaignTrickle      *sqlx.Stmt `query:"halt-campaign-trickle"`
+	GetTricklingRollouts     *sqlx.Stmt `query:"get-trickling-rollouts"`
+	SetRolloutReason         *sqlx.Stmt `query:"set-campaign-rollout-reason"`
+	GetHeldABTests           *sqlx.Stmt `query:"get-held-ab-tests"`
+	GetCampaignABMetrics     *sqlx.Stmt `query:"get-campaign-ab-metrics"`
+	SetCampaignABWinner      *sqlx.Stmt `query:"set-campaign-ab-winner"`
+	GetHeldCampaignRollouts  *sqlx.Stmt `query:"get-held-campaign-rollouts"`
+	GetCampaignRollout       *sqlx.Stmt `query:"get-campaign-rollout-metrics"`
+	GetCampaignLangs         *sqlx.Stmt `query:"get-campaign-langs"`
 	GetCampaignStats         *sqlx.Stmt `query:"get-campaign-stats"`
+	GetCampaignLangStats     *sqlx.Stmt `query:"get-campaign-lang-stats"`
+	GetCampaignAnalytics     *sqlx.Stmt `query:"get-campaign-analytics"`
+	GetCampaignQueue         *sqlx.Stmt `query:"get-campaign-queue"`
 	GetCampaignStatus        *sqlx.Stmt `query:"get-campaign-status"`
 	NextCampaigns            *sqlx.Stmt `query:"next-campaigns"`
 	NextCampaignSubscribers  *sqlx.Stmt `query:"next-campaign-subscribers"`
+	CheckpointCampaign       *sqlx.Stmt `query:"checkpoint-campaign"`
+	ResumeCampaign           *sqlx.Stmt `query:"resume-campaign"`
 	GetOneCampaignSubscriber *sqlx.Stmt `query:"get-one-campaign-subscriber"`
 	UpdateCampaign           *sqlx.Stmt `query:"update-campaign"`
 	UpdateCampaignStatus     *sqlx.Stmt `query:"update-campaign-status"`
+	RequestCampaignApproval  *sqlx.Stmt `query:"request-campaign-approval"`
+	ReviewCampaign           *sqlx.Stmt `query:"review-campaign"`
 	UpdateCampaignCounts     *sqlx.Stmt `query:"update-campaign-counts"`
 	RegisterCampaignView     *sqlx.Stmt `query:"register-campaign-view"`
+	RegisterConversion       *sqlx.Stmt `query:"register-conversion"`
+	InsertBounce             *sqlx.Stmt `query:"insert-bounce"`
+	InsertReply              *sqlx.Stmt `query:"insert-reply"`
+	InsertCampaignFailures   *sqlx.Stmt `query:"insert-campaign-failures"`
+	InsertCampaignDeliveries *sqlx.Stmt `query:"insert-campaign-deliveries"`
+	GetCampaignFailureCounts *sqlx.Stmt `query:"get-campaign-failure-counts"`
+	ClearCampaignSnapshot    *sqlx.Stmt `query:"clear-campaign-snapshot"`
+	SetCampaignSimulate      *sqlx.Stmt `query:"set-campaign-simulate"`
+	SetCampaignAbortReason   *sqlx.Stmt `query:"set-campaign-abort-reason"`
+	RecordRenderErrors       *sqlx.Stmt `query:"record-campaign-render-errors"`
 	DeleteCampaign           *sqlx.Stmt `query:"delete-campaign"`
 
+	SetCampaignExclusions            *sqlx.Stmt `query:"set-campaign-exclusions"`
+	DeleteCampaignSegmentExclusions  *sqlx.Stmt `query:"delete-campaign-segment-exclusions"`
+	AddCampaignSegmentExclusions     string     `query:"add-campaign-segment-exclusions"`
+	GetCampaignSegments              *sqlx.Stmt `query:"get-campaign-segments"`
+	SetCampaignSegments              *sqlx.Stmt `query:"set-campaign-segments"`
+	DeleteCampaignSegmentSubscribers *sqlx.Stmt `query:"delete-campaign-segment-subscribers"`
+	AddCampaignSegmentSubscribers    string     `query:"add-campaign-segment-subscribers"`
+	GetCampaignRecipientCounts       *sqlx.Stmt `query:"get-campaign-recipient-counts"`
+
 	InsertMedia *sqlx.Stmt `query:"insert-media"`
 	GetMedia    *sqlx.Stmt `query:"get-media"`
 	DeleteMedia *sqlx.Stmt `query:"delete-media"`
 
+	GetMediaMigration *sqlx.Stmt `query:"get-media-migration"`
+	SaveMigratedMedia *sqlx.Stmt `query:"save-migrated-media"`
+	RewriteMediaURLs  *sqlx.Stmt `query:"rewrite-media-urls"`
+
+	GetSegments             *sqlx.Stmt `query:"get-segments"`
+	CreateSegment           *sqlx.Stmt `query:"create-segment"`
+	UpdateSegment           *sqlx.Stmt `query:"update-segment"`
+	DeleteSegment           *sqlx.Stmt `query:"delete-segment"`
+	CountSegmentSubscribers string     `query:"count-segment-subscribers"`
+
+	GetAttribIndexes        *sqlx.Stmt `query:"get-attrib-indexes"`
+	GetReadyAttribIndexes   *sqlx.Stmt `query:"get-ready-attrib-indexes"`
+	UpsertAttribIndex       *sqlx.Stmt `query:"upsert-attrib-index"`
+	UpdateAttribIndexStatus *sqlx.Stmt `query:"update-attrib-index-status"`
+	DropAttribIndex         *sqlx.Stmt `query:"drop-attrib-index"`
+	DeleteAttribIndex       *sqlx.Stmt `query:"delete-attrib-index"`
+	GetInvalidIndex         *sqlx.Stmt `query:"get-invalid-index"`
+	CreateAttribIndex       string     `query:"create-attrib-index"`
+	DropIndex               string     `query:"drop-index"`
+
+	GetListRules              *sqlx.Stmt `query:"get-list-rules"`
+	CreateListRule            *sqlx.Stmt `query:"create-list-rule"`
+	UpdateListRule            *sqlx.Stmt `query:"update-list-rule"`
+	DeleteListRule            *sqlx.Stmt `query:"delete-list-rule"`
+	AddListRuleSubscribers    string     `query:"add-list-rule-subscribers"`
+	RemoveListRuleSubscribers string     `query:"remove-list-rule-subscribers"`
+	CountListRuleSubscribers  string     `query:"count-list-rule-subscribers"`
+
+	GetWelcomeSteps       *sqlx.Stmt `query:"get-welcome-steps"`
+	DeleteWelcomeSteps    *sqlx.Stmt `query:"delete-welcome-steps"`
+	InsertWelcomeStep     *sqlx.Stmt `query:"insert-welcome-step"`
+	QueueWelcomeMessages  *sqlx.Stmt `query:"queue-welcome-messages"`
+	NextWelcomeMessages   *sqlx.Stmt `query:"next-welcome-messages"`
+	DeleteWelcomeMessages *sqlx.Stmt `query:"delete-welcome-messages"`
+
+	GetArchiveList       *sqlx.Stmt `query:"get-archive-list"`
+	GetArchivedCampaigns *sqlx.Stmt `query:"get-archived-campaigns"`
+
+	GetSequences              *sqlx.Stmt `query:"get-sequences"`
+	CreateSequence            *sqlx.Stmt `query:"create-sequence"`
+	UpdateSequence            *sqlx.Stmt `query:"update-sequence"`
+	DeleteSequence            *sqlx.Stmt `query:"delete-sequence"`
+	DeleteSequenceSteps       *sqlx.Stmt `query:"delete-sequence-steps"`
+	InsertSequenceStep        *sqlx.Stmt `query:"insert-sequence-step"`
+	GetSequenceSubscribers    *sqlx.Stmt `query:"get-sequence-subscribers"`
+	EnrollSequenceSubscribers *sqlx.Stmt `query:"enroll-sequence-subscribers"`
+	NextSequenceMessages      *sqlx.Stmt `query:"next-sequence-messages"`
+	AdvanceSequenceSubscriber *sqlx.Stmt `query:"advance-sequence-subscriber"`
+
+	ReengageWinbacks      *sqlx.Stmt `query:"reengage-winbacks"`
+	NextWinbackMessages   *sqlx.Stmt `query:"next-winback-messages"`
+	DeleteExpiredWinbacks *sqlx.Stmt `query:"delete-expired-winbacks"`
+
 	CreateTemplate     *sqlx.Stmt `query:"create-template"`
 	GetTemplates       *sqlx.Stmt `query:"get-templates"`
 	UpdateTemplate     *sqlx.Stmt `query:"update-template"`
 	SetDefaultTemplate *sqlx.Stmt `query:"set-default-template"`
 	DeleteTemplate     *sqlx.Stmt `query:"delete-template"`
 
-	CreateLink        *sqlx.Stmt `query:"create-link"`
-	RegisterLinkClick *sqlx.Stmt `query:"register-link-click"`
+	CreateLink                *sqlx.Stmt `query:"create-link"`
+	RegisterLinkClick         *sqlx.Stmt `query:"register-link-click"`
+	RegisterProviderLinkClick *sqlx.Stmt `query:"register-provider-link-click"`
+	GetLinkURL                *sqlx.Stmt `query:"get-link-url"`
+	GetTrackingEvent          *sqlx.Stmt `query:"get-tracking-event"`
+	CreateShortLink           *sqlx.Stmt `query:"create-short-link"`
+	RegisterShortLinkClick    *sqlx.Stmt `query:"register-short-link-click"`
+	GetShortLinkURL           *sqlx.Stmt `query:"get-short-link-url"`
+	GetCampaignShortLinks     *sqlx.Stmt `query:"get-campaign-short-links"`
+
+	PurgeCampaignViews *sqlx.Stmt `query:"purge-campaign-views"`
+	PurgeLinkClicks    *sqlx.Stmt `query:"purge-link-clicks"`
+
+	InsertRenderedMessage *sqlx.Stmt `query:"insert-rendered-message"`
+	QueryRenderedMessages *sqlx.Stmt `query:"query-rendered-messages"`
+	PurgeRenderedMessages *sqlx.Stmt `query:"purge-rendered-messages"`
+
+	CreateJob         *sqlx.Stmt `query:"create-job"`
+	GetJob            *sqlx.Stmt `query:"get-job"`
+	QueryJobs         *sqlx.Stmt `query:"query-jobs"`
+	ClaimJob          *sqlx.Stmt `query:"claim-job"`
+	UpdateJobProgress *sqlx.Stmt `query:"update-job-progress"`
+	FinishJob         *sqlx.Stmt `query:"finish-job"`
+	CancelJob         *sqlx.Stmt `query:"cancel-job"`
+	RecoverJobs       *sqlx.Stmt `query:"recover-jobs"`
+
+	QueueWebhookDeliveries    *sqlx.Stmt `query:"queue-webhook-deliveries"`
+	ClaimWebhookDeliveries    *sqlx.Stmt `query:"claim-webhook-deliveries"`
+	DeleteWebhookDelivery     *sqlx.Stmt `query:"delete-webhook-delivery"`
+	RetryWebhookDelivery      *sqlx.Stmt `query:"retry-webhook-delivery"`
+	DeadLetterWebhookDelivery *sqlx.Stmt `query:"dead-letter-webhook-delivery"`
+	QueryWebhookDeadLetters   *sqlx.Stmt `query:"query-webhook-dead-letters"`
+	GetWebhookDeadLetter      *sqlx.Stmt `query:"get-webhook-dead-letter"`
+	ReplayWebhookDeadLetters  *sqlx.Stmt `query:"replay-webhook-dead-letters"`
+	DeleteWebhookDeadLetters  *sqlx.Stmt `query:"delete-webhook-dead-letters"`
+
+	ExportSubscribers     string     `query:"export-subscribers"`
+	ExportCampaigns       string     `query:"export-campaigns"`
+	ExportIDRange         string     `query:"export-id-range"`
+	ExportSnapshot        string     `query:"export-snapshot"`
+	SetExportSnapshot     string     `query:"set-export-snapshot"`
+	InsertExportFile      *sqlx.Stmt `query:"insert-export-file"`
+	GetExpiredExportFiles *sqlx.Stmt `query:"get-expired-export-files"`
+	DeleteExportFile      *sqlx.Stmt `query:"delete-export-file"`
+
+	GetUsers       *sqlx.Stmt `query:"get-users"`
+	GetUserByEmail *sqlx.Stmt `query:"get-user-by-email"`
+	CountUsers     *sqlx.Stmt `query:"count-users"`
+	CreateUser     *sqlx.Stmt `query:"create-user"`
+	UpdateUser     *sqlx.Stmt `query:"update-user"`
+	DeleteUser     *sqlx.Stmt `query:"delete-user"`
 
 	// GetStats *sqlx.Stmt `query:"get-stats"`
 }
@@ -89,10 +247,30 @@ type dbConf struct {
 	SSLMode  string `koanf:"ssl_mode"`
 	MaxOpen  int    `koanf:"max_open"`
 	MaxIdle  int    `koanf:"max_idle"`
+
+	// Maximum time a connection is reused for and can be idle for.
+	// 0 is unlimited.
+	MaxLifetime time.Duration `koanf:"max_lifetime"`
+	MaxIdleTime time.Duration `koanf:"max_idle_time"`
+}
+
+// validate validates the connection pool settings.
+func (c dbConf) validate() error {
+	if c.MaxOpen < 0 || c.MaxIdle < 0 || c.MaxLifetime < 0 || c.MaxIdleTime < 0 {
+		return errors.New("db.max_open, max_idle, max_lifetime, and max_idle_time should be >= 0")
+	}
+	if c.MaxOpen > 0 && c.MaxIdle > c.MaxOpen {
+		return fmt.Errorf("db.max_idle (%d) should not be higher than db.max_open (%d)", c.MaxIdle, c.MaxOpen)
+	}
+	return nil
 }
 
 // connectDB initializes a database connection.
 func connectDB(c dbConf) (*sqlx.DB, error) {
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+
 	db, err := sqlx.Connect("postgres",
 		fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s",
 			c.Host, c.Port, c.User, c.Password, c.DBName, c.SSLMode))
@@ -101,6 +279,8 @@ func connectDB(c dbConf) (*sqlx.DB, error) {
 	}
 	db.SetMaxOpenConns(c.MaxOpen)
 	db.SetMaxIdleConns(c.MaxIdle)
+	db.SetConnMaxLifetime(c.MaxLifetime)
+	db.SetConnMaxIdleTime(c.MaxIdleTime)
 	return db, nil
 }
 
@@ -128,6 +308,31 @@ func (q *Queries) compileSubscriberQueryTpl(exp string, db *sqlx.DB) (string, er
 	return stmt, nil
 }
 
+// selectSubscriberIDsByQuery takes an arbitrary WHERE expression and returns
+// the IDs of the subscribers that match it.
+func (q *Queries) selectSubscriberIDsByQuery(exp string, listIDs []int64, db *sqlx.DB) ([]int64, error) {
+	stmt, err := q.compileSubscriberQueryTpl(exp, db)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(listIDs) == 0 {
+		listIDs = pq.Int64Array{}
+	}
+
+	tx, err := db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var out []int64
+	if err := tx.Select(&out, stmt, false, pq.Int64Array(listIDs)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // compileSubscriberQueryTpl takes a arbitrary WHERE expressions and a subscriber
 // query template that depends on the filter (eg: delete by query, blacklist by query etc.)
 // combines and executes them.
@@ -149,3 +354,18 @@ func (q *Queries) execSubscriberQueryTpl(exp, tpl string, listIDs []int64, db *s
 
 	return nil
 }
+
+// selectSubscriberQueryTpl is execSubscriberQueryTpl for the templates that
+// return rows, which are scanned into dest.
+func (q *Queries) selectSubscriberQueryTpl(dest interface{}, exp, tpl string, listIDs []int64, db *sqlx.DB, args ...interface{}) error {
+	filterExp, err := q.compileSubscriberQueryTpl(exp, db)
+	if err != nil {
+		return err
+	}
+
+	if len(listIDs) == 0 {
+		listIDs = pq.Int64Array{}
+	}
+	a := append([]interface{}{false, pq.Int64Array(listIDs)}, args...)
+	return db.Select(dest, fmt.Sprintf(tpl, filterExp), a...)
+}
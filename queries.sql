@@ -11,6 +11,10 @@ SELECT exists (SELECT true FROM subscribers WHERE CASE WHEN $1 > 0 THEN id = $1
 -- Get subscribers by emails.
 SELECT * FROM subscribers WHERE email=ANY($1);
 
+-- name: get-subscribers-by-ids
+-- Get subscribers by IDs or UUIDs.
+SELECT * FROM subscribers WHERE id = ANY($1::INT[]) OR uuid = ANY($2::UUID[]) ORDER BY id;
+
 -- name: get-subscriber-lists
 WITH sub AS (
     SELECT id FROM subscribers WHERE CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END
@@ -35,7 +39,20 @@ SELECT * FROM lists
 WITH subs AS (
     SELECT subscriber_id, JSON_AGG(
         ROW_TO_JSON(
-            (SELECT l FROM (SELECT subscriber_lists.status AS subscription_status, lists.*) l)
+            (SELECT l FROM (SELECT subscriber_lists.status AS subscription_status,
+                COALESCE(subscriber_lists.subscribed_at, subscriber_lists.created_at) AS subscribed_at,
+                subscriber_lists.confirmed_at,
+                COALESCE(subscriber_lists.unsubscribed_at,
+                    (CASE WHEN subscriber_lists.status = 'unsubscribed' THEN subscriber_lists.updated_at END)) AS unsubscribed_at,
+                (CASE WHEN subscriber_lists.consent_at IS NOT NULL THEN JSON_BUILD_OBJECT(
+                    'source', subscriber_lists.consent_source, 'ip', subscriber_lists.consent_ip,
+                    'user_agent', subscriber_lists.consent_user_agent, 'created_at', subscriber_lists.consent_at,
+                    'confirm_ip', subscriber_lists.confirm_ip, 'confirm_user_agent', subscriber_lists.confirm_user_agent)
+                END) AS consent,
+                -- Unsubscriptions that are paused for win-back until they're removed.
+                (SELECT remove_at FROM list_winbacks WHERE list_winbacks.subscriber_id = subscriber_lists.subscriber_id
+                    AND list_winbacks.list_id = subscriber_lists.list_id) AS paused_until,
+                lists.*) l)
         )
     ) AS lists FROM lists
     LEFT JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id)
@@ -49,6 +66,8 @@ SELECT id as subscriber_id,
     ORDER BY ARRAY_POSITION($1, id);
 
 -- name: insert-subscriber
+-- The subscriptions get the consent record of the request ($8 source,
+-- $9 IP, $10 user agent) if there is one.
 WITH sub AS (
     INSERT INTO subscribers (uuid, email, name, status, attribs)
     VALUES($1, $2, $3, $4, $5)
@@ -60,11 +79,13 @@ listIDs AS (
               ELSE uuid=ANY($7::UUID[]) END)
 ),
 subs AS (
-    INSERT INTO subscriber_lists (subscriber_id, list_id, status)
+    INSERT INTO subscriber_lists (subscriber_id, list_id, status,
+        consent_source, consent_ip, consent_user_agent, consent_at)
     VALUES(
         (SELECT id FROM sub),
         UNNEST(ARRAY(SELECT id FROM listIDs)),
-        (CASE WHEN $4='blacklisted' THEN 'unsubscribed'::subscription_status ELSE 'unconfirmed' END)
+        (CASE WHEN $4='blacklisted' THEN 'unsubscribed'::subscription_status ELSE 'unconfirmed' END),
+        $8, $9, $10, (CASE WHEN $9 != '' THEN NOW() END)
     )
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
     SET updated_at=NOW()
@@ -72,17 +93,27 @@ subs AS (
 SELECT id from sub;
 
 -- name: upsert-subscriber
--- Upserts a subscriber where existing subscribers get their names and attributes overwritten.
--- If $6 = true, update values, otherwise, skip.
+-- Upserts a subscriber matched by the lowercased e-mail. $6 is the policy for
+-- existing subscribers: 'overwrite' replaces their name and attributes, 'merge'
+-- replaces the name and merges the attributes (the new keys taking precedence),
+-- and 'skip' leaves them untouched. If $7 = 'replace', the subscriber's
+-- subscriptions to lists not in $5 are removed, otherwise, they're retained.
+-- Returns whether the subscriber was inserted.
 WITH sub AS (
     INSERT INTO subscribers as s (uuid, email, name, attribs)
-    VALUES($1, $2, $3, $4)
-    ON CONFLICT (email)
+    VALUES($1, LOWER(TRIM($2)), $3, $4)
+    ON CONFLICT ((LOWER(email)))
     DO UPDATE SET
-        name=(CASE WHEN $6 THEN $3 ELSE s.name END),
-        attribs=(CASE WHEN $6 THEN $4 ELSE s.attribs END),
-        updated_at=NOW()
-    RETURNING uuid, id
+        name=(CASE WHEN $6 IN ('overwrite', 'merge') THEN $3 ELSE s.name END),
+        attribs=(CASE $6 WHEN 'overwrite' THEN $4::JSONB
+            WHEN 'merge' THEN s.attribs || $4::JSONB
+            ELSE s.attribs END),
+        updated_at=(CASE WHEN $6 IN ('overwrite', 'merge') THEN NOW() ELSE s.updated_at END)
+    RETURNING id, (xmax = 0) AS inserted
+),
+d AS (
+    DELETE FROM subscriber_lists WHERE $7 = 'replace' AND
+        subscriber_id = (SELECT id FROM sub) AND list_id != ALL($5::INT[])
 ),
 subs AS (
     INSERT INTO subscriber_lists (subscriber_id, list_id)
@@ -90,21 +121,106 @@ subs AS (
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
     SET updated_at=NOW()
 )
-SELECT uuid, id from sub;
+SELECT inserted FROM sub;
 
 -- name: upsert-blacklist-subscriber
 -- Upserts a subscriber where the update will only set the status to blacklisted
 -- unlike upsert-subscribers where name and attributes are updated. In addition, all
--- existing subscriptions are marked as 'unsubscribed'.
+-- existing subscriptions are marked as 'unsubscribed'. Returns the UUID of the
+-- subscriber if it existed and wasn't blacklisted.
 -- This is used in the bulk importer.
-WITH sub AS (
+WITH prev AS (
+    SELECT id FROM subscribers WHERE LOWER(email) = LOWER($2) AND status != 'blacklisted'
+),
+sub AS (
     INSERT INTO subscribers (uuid, email, name, attribs, status)
     VALUES($1, $2, $3, $4, 'blacklisted')
-    ON CONFLICT (email) DO UPDATE SET status='blacklisted', updated_at=NOW()
-    RETURNING id
+    ON CONFLICT ((LOWER(email))) DO UPDATE SET status='blacklisted', updated_at=NOW()
+    RETURNING id, uuid
+),
+subs AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW(),
+        unsubscribed_at=COALESCE(unsubscribed_at, NOW())
+    WHERE subscriber_id = (SELECT id FROM sub)
+)
+SELECT uuid FROM sub WHERE id IN (SELECT id FROM prev);
+
+-- name: upsert-subscribers
+-- Multi-row version of upsert-subscriber used by the bulk importer. It takes
+-- parallel arrays of UUIDs, e-mails, names, and attributes, one element per
+-- subscriber. Duplicate e-mails within a batch are collapsed, the last one
+-- taking precedence, as ON CONFLICT cannot update the same row twice.
+-- $6 and $7 are the policies described in upsert-subscriber.
+-- Returns the number of inserted and existing subscribers.
+WITH input AS (
+    SELECT DISTINCT ON (LOWER(TRIM(email))) uuid, LOWER(TRIM(email)) AS email, name, attribs FROM
+        UNNEST($1::UUID[], $2::TEXT[], $3::TEXT[], $4::JSONB[]) WITH ORDINALITY AS t(uuid, email, name, attribs, n)
+    ORDER BY LOWER(TRIM(email)), n DESC
+),
+sub AS (
+    INSERT INTO subscribers as s (uuid, email, name, attribs)
+    SELECT uuid, email, name, attribs FROM input
+    ON CONFLICT ((LOWER(email)))
+    DO UPDATE SET
+        name=(CASE WHEN $6 IN ('overwrite', 'merge') THEN EXCLUDED.name ELSE s.name END),
+        attribs=(CASE $6 WHEN 'overwrite' THEN EXCLUDED.attribs
+            WHEN 'merge' THEN s.attribs || EXCLUDED.attribs
+            ELSE s.attribs END),
+        updated_at=(CASE WHEN $6 IN ('overwrite', 'merge') THEN NOW() ELSE s.updated_at END)
+    RETURNING id, (xmax = 0) AS inserted
+),
+d AS (
+    DELETE FROM subscriber_lists WHERE $7 = 'replace' AND
+        subscriber_id = ANY(SELECT id FROM sub) AND list_id != ALL($5::INT[])
+),
+subs AS (
+    INSERT INTO subscriber_lists (subscriber_id, list_id)
+    (SELECT a.id, b FROM sub a, UNNEST($5::INT[]) b)
+    ON CONFLICT (subscriber_id, list_id) DO UPDATE
+    SET updated_at=NOW()
 )
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE subscriber_id = (SELECT id FROM sub);
+SELECT COUNT(*) FILTER (WHERE inserted), COUNT(*) FILTER (WHERE NOT inserted) FROM sub;
+
+-- name: upsert-blacklist-subscribers
+-- Multi-row version of upsert-blacklist-subscriber used by the bulk importer.
+WITH input AS (
+    SELECT DISTINCT ON (email) uuid, email, name, attribs FROM
+        UNNEST($1::UUID[], $2::TEXT[], $3::TEXT[], $4::JSONB[]) WITH ORDINALITY AS t(uuid, email, name, attribs, n)
+    ORDER BY email, n DESC
+),
+prev AS (
+    SELECT id FROM subscribers WHERE LOWER(email) = ANY(SELECT LOWER(email) FROM input)
+        AND status != 'blacklisted'
+),
+sub AS (
+    INSERT INTO subscribers (uuid, email, name, attribs, status)
+    SELECT uuid, email, name, attribs, 'blacklisted' FROM input
+    ON CONFLICT ((LOWER(email))) DO UPDATE SET status='blacklisted', updated_at=NOW()
+    RETURNING id, uuid
+),
+subs AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW(),
+        unsubscribed_at=COALESCE(unsubscribed_at, NOW())
+    WHERE subscriber_id = ANY(SELECT id FROM sub)
+)
+SELECT uuid FROM sub WHERE id IN (SELECT id FROM prev);
+
+-- name: get-suppressed-subscribers
+-- Returns the subscribers among the lowercased e-mails $1 that shouldn't be
+-- re-added by imports to the lists $2 and why: they're blacklisted, they've
+-- reported a message as spam, or they've unsubscribed from one of the lists.
+-- Used by the bulk importer.
+SELECT email, reason FROM (
+    SELECT LOWER(s.email) AS email,
+        (CASE WHEN s.status = 'blacklisted' THEN 'blacklisted'
+            WHEN EXISTS (SELECT 1 FROM bounces WHERE subscriber_id = s.id AND type = 'complaint')
+                THEN 'complaint'
+            WHEN EXISTS (SELECT 1 FROM subscriber_lists WHERE subscriber_id = s.id
+                AND list_id = ANY($2::INT[]) AND status = 'unsubscribed')
+                THEN 'unsubscribed'
+        END) AS reason
+    FROM subscribers s WHERE LOWER(s.email) = ANY($1::TEXT[])
+) t WHERE reason IS NOT NULL;
 
 -- name: update-subscriber
 -- Updates a subscriber's data, and given a list of list_ids, inserts subscriptions
@@ -128,19 +244,81 @@ INSERT INTO subscriber_lists (subscriber_id, list_id, status)
         (CASE WHEN $4='blacklisted' THEN 'unsubscribed'::subscription_status ELSE 'unconfirmed' END)
     )
     ON CONFLICT (subscriber_id, list_id) DO UPDATE
-    SET status = (CASE WHEN $4='blacklisted' THEN 'unsubscribed'::subscription_status ELSE subscriber_lists.status END);
+    SET status = (CASE WHEN $4='blacklisted' THEN 'unsubscribed'::subscription_status ELSE subscriber_lists.status END),
+        unsubscribed_at = (CASE WHEN $4='blacklisted' THEN COALESCE(subscriber_lists.unsubscribed_at, NOW())
+            ELSE subscriber_lists.unsubscribed_at END);
 
 -- name: delete-subscribers
--- Delete one or more subscribers by ID or UUID.
-DELETE FROM subscribers WHERE CASE WHEN ARRAY_LENGTH($1::INT[], 1) > 0 THEN id = ANY($1) ELSE uuid = ANY($2::UUID[]) END;
+-- Delete one or more subscribers by ID and record the deletions in the audit log.
+-- $2 = source of the deletion, $3 = history (anonymize, delete).
+WITH d AS (
+    DELETE FROM subscribers WHERE id = ANY($1::INT[]) RETURNING uuid
+)
+INSERT INTO subscriber_deletions (subscriber_uuid, source, history)
+    SELECT uuid, $2, $3 FROM d
+    RETURNING subscriber_uuid;
+
+-- name: delete-subscriber-history
+-- Delete the campaign views, link clicks, conversions, unsubscribe reasons, and replies of subscribers.
+WITH v AS (
+    DELETE FROM campaign_views WHERE subscriber_id = ANY($1::INT[])
+),
+rp AS (
+    DELETE FROM replies WHERE subscriber_id = ANY($1::INT[])
+),
+c AS (
+    DELETE FROM link_clicks WHERE subscriber_id = ANY($1::INT[])
+),
+r AS (
+    DELETE FROM unsubscribe_reasons WHERE subscriber_id = ANY($1::INT[])
+)
+DELETE FROM conversions WHERE subscriber_id = ANY($1::INT[]);
+
+-- name: get-unsubscribe-reasons
+-- The number of unsubscriptions by reason, optionally filtered by
+-- a list ($1) and/or a campaign ($2).
+SELECT reason, COUNT(*) AS count FROM unsubscribe_reasons
+    WHERE ($1 = 0 OR $1 = ANY(list_ids)) AND ($2 = 0 OR campaign_id = $2)
+    GROUP BY reason ORDER BY count DESC, reason;
+
+-- name: get-subscriber-deletions
+-- Get the audit log of deleted subscribers, optionally filtered by UUID.
+SELECT COUNT(*) OVER () AS total, subscriber_deletions.* FROM subscriber_deletions
+    WHERE ($1 = '' OR subscriber_uuid = NULLIF($1, '')::UUID)
+    ORDER BY id DESC
+    OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END);
+
+-- name: get-subscriptions-without-consent
+-- Subscriptions that aren't unsubscribed and lack consent records, optionally
+-- on a list ($1): ones that weren't made on a public form and double opt-in
+-- ones that weren't confirmed by the subscriber, eg: imported or added by admins.
+SELECT COUNT(*) OVER () AS total, subscribers.id AS subscriber_id, subscribers.uuid AS subscriber_uuid,
+    subscribers.email, lists.id AS list_id, lists.name AS list_name, subscriber_lists.status AS subscription_status,
+    COALESCE(subscriber_lists.subscribed_at, subscriber_lists.created_at) AS subscribed_at,
+    subscriber_lists.consent_at IS NULL AS missing_consent,
+    (lists.optin = 'double' AND subscriber_lists.status = 'confirmed' AND subscriber_lists.confirm_ip = '') AS missing_confirmation
+    FROM subscriber_lists
+    INNER JOIN subscribers ON (subscribers.id = subscriber_lists.subscriber_id)
+    INNER JOIN lists ON (lists.id = subscriber_lists.list_id)
+    WHERE subscriber_lists.status != 'unsubscribed' AND ($1 = 0 OR subscriber_lists.list_id = $1)
+    AND (subscriber_lists.consent_at IS NULL OR
+        (lists.optin = 'double' AND subscriber_lists.status = 'confirmed' AND subscriber_lists.confirm_ip = ''))
+    ORDER BY subscriber_lists.subscriber_id, subscriber_lists.list_id
+    OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END);
 
 -- name: blacklist-subscribers
+-- Returns the IDs of the subscribers that weren't blacklisted.
 WITH b AS (
     UPDATE subscribers SET status='blacklisted', updated_at=NOW()
-    WHERE id = ANY($1::INT[])
+    WHERE id = ANY($1::INT[]) AND status != 'blacklisted'
+    RETURNING id
+),
+subs AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW(),
+        unsubscribed_at=COALESCE(unsubscribed_at, NOW())
+    WHERE subscriber_id = ANY($1::INT[])
 )
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE subscriber_id = ANY($1::INT[]);
+SELECT id FROM b;
 
 -- name: add-subscribers-to-lists
 INSERT INTO subscriber_lists (subscriber_id, list_id)
@@ -152,39 +330,219 @@ DELETE FROM subscriber_lists
     WHERE (subscriber_id, list_id) = ANY(SELECT a, b FROM UNNEST($1::INT[]) a, UNNEST($2::INT[]) b);
 
 -- name: confirm-subscription-optin
+-- Confirms subscriptions and records the IP ($3) and the user agent ($4)
+-- of the first confirmation. Returns the number of subscriptions that
+-- weren't confirmed.
 WITH subID AS (
     SELECT id FROM subscribers WHERE uuid = $1::UUID
 ),
 listIDs AS (
     SELECT id FROM lists WHERE uuid = ANY($2::UUID[])
+),
+prev AS (
+    SELECT list_id FROM subscriber_lists WHERE subscriber_id = (SELECT id FROM subID)
+        AND list_id = ANY(SELECT id FROM listIDs) AND status != 'confirmed'
+),
+u AS (
+    UPDATE subscriber_lists SET status='confirmed', updated_at=NOW(), confirmed_at=COALESCE(confirmed_at, NOW()),
+        confirm_ip=(CASE WHEN confirm_ip = '' THEN $3 ELSE confirm_ip END),
+        confirm_user_agent=(CASE WHEN confirm_ip = '' THEN $4 ELSE confirm_user_agent END)
+    WHERE subscriber_id = (SELECT id FROM subID) AND list_id = ANY(SELECT id FROM listIDs)
 )
-UPDATE subscriber_lists SET status='confirmed', updated_at=NOW()
-    WHERE subscriber_id = (SELECT id FROM subID) AND list_id = ANY(SELECT id FROM listIDs);
+SELECT COUNT(*) FROM prev;
 
 -- name: unsubscribe-subscribers-from-lists
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE (subscriber_id, list_id) = ANY(SELECT a, b FROM UNNEST($1::INT[]) a, UNNEST($2::INT[]) b);
+-- Returns the IDs of the subscribers that were unsubscribed from any of the lists.
+WITH u AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW(),
+        unsubscribed_at=COALESCE(unsubscribed_at, NOW())
+    WHERE (subscriber_id, list_id) = ANY(SELECT a, b FROM UNNEST($1::INT[]) a, UNNEST($2::INT[]) b)
+        AND status != 'unsubscribed'
+    RETURNING subscriber_id
+)
+SELECT DISTINCT subscriber_id FROM u;
 
 -- name: unsubscribe
--- Unsubscribes a subscriber given a campaign UUID (from all the lists in the campaign) and the subscriber UUID.
+-- Unsubscribes a subscriber given a campaign UUID (from all the lists in the campaign)
+-- or a list UUID (from the list, for welcome messages) and the subscriber UUID.
 -- If $3 is TRUE, then all subscriptions of the subscriber is blacklisted
 -- and all existing subscriptions, irrespective of lists, unsubscribed.
-WITH lists AS (
+-- The reason ($4) and the comment ($5) are recorded if any lists were unsubscribed from.
+-- If $6 is TRUE, the unsubscriptions from lists with a win-back grace period
+-- are paused, otherwise they're immediate and remove paused unsubscriptions.
+WITH listIDs AS (
     SELECT list_id FROM campaign_lists
     LEFT JOIN campaigns ON (campaign_lists.campaign_id = campaigns.id)
     WHERE campaigns.uuid = $1
+    UNION SELECT id FROM lists WHERE uuid = $1
 ),
 sub AS (
     UPDATE subscribers SET status = (CASE WHEN $3 IS TRUE THEN 'blacklisted' ELSE status END)
     WHERE uuid = $2 RETURNING id
+),
+subs AS (
+    UPDATE subscriber_lists SET status = 'unsubscribed', updated_at = NOW(), unsubscribed_at = NOW()
+    FROM subscriber_lists prev WHERE
+        prev.subscriber_id = subscriber_lists.subscriber_id AND prev.list_id = subscriber_lists.list_id AND
+        subscriber_lists.subscriber_id = (SELECT id FROM sub) AND subscriber_lists.status != 'unsubscribed' AND
+        -- If $3 is false, unsubscribe from the campaign's lists, otherwise all lists.
+        CASE WHEN $3 IS FALSE THEN subscriber_lists.list_id = ANY(SELECT list_id FROM listIDs) ELSE subscriber_lists.list_id != 0 END
+    RETURNING subscriber_lists.list_id, prev.status
+),
+winbacks AS (
+    INSERT INTO list_winbacks (subscriber_id, list_id, status, remove_at)
+        SELECT (SELECT id FROM sub), subs.list_id, subs.status, NOW() + lists.winback_days * INTERVAL '1 day'
+        FROM subs INNER JOIN lists ON (lists.id = subs.list_id)
+        WHERE $6 IS TRUE AND $3 IS FALSE AND lists.winback_days > 0
+),
+removed AS (
+    DELETE FROM list_winbacks WHERE ($6 IS FALSE OR $3 IS TRUE) AND subscriber_id = (SELECT id FROM sub) AND
+        CASE WHEN $3 IS FALSE THEN list_id = ANY(SELECT list_id FROM listIDs) ELSE TRUE END
+)
+INSERT INTO unsubscribe_reasons (subscriber_id, campaign_id, list_ids, reason, comment)
+    SELECT (SELECT id FROM sub), (SELECT id FROM campaigns WHERE uuid = $1),
+        ARRAY(SELECT list_id FROM subs), $4, $5
+    WHERE EXISTS (SELECT 1 FROM subs);
+
+-- name: reengage-winbacks
+-- Restores the previous statuses of the paused memberships of a subscriber
+-- ($1) on re-engagement, unless they've been changed since or the subscriber
+-- is blacklisted.
+WITH wb AS (
+    DELETE FROM list_winbacks WHERE subscriber_id = (SELECT id FROM subscribers WHERE uuid = $1::UUID)
+    RETURNING subscriber_id, list_id, status, created_at
+)
+UPDATE subscriber_lists SET status = wb.status, unsubscribed_at = NULL, updated_at = NOW()
+    FROM wb WHERE subscriber_lists.subscriber_id = wb.subscriber_id AND subscriber_lists.list_id = wb.list_id
+        AND subscriber_lists.status = 'unsubscribed' AND subscriber_lists.updated_at <= wb.created_at
+        AND (SELECT status FROM subscribers WHERE id = wb.subscriber_id) != 'blacklisted';
+
+-- name: next-winback-messages
+-- Marks up to $1 due win-back messages of paused memberships as sent and
+-- returns them with the default template. Memberships that were changed
+-- since they were paused and blacklisted subscribers are skipped.
+WITH due AS (
+    UPDATE list_winbacks SET sent_at = NOW() WHERE (subscriber_id, list_id) IN (
+        SELECT list_winbacks.subscriber_id, list_winbacks.list_id FROM list_winbacks
+        INNER JOIN lists ON (lists.id = list_winbacks.list_id)
+        WHERE list_winbacks.sent_at IS NULL AND list_winbacks.remove_at > NOW()
+            AND lists.winback_subject != '' AND lists.winback_body != ''
+            AND list_winbacks.created_at + lists.winback_send_days * INTERVAL '1 day' <= NOW()
+        ORDER BY list_winbacks.created_at LIMIT $1 FOR UPDATE OF list_winbacks SKIP LOCKED
+    )
+    RETURNING subscriber_id, list_id, created_at
+)
+SELECT subscribers.*, lists.id AS list_id, lists.uuid AS list_uuid, lists.winback_subject, lists.winback_body,
+    templates.body AS template_body, templates.format AS template_format
+    FROM due
+    INNER JOIN lists ON (lists.id = due.list_id)
+    INNER JOIN subscribers ON (subscribers.id = due.subscriber_id)
+    INNER JOIN subscriber_lists ON (subscriber_lists.subscriber_id = due.subscriber_id AND subscriber_lists.list_id = due.list_id)
+    INNER JOIN templates ON (templates.is_default = true)
+    WHERE subscriber_lists.status = 'unsubscribed' AND subscriber_lists.updated_at <= due.created_at
+        AND subscribers.status != 'blacklisted'
+    ORDER BY lists.id;
+
+-- name: delete-expired-winbacks
+-- Removes the paused memberships whose grace periods have passed, leaving
+-- them unsubscribed.
+DELETE FROM list_winbacks WHERE remove_at <= NOW();
+
+-- name: get-unsubscribe-redirect
+-- Returns the unsubscribe redirect URL of a campaign, or of the first of its lists
+-- (by ID) that has one, given a campaign UUID, or that of a list given a list UUID.
+SELECT COALESCE(NULLIF((SELECT unsubscribe_redirect FROM campaigns WHERE uuid = $1), ''),
+    (SELECT unsubscribe_redirect FROM lists WHERE unsubscribe_redirect != '' AND
+        (uuid = $1 OR id IN (SELECT list_id FROM campaign_lists
+            WHERE campaign_id = (SELECT id FROM campaigns WHERE uuid = $1)))
+        ORDER BY id LIMIT 1), '');
+
+-- name: unsubscribe-by-email
+-- Unsubscribes a subscriber given an e-mail from all lists.
+-- If $2 is TRUE, then the subscriber is also blacklisted.
+WITH sub AS (
+    UPDATE subscribers SET status = (CASE WHEN $2 IS TRUE THEN 'blacklisted' ELSE status END),
+        updated_at = NOW()
+    WHERE LOWER(email) = LOWER($1) RETURNING id, uuid
+),
+subs AS (
+    UPDATE subscriber_lists SET status = 'unsubscribed', updated_at = NOW(), unsubscribed_at = NOW()
+    WHERE subscriber_id = (SELECT id FROM sub) AND status != 'unsubscribed'
 )
-UPDATE subscriber_lists SET status = 'unsubscribed' WHERE
-    subscriber_id = (SELECT id FROM sub) AND status != 'unsubscribed' AND
-    -- If $3 is false, unsubscribe from the campaign's lists, otherwise all lists.
-    CASE WHEN $3 IS FALSE THEN list_id = ANY(SELECT list_id FROM lists) ELSE list_id != 0 END;
+SELECT uuid FROM sub;
+
+-- name: unsubscribe-complaint
+-- Acts on the spam complaint recorded as a bounce ($1): unsubscribes the subscriber
+-- from all lists if $2 is 'unsubscribe', also blacklisting them if it's 'blacklist',
+-- and records the unsubscription with the reason 'complaint'. With 'none', the
+-- subscriber is left as is. unsubscribed is the number of lists unsubscribed from.
+WITH b AS (
+    SELECT subscriber_id, campaign_id FROM bounces WHERE id = $1 AND type = 'complaint'
+),
+sub AS (
+    UPDATE subscribers SET status = (CASE WHEN $2 = 'blacklist' THEN 'blacklisted' ELSE status END),
+        updated_at = NOW()
+    WHERE id = (SELECT subscriber_id FROM b) AND $2 != 'none' RETURNING id
+),
+subs AS (
+    UPDATE subscriber_lists SET status = 'unsubscribed', updated_at = NOW(), unsubscribed_at = NOW()
+    WHERE subscriber_id = (SELECT id FROM sub) AND status != 'unsubscribed'
+    RETURNING list_id
+),
+r AS (
+    INSERT INTO unsubscribe_reasons (subscriber_id, campaign_id, list_ids, reason)
+        SELECT (SELECT id FROM sub), (SELECT campaign_id FROM b), ARRAY(SELECT list_id FROM subs), 'complaint'
+        WHERE EXISTS (SELECT 1 FROM subs)
+)
+SELECT subscribers.id AS subscriber_id, subscribers.uuid AS subscriber_uuid,
+    campaigns.id AS campaign_id, campaigns.name AS campaign_name,
+    (SELECT COUNT(*) FROM subs) AS unsubscribed
+    FROM b
+    INNER JOIN subscribers ON (subscribers.id = b.subscriber_id)
+    LEFT JOIN campaigns ON (campaigns.id = b.campaign_id);
+
+-- name: get-subscriber-activity
+-- Returns the activity timeline of a subscriber, latest first: list
+-- subscriptions, confirmations, and unsubscriptions, campaign views,
+-- link clicks, bounces, and replies.
+WITH subLists AS (
+    SELECT lists.name AS list_name, subscriber_lists.*
+    FROM subscriber_lists
+    LEFT JOIN lists ON (lists.id = subscriber_lists.list_id)
+    WHERE subscriber_lists.subscriber_id = $1
+),
+events AS (
+    SELECT 'subscribed' AS type, COALESCE(subscribed_at, created_at) AS created_at,
+        list_id, list_name, NULL::INT AS campaign_id, NULL AS url
+        FROM subLists
+    UNION ALL
+    SELECT 'confirmed', confirmed_at, list_id, list_name, NULL, NULL
+        FROM subLists WHERE confirmed_at IS NOT NULL
+    UNION ALL
+    SELECT 'unsubscribed', COALESCE(unsubscribed_at, updated_at), list_id, list_name, NULL, NULL
+        FROM subLists WHERE status = 'unsubscribed'
+    UNION ALL
+    SELECT 'view', created_at, NULL, NULL, campaign_id, NULL
+        FROM campaign_views WHERE subscriber_id = $1
+    UNION ALL
+    SELECT 'click', link_clicks.created_at, NULL, NULL, campaign_id, links.url
+        FROM link_clicks LEFT JOIN links ON (links.id = link_clicks.link_id)
+        WHERE subscriber_id = $1
+    UNION ALL
+    SELECT type, created_at, NULL, NULL, campaign_id, NULL
+        FROM bounces WHERE subscriber_id = $1
+    UNION ALL
+    SELECT 'reply', created_at, NULL, NULL, campaign_id, NULL
+        FROM replies WHERE subscriber_id = $1
+)
+SELECT COUNT(*) OVER () AS total, events.*, campaigns.name AS campaign_name FROM events
+    LEFT JOIN campaigns ON (campaigns.id = events.campaign_id)
+    ORDER BY events.created_at DESC OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END);
 
 -- privacy
 -- name: export-subscriber-data
+-- The profile excludes the sequential ID as subscribers can export their
+-- own data publicly.
 WITH prof AS (
     SELECT id, uuid, email, name, attribs, status, created_at, updated_at FROM subscribers WHERE
     CASE WHEN $1 > 0 THEN id = $1 ELSE uuid = $2 END
@@ -192,7 +550,16 @@ WITH prof AS (
 subs AS (
     SELECT subscriber_lists.status AS subscription_status,
             (CASE WHEN lists.type = 'private' THEN 'Private list' ELSE lists.name END) as name,
-            lists.type, subscriber_lists.created_at
+            lists.type, subscriber_lists.created_at,
+            COALESCE(subscriber_lists.subscribed_at, subscriber_lists.created_at) AS subscribed_at,
+            subscriber_lists.confirmed_at,
+            COALESCE(subscriber_lists.unsubscribed_at,
+                (CASE WHEN subscriber_lists.status = 'unsubscribed' THEN subscriber_lists.updated_at END)) AS unsubscribed_at,
+            (CASE WHEN subscriber_lists.consent_at IS NOT NULL THEN JSON_BUILD_OBJECT(
+                'source', subscriber_lists.consent_source, 'ip', subscriber_lists.consent_ip,
+                'user_agent', subscriber_lists.consent_user_agent, 'created_at', subscriber_lists.consent_at,
+                'confirm_ip', subscriber_lists.confirm_ip, 'confirm_user_agent', subscriber_lists.confirm_user_agent)
+            END) AS consent
     FROM lists
     LEFT JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id)
     WHERE subscriber_lists.subscriber_id = (SELECT id FROM prof)
@@ -210,7 +577,7 @@ clicks AS (
         GROUP BY links.id ORDER BY id
 )
 SELECT (SELECT email FROM prof) as email,
-        COALESCE((SELECT JSON_AGG(t) FROM prof t), '{}') AS profile,
+        COALESCE((SELECT JSON_AGG(t) FROM (SELECT uuid, email, name, attribs, status, created_at, updated_at FROM prof) t), '{}') AS profile,
         COALESCE((SELECT JSON_AGG(t) FROM subs t), '[]') AS subscriptions,
         COALESCE((SELECT JSON_AGG(t) FROM views t), '[]') AS campaign_views,
         COALESCE((SELECT JSON_AGG(t) FROM clicks t), '[]') AS link_clicks;
@@ -256,20 +623,21 @@ ON (
 WHERE subscriber_lists.list_id = ALL($2::INT[]) %s
 LIMIT (CASE WHEN $1 THEN 1 END)
 
--- name: delete-subscribers-by-query
--- raw: true
-WITH subs AS (%s)
-DELETE FROM subscribers WHERE id=ANY(SELECT id FROM subs);
-
 -- name: blacklist-subscribers-by-query
 -- raw: true
+-- Returns the IDs of the subscribers that weren't blacklisted.
 WITH subs AS (%s),
 b AS (
     UPDATE subscribers SET status='blacklisted', updated_at=NOW()
-    WHERE id = ANY(SELECT id FROM subs)
+    WHERE id = ANY(SELECT id FROM subs) AND status != 'blacklisted'
+    RETURNING id
+),
+sl AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW(),
+        unsubscribed_at=COALESCE(unsubscribed_at, NOW())
+    WHERE subscriber_id = ANY(SELECT id FROM subs)
 )
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE subscriber_id = ANY(SELECT id FROM subs);
+SELECT id FROM b;
 
 -- name: add-subscribers-to-lists-by-query
 -- raw: true
@@ -286,9 +654,16 @@ DELETE FROM subscriber_lists
 
 -- name: unsubscribe-subscribers-from-lists-by-query
 -- raw: true
-WITH subs AS (%s)
-UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
-    WHERE (subscriber_id, list_id) = ANY(SELECT a, b FROM UNNEST(ARRAY(SELECT id FROM subs)) a, UNNEST($3::INT[]) b);
+-- Returns the IDs of the subscribers that were unsubscribed from any of the lists.
+WITH subs AS (%s),
+u AS (
+    UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW(),
+        unsubscribed_at=COALESCE(unsubscribed_at, NOW())
+    WHERE (subscriber_id, list_id) = ANY(SELECT a, b FROM UNNEST(ARRAY(SELECT id FROM subs)) a, UNNEST($3::INT[]) b)
+        AND status != 'unsubscribed'
+    RETURNING subscriber_id
+)
+SELECT DISTINCT subscriber_id FROM u;
 
 
 -- lists
@@ -307,7 +682,9 @@ SELECT * FROM lists WHERE (CASE WHEN $1 != '' THEN optin=$1::list_optin ELSE TRU
     END) ORDER BY name;
 
 -- name: create-list
-INSERT INTO lists (uuid, name, type, optin, tags) VALUES($1, $2, $3, $4, $5) RETURNING id;
+INSERT INTO lists (uuid, name, type, optin, tags, from_name, reply_to, bounce_address,
+    send_windows, send_timezone, unsubscribe_redirect, winback_days, winback_send_days, winback_subject, winback_body, messenger)
+    VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16) RETURNING id;
 
 -- name: update-list
 UPDATE lists SET
@@ -315,9 +692,31 @@ UPDATE lists SET
     type=(CASE WHEN $3 != '' THEN $3::list_type ELSE type END),
     optin=(CASE WHEN $4 != '' THEN $4::list_optin ELSE optin END),
     tags=(CASE WHEN ARRAY_LENGTH($5::VARCHAR(100)[], 1) > 0 THEN $5 ELSE tags END),
+    from_name=$6,
+    reply_to=$7,
+    bounce_address=$8,
+    send_windows=$9,
+    send_timezone=$10,
+    unsubscribe_redirect=$11,
+    winback_days=$12,
+    winback_send_days=$13,
+    winback_subject=$14,
+    winback_body=$15,
+    messenger=$16,
     updated_at=NOW()
 WHERE id = $1;
 
+-- name: get-list-addresses
+-- The distinct Reply-To and bounce addresses of lists.
+SELECT COALESCE(ARRAY_AGG(DISTINCT reply_to) FILTER (WHERE reply_to != ''), '{}') AS reply_to,
+    COALESCE(ARRAY_AGG(DISTINCT bounce_address) FILTER (WHERE bounce_address != ''), '{}') AS bounce_address
+    FROM lists;
+
+-- name: get-lists-messengers
+-- The distinct default messengers of lists.
+SELECT COALESCE(ARRAY_AGG(DISTINCT messenger ORDER BY messenger) FILTER (WHERE messenger != ''), '{}')
+    FROM lists WHERE id = ANY($1::INT[]);
+
 -- name: update-lists-date
 UPDATE lists SET updated_at=NOW() WHERE id = ANY($1);
 
@@ -327,7 +726,8 @@ DELETE FROM lists WHERE id = ALL($1);
 
 -- campaigns
 -- name: create-campaign
--- This creates the campaign and inserts campaign_lists relationships.
+-- This creates the campaign and inserts campaign_lists relationships. Campaigns
+-- that only target segments ($12 is empty) have no lists.
 WITH campLists AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
     SELECT id AS list_id, campaign_id, optin FROM lists
@@ -355,13 +755,104 @@ counts AS (
     AND subscribers.status='enabled'
 ),
 camp AS (
-    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, content_type, send_at, tags, messenger, template_id, to_send, max_subscriber_id)
-        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts)
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, content_type, send_at, tags, messenger, template_id, to_send, max_subscriber_id, tracking_domain, parent_id, parent_audience, variants,
+        send_order, send_order_field, send_order_desc, from_name, exclude_segment_id, priority, allow_resend, charset, transfer_encoding, outage_policy, local_send_time,
+        rollout_percent, rollout_gate, rollout_stage, unsubscribe_redirect, metadata, amp_body, altbody, auto_altbody, shorten_links,
+        error_mode, error_rate, error_window, category, rollout_rate, recurrence, ab_test, archive)
+        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts), $13,
+            (CASE WHEN $14 > 0 THEN $14 ELSE NULL END), $15, $16, $17, $18, $19, $20, (CASE WHEN $21 > 0 THEN $21 ELSE NULL END), $22, $23, $24, $25, $26, $27,
+            $28, $29, (CASE WHEN $28 > 0 THEN 'initial' ELSE '' END), $30, $31, $32, $33, $34, $35, $36, $37, $38, $39, $40, $41, $42, $43
         RETURNING id
+),
+l AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        (SELECT (SELECT id FROM camp), id, name FROM lists WHERE id=ANY($12::INT[]))
+        RETURNING campaign_id
 )
-INSERT INTO campaign_lists (campaign_id, list_id, list_name)
-    (SELECT (SELECT id FROM camp), id, name FROM lists WHERE id=ANY($12::INT[]))
-    RETURNING (SELECT id FROM camp);
+SELECT id FROM camp WHERE CARDINALITY($12::INT[]) = 0 OR EXISTS (SELECT 1 FROM l);
+
+-- name: create-campaign-occurrence
+-- Clones a finished recurring campaign into its next occurrence that's scheduled at $3
+-- with fresh stats and a fresh content snapshot, and moves the recurrence ($4, which it
+-- had when it finished) to it. The clone has the campaign's lists, segments, and the
+-- subscribers that were excluded by hand.
+WITH prev AS (
+    UPDATE campaigns SET recurrence='', updated_at=NOW()
+    WHERE id = $1 AND status = 'finished' AND recurrence = $4 AND recurrence != ''
+    RETURNING *
+),
+camp AS (
+    INSERT INTO campaigns (uuid, type, category, name, subject, from_email, from_name, body, content_type,
+        amp_body, altbody, auto_altbody, shorten_links, send_at, status, tags, messenger, template_id,
+        tracking_domain, variants, send_order, send_order_field, send_order_desc, priority, allow_resend,
+        charset, transfer_encoding, outage_policy, error_mode, error_rate, error_window, local_send_time,
+        rollout_percent, rollout_gate, rollout_stage, rollout_rate, unsubscribe_redirect, metadata,
+        exclude_segment_id, recurrence, recurrence_of, ab_test,
+        approved, approval_requested_by, reviewed_by, reviewed_at, review_note, archive)
+    SELECT $2, type, category, name, subject, from_email, from_name, body, content_type,
+        amp_body, altbody, auto_altbody, shorten_links, $3, 'scheduled', tags, messenger, template_id,
+        tracking_domain, variants, send_order, send_order_field, send_order_desc, priority, allow_resend,
+        charset, transfer_encoding, outage_policy, error_mode, error_rate, error_window, local_send_time,
+        rollout_percent, rollout_gate, (CASE WHEN rollout_percent > 0 THEN 'initial' ELSE '' END), rollout_rate,
+        unsubscribe_redirect, metadata, exclude_segment_id, $4, COALESCE(recurrence_of, id), ab_test,
+        approved, approval_requested_by, reviewed_by, reviewed_at, review_note, archive
+    FROM prev
+    RETURNING id
+),
+l AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        SELECT (SELECT id FROM camp), list_id, list_name FROM campaign_lists
+        WHERE campaign_id = $1 AND list_id IS NOT NULL AND EXISTS (SELECT 1 FROM camp)
+),
+s AS (
+    INSERT INTO campaign_segments (campaign_id, segment_id)
+        SELECT (SELECT id FROM camp), segment_id FROM campaign_segments
+        WHERE campaign_id = $1 AND EXISTS (SELECT 1 FROM camp)
+),
+e AS (
+    INSERT INTO campaign_exclusions (campaign_id, subscriber_id)
+        SELECT (SELECT id FROM camp), subscriber_id FROM campaign_exclusions
+        WHERE campaign_id = $1 AND NOT from_segment AND EXISTS (SELECT 1 FROM camp)
+)
+SELECT id FROM camp;
+
+-- name: duplicate-campaign
+-- Clones a campaign ($1) into a new draft ($2 = UUID) named $3 (or "Copy of" the
+-- campaign's name) with its content, template, tags, settings, lists, segments, and
+-- the subscribers that were excluded by hand. The schedule, the recurrence, the
+-- stats, and the approval aren't cloned.
+WITH camp AS (
+    INSERT INTO campaigns (uuid, type, category, name, subject, from_email, from_name, body, content_type,
+        amp_body, altbody, auto_altbody, shorten_links, tags, messenger, template_id,
+        tracking_domain, parent_id, parent_audience, variants, send_order, send_order_field, send_order_desc,
+        priority, allow_resend, charset, transfer_encoding, outage_policy, error_mode, error_rate, error_window,
+        local_send_time, rollout_percent, rollout_gate, rollout_stage, rollout_rate, unsubscribe_redirect,
+        metadata, exclude_segment_id, ab_test, archive)
+    SELECT $2, type, category, COALESCE(NULLIF($3, ''), 'Copy of ' || name), subject, from_email, from_name, body,
+        content_type, amp_body, altbody, auto_altbody, shorten_links, tags, messenger, template_id,
+        tracking_domain, parent_id, parent_audience, variants, send_order, send_order_field, send_order_desc,
+        priority, allow_resend, charset, transfer_encoding, outage_policy, error_mode, error_rate, error_window,
+        local_send_time, rollout_percent, rollout_gate, (CASE WHEN rollout_percent > 0 THEN 'initial' ELSE '' END),
+        rollout_rate, unsubscribe_redirect, metadata, exclude_segment_id, ab_test, archive
+    FROM campaigns WHERE id = $1
+    RETURNING id
+),
+l AS (
+    INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+        SELECT (SELECT id FROM camp), list_id, list_name FROM campaign_lists
+        WHERE campaign_id = $1 AND list_id IS NOT NULL AND EXISTS (SELECT 1 FROM camp)
+),
+s AS (
+    INSERT INTO campaign_segments (campaign_id, segment_id)
+        SELECT (SELECT id FROM camp), segment_id FROM campaign_segments
+        WHERE campaign_id = $1 AND EXISTS (SELECT 1 FROM camp)
+),
+e AS (
+    INSERT INTO campaign_exclusions (campaign_id, subscriber_id)
+        SELECT (SELECT id FROM camp), subscriber_id FROM campaign_exclusions
+        WHERE campaign_id = $1 AND NOT from_segment AND EXISTS (SELECT 1 FROM camp)
+)
+SELECT id FROM camp;
 
 -- name: query-campaigns
 -- Here, 'lists' is returned as an aggregated JSON array from campaign_lists because
@@ -376,7 +867,11 @@ SELECT COUNT(*) OVER () AS total, campaigns.*, (
             campaign_lists.list_name AS name
             FROM campaign_lists WHERE campaign_lists.campaign_id = campaigns.id
         ) l
-    ) AS lists
+    ) AS lists,
+    (SELECT COALESCE(ARRAY_AGG(subscriber_id ORDER BY subscriber_id), '{}') FROM campaign_exclusions
+        WHERE campaign_id = campaigns.id AND NOT from_segment) AS exclude_subscribers,
+    (SELECT COALESCE(ARRAY_AGG(segment_id ORDER BY segment_id), '{}') FROM campaign_segments
+        WHERE campaign_id = campaigns.id) AS segment_ids
 FROM campaigns
 WHERE ($1 = 0 OR id = $1)
     AND status=ANY(CASE WHEN ARRAY_LENGTH($2::campaign_status[], 1) != 0 THEN $2::campaign_status[] ELSE ARRAY[status] END)
@@ -385,41 +880,113 @@ ORDER BY campaigns.updated_at DESC OFFSET $4 LIMIT $5;
 
 -- name: get-campaign
 SELECT campaigns.*,
-    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    COALESCE(templates.format, (SELECT format FROM templates WHERE is_default = true LIMIT 1)) AS template_format
     FROM campaigns
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
     WHERE CASE WHEN $1 > 0 THEN campaigns.id = $1 ELSE uuid = $2 END;
 
+-- name: get-campaign-send-windows
+-- The send windows of the lists of a campaign that have any.
+SELECT COALESCE(JSON_AGG(JSON_BUILD_OBJECT('list_id', lists.id, 'list_name', lists.name,
+    'timezone', lists.send_timezone, 'windows', lists.send_windows) ORDER BY lists.id), '[]') AS send_windows
+    FROM lists INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+    WHERE campaign_lists.campaign_id = $1 AND lists.send_windows != '[]';
+
+-- name: get-campaign-langs
+-- The distinct languages in the attribute $2 of the subscribers of the lists
+-- of a campaign ($1) and the number of subscribers with each, at most $3.
+SELECT LOWER(TRIM(s.attribs->>$2)) AS lang, COUNT(*) AS count FROM subscribers s
+    WHERE s.status != 'blacklisted' AND COALESCE(TRIM(s.attribs->>$2), '') != ''
+    AND s.id IN (SELECT subscriber_id FROM subscriber_lists
+        WHERE list_id IN (SELECT list_id FROM campaign_lists WHERE campaign_id = $1)
+        AND status != 'unsubscribed')
+    GROUP BY 1 ORDER BY 2 DESC LIMIT $3;
+
 -- name: get-campaign-stats
 -- This query is used to lazy load campaign stats (views, counts, list of lists) given a list of campaign IDs.
 -- The query returns results in the same order as the given campaign IDs, and for non-existent campaign IDs,
 -- the query still returns a row with 0 values. Thus, for lazy loading, the application simply iterate on the results in
 -- the same order as the list of campaigns it would've queried and attach the results.
+-- If the attribution window ($2, in seconds) is set, the stats of the events within it from the start of
+-- each campaign are also returned as window. Rolled up counts of purged events are only counted for the
+-- days that end within the window.
 WITH lists AS (
     SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', list_id, 'name', list_name)) AS lists FROM campaign_lists
     WHERE campaign_id = ANY($1) GROUP BY campaign_id
-), views AS (
-    SELECT campaign_id, COUNT(campaign_id) as num FROM campaign_views
-    WHERE campaign_id = ANY($1)
-    GROUP BY campaign_id
+),
+win AS (
+    SELECT id AS campaign_id, COALESCE(started_at, created_at) + $2::INT * INTERVAL '1 second' AS until
+    FROM campaigns WHERE id = ANY($1)
+),
+views AS (
+    -- Live views and the rolled up counts of purged views.
+    SELECT campaign_id, SUM(num) AS num, SUM(win_num) AS win_num FROM (
+        SELECT campaign_id, COUNT(campaign_id) as num,
+            COUNT(campaign_id) FILTER (WHERE created_at < win.until) AS win_num
+        FROM campaign_views INNER JOIN win USING (campaign_id)
+        GROUP BY campaign_id
+        UNION ALL
+        SELECT campaign_id, SUM(count) AS num,
+            COALESCE(SUM(count) FILTER (WHERE date < win.until::DATE), 0) AS win_num
+        FROM campaign_views_daily INNER JOIN win USING (campaign_id)
+        GROUP BY campaign_id
+    ) v GROUP BY campaign_id
 ),
 clicks AS (
-    SELECT campaign_id, COUNT(campaign_id) as num FROM link_clicks
-    WHERE campaign_id = ANY($1)
+    SELECT campaign_id, SUM(num) AS num, SUM(win_num) AS win_num FROM (
+        SELECT campaign_id, COUNT(campaign_id) as num,
+            COUNT(campaign_id) FILTER (WHERE created_at < win.until) AS win_num
+        FROM link_clicks INNER JOIN win USING (campaign_id)
+        GROUP BY campaign_id
+        UNION ALL
+        SELECT campaign_id, SUM(count) AS num,
+            COALESCE(SUM(count) FILTER (WHERE date < win.until::DATE), 0) AS win_num
+        FROM link_clicks_daily INNER JOIN win USING (campaign_id)
+        GROUP BY campaign_id
+    ) c GROUP BY campaign_id
+),
+convs AS (
+    SELECT campaign_id, COUNT(*) AS num, SUM(value) AS value,
+        COUNT(*) FILTER (WHERE created_at < win.until) AS win_num,
+        COALESCE(SUM(value) FILTER (WHERE created_at < win.until), 0) AS win_value
+    FROM conversions INNER JOIN win USING (campaign_id)
     GROUP BY campaign_id
 )
 SELECT id as campaign_id,
     COALESCE(v.num, 0) AS views,
     COALESCE(c.num, 0) AS clicks,
-    COALESCE(l.lists, '[]') AS lists
+    COALESCE(cv.num, 0) AS conversions,
+    COALESCE(cv.value, 0) AS conversion_value,
+    COALESCE(l.lists, '[]') AS lists,
+    (CASE WHEN $2::INT > 0 THEN JSON_BUILD_OBJECT(
+        'views', COALESCE(v.win_num, 0),
+        'clicks', COALESCE(c.win_num, 0),
+        'conversions', COALESCE(cv.win_num, 0),
+        'conversion_value', COALESCE(cv.win_value, 0)
+    ) END) AS window_stats
 FROM (SELECT id FROM UNNEST($1) AS id) x
 LEFT JOIN lists AS l ON (l.campaign_id = id)
 LEFT JOIN views AS v ON (v.campaign_id = id)
 LEFT JOIN clicks AS c ON (c.campaign_id = id)
+LEFT JOIN convs AS cv ON (cv.campaign_id = id)
 ORDER BY ARRAY_POSITION($1, id);
 
 -- name: get-campaign-for-preview
 SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    COALESCE(templates.format, (SELECT format FROM templates WHERE is_default = true LIMIT 1)) AS template_format,
+    COALESCE((SELECT lists.from_name FROM lists
+        INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND lists.from_name != ''
+        ORDER BY lists.id LIMIT 1), '') AS list_from_name,
+    COALESCE((SELECT lists.reply_to FROM lists
+        INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND lists.reply_to != ''
+        ORDER BY lists.id LIMIT 1), '') AS list_reply_to,
+    COALESCE((SELECT lists.bounce_address FROM lists
+        INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND lists.bounce_address != ''
+        ORDER BY lists.id LIMIT 1), '') AS list_bounce_address,
 (
 	SELECT COALESCE(ARRAY_TO_JSON(ARRAY_AGG(l)), '[]') FROM (
 		SELECT COALESCE(campaign_lists.list_id, 0) AS id,
@@ -431,25 +998,117 @@ FROM campaigns
 LEFT JOIN templates ON (templates.id = campaigns.template_id)
 WHERE campaigns.id = $1;
 
+-- name: get-campaign-lang-stats
+-- Views and clicks of a campaign broken down by the language variant that
+-- subscribers get based on their language attribute ($2). lang is empty for the
+-- default variant. Rolled up counts of purged events don't have subscribers
+-- and aren't included. If the attribution window ($3, in seconds) is set, only
+-- the events within it from the start of the campaign are counted.
+WITH camp AS (
+    SELECT variants, (CASE WHEN $3::INT > 0 THEN COALESCE(started_at, created_at) + $3::INT * INTERVAL '1 second'
+        ELSE 'infinity' END) AS until
+    FROM campaigns WHERE id = $1
+),
+events AS (
+    SELECT subscriber_id, 1 AS views, 0 AS clicks FROM campaign_views
+        WHERE campaign_id = $1 AND created_at < (SELECT until FROM camp)
+    UNION ALL
+    SELECT subscriber_id, 0 AS views, 1 AS clicks FROM link_clicks
+        WHERE campaign_id = $1 AND created_at < (SELECT until FROM camp)
+)
+SELECT (CASE WHEN camp.variants -> l.lang IS NOT NULL THEN l.lang
+        WHEN camp.variants -> l.base IS NOT NULL THEN l.base
+        ELSE '' END) AS lang,
+    SUM(events.views) AS views, SUM(events.clicks) AS clicks
+    FROM events
+    CROSS JOIN camp
+    LEFT JOIN subscribers ON (subscribers.id = events.subscriber_id)
+    CROSS JOIN LATERAL (SELECT LOWER(TRIM(subscribers.attribs->>$2)) AS lang) s
+    CROSS JOIN LATERAL (SELECT s.lang, SPLIT_PART(REPLACE(s.lang, '_', '-'), '-', 1) AS base) l
+    GROUP BY 1 ORDER BY 2 DESC;
+
+-- name: get-campaign-analytics
+-- Views and clicks by campaign and day between $3 and $4 of the events whose
+-- recorded campaign metadata has all the keys ($1) with the values ($2), where
+-- an empty value only requires the key. Values are compared as text. Rolled up
+-- counts of purged events don't have metadata and aren't included.
+WITH events AS (
+    SELECT campaign_id, created_at, metadata, 1 AS views, 0 AS clicks FROM campaign_views
+        WHERE created_at >= $3 AND created_at < $4
+    UNION ALL
+    SELECT campaign_id, created_at, metadata, 0 AS views, 1 AS clicks FROM link_clicks
+        WHERE created_at >= $3 AND created_at < $4 AND campaign_id IS NOT NULL
+)
+SELECT events.campaign_id, campaigns.name AS campaign_name, events.created_at::DATE::TEXT AS date,
+    SUM(events.views) AS views, SUM(events.clicks) AS clicks
+    FROM events
+    INNER JOIN campaigns ON (campaigns.id = events.campaign_id)
+    WHERE NOT EXISTS (
+        SELECT 1 FROM UNNEST($1::TEXT[], $2::TEXT[]) AS f(key, val)
+        WHERE (events.metadata -> f.key) IS NULL OR (f.val != '' AND events.metadata ->> f.key IS DISTINCT FROM f.val)
+    )
+    GROUP BY events.campaign_id, campaigns.name, date
+    ORDER BY date, events.campaign_id;
+
+-- name: get-campaign-queue
+-- Campaigns that are waiting for a slot under the cap on running campaigns,
+-- that is, the ones that next-campaigns would pick up besides the ones that are
+-- being processed ($1), in the order in which they're started.
+SELECT ROW_NUMBER() OVER (ORDER BY priority DESC, q.queued_at, id) AS position,
+    id, uuid, name, status, priority, q.queued_at
+    FROM campaigns
+    CROSS JOIN LATERAL (SELECT (CASE WHEN status = 'scheduled' THEN send_at
+        ELSE COALESCE(campaigns.queued_at, send_at, created_at) END) AS queued_at) q
+    WHERE (status='running' OR (status='scheduled' AND NOW() >= send_at))
+    AND NOT(id = ANY($1::INT[]))
+    ORDER BY position;
+
 -- name: get-campaign-status
-SELECT id, status, to_send, sent, started_at, updated_at
+SELECT id, status, to_send, sent, started_at, updated_at, priority
     FROM campaigns
     WHERE status=$1;
 
 -- name: next-campaigns
 -- Retreives campaigns that are running (or scheduled and the time's up) and need
 -- to be processed. It updates the to_send count and max_subscriber_id of the campaign,
--- that is, the total number of subscribers to be processed across all lists of a campaign.
+-- that is, the total number of subscribers to be processed across all lists and segments of a campaign.
 -- Thus, it has a sideaffect.
+-- If $2 is true, the content of the campaigns that don't have a snapshot
+-- is frozen in one, which is used for the rest of their runs.
 -- In addition, it finds the max_subscriber_id, the upper limit across all lists of
 -- a campaign. This is used to fetch and slice subscribers for the campaign in next-subscriber-campaigns.
 WITH camps AS (
     -- Get all running campaigns and their template bodies (if the template's deleted, the default template body instead)
-    SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
+    COALESCE(templates.format, (SELECT format FROM templates WHERE is_default = true LIMIT 1)) AS template_format,
+    -- The from-name, reply-to, and bounce address of the first of the
+    -- campaign's lists that has one.
+    COALESCE((SELECT lists.from_name FROM lists
+        INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND lists.from_name != ''
+        ORDER BY lists.id LIMIT 1), '') AS list_from_name,
+    COALESCE((SELECT lists.reply_to FROM lists
+        INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND lists.reply_to != ''
+        ORDER BY lists.id LIMIT 1), '') AS list_reply_to,
+    COALESCE((SELECT lists.bounce_address FROM lists
+        INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND lists.bounce_address != ''
+        ORDER BY lists.id LIMIT 1), '') AS list_bounce_address,
+    -- The send windows of the campaign's lists that have any.
+    COALESCE((SELECT JSON_AGG(JSON_BUILD_OBJECT('list_id', lists.id, 'list_name', lists.name,
+        'timezone', lists.send_timezone, 'windows', lists.send_windows) ORDER BY lists.id) FROM lists
+        INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+        WHERE campaign_lists.campaign_id = campaigns.id AND lists.send_windows != '[]'), '[]') AS list_send_windows
     FROM campaigns
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
     WHERE (status='running' OR (status='scheduled' AND NOW() >= campaigns.send_at))
     AND NOT(campaigns.id = ANY($1::INT[]))
+    -- Up to $3 campaigns (all if it's 0) in the order of the queue. See get-campaign-queue.
+    ORDER BY campaigns.priority DESC,
+        (CASE WHEN campaigns.status = 'scheduled' THEN campaigns.send_at
+            ELSE COALESCE(campaigns.queued_at, campaigns.send_at, campaigns.created_at) END), campaigns.id
+    LIMIT (CASE WHEN $3::INT > 0 THEN $3::INT END)
 ),
 campLists AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
@@ -457,15 +1116,13 @@ campLists AS (
     INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
     WHERE campaign_lists.campaign_id = ANY(SELECT id FROM camps)
 ),
-counts AS (
-    -- For each campaign above, get the total number of subscribers and the max_subscriber_id
-    -- across all its lists.
-    SELECT id AS campaign_id,
-                 COUNT(DISTINCT(subscriber_lists.subscriber_id)) AS to_send,
-                 COALESCE(MAX(subscriber_lists.subscriber_id), 0) AS max_subscriber_id
+targets AS (
+    -- The subscribers of the campaigns' lists and segments. UNION dedupes the
+    -- subscribers who are in more than one of them.
+    SELECT camps.id AS campaign_id, subscriber_lists.subscriber_id
     FROM camps
-    LEFT JOIN campLists ON (campLists.campaign_id = camps.id)
-    LEFT JOIN subscriber_lists ON (
+    INNER JOIN campLists ON (campLists.campaign_id = camps.id)
+    INNER JOIN subscriber_lists ON (
         subscriber_lists.list_id = campLists.list_id AND
         (CASE
             -- For optin campaigns, only e-mail 'unconfirmed' subscribers belonging to 'double' optin lists.
@@ -479,17 +1136,93 @@ counts AS (
             ELSE subscriber_lists.status != 'unsubscribed'
         END)
     )
+    UNION
+    -- Opt-in campaigns are only sent to lists.
+    SELECT camps.id AS campaign_id, campaign_segment_subscribers.subscriber_id
+    FROM camps
+    INNER JOIN campaign_segment_subscribers ON (campaign_segment_subscribers.campaign_id = camps.id)
+    WHERE camps.type != 'optin'
+),
+counts AS (
+    -- For each campaign above, get the total number of subscribers and the max_subscriber_id
+    -- across all its lists and segments.
+    SELECT id AS campaign_id,
+                 COUNT(targets.subscriber_id) AS to_send,
+                 COALESCE(MAX(targets.subscriber_id), 0) AS max_subscriber_id
+    FROM camps
+    LEFT JOIN targets ON (
+        targets.campaign_id = camps.id AND
+        -- For follow-up campaigns, only the parent's recipients who match the audience.
+        (CASE
+            -- Recipients it was delivered to who haven't opened it, and who haven't
+            -- bounced on it or on anything since it was started.
+            WHEN camps.parent_audience = 'non_openers' THEN
+                EXISTS (SELECT 1 FROM campaign_deliveries WHERE campaign_id = camps.parent_id
+                    AND subscriber_id = targets.subscriber_id)
+                AND NOT EXISTS (SELECT 1 FROM campaign_views WHERE campaign_id = camps.parent_id
+                    AND subscriber_id = targets.subscriber_id)
+                AND NOT EXISTS (SELECT 1 FROM bounces WHERE subscriber_id = targets.subscriber_id
+                    AND (campaign_id = camps.parent_id
+                        OR created_at >= (SELECT started_at FROM campaigns WHERE id = camps.parent_id)))
+            -- Retryable failures that haven't bounced.
+            WHEN camps.parent_audience = 'failed' THEN
+                EXISTS (SELECT 1 FROM campaign_failures WHERE campaign_id = camps.parent_id
+                    AND subscriber_id = targets.subscriber_id AND NOT permanent)
+                AND NOT EXISTS (SELECT 1 FROM bounces WHERE campaign_id = camps.parent_id
+                    AND subscriber_id = targets.subscriber_id)
+            ELSE true
+        END) AND
+        NOT EXISTS (SELECT 1 FROM campaign_exclusions WHERE campaign_id = camps.id
+            AND subscriber_id = targets.subscriber_id)
+    )
     GROUP BY camps.id
 ),
 u AS (
     -- For each campaign, update the to_send count and set the max_subscriber_id.
     UPDATE campaigns AS ca
     SET to_send = co.to_send,
-        status = (CASE WHEN status != 'running' THEN 'running' ELSE status END),
+        status = (CASE WHEN ca.status != 'running' THEN 'running' ELSE ca.status END),
         max_subscriber_id = co.max_subscriber_id,
-        started_at=(CASE WHEN ca.started_at IS NULL THEN NOW() ELSE ca.started_at END)
+        started_at=(CASE WHEN ca.started_at IS NULL THEN NOW() ELSE ca.started_at END),
+        snapshot=(CASE WHEN $2 AND ca.snapshot IS NULL THEN JSON_BUILD_OBJECT(
+            'subject', camps.subject, 'from_email', camps.from_email, 'from_name', camps.from_name,
+            'body', camps.body, 'amp_body', camps.amp_body, 'altbody', camps.altbody, 'content_type', camps.content_type, 'template_body', camps.template_body,
+            'template_format', camps.template_format, 'variants', camps.variants)::JSONB
+            ELSE ca.snapshot END),
+        snapshot_at=(CASE WHEN $2 AND ca.snapshot IS NULL THEN NOW() ELSE ca.snapshot_at END)
     FROM (SELECT * FROM counts) co
+    INNER JOIN camps ON (camps.id = co.campaign_id)
     WHERE ca.id = co.campaign_id
+),
+ord AS (
+    -- For each campaign that's sent in the random or a field order (but not at a local time)
+    -- and doesn't have one yet, compute the order of its subscribers by their [value, id]
+    -- sort keys. In the random order, the value is a hash of the campaign UUID and the
+    -- subscriber ID that shuffles subscribers differently for every campaign.
+    INSERT INTO campaign_send_order (campaign_id, position, subscriber_id)
+    SELECT campaign_id, ROW_NUMBER() OVER (PARTITION BY campaign_id
+            ORDER BY (CASE WHEN send_order_desc THEN NULL ELSE sort_key END),
+                (CASE WHEN send_order_desc THEN sort_key END) DESC),
+        subscriber_id
+    FROM (
+        SELECT targets.campaign_id, targets.subscriber_id, camps.send_order_desc,
+            JSONB_BUILD_ARRAY((CASE camps.send_order
+                WHEN 'random' THEN TO_JSONB(MD5(camps.uuid::TEXT || subscribers.id::TEXT))
+                ELSE (CASE camps.send_order_field
+                    WHEN 'email' THEN TO_JSONB(subscribers.email)
+                    WHEN 'name' THEN TO_JSONB(subscribers.name)
+                    WHEN 'created_at' THEN TO_JSONB(subscribers.created_at)
+                    WHEN 'updated_at' THEN TO_JSONB(subscribers.updated_at)
+                    -- attribs.a.b => attribs->'a'->'b'
+                    ELSE subscribers.attribs #> STRING_TO_ARRAY(SUBSTRING(camps.send_order_field FROM 9), '.')
+                END)
+            END), subscribers.id) AS sort_key
+        FROM camps
+        INNER JOIN targets ON (targets.campaign_id = camps.id)
+        INNER JOIN subscribers ON (subscribers.id = targets.subscriber_id)
+        WHERE camps.send_order IN ('random', 'field') AND camps.local_send_time = '' AND
+            NOT EXISTS (SELECT 1 FROM campaign_send_order WHERE campaign_id = camps.id)
+    ) k
 )
 SELECT * FROM camps;
 
@@ -497,25 +1230,56 @@ SELECT * FROM camps;
 -- Returns a batch of subscribers in a given campaign starting from the last checkpoint
 -- (last_subscriber_id). Every fetch updates the checkpoint and the sent count, which means
 -- every fetch returns a new batch of subscribers until all rows are exhausted.
+-- Campaigns that aren't sent in the ID order are checkpointed on last_sort_key instead,
+-- the [value, id] sort key of the last subscriber in the batch. Campaigns that are sent in
+-- the random or a field order are paged from the positions after the checkpoint in the order
+-- that was computed when they were started (campaign_send_order), and the value is the
+-- position. last_subscriber_id is then the highest ID that's been sent.
+-- Campaigns with a local_send_time are sent to every subscriber at its next occurrence
+-- in their timezone (the $3 attribute, or the $4 default) after the campaign started.
+-- Only the subscribers whose time has come are returned, in the order of their send times,
+-- and the [send time, id] sort key checkpoints them. Subscribers whose timezone changes
+-- to an earlier one during the send are skipped.
+-- Staged rollouts are sent to the subscribers whose hash of the campaign UUID and their
+-- ID falls in the initial rollout_percent, and once released, to the rest. Simulations
+-- are sent to everyone.
+-- The position before every batch is appended to checkpoints, which the manager drops
+-- once the batch's messages have been pushed (see checkpoint-campaign and resume-campaign).
 WITH camps AS (
-    SELECT last_subscriber_id, max_subscriber_id, type
+    SELECT uuid, last_subscriber_id, max_subscriber_id, type, parent_id, parent_audience,
+        send_order, o.ordered, last_sort_key, allow_resend,
+        -- The direction is a part of the positions of the computed orders.
+        send_order_desc AND NOT o.ordered AS send_order_desc,
+        (CASE WHEN o.ordered THEN COALESCE((last_sort_key->>0)::INT, 0) END) AS last_position,
+        simulate, rollout_percent, rollout_stage, resume_after,
+        NULLIF(local_send_time, '')::TIME AS local_send_time,
+        COALESCE(started_at, send_at, NOW()) AS local_send_from
     FROM campaigns
+    CROSS JOIN LATERAL (SELECT send_order IN ('random', 'field') AND local_send_time = '' AS ordered) o
     WHERE id=$1 AND status='running'
 ),
+positions AS (
+    -- The subscribers after the checkpoint in the computed order, if there's one.
+    SELECT subscriber_id AS id, position FROM campaign_send_order
+    WHERE campaign_id = $1 AND position > (SELECT last_position FROM camps)
+),
+zones AS (
+    -- The valid timezones of subscribers, only for local sends.
+    SELECT name FROM pg_timezone_names WHERE (SELECT local_send_time FROM camps) IS NOT NULL
+),
 campLists AS (
     SELECT id AS list_id, optin FROM lists
     INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
     WHERE campaign_lists.campaign_id = $1
 ),
-subs AS (
-    SELECT DISTINCT ON(subscribers.id) id AS uniq_id, subscribers.* FROM subscriber_lists
+targets AS (
+    -- The subscribers of the campaign's lists and segments in the range of
+    -- the batch. UNION dedupes the subscribers who are in more than one of them.
+    SELECT subscriber_lists.subscriber_id AS id FROM subscriber_lists
     INNER JOIN campLists ON (
         campLists.list_id = subscriber_lists.list_id
     )
-    INNER JOIN subscribers ON (
-        subscribers.status != 'blacklisted' AND
-        subscribers.id = subscriber_lists.subscriber_id AND
-
+    WHERE subscriber_lists.status != 'unsubscribed' AND
         (CASE
             -- For optin campaigns, only e-mail 'unconfirmed' subscribers.
             WHEN (SELECT type FROM camps) = 'optin' THEN subscriber_lists.status = 'unconfirmed' AND campLists.optin = 'double'
@@ -526,28 +1290,248 @@ subs AS (
             -- For regular campaigns with non-double optin lists, e-mail everyone
             -- except unsubscribed subscribers.
             ELSE subscriber_lists.status != 'unsubscribed'
-        END)
-    )
-    WHERE subscriber_lists.status != 'unsubscribed' AND
-    id > (SELECT last_subscriber_id FROM camps) AND
-    id <= (SELECT max_subscriber_id FROM camps)
-    ORDER BY id LIMIT $2
+        END) AND
+        (CASE WHEN (SELECT send_order FROM camps) = 'id' AND (SELECT local_send_time FROM camps) IS NULL
+            THEN subscriber_id > (SELECT last_subscriber_id FROM camps) ELSE true END) AND
+        subscriber_id <= (SELECT max_subscriber_id FROM camps)
+    UNION
+    -- Opt-in campaigns are only sent to lists.
+    SELECT subscriber_id AS id FROM campaign_segment_subscribers
+    WHERE campaign_id = $1 AND (SELECT type FROM camps) != 'optin' AND
+        (CASE WHEN (SELECT send_order FROM camps) = 'id' AND (SELECT local_send_time FROM camps) IS NULL
+            THEN subscriber_id > (SELECT last_subscriber_id FROM camps) ELSE true END) AND
+        subscriber_id <= (SELECT max_subscriber_id FROM camps)
+),
+candidates AS (
+    SELECT id AS uniq_id, subscribers.*, positions.position,
+        (CASE WHEN ls.send_at IS NOT NULL THEN JSONB_BUILD_ARRAY(EXTRACT(EPOCH FROM ls.send_at), subscribers.id)
+            WHEN (SELECT ordered FROM camps) THEN JSONB_BUILD_ARRAY(positions.position, subscribers.id)
+        END) AS sort_key
+    FROM targets
+    INNER JOIN subscribers USING (id)
+    LEFT JOIN positions USING (id)
+    LEFT JOIN zones ON (zones.name = subscribers.attribs->>$3)
+    -- The next occurrence of the local send time in the subscriber's timezone.
+    LEFT JOIN LATERAL (
+        SELECT ((t::DATE + (CASE WHEN t::TIME > (SELECT local_send_time FROM camps) THEN 1 ELSE 0 END)
+            + (SELECT local_send_time FROM camps)) AT TIME ZONE tz) AS send_at
+        FROM (SELECT COALESCE(zones.name, $4) AS tz,
+            (SELECT local_send_from FROM camps) AT TIME ZONE COALESCE(zones.name, $4) AS t) l
+        WHERE (SELECT local_send_time FROM camps) IS NOT NULL
+    ) ls ON true
+    WHERE subscribers.status != 'blacklisted' AND
+    (ls.send_at IS NULL OR ls.send_at <= NOW()) AND
+    (NOT (SELECT ordered FROM camps) OR positions.position IS NOT NULL) AND
+    -- For follow-up campaigns, only the parent's recipients who match the audience.
+    (CASE
+        WHEN (SELECT parent_audience FROM camps) = 'non_openers' THEN
+            EXISTS (SELECT 1 FROM campaign_deliveries WHERE campaign_id = (SELECT parent_id FROM camps)
+                AND subscriber_id = subscribers.id)
+            AND NOT EXISTS (SELECT 1 FROM campaign_views WHERE campaign_id = (SELECT parent_id FROM camps)
+                AND subscriber_id = subscribers.id)
+            AND NOT EXISTS (SELECT 1 FROM bounces WHERE subscriber_id = subscribers.id
+                AND (campaign_id = (SELECT parent_id FROM camps)
+                    OR created_at >= (SELECT started_at FROM campaigns WHERE id = (SELECT parent_id FROM camps))))
+        WHEN (SELECT parent_audience FROM camps) = 'failed' THEN
+            EXISTS (SELECT 1 FROM campaign_failures WHERE campaign_id = (SELECT parent_id FROM camps)
+                AND subscriber_id = subscribers.id AND NOT permanent)
+            AND NOT EXISTS (SELECT 1 FROM bounces WHERE campaign_id = (SELECT parent_id FROM camps)
+                AND subscriber_id = subscribers.id)
+        ELSE true
+    END) AND
+    NOT EXISTS (SELECT 1 FROM campaign_exclusions WHERE campaign_id = $1 AND subscriber_id = subscribers.id) AND
+    (CASE WHEN (SELECT rollout_percent FROM camps) = 0 OR (SELECT simulate FROM camps) THEN true
+        WHEN (SELECT rollout_stage FROM camps) = 'initial' THEN
+            ('x' || SUBSTR(MD5((SELECT uuid FROM camps)::TEXT || subscribers.id::TEXT), 1, 8))::BIT(32)::BIGINT % 100 < (SELECT rollout_percent FROM camps)
+        ELSE ('x' || SUBSTR(MD5((SELECT uuid FROM camps)::TEXT || subscribers.id::TEXT), 1, 8))::BIT(32)::BIGINT % 100 >= (SELECT rollout_percent FROM camps)
+    END) AND
+    -- Skip the subscribers the campaign was already delivered to unless it allows resends,
+    -- and the ones it was delivered to or failed for since it was resumed after a restart.
+    NOT EXISTS (SELECT 1 FROM campaign_deliveries WHERE campaign_id = $1 AND subscriber_id = subscribers.id
+        AND (NOT (SELECT allow_resend FROM camps) OR created_at >= (SELECT resume_after FROM camps))) AND
+    NOT EXISTS (SELECT 1 FROM campaign_failures WHERE campaign_id = $1 AND subscriber_id = subscribers.id
+        AND created_at >= (SELECT resume_after FROM camps))
+),
+subs AS (
+    SELECT * FROM candidates
+    WHERE (SELECT last_sort_key FROM camps) IS NULL OR
+        (CASE WHEN (SELECT send_order_desc FROM camps) THEN sort_key < (SELECT last_sort_key FROM camps)
+            ELSE sort_key > (SELECT last_sort_key FROM camps) END)
+    -- sort_key is NULL in the ID order and position is NULL unless the order is computed.
+    ORDER BY position,
+        (CASE WHEN (SELECT send_order_desc FROM camps) THEN NULL ELSE sort_key END),
+        (CASE WHEN (SELECT send_order_desc FROM camps) THEN sort_key END) DESC,
+        id
+    LIMIT $2
 ),
 u AS (
     UPDATE campaigns
-    SET last_subscriber_id = (SELECT MAX(id) FROM subs),
+    SET last_subscriber_id = GREATEST(last_subscriber_id, (SELECT MAX(id) FROM subs)),
+        last_sort_key = (CASE WHEN (SELECT send_order_desc FROM camps) THEN (SELECT sort_key FROM subs ORDER BY sort_key LIMIT 1)
+            ELSE (SELECT sort_key FROM subs ORDER BY sort_key DESC LIMIT 1) END),
         sent = sent + (SELECT COUNT(id) FROM subs),
+        checkpoints = checkpoints || JSONB_BUILD_OBJECT('last_subscriber_id', last_subscriber_id,
+            'last_sort_key', last_sort_key, 'sent', sent, 'at', NOW()),
         updated_at = NOW()
     WHERE (SELECT COUNT(id) FROM subs) > 0 AND id=$1
 )
 SELECT * FROM subs;
 
+-- name: checkpoint-campaign
+-- Drops the checkpoint of the oldest batch of subscribers of a campaign, all of whose
+-- messages have been pushed and recorded.
+UPDATE campaigns SET checkpoints = checkpoints - 0 WHERE id = $1;
+
+-- name: resume-campaign
+-- Rewinds a running campaign that's picked up after a restart to the checkpoint of its
+-- oldest batch of subscribers whose messages may not all have been pushed. The ones that
+-- have been delivered to or failed since are skipped (see next-campaign-subscribers) and
+-- stay counted as sent. Returns the sent count, and nothing if there's no checkpoint.
+WITH cp AS (
+    SELECT checkpoints->0 AS c, (checkpoints->0->>'at')::TIMESTAMP WITH TIME ZONE AS at
+    FROM campaigns WHERE id = $1 AND JSONB_ARRAY_LENGTH(checkpoints) > 0
+)
+UPDATE campaigns SET
+    last_subscriber_id = (cp.c->>'last_subscriber_id')::INT,
+    last_sort_key = NULLIF(cp.c->'last_sort_key', 'null'::JSONB),
+    sent = LEAST(sent, (cp.c->>'sent')::INT
+        + (SELECT COUNT(*) FROM campaign_deliveries WHERE campaign_id = $1 AND created_at >= cp.at)
+        + (SELECT COUNT(*) FROM campaign_failures WHERE campaign_id = $1 AND created_at >= cp.at)),
+    checkpoints = '[]',
+    resume_after = cp.at,
+    updated_at = NOW()
+FROM cp WHERE id = $1
+RETURNING sent;
+
+-- name: hold-campaign-rollout
+-- Pauses a staged rollout whose initial share of subscribers has been sent.
+UPDATE campaigns SET status='paused', rollout_stage='holding', rollout_sent=sent,
+    rollout_held_at=NOW(), updated_at=NOW()
+    WHERE id = $1 AND status = 'running' AND rollout_stage = 'initial' AND NOT simulate;
+
+-- name: halt-campaign-rollout
+UPDATE campaigns SET rollout_stage='halted', rollout_reason=$2, updated_at=NOW()
+    WHERE id = $1 AND status = 'paused' AND rollout_stage = 'holding';
+
+-- name: halt-campaign-trickle
+-- Pauses a trickled staged rollout whose initial share crossed its gate's maximum
+-- rates before it was sent to all of the share.
+UPDATE campaigns SET status='paused', rollout_stage='halted', rollout_sent=sent,
+    rollout_held_at=NOW(), rollout_reason=$2, updated_at=NOW()
+    WHERE id = $1 AND status = 'running' AND rollout_stage = 'initial' AND NOT simulate;
+
+-- name: get-trickling-rollouts
+-- Returns the IDs of the running trickled staged rollouts that have a gate.
+SELECT id FROM campaigns WHERE status = 'running' AND rollout_stage = 'initial' AND rollout_rate > 0
+    AND rollout_gate != '{}' AND NOT simulate ORDER BY id;
+
+-- name: set-campaign-rollout-reason
+UPDATE campaigns SET rollout_reason=$2, updated_at=NOW() WHERE id = $1;
+
+-- name: get-held-campaign-rollouts
+-- Returns the IDs of the held staged rollouts that have a gate and whose A/B tests,
+-- if any, have a winner.
+SELECT id FROM campaigns WHERE status = 'paused' AND rollout_stage = 'holding' AND rollout_gate != '{}'
+    AND (ab_test = '{}' OR ab_winner >= 0)
+    ORDER BY rollout_held_at;
+
+-- name: get-held-ab-tests
+-- Returns the IDs of the held staged rollouts whose A/B tests are yet to have a winner.
+SELECT id FROM campaigns WHERE status = 'paused' AND rollout_stage = 'holding' AND ab_test != '{}'
+    AND ab_winner < 0 ORDER BY rollout_held_at;
+
+-- name: get-campaign-ab-metrics
+-- Returns the metrics of the $2 variants of the A/B test of a staged rollout. The
+-- subscribers of its initial share (see next-campaign-subscribers) are split between
+-- the variants by the same hash of the campaign UUID and their IDs as models.CampaignABTest.
+-- The messages sent are the deliveries.
+WITH camp AS (
+    SELECT uuid, rollout_percent FROM campaigns WHERE id = $1 AND rollout_percent > 0
+),
+sample AS (
+    SELECT id, ('x' || SUBSTR(MD5((SELECT uuid FROM camp)::TEXT || id::TEXT || ':ab'), 1, 8))::BIT(32)::BIGINT % $2 AS variant
+    FROM subscribers
+    WHERE ('x' || SUBSTR(MD5((SELECT uuid FROM camp)::TEXT || id::TEXT), 1, 8))::BIT(32)::BIGINT % 100 < (SELECT rollout_percent FROM camp)
+)
+SELECT v.variant,
+    (SELECT COUNT(*) FROM campaign_deliveries
+        WHERE campaign_id = $1 AND subscriber_id IN (SELECT id FROM sample WHERE variant = v.variant)) AS sent,
+    (SELECT COUNT(DISTINCT subscriber_id) FROM campaign_views
+        WHERE campaign_id = $1 AND subscriber_id IN (SELECT id FROM sample WHERE variant = v.variant)) AS views,
+    (SELECT COUNT(DISTINCT subscriber_id) FROM link_clicks
+        WHERE campaign_id = $1 AND subscriber_id IN (SELECT id FROM sample WHERE variant = v.variant)) AS clicks
+FROM GENERATE_SERIES(0, $2 - 1) AS v(variant)
+WHERE EXISTS (SELECT 1 FROM camp)
+ORDER BY v.variant;
+
+-- name: set-campaign-ab-winner
+UPDATE campaigns SET ab_winner=$2, rollout_reason=$3, updated_at=NOW() WHERE id = $1 AND ab_winner < 0;
+
+-- name: get-campaign-rollout-metrics
+-- Returns the metrics of the initial share of the subscribers of a staged rollout (see
+-- next-campaign-subscribers). Until it's held, all the messages sent are to that share.
+WITH camp AS (
+    SELECT uuid, rollout_percent, (CASE WHEN rollout_stage = 'initial' THEN sent ELSE rollout_sent END) AS sent
+    FROM campaigns WHERE id = $1 AND rollout_percent > 0
+),
+initial AS (
+    SELECT id FROM subscribers
+    WHERE ('x' || SUBSTR(MD5((SELECT uuid FROM camp)::TEXT || id::TEXT), 1, 8))::BIT(32)::BIGINT % 100 < (SELECT rollout_percent FROM camp)
+)
+SELECT (SELECT sent FROM camp) AS sent,
+    (SELECT COUNT(DISTINCT subscriber_id) FROM campaign_views
+        WHERE campaign_id = $1 AND subscriber_id IN (SELECT id FROM initial)) AS views,
+    (SELECT COUNT(DISTINCT subscriber_id) FROM link_clicks
+        WHERE campaign_id = $1 AND subscriber_id IN (SELECT id FROM initial)) AS clicks,
+    (SELECT COUNT(DISTINCT subscriber_id) FROM bounces
+        WHERE campaign_id = $1 AND type = 'bounce' AND subscriber_id IN (SELECT id FROM initial)) AS bounces,
+    (SELECT COUNT(DISTINCT subscriber_id) FROM unsubscribe_reasons
+        WHERE campaign_id = $1 AND subscriber_id IN (SELECT id FROM initial)) AS unsubscribes,
+    (SELECT COUNT(DISTINCT subscriber_id) FROM bounces
+        WHERE campaign_id = $1 AND type = 'complaint' AND subscriber_id IN (SELECT id FROM initial)) AS complaints
+FROM camp;
+
+-- name: get-campaign-local-send-buckets
+-- Groups the recipients of a campaign with a local send time by their timezones, with
+-- the times at which they're sent the campaign (see next-campaign-subscribers) and how
+-- many of them it was delivered to.
+WITH camp AS (
+    SELECT id, max_subscriber_id, local_send_time::TIME AS local_send_time,
+        COALESCE(started_at, send_at, NOW()) AS local_send_from
+    FROM campaigns WHERE id = $1 AND local_send_time != ''
+),
+zones AS (
+    SELECT name FROM pg_timezone_names WHERE EXISTS (SELECT 1 FROM camp)
+),
+targets AS (
+    SELECT subscriber_id AS id FROM subscriber_lists
+    WHERE list_id = ANY(SELECT list_id FROM campaign_lists WHERE campaign_id = $1) AND status != 'unsubscribed'
+    UNION
+    SELECT subscriber_id AS id FROM campaign_segment_subscribers WHERE campaign_id = $1
+),
+subs AS (
+    SELECT id, COALESCE(zones.name, $3) AS timezone FROM targets
+    INNER JOIN subscribers USING (id)
+    LEFT JOIN zones ON (zones.name = subscribers.attribs->>$2)
+    WHERE subscribers.status != 'blacklisted' AND id <= (SELECT max_subscriber_id FROM camp)
+),
+buckets AS (
+    SELECT timezone, (SELECT local_send_from FROM camp) AT TIME ZONE timezone AS t,
+        COUNT(*) AS total,
+        COUNT(*) FILTER (WHERE EXISTS (SELECT 1 FROM campaign_deliveries WHERE campaign_id = $1 AND subscriber_id = subs.id)) AS delivered
+    FROM subs GROUP BY timezone
+)
+SELECT timezone, ((t::DATE + (CASE WHEN t::TIME > (SELECT local_send_time FROM camp) THEN 1 ELSE 0 END)
+        + (SELECT local_send_time FROM camp)) AT TIME ZONE timezone) AS send_at,
+    total, delivered
+FROM buckets ORDER BY send_at, timezone;
+
 -- name: get-one-campaign-subscriber
 SELECT * FROM subscribers
 LEFT JOIN subscriber_lists ON (subscribers.id = subscriber_lists.subscriber_id AND subscriber_lists.status != 'unsubscribed')
 WHERE subscriber_lists.list_id=ANY(
     SELECT list_id FROM campaign_lists where campaign_id=$1 AND list_id IS NOT NULL
-)
+) OR subscribers.id IN (SELECT subscriber_id FROM campaign_segment_subscribers WHERE campaign_id=$1)
 ORDER BY RANDOM() LIMIT 1;
 
 -- name: update-campaign
@@ -559,9 +1543,51 @@ WITH camp AS (
         body=(CASE WHEN $5 != '' THEN $5 ELSE body END),
         content_type=(CASE WHEN $6 != '' THEN $6::content_type ELSE content_type END),
         send_at=(CASE WHEN $8 THEN $7::TIMESTAMP WITH TIME ZONE WHEN NOT $8 THEN NULL ELSE send_at END),
-        status=(CASE WHEN NOT $8 THEN 'draft' ELSE status END),
+        status=(CASE WHEN NOT $8 OR ($41 AND status = 'scheduled') THEN 'draft' ELSE status END),
         tags=(CASE WHEN ARRAY_LENGTH($9::VARCHAR(100)[], 1) > 0 THEN $9 ELSE tags END),
         template_id=(CASE WHEN $10 != 0 THEN $10 ELSE template_id END),
+        tracking_domain=$12,
+        variants=$13,
+        send_order=$14,
+        send_order_field=$15,
+        send_order_desc=$16,
+        from_name=$17,
+        exclude_segment_id=(CASE WHEN $18 > 0 THEN $18 ELSE NULL END),
+        priority=$19,
+        allow_resend=$20,
+        charset=$21,
+        transfer_encoding=$22,
+        outage_policy=$23,
+        local_send_time=$24,
+        rollout_percent=$25,
+        rollout_gate=$26,
+        -- Rollouts that haven't started are reset to the initial stage and halted
+        -- ones whose gate changes are held again for the new gate.
+        rollout_stage=(CASE WHEN status IN ('draft', 'scheduled') THEN (CASE WHEN $25 > 0 THEN 'initial' ELSE '' END)
+            WHEN rollout_stage = 'halted' AND rollout_gate != $26 THEN 'holding'
+            ELSE rollout_stage END),
+        unsubscribe_redirect=$27,
+        metadata=$28,
+        amp_body=$29,
+        altbody=$30,
+        auto_altbody=$31,
+        shorten_links=$32,
+        error_mode=$33,
+        error_rate=$34,
+        error_window=$35,
+        messenger=$36,
+        category=$37,
+        rollout_rate=$38,
+        recurrence=$39,
+        ab_test=$40,
+        -- The winner of a test that hasn't been sent is picked again.
+        ab_winner=(CASE WHEN status IN ('draft', 'scheduled') THEN -1 ELSE ab_winner END),
+        -- Edits before the campaign starts clear its approval, and with approvals ($41),
+        -- scheduled campaigns return to drafts to be approved again. So do the edits of
+        -- paused campaigns without a content snapshot, which are sent when they resume.
+        approved=(CASE WHEN status IN ('draft', 'scheduled') OR ($41 AND status = 'paused' AND snapshot IS NULL)
+            THEN false ELSE approved END),
+        archive=$42,
         updated_at=NOW()
     WHERE id = $1 RETURNING id
 ),
@@ -573,6 +1599,108 @@ INSERT INTO campaign_lists (campaign_id, list_id, list_name)
     (SELECT $1 as campaign_id, id, name FROM lists WHERE id=ANY($11::INT[]))
     ON CONFLICT (campaign_id, list_id) DO UPDATE SET list_name = EXCLUDED.list_name;
 
+-- name: set-campaign-exclusions
+-- Replace the explicitly excluded subscribers of a campaign with $2.
+WITH d AS (
+    DELETE FROM campaign_exclusions WHERE campaign_id = $1 AND NOT from_segment
+        AND NOT (subscriber_id = ANY($2::INT[]))
+)
+INSERT INTO campaign_exclusions (campaign_id, subscriber_id)
+    (SELECT $1, id FROM subscribers WHERE id = ANY($2::INT[]))
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE SET from_segment = false;
+
+-- name: delete-campaign-segment-exclusions
+DELETE FROM campaign_exclusions WHERE campaign_id = $1 AND from_segment;
+
+-- name: get-campaign-segments
+SELECT segments.* FROM segments
+    INNER JOIN campaign_segments ON (campaign_segments.segment_id = segments.id)
+    WHERE campaign_segments.campaign_id = $1 ORDER BY segments.id;
+
+-- name: set-campaign-segments
+-- Replace the segments that a campaign is sent to with $2.
+WITH d AS (
+    DELETE FROM campaign_segments WHERE campaign_id = $1 AND NOT (segment_id = ANY($2::INT[]))
+)
+INSERT INTO campaign_segments (campaign_id, segment_id)
+    (SELECT $1, id FROM segments WHERE id = ANY($2::INT[]))
+    ON CONFLICT (campaign_id, segment_id) DO NOTHING;
+
+-- name: delete-campaign-segment-subscribers
+DELETE FROM campaign_segment_subscribers WHERE campaign_id = $1;
+
+-- name: add-campaign-segment-subscribers
+-- raw: true
+-- Unprepared statement for copying the subscribers matching one of the
+-- campaign's ($1) segments. Subscribers in more than one are copied once.
+-- %s = compiled segment expression
+INSERT INTO campaign_segment_subscribers (campaign_id, subscriber_id)
+    (SELECT $1, id FROM subscribers WHERE status != 'blacklisted' AND (%s))
+    ON CONFLICT (campaign_id, subscriber_id) DO NOTHING;
+
+-- name: add-campaign-segment-exclusions
+-- raw: true
+-- Unprepared statement for excluding the subscribers matching the campaign's
+-- ($1) exclusion segment.
+-- %s = compiled segment expression
+INSERT INTO campaign_exclusions (campaign_id, subscriber_id, from_segment)
+    (SELECT $1, id, true FROM subscribers WHERE %s)
+    ON CONFLICT (campaign_id, subscriber_id) DO NOTHING;
+
+-- name: get-campaign-recipient-counts
+-- The number of subscribers in a campaign's lists and segments that it would
+-- be sent to, how many of them are excluded, and how many are in both its lists
+-- and segments (and are sent to once).
+WITH camp AS (
+    SELECT type, parent_id, parent_audience FROM campaigns WHERE id = $1
+),
+campLists AS (
+    SELECT id AS list_id, optin FROM lists
+    INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+    WHERE campaign_lists.campaign_id = $1
+),
+targets AS (
+    SELECT subscriber_lists.subscriber_id AS id, true AS in_list FROM subscriber_lists
+    INNER JOIN campLists ON (campLists.list_id = subscriber_lists.list_id)
+    WHERE (CASE
+        WHEN (SELECT type FROM camp) = 'optin' THEN subscriber_lists.status = 'unconfirmed' AND campLists.optin = 'double'
+        WHEN campLists.optin = 'double' THEN subscriber_lists.status = 'confirmed'
+        ELSE subscriber_lists.status != 'unsubscribed'
+    END)
+    UNION ALL
+    SELECT subscriber_id AS id, false AS in_list FROM campaign_segment_subscribers
+    WHERE campaign_id = $1 AND (SELECT type FROM camp) != 'optin'
+),
+subs AS (
+    SELECT subscribers.id, BOOL_OR(targets.in_list) AS in_list, BOOL_OR(NOT targets.in_list) AS in_segment
+    FROM targets
+    INNER JOIN subscribers ON (subscribers.status != 'blacklisted' AND subscribers.id = targets.id)
+    WHERE (CASE
+        WHEN (SELECT parent_audience FROM camp) = 'non_openers' THEN
+            EXISTS (SELECT 1 FROM campaign_deliveries WHERE campaign_id = (SELECT parent_id FROM camp)
+                AND subscriber_id = subscribers.id)
+            AND NOT EXISTS (SELECT 1 FROM campaign_views WHERE campaign_id = (SELECT parent_id FROM camp)
+                AND subscriber_id = subscribers.id)
+            AND NOT EXISTS (SELECT 1 FROM bounces WHERE subscriber_id = subscribers.id
+                AND (campaign_id = (SELECT parent_id FROM camp)
+                    OR created_at >= (SELECT started_at FROM campaigns WHERE id = (SELECT parent_id FROM camp))))
+        WHEN (SELECT parent_audience FROM camp) = 'failed' THEN
+            EXISTS (SELECT 1 FROM campaign_failures WHERE campaign_id = (SELECT parent_id FROM camp)
+                AND subscriber_id = subscribers.id AND NOT permanent)
+            AND NOT EXISTS (SELECT 1 FROM bounces WHERE campaign_id = (SELECT parent_id FROM camp)
+                AND subscriber_id = subscribers.id)
+        ELSE true
+    END)
+    GROUP BY subscribers.id
+)
+SELECT COUNT(*) AS total,
+    COUNT(*) FILTER (WHERE EXISTS (SELECT 1 FROM campaign_exclusions
+        WHERE campaign_id = $1 AND subscriber_id = subs.id)) AS excluded,
+    COUNT(*) FILTER (WHERE in_list) AS lists,
+    COUNT(*) FILTER (WHERE in_segment) AS segments,
+    COUNT(*) FILTER (WHERE in_list AND in_segment) AS overlap
+    FROM subs;
+
 -- name: update-campaign-counts
 UPDATE campaigns SET
     to_send=(CASE WHEN $2 != 0 THEN $2 ELSE to_send END),
@@ -582,57 +1710,523 @@ UPDATE campaigns SET
 WHERE id=$1;
 
 -- name: update-campaign-status
-UPDATE campaigns SET status=$2, updated_at=NOW() WHERE id = $1;
+-- Simulated campaigns that finish or are cancelled record the results of the
+-- run and are reset to drafts that can be sent (or simulated) again.
+-- Resuming a held staged rollout releases it to the rest of the subscribers, who
+-- are sent to from the start (see next-campaign-subscribers).
+-- The computed send order of campaigns that finish or are cancelled is dropped.
+WITH ord AS (
+    DELETE FROM campaign_send_order
+    WHERE campaign_id = $1 AND $2::campaign_status IN ('finished', 'cancelled', 'aborted')
+)
+UPDATE campaigns SET
+    status=(CASE WHEN s.reset THEN 'draft' ELSE $2::campaign_status END),
+    simulate=(CASE WHEN s.reset THEN false ELSE simulate END),
+    simulation=(CASE WHEN s.reset THEN JSON_BUILD_OBJECT('status', $2::campaign_status,
+        'to_send', to_send, 'sent', sent, 'started_at', started_at, 'finished_at', NOW(),
+        'duration', EXTRACT(EPOCH FROM NOW() - COALESCE(started_at, NOW())),
+        'rate', sent / GREATEST(EXTRACT(EPOCH FROM NOW() - COALESCE(started_at, NOW())), 1),
+        'render_errors', render_errors, 'render_error', render_error)::JSONB
+        ELSE simulation END),
+    render_errors=(CASE WHEN s.reset THEN 0 ELSE render_errors END),
+    render_error=(CASE WHEN s.reset THEN '' ELSE render_error END),
+    sent=(CASE WHEN s.reset THEN 0 ELSE sent END),
+    last_subscriber_id=(CASE WHEN s.reset OR s.release THEN 0 ELSE last_subscriber_id END),
+    last_sort_key=(CASE WHEN s.reset OR s.release THEN NULL ELSE last_sort_key END),
+    checkpoints=(CASE WHEN s.reset OR s.release THEN '[]' ELSE checkpoints END),
+    resume_after=(CASE WHEN s.reset OR s.release THEN NULL ELSE resume_after END),
+    rollout_stage=(CASE WHEN s.reset THEN (CASE WHEN rollout_percent > 0 THEN 'initial' ELSE '' END)
+        WHEN s.release THEN 'released' ELSE rollout_stage END),
+    rollout_reason=(CASE WHEN s.reset THEN '' ELSE rollout_reason END),
+    ab_winner=(CASE WHEN s.reset THEN -1 ELSE ab_winner END),
+    started_at=(CASE WHEN s.reset THEN NULL ELSE started_at END),
+    snapshot=(CASE WHEN s.reset THEN NULL ELSE snapshot END),
+    snapshot_at=(CASE WHEN s.reset THEN NULL ELSE snapshot_at END),
+    queued_at=(CASE WHEN $2::campaign_status = 'running' THEN NOW() ELSE queued_at END),
+    updated_at=NOW()
+FROM (SELECT simulate AND $2::campaign_status IN ('finished', 'cancelled', 'aborted') AS reset,
+    $2::campaign_status = 'running' AND rollout_stage IN ('holding', 'halted') AS release
+    FROM campaigns WHERE id = $1) s
+WHERE id = $1;
+
+-- name: request-campaign-approval
+-- Submits a draft, or a paused campaign that isn't approved, for approval by a user
+-- other than the submitter ($2).
+UPDATE campaigns SET status='pending_approval', approved=false, approval_requested_by=$2, updated_at=NOW()
+    WHERE id = $1 AND (status = 'draft' OR (status = 'paused' AND NOT approved));
+
+-- name: review-campaign
+-- Approves ($3) or rejects a campaign that's pending approval and returns it to a draft, or
+-- if it has been started, to paused. Campaigns can't be reviewed by their submitters.
+UPDATE campaigns SET status=(CASE WHEN started_at IS NULL THEN 'draft' ELSE 'paused' END)::campaign_status,
+    approved=$3, reviewed_by=$2, reviewed_at=NOW(), review_note=$4, updated_at=NOW()
+    WHERE id = $1 AND status = 'pending_approval' AND approval_requested_by IS DISTINCT FROM $2;
+
+-- name: set-campaign-abort-reason
+UPDATE campaigns SET abort_reason=$2, updated_at=NOW() WHERE id = $1;
+
+-- name: record-campaign-render-errors
+-- Adds $2 messages that couldn't be rendered to a campaign with the last error ($3).
+UPDATE campaigns SET render_errors=render_errors+$2, render_error=$3 WHERE id = $1;
+
+-- name: set-campaign-simulate
+UPDATE campaigns SET simulate=$2, updated_at=NOW() WHERE id = $1;
+
+-- name: clear-campaign-snapshot
+-- Clears the snapshot of a paused campaign so that its edits apply to the
+-- rest of its recipients. The snapshot is taken again when it's resumed.
+-- With approvals ($2), the edits have to be approved before it's resumed.
+UPDATE campaigns SET snapshot=NULL, snapshot_at=NULL,
+    approved=(CASE WHEN $2 THEN false ELSE approved END), updated_at=NOW()
+    WHERE id = $1 AND status = 'paused' AND snapshot IS NOT NULL;
 
 -- name: delete-campaign
 DELETE FROM campaigns WHERE id=$1 AND (status = 'draft' OR status = 'scheduled');
 
 -- name: register-campaign-view
 WITH view AS (
-    SELECT campaigns.id as campaign_id, subscribers.id AS subscriber_id FROM campaigns
+    SELECT campaigns.id as campaign_id, subscribers.id AS subscriber_id, campaigns.metadata FROM campaigns
     LEFT JOIN subscribers ON (subscribers.uuid = $2)
     WHERE campaigns.uuid = $1
 )
-INSERT INTO campaign_views (campaign_id, subscriber_id)
-    VALUES((SELECT campaign_id FROM view), (SELECT subscriber_id FROM view));
+INSERT INTO campaign_views (campaign_id, subscriber_id, metadata)
+    VALUES((SELECT campaign_id FROM view), (SELECT subscriber_id FROM view), COALESCE((SELECT metadata FROM view), '{}'));
 
--- users
--- name: get-users
-SELECT * FROM users WHERE $1 = 0 OR id = $1 OFFSET $2 LIMIT $3;
+-- name: insert-bounce
+-- Records a bounce or a complaint ($6) of a subscriber identified by the UUID
+-- ($1) or if it's empty, the e-mail ($2), on an optional campaign UUID ($3).
+WITH sub AS (
+    SELECT id FROM subscribers
+    WHERE ($1 != '' AND uuid = NULLIF($1, '')::UUID) OR ($1 = '' AND LOWER(email) = LOWER($2))
+)
+INSERT INTO bounces (subscriber_id, campaign_id, source, meta, type)
+    SELECT (SELECT id FROM sub), (SELECT id FROM campaigns WHERE uuid = NULLIF($3, '')::UUID), $4, $5, $6
+    WHERE EXISTS (SELECT 1 FROM sub)
+    RETURNING id;
+
+-- name: insert-reply
+-- Records a reply of a subscriber identified by the UUID ($1) or if it's
+-- empty, the e-mail ($2), to an optional campaign UUID ($3). Replies with
+-- a Message-ID ($4) are recorded once.
+WITH sub AS (
+    SELECT id FROM subscribers
+    WHERE ($1 != '' AND uuid = NULLIF($1, '')::UUID) OR ($1 = '' AND LOWER(email) = LOWER($2))
+)
+INSERT INTO replies (subscriber_id, campaign_id, message_id, from_email, subject)
+    SELECT (SELECT id FROM sub), (SELECT id FROM campaigns WHERE uuid = NULLIF($3, '')::UUID), $4, $5, $6
+    WHERE EXISTS (SELECT 1 FROM sub)
+    ON CONFLICT (message_id) WHERE message_id != '' DO NOTHING
+    RETURNING id;
+
+-- name: insert-campaign-failures
+-- Records the subscribers that campaign messages failed to be sent to, given
+-- parallel arrays of campaign IDs, subscriber IDs, errors, and whether the
+-- failures are permanent.
+INSERT INTO campaign_failures (campaign_id, subscriber_id, error, permanent)
+    SELECT DISTINCT ON (f.campaign_id, f.subscriber_id) f.* FROM
+        UNNEST($1::INT[], $2::INT[], $3::TEXT[], $4::BOOLEAN[]) AS f(campaign_id, subscriber_id, error, permanent)
+    -- Subscribers may have been deleted since.
+    WHERE EXISTS (SELECT 1 FROM subscribers WHERE id = f.subscriber_id)
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE
+    SET error = EXCLUDED.error, permanent = EXCLUDED.permanent, created_at = NOW();
+
+-- name: insert-campaign-deliveries
+-- Records the subscribers that campaign messages were delivered to, given
+-- parallel arrays of campaign IDs and subscriber IDs. Redeliveries of campaigns
+-- that allow resends update the time.
+INSERT INTO campaign_deliveries (campaign_id, subscriber_id)
+    SELECT DISTINCT d.campaign_id, d.subscriber_id FROM UNNEST($1::INT[], $2::INT[]) AS d(campaign_id, subscriber_id)
+    -- Subscribers may have been deleted since.
+    WHERE EXISTS (SELECT 1 FROM subscribers WHERE id = d.subscriber_id)
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE SET created_at = NOW();
+
+-- name: get-campaign-failure-counts
+-- Counts of the failed recipients of a campaign that can be resent to and
+-- that have failed permanently, either due to a permanent error or a bounce.
+SELECT COUNT(*) FILTER (WHERE retryable) AS retryable,
+    COUNT(*) FILTER (WHERE NOT retryable) AS permanent
+FROM (
+    SELECT NOT f.permanent AND NOT EXISTS (
+        SELECT 1 FROM bounces WHERE campaign_id = f.campaign_id AND subscriber_id = f.subscriber_id
+    ) AS retryable
+    FROM campaign_failures f WHERE f.campaign_id = $1
+) t;
+
+-- name: register-conversion
+-- Records a conversion for a campaign and subscriber. A conversion with a
+-- ref that's already been recorded for the campaign is ignored.
+INSERT INTO conversions (campaign_id, subscriber_id, value, ref)
+    SELECT campaigns.id, subscribers.id, $3, NULLIF($4, '') FROM campaigns
+    LEFT JOIN subscribers ON (subscribers.uuid = $2)
+    WHERE campaigns.uuid = $1
+    ON CONFLICT (campaign_id, ref) DO NOTHING;
 
--- name: create-user
-INSERT INTO users (email, name, password, type, status) VALUES($1, $2, $3, $4, $5) RETURNING id;
+-- segments
+-- name: get-segments
+SELECT * FROM segments WHERE $1 = 0 OR id = $1 ORDER BY created_at;
 
--- name: update-user
-UPDATE users SET
-    email=(CASE WHEN $2 != '' THEN $2 ELSE email END),
-    name=(CASE WHEN $3 != '' THEN $3 ELSE name END),
-    password=(CASE WHEN $4 != '' THEN $4 ELSE password END),
-    type=(CASE WHEN $5 != '' THEN $5::user_type ELSE type END),
-    status=(CASE WHEN $6 != '' THEN $6::user_status ELSE status END),
+-- name: create-segment
+INSERT INTO segments (uuid, name, rules) VALUES($1, $2, $3) RETURNING id;
+
+-- name: update-segment
+UPDATE segments SET
+    name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
+    rules=$3,
     updated_at=NOW()
 WHERE id = $1;
 
--- name: delete-user
--- Delete a user, except for the primordial super admin.
-DELETE FROM users WHERE $1 != 1 AND id=$1;
+-- name: delete-segment
+DELETE FROM segments WHERE id = $1;
+
+-- name: count-segment-subscribers
+-- raw: true
+-- Unprepared statement for counting the subscribers matching a compiled
+-- segment expression.
+-- %s = compiled segment expression
+SELECT COUNT(*) FROM subscribers WHERE %s;
+
+-- attribute indexes
+-- name: get-attrib-indexes
+SELECT * FROM attrib_indexes ORDER BY key;
+
+-- name: get-ready-attrib-indexes
+SELECT key FROM attrib_indexes WHERE status = 'ready';
+
+-- name: upsert-attrib-index
+-- Adds an indexed key or retries a failed one. Keys that are being dropped
+-- can't be re-added until they're dropped.
+INSERT INTO attrib_indexes (key) VALUES($1)
+    ON CONFLICT (key) DO UPDATE SET status='pending', error='', updated_at=NOW()
+    WHERE attrib_indexes.status = 'failed'
+    RETURNING *;
+
+-- name: update-attrib-index-status
+UPDATE attrib_indexes SET status=$2, error=$3, updated_at=NOW() WHERE key = $1;
+
+-- name: drop-attrib-index
+UPDATE attrib_indexes SET status='dropping', updated_at=NOW()
+    WHERE key = $1 AND status != 'dropping' RETURNING *;
+
+-- name: delete-attrib-index
+DELETE FROM attrib_indexes WHERE key = $1;
+
+-- name: get-invalid-index
+-- Returns the name of an index if it's invalid, eg: left behind by a
+-- concurrent build that failed midway.
+SELECT c.relname FROM pg_class c
+    INNER JOIN pg_index i ON (i.indexrelid = c.oid)
+    WHERE c.relname = $1 AND NOT i.indisvalid;
+
+-- name: create-attrib-index
+-- raw: true
+-- Unprepared statement for creating an expression index on a subscriber
+-- attribute. It can't run in a transaction.
+-- %s = index name, %s = attribute operator (-> or ->>), %s = quoted key
+CREATE INDEX CONCURRENTLY IF NOT EXISTS %s ON subscribers ((attribs%s%s));
+
+-- name: drop-index
+-- raw: true
+-- %s = index name
+DROP INDEX CONCURRENTLY IF EXISTS %s;
+
+-- list rules
+-- name: get-list-rules
+SELECT * FROM list_rules WHERE $1 = 0 OR id = $1 ORDER BY id;
+
+-- name: create-list-rule
+INSERT INTO list_rules (name, list_id, rules, remove_unmatched, enabled)
+    VALUES($1, $2, $3, $4, $5) RETURNING id;
+
+-- name: update-list-rule
+UPDATE list_rules SET
+    name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
+    list_id=(CASE WHEN $3 > 0 THEN $3 ELSE list_id END),
+    rules=$4,
+    remove_unmatched=$5,
+    enabled=$6,
+    updated_at=NOW()
+WHERE id = $1;
+
+-- name: delete-list-rule
+DELETE FROM list_rules WHERE id = $1;
+
+-- name: add-list-rule-subscribers
+-- raw: true
+-- Unprepared statement for adding subscribers matching a list rule's compiled
+-- expression to its list. Blacklisted subscribers are never added.
+-- $1 = list ID, $2 = optional subscriber IDs and $3 = optional e-mails to
+-- limit the subscribers to. If both are NULL, all subscribers are considered.
+-- %s = compiled rule expression
+WITH subs AS (
+    INSERT INTO subscriber_lists (subscriber_id, list_id)
+    SELECT subscribers.id, $1 FROM subscribers
+    WHERE subscribers.status != 'blacklisted'
+        AND ($2::INT[] IS NULL OR subscribers.id = ANY($2::INT[]))
+        AND ($3::TEXT[] IS NULL OR subscribers.email = ANY($3::TEXT[]))
+        AND (%s)
+    ON CONFLICT (subscriber_id, list_id) DO NOTHING
+    RETURNING subscriber_id
+)
+SELECT COUNT(*) FROM subs;
 
+-- name: remove-list-rule-subscribers
+-- raw: true
+-- Unprepared statement for removing subscribers that don't match a list
+-- rule's compiled expression from its list. Params are the same as
+-- add-list-rule-subscribers.
+-- %s = compiled rule expression
+WITH subs AS (
+    DELETE FROM subscriber_lists WHERE list_id = $1 AND subscriber_id IN (
+        SELECT subscribers.id FROM subscribers
+        WHERE ($2::INT[] IS NULL OR subscribers.id = ANY($2::INT[]))
+            AND ($3::TEXT[] IS NULL OR subscribers.email = ANY($3::TEXT[]))
+            AND NOT COALESCE((%s), false)
+    )
+    RETURNING subscriber_id
+)
+SELECT COUNT(*) FROM subs;
+
+-- name: count-list-rule-subscribers
+-- raw: true
+-- Unprepared statement for a dry-run of a list rule against all subscribers.
+-- Returns the number of subscribers matching the rule, and those that'd be
+-- added to and removed from the list ($1) by it.
+-- %s = compiled rule expression
+SELECT COUNT(*) FILTER (WHERE matched) AS matched,
+    COUNT(*) FILTER (WHERE matched AND NOT on_list AND status != 'blacklisted') AS to_add,
+    COUNT(*) FILTER (WHERE NOT matched AND on_list) AS to_remove
+FROM (
+    SELECT subscribers.status, COALESCE((%s), false) AS matched,
+        EXISTS (
+            SELECT 1 FROM subscriber_lists
+            WHERE subscriber_id = subscribers.id AND list_id = $1
+        ) AS on_list
+    FROM subscribers
+) t;
+
+-- welcome steps
+-- name: get-welcome-steps
+SELECT id, list_id, position, COALESCE(template_id, 0) AS template_id,
+    COALESCE(campaign_id, 0) AS campaign_id, subject, body,
+    EXTRACT(EPOCH FROM delay)::INT AS delay, created_at, updated_at
+    FROM welcome_steps WHERE list_id = $1 ORDER BY position;
+
+-- name: delete-welcome-steps
+DELETE FROM welcome_steps WHERE list_id = $1;
+
+-- name: insert-welcome-step
+-- $3 = template ID (0 for the default template), $6 = delay in seconds,
+-- $7 = campaign ID (0 for none).
+INSERT INTO welcome_steps (list_id, position, template_id, subject, body, delay, campaign_id)
+    VALUES($1, $2, NULLIF($3, 0), $4, $5, $6 * INTERVAL '1 second', NULLIF($7, 0));
+
+-- name: queue-welcome-messages
+-- Queues the welcome steps of the lists ($2) that a subscriber ($1) has
+-- confirmed, each after the sum of the delays up to it. Steps that were
+-- already queued for the subscriber aren't queued again.
+WITH sub AS (
+    SELECT id FROM subscribers WHERE uuid = $1::UUID
+)
+INSERT INTO welcome_queue (step_id, subscriber_id, send_at)
+    SELECT welcome_steps.id, (SELECT id FROM sub),
+        NOW() + SUM(welcome_steps.delay) OVER (PARTITION BY welcome_steps.list_id ORDER BY welcome_steps.position)
+    FROM welcome_steps
+    INNER JOIN lists ON (lists.id = welcome_steps.list_id)
+    INNER JOIN subscriber_lists ON (subscriber_lists.list_id = lists.id AND subscriber_lists.subscriber_id = (SELECT id FROM sub))
+    WHERE lists.uuid = ANY($2::UUID[]) AND subscriber_lists.status = 'confirmed'
+    ON CONFLICT (step_id, subscriber_id) DO NOTHING;
+
+-- name: next-welcome-messages
+-- Leases up to $1 welcome messages that are due for $2 seconds and returns
+-- them with the steps, their templates (or the default template), the
+-- messengers of the lists, and whether the subscribers are still subscribed
+-- to the lists and aren't blacklisted. The messages are dropped with
+-- delete-welcome-messages once they're sent (or aren't eligible), and the
+-- others are sent again when their leases are up.
+WITH due AS (
+    UPDATE welcome_queue SET send_at = NOW() + $2 * INTERVAL '1 second', attempts = attempts + 1
+    WHERE id = ANY(
+        SELECT id FROM welcome_queue WHERE send_at <= NOW()
+        ORDER BY send_at LIMIT $1 FOR UPDATE SKIP LOCKED
+    )
+    RETURNING id, step_id, subscriber_id, attempts
+)
+SELECT subscribers.*, due.id AS queue_id, due.attempts, welcome_steps.id AS step_id,
+    COALESCE(welcome_steps.campaign_id, 0) AS step_campaign_id, welcome_steps.subject AS step_subject,
+    welcome_steps.body AS step_body, lists.uuid AS list_uuid, lists.messenger AS list_messenger,
+    COALESCE(templates.body, '') AS template_body, COALESCE(templates.format, '') AS template_format,
+    COALESCE(subscriber_lists.status = 'confirmed' AND subscribers.status != 'blacklisted', false) AS eligible
+    FROM due
+    INNER JOIN welcome_steps ON (welcome_steps.id = due.step_id)
+    INNER JOIN lists ON (lists.id = welcome_steps.list_id)
+    INNER JOIN subscribers ON (subscribers.id = due.subscriber_id)
+    LEFT JOIN subscriber_lists ON (subscriber_lists.subscriber_id = subscribers.id AND subscriber_lists.list_id = lists.id)
+    LEFT JOIN templates ON (templates.id = COALESCE(welcome_steps.template_id,
+        (SELECT id FROM templates WHERE is_default = true LIMIT 1)))
+    ORDER BY welcome_steps.id;
+
+-- name: delete-welcome-messages
+DELETE FROM welcome_queue WHERE id = ANY($1::BIGINT[]);
+
+-- archive
+-- name: get-archive-list
+-- Returns a public list ($1 = UUID) for its archive page.
+SELECT * FROM lists WHERE uuid = $1 AND type = 'public';
+
+-- name: get-archived-campaigns
+-- Returns the campaigns in the archive of a list ($1) that have started and
+-- aren't simulations, latest first, with the subjects they were sent with.
+SELECT COUNT(*) OVER () AS total, campaigns.uuid,
+    COALESCE(campaigns.snapshot->>'subject', campaigns.subject) AS subject, campaigns.started_at
+    FROM campaigns INNER JOIN campaign_lists ON (campaign_lists.campaign_id = campaigns.id)
+    WHERE campaign_lists.list_id = $1 AND campaigns.archive = true AND campaigns.started_at IS NOT NULL
+        AND NOT campaigns.simulate
+    ORDER BY campaigns.started_at DESC OFFSET $2 LIMIT $3;
+
+-- sequences
+-- name: get-sequences
+-- Returns the sequences ($1 = 0 for all) with their steps and the numbers of
+-- their subscribers by status.
+SELECT sequences.*,
+    COALESCE((SELECT JSON_AGG(JSON_BUILD_OBJECT('position', s.position, 'campaign_id', s.campaign_id,
+        'campaign_name', campaigns.name, 'delay', EXTRACT(EPOCH FROM s.delay)::INT) ORDER BY s.position)
+        FROM sequence_steps s INNER JOIN campaigns ON (campaigns.id = s.campaign_id)
+        WHERE s.sequence_id = sequences.id), '[]') AS steps,
+    (SELECT JSON_BUILD_OBJECT('active', COUNT(*) FILTER (WHERE status = 'active'),
+        'finished', COUNT(*) FILTER (WHERE status = 'finished'),
+        'exited', COUNT(*) FILTER (WHERE status = 'exited'))
+        FROM sequence_subscribers WHERE sequence_id = sequences.id) AS subscribers
+    FROM sequences WHERE $1 = 0 OR id = $1 ORDER BY id;
+
+-- name: create-sequence
+-- Only the events after the creation of a sequence enroll subscribers.
+INSERT INTO sequences (name, trigger, trigger_url, enabled)
+    VALUES($1, $2, $3, $4) RETURNING id;
+
+-- name: update-sequence
+-- Sequences that are re-enabled pick up the events from then on.
+UPDATE sequences SET
+    name=$2,
+    trigger=$3,
+    trigger_url=$4,
+    scanned_at=(CASE WHEN $5 AND NOT enabled THEN NOW() ELSE scanned_at END),
+    enabled=$5,
+    updated_at=NOW()
+WHERE id = $1;
+
+-- name: delete-sequence
+DELETE FROM sequences WHERE id = $1;
+
+-- name: delete-sequence-steps
+DELETE FROM sequence_steps WHERE sequence_id = $1;
+
+-- name: insert-sequence-step
+-- $4 = delay in seconds.
+INSERT INTO sequence_steps (sequence_id, position, campaign_id, delay)
+    VALUES($1, $2, $3, $4 * INTERVAL '1 second');
+
+-- name: get-sequence-subscribers
+-- Returns the subscribers of a sequence ($1), optionally by their status ($2),
+-- latest enrollments first.
+SELECT COUNT(*) OVER () AS total, ss.subscriber_id, subscribers.uuid AS subscriber_uuid,
+    subscribers.email, subscribers.name, ss.step, ss.status, ss.send_at, ss.last_sent_at,
+    ss.created_at, ss.updated_at
+    FROM sequence_subscribers ss
+    INNER JOIN subscribers ON (subscribers.id = ss.subscriber_id)
+    WHERE ss.sequence_id = $1 AND ($2 = '' OR ss.status = $2)
+    ORDER BY ss.created_at DESC, ss.subscriber_id
+    OFFSET $3 LIMIT (CASE WHEN $4 = 0 THEN NULL ELSE $4 END);
+
+-- name: enroll-sequence-subscribers
+-- Enrolls the subscribers that have clicked the trigger links of the enabled
+-- sequences since they were last scanned, with a minute of overlap for the
+-- events that were being committed, and returns the number of new
+-- enrollments. Subscribers are enrolled once per sequence and blacklisted
+-- ones are skipped.
+WITH seqs AS (
+    SELECT id, trigger, trigger_url, scanned_at - INTERVAL '1 minute' AS since
+    FROM sequences WHERE enabled = true
+),
+scan AS (
+    UPDATE sequences SET scanned_at = NOW() WHERE id IN (SELECT id FROM seqs)
+),
+events AS (
+    SELECT DISTINCT seqs.id AS sequence_id, lc.subscriber_id FROM seqs
+        INNER JOIN links ON (links.url = seqs.trigger_url)
+        INNER JOIN link_clicks lc ON (lc.link_id = links.id)
+        WHERE seqs.trigger = 'link_click' AND lc.subscriber_id IS NOT NULL AND lc.created_at >= seqs.since
+),
+ins AS (
+    INSERT INTO sequence_subscribers (sequence_id, subscriber_id, step, send_at)
+        SELECT events.sequence_id, events.subscriber_id, first_step.position, NOW() + first_step.delay FROM events
+        INNER JOIN subscribers ON (subscribers.id = events.subscriber_id)
+        INNER JOIN LATERAL (SELECT position, delay FROM sequence_steps WHERE sequence_id = events.sequence_id
+            ORDER BY position LIMIT 1) first_step ON true
+        WHERE subscribers.status != 'blacklisted'
+        ON CONFLICT DO NOTHING
+        RETURNING 1
+)
+SELECT COUNT(*) FROM ins;
+
+-- name: next-sequence-messages
+-- Leases up to $1 subscribers whose steps in the enabled sequences are due for
+-- $2 seconds and returns them with the campaigns of the due steps (0 if the
+-- campaigns have been deleted) and whether they're still eligible, ie: not
+-- blacklisted. They're moved on to the next steps with advance-sequence-subscriber
+-- once the steps are sent, and the steps of the others are sent again when their
+-- leases are up.
+WITH due AS (
+    SELECT ss.sequence_id, ss.subscriber_id FROM sequence_subscribers ss
+    INNER JOIN sequences ON (sequences.id = ss.sequence_id AND sequences.enabled = true)
+    WHERE ss.status = 'active' AND ss.send_at <= NOW()
+    ORDER BY ss.send_at LIMIT $1
+    FOR UPDATE OF ss SKIP LOCKED
+),
+leased AS (
+    UPDATE sequence_subscribers ss SET send_at = NOW() + $2 * INTERVAL '1 second', attempts = ss.attempts + 1
+    FROM due WHERE ss.sequence_id = due.sequence_id AND ss.subscriber_id = due.subscriber_id
+    RETURNING ss.sequence_id, ss.subscriber_id, ss.step, ss.attempts
+)
+SELECT subscribers.*, leased.sequence_id, leased.step, leased.attempts,
+    COALESCE(st.campaign_id, 0) AS campaign_id, subscribers.status != 'blacklisted' AS eligible
+    FROM leased
+    INNER JOIN subscribers ON (subscribers.id = leased.subscriber_id)
+    LEFT JOIN sequence_steps st ON (st.sequence_id = leased.sequence_id AND st.position = leased.step)
+    ORDER BY campaign_id;
+
+-- name: advance-sequence-subscriber
+-- Moves a subscriber ($2) in a sequence ($1) from a step ($3) on to the next
+-- step, or finishes the sequence after the last step. Subscribers that aren't
+-- eligible ($4 = false) exit the sequence instead. $5 is whether the step was sent.
+WITH next_step AS (
+    SELECT position, delay FROM sequence_steps WHERE sequence_id = $1 AND position > $3
+    ORDER BY position LIMIT 1
+)
+UPDATE sequence_subscribers SET
+    step = COALESCE((SELECT position FROM next_step), step),
+    status = (CASE WHEN NOT $4 THEN 'exited' WHEN NOT EXISTS (SELECT 1 FROM next_step) THEN 'finished' ELSE 'active' END),
+    send_at = (CASE WHEN $4 THEN NOW() + (SELECT delay FROM next_step) END),
+    last_sent_at = (CASE WHEN $5 THEN NOW() ELSE last_sent_at END),
+    attempts = 0,
+    updated_at = NOW()
+WHERE sequence_id = $1 AND subscriber_id = $2 AND step = $3;
 
 -- templates
 -- name: get-templates
 -- Only if the second param ($2) is true, body is returned.
-SELECT id, name, (CASE WHEN $2 = false THEN body ELSE '' END) as body,
-    is_default, created_at, updated_at
+SELECT id, uuid, name, (CASE WHEN $2 = false THEN body ELSE '' END) as body,
+    is_default, format, created_at, updated_at
     FROM templates WHERE $1 = 0 OR id = $1
     ORDER BY created_at;
 
 -- name: create-template
-INSERT INTO templates (name, body) VALUES($1, $2) RETURNING id;
+INSERT INTO templates (name, body, format, uuid) VALUES($1, $2, $3, $4) RETURNING id;
 
 -- name: update-template
 UPDATE templates SET
     name=(CASE WHEN $2 != '' THEN $2 ELSE name END),
     body=(CASE WHEN $3 != '' THEN $3 ELSE body END),
+    format=(CASE WHEN $4 != '' THEN $4 ELSE format END),
     updated_at=NOW()
 WHERE id = $1;
 
@@ -665,35 +2259,180 @@ SELECT * FROM media WHERE provider=$1 ORDER BY created_at DESC;
 -- name: delete-media
 DELETE FROM media WHERE id=$1 RETURNING filename;
 
+-- name: get-media-migration
+-- Returns the media of a provider ($1) with their copies on another provider ($2), if any.
+SELECT src.*, COALESCE(dst.filename, '') AS dst_filename, COALESCE(dst.thumb, '') AS dst_thumb
+    FROM media src
+    LEFT JOIN media dst ON (dst.migrated_from = src.id AND dst.provider = $2)
+    WHERE src.provider = $1 ORDER BY src.id;
+
+-- name: save-migrated-media
+-- Records the copy of a media ($5) on another provider ($4).
+WITH u AS (
+    UPDATE media SET filename=$2, thumb=$3 WHERE provider=$4 AND migrated_from=$5 RETURNING id
+)
+INSERT INTO media (uuid, filename, thumb, provider, migrated_from, created_at)
+    SELECT $1, $2, $3, $4, $5, $6 WHERE NOT EXISTS (SELECT 1 FROM u);
+
+-- name: rewrite-media-urls
+-- Replaces a media URL ($1) with another ($2) in the stored content of templates,
+-- welcome steps, and campaigns (including their variants and snapshots) and
+-- returns the number of updated records.
+WITH t AS (
+    UPDATE templates SET body=REPLACE(body, $1, $2), updated_at=NOW()
+    WHERE STRPOS(body, $1) > 0 RETURNING id
+),
+w AS (
+    UPDATE welcome_steps SET body=REPLACE(body, $1, $2), updated_at=NOW()
+    WHERE STRPOS(body, $1) > 0 RETURNING id
+),
+c AS (
+    UPDATE campaigns SET body=REPLACE(body, $1, $2),
+        variants=REPLACE(variants::TEXT, $1, $2)::JSONB,
+        snapshot=REPLACE(snapshot::TEXT, $1, $2)::JSONB
+    WHERE STRPOS(body, $1) > 0 OR STRPOS(variants::TEXT, $1) > 0 OR STRPOS(COALESCE(snapshot::TEXT, ''), $1) > 0
+    RETURNING id
+)
+SELECT (SELECT COUNT(*) FROM t) + (SELECT COUNT(*) FROM w) + (SELECT COUNT(*) FROM c);
+
 -- links
 -- name: create-link
 INSERT INTO links (uuid, url) VALUES($1, $2) ON CONFLICT (url) DO UPDATE SET url=EXCLUDED.url RETURNING uuid;
 
 -- name: register-link-click
 WITH link AS (
-    SELECT url, links.id AS link_id, campaigns.id as campaign_id, subscribers.id AS subscriber_id FROM links
+    SELECT url, links.id AS link_id, campaigns.id as campaign_id, subscribers.id AS subscriber_id, campaigns.metadata FROM links
     LEFT JOIN campaigns ON (campaigns.uuid = $2)
     LEFT JOIN subscribers ON (subscribers.uuid = $3)
     WHERE links.uuid = $1
 )
-INSERT INTO link_clicks (campaign_id, subscriber_id, link_id)
-    VALUES((SELECT campaign_id FROM link), (SELECT subscriber_id FROM link), (SELECT link_id FROM link))
+INSERT INTO link_clicks (campaign_id, subscriber_id, link_id, metadata)
+    VALUES((SELECT campaign_id FROM link), (SELECT subscriber_id FROM link), (SELECT link_id FROM link),
+        COALESCE((SELECT metadata FROM link), '{}'))
     RETURNING (SELECT url FROM link);
 
+-- name: get-link-url
+SELECT url FROM links WHERE uuid = $1;
+
+-- name: get-tracking-event
+-- The campaign ($1), the subscriber ($2), and the optional link ($3) of a
+-- campaign view or a link click for the webhooks of tracking events.
+SELECT campaigns.id AS campaign_id, campaigns.uuid AS campaign_uuid, campaigns.name AS campaign_name,
+    campaigns.metadata AS campaign_metadata,
+    subscribers.id AS subscriber_id, subscribers.uuid AS subscriber_uuid, subscribers.email AS subscriber_email,
+    subscribers.name AS subscriber_name, subscribers.attribs AS subscriber_attribs,
+    links.id AS link_id, COALESCE(links.url, '') AS link_url
+    FROM campaigns
+    LEFT JOIN subscribers ON (subscribers.uuid = $2::UUID)
+    LEFT JOIN links ON ($3 != '' AND links.uuid = NULLIF($3, '')::UUID)
+    WHERE campaigns.uuid = $1;
+
+-- name: create-short-link
+-- Returns the short code of the link ($2) of a campaign ($1), creating it
+-- with the code $3 if it doesn't exist.
+WITH link AS (
+    SELECT id FROM links WHERE uuid = $2
+),
+ins AS (
+    INSERT INTO short_links (code, campaign_id, link_id) SELECT $3, $1, id FROM link
+    ON CONFLICT (campaign_id, link_id) DO NOTHING
+    RETURNING code
+)
+SELECT code FROM ins
+UNION ALL
+SELECT code FROM short_links WHERE campaign_id = $1 AND link_id = (SELECT id FROM link)
+LIMIT 1;
+
+-- name: register-short-link-click
+-- Records a click on a short link and returns its URL.
+WITH sl AS (
+    UPDATE short_links SET clicks = clicks + 1 WHERE code = $1 RETURNING campaign_id, link_id
+),
+ins AS (
+    INSERT INTO link_clicks (campaign_id, link_id, metadata)
+        SELECT sl.campaign_id, sl.link_id, campaigns.metadata FROM sl
+        INNER JOIN campaigns ON (campaigns.id = sl.campaign_id)
+)
+SELECT url FROM links WHERE id = (SELECT link_id FROM sl);
+
+-- name: get-short-link-url
+SELECT url FROM links WHERE id = (SELECT link_id FROM short_links WHERE code = $1);
+
+-- name: get-campaign-short-links
+SELECT short_links.code, links.url, short_links.clicks, short_links.created_at FROM short_links
+    INNER JOIN links ON (links.id = short_links.link_id)
+    WHERE short_links.campaign_id = $1
+    ORDER BY short_links.clicks DESC, links.url;
+
+-- name: register-provider-link-click
+-- Records a click on a URL ($1) that's reported by the e-mail provider in a
+-- campaign ($2) by a subscriber ($3), registering the URL with a new UUID ($4)
+-- if it isn't already.
+WITH link AS (
+    INSERT INTO links (uuid, url) VALUES($4, $1) ON CONFLICT (url) DO UPDATE SET url=EXCLUDED.url RETURNING id
+)
+INSERT INTO link_clicks (campaign_id, subscriber_id, link_id, metadata)
+    SELECT campaigns.id, (SELECT id FROM subscribers WHERE uuid = $3), (SELECT id FROM link), campaigns.metadata
+    FROM campaigns WHERE uuid = $2;
+
+
+-- name: purge-campaign-views
+-- Deletes a batch of up to $2 campaign views older than $1. If $3 = true,
+-- the deleted views are rolled up into daily counts.
+WITH del AS (
+    DELETE FROM campaign_views WHERE ctid = ANY(ARRAY(
+        SELECT ctid FROM campaign_views WHERE created_at < $1 LIMIT $2
+    ))
+    RETURNING campaign_id, created_at
+),
+rollup AS (
+    INSERT INTO campaign_views_daily (campaign_id, date, count)
+    SELECT campaign_id, created_at::DATE, COUNT(*) FROM del
+    WHERE $3 = true
+    GROUP BY campaign_id, created_at::DATE
+    ON CONFLICT (campaign_id, date) DO UPDATE
+    SET count = campaign_views_daily.count + EXCLUDED.count
+)
+SELECT COUNT(*) FROM del;
+
+-- name: purge-link-clicks
+-- Deletes a batch of up to $2 link clicks older than $1. If $3 = true,
+-- the deleted clicks are rolled up into daily counts.
+WITH del AS (
+    DELETE FROM link_clicks WHERE ctid = ANY(ARRAY(
+        SELECT ctid FROM link_clicks WHERE created_at < $1 LIMIT $2
+    ))
+    RETURNING campaign_id, link_id, created_at
+),
+rollup AS (
+    INSERT INTO link_clicks_daily (campaign_id, link_id, date, count)
+    SELECT campaign_id, link_id, created_at::DATE, COUNT(*) FROM del
+    WHERE $3 = true AND campaign_id IS NOT NULL AND link_id IS NOT NULL
+    GROUP BY campaign_id, link_id, created_at::DATE
+    ON CONFLICT (campaign_id, link_id, date) DO UPDATE
+    SET count = link_clicks_daily.count + EXCLUDED.count
+)
+SELECT COUNT(*) FROM del;
 
 -- name: get-dashboard-charts
 WITH clicks AS (
     -- Clicks by day for the last 3 months
     SELECT JSON_AGG(ROW_TO_JSON(row))
-    FROM (SELECT COUNT(*) AS count, created_at::DATE as date
-          FROM link_clicks GROUP by date ORDER BY date DESC LIMIT 100
+    FROM (SELECT SUM(count) AS count, date FROM (
+            SELECT COUNT(*) AS count, created_at::DATE as date FROM link_clicks GROUP by date
+            UNION ALL
+            SELECT SUM(count) AS count, date FROM link_clicks_daily GROUP BY date
+          ) c GROUP BY date ORDER BY date DESC LIMIT 100
     ) row
 ),
 views AS (
     -- Views by day for the last 3 months
     SELECT JSON_AGG(ROW_TO_JSON(row))
-    FROM (SELECT COUNT(*) AS count, created_at::DATE as date
-          FROM campaign_views GROUP by date ORDER BY date DESC LIMIT 100
+    FROM (SELECT SUM(count) AS count, date FROM (
+            SELECT COUNT(*) AS count, created_at::DATE as date FROM campaign_views GROUP by date
+            UNION ALL
+            SELECT SUM(count) AS count, date FROM campaign_views_daily GROUP BY date
+          ) v GROUP BY date ORDER BY date DESC LIMIT 100
     ) row
 )
 SELECT JSON_BUILD_OBJECT('link_clicks', COALESCE((SELECT * FROM clicks), '[]'),
@@ -721,6 +2460,243 @@ SELECT JSON_BUILD_OBJECT('subscribers', JSON_BUILD_OBJECT(
                             'by_status', (
                                 SELECT JSON_OBJECT_AGG (status, num) FROM
                                 (SELECT status, COUNT(*) AS num FROM campaigns GROUP BY status) r
+                            ),
+                            -- Campaigns, messages, views, and clicks by category ('' is uncategorized).
+                            'by_category', (
+                                SELECT JSON_OBJECT_AGG (category, JSON_BUILD_OBJECT(
+                                    'total', num, 'sent', sent, 'views', views, 'clicks', clicks)) FROM
+                                (SELECT category, COUNT(*) AS num, COALESCE(SUM(sent), 0) AS sent,
+                                    COALESCE(SUM(
+                                        (SELECT COUNT(*) FROM campaign_views WHERE campaign_id = c.id) +
+                                        (SELECT COALESCE(SUM(count), 0) FROM campaign_views_daily WHERE campaign_id = c.id)
+                                    ), 0) AS views,
+                                    COALESCE(SUM(
+                                        (SELECT COUNT(*) FROM link_clicks WHERE campaign_id = c.id) +
+                                        (SELECT COALESCE(SUM(count), 0) FROM link_clicks_daily WHERE campaign_id = c.id)
+                                    ), 0) AS clicks
+                                FROM campaigns c GROUP BY category) r
                             )
                         ),
                         'messages', (SELECT SUM(sent) AS messages FROM campaigns));
+
+
+-- jobs
+-- name: create-job
+INSERT INTO jobs (type, params) VALUES($1, $2) RETURNING id;
+
+-- name: get-job
+-- rate is the throughput (done per second) of the job while it was running.
+SELECT *, (CASE WHEN started_at IS NULL THEN 0
+    ELSE done / GREATEST(EXTRACT(EPOCH FROM COALESCE(finished_at, updated_at) - started_at), 1) END) AS rate
+    FROM jobs WHERE id = $1;
+
+-- name: query-jobs
+-- Get jobs optionally filtered by type and status.
+SELECT COUNT(*) OVER () AS total_rows, *, (CASE WHEN started_at IS NULL THEN 0
+    ELSE done / GREATEST(EXTRACT(EPOCH FROM COALESCE(finished_at, updated_at) - started_at), 1) END) AS rate
+    FROM jobs
+    WHERE ($1 = '' OR type = $1) AND ($2 = '' OR status::TEXT = $2)
+    ORDER BY id DESC
+    OFFSET $3 LIMIT (CASE WHEN $4 = 0 THEN NULL ELSE $4 END);
+
+-- name: claim-job
+-- Mark the oldest queued job of a type as running and return it.
+UPDATE jobs SET status='running', started_at=COALESCE(started_at, NOW()), updated_at=NOW()
+    WHERE id = (
+        SELECT id FROM jobs WHERE type = $1 AND status = 'queued'
+        ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+    )
+    RETURNING *;
+
+-- name: update-job-progress
+-- Update the progress of a running job and return whether it's been cancelled.
+UPDATE jobs SET total=$2, done=$3, state=COALESCE($4, state), updated_at=NOW()
+    WHERE id = $1
+    RETURNING cancel;
+
+-- name: finish-job
+UPDATE jobs SET status=$2, error=$3, total=$4, done=$5, result=$6::JSONB, updated_at=NOW(), finished_at=NOW()
+    WHERE id = $1;
+
+-- name: cancel-job
+-- Cancel a queued job right away, or request a running job to be cancelled.
+UPDATE jobs SET cancel=true,
+    status=(CASE WHEN status='queued' THEN 'cancelled' ELSE status END),
+    finished_at=(CASE WHEN status='queued' THEN NOW() ELSE finished_at END),
+    updated_at=NOW()
+    WHERE id = $1 AND status IN ('queued', 'running')
+    RETURNING *;
+
+-- name: recover-jobs
+-- Requeue the jobs that were running when the app stopped if their type ($1)
+-- can be resumed. The rest are marked as interrupted (or cancelled, if that
+-- was requested).
+UPDATE jobs SET
+    status=(CASE WHEN cancel THEN 'cancelled'::job_status
+        WHEN type = ANY($1::TEXT[]) THEN 'queued'
+        ELSE 'interrupted' END),
+    finished_at=(CASE WHEN type = ANY($1::TEXT[]) AND NOT cancel THEN NULL ELSE NOW() END),
+    updated_at=NOW()
+    WHERE status = 'running';
+
+-- webhooks
+-- name: queue-webhook-deliveries
+INSERT INTO webhook_deliveries (endpoint, event, body) SELECT UNNEST($1::TEXT[]), $2, $3;
+
+-- name: claim-webhook-deliveries
+-- Defer the due deliveries of the endpoints ($1) by a lease ($3 seconds) and return them.
+UPDATE webhook_deliveries SET next_at = NOW() + $3::FLOAT * INTERVAL '1 second'
+    WHERE id IN (
+        SELECT id FROM webhook_deliveries WHERE endpoint = ANY($1::TEXT[]) AND next_at <= NOW()
+        ORDER BY next_at, id LIMIT $2 FOR UPDATE SKIP LOCKED
+    )
+    RETURNING *;
+
+-- name: delete-webhook-delivery
+DELETE FROM webhook_deliveries WHERE id = $1;
+
+-- name: retry-webhook-delivery
+UPDATE webhook_deliveries SET attempts = $2, last_error = $3,
+    next_at = NOW() + $4::FLOAT * INTERVAL '1 second'
+    WHERE id = $1;
+
+-- name: dead-letter-webhook-delivery
+WITH d AS (
+    DELETE FROM webhook_deliveries WHERE id = $1 RETURNING *
+)
+INSERT INTO webhook_dead_letters (endpoint, event, body, attempts, last_error, created_at)
+    SELECT endpoint, event, body, $2, $3, created_at FROM d;
+
+-- name: query-webhook-dead-letters
+-- Dead-lettered deliveries optionally filtered by endpoint ($1) and event ($2).
+SELECT COUNT(*) OVER () AS total, * FROM webhook_dead_letters
+    WHERE ($1 = '' OR endpoint = $1) AND ($2 = '' OR event = $2)
+    ORDER BY id DESC
+    OFFSET $3 LIMIT (CASE WHEN $4 = 0 THEN NULL ELSE $4 END);
+
+-- name: get-webhook-dead-letter
+SELECT * FROM webhook_dead_letters WHERE id = $1;
+
+-- name: replay-webhook-dead-letters
+-- Move dead-lettered deliveries back to the queue with their retries reset.
+WITH d AS (
+    DELETE FROM webhook_dead_letters WHERE id = ANY($1::BIGINT[]) RETURNING *
+)
+INSERT INTO webhook_deliveries (endpoint, event, body, created_at)
+    SELECT endpoint, event, body, created_at FROM d
+    RETURNING id;
+
+-- name: delete-webhook-dead-letters
+DELETE FROM webhook_dead_letters WHERE id = ANY($1::BIGINT[]);
+
+-- exports
+-- name: export-subscribers
+-- raw: true
+-- Unprepared statement for exporting the subscribers of an optional list ($1)
+-- that match an arbitrary expression as JSON rows.
+-- %s = fields, %s = arbitrary expression
+SELECT ROW_TO_JSON(t) FROM (
+    SELECT %s FROM subscribers
+    WHERE ($1 = 0 OR subscribers.id IN (SELECT subscriber_id FROM subscriber_lists WHERE list_id = $1))
+    %s
+    ORDER BY subscribers.id
+) t;
+
+-- name: export-campaigns
+-- raw: true
+-- Unprepared statement for exporting the campaigns, with their stats, that
+-- match an arbitrary expression as JSON rows.
+-- %s = fields, %s = arbitrary expression
+SELECT ROW_TO_JSON(t) FROM (
+    SELECT %s FROM campaigns
+    LEFT JOIN LATERAL (
+        -- Live views and the rolled up counts of purged views.
+        SELECT (SELECT COUNT(*) FROM campaign_views WHERE campaign_id = campaigns.id) +
+            (SELECT COALESCE(SUM(count), 0) FROM campaign_views_daily WHERE campaign_id = campaigns.id) AS num
+    ) v ON true
+    LEFT JOIN LATERAL (
+        SELECT (SELECT COUNT(*) FROM link_clicks WHERE campaign_id = campaigns.id) +
+            (SELECT COALESCE(SUM(count), 0) FROM link_clicks_daily WHERE campaign_id = campaigns.id) AS num
+    ) c ON true
+    WHERE true
+    %s
+    ORDER BY campaigns.id
+) t;
+
+-- name: export-id-range
+-- raw: true
+-- Unprepared statement for getting the range of the IDs of the records of an export.
+-- %s = table
+SELECT COALESCE(MIN(id), 0), COALESCE(MAX(id), 0) FROM %s;
+
+-- name: export-snapshot
+-- raw: true
+-- Exports the snapshot of the transaction of an export, which the transactions of
+-- its workers are set to (set-export-snapshot) to read the same data.
+SELECT pg_export_snapshot();
+
+-- name: set-export-snapshot
+-- raw: true
+-- %s = snapshot ID
+SET TRANSACTION SNAPSHOT '%s';
+
+-- name: insert-export-file
+INSERT INTO export_files (export, file) VALUES($1, $2);
+
+-- name: get-expired-export-files
+-- Get the files of an export ($1) other than the latest $2.
+SELECT id, file FROM export_files WHERE export = $1
+    ORDER BY created_at DESC, id DESC OFFSET $2;
+
+-- name: delete-export-file
+DELETE FROM export_files WHERE id = $1;
+
+-- users
+-- name: get-users
+SELECT * FROM users WHERE $1 = 0 OR id = $1 ORDER BY id;
+
+-- name: get-user-by-email
+SELECT * FROM users WHERE LOWER(email) = LOWER($1) AND status = 'enabled';
+
+-- name: count-users
+SELECT COUNT(*) FROM users;
+
+-- name: create-user
+INSERT INTO users (email, name, password, role, status) VALUES($1, $2, $3, $4, $5) RETURNING id;
+
+-- name: update-user
+-- The password ($4) is only changed if it's set. The last enabled admin
+-- can't be demoted or disabled.
+UPDATE users SET
+    email=(CASE WHEN $2 != '' THEN $2 ELSE email END),
+    name=(CASE WHEN $3 != '' THEN $3 ELSE name END),
+    password=(CASE WHEN $4 != '' THEN $4 ELSE password END),
+    role=(CASE WHEN $5 != '' THEN $5::user_role ELSE role END),
+    status=(CASE WHEN $6 != '' THEN $6::user_status ELSE status END),
+    updated_at=NOW()
+WHERE id = $1 AND (
+    (COALESCE(NULLIF($5, ''), role::TEXT) = 'admin' AND COALESCE(NULLIF($6, ''), status::TEXT) = 'enabled') OR
+    EXISTS (SELECT 1 FROM users WHERE id != $1 AND role = 'admin' AND status = 'enabled')
+);
+
+-- name: delete-user
+-- The last enabled admin can't be deleted.
+DELETE FROM users WHERE id = $1
+    AND EXISTS (SELECT 1 FROM users WHERE id != $1 AND role = 'admin' AND status = 'enabled');
+
+-- rendered messages
+-- name: insert-rendered-message
+INSERT INTO rendered_messages (campaign_id, subscriber_id, headers, body) VALUES($1, $2, $3, $4);
+
+-- name: query-rendered-messages
+-- Logged messages, optionally of a campaign ($1), a subscriber ($2), and/or an e-mail ($3).
+SELECT COUNT(*) OVER () AS total, rendered_messages.*, subscribers.email FROM rendered_messages
+    INNER JOIN subscribers ON (subscribers.id = rendered_messages.subscriber_id)
+    WHERE ($1 = 0 OR rendered_messages.campaign_id = $1)
+    AND ($2 = 0 OR rendered_messages.subscriber_id = $2)
+    AND ($3 = '' OR LOWER(subscribers.email) = LOWER($3))
+    ORDER BY rendered_messages.id DESC
+    OFFSET $4 LIMIT (CASE WHEN $5 = 0 THEN NULL ELSE $5 END);
+
+-- name: purge-rendered-messages
+DELETE FROM rendered_messages WHERE created_at < $1;
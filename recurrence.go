@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/cron"
+	"github.com/knadh/listmonk/models"
+)
+
+// campaignFinished is invoked by the campaign manager with the campaigns that
+// finish sending to all their subscribers.
+func (app *App) campaignFinished(c *models.Campaign) {
+	app.sendCampaignFinished(c)
+	if !c.Simulate {
+		scheduleOccurrence(c.ID, app)
+	}
+}
+
+// scheduleOccurrence clones a finished recurring campaign into its next
+// occurrence, scheduled at the next time of its recurrence (in the server's
+// timezone), with fresh snapshots of its segments like when it's scheduled
+// by hand. Cancelled and aborted campaigns don't recur.
+func scheduleOccurrence(campID int, app *App) {
+	var cm models.Campaign
+	if err := app.queries.GetCampaign.Get(&cm, campID, nil); err != nil {
+		app.log.Printf("error fetching campaign: %v", err)
+		return
+	}
+	if cm.Recurrence == "" {
+		return
+	}
+
+	s, err := cron.ParseRule(cm.Recurrence)
+	if err != nil {
+		app.log.Printf("invalid recurrence '%s' of campaign (%s): %v", cm.Recurrence, cm.Name, err)
+		return
+	}
+	next := s.Next(time.Now())
+	if next.IsZero() {
+		app.log.Printf("recurrence '%s' of campaign (%s) doesn't occur again", cm.Recurrence, cm.Name)
+		return
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return
+	}
+
+	var id int
+	if err := app.queries.CreateCampaignOccurrence.Get(&id, cm.ID, uu, next, cm.Recurrence); err != nil {
+		if err != sql.ErrNoRows {
+			app.log.Printf("error creating the next occurrence of campaign (%s): %v", cm.Name, err)
+		}
+		return
+	}
+	if err := excludeCampaignSegment(id, cm.ExcludeSegmentID, app); err != nil {
+		app.log.Printf("error saving campaign exclusions: %v", err)
+	}
+	if err := snapshotCampaignSegments(id, app); err != nil {
+		app.log.Printf("error saving campaign segments: %v", err)
+	}
+
+	app.log.Printf("scheduled the next occurrence (%d) of campaign (%s) at %s",
+		id, cm.Name, next.Format(time.RFC3339))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// retentionConf represents the retention settings of tracking events.
+type retentionConf struct {
+	// Number of days to retain each type of event for. 0 retains forever.
+	CampaignViews int `koanf:"campaign_views"`
+	LinkClicks    int `koanf:"link_clicks"`
+
+	// Roll up purged events into daily counts for historical stats.
+	Rollup bool `koanf:"rollup"`
+
+	Interval  time.Duration `koanf:"purge_interval"`
+	BatchSize int           `koanf:"purge_batch_size"`
+}
+
+// retentionPurgePause is the pause between consecutive purge batches
+// so that other writes on the tables aren't starved.
+const retentionPurgePause = time.Millisecond * 100
+
+// runRetentionPurge is a blocking function that periodically purges tracking
+// events that are older than their retention periods.
+func runRetentionPurge(cfg retentionConf, app *App) {
+	if cfg.CampaignViews < 1 && cfg.LinkClicks < 1 {
+		return
+	}
+
+	for {
+		purgeEvents("campaign views", cfg.CampaignViews, app.queries.PurgeCampaignViews, cfg, app)
+		purgeEvents("link clicks", cfg.LinkClicks, app.queries.PurgeLinkClicks, cfg, app)
+		time.Sleep(cfg.Interval)
+	}
+}
+
+// purgeEvents deletes the events older than the given number of days using
+// the given purge statement in batches until there are none left.
+func purgeEvents(name string, days int, stmt *sqlx.Stmt, cfg retentionConf, app *App) {
+	if days < 1 {
+		return
+	}
+
+	var (
+		before = time.Now().AddDate(0, 0, -days)
+		total  = 0
+	)
+	for {
+		var n int
+		if err := stmt.Get(&n, before, cfg.BatchSize, cfg.Rollup); err != nil {
+			app.log.Printf("error purging %s: %v", name, err)
+			break
+		}
+		total += n
+		if n < cfg.BatchSize {
+			break
+		}
+		time.Sleep(retentionPurgePause)
+	}
+
+	app.log.Printf("purged %d %s older than %d days", total, name, days)
+}
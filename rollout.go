@@ -0,0 +1,338 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+const (
+	// rolloutGateInterval is the interval at which the gates of held and
+	// trickled staged rollouts are checked.
+	rolloutGateInterval = time.Minute
+
+	// trickleMinSent is the number of messages of the initial share of a
+	// trickled rollout after which its gate's maximum rates are checked so
+	// that a bounce or two in the first messages don't halt it.
+	trickleMinSent = 50
+)
+
+// campaignRollout represents the state of a campaign's staged rollout and
+// the metrics of its initial share. ReleaseAt is when its gate is checked,
+// and Failed, the gate's thresholds that the metrics fail as of now. Rate is
+// the trickle rate of the initial share and Reason, the last decision on the
+// gate.
+type campaignRollout struct {
+	Percent   int                           `json:"percent"`
+	Stage     string                        `json:"stage"`
+	Gate      models.CampaignRolloutGate    `json:"gate"`
+	HeldAt    null.Time                     `json:"held_at"`
+	ReleaseAt null.Time                     `json:"release_at"`
+	Initial   models.CampaignRolloutMetrics `json:"initial"`
+	Failed    []string                      `json:"failed"`
+
+	Rate   int    `json:"rate"`
+	Reason string `json:"reason"`
+
+	// AB has the metrics of the variants of the rollout's A/B test, if any,
+	// and Winner, the variant that won it or -1.
+	AB     []models.CampaignABMetrics `json:"ab"`
+	Winner int                        `json:"winner"`
+}
+
+// handleGetCampaignRollout returns the state of a campaign's staged rollout
+// and the metrics of the subscribers it was sent to first. Held rollouts are
+// released by resuming them.
+func handleGetCampaignRollout(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	var cm models.Campaign
+	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+	if cm.RolloutPercent == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "The campaign isn't a staged rollout.")
+	}
+
+	m, err := getRolloutMetrics(cm.ID, app)
+	if err != nil {
+		app.log.Printf("error fetching campaign rollout metrics: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign rollout metrics: %s", pqErrMsg(err)))
+	}
+
+	out := campaignRollout{
+		Percent: cm.RolloutPercent,
+		Stage:   cm.RolloutStage,
+		Gate:    cm.RolloutGate,
+		HeldAt:  cm.RolloutHeldAt,
+		Initial: m,
+		Failed:  cm.RolloutGate.Check(m),
+		Rate:    cm.RolloutRate,
+		Reason:  cm.RolloutReason,
+		AB:      []models.CampaignABMetrics{},
+		Winner:  cm.ABWinner,
+	}
+	if cm.ABTest.Enabled() {
+		if out.AB, err = getABMetrics(cm, app); err != nil {
+			app.log.Printf("error fetching campaign A/B metrics: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error fetching campaign A/B metrics: %s", pqErrMsg(err)))
+		}
+	}
+	if cm.RolloutGate.Enabled() && cm.RolloutHeldAt.Valid {
+		out.ReleaseAt = null.TimeFrom(cm.RolloutHeldAt.Time.Add(cm.RolloutGate.WaitDuration()))
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// runRolloutGates is a blocking function that periodically checks the gates
+// of held and trickled staged rollouts.
+func runRolloutGates(app *App) {
+	for {
+		if err := checkABTests(app); err != nil {
+			app.log.Printf("error checking A/B tests: %v", err)
+		}
+		if err := checkRolloutGates(app); err != nil {
+			app.log.Printf("error checking rollout gates: %v", err)
+		}
+		if err := checkRolloutTrickles(app); err != nil {
+			app.log.Printf("error checking rollout trickles: %v", err)
+		}
+		time.Sleep(rolloutGateInterval)
+	}
+}
+
+// checkRolloutGates releases the held rollouts whose gates' waits have
+// passed if the metrics of their initial shares pass their gates, and halts
+// the ones that don't. Admins are notified either way.
+func checkRolloutGates(app *App) error {
+	var ids []int
+	if err := app.queries.GetHeldCampaignRollouts.Select(&ids); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var cm models.Campaign
+		if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+			app.log.Printf("error fetching campaign: %v", err)
+			continue
+		}
+		if time.Since(cm.RolloutHeldAt.Time) < cm.RolloutGate.WaitDuration() {
+			continue
+		}
+
+		m, err := getRolloutMetrics(cm.ID, app)
+		if err != nil {
+			app.log.Printf("error fetching campaign (%s) rollout metrics: %v", cm.Name, err)
+			continue
+		}
+
+		if failed := cm.RolloutGate.Check(m); len(failed) > 0 {
+			reason := "Halted: " + strings.Join(failed, ", ")
+			if _, err := app.queries.HaltCampaignRollout.Exec(cm.ID, reason); err != nil {
+				app.log.Printf("error halting campaign (%s) rollout: %v", cm.Name, err)
+				continue
+			}
+			app.log.Printf("halted campaign (%s) rollout: %s", cm.Name, strings.Join(failed, ", "))
+			notifyRollout(cm, models.CampaignStatusPaused,
+				"The rollout failed its gate: "+strings.Join(failed, ", ")+". Resume the campaign to release it anyway.", app)
+			continue
+		}
+
+		if err := releaseRollout(cm, app); err != nil {
+			app.log.Printf("error releasing campaign (%s) rollout: %v", cm.Name, err)
+			continue
+		}
+		reason := fmt.Sprintf("Released: the metrics of the %d messages to the initial share passed the gate", m.Sent)
+		if _, err := app.queries.SetRolloutReason.Exec(cm.ID, reason); err != nil {
+			app.log.Printf("error recording campaign (%s) rollout reason: %v", cm.Name, err)
+		}
+		app.log.Printf("released campaign (%s) rollout", cm.Name)
+		notifyRollout(cm, models.CampaignStatusRunning,
+			"The initial metrics passed the rollout gate and the rollout was released to the rest of the subscribers.", app)
+	}
+	return nil
+}
+
+// checkRolloutTrickles halts the trickled rollouts whose initial metrics
+// cross their gates' maximum rates (eg: complaints) before they're sent to
+// all of their initial shares. Trickles that stay under them are held and
+// checked against their full gates like other rollouts when they're done.
+func checkRolloutTrickles(app *App) error {
+	var ids []int
+	if err := app.queries.GetTricklingRollouts.Select(&ids); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var cm models.Campaign
+		if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+			app.log.Printf("error fetching campaign: %v", err)
+			continue
+		}
+
+		m, err := getRolloutMetrics(cm.ID, app)
+		if err != nil {
+			app.log.Printf("error fetching campaign (%s) rollout metrics: %v", cm.Name, err)
+			continue
+		}
+		if m.Sent < trickleMinSent {
+			continue
+		}
+
+		failed := cm.RolloutGate.CheckMax(m)
+		if len(failed) == 0 {
+			continue
+		}
+		reason := fmt.Sprintf("Halted after %d trickled messages: %s", m.Sent, strings.Join(failed, ", "))
+		res, err := app.queries.HaltCampaignTrickle.Exec(cm.ID, reason)
+		if err != nil {
+			app.log.Printf("error halting campaign (%s) rollout: %v", cm.Name, err)
+			continue
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+		app.log.Printf("halted campaign (%s) rollout trickle: %s", cm.Name, strings.Join(failed, ", "))
+		notifyRollout(cm, models.CampaignStatusPaused,
+			"The trickle crossed the rollout gate: "+strings.Join(failed, ", ")+". Resume the campaign to release it anyway.", app)
+	}
+	return nil
+}
+
+// checkABTests picks the winners of the A/B tests of the held rollouts whose
+// windows have passed. The rollouts that have gates are then left to them
+// and the rest are released with the winners.
+func checkABTests(app *App) error {
+	var ids []int
+	if err := app.queries.GetHeldABTests.Select(&ids); err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		var cm models.Campaign
+		if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+			app.log.Printf("error fetching campaign: %v", err)
+			continue
+		}
+		if time.Since(cm.RolloutHeldAt.Time) < cm.ABTest.WindowDuration() {
+			continue
+		}
+
+		if err := pickABWinner(cm, app); err != nil {
+			app.log.Printf("error picking the A/B test winner of campaign (%s): %v", cm.Name, err)
+			continue
+		}
+		if cm.RolloutGate.Enabled() {
+			continue
+		}
+
+		if err := releaseRollout(cm, app); err != nil {
+			app.log.Printf("error releasing campaign (%s) rollout: %v", cm.Name, err)
+			continue
+		}
+		app.log.Printf("released campaign (%s) rollout", cm.Name)
+		notifyRollout(cm, models.CampaignStatusRunning,
+			"The A/B test picked a winner and the rollout was released to the rest of the subscribers with it.", app)
+	}
+	return nil
+}
+
+// pickABWinner records the variant of a rollout's A/B test with the highest
+// rate of its metric as the one that's sent to the rest of the subscribers.
+func pickABWinner(cm models.Campaign, app *App) error {
+	m, err := getABMetrics(cm, app)
+	if err != nil {
+		return err
+	}
+	w, err := cm.ABTest.Winner(m)
+	if err != nil {
+		return err
+	}
+
+	rate := w.ViewRate
+	if cm.ABTest.Metric == models.CampaignABMetricClicks {
+		rate = w.ClickRate
+	}
+	reason := fmt.Sprintf("A/B test: variant %d won with a %s rate of %.2f%% over %d messages",
+		w.Variant, strings.TrimSuffix(cm.ABTest.Metric, "s"), rate, w.Sent)
+	if _, err := app.queries.SetCampaignABWinner.Exec(cm.ID, w.Variant, reason); err != nil {
+		return err
+	}
+	app.log.Printf("campaign (%s): %s", cm.Name, reason)
+	return nil
+}
+
+// getABMetrics returns the metrics of the variants of a rollout's A/B test.
+func getABMetrics(cm models.Campaign, app *App) ([]models.CampaignABMetrics, error) {
+	n := len(cm.ABTest.Variants) + 1
+
+	var out []models.CampaignABMetrics
+	if err := app.queries.GetCampaignABMetrics.Select(&out, cm.ID, n); err != nil {
+		return nil, err
+	}
+	for i := range out {
+		out[i].SetRates()
+	}
+	return out, nil
+}
+
+// releaseRollout resumes a held rollout to send it to the rest of its
+// subscribers, with fresh snapshots of its segments, like resuming it by
+// hand (see handleUpdateCampaignStatus).
+func releaseRollout(cm models.Campaign, app *App) error {
+	if err := excludeCampaignSegment(cm.ID, cm.ExcludeSegmentID, app); err != nil {
+		return err
+	}
+	if err := snapshotCampaignSegments(cm.ID, app); err != nil {
+		return err
+	}
+	_, err := app.queries.UpdateCampaignStatus.Exec(cm.ID, models.CampaignStatusRunning)
+	return err
+}
+
+// getRolloutMetrics returns the metrics of the initial share of a staged
+// rollout.
+func getRolloutMetrics(campID int, app *App) (models.CampaignRolloutMetrics, error) {
+	var out models.CampaignRolloutMetrics
+	if err := app.queries.GetCampaignRollout.Get(&out, campID); err != nil {
+		return out, err
+	}
+	out.SetRates()
+	return out, nil
+}
+
+// notifyRollout notifies admins of the decision on a rollout's gate.
+func notifyRollout(cm models.Campaign, status, reason string, app *App) {
+	app.sendNotification(app.constants.NotifyEmails,
+		fmt.Sprintf("%s: %s", strings.Title(status), cm.Name),
+		notifTplCampaign,
+		map[string]interface{}{
+			"ID":     cm.ID,
+			"Name":   cm.Name,
+			"Status": status,
+			"Sent":   cm.Sent,
+			"ToSend": cm.ToSend,
+			"Reason": reason,
+		})
+}
@@ -2,9 +2,12 @@ DROP TYPE IF EXISTS list_type CASCADE; CREATE TYPE list_type AS ENUM ('public',
 DROP TYPE IF EXISTS list_optin CASCADE; CREATE TYPE list_optin AS ENUM ('single', 'double');
 DROP TYPE IF EXISTS subscriber_status CASCADE; CREATE TYPE subscriber_status AS ENUM ('enabled', 'disabled', 'blacklisted');
 DROP TYPE IF EXISTS subscription_status CASCADE; CREATE TYPE subscription_status AS ENUM ('unconfirmed', 'confirmed', 'unsubscribed');
-DROP TYPE IF EXISTS campaign_status CASCADE; CREATE TYPE campaign_status AS ENUM ('draft', 'running', 'scheduled', 'paused', 'cancelled', 'finished');
+DROP TYPE IF EXISTS campaign_status CASCADE; CREATE TYPE campaign_status AS ENUM ('draft', 'running', 'scheduled', 'paused', 'cancelled', 'finished', 'aborted', 'pending_approval');
 DROP TYPE IF EXISTS campaign_type CASCADE; CREATE TYPE campaign_type AS ENUM ('regular', 'optin');
 DROP TYPE IF EXISTS content_type CASCADE; CREATE TYPE content_type AS ENUM ('richtext', 'html', 'plain');
+DROP TYPE IF EXISTS job_status CASCADE; CREATE TYPE job_status AS ENUM ('queued', 'running', 'finished', 'failed', 'cancelled', 'interrupted');
+DROP TYPE IF EXISTS user_role CASCADE; CREATE TYPE user_role AS ENUM ('admin', 'editor', 'analyst');
+DROP TYPE IF EXISTS user_status CASCADE; CREATE TYPE user_status AS ENUM ('enabled', 'disabled');
 
 -- subscribers
 DROP TABLE IF EXISTS subscribers CASCADE;
@@ -33,6 +36,35 @@ CREATE TABLE lists (
     optin           list_optin NOT NULL DEFAULT 'single',
     tags            VARCHAR(100)[],
 
+    -- Optional from-name (template) of campaigns sent to the list.
+    from_name       TEXT NOT NULL DEFAULT '',
+
+    -- Optional Reply-To and envelope sender (return-path) addresses of
+    -- campaigns sent to the list.
+    reply_to        TEXT NOT NULL DEFAULT '',
+    bounce_address  TEXT NOT NULL DEFAULT '',
+
+    -- Optional weekly windows ([{"days": [1, 2], "start": "09:00", "end": "17:00"}])
+    -- in the timezone in which campaigns are sent to the list.
+    send_windows    JSONB NOT NULL DEFAULT '[]',
+    send_timezone   TEXT NOT NULL DEFAULT 'UTC',
+
+    -- Optional URL of the page that subscribers are redirected to after they
+    -- unsubscribe on the subscription page instead of the built-in one.
+    unsubscribe_redirect TEXT NOT NULL DEFAULT '',
+
+    -- Optional win-back grace period of unsubscriptions. Unsubscriptions on
+    -- the subscription page (but not one-click ones) are paused for the days,
+    -- during which the optional win-back message is sent once after
+    -- winback_send_days, and are removed unless the subscriber re-engages.
+    winback_days      INTEGER NOT NULL DEFAULT 0,
+    winback_send_days INTEGER NOT NULL DEFAULT 0,
+    winback_subject   TEXT NOT NULL DEFAULT '',
+    winback_body      TEXT NOT NULL DEFAULT '',
+
+    -- Optional default messenger of campaigns sent to the list.
+    messenger       TEXT NOT NULL DEFAULT '',
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -43,6 +75,23 @@ CREATE TABLE subscriber_lists (
     list_id            INTEGER NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
     status             subscription_status NOT NULL DEFAULT 'unconfirmed',
 
+    -- Subscription history. On memberships that predate these, reads fall
+    -- back to created_at and (for unsubscriptions) updated_at.
+    subscribed_at      TIMESTAMP WITH TIME ZONE NULL DEFAULT NOW(),
+    confirmed_at       TIMESTAMP WITH TIME ZONE NULL,
+    unsubscribed_at    TIMESTAMP WITH TIME ZONE NULL,
+
+    -- Consent records of subscriptions made on public forms: the page the
+    -- form was submitted from, the IP and the user agent of the request and
+    -- when it was made, and the IP and the user agent of the double opt-in
+    -- confirmation (at confirmed_at).
+    consent_source     TEXT NOT NULL DEFAULT '',
+    consent_ip         TEXT NOT NULL DEFAULT '',
+    consent_user_agent TEXT NOT NULL DEFAULT '',
+    consent_at         TIMESTAMP WITH TIME ZONE NULL,
+    confirm_ip         TEXT NOT NULL DEFAULT '',
+    confirm_user_agent TEXT NOT NULL DEFAULT '',
+
     created_at         TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at         TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
 
@@ -52,14 +101,87 @@ DROP INDEX IF EXISTS idx_sub_lists_sub_id; CREATE INDEX idx_sub_lists_sub_id ON
 DROP INDEX IF EXISTS idx_sub_lists_list_id; CREATE INDEX idx_sub_lists_list_id ON subscriber_lists(list_id);
 DROP INDEX IF EXISTS idx_sub_lists_status; CREATE INDEX idx_sub_lists_status ON subscriber_lists(status);
 
+-- list win-backs
+-- The paused memberships of lists with a win-back grace period. The
+-- memberships are unsubscribed in the meantime so that nothing but the
+-- win-back message is sent to them. A view or a click by the subscriber
+-- restores the previous status (status) of the memberships, otherwise
+-- they're fully unsubscribed at remove_at.
+DROP TABLE IF EXISTS list_winbacks CASCADE;
+CREATE TABLE list_winbacks (
+    subscriber_id    INTEGER NOT NULL,
+    list_id          INTEGER NOT NULL,
+    status           subscription_status NOT NULL,
+    remove_at        TIMESTAMP WITH TIME ZONE NOT NULL,
+    sent_at          TIMESTAMP WITH TIME ZONE NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (subscriber_id, list_id),
+    FOREIGN KEY (subscriber_id, list_id) REFERENCES subscriber_lists(subscriber_id, list_id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+DROP INDEX IF EXISTS idx_list_winbacks_remove_at; CREATE INDEX idx_list_winbacks_remove_at ON list_winbacks(remove_at);
+
+-- segments
+DROP TABLE IF EXISTS segments CASCADE;
+CREATE TABLE segments (
+    id              SERIAL PRIMARY KEY,
+    uuid            uuid NOT NULL UNIQUE,
+    name            TEXT NOT NULL,
+
+    -- The structured filter tree that's compiled into an SQL expression.
+    rules           JSONB NOT NULL DEFAULT '{}',
+
+    created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- subscriber attribute indexes
+-- The subscriber attribute keys that are indexed for segment queries. The
+-- expression indexes on them are created and dropped by background jobs.
+DROP TYPE IF EXISTS attrib_index_status CASCADE; CREATE TYPE attrib_index_status AS ENUM ('pending', 'ready', 'failed', 'dropping');
+DROP TABLE IF EXISTS attrib_indexes CASCADE;
+CREATE TABLE attrib_indexes (
+    key             TEXT NOT NULL PRIMARY KEY,
+    status          attrib_index_status NOT NULL DEFAULT 'pending',
+    error           TEXT NOT NULL DEFAULT '',
+    created_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at      TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- list rules
+DROP TABLE IF EXISTS list_rules CASCADE;
+CREATE TABLE list_rules (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL,
+    list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- The structured filter tree (same as segments) that subscribers
+    -- are matched against to be added to the list.
+    rules            JSONB NOT NULL DEFAULT '{}',
+
+    -- Remove subscribers that no longer match the rules from the list.
+    remove_unmatched BOOLEAN NOT NULL DEFAULT false,
+    enabled          BOOLEAN NOT NULL DEFAULT true,
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
 -- templates
 DROP TABLE IF EXISTS templates CASCADE;
 CREATE TABLE templates (
     id              SERIAL PRIMARY KEY,
+
+    -- The stable key of the template in template bundles.
+    uuid            uuid NOT NULL UNIQUE,
     name            TEXT NOT NULL,
     body            TEXT NOT NULL,
     is_default      BOOLEAN NOT NULL DEFAULT false,
 
+    -- The format of the template's body (html, plain) that's checked
+    -- against the formats messengers are compatible with.
+    format          TEXT NOT NULL DEFAULT 'html',
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -74,8 +196,25 @@ CREATE TABLE campaigns (
     name             TEXT NOT NULL,
     subject          TEXT NOT NULL,
     from_email       TEXT NOT NULL,
+
+    -- Optional from-name (template) that overrides the name in from_email
+    -- and the from-names of the campaign's lists.
+    from_name        TEXT NOT NULL DEFAULT '',
     body             TEXT NOT NULL,
     content_type     content_type NOT NULL DEFAULT 'richtext',
+
+    -- Optional AMP for e-mail version of the body that's sent alongside the
+    -- HTML as a text/x-amp-html part.
+    amp_body         TEXT NOT NULL DEFAULT '',
+
+    -- Optional plaintext alternative of the body. If it's empty, one is
+    -- generated from the HTML when auto_altbody (or the app default if it's
+    -- NULL) is on.
+    altbody          TEXT NOT NULL DEFAULT '',
+    auto_altbody     BOOLEAN NULL,
+
+    -- Replace the tracked links ({{ TrackLink }}) with short links.
+    shorten_links    BOOLEAN NOT NULL DEFAULT false,
     send_at          TIMESTAMP WITH TIME ZONE,
     status           campaign_status NOT NULL DEFAULT 'draft',
     tags             VARCHAR(100)[],
@@ -84,16 +223,166 @@ CREATE TABLE campaigns (
     -- For opt-in campaigns, this will be 'unsubscribed'.
     type campaign_type DEFAULT 'regular',
 
+    -- Optional category (transactional, newsletter, promotional) that classifies
+    -- the campaign for the defaults of new campaigns (campaign_categories) and
+    -- the per-category dashboard counts.
+    category         TEXT NOT NULL DEFAULT '',
+
     -- The ID of the messenger backend used to send this campaign. 
     messenger        TEXT NOT NULL,
     template_id      INTEGER REFERENCES templates(id) ON DELETE SET DEFAULT DEFAULT 1,
 
+    -- Optional tracking domain (from the app.tracking_domains config) used in
+    -- link and view tracking URLs instead of the root URL.
+    tracking_domain  TEXT NOT NULL DEFAULT '',
+
+    -- Follow-up campaigns derived from a parent campaign target a subset of the
+    -- parent's recipients described by parent_audience, eg: 'non_openers'.
+    parent_id        INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    parent_audience  TEXT NOT NULL DEFAULT '',
+
+    -- Optional language variants of the subject and body keyed by language code,
+    -- eg: {"de": {"subject": "..", "body": ".."}}
+    variants         JSONB NOT NULL DEFAULT '{}',
+
+    -- The order in which subscribers are sent the campaign: 'id', 'random', or 'field'
+    -- (by send_order_field). See next-campaign-subscribers and campaign_send_order.
+    send_order       TEXT NOT NULL DEFAULT 'id',
+    send_order_field TEXT NOT NULL DEFAULT '',
+    send_order_desc  BOOLEAN NOT NULL DEFAULT false,
+
+    -- Priority (1-5) by which the running campaigns share the send
+    -- capacity. Each level doubles a campaign's share.
+    priority         SMALLINT NOT NULL DEFAULT 3,
+
+    -- When the campaign was last started or resumed. With a cap on running
+    -- campaigns (app.max_running_campaigns), campaigns of the same priority
+    -- are started in the order of this or send_at if they're scheduled.
+    queued_at        TIMESTAMP WITH TIME ZONE NULL,
+
+    -- Whether the campaign can send to subscribers that it was already
+    -- delivered to (campaign_deliveries), eg: when it's started again.
+    allow_resend     BOOLEAN NOT NULL DEFAULT false,
+
+    -- Optional charset and content transfer encoding of the campaign's
+    -- e-mails. Empty values use the app defaults.
+    charset           TEXT NOT NULL DEFAULT '',
+    transfer_encoding TEXT NOT NULL DEFAULT '',
+
+    -- Optional policy (pause, cancel, continue) on outages of the
+    -- campaign's messenger. Empty uses the app default.
+    outage_policy     TEXT NOT NULL DEFAULT '',
+
+    -- Optional threshold (count, rate) of send errors. count pauses the
+    -- campaign after app.max_send_errors errors and rate aborts it when
+    -- error_rate percent of its last error_window messages fail. Empty and
+    -- zeros use the app defaults. abort_reason is why it was aborted.
+    error_mode        TEXT NOT NULL DEFAULT '',
+    error_rate        REAL NOT NULL DEFAULT 0,
+    error_window      INTEGER NOT NULL DEFAULT 0,
+    abort_reason      TEXT NOT NULL DEFAULT '',
+
+    -- Optional local time (HH:MM) at which the campaign is sent to every
+    -- subscriber in their timezone (app.local_send_attribute) over the day
+    -- after it starts. See next-campaign-subscribers.
+    local_send_time   TEXT NOT NULL DEFAULT '',
+
+    -- Optional staged rollout that's sent to rollout_percent of the subscribers
+    -- first and then held (paused) until it's resumed, or until rollout_gate
+    -- releases it, to be sent to the rest. rollout_stage is one of initial,
+    -- holding, halted (failed the gate), and released. See next-campaign-subscribers.
+    rollout_percent   SMALLINT NOT NULL DEFAULT 0,
+    rollout_gate      JSONB NOT NULL DEFAULT '{}',
+    rollout_stage     TEXT NOT NULL DEFAULT '',
+    rollout_sent      INT NOT NULL DEFAULT 0,
+    rollout_held_at   TIMESTAMP WITH TIME ZONE NULL,
+
+    -- Optional rate (messages per hour) at which the initial share of a staged
+    -- rollout is trickled, eg: to a cold segment of dormant subscribers, while its
+    -- gate's maximum rates are checked on the way. rollout_reason is the last
+    -- decision on the gate (halted or released, and why).
+    rollout_rate      INT NOT NULL DEFAULT 0,
+    rollout_reason    TEXT NOT NULL DEFAULT '',
+
+    -- Optional recurrence (a cron expression or an RRULE) on which the campaign is
+    -- cloned into its next occurrence, scheduled with fresh stats, when it finishes.
+    -- The recurrence moves to the latest occurrence and recurrence_of is the first
+    -- campaign of the series.
+    recurrence        TEXT NOT NULL DEFAULT '',
+    recurrence_of     INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Optional A/B test of the subject and body, eg: {"variants": [{"subject": ".."}],
+    -- "metric": "views", "window": "4h"}, whose variants are sent to the initial share
+    -- of a staged rollout. Once it's been held for the window, the variant with the
+    -- highest view or click rate wins (ab_winner, 0 is the campaign's own content)
+    -- and is sent to the rest. See get-campaign-ab-metrics.
+    ab_test           JSONB NOT NULL DEFAULT '{}',
+    ab_winner         SMALLINT NOT NULL DEFAULT -1,
+
+    -- With campaign approvals (campaign_approval.enabled), campaigns are only sent
+    -- once they've been approved by a user other than the one who submitted them
+    -- (approval_requested_by). reviewed_by is the user (users.id) who last approved
+    -- or rejected the campaign with the optional review_note. Edits that are made
+    -- before the campaign starts clear the approval.
+    approved              BOOLEAN NOT NULL DEFAULT false,
+    approval_requested_by INTEGER NULL,
+    reviewed_by           INTEGER NULL,
+    reviewed_at           TIMESTAMP WITH TIME ZONE NULL,
+    review_note           TEXT NOT NULL DEFAULT '',
+
+    -- Campaigns in the archive are published at /archive/:uuid, and on the
+    -- archive pages of their lists, once they've started.
+    archive          BOOLEAN NOT NULL DEFAULT false,
+
+    -- Optional unsubscribe redirect URL that overrides the ones of the
+    -- campaign's lists.
+    unsubscribe_redirect TEXT NOT NULL DEFAULT '',
+
+    -- Arbitrary metadata (eg: category, internal ID) that's copied into the
+    -- campaign's views and clicks and the campaign.finished webhook.
+    metadata         JSONB NOT NULL DEFAULT '{}',
+
+    -- Optional segment whose subscribers are excluded from the campaign.
+    -- Its subscribers are copied to campaign_exclusions when the campaign
+    -- is saved, scheduled, or started.
+    exclude_segment_id INTEGER NULL REFERENCES segments(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
     -- Progress and stats.
     to_send            INT NOT NULL DEFAULT 0,
     sent               INT NOT NULL DEFAULT 0,
     max_subscriber_id  INT NOT NULL DEFAULT 0,
     last_subscriber_id INT NOT NULL DEFAULT 0,
 
+    -- Checkpoint of the campaigns that aren't sent in the ID order.
+    last_sort_key      JSONB NULL,
+
+    -- The positions (last_subscriber_id, last_sort_key, and sent) before the
+    -- batches of subscribers that have been fetched and whose messages are
+    -- yet to be pushed and recorded, oldest first, and when they were fetched.
+    -- A running campaign that's picked up after a restart is rewound to the
+    -- oldest one, and from then (resume_after), skips the subscribers it has
+    -- been delivered to or failed for.
+    checkpoints        JSONB NOT NULL DEFAULT '[]',
+    resume_after       TIMESTAMP WITH TIME ZONE NULL,
+
+    -- Simulated campaigns (dry runs) are run without delivering their messages.
+    -- When a simulated run finishes or is cancelled, its results are recorded in
+    -- simulation and the campaign returns to a draft.
+    simulate           BOOLEAN NOT NULL DEFAULT false,
+    simulation         JSONB NULL,
+
+    -- The number of messages that couldn't be rendered in the run, which are
+    -- skipped, and the last of the errors.
+    render_errors      INTEGER NOT NULL DEFAULT 0,
+    render_error       TEXT NOT NULL DEFAULT '',
+
+    -- The content (subject, from, body, template, and variants) frozen when
+    -- the campaign starts, which the entire run, and the campaign's message
+    -- views, use regardless of later edits. It's cleared to apply the edits of
+    -- a paused campaign, which freezes the content again when it's resumed.
+    snapshot           JSONB NULL,
+    snapshot_at        TIMESTAMP WITH TIME ZONE NULL,
+
     started_at       TIMESTAMP WITH TIME ZONE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
@@ -112,16 +401,59 @@ CREATE UNIQUE INDEX ON campaign_lists (campaign_id, list_id);
 DROP INDEX IF EXISTS idx_camp_lists_camp_id; CREATE INDEX idx_camp_lists_camp_id ON campaign_lists(campaign_id);
 DROP INDEX IF EXISTS idx_camp_lists_list_id; CREATE INDEX idx_camp_lists_list_id ON campaign_lists(list_id);
 
+-- Segments whose subscribers a campaign is sent to along with the subscribers
+-- of its lists. Subscribers in more than one of a campaign's lists and
+-- segments are sent to once. The segments' subscribers are copied to
+-- campaign_segment_subscribers when the campaign is saved, scheduled, or started.
+DROP TABLE IF EXISTS campaign_segments CASCADE;
+CREATE TABLE campaign_segments (
+    campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    segment_id   INTEGER NOT NULL REFERENCES segments(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX ON campaign_segments (campaign_id, segment_id);
+
+DROP TABLE IF EXISTS campaign_segment_subscribers CASCADE;
+CREATE TABLE campaign_segment_subscribers (
+    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+CREATE UNIQUE INDEX ON campaign_segment_subscribers (campaign_id, subscriber_id);
+
+-- Subscribers excluded from a campaign, explicitly or by the campaign's
+-- exclude_segment_id (from_segment).
+DROP TABLE IF EXISTS campaign_exclusions CASCADE;
+CREATE TABLE campaign_exclusions (
+    campaign_id    INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id  INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    from_segment   BOOLEAN NOT NULL DEFAULT false
+);
+CREATE UNIQUE INDEX ON campaign_exclusions (campaign_id, subscriber_id);
+
 DROP TABLE IF EXISTS campaign_views CASCADE;
 CREATE TABLE campaign_views (
     campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
 
     -- Subscribers may be deleted, but the view counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- The campaign's metadata at the time of the view.
+    metadata         JSONB NOT NULL DEFAULT '{}',
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
-DROP INDEX IF EXISTS idx_views_camp_id; CREATE INDEX idx_views_camp_id ON campaign_views(campaign_id);
+DROP INDEX IF EXISTS idx_views_camp_id; CREATE INDEX idx_views_camp_id ON campaign_views(campaign_id, created_at);
 DROP INDEX IF EXISTS idx_views_subscriber_id; CREATE INDEX idx_views_subscriber_id ON campaign_views(subscriber_id);
+DROP INDEX IF EXISTS idx_views_created_at; CREATE INDEX idx_views_created_at ON campaign_views(created_at);
+
+-- Daily view counts rolled up from campaign_views that are purged
+-- after the retention period.
+DROP TABLE IF EXISTS campaign_views_daily CASCADE;
+CREATE TABLE campaign_views_daily (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    date             DATE NOT NULL,
+    count            INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (campaign_id, date)
+);
 
 -- media
 DROP TABLE IF EXISTS media CASCADE;
@@ -131,6 +463,9 @@ CREATE TABLE media (
     provider         TEXT NOT NULL,
     filename         TEXT NOT NULL,
     thumb            TEXT NOT NULL,
+
+    -- The media on the provider that this was copied from by a migration.
+    migrated_from    INTEGER NULL REFERENCES media(id) ON DELETE SET NULL,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
@@ -143,6 +478,20 @@ CREATE TABLE links (
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- short links
+-- The short codes (/s/:code) of the links of campaigns that shorten them.
+-- Clicks on them are recorded in link_clicks without the subscriber.
+DROP TABLE IF EXISTS short_links CASCADE;
+CREATE TABLE short_links (
+    code             TEXT NOT NULL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    link_id          INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    clicks           INTEGER NOT NULL DEFAULT 0,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    UNIQUE (campaign_id, link_id)
+);
+
 DROP TABLE IF EXISTS link_clicks CASCADE;
 CREATE TABLE link_clicks (
     campaign_id      INTEGER REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
@@ -150,8 +499,361 @@ CREATE TABLE link_clicks (
 
     -- Subscribers may be deleted, but the link counts should remain.
     subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- The campaign's metadata at the time of the click.
+    metadata         JSONB NOT NULL DEFAULT '{}',
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
-DROP INDEX IF EXISTS idx_clicks_camp_id; CREATE INDEX idx_clicks_camp_id ON link_clicks(campaign_id);
+DROP INDEX IF EXISTS idx_clicks_camp_id; CREATE INDEX idx_clicks_camp_id ON link_clicks(campaign_id, created_at);
 DROP INDEX IF EXISTS idx_clicks_link_id; CREATE INDEX idx_clicks_link_id ON link_clicks(link_id);
 DROP INDEX IF EXISTS idx_clicks_sub_id; CREATE INDEX idx_clicks_sub_id ON link_clicks(subscriber_id);
+DROP INDEX IF EXISTS idx_clicks_created_at; CREATE INDEX idx_clicks_created_at ON link_clicks(created_at);
+
+-- welcome steps
+-- The ordered welcome messages of a list that are sent to subscribers when
+-- they confirm their subscriptions. The delay of a step is from the previous
+-- step (or the confirmation). A step sends either its subject and body with
+-- its template, or the content of a campaign (campaign_id) without the
+-- campaign being started. A step whose template is deleted is sent with the
+-- default template.
+DROP TABLE IF EXISTS welcome_steps CASCADE;
+CREATE TABLE welcome_steps (
+    id               SERIAL PRIMARY KEY,
+    list_id          INTEGER NOT NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    position         INTEGER NOT NULL,
+    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL,
+    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subject          TEXT NOT NULL DEFAULT '',
+    body             TEXT NOT NULL DEFAULT '',
+    delay            INTERVAL NOT NULL DEFAULT '0',
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    UNIQUE(list_id, position)
+);
+
+-- The welcome messages that are due to be sent to subscribers. A step is
+-- queued once per subscriber. Messages that are being sent are leased by
+-- moving send_at ahead, and they're dropped once they're sent, so the ones
+-- whose sends fail are retried (attempts) when their leases are up.
+DROP TABLE IF EXISTS welcome_queue CASCADE;
+CREATE TABLE welcome_queue (
+    id               BIGSERIAL PRIMARY KEY,
+    step_id          INTEGER NOT NULL REFERENCES welcome_steps(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    send_at          TIMESTAMP WITH TIME ZONE NOT NULL,
+    attempts         INTEGER NOT NULL DEFAULT 0,
+
+    UNIQUE(step_id, subscriber_id)
+);
+DROP INDEX IF EXISTS idx_welcome_queue_send_at; CREATE INDEX idx_welcome_queue_send_at ON welcome_queue(send_at);
+
+-- sequences
+-- Automated sequences of campaigns that subscribers are enrolled in when
+-- they click a link (link_click). Sequences on list joins are the welcome
+-- steps of lists, which can send campaigns. The events are picked up since
+-- scanned_at. The delay of a step is from the previous step
+-- (or the enrollment). The content of steps is sent to the subscribers of
+-- the sequence without the campaigns being started.
+DROP TABLE IF EXISTS sequences CASCADE;
+CREATE TABLE sequences (
+    id               SERIAL PRIMARY KEY,
+    name             TEXT NOT NULL,
+    trigger          TEXT NOT NULL CHECK (trigger IN ('link_click')),
+    trigger_url      TEXT NOT NULL DEFAULT '',
+    enabled          BOOLEAN NOT NULL DEFAULT true,
+    scanned_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS sequence_steps CASCADE;
+CREATE TABLE sequence_steps (
+    id               SERIAL PRIMARY KEY,
+    sequence_id      INTEGER NOT NULL REFERENCES sequences(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    position         INTEGER NOT NULL,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    delay            INTERVAL NOT NULL DEFAULT '0',
+
+    UNIQUE(sequence_id, position)
+);
+
+-- The state of the subscribers in sequences. step is the position of the
+-- next step that's due at send_at. Subscribers are enrolled once per
+-- sequence and exit it when they're blacklisted. Like welcome messages,
+-- steps that are being sent are leased by moving send_at ahead, and the
+-- subscribers are moved on to the next steps once they're sent.
+DROP TABLE IF EXISTS sequence_subscribers CASCADE;
+CREATE TABLE sequence_subscribers (
+    sequence_id      INTEGER NOT NULL REFERENCES sequences(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    step             INTEGER NOT NULL DEFAULT 1,
+    status           TEXT NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'finished', 'exited')),
+    send_at          TIMESTAMP WITH TIME ZONE NULL,
+    last_sent_at     TIMESTAMP WITH TIME ZONE NULL,
+    attempts         INTEGER NOT NULL DEFAULT 0,
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (sequence_id, subscriber_id)
+);
+DROP INDEX IF EXISTS idx_seq_subs_send_at; CREATE INDEX idx_seq_subs_send_at ON sequence_subscribers(send_at) WHERE status = 'active';
+DROP INDEX IF EXISTS idx_seq_subs_sub_id; CREATE INDEX idx_seq_subs_sub_id ON sequence_subscribers(subscriber_id);
+
+-- bounces
+DROP TABLE IF EXISTS bounces CASCADE;
+CREATE TABLE bounces (
+    id               BIGSERIAL PRIMARY KEY,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- Where the bounce was received from, eg: 'verp' or an e-mail provider's webhook.
+    source           TEXT NOT NULL DEFAULT '',
+
+    -- 'bounce' or 'complaint' if the recipient reported the message as spam.
+    type             TEXT NOT NULL DEFAULT 'bounce',
+
+    -- Details of the bounce, eg: the DSN status and diagnostic.
+    meta             JSONB NOT NULL DEFAULT '{}',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_bounces_sub_id; CREATE INDEX idx_bounces_sub_id ON bounces(subscriber_id);
+DROP INDEX IF EXISTS idx_bounces_camp_id; CREATE INDEX idx_bounces_camp_id ON bounces(campaign_id);
+
+-- replies
+-- Replies to campaigns attributed by the plus-addressed Reply-To of messages.
+DROP TABLE IF EXISTS replies CASCADE;
+CREATE TABLE replies (
+    id               BIGSERIAL PRIMARY KEY,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- The Message-ID of the reply that it's recorded once by.
+    message_id       TEXT NOT NULL DEFAULT '',
+    from_email       TEXT NOT NULL DEFAULT '',
+    subject          TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_replies_sub_id; CREATE INDEX idx_replies_sub_id ON replies(subscriber_id);
+DROP INDEX IF EXISTS idx_replies_camp_id; CREATE INDEX idx_replies_camp_id ON replies(campaign_id);
+DROP INDEX IF EXISTS idx_replies_msg_id; CREATE UNIQUE INDEX idx_replies_msg_id ON replies(message_id) WHERE message_id != '';
+
+-- campaign failures
+-- Subscribers that campaign messages failed to be sent to. Only failures are
+-- recorded. Permanent failures (eg: rejected recipients) aren't resent.
+DROP TABLE IF EXISTS campaign_failures CASCADE;
+CREATE TABLE campaign_failures (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    error            TEXT NOT NULL DEFAULT '',
+    permanent        BOOLEAN NOT NULL DEFAULT false,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (campaign_id, subscriber_id)
+);
+
+-- campaign deliveries
+-- Subscribers that the messages of campaigns were pushed to, which campaigns
+-- that don't allow resends skip when they're started again or resumed, and
+-- all campaigns skip when they're resumed after a restart.
+DROP TABLE IF EXISTS campaign_deliveries CASCADE;
+CREATE TABLE campaign_deliveries (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (campaign_id, subscriber_id)
+);
+
+-- campaign send order
+-- The order of the subscribers of campaigns that are sent in the random or a field
+-- order, which is computed once when they're started (see next-campaigns) and which
+-- their batches are paged from by position. Subscribers who join the campaigns' lists
+-- after that aren't sent to. It's dropped when the campaigns finish or are cancelled.
+DROP TABLE IF EXISTS campaign_send_order CASCADE;
+CREATE TABLE campaign_send_order (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    position         INTEGER NOT NULL,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    PRIMARY KEY (campaign_id, position)
+);
+
+-- subscriber deletions
+-- Audit log of deleted subscribers. Only the UUID is retained.
+DROP TABLE IF EXISTS subscriber_deletions CASCADE;
+CREATE TABLE subscriber_deletions (
+    id               BIGSERIAL PRIMARY KEY,
+    subscriber_uuid  UUID NOT NULL,
+
+    -- Who deleted the subscriber: admin, query (admin, by query), or wipe (the subscriber).
+    source           TEXT NOT NULL,
+
+    -- Whether the subscriber's views, clicks, and conversions were anonymized or deleted.
+    history          TEXT NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_sub_deletions_uuid; CREATE INDEX idx_sub_deletions_uuid ON subscriber_deletions(subscriber_uuid);
+
+-- unsubscribe reasons
+-- The reasons subscribers give when they unsubscribe on the subscription page.
+DROP TABLE IF EXISTS unsubscribe_reasons CASCADE;
+CREATE TABLE unsubscribe_reasons (
+    id               BIGSERIAL PRIMARY KEY,
+
+    -- Subscribers and campaigns may be deleted, but the reasons should remain.
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    campaign_id      INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL ON UPDATE CASCADE,
+
+    -- The lists that were unsubscribed from.
+    list_ids         INTEGER[] NOT NULL DEFAULT '{}',
+
+    -- One of the configured reasons (privacy.unsubscribe_reasons), 'other',
+    -- 'one-click' (List-Unsubscribe), or empty if none was given.
+    reason           TEXT NOT NULL DEFAULT '',
+    comment          TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_unsub_reasons_camp_id; CREATE INDEX idx_unsub_reasons_camp_id ON unsubscribe_reasons(campaign_id);
+DROP INDEX IF EXISTS idx_unsub_reasons_list_ids; CREATE INDEX idx_unsub_reasons_list_ids ON unsubscribe_reasons USING GIN(list_ids);
+
+-- conversions
+-- Conversions (eg: purchases) on external sites attributed to campaigns.
+DROP TABLE IF EXISTS conversions CASCADE;
+CREATE TABLE conversions (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- Subscribers may be deleted, but the conversions should remain.
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    value            NUMERIC(14, 2) NOT NULL DEFAULT 0,
+
+    -- Optional reference (eg: order ID) that makes repeated reports of
+    -- the same conversion idempotent.
+    ref              TEXT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+
+    UNIQUE (campaign_id, ref)
+);
+DROP INDEX IF EXISTS idx_conversions_sub_id; CREATE INDEX idx_conversions_sub_id ON conversions(subscriber_id);
+DROP INDEX IF EXISTS idx_conversions_camp_id; CREATE INDEX idx_conversions_camp_id ON conversions(campaign_id, created_at);
+
+-- Daily click counts rolled up from link_clicks that are purged
+-- after the retention period.
+DROP TABLE IF EXISTS link_clicks_daily CASCADE;
+CREATE TABLE link_clicks_daily (
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    link_id          INTEGER NOT NULL REFERENCES links(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    date             DATE NOT NULL,
+    count            INTEGER NOT NULL DEFAULT 0,
+
+    PRIMARY KEY (campaign_id, link_id, date)
+);
+
+-- jobs
+-- Long-running background operations (eg: imports) and their progress.
+DROP TABLE IF EXISTS jobs CASCADE;
+CREATE TABLE jobs (
+    id               BIGSERIAL PRIMARY KEY,
+    type             TEXT NOT NULL,
+    status           job_status NOT NULL DEFAULT 'queued',
+    params           JSONB NOT NULL DEFAULT '{}',
+
+    -- Handler specific state that a job is resumed from after a restart.
+    state            JSONB NULL,
+
+    -- Optional result of a finished job, eg: a report.
+    result           JSONB NULL,
+    total            INTEGER NOT NULL DEFAULT 0,
+    done             INTEGER NOT NULL DEFAULT 0,
+    error            TEXT NOT NULL DEFAULT '',
+
+    -- Set when the cancellation of a running job is requested.
+    cancel           BOOLEAN NOT NULL DEFAULT false,
+
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    started_at       TIMESTAMP WITH TIME ZONE NULL,
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    finished_at      TIMESTAMP WITH TIME ZONE NULL
+);
+DROP INDEX IF EXISTS idx_jobs_type_status; CREATE INDEX idx_jobs_type_status ON jobs(type, status);
+
+-- export files
+-- Files uploaded by scheduled exports that are deleted from the store
+-- once they're beyond an export's retention.
+DROP TABLE IF EXISTS export_files CASCADE;
+CREATE TABLE export_files (
+    id               BIGSERIAL PRIMARY KEY,
+    export           TEXT NOT NULL,
+    file             TEXT NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_export_files_export; CREATE INDEX idx_export_files_export ON export_files(export);
+
+-- webhook deliveries
+-- Outbound webhook payloads queued for delivery to an endpoint (by its name in
+-- the config). Failed deliveries are retried at next_at until they exhaust
+-- the retry schedule and are moved to webhook_dead_letters.
+DROP TABLE IF EXISTS webhook_deliveries CASCADE;
+CREATE TABLE webhook_deliveries (
+    id               BIGSERIAL PRIMARY KEY,
+    endpoint         TEXT NOT NULL,
+    event            TEXT NOT NULL,
+    body             TEXT NOT NULL,
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    last_error       TEXT NOT NULL DEFAULT '',
+    next_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_webhook_deliveries_next_at; CREATE INDEX idx_webhook_deliveries_next_at ON webhook_deliveries(next_at);
+
+DROP TABLE IF EXISTS webhook_dead_letters CASCADE;
+CREATE TABLE webhook_dead_letters (
+    id               BIGSERIAL PRIMARY KEY,
+    endpoint         TEXT NOT NULL,
+    event            TEXT NOT NULL,
+    body             TEXT NOT NULL,
+    attempts         INTEGER NOT NULL DEFAULT 0,
+    last_error       TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    failed_at        TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- users
+-- Users of the admin. Their roles have the permission scopes of the API
+-- endpoints they can access. See authorize().
+DROP TABLE IF EXISTS users CASCADE;
+CREATE TABLE users (
+    id               SERIAL PRIMARY KEY,
+    email            TEXT NOT NULL,
+    name             TEXT NOT NULL,
+
+    -- bcrypt hash of the password.
+    password         TEXT NOT NULL,
+    role             user_role NOT NULL,
+    status           user_status NOT NULL DEFAULT 'enabled',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_users_email; CREATE UNIQUE INDEX idx_users_email ON users(LOWER(email));
+
+-- rendered messages
+-- The log of rendered campaign messages (a sample of the recipients or
+-- specific e-mails) for debugging that's purged after its retention.
+DROP TABLE IF EXISTS rendered_messages CASCADE;
+CREATE TABLE rendered_messages (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- Headers including From, To, and Subject, eg: {"Subject": [".."]}
+    headers          JSONB NOT NULL DEFAULT '{}',
+    body             TEXT NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_rendered_msgs_camp_id; CREATE INDEX idx_rendered_msgs_camp_id ON rendered_messages(campaign_id);
+DROP INDEX IF EXISTS idx_rendered_msgs_sub_id; CREATE INDEX idx_rendered_msgs_sub_id ON rendered_messages(subscriber_id);
+DROP INDEX IF EXISTS idx_rendered_msgs_created_at; CREATE INDEX idx_rendered_msgs_created_at ON rendered_messages(created_at);
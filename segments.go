@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/segment"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+// segmentReq represents a segment create / update / count request.
+type segmentReq struct {
+	Name  string       `json:"name"`
+	Rules segment.Rule `json:"rules"`
+}
+
+// handleGetSegments handles retrieval of segments. When a single segment
+// is requested, the number of subscribers matching it is also returned.
+func handleGetSegments(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.Segment
+
+		id, _  = strconv.Atoi(c.Param("id"))
+		single = false
+	)
+
+	// Fetch one segment.
+	if id > 0 {
+		single = true
+	}
+
+	if err := app.queries.GetSegments.Select(&out, id); err != nil {
+		app.log.Printf("error fetching segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching segments: %s", pqErrMsg(err)))
+	}
+	if single && len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Segment not found.")
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	if !single {
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Count the matching subscribers.
+	var r segment.Rule
+	if err := json.Unmarshal(out[0].Rules, &r); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error reading segment rules: %v", err))
+	}
+	n, err := countSegment(r, app)
+	if err != nil {
+		return err
+	}
+	out[0].Count = n
+
+	return c.JSON(http.StatusOK, okResp{out[0]})
+}
+
+// handleCountSegment compiles a filter tree and returns the number of
+// subscribers matching it without storing it.
+func handleCountSegment(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req segmentReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	n, err := countSegment(req.Rules, app)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		Count int `json:"count"`
+	}{n}})
+}
+
+// handleCreateSegment handles segment creation.
+func handleCreateSegment(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req segmentReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
+	}
+
+	rules, err := validateSegmentRules(req.Rules)
+	if err != nil {
+		return err
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error generating UUID")
+	}
+
+	// Insert and read ID.
+	var newID int
+	if err := app.queries.CreateSegment.Get(&newID, uu, req.Name, rules); err != nil {
+		app.log.Printf("error creating segment: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating segment: %s", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprintf("%d", newID))
+	return handleGetSegments(c)
+}
+
+// handleUpdateSegment handles segment modification.
+func handleUpdateSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   segmentReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Name != "" && !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
+	}
+
+	rules, err := validateSegmentRules(req.Rules)
+	if err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdateSegment.Exec(id, req.Name, rules)
+	if err != nil {
+		app.log.Printf("error updating segment: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating segment: %s", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Segment not found.")
+	}
+
+	return handleGetSegments(c)
+}
+
+// handleDeleteSegment handles segment deletion.
+func handleDeleteSegment(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if _, err := app.queries.DeleteSegment.Exec(id); err != nil {
+		app.log.Printf("error deleting segment: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error deleting segment: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateSegmentRules compiles a filter tree to validate it and returns
+// its JSON representation for storage.
+func validateSegmentRules(r segment.Rule) ([]byte, error) {
+	if _, _, err := segment.Compile(r, 0, nil); err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid rules: %v", err))
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid rules: %v", err))
+	}
+	return b, nil
+}
+
+// countSegment compiles a filter tree and returns the number of subscribers
+// matching it.
+func countSegment(r segment.Rule, app *App) (int, error) {
+	exp, args, err := segment.Compile(r, 0, app.attribIndexes.Keys())
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid rules: %v", err))
+	}
+
+	// Create a readonly transaction as an additional safeguard.
+	tx, err := app.db.BeginTxx(context.Background(), &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		app.log.Printf("error preparing segment query: %v", err)
+		return 0, echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error preparing segment query: %v", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	var n int
+	if err := tx.Get(&n, fmt.Sprintf(app.queries.CountSegmentSubscribers, exp), args...); err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error querying segment: %v", pqErrMsg(err)))
+	}
+	return n, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/koanf"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+// sendConfirmConf contains the settings of the confirmation of large sends.
+type sendConfirmConf struct {
+	Enabled   bool          `koanf:"enabled"`
+	Threshold int           `koanf:"threshold"`
+	Window    time.Duration `koanf:"window"`
+}
+
+// sendConfirmation is a confirmation of the number of recipients that a
+// campaign is started with. Token is empty if no confirmation is required.
+type sendConfirmation struct {
+	CampaignID int       `json:"campaign_id"`
+	Recipients int       `json:"recipients"`
+	Required   bool      `json:"required"`
+	Token      string    `json:"token,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at,omitempty"`
+}
+
+// sendConfirmations holds the issued confirmation tokens until they're used
+// or expire.
+type sendConfirmations struct {
+	sync.Mutex
+	tokens map[string]sendConfirmation
+}
+
+// handleConfirmCampaignSend returns the number of subscribers a campaign
+// would be sent to if it were started now and, if it's above the threshold,
+// a token to start or schedule it with (confirm_token on /status). Starting a
+// paused campaign only counts its remaining recipients.
+func handleConfirmCampaignSend(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		conf  = app.constants.SendConfirm
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	var cm models.Campaign
+	if err := app.queries.GetCampaign.Get(&cm, id, nil); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Campaign not found.")
+		}
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign: %s", pqErrMsg(err)))
+	}
+
+	switch cm.Status {
+	case models.CampaignStatusDraft, models.CampaignStatusScheduled, models.CampaignStatusPaused:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Only drafts, scheduled, and paused campaigns can be confirmed.")
+	}
+
+	// Segments are snapshotted on starting the campaign. Take a fresh one
+	// so that the count matches.
+	if err := excludeCampaignSegment(cm.ID, cm.ExcludeSegmentID, app); err != nil {
+		app.log.Printf("error saving campaign exclusions: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign exclusions: %v", pqErrMsg(err)))
+	}
+	if err := snapshotCampaignSegments(cm.ID, app); err != nil {
+		app.log.Printf("error saving campaign segments: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error saving campaign segments: %v", pqErrMsg(err)))
+	}
+
+	n, err := countSendRecipients(cm, app)
+	if err != nil {
+		app.log.Printf("error fetching campaign recipients: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign recipients: %s", pqErrMsg(err)))
+	}
+
+	out := sendConfirmation{
+		CampaignID: cm.ID,
+		Recipients: n,
+		Required:   conf.Enabled && n > conf.Threshold,
+	}
+	if out.Required {
+		uu, err := uuid.NewV4()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error generating token: %v", err))
+		}
+		out.Token = uu.String()
+		out.ExpiresAt = time.Now().Add(conf.Window)
+		app.sendConfirms.add(out)
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// checkSendConfirmation checks that a campaign that's being started or
+// scheduled above the threshold has a valid confirmation token, and uses
+// up the token. The segments of the campaign should be snapshotted.
+func checkSendConfirmation(cm models.Campaign, token string, app *App) error {
+	conf := app.constants.SendConfirm
+	if !conf.Enabled {
+		return nil
+	}
+
+	n, err := countSendRecipients(cm, app)
+	if err != nil {
+		app.log.Printf("error fetching campaign recipients: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign recipients: %s", pqErrMsg(err)))
+	}
+	if n <= conf.Threshold {
+		return nil
+	}
+
+	if token == "" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("The campaign is sent to %d subscribers and needs a `confirm_token` from /api/campaigns/%d/confirm.", n, cm.ID))
+	}
+	if err := app.sendConfirms.use(token, cm.ID); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return nil
+}
+
+// countSendRecipients returns the number of subscribers a campaign would be
+// sent to if it were started now.
+func countSendRecipients(cm models.Campaign, app *App) (int, error) {
+	if cm.Status == models.CampaignStatusPaused {
+		if n := cm.ToSend - cm.Sent; n > 0 {
+			return n, nil
+		}
+		return 0, nil
+	}
+
+	var out campaignRecipientCounts
+	if err := app.queries.GetCampaignRecipientCounts.Get(&out, cm.ID); err != nil {
+		return 0, err
+	}
+	return out.Total - out.Excluded, nil
+}
+
+// add stores an issued token and forgets the expired ones.
+func (s *sendConfirmations) add(c sendConfirmation) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for t, e := range s.tokens {
+		if now.After(e.ExpiresAt) {
+			delete(s.tokens, t)
+		}
+	}
+	s.tokens[c.Token] = c
+}
+
+// use checks that a token was issued for a campaign and hasn't expired,
+// and forgets it.
+func (s *sendConfirmations) use(token string, campID int) error {
+	s.Lock()
+	defer s.Unlock()
+
+	c, ok := s.tokens[token]
+	if !ok || c.CampaignID != campID {
+		return errors.New("Invalid or already used `confirm_token`.")
+	}
+	delete(s.tokens, token)
+
+	if time.Now().After(c.ExpiresAt) {
+		return errors.New("The `confirm_token` has expired. Confirm the campaign again.")
+	}
+	return nil
+}
+
+// loadSendConfirm loads the settings of the confirmation of large sends
+// from a config.
+func loadSendConfirm(k *koanf.Koanf) (sendConfirmConf, error) {
+	var c sendConfirmConf
+	if err := k.Unmarshal("send_confirmation", &c); err != nil {
+		return c, err
+	}
+	if c.Threshold < 0 {
+		return c, errors.New("send_confirmation.threshold can't be negative")
+	}
+	if c.Enabled && c.Window <= 0 {
+		return c, errors.New("send_confirmation.window should be a positive duration")
+	}
+	return c, nil
+}
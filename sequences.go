@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	// sequenceMaxSteps is the maximum number of steps in a sequence.
+	sequenceMaxSteps = 50
+
+	// sequenceInterval is the interval at which subscribers are enrolled in
+	// sequences and their due steps are sent, in batches of sequenceBatchSize.
+	sequenceInterval  = time.Second * 30
+	sequenceBatchSize = 1000
+
+	// sequenceLease is the time (in seconds) for which the due steps of a
+	// batch are leased to be sent, like welcomeLease. Steps that couldn't be
+	// sent after sequenceMaxAttempts are skipped.
+	sequenceLease       = 600
+	sequenceMaxAttempts = 3
+)
+
+// sequenceReq represents a sequence create / update request. The steps
+// replace the sequence's steps, in their order.
+type sequenceReq struct {
+	Name       string                `json:"name"`
+	Trigger    string                `json:"trigger"`
+	TriggerURL string                `json:"trigger_url"`
+	Enabled    bool                  `json:"enabled"`
+	Steps      []models.SequenceStep `json:"steps"`
+}
+
+// sequenceMessage represents a step of a sequence that's due to a subscriber.
+type sequenceMessage struct {
+	models.Subscriber
+
+	SequenceID int  `db:"sequence_id"`
+	Step       int  `db:"step"`
+	Attempts   int  `db:"attempts"`
+	CampaignID int  `db:"campaign_id"`
+	Eligible   bool `db:"eligible"`
+}
+
+type sequenceSubscribersWrap struct {
+	Results []models.SequenceSubscriber `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// handleGetSequences handles retrieval of sequences.
+func handleGetSequences(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		out []models.Sequence
+
+		id, _  = strconv.Atoi(c.Param("id"))
+		single = false
+	)
+
+	// Fetch one sequence.
+	if id > 0 {
+		single = true
+	}
+
+	if err := app.queries.GetSequences.Select(&out, id); err != nil {
+		app.log.Printf("error fetching sequences: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching sequences: %s", pqErrMsg(err)))
+	}
+	if single && len(out) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Sequence not found.")
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	if single {
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateSequence handles sequence creation. Only the subscribers that
+// click the trigger link after a sequence is created are enrolled in it.
+func handleCreateSequence(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req sequenceReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if err := validateSequence(req); err != nil {
+		return err
+	}
+
+	tx, err := app.db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		app.log.Printf("error creating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating sequence: %s", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	// Insert and read ID.
+	var newID int
+	if err := tx.Stmtx(app.queries.CreateSequence).Get(&newID, req.Name, req.Trigger,
+		req.TriggerURL, req.Enabled); err != nil {
+		app.log.Printf("error creating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating sequence: %s", pqErrMsg(err)))
+	}
+	if err := insertSequenceSteps(tx, newID, req.Steps, app); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		app.log.Printf("error creating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating sequence: %s", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprintf("%d", newID))
+	return handleGetSequences(c)
+}
+
+// handleUpdateSequence handles sequence modification. The subscribers in
+// the sequence carry on from the steps after the ones they were last sent,
+// by position.
+func handleUpdateSequence(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   sequenceReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if err := validateSequence(req); err != nil {
+		return err
+	}
+
+	tx, err := app.db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		app.log.Printf("error updating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating sequence: %s", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Stmtx(app.queries.UpdateSequence).Exec(id, req.Name, req.Trigger,
+		req.TriggerURL, req.Enabled)
+	if err != nil {
+		app.log.Printf("error updating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating sequence: %s", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Sequence not found.")
+	}
+
+	if _, err := tx.Stmtx(app.queries.DeleteSequenceSteps).Exec(id); err != nil {
+		app.log.Printf("error deleting sequence steps: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating sequence: %s", pqErrMsg(err)))
+	}
+	if err := insertSequenceSteps(tx, id, req.Steps, app); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		app.log.Printf("error updating sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating sequence: %s", pqErrMsg(err)))
+	}
+
+	return handleGetSequences(c)
+}
+
+// handleDeleteSequence handles sequence deletion, which drops the state of
+// its subscribers.
+func handleDeleteSequence(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if _, err := app.queries.DeleteSequence.Exec(id); err != nil {
+		app.log.Printf("error deleting sequence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error deleting sequence: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetSequenceSubscribers returns the subscribers of a sequence and
+// where they are in it, optionally filtered by their status.
+func handleGetSequenceSubscribers(c echo.Context) error {
+	var (
+		app    = c.Get("app").(*App)
+		id, _  = strconv.Atoi(c.Param("id"))
+		status = c.QueryParam("status")
+		pg     = getPagination(c.QueryParams())
+		out    sequenceSubscribersWrap
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	switch status {
+	case "", models.SequenceSubActive, models.SequenceSubFinished, models.SequenceSubExited:
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid `status`.")
+	}
+
+	if err := app.queries.GetSequenceSubscribers.Select(&out.Results,
+		id, status, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching sequence subscribers: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching sequence subscribers: %s", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.SequenceSubscriber{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// validateSequence validates the fields and the steps of a sequence.
+func validateSequence(req sequenceReq) error {
+	if !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
+	}
+
+	// Sequences on list joins are the welcome steps of the lists.
+	switch req.Trigger {
+	case models.SequenceTriggerLinkClick:
+		if !strHasLen(req.TriggerURL, 1, 2000) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid `trigger_url`.")
+		}
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Invalid trigger '%s'. Should be %s. For list joins, use the welcome steps of the list.",
+				req.Trigger, models.SequenceTriggerLinkClick))
+	}
+
+	if len(req.Steps) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "A sequence needs at least one step.")
+	}
+	if len(req.Steps) > sequenceMaxSteps {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("A sequence can have up to %d steps.", sequenceMaxSteps))
+	}
+	for i, s := range req.Steps {
+		if s.CampaignID < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Step %d: invalid `campaign_id`", i+1))
+		}
+		if s.Delay < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Step %d: `delay` can't be negative", i+1))
+		}
+	}
+	return nil
+}
+
+// insertSequenceSteps inserts the steps of a sequence in a transaction.
+func insertSequenceSteps(tx *sqlx.Tx, id int, steps []models.SequenceStep, app *App) error {
+	for i, s := range steps {
+		if _, err := tx.Stmtx(app.queries.InsertSequenceStep).Exec(id, i+1, s.CampaignID, s.Delay); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					fmt.Sprintf("Step %d: unknown campaign.", i+1))
+			}
+			app.log.Printf("error inserting sequence step: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error saving sequence steps: %s", pqErrMsg(err)))
+		}
+	}
+	return nil
+}
+
+// runSequences is a blocking function that periodically enrolls the
+// subscribers that have clicked the trigger links of sequences and sends the
+// steps that are due to them through the pipeline of campaign messages, like
+// the welcome steps that send campaigns. Steps are sent with the content, the
+// template, and the messenger of their campaigns, and their views and clicks
+// are tracked against the campaigns. The campaigns needn't be (and usually
+// aren't) started.
+func runSequences(app *App) {
+	for {
+		var n int
+		if err := app.queries.EnrollSequenceSubscribers.Get(&n); err != nil {
+			app.log.Printf("error enrolling sequence subscribers: %v", err)
+		} else if n > 0 {
+			app.log.Printf("enrolled %d subscribers in sequences", n)
+		}
+
+		for {
+			n, err := sendSequenceMessages(app)
+			if err != nil {
+				app.log.Printf("error sending sequence messages: %v", err)
+			}
+			if err != nil || n < sequenceBatchSize {
+				break
+			}
+		}
+		time.Sleep(sequenceInterval)
+	}
+}
+
+// sendSequenceMessages leases a batch of subscribers whose sequence steps are
+// due, sends the steps, and moves the subscribers on to their next steps once
+// they're sent. It returns the number of messages in the batch.
+func sendSequenceMessages(app *App) (int, error) {
+	var msgs []sequenceMessage
+	if err := app.queries.NextSequenceMessages.Select(&msgs, sequenceBatchSize, sequenceLease); err != nil {
+		return 0, err
+	}
+
+	// Fetch and compile each campaign once per batch.
+	camps := make(map[int]*models.Campaign)
+	for _, s := range msgs {
+		// Steps whose campaigns have been deleted are skipped and subscribers
+		// that aren't eligible exit the sequence.
+		sent := false
+		if s.Eligible && s.CampaignID > 0 {
+			camp, ok := camps[s.CampaignID]
+			if !ok {
+				camp = loadStepCampaign(s.CampaignID, app)
+				camps[s.CampaignID] = camp
+			}
+
+			err := errStepCampaign
+			if camp != nil {
+				err = sendCampaignStep(camp, s.Subscriber, app)
+			}
+			if err != nil {
+				app.log.Printf("error sending step %d of sequence %d to subscriber %d: %v",
+					s.Step, s.SequenceID, s.ID, err)
+				if s.Attempts < sequenceMaxAttempts {
+					continue
+				}
+			}
+			sent = err == nil
+		}
+
+		if _, err := app.queries.AdvanceSequenceSubscriber.Exec(s.SequenceID, s.ID,
+			s.Step, s.Eligible, sent); err != nil {
+			return len(msgs), err
+		}
+	}
+	return len(msgs), nil
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/providers/rawbytes"
+	"github.com/labstack/echo"
+)
+
+// reloadablePrefixes are the config keys that a settings reload applies.
+// The rest are read by the components (the campaign manager, webhooks,
+// the HTTP server etc.) on startup and require a restart. Changes to the
+// SMTP servers only rebuild the e-mail messenger and its connection pools.
+var reloadablePrefixes = []string{"privacy.", "upload.s3.", "upload.max_file_size",
+	"upload.allowed_", "smtp.", "sanitize.", "send_confirmation."}
+
+var (
+	// liveApp holds the *App that's injected into HTTP handlers. A reload
+	// swaps it with a copy that has the reloaded settings while requests
+	// that are already being processed finish with the one they started with.
+	liveApp atomic.Value
+
+	// reloadMut serializes reloads and guards lastConf, the config that
+	// was loaded by the last reload (or on startup).
+	reloadMut sync.Mutex
+	lastConf  *koanf.Koanf
+)
+
+// namedConfPrefixes are the config sections whose sub-sections are named by
+// users (eg: smtp.my0). In the schema, their names are replaced with *.
+var namedConfPrefixes = []string{"smtp.", "messengers.", "footer.lang.",
+	"exports.", "webhooks.endpoints.", "subscriber_webhook.mapping.attribs.",
+	"domain_limits."}
+
+// secretConfKeys are the words in the names of the config keys whose
+// values are secrets.
+var secretConfKeys = []string{"password", "secret", "token", "private_key"}
+
+// settingSchema describes a config key.
+type settingSchema struct {
+	Key string `json:"key"`
+
+	// string, duration, int, float, bool, or array. Numbers are ints if
+	// their defaults are whole numbers.
+	Type string `json:"type"`
+
+	// Type of the items of arrays.
+	Items string `json:"items,omitempty"`
+
+	// The default value in the sample config, which is empty for secrets.
+	Default interface{} `json:"default"`
+
+	Secret     bool   `json:"secret"`
+	Reloadable bool   `json:"reloadable"`
+	Env        string `json:"env"`
+}
+
+type settingsReloadResp struct {
+	// Keys that changed since the last reload.
+	Changed []string `json:"changed"`
+
+	// Changed keys that were applied.
+	Applied []string `json:"applied"`
+
+	// Keys that differ from the running config and that only take
+	// effect on a restart, including ones changed before the last reload.
+	RestartRequired []string `json:"restart_required"`
+}
+
+// handleReloadSettings reloads the config files and environment variables,
+// applies the reloadable settings without restarting, and returns the keys
+// that changed. Values are never returned as they may be secrets.
+func handleReloadSettings(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	reloadMut.Lock()
+	defer reloadMut.Unlock()
+
+	k := koanf.New(".")
+	if err := loadConfig(k); err != nil {
+		app.log.Printf("error reloading config: %v", err)
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("Error reading config: %v", err))
+	}
+
+	prev := lastConf
+	if prev == nil {
+		prev = ko
+	}
+
+	// Apply the changed settings on a copy of the current instance.
+	var (
+		changed = diffConfKeys(prev, k)
+		cur     = liveApp.Load().(*App)
+		next    = *cur
+		cs      = *cur.constants
+		out     = settingsReloadResp{Changed: changed, Applied: []string{}}
+	)
+	if hasKeyPrefix(changed, "privacy.") {
+		p, err := loadPrivacy(k)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Error loading privacy settings: %v", err))
+		}
+		cs.Privacy = p
+	}
+	if hasKeyPrefix(changed, "upload.max_file_size") || hasKeyPrefix(changed, "upload.allowed_") {
+		u, err := loadUpload(k)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Error loading upload settings: %v", err))
+		}
+		cs.MediaUpload = u
+	}
+	if hasKeyPrefix(changed, "sanitize.") {
+		s, err := loadSanitizer(k)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Error loading sanitize settings: %v", err))
+		}
+		cs.Sanitizer = s
+	}
+	if hasKeyPrefix(changed, "send_confirmation.") {
+		s, err := loadSendConfirm(k)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Error loading send_confirmation settings: %v", err))
+		}
+		cs.SendConfirm = s
+	}
+
+	// Switching providers requires a restart.
+	if hasKeyPrefix(changed, "upload.s3.") && cs.MediaProvider == "s3" &&
+		k.String("upload.provider") == "s3" {
+		st, err := newMediaStore(k)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Error initializing upload provider: %v", err))
+		}
+		next.media = st
+	}
+
+	// Rebuild the e-mail messenger. The running campaigns switch to it
+	// without being interrupted.
+	if hasKeyPrefix(changed, "smtp.") {
+		msgr, err := newEmailer(k, initVERP())
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				fmt.Sprintf("Error initializing e-mail messenger: %v", err))
+		}
+		if err := app.manager.ReplaceMessenger(msgr); err != nil {
+			msgr.Close()
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error replacing e-mail messenger: %v", err))
+		}
+		next.messenger = msgr
+	}
+
+	next.constants = &cs
+	liveApp.Store(&next)
+	lastConf = k
+
+	for _, key := range changed {
+		if isReloadable(key) {
+			out.Applied = append(out.Applied, key)
+		}
+	}
+
+	// Compare with the startup config for what's pending a restart.
+	out.RestartRequired = []string{}
+	for _, key := range diffConfKeys(ko, k) {
+		if !isReloadable(key) {
+			out.RestartRequired = append(out.RestartRequired, key)
+		}
+	}
+
+	app.log.Printf("reloaded settings: %d changed, %d applied, %d require a restart",
+		len(out.Changed), len(out.Applied), len(out.RestartRequired))
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetSettingsSchema returns the schema of the config keys. It's
+// generated from the sample config that's embedded in the binary (the one
+// --new-config writes), which has every key with its default value.
+func handleGetSettingsSchema(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	b, err := app.fs.Read("config.toml.sample")
+	if err != nil {
+		app.log.Printf("error reading sample config: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error reading sample config: %v", err))
+	}
+
+	k := koanf.New(".")
+	if err := k.Load(rawbytes.Provider(b), toml.Parser()); err != nil {
+		app.log.Printf("error parsing sample config: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error parsing sample config: %v", err))
+	}
+
+	return c.JSON(http.StatusOK, okResp{makeSettingsSchema(k)})
+}
+
+// makeSettingsSchema returns the sorted schema of the keys in a config.
+func makeSettingsSchema(k *koanf.Koanf) []settingSchema {
+	var (
+		seen = make(map[string]bool)
+		out  = []settingSchema{}
+	)
+	for key, val := range k.All() {
+		key = schemaKey(key)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		s := settingSchema{
+			Key:        key,
+			Type:       confValType(val),
+			Default:    val,
+			Secret:     isSecretKey(key),
+			Reloadable: isReloadable(key),
+			Env:        "LISTMONK_" + strings.ToUpper(strings.Replace(key, ".", "__", -1)),
+		}
+		if s.Type == "array" {
+			s.Items = "string"
+			if v, ok := val.([]interface{}); ok && len(v) > 0 {
+				s.Items = confValType(v[0])
+			} else {
+				s.Default = []interface{}{}
+			}
+		}
+		if s.Secret {
+			s.Default = ""
+		}
+		out = append(out, s)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Key < out[j].Key
+	})
+	return out
+}
+
+// schemaKey replaces the names of the user named sections in a key with *,
+// eg: smtp.my0.host => smtp.*.host.
+func schemaKey(key string) string {
+	for _, p := range namedConfPrefixes {
+		if !strings.HasPrefix(key, p) {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(key, p), ".", 2)
+		if len(parts) == 2 {
+			return p + "*." + parts[1]
+		}
+	}
+	return key
+}
+
+// confValType returns the schema type of a config value.
+func confValType(v interface{}) string {
+	switch v := v.(type) {
+	case bool:
+		return "bool"
+	case int, int64:
+		return "int"
+	case float64:
+		if v == math.Trunc(v) {
+			return "int"
+		}
+		return "float"
+	case []interface{}, nil:
+		// Empty arrays are nil.
+		return "array"
+	case string:
+		// Durations (eg: 5s, or "0") are strings in the config.
+		if _, err := time.ParseDuration(v); err == nil {
+			return "duration"
+		}
+	}
+	return "string"
+}
+
+// isSecretKey checks whether the value of a config key is a secret.
+func isSecretKey(key string) bool {
+	name := key[strings.LastIndex(key, ".")+1:]
+	for _, s := range secretConfKeys {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// diffConfKeys returns the sorted keys whose values differ between two configs.
+func diffConfKeys(a, b *koanf.Koanf) []string {
+	var (
+		av  = a.All()
+		bv  = b.All()
+		out = []string{}
+	)
+	for k, v := range av {
+		if w, ok := bv[k]; !ok || !reflect.DeepEqual(v, w) {
+			out = append(out, k)
+		}
+	}
+	for k := range bv {
+		if _, ok := av[k]; !ok {
+			out = append(out, k)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// isReloadable checks whether a config key is applied by settings reloads.
+func isReloadable(key string) bool {
+	for _, p := range reloadablePrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasKeyPrefix checks whether any of the keys has the given prefix.
+func hasKeyPrefix(keys []string, prefix string) bool {
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			return true
+		}
+	}
+	return false
+}
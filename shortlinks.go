@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// shortCodeLen is the length of the short codes of links. 62^10 codes
+	// make them impractical to guess or enumerate.
+	shortCodeLen     = 10
+	shortCodeChars   = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	shortCodeRetries = 3
+)
+
+// shortLink represents a short link of a campaign and its clicks.
+type shortLink struct {
+	Code      string    `db:"code" json:"code"`
+	URL       string    `db:"url" json:"url"`
+	ShortURL  string    `db:"-" json:"short_url"`
+	Clicks    int       `db:"clicks" json:"clicks"`
+	CreatedAt time.Time `db:"created_at" json:"created_at"`
+}
+
+// handleShortLinkRedirect redirects a short link to its original URL after
+// recording the click in the campaign. These links replace the {{ TrackLink }}
+// links of campaigns that shorten links. Short links are shared by the
+// subscribers of a campaign and their clicks aren't attributed to them.
+func handleShortLinkRedirect(c echo.Context) error {
+	var (
+		app  = c.Get("app").(*App)
+		code = c.Param("code")
+	)
+
+	// Clicks aren't recorded if tracking is disabled.
+	var (
+		url  string
+		stmt = app.queries.RegisterShortLinkClick
+	)
+	if app.constants.Privacy.DisableTracking {
+		stmt = app.queries.GetShortLinkURL
+	}
+	if validShortCode(code) {
+		if err := stmt.Get(&url, code); err != nil && err != sql.ErrNoRows {
+			app.log.Printf("error fetching short link: %s", err)
+			return c.Render(http.StatusInternalServerError, tplMessage,
+				makeMsgTpl("Error opening link", "",
+					"There was an error opening the link. Please try later."))
+		}
+	}
+	if url == "" {
+		return c.Render(http.StatusNotFound, tplMessage,
+			makeMsgTpl("Link not found", "", "The link is invalid or has expired."))
+	}
+
+	return c.Redirect(http.StatusTemporaryRedirect, url)
+}
+
+// handleGetCampaignShortLinks returns the short links of a campaign and
+// their clicks.
+func handleGetCampaignShortLinks(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		out   []shortLink
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetCampaignShortLinks.Select(&out, id); err != nil {
+		app.log.Printf("error fetching campaign short links: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching campaign short links: %s", pqErrMsg(err)))
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	for i := range out {
+		out[i].ShortURL = fmt.Sprintf(app.constants.ShortLinkURL, out[i].Code)
+	}
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// newShortCode generates a random short code.
+func newShortCode() (string, error) {
+	var (
+		b   = make([]byte, shortCodeLen)
+		max = big.NewInt(int64(len(shortCodeChars)))
+	)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = shortCodeChars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// validShortCode checks whether a string is a well formed short code.
+func validShortCode(s string) bool {
+	if len(s) != shortCodeLen {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z') {
+			return false
+		}
+	}
+	return true
+}
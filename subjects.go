@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// subjectWarnLen is the length (in characters) of subjects beyond which
+	// they're warned about as most clients truncate them.
+	subjectWarnLen = 78
+
+	// ctxCampaignWarnings is the key of the request context that has the
+	// warnings of a campaign that's been saved or started.
+	ctxCampaignWarnings = "campaign_warnings"
+
+	// campaignLangsMax is the maximum number of languages of subscribers
+	// that are checked for variants when a localized campaign is started.
+	campaignLangsMax = 100
+)
+
+// campaignLang represents a language of the subscribers of a campaign's lists.
+type campaignLang struct {
+	Lang  string `db:"lang"`
+	Count int    `db:"count"`
+}
+
+// normalizeSubject normalizes a subject to be a valid single line header:
+// invalid UTF-8, byte order marks, and control characters are removed, the
+// whitespace is collapsed, and emoji variation selectors and joiners that
+// don't follow a character (which clients render as boxes) and duplicate
+// selectors are removed. The non-ASCII text is encoded as RFC 2047
+// encoded-words by the messengers.
+func normalizeSubject(s string) string {
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "")
+	}
+
+	var (
+		b    strings.Builder
+		prev rune = ' '
+	)
+	b.Grow(len(s))
+	for _, r := range s {
+		switch {
+		case r == '\uFEFF':
+			continue
+		case unicode.IsControl(r) || unicode.IsSpace(r):
+			r = ' '
+			if prev == ' ' {
+				continue
+			}
+		case isEmojiModifier(r):
+			if prev == ' ' || r == prev {
+				continue
+			}
+		}
+		b.WriteRune(r)
+		prev = r
+	}
+
+	// Joiners at the end don't join anything.
+	return strings.TrimRight(strings.TrimSpace(b.String()), "\u200D")
+}
+
+// isEmojiModifier checks whether a rune is a variation selector or the zero
+// width joiner, which only modify the characters they follow.
+func isEmojiModifier(r rune) bool {
+	return (r >= '\uFE00' && r <= '\uFE0F') || r == '\u200D'
+}
+
+// subjectWarnings returns warnings for the subjects of a campaign and its
+// language variants that are likely to be truncated.
+func subjectWarnings(c campaignReq) []string {
+	var out []string
+	if n := utf8.RuneCountInString(c.Subject); n > subjectWarnLen {
+		out = append(out, fmt.Sprintf("The subject has %d characters and may be truncated beyond %d.", n, subjectWarnLen))
+	}
+	for lang, v := range c.Variants {
+		if n := utf8.RuneCountInString(v.Subject); n > subjectWarnLen {
+			out = append(out, fmt.Sprintf("The subject of the variant '%s' has %d characters and may be truncated beyond %d.",
+				lang, n, subjectWarnLen))
+		}
+	}
+	return out
+}
+
+// campaignLangWarnings returns warnings for the languages of the subscribers
+// of a localized campaign's lists that don't have a variant and get the
+// default subject and body.
+func campaignLangWarnings(cm models.Campaign, app *App) []string {
+	attrib := app.constants.LangAttrib
+	if len(cm.Variants) == 0 || attrib == "" {
+		return nil
+	}
+
+	var langs []campaignLang
+	if err := app.queries.GetCampaignLangs.Select(&langs, cm.ID, attrib, campaignLangsMax); err != nil {
+		app.log.Printf("error fetching campaign languages: %v", err)
+		return nil
+	}
+
+	var out []string
+	for _, l := range langs {
+		sub := models.Subscriber{Attribs: models.SubscriberAttribs{attrib: l.Lang}}
+		if cm.Variant(sub, attrib) == "" {
+			out = append(out, fmt.Sprintf("%d subscribers have the language '%s' that doesn't have a variant and will get the default subject and body.",
+				l.Count, l.Lang))
+		}
+	}
+	return out
+}
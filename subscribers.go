@@ -12,15 +12,32 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
 	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
 )
 
 const (
 	dummyUUID = "00000000-0000-0000-0000-000000000000"
 )
 
+const (
+	// What happens to the views, clicks, and conversions of deleted subscribers.
+	delHistoryAnonymize = "anonymize"
+	delHistoryDelete    = "delete"
+
+	// Sources of subscriber deletions recorded in the audit log.
+	delSourceAdmin = "admin"
+	delSourceQuery = "query"
+	delSourceWipe  = "wipe"
+
+	// deleteBatchSize is the number of subscribers deleted in a single
+	// transaction.
+	deleteBatchSize = 1000
+)
+
 // subQueryReq is a "catch all" struct for reading various
 // subscriber related requests.
 type subQueryReq struct {
@@ -40,6 +57,83 @@ type subsWrap struct {
 	Page    int    `json:"page"`
 }
 
+// subActivity represents an event in a subscriber's activity timeline.
+type subActivity struct {
+	Type         string      `db:"type" json:"type"`
+	ListID       null.Int    `db:"list_id" json:"list_id"`
+	ListName     null.String `db:"list_name" json:"list_name"`
+	CampaignID   null.Int    `db:"campaign_id" json:"campaign_id"`
+	CampaignName null.String `db:"campaign_name" json:"campaign_name"`
+	URL          null.String `db:"url" json:"url"`
+	CreatedAt    null.Time   `db:"created_at" json:"created_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+type subActivityWrap struct {
+	Results []subActivity `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// subDeletion represents an entry in the audit log of deleted subscribers.
+type subDeletion struct {
+	ID        int64     `db:"id" json:"id"`
+	UUID      string    `db:"subscriber_uuid" json:"subscriber_uuid"`
+	Source    string    `db:"source" json:"source"`
+	History   string    `db:"history" json:"history"`
+	CreatedAt null.Time `db:"created_at" json:"created_at"`
+
+	Total int `db:"total" json:"-"`
+}
+
+type subDeletionsWrap struct {
+	Results []subDeletion `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// subConsent represents the consent record of a subscription request.
+type subConsent struct {
+	Source    string
+	IP        string
+	UserAgent string
+}
+
+// subNoConsent represents a subscription that lacks consent records.
+type subNoConsent struct {
+	SubscriberID        int       `db:"subscriber_id" json:"subscriber_id"`
+	SubscriberUUID      string    `db:"subscriber_uuid" json:"subscriber_uuid"`
+	Email               string    `db:"email" json:"email"`
+	ListID              int       `db:"list_id" json:"list_id"`
+	ListName            string    `db:"list_name" json:"list_name"`
+	SubscriptionStatus  string    `db:"subscription_status" json:"subscription_status"`
+	SubscribedAt        null.Time `db:"subscribed_at" json:"subscribed_at"`
+	MissingConsent      bool      `db:"missing_consent" json:"missing_consent"`
+	MissingConfirmation bool      `db:"missing_confirmation" json:"missing_confirmation"`
+
+	Total int `db:"total" json:"-"`
+}
+
+type subNoConsentWrap struct {
+	Results []subNoConsent `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// unsubReasonCount represents the number of unsubscriptions with a reason.
+// Reason is empty for the ones that didn't give one.
+type unsubReasonCount struct {
+	Reason string `db:"reason" json:"reason"`
+	Count  int    `db:"count" json:"count"`
+}
+
 // subProfileData represents a subscriber's collated data in JSON
 // for export.
 type subProfileData struct {
@@ -163,9 +257,12 @@ func handleCreateSubscriber(c echo.Context) error {
 	if err := subimporter.ValidateFields(req); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
+	if err := app.constants.Attribs.Normalize(req.Attribs); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
 	// Insert the subscriber into the DB.
-	sub, err := insertSubscriber(req, app)
+	sub, err := insertSubscriber(req, subConsent{}, app)
 	if err != nil {
 		return err
 	}
@@ -194,8 +291,17 @@ func handleUpdateSubscriber(c echo.Context) error {
 	if req.Name != "" && !strHasLen(req.Name, 1, stdInputMaxLen) {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
 	}
+	if err := app.constants.Attribs.Normalize(req.Attribs); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
 
-	_, err := app.queries.UpdateSubscriber.Exec(req.ID,
+	// The previous status of the subscriber for its status transition.
+	prev, err := getSubscriber(int(id), app)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.queries.UpdateSubscriber.Exec(req.ID,
 		strings.ToLower(strings.TrimSpace(req.Email)),
 		strings.TrimSpace(req.Name),
 		req.Status,
@@ -207,12 +313,19 @@ func handleUpdateSubscriber(c echo.Context) error {
 			fmt.Sprintf("Error updating subscriber: %v", pqErrMsg(err)))
 	}
 
+	// Apply list rules to the updated subscriber.
+	applyListRules([]int64{id}, nil, app)
+
 	// Send a confirmation e-mail (if there are any double opt-in lists).
 	sub, err := getSubscriber(int(id), app)
 	if err != nil {
 		return err
 	}
 	_ = sendOptinConfirmation(sub, []int64(req.Lists), app)
+	pushSubscriberEvent(webhooks.EventSubscriberUpdated, sub, app)
+	if sub.Status == models.SubscriberStatusBlackListed && prev.Status != models.SubscriberStatusBlackListed {
+		onStatusTransition(webhooks.EventSubscriberBlacklisted, []int64{id}, nil, app)
+	}
 
 	return c.JSON(http.StatusOK, sub)
 }
@@ -278,11 +391,13 @@ func handleBlacklistSubscribers(c echo.Context) error {
 		IDs = req.SubscriberIDs
 	}
 
-	if _, err := app.queries.BlacklistSubscribers.Exec(IDs); err != nil {
+	var blacklisted []int64
+	if err := app.queries.BlacklistSubscribers.Select(&blacklisted, IDs); err != nil {
 		app.log.Printf("error blacklisting subscribers: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error blacklisting: %v", err))
 	}
+	onStatusTransition(webhooks.EventSubscriberBlacklisted, blacklisted, nil, app)
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
@@ -323,14 +438,17 @@ func handleManageSubscriberLists(c echo.Context) error {
 	}
 
 	// Action.
-	var err error
+	var (
+		unsubscribed []int64
+		err          error
+	)
 	switch req.Action {
 	case "add":
 		_, err = app.queries.AddSubscribersToLists.Exec(IDs, req.TargetListIDs)
 	case "remove":
 		_, err = app.queries.DeleteSubscriptions.Exec(IDs, req.TargetListIDs)
 	case "unsubscribe":
-		_, err = app.queries.UnsubscribeSubscribersFromLists.Exec(IDs, req.TargetListIDs)
+		err = app.queries.UnsubscribeSubscribersFromLists.Select(&unsubscribed, IDs, req.TargetListIDs)
 	default:
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid action.")
 	}
@@ -340,6 +458,7 @@ func handleManageSubscriberLists(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error processing lists: %v", err))
 	}
+	onStatusTransition(webhooks.EventSubscriberUnsubscribed, unsubscribed, nil, app)
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
@@ -374,7 +493,7 @@ func handleDeleteSubscribers(c echo.Context) error {
 		IDs = i
 	}
 
-	if _, err := app.queries.DeleteSubscribers.Exec(IDs, nil); err != nil {
+	if _, err := deleteSubscribers(IDs, delSourceAdmin, app); err != nil {
 		app.log.Printf("error deleting subscribers: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error deleting subscribers: %v", err))
@@ -395,8 +514,7 @@ func handleDeleteSubscribersByQuery(c echo.Context) error {
 		return err
 	}
 
-	err := app.queries.execSubscriberQueryTpl(sanitizeSQLExp(req.Query),
-		app.queries.DeleteSubscribersByQuery,
+	IDs, err := app.queries.selectSubscriberIDsByQuery(sanitizeSQLExp(req.Query),
 		req.ListIDs, app.db)
 	if err != nil {
 		app.log.Printf("error querying subscribers: %v", err)
@@ -404,9 +522,166 @@ func handleDeleteSubscribersByQuery(c echo.Context) error {
 			fmt.Sprintf("Error: %v", err))
 	}
 
+	if _, err := deleteSubscribers(IDs, delSourceQuery, app); err != nil {
+		app.log.Printf("error deleting subscribers: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error deleting subscribers: %v", err))
+	}
+
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetSubscriberDeletions returns the audit log of deleted subscribers,
+// optionally filtered by a subscriber UUID.
+func handleGetSubscriberDeletions(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		subUUID = c.QueryParam("uuid")
+		pg      = getPagination(c.QueryParams())
+		out     subDeletionsWrap
+	)
+
+	if subUUID != "" && !reUUID.MatchString(subUUID) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid UUID.")
+	}
+
+	if err := app.queries.GetSubscriberDeletions.Select(&out.Results, subUUID, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching subscriber deletions: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching subscriber deletions: %s", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []subDeletion{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetSubscriptionsWithoutConsent returns the subscriptions that lack
+// consent records for remediation, optionally filtered by a list.
+func handleGetSubscriptionsWithoutConsent(c echo.Context) error {
+	var (
+		app       = c.Get("app").(*App)
+		listID, _ = strconv.Atoi(c.QueryParam("list_id"))
+		pg        = getPagination(c.QueryParams())
+		out       subNoConsentWrap
+	)
+
+	if err := app.queries.GetSubscriptionsWithoutConsent.Select(&out.Results, listID, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching subscriptions without consent: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching subscriptions: %s", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []subNoConsent{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetUnsubscribeReasons returns the number of unsubscriptions by reason,
+// optionally filtered by a list and/or a campaign.
+func handleGetUnsubscribeReasons(c echo.Context) error {
+	var (
+		app       = c.Get("app").(*App)
+		listID, _ = strconv.Atoi(c.QueryParam("list_id"))
+		campID, _ = strconv.Atoi(c.QueryParam("campaign_id"))
+		out       = []unsubReasonCount{}
+	)
+
+	if err := app.queries.GetUnsubscribeReasons.Select(&out, listID, campID); err != nil {
+		app.log.Printf("error fetching unsubscribe reasons: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching unsubscribe reasons: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// deleteSubscribers deletes subscribers and their subscriptions, bounces, and
+// failures, and anonymizes or deletes their views, clicks, and conversions as
+// per the privacy settings. Subscribers are deleted in batches, each in a
+// transaction, so that large deletions don't hold long locks on the related
+// tables. Deletions are recorded in the audit log and subscriber.deleted
+// webhooks are pushed for them. It returns the number of deleted subscribers.
+func deleteSubscribers(IDs []int64, source string, app *App) (int, error) {
+	var (
+		history = app.constants.Privacy.DelHistory
+		num     = 0
+	)
+	for len(IDs) > 0 {
+		batch := IDs
+		if len(batch) > deleteBatchSize {
+			batch = batch[:deleteBatchSize]
+		}
+		IDs = IDs[len(batch):]
+
+		// Fetch the subscribers for the webhooks before they're deleted.
+		var subs models.Subscribers
+		if app.webhooks.Has(webhooks.EventSubscriberDeleted) {
+			if err := app.queries.GetSubscribersByIDs.Select(&subs,
+				pq.Int64Array(batch), pq.StringArray{}); err != nil {
+				return num, err
+			}
+			if err := subs.LoadLists(app.queries.GetSubscriberListsLazy); err != nil {
+				return num, err
+			}
+		}
+
+		n, err := deleteSubscriberBatch(batch, source, history, app)
+		if err != nil {
+			return num, err
+		}
+		num += n
+
+		for _, s := range subs {
+			pushSubscriberEvent(webhooks.EventSubscriberDeleted, s, app)
+		}
+	}
+
+	if num > 0 {
+		app.log.Printf("deleted %d subscriber(s) (source: %s, history: %s)", num, source, history)
+	}
+	return num, nil
+}
+
+// deleteSubscriberBatch deletes a batch of subscribers in a transaction.
+func deleteSubscriberBatch(IDs []int64, source, history string, app *App) (int, error) {
+	tx, err := app.db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// The views, clicks, and conversions are otherwise anonymized
+	// by their foreign keys.
+	if history == delHistoryDelete {
+		if _, err := tx.Stmtx(app.queries.DeleteSubscriberHistory).Exec(pq.Int64Array(IDs)); err != nil {
+			return 0, err
+		}
+	}
+
+	var deleted []string
+	if err := tx.Stmtx(app.queries.DeleteSubscribers).Select(&deleted,
+		pq.Int64Array(IDs), source, history); err != nil {
+		return 0, err
+	}
+
+	return len(deleted), tx.Commit()
+}
+
 // handleBlacklistSubscribersByQuery bulk blacklists subscribers
 // based on an arbitrary SQL expression.
 func handleBlacklistSubscribersByQuery(c echo.Context) error {
@@ -419,7 +694,8 @@ func handleBlacklistSubscribersByQuery(c echo.Context) error {
 		return err
 	}
 
-	err := app.queries.execSubscriberQueryTpl(sanitizeSQLExp(req.Query),
+	var blacklisted []int64
+	err := app.queries.selectSubscriberQueryTpl(&blacklisted, sanitizeSQLExp(req.Query),
 		app.queries.BlacklistSubscribersByQuery,
 		req.ListIDs, app.db)
 	if err != nil {
@@ -427,6 +703,7 @@ func handleBlacklistSubscribersByQuery(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Error: %v", err))
 	}
+	onStatusTransition(webhooks.EventSubscriberBlacklisted, blacklisted, nil, app)
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
@@ -459,17 +736,59 @@ func handleManageSubscriberListsByQuery(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Invalid action.")
 	}
 
-	err := app.queries.execSubscriberQueryTpl(sanitizeSQLExp(req.Query),
-		stmt, req.ListIDs, app.db, req.TargetListIDs)
+	var (
+		unsubscribed []int64
+		err          error
+	)
+	if req.Action == "unsubscribe" {
+		err = app.queries.selectSubscriberQueryTpl(&unsubscribed, sanitizeSQLExp(req.Query),
+			stmt, req.ListIDs, app.db, req.TargetListIDs)
+	} else {
+		err = app.queries.execSubscriberQueryTpl(sanitizeSQLExp(req.Query),
+			stmt, req.ListIDs, app.db, req.TargetListIDs)
+	}
 	if err != nil {
 		app.log.Printf("error updating subscriptions: %v", err)
 		return echo.NewHTTPError(http.StatusBadRequest,
 			fmt.Sprintf("Error: %v", err))
 	}
+	onStatusTransition(webhooks.EventSubscriberUnsubscribed, unsubscribed, nil, app)
 
 	return c.JSON(http.StatusOK, okResp{true})
 }
 
+// handleGetSubscriberActivity handles the retrieval of a subscriber's
+// activity timeline.
+func handleGetSubscriberActivity(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		pg    = getPagination(c.QueryParams())
+		out   subActivityWrap
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetSubscriberActivity.Select(&out.Results, id, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching subscriber activity: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching subscriber activity: %s", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []subActivity{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
 // handleExportSubscriberData pulls the subscriber's profile,
 // list subscriptions, campaign views and clicks and produces
 // a JSON report. This is a privacy feature and depends on the
@@ -499,8 +818,9 @@ func handleExportSubscriberData(c echo.Context) error {
 	return c.Blob(http.StatusOK, "application/json", b)
 }
 
-// insertSubscriber inserts a subscriber and returns the ID.
-func insertSubscriber(req subimporter.SubReq, app *App) (models.Subscriber, error) {
+// insertSubscriber inserts a subscriber and returns the ID. Its subscriptions
+// get the consent record, if it's set.
+func insertSubscriber(req subimporter.SubReq, consent subConsent, app *App) (models.Subscriber, error) {
 	uu, err := uuid.NewV4()
 	if err != nil {
 		return req.Subscriber, err
@@ -514,7 +834,10 @@ func insertSubscriber(req subimporter.SubReq, app *App) (models.Subscriber, erro
 		req.Status,
 		req.Attribs,
 		req.Lists,
-		req.ListUUIDs)
+		req.ListUUIDs,
+		consent.Source,
+		consent.IP,
+		consent.UserAgent)
 	if err != nil {
 		if pqErr, ok := err.(*pq.Error); ok && pqErr.Constraint == "subscribers_email_key" {
 			return req.Subscriber, echo.NewHTTPError(http.StatusBadRequest, "The e-mail already exists.")
@@ -525,6 +848,9 @@ func insertSubscriber(req subimporter.SubReq, app *App) (models.Subscriber, erro
 			fmt.Sprintf("Error inserting subscriber: %v", err))
 	}
 
+	// Apply list rules to the new subscriber.
+	applyListRules([]int64{int64(req.ID)}, nil, app)
+
 	// Fetch the subscriber's full data.
 	sub, err := getSubscriber(req.ID, app)
 	if err != nil {
@@ -533,9 +859,24 @@ func insertSubscriber(req subimporter.SubReq, app *App) (models.Subscriber, erro
 
 	// Send a confirmation e-mail (if there are any double opt-in lists).
 	_ = sendOptinConfirmation(sub, []int64(req.Lists), app)
+	pushSubscriberEvent(webhooks.EventSubscriberCreated, sub, app)
 	return sub, nil
 }
 
+// makeConsent returns the consent record of a public subscription request:
+// the page it was made from (the referer), the IP, and the user agent.
+func makeConsent(c echo.Context) subConsent {
+	source := c.Request().Referer()
+	if source == "" {
+		source = c.Request().URL.String()
+	}
+	return subConsent{
+		Source:    truncate(source, consentMaxLen),
+		IP:        c.RealIP(),
+		UserAgent: truncate(c.Request().UserAgent(), consentMaxLen),
+	}
+}
+
 // getSubscriber gets a single subscriber by ID.
 func getSubscriber(id int, app *App) (models.Subscriber, error) {
 	var (
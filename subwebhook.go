@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+// subWebhookMaxAge is the maximum age of the timestamp of a signed request
+// to the subscriber webhook. Older requests are rejected as replays.
+const subWebhookMaxAge = time.Minute * 5
+
+// subWebhookConf represents the inbound webhook that creates subscribers
+// from the JSON payloads of external systems.
+type subWebhookConf struct {
+	Secret string
+
+	// Lists are the UUIDs of the lists that subscribers are added to. If
+	// ListsPath is set, the payload picks from these lists instead.
+	Lists []string
+
+	// Paths are dot separated paths of the fields in the payload, eg:
+	// "data.contact.email". Attribs maps attribute names to paths.
+	EmailPath string
+	NamePath  string
+	ListsPath string
+	Attribs   map[string]string
+}
+
+// handleSubscriberWebhook handles a request from an external system with a
+// JSON payload that's mapped to a new subscriber. The request should be
+// signed (see webhooks.Sign) with the shared secret in the signature and
+// timestamp headers, or have the secret as the password of basic auth or as
+// the token param. Subscriptions to double opt-in lists are unconfirmed and
+// get confirmation e-mails, like on the public subscription form.
+func handleSubscriberWebhook(c echo.Context) error {
+	var (
+		app  = c.Get("app").(*App)
+		conf = app.subWebhook
+	)
+	if conf == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "The feature is not available.")
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, maxEventBodySize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Error reading request.")
+	}
+	if err := verifySubWebhook(c, conf.Secret, b); err != nil {
+		return err
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(b, &payload); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid JSON payload.")
+	}
+
+	req, err := mapSubWebhookPayload(payload, conf)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := subimporter.ValidateFields(req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if err := app.constants.Attribs.Normalize(req.Attribs); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	consent := subConsent{
+		Source:    "webhook",
+		IP:        c.RealIP(),
+		UserAgent: truncate(c.Request().UserAgent(), consentMaxLen),
+	}
+	if _, err := insertSubscriber(req, consent, app); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// verifySubWebhook checks the signature of a request to the subscriber
+// webhook, or its token if it isn't signed.
+func verifySubWebhook(c echo.Context, secret string, body []byte) error {
+	sig := c.Request().Header.Get(webhooks.HeaderSignature)
+	if sig == "" {
+		token := c.QueryParam("token")
+		if _, pwd, ok := c.Request().BasicAuth(); ok {
+			token = pwd
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return echo.NewHTTPError(http.StatusForbidden, "Invalid token.")
+		}
+		return nil
+	}
+
+	ts := c.Request().Header.Get(webhooks.HeaderTimestamp)
+	t, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid timestamp.")
+	}
+	if d := time.Since(time.Unix(t, 0)); d > subWebhookMaxAge || d < -subWebhookMaxAge {
+		return echo.NewHTTPError(http.StatusForbidden, "The timestamp has expired.")
+	}
+	if !hmac.Equal([]byte(strings.ToLower(sig)), []byte(webhooks.Sign(secret, ts, body))) {
+		return echo.NewHTTPError(http.StatusForbidden, "Invalid signature.")
+	}
+	return nil
+}
+
+// mapSubWebhookPayload maps the fields of a JSON payload to a subscriber.
+// The e-mail is required and the name, the attributes, and the lists are
+// optional. Lists in the payload that aren't in the webhook's lists are
+// ignored.
+func mapSubWebhookPayload(payload map[string]interface{}, conf *subWebhookConf) (subimporter.SubReq, error) {
+	var req subimporter.SubReq
+
+	email, ok := jsonPath(payload, conf.EmailPath).(string)
+	if !ok || strings.TrimSpace(email) == "" {
+		return req, fmt.Errorf("`%s` should be an e-mail", conf.EmailPath)
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(email))
+
+	if v := jsonPath(payload, conf.NamePath); v != nil {
+		name, ok := v.(string)
+		if !ok {
+			return req, fmt.Errorf("`%s` should be a string", conf.NamePath)
+		}
+		req.Name = strings.TrimSpace(name)
+	}
+	// If there's no name, use the name bit from the e-mail.
+	if req.Name == "" {
+		req.Name = strings.Split(req.Email, "@")[0]
+	}
+
+	req.Attribs = make(models.SubscriberAttribs, len(conf.Attribs))
+	for k, p := range conf.Attribs {
+		if v := jsonPath(payload, p); v != nil {
+			req.Attribs[k] = v
+		}
+	}
+
+	lists := conf.Lists
+	if conf.ListsPath != "" {
+		lists = nil
+		v := jsonPath(payload, conf.ListsPath)
+		if s, ok := v.(string); ok {
+			v = []interface{}{s}
+		}
+		vals, ok := v.([]interface{})
+		if v != nil && !ok {
+			return req, fmt.Errorf("`%s` should be a list of list UUIDs", conf.ListsPath)
+		}
+		for _, l := range vals {
+			u, ok := l.(string)
+			if !ok {
+				return req, fmt.Errorf("`%s` should be a list of list UUIDs", conf.ListsPath)
+			}
+			for _, c := range conf.Lists {
+				if strings.EqualFold(u, c) {
+					lists = append(lists, c)
+					break
+				}
+			}
+		}
+	}
+	if len(lists) == 0 {
+		return req, fmt.Errorf("no lists to subscribe to")
+	}
+
+	req.Status = models.SubscriberStatusEnabled
+	req.ListUUIDs = pq.StringArray(lists)
+	return req, nil
+}
+
+// jsonPath returns the value at a dot separated path in a decoded JSON
+// object, eg: "contact.emails.0", or nil if there isn't one.
+func jsonPath(obj map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+
+	var v interface{} = obj
+	for _, k := range strings.Split(path, ".") {
+		switch o := v.(type) {
+		case map[string]interface{}:
+			v = o[k]
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(o) {
+				return nil
+			}
+			v = o[i]
+		default:
+			return nil
+		}
+	}
+	return v
+}
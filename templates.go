@@ -8,6 +8,7 @@ import (
 	"regexp"
 	"strconv"
 
+	"github.com/gofrs/uuid"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
 )
@@ -108,7 +109,7 @@ func handlePreviewTemplate(c echo.Context) error {
 		Body:         dummyTpl,
 	}
 
-	if err := camp.CompileTemplate(app.manager.TemplateFuncs(&camp)); err != nil {
+	if err := app.manager.CompileTemplate(&camp); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Error compiling template: %v", err))
 	}
 
@@ -132,16 +133,27 @@ func handleCreateTemplate(c echo.Context) error {
 	if err := c.Bind(&o); err != nil {
 		return err
 	}
+	if o.Format == "" {
+		o.Format = models.TemplateFormatHTML
+	}
 
 	if err := validateTemplate(o); err != nil {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error generating UUID")
+	}
+
 	// Insert and read ID.
 	var newID int
 	if err := app.queries.CreateTemplate.Get(&newID,
 		o.Name,
-		o.Body); err != nil {
+		o.Body,
+		o.Format,
+		uu.String()); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error template user: %v", pqErrMsg(err)))
 	}
@@ -173,7 +185,7 @@ func handleUpdateTemplate(c echo.Context) error {
 	}
 
 	// TODO: PASSWORD HASHING.
-	res, err := app.queries.UpdateTemplate.Exec(o.ID, o.Name, o.Body)
+	res, err := app.queries.UpdateTemplate.Exec(o.ID, o.Name, o.Body, o.Format)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			fmt.Sprintf("Error updating template: %s", pqErrMsg(err)))
@@ -248,5 +260,9 @@ func validateTemplate(o models.Template) error {
 		return fmt.Errorf("template body should contain the %s placeholder exactly once", tplTag)
 	}
 
+	if o.Format != "" && o.Format != models.TemplateFormatHTML && o.Format != models.TemplateFormatPlain {
+		return errors.New("invalid `format`. Should be html or plain")
+	}
+
 	return nil
 }
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+const (
+	// tplBundleManifest is the file in template bundles that describes
+	// the templates in it.
+	tplBundleManifest = "manifest.json"
+
+	// tplBundleDir is the directory of the template bodies in bundles.
+	tplBundleDir = "templates"
+
+	// tplBundleMaxSize is the maximum size of an uploaded bundle and of
+	// each file in it.
+	tplBundleMaxSize = 10 << 20
+
+	// tplDiffMaxLines is the maximum number of lines of the bodies that
+	// are diffed in dry runs. Longer bodies are only reported as changed.
+	tplDiffMaxLines = 2000
+
+	// tplDiffContext is the number of unchanged lines around changes in diffs.
+	tplDiffContext = 2
+)
+
+// Actions of templates in bundle imports.
+const (
+	tplActionCreate    = "create"
+	tplActionUpdate    = "update"
+	tplActionUnchanged = "unchanged"
+	tplActionConflict  = "conflict"
+)
+
+var regexpSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// tplBundle represents the manifest of a template bundle, a ZIP file with
+// the manifest and the bodies of the templates in the templates directory,
+// which can be version controlled and imported back.
+type tplBundle struct {
+	Version    int              `json:"version"`
+	ExportedAt time.Time        `json:"exported_at"`
+	Templates  []tplBundleEntry `json:"templates"`
+}
+
+// tplBundleEntry represents a template in a bundle. UUID is the stable key
+// of the template and Hash, the hash of its name, format, and body when it
+// was exported, which detects changes made on the server since. Templates
+// with new UUIDs (and no hash) are created on import.
+type tplBundleEntry struct {
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	Format    string    `json:"format"`
+	IsDefault bool      `json:"is_default"`
+	File      string    `json:"file"`
+	Hash      string    `json:"hash"`
+	UpdatedAt null.Time `json:"updated_at"`
+
+	body string
+}
+
+// tplImportChange represents the change to a template in a bundle import.
+// Conflicts are templates that have been edited both on the server since
+// the export and in the bundle.
+type tplImportChange struct {
+	UUID   string   `json:"uuid"`
+	Name   string   `json:"name"`
+	Action string   `json:"action"`
+	Fields []string `json:"fields"`
+	Diff   string   `json:"diff,omitempty"`
+
+	id int
+}
+
+// tplImportResult represents the result of a bundle import or a dry run.
+type tplImportResult struct {
+	DryRun    bool              `json:"dry_run"`
+	Conflicts int               `json:"conflicts"`
+	Changes   []tplImportChange `json:"changes"`
+}
+
+// handleExportTemplates exports all the templates as a bundle.
+func handleExportTemplates(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, 0, false); err != nil {
+		app.log.Printf("error fetching templates: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching templates: %s", pqErrMsg(err)))
+	}
+
+	var (
+		buf   = &bytes.Buffer{}
+		zw    = zip.NewWriter(buf)
+		man   = tplBundle{Version: 1, ExportedAt: time.Now(), Templates: []tplBundleEntry{}}
+		files = make(map[string]bool, len(tpls))
+	)
+	for _, t := range tpls {
+		f := tplBundleFile(t, files)
+		w, err := zw.Create(f)
+		if err == nil {
+			_, err = io.WriteString(w, t.Body)
+		}
+		if err != nil {
+			app.log.Printf("error exporting templates: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError, "Error exporting templates.")
+		}
+
+		man.Templates = append(man.Templates, tplBundleEntry{
+			UUID:      t.UUID,
+			Name:      t.Name,
+			Format:    t.Format,
+			IsDefault: t.IsDefault,
+			File:      f,
+			Hash:      tplHash(t.Name, t.Format, t.Body),
+			UpdatedAt: t.UpdatedAt,
+		})
+	}
+
+	b, err := json.MarshalIndent(man, "", "  ")
+	if err == nil {
+		var w io.Writer
+		if w, err = zw.Create(tplBundleManifest); err == nil {
+			_, err = w.Write(b)
+		}
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		app.log.Printf("error exporting templates: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Error exporting templates.")
+	}
+
+	c.Response().Header().Set("Cache-Control", "no-cache")
+	c.Response().Header().Set("Content-Disposition", `attachment; filename="templates.zip"`)
+	return c.Blob(http.StatusOK, "application/zip", buf.Bytes())
+}
+
+// handleImportTemplates imports an uploaded template bundle, creating and
+// updating templates by their UUIDs. With `dry_run`, it only reports the
+// changes that an import would make with diffs of the bodies. An import with
+// conflicts is rejected unless `force` is set, in which case the bundle
+// overwrites the templates edited on the server. The default template isn't
+// changed by imports and templates that aren't in the bundle are retained.
+func handleImportTemplates(c echo.Context) error {
+	var (
+		app       = c.Get("app").(*App)
+		dryRun, _ = strconv.ParseBool(c.QueryParam("dry_run"))
+		force, _  = strconv.ParseBool(c.QueryParam("force"))
+	)
+
+	req := c.Request()
+	if req.ContentLength > tplBundleMaxSize+multipartOverhead {
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "The bundle is too big.")
+	}
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, tplBundleMaxSize+multipartOverhead)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid `file`: %v", err))
+	}
+	src, err := file.Open()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid `file`: %v", err))
+	}
+	defer src.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(src, tplBundleMaxSize))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid `file`: %v", err))
+	}
+	bundle, err := readTplBundle(b)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Invalid bundle: %v", err))
+	}
+
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, 0, false); err != nil {
+		app.log.Printf("error fetching templates: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching templates: %s", pqErrMsg(err)))
+	}
+
+	res := diffTplBundle(bundle, tpls, dryRun)
+	if dryRun {
+		return c.JSON(http.StatusOK, okResp{res})
+	}
+	if res.Conflicts > 0 && !force {
+		return echo.NewHTTPError(http.StatusConflict,
+			fmt.Sprintf("%d template(s) have been edited since the export. Run a dry run to see the changes or force the import.", res.Conflicts))
+	}
+
+	tx, err := app.db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		app.log.Printf("error importing templates: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error importing templates: %s", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	for i, ch := range res.Changes {
+		t := bundle.Templates[i]
+		switch ch.Action {
+		case tplActionCreate:
+			var id int
+			err = tx.Stmtx(app.queries.CreateTemplate).Get(&id, t.Name, t.body, t.Format, t.UUID)
+		case tplActionUpdate, tplActionConflict:
+			_, err = tx.Stmtx(app.queries.UpdateTemplate).Exec(ch.id, t.Name, t.body, t.Format)
+		}
+		if err != nil {
+			app.log.Printf("error importing template %s: %v", t.UUID, err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error importing template %s: %s", t.Name, pqErrMsg(err)))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		app.log.Printf("error importing templates: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error importing templates: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{res})
+}
+
+// readTplBundle reads and validates a ZIP template bundle.
+func readTplBundle(b []byte) (tplBundle, error) {
+	var out tplBundle
+
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return out, err
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[path.Clean(f.Name)] = f
+	}
+
+	mf, ok := files[tplBundleManifest]
+	if !ok {
+		return out, fmt.Errorf("%s not found", tplBundleManifest)
+	}
+	m, err := readZipFile(mf)
+	if err != nil {
+		return out, err
+	}
+	if err := json.Unmarshal(m, &out); err != nil {
+		return out, fmt.Errorf("invalid %s: %v", tplBundleManifest, err)
+	}
+	if out.Version != 1 {
+		return out, fmt.Errorf("unsupported bundle version %d", out.Version)
+	}
+
+	uuids := make(map[string]bool, len(out.Templates))
+	for i, t := range out.Templates {
+		if !reUUID.MatchString(t.UUID) {
+			return out, fmt.Errorf("template %d: invalid uuid '%s'", i+1, t.UUID)
+		}
+		t.UUID = strings.ToLower(t.UUID)
+		if uuids[t.UUID] {
+			return out, fmt.Errorf("template %d: duplicate uuid %s", i+1, t.UUID)
+		}
+		uuids[t.UUID] = true
+
+		f, ok := files[path.Clean(t.File)]
+		if !ok {
+			return out, fmt.Errorf("template %d: file '%s' not found", i+1, t.File)
+		}
+		body, err := readZipFile(f)
+		if err != nil {
+			return out, fmt.Errorf("template %d: %v", i+1, err)
+		}
+		t.body = string(body)
+
+		if t.Format == "" {
+			t.Format = models.TemplateFormatHTML
+		}
+		if err := validateTemplate(models.Template{Name: t.Name, Body: t.body, Format: t.Format}); err != nil {
+			return out, fmt.Errorf("template %d (%s): %v", i+1, t.Name, err)
+		}
+		out.Templates[i] = t
+	}
+	return out, nil
+}
+
+// readZipFile reads a file in a ZIP file up to the bundle size limit.
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(r, tplBundleMaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > tplBundleMaxSize {
+		return nil, fmt.Errorf("%s is too big", f.Name)
+	}
+	return b, nil
+}
+
+// diffTplBundle compares the templates in a bundle with the ones on the
+// server and returns the change to each of them, in order. Diffs of the
+// bodies are only made for dry runs.
+func diffTplBundle(b tplBundle, tpls []models.Template, withDiff bool) tplImportResult {
+	byUUID := make(map[string]models.Template, len(tpls))
+	for _, t := range tpls {
+		byUUID[strings.ToLower(t.UUID)] = t
+	}
+
+	out := tplImportResult{DryRun: withDiff, Changes: make([]tplImportChange, 0, len(b.Templates))}
+	for _, t := range b.Templates {
+		ch := tplImportChange{UUID: t.UUID, Name: t.Name, Fields: []string{}}
+
+		cur, ok := byUUID[t.UUID]
+		if !ok {
+			ch.Action = tplActionCreate
+			out.Changes = append(out.Changes, ch)
+			continue
+		}
+		ch.id = cur.ID
+
+		if cur.Name != t.Name {
+			ch.Fields = append(ch.Fields, "name")
+		}
+		if cur.Format != t.Format {
+			ch.Fields = append(ch.Fields, "format")
+		}
+		if cur.Body != t.body {
+			ch.Fields = append(ch.Fields, "body")
+			if withDiff {
+				ch.Diff = diffLines(cur.Body, t.body)
+			}
+		}
+
+		switch {
+		case len(ch.Fields) == 0:
+			ch.Action = tplActionUnchanged
+		case t.Hash != tplHash(cur.Name, cur.Format, cur.Body):
+			// The server's copy has changed since the export (or the
+			// template wasn't exported from this server).
+			ch.Action = tplActionConflict
+			out.Conflicts++
+		default:
+			ch.Action = tplActionUpdate
+		}
+		out.Changes = append(out.Changes, ch)
+	}
+	return out
+}
+
+// tplBundleFile returns the unique path of the body of a template in
+// a bundle, named after the template.
+func tplBundleFile(t models.Template, files map[string]bool) string {
+	ext := ".html"
+	if t.Format == models.TemplateFormatPlain {
+		ext = ".txt"
+	}
+
+	slug := strings.Trim(regexpSlug.ReplaceAllString(strings.ToLower(t.Name), "-"), "-")
+	if slug == "" {
+		slug = "template"
+	}
+
+	f := path.Join(tplBundleDir, slug+ext)
+	if files[f] {
+		f = path.Join(tplBundleDir, fmt.Sprintf("%s-%d%s", slug, t.ID, ext))
+	}
+	files[f] = true
+	return f
+}
+
+// tplHash returns the hex encoded SHA-256 hash of a template's content.
+func tplHash(name, format, body string) string {
+	h := sha256.New()
+	io.WriteString(h, name)
+	h.Write([]byte{0})
+	io.WriteString(h, format)
+	h.Write([]byte{0})
+	io.WriteString(h, body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// diffLines returns a line diff of two texts with the removed lines
+// prefixed with -, the added lines with +, and a few unchanged lines of
+// context around them. Hunks start with the line numbers in the old text.
+func diffLines(a, b string) string {
+	var (
+		al = strings.Split(a, "\n")
+		bl = strings.Split(b, "\n")
+	)
+	if len(al) > tplDiffMaxLines || len(bl) > tplDiffMaxLines {
+		return ""
+	}
+
+	// Lengths of the longest common subsequences of the suffixes.
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// Walk the table into an edit script of (op, old line number, text).
+	type edit struct {
+		op   byte
+		line int
+		text string
+	}
+	var (
+		eds  []edit
+		i, j int
+	)
+	for i < len(al) || j < len(bl) {
+		switch {
+		case i < len(al) && j < len(bl) && al[i] == bl[j]:
+			eds = append(eds, edit{' ', i + 1, al[i]})
+			i++
+			j++
+		case i < len(al) && (j == len(bl) || lcs[i+1][j] >= lcs[i][j+1]):
+			eds = append(eds, edit{'-', i + 1, al[i]})
+			i++
+		default:
+			eds = append(eds, edit{'+', i + 1, bl[j]})
+			j++
+		}
+	}
+
+	// Print the changes with their context.
+	var (
+		out  strings.Builder
+		last = -1
+	)
+	for n, e := range eds {
+		if e.op == ' ' {
+			continue
+		}
+		start := n - tplDiffContext
+		if last >= 0 && start <= last {
+			start = last + 1
+		} else {
+			if start < 0 {
+				start = 0
+			}
+			fmt.Fprintf(&out, "@@ line %d\n", eds[start].line)
+		}
+		end := n
+		for k := n + 1; k < len(eds) && k <= n+tplDiffContext; k++ {
+			if eds[k].op != ' ' {
+				break
+			}
+			end = k
+		}
+		for k := start; k <= end; k++ {
+			out.WriteByte(eds[k].op)
+			out.WriteString(eds[k].text)
+			out.WriteByte('\n')
+		}
+		last = end
+	}
+	return out.String()
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx/types"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// trackingSource is the source of the tracking events that are recorded by
+// the view tracking pixel and the link redirects. Events reported by the
+// e-mail provider have the provider's name.
+const trackingSource = "tracking"
+
+// trackingEvent is the payload of the webhooks of campaign views and link
+// clicks. The subscriber fields are null if the subscriber has been deleted
+// and the link fields are empty for views.
+type trackingEvent struct {
+	CampaignID       int            `db:"campaign_id" json:"campaign_id"`
+	CampaignUUID     string         `db:"campaign_uuid" json:"campaign_uuid"`
+	CampaignName     string         `db:"campaign_name" json:"campaign_name"`
+	CampaignMetadata types.JSONText `db:"campaign_metadata" json:"campaign_metadata"`
+
+	SubscriberID      null.Int       `db:"subscriber_id" json:"subscriber_id"`
+	SubscriberUUID    null.String    `db:"subscriber_uuid" json:"subscriber_uuid"`
+	SubscriberEmail   null.String    `db:"subscriber_email" json:"subscriber_email"`
+	SubscriberName    null.String    `db:"subscriber_name" json:"subscriber_name"`
+	SubscriberAttribs types.JSONText `db:"subscriber_attribs" json:"subscriber_attribs"`
+
+	LinkID  null.Int `db:"link_id" json:"link_id"`
+	LinkURL string   `db:"link_url" json:"link_url"`
+
+	Source string `db:"-" json:"source"`
+}
+
+// pushTrackingEvent queues the webhook of a campaign view or a link click
+// with the context of its campaign, subscriber, and link (by its UUID or,
+// for clicks reported by the e-mail provider, its URL). The context is only
+// fetched if there are endpoints subscribed to the event.
+func pushTrackingEvent(event, campUUID, subUUID, linkUUID, url, source string, app *App) {
+	if app.constants.Privacy.DisableTracking || !app.webhooks.Has(event) {
+		return
+	}
+
+	var e trackingEvent
+	if err := app.queries.GetTrackingEvent.Get(&e, campUUID, subUUID, linkUUID); err != nil {
+		app.log.Printf("error fetching tracking event for webhook '%s': %v", event, err)
+		return
+	}
+	if e.LinkURL == "" {
+		e.LinkURL = url
+	}
+	e.Source = source
+
+	if err := app.webhooks.Push(event, e); err != nil {
+		app.log.Printf("error queuing webhook '%s': %v", event, err)
+	}
+}
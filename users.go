@@ -0,0 +1,196 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/subimporter"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password lengths. bcrypt ignores the bytes beyond 72.
+const (
+	userPasswordMinLen = 8
+	userPasswordMaxLen = 72
+)
+
+// userReq represents a user create / update request.
+type userReq struct {
+	models.User
+
+	Password string `json:"password"`
+}
+
+// handleGetUsers handles retrieval of users.
+func handleGetUsers(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		out   []models.User
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if err := app.queries.GetUsers.Select(&out, id); err != nil {
+		app.log.Printf("error fetching users: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching users: %s", pqErrMsg(err)))
+	}
+	if id > 0 {
+		if len(out) == 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "User not found.")
+		}
+		return c.JSON(http.StatusOK, okResp{out[0]})
+	}
+	if len(out) == 0 {
+		return c.JSON(http.StatusOK, okResp{[]struct{}{}})
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetProfile returns the user making the request.
+func handleGetProfile(c echo.Context) error {
+	return c.JSON(http.StatusOK, okResp{c.Get("user").(models.User)})
+}
+
+// handleCreateUser handles user creation.
+func handleCreateUser(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req userReq
+	)
+
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if req.Status == "" {
+		req.Status = models.UserStatusEnabled
+	}
+	if req.Email == "" || req.Name == "" || req.Role == "" || req.Password == "" {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"`email`, `name`, `role`, and `password` are required.")
+	}
+
+	pwd, err := validateUserReq(&req)
+	if err != nil {
+		return err
+	}
+
+	var newID int
+	if err := app.queries.CreateUser.Get(&newID,
+		req.Email, req.Name, pwd, req.Role, req.Status); err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Constraint == "idx_users_email" {
+			return echo.NewHTTPError(http.StatusBadRequest, "The e-mail already exists.")
+		}
+		app.log.Printf("error creating user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error creating user: %s", pqErrMsg(err)))
+	}
+
+	// Hand over to the GET handler to return the last insertion.
+	c.SetParamNames("id")
+	c.SetParamValues(fmt.Sprintf("%d", newID))
+	return handleGetUsers(c)
+}
+
+// handleUpdateUser handles user modification. The password is only
+// changed if it's set.
+func handleUpdateUser(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   userReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+
+	pwd, err := validateUserReq(&req)
+	if err != nil {
+		return err
+	}
+
+	res, err := app.queries.UpdateUser.Exec(id, req.Email, req.Name, pwd, req.Role, req.Status)
+	if err != nil {
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Constraint == "idx_users_email" {
+			return echo.NewHTTPError(http.StatusBadRequest, "The e-mail already exists.")
+		}
+		app.log.Printf("error updating user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating user: %s", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"User not found, or it's the last admin that can't be demoted or disabled.")
+	}
+	authUsers.reset()
+
+	return handleGetUsers(c)
+}
+
+// handleDeleteUser handles user deletion.
+func handleDeleteUser(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	res, err := app.queries.DeleteUser.Exec(id)
+	if err != nil {
+		app.log.Printf("error deleting user: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error deleting user: %s", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			"User not found, or it's the last admin that can't be deleted.")
+	}
+	authUsers.reset()
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateUserReq validates the fields of a user request, where empty
+// fields are left unchanged on updates, and returns the hash of the
+// password if it's set.
+func validateUserReq(req *userReq) (string, error) {
+	req.Email = strings.TrimSpace(req.Email)
+	if req.Email != "" && (!strHasLen(req.Email, 1, stdInputMaxLen) || !subimporter.IsEmail(req.Email)) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid `email`.")
+	}
+	if req.Name != "" && !strHasLen(req.Name, 1, stdInputMaxLen) {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid length for `name`.")
+	}
+	if req.Role != "" && rolePerms[req.Role] == nil {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid `role`.")
+	}
+	if req.Status != "" && req.Status != models.UserStatusEnabled && req.Status != models.UserStatusDisabled {
+		return "", echo.NewHTTPError(http.StatusBadRequest, "Invalid `status`.")
+	}
+	if req.Password == "" {
+		return "", nil
+	}
+
+	if !strHasLen(req.Password, userPasswordMinLen, userPasswordMaxLen) {
+		return "", echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("`password` should be %d to %d characters.", userPasswordMinLen, userPasswordMaxLen))
+	}
+	h, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error hashing password: %v", err))
+	}
+	return string(h), nil
+}
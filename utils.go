@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"fmt"
+	"net/url"
 	"regexp"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/lib/pq"
 )
@@ -19,7 +22,8 @@ var (
 )
 
 // validateMIME is a helper function to validate uploaded file's MIME type
-// against the slice of MIME types is given.
+// (or extension) against the slice of MIME types is given. An empty slice
+// allows all types.
 func validateMIME(typ string, mimes []string) (ok bool) {
 	if len(mimes) > 0 {
 		var (
@@ -132,3 +136,43 @@ func generateRandomString(n int) (string, error) {
 func strHasLen(str string, min, max int) bool {
 	return len(str) >= min && len(str) <= max
 }
+
+// truncate returns the first n bytes of a string without splitting
+// a multi-byte character.
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// parseTrackingDomain parses a tracking domain from the config that's either
+// a hostname or a URL and returns the lowercased hostname and the base URL.
+// If there's no scheme, the scheme of the root URL is used.
+func parseTrackingDomain(d, rootURL string) (string, string, error) {
+	d = strings.TrimRight(strings.TrimSpace(d), "/")
+	if !strings.Contains(d, "://") {
+		scheme := "https"
+		if r, err := url.Parse(rootURL); err == nil && r.Scheme != "" {
+			scheme = r.Scheme
+		}
+		d = scheme + "://" + d
+	}
+
+	u, err := url.Parse(d)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Host == "" {
+		return "", "", errors.New("no hostname")
+	}
+	if u.Path != "" || u.RawQuery != "" {
+		return "", "", errors.New("tracking domain should not have a path")
+	}
+
+	host := strings.ToLower(u.Host)
+	return host, u.Scheme + "://" + host, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// pushSubscriberEvent queues a subscriber lifecycle webhook event
+// for the given subscriber.
+func pushSubscriberEvent(event string, sub models.Subscriber, app *App) {
+	if err := app.webhooks.Push(event, sub); err != nil {
+		app.log.Printf("error queuing webhook '%s': %v", event, err)
+	}
+}
+
+// pushSubscriberEventByIDs fetches subscribers by their IDs or UUIDs
+// and queues a subscriber lifecycle webhook event for each of them. The
+// subscribers are only fetched if there are endpoints subscribed to the event.
+func pushSubscriberEventByIDs(event string, ids []int64, uuids []string, app *App) {
+	if !app.webhooks.Has(event) {
+		return
+	}
+
+	var subs models.Subscribers
+	if err := app.queries.GetSubscribersByIDs.Select(&subs,
+		pq.Int64Array(ids), pq.StringArray(uuids)); err != nil {
+		app.log.Printf("error fetching subscribers for webhook '%s': %v", event, err)
+		return
+	}
+	if len(subs) == 0 {
+		return
+	}
+	if err := subs.LoadLists(app.queries.GetSubscriberListsLazy); err != nil {
+		app.log.Printf("error loading subscriber lists for webhook '%s': %v", event, err)
+		return
+	}
+
+	for _, s := range subs {
+		pushSubscriberEvent(event, s, app)
+	}
+}
+
+// webhookDeadLetter represents an outbound webhook delivery that exhausted
+// its retries. CreatedAt is when the event was first queued.
+type webhookDeadLetter struct {
+	ID        int64          `db:"id" json:"id"`
+	Endpoint  string         `db:"endpoint" json:"endpoint"`
+	Event     string         `db:"event" json:"event"`
+	Body      types.JSONText `db:"body" json:"body"`
+	Attempts  int            `db:"attempts" json:"attempts"`
+	LastError string         `db:"last_error" json:"last_error"`
+	CreatedAt null.Time      `db:"created_at" json:"created_at"`
+	FailedAt  null.Time      `db:"failed_at" json:"failed_at"`
+
+	// Pseudofield for getting the total number of dead-letters in queries.
+	Total int `db:"total" json:"-"`
+}
+
+type deadLettersWrap struct {
+	Results []webhookDeadLetter `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// handleGetWebhookDeadLetters retrieves paginated dead-lettered webhook
+// deliveries optionally filtered by endpoint and event.
+func handleGetWebhookDeadLetters(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = getPagination(c.QueryParams())
+		out deadLettersWrap
+	)
+
+	if err := app.queries.QueryWebhookDeadLetters.Select(&out.Results,
+		c.QueryParam("endpoint"), c.QueryParam("event"), pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching webhook dead-letters: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching webhook dead-letters: %s", pqErrMsg(err)))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []webhookDeadLetter{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleGetWebhookDeadLetter retrieves a single dead-lettered webhook delivery.
+func handleGetWebhookDeadLetter(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.ParseInt(c.Param("id"), 10, 64)
+		out   webhookDeadLetter
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetWebhookDeadLetter.Get(&out, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest, "Dead-letter not found.")
+		}
+		app.log.Printf("error fetching webhook dead-letter: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching webhook dead-letter: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleReplayWebhookDeadLetters queues one (/:id) or more (?id=) dead-lettered
+// webhook deliveries for delivery again with their retries reset.
+func handleReplayWebhookDeadLetters(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	ids, err := getDeadLetterIDs(c)
+	if err != nil {
+		return err
+	}
+
+	var out []int64
+	if err := app.queries.ReplayWebhookDeadLetters.Select(&out, pq.Int64Array(ids)); err != nil {
+		app.log.Printf("error replaying webhook dead-letters: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error replaying webhook dead-letters: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{len(out)})
+}
+
+// handleDeleteWebhookDeadLetters deletes one (/:id) or more (?id=)
+// dead-lettered webhook deliveries.
+func handleDeleteWebhookDeadLetters(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	ids, err := getDeadLetterIDs(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := app.queries.DeleteWebhookDeadLetters.Exec(pq.Int64Array(ids)); err != nil {
+		app.log.Printf("error deleting webhook dead-letters: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error deleting webhook dead-letters: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// getDeadLetterIDs returns the dead-letter ID in the path, or the IDs in the
+// id query params.
+func getDeadLetterIDs(c echo.Context) ([]int64, error) {
+	if p := c.Param("id"); p != "" {
+		id, _ := strconv.ParseInt(p, 10, 64)
+		if id < 1 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+		}
+		return []int64{id}, nil
+	}
+
+	ids, err := parseStringIDs(c.Request().URL.Query()["id"])
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("One or more invalid IDs given: %v", err))
+	}
+	if len(ids) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "No IDs given.")
+	}
+	return ids, nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/internal/webhooks"
+	"github.com/lib/pq"
+)
+
+// webhooksDB implements webhooks.Store over the primary database.
+type webhooksDB struct {
+	queries *Queries
+}
+
+// QueueDeliveries inserts the deliveries of an event to endpoints.
+func (w *webhooksDB) QueueDeliveries(endpoints []string, event string, body []byte) error {
+	_, err := w.queries.QueueWebhookDeliveries.Exec(pq.StringArray(endpoints), event, string(body))
+	return err
+}
+
+// ClaimDeliveries defers the due deliveries of endpoints by a lease and
+// returns them.
+func (w *webhooksDB) ClaimDeliveries(endpoints []string, limit int, lease time.Duration) ([]webhooks.Delivery, error) {
+	var out []webhooks.Delivery
+	err := w.queries.ClaimWebhookDeliveries.Select(&out, pq.StringArray(endpoints), limit, lease.Seconds())
+	return out, err
+}
+
+// DeleteDelivery deletes a delivered delivery.
+func (w *webhooksDB) DeleteDelivery(id int64) error {
+	_, err := w.queries.DeleteWebhookDelivery.Exec(id)
+	return err
+}
+
+// RetryDelivery records a failed attempt of a delivery and when it's due again.
+func (w *webhooksDB) RetryDelivery(id int64, attempts int, errMsg string, wait time.Duration) error {
+	_, err := w.queries.RetryWebhookDelivery.Exec(id, attempts, errMsg, wait.Seconds())
+	return err
+}
+
+// DeadLetter moves a delivery to the dead-letters.
+func (w *webhooksDB) DeadLetter(id int64, attempts int, errMsg string) error {
+	_, err := w.queries.DeadLetterWebhookDelivery.Exec(id, attempts, errMsg)
+	return err
+}
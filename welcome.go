@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	// welcomeMaxSteps is the maximum number of steps in the welcome
+	// sequence of a list.
+	welcomeMaxSteps = 20
+
+	// welcomeInterval is the interval at which due welcome messages are
+	// sent, in batches of welcomeBatchSize.
+	welcomeInterval  = time.Second * 30
+	welcomeBatchSize = 1000
+
+	// welcomeLease is the time (in seconds) for which the due messages of a
+	// batch are leased to be sent. Messages that couldn't be sent are sent
+	// again when their leases are up, up to welcomeMaxAttempts times.
+	welcomeLease       = 600
+	welcomeMaxAttempts = 3
+)
+
+// errStepCampaign is the error of the steps of automations whose campaigns
+// couldn't be loaded, which is logged when they're loaded.
+var errStepCampaign = errors.New("the campaign of the step couldn't be loaded")
+
+// welcomeReq represents a request to replace the welcome sequence of a list.
+type welcomeReq struct {
+	Steps []models.WelcomeStep `json:"steps"`
+}
+
+// welcomeMessage represents a welcome message that's due to a subscriber.
+type welcomeMessage struct {
+	models.Subscriber
+
+	QueueID        int64  `db:"queue_id"`
+	Attempts       int    `db:"attempts"`
+	StepID         int    `db:"step_id"`
+	CampaignID     int    `db:"step_campaign_id"`
+	Subject        string `db:"step_subject"`
+	Body           string `db:"step_body"`
+	ListUUID       string `db:"list_uuid"`
+	ListMessenger  string `db:"list_messenger"`
+	TemplateBody   string `db:"template_body"`
+	TemplateFormat string `db:"template_format"`
+	Eligible       bool   `db:"eligible"`
+}
+
+// handleGetWelcomeSteps returns the welcome sequence of a list.
+func handleGetWelcomeSteps(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		out   = []models.WelcomeStep{}
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+
+	if err := app.queries.GetWelcomeSteps.Select(&out, id); err != nil {
+		app.log.Printf("error fetching welcome steps: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error fetching welcome steps: %s", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleUpdateWelcomeSteps replaces the welcome sequence of a list with the
+// steps in the request, in their order. The messages of the previous steps
+// that are yet to be sent are dropped. An empty sequence disables welcome
+// messages on the list.
+func handleUpdateWelcomeSteps(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		req   welcomeReq
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid ID.")
+	}
+	if err := c.Bind(&req); err != nil {
+		return err
+	}
+	if len(req.Steps) > welcomeMaxSteps {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			fmt.Sprintf("A list can have up to %d welcome steps.", welcomeMaxSteps))
+	}
+	for i, s := range req.Steps {
+		if err := validateWelcomeStep(s, app); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Step %d: %v", i+1, err))
+		}
+	}
+
+	tx, err := app.db.BeginTxx(context.Background(), nil)
+	if err != nil {
+		app.log.Printf("error updating welcome steps: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating welcome steps: %s", pqErrMsg(err)))
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Stmtx(app.queries.DeleteWelcomeSteps).Exec(id); err != nil {
+		app.log.Printf("error deleting welcome steps: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating welcome steps: %s", pqErrMsg(err)))
+	}
+	for i, s := range req.Steps {
+		if _, err := tx.Stmtx(app.queries.InsertWelcomeStep).Exec(id, i+1,
+			s.TemplateID, s.Subject, s.Body, s.Delay, s.CampaignID); err != nil {
+			if pqErr, ok := err.(*pq.Error); ok && pqErr.Code.Name() == "foreign_key_violation" {
+				return echo.NewHTTPError(http.StatusBadRequest, "Unknown list, template, or campaign.")
+			}
+			app.log.Printf("error inserting welcome step: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				fmt.Sprintf("Error updating welcome steps: %s", pqErrMsg(err)))
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		app.log.Printf("error updating welcome steps: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			fmt.Sprintf("Error updating welcome steps: %s", pqErrMsg(err)))
+	}
+
+	return handleGetWelcomeSteps(c)
+}
+
+// validateWelcomeStep validates a welcome step and compiles its subject and
+// body to check their template expressions. Steps that send campaigns don't
+// have their own subjects and bodies.
+func validateWelcomeStep(s models.WelcomeStep, app *App) error {
+	if s.Delay < 0 {
+		return fmt.Errorf("`delay` can't be negative")
+	}
+	if s.CampaignID > 0 {
+		if s.Subject != "" || s.Body != "" {
+			return fmt.Errorf("steps with a `campaign_id` can't have a `subject` or a `body`")
+		}
+		return nil
+	}
+
+	if !strHasLen(s.Subject, 1, stdInputMaxLen) {
+		return fmt.Errorf("invalid length for `subject`")
+	}
+	if s.Body == "" {
+		return fmt.Errorf("`body` is required")
+	}
+
+	camp := models.Campaign{
+		Subject:      s.Subject,
+		Body:         s.Body,
+		TemplateBody: tplTag,
+	}
+	if err := app.manager.CompileTemplate(&camp); err != nil {
+		return err
+	}
+	return nil
+}
+
+// runWelcomeMessages is a blocking function that periodically sends the
+// welcome messages that are due through the pipeline of campaign messages.
+// Steps with their own content aren't campaigns and their views and clicks
+// aren't tracked. Their unsubscribe links unsubscribe from their lists.
+// The views and clicks of the steps that send campaigns are tracked against
+// the campaigns.
+func runWelcomeMessages(app *App) {
+	for {
+		for {
+			n, err := sendWelcomeMessages(app)
+			if err != nil {
+				app.log.Printf("error sending welcome messages: %v", err)
+			}
+			if err != nil || n < welcomeBatchSize {
+				break
+			}
+		}
+		time.Sleep(welcomeInterval)
+	}
+}
+
+// sendWelcomeMessages leases a batch of due welcome messages, sends them,
+// and drops the ones that are sent or are no longer due to their subscribers.
+// It returns the number of messages in the batch.
+func sendWelcomeMessages(app *App) (int, error) {
+	var msgs []welcomeMessage
+	if err := app.queries.NextWelcomeMessages.Select(&msgs, welcomeBatchSize, welcomeLease); err != nil {
+		return 0, err
+	}
+
+	// Compile each step once per batch.
+	var (
+		camps = make(map[int]*models.Campaign)
+		done  = make(pq.Int64Array, 0, len(msgs))
+	)
+	for _, w := range msgs {
+		if !w.Eligible {
+			done = append(done, w.QueueID)
+			continue
+		}
+
+		camp, ok := camps[w.StepID]
+		if !ok {
+			camp = welcomeCampaign(w, app)
+			camps[w.StepID] = camp
+		}
+
+		err := errStepCampaign
+		if camp != nil {
+			err = sendCampaignStep(camp, w.Subscriber, app)
+		}
+		if err != nil {
+			app.log.Printf("error sending welcome step %d to subscriber %d: %v", w.StepID, w.ID, err)
+			if w.Attempts < welcomeMaxAttempts {
+				continue
+			}
+		}
+		done = append(done, w.QueueID)
+	}
+
+	if len(done) > 0 {
+		if _, err := app.queries.DeleteWelcomeMessages.Exec(done); err != nil {
+			return len(msgs), err
+		}
+	}
+	return len(msgs), nil
+}
+
+// welcomeCampaign returns the compiled campaign that a welcome step is sent
+// as, which is the step's campaign, or for the steps with their own content,
+// a campaign of the list that isn't in the database. It returns nil if the
+// campaign couldn't be loaded.
+func welcomeCampaign(w welcomeMessage, app *App) *models.Campaign {
+	if w.CampaignID > 0 {
+		return loadStepCampaign(w.CampaignID, app)
+	}
+
+	camp := &models.Campaign{
+		UUID:           w.ListUUID,
+		Subject:        w.Subject,
+		Body:           w.Body,
+		FromEmail:      app.constants.FromEmail,
+		MessengerID:    w.ListMessenger,
+		TemplateBody:   w.TemplateBody,
+		TemplateFormat: w.TemplateFormat,
+	}
+	if camp.MessengerID == "" {
+		camp.MessengerID = app.constants.DefMessenger
+	}
+	if err := app.manager.CompileTemplate(camp); err != nil {
+		app.log.Printf("error compiling welcome step %d: %v", w.StepID, err)
+		return nil
+	}
+	return camp
+}
+
+// loadStepCampaign fetches and compiles the campaign of a step of an
+// automation (welcome steps and sequences), which needn't be (and usually
+// isn't) started. It returns nil if the campaign couldn't be loaded.
+func loadStepCampaign(id int, app *App) *models.Campaign {
+	camp := &models.Campaign{}
+	if err := app.queries.GetCampaign.Get(camp, id, nil); err != nil {
+		if err != sql.ErrNoRows {
+			app.log.Printf("error fetching campaign %d: %v", id, err)
+		}
+		return nil
+	}
+	if camp.MessengerID == "" {
+		camp.MessengerID = app.constants.DefMessenger
+	}
+	if err := app.manager.CompileTemplate(camp); err != nil {
+		app.log.Printf("error compiling campaign %d: %v", id, err)
+		return nil
+	}
+	return camp
+}
+
+// sendCampaignStep renders a campaign of a step of an automation for a
+// subscriber and sends it through the pipeline of campaign messages, with
+// the campaign's headers, transforms, domain limits, and delivery records.
+func sendCampaignStep(camp *models.Campaign, sub models.Subscriber, app *App) error {
+	msg := app.manager.NewCampaignMessage(camp, sub)
+	if err := msg.Render(); err != nil {
+		return fmt.Errorf("error rendering message: %v", err)
+	}
+	return app.manager.PushCampaignMessage(msg)
+}
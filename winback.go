@@ -0,0 +1,117 @@
+package main
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/models"
+)
+
+const (
+	// winbackMaxDays is the maximum win-back grace period of lists.
+	winbackMaxDays = 365
+
+	// winbackInterval is the interval at which due win-back messages are
+	// sent, in batches of winbackBatchSize, and expired grace periods are
+	// removed.
+	winbackInterval  = time.Minute
+	winbackBatchSize = 1000
+)
+
+// winbackMessage represents a win-back message that's due to a subscriber
+// whose unsubscription from a list is paused.
+type winbackMessage struct {
+	models.Subscriber
+
+	ListID         int    `db:"list_id"`
+	ListUUID       string `db:"list_uuid"`
+	Subject        string `db:"winback_subject"`
+	Body           string `db:"winback_body"`
+	TemplateBody   string `db:"template_body"`
+	TemplateFormat string `db:"template_format"`
+}
+
+// runWinbacks is a blocking function that periodically sends the win-back
+// messages of paused unsubscriptions that are due over the transactional
+// send path, and removes the paused unsubscriptions whose grace periods
+// have passed. Like welcome messages, win-back messages aren't campaigns and
+// their unsubscribe links unsubscribe from their lists.
+func runWinbacks(app *App) {
+	for {
+		for {
+			n, err := sendWinbackMessages(app)
+			if err != nil {
+				app.log.Printf("error sending win-back messages: %v", err)
+			}
+			if err != nil || n < winbackBatchSize {
+				break
+			}
+		}
+
+		if _, err := app.queries.DeleteExpiredWinbacks.Exec(); err != nil {
+			app.log.Printf("error removing expired win-backs: %v", err)
+		}
+		time.Sleep(winbackInterval)
+	}
+}
+
+// sendWinbackMessages marks a batch of due win-back messages as sent and
+// sends them. It returns the number of messages in the batch.
+func sendWinbackMessages(app *App) (int, error) {
+	var msgs []winbackMessage
+	if err := app.queries.NextWinbackMessages.Select(&msgs, winbackBatchSize); err != nil {
+		return 0, err
+	}
+
+	// Compile each list's message once per batch.
+	camps := make(map[int]*models.Campaign)
+	for _, w := range msgs {
+		camp, ok := camps[w.ListID]
+		if !ok {
+			camp = &models.Campaign{
+				UUID:           w.ListUUID,
+				Subject:        w.Subject,
+				Body:           w.Body,
+				FromEmail:      app.constants.FromEmail,
+				TemplateBody:   w.TemplateBody,
+				TemplateFormat: w.TemplateFormat,
+			}
+			if err := app.manager.CompileTemplate(camp); err != nil {
+				app.log.Printf("error compiling win-back message of list %d: %v", w.ListID, err)
+				camp = nil
+			}
+			camps[w.ListID] = camp
+		}
+		if camp == nil {
+			continue
+		}
+
+		msg := app.manager.NewCampaignMessage(camp, w.Subscriber)
+		if err := msg.Render(); err != nil {
+			app.log.Printf("error rendering win-back message of list %d for subscriber %d: %v", w.ListID, w.ID, err)
+			continue
+		}
+		if err := app.manager.PushMessage(manager.Message{
+			From:      msg.From(),
+			To:        []string{w.Email},
+			Subject:   msg.Subject(),
+			Body:      msg.Body(),
+			Messenger: "email",
+		}); err != nil {
+			app.log.Printf("error sending win-back message of list %d to subscriber %d: %v", w.ListID, w.ID, err)
+		}
+	}
+	return len(msgs), nil
+}
+
+// reengageWinbacks cancels the removal of the paused unsubscriptions of a
+// subscriber who viewed or clicked on a message, restoring them.
+func reengageWinbacks(subUUID string, app *App) {
+	if subUUID == dummyUUID {
+		return
+	}
+
+	if _, err := app.queries.ReengageWinbacks.Exec(subUUID); err != nil {
+		app.log.Printf("error re-engaging win-backs: %v", err)
+	}
+}